@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+// requireAdmin allows a request through to next only if it carries the admin
+// token as a bearer token.
+func (s *Server) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeError(w, http.StatusUnauthorized, codeUnauthorized, "A valid admin token is required")
+			return
+		}
+		requestInfoFrom(r.Context()).client = "admin"
+		next.ServeHTTP(w, r)
+	})
+}
+
+// recalculateSummary is the response to POST /admin/recalculate.
+type recalculateSummary struct {
+	Receipts   int   `json:"receipts"`
+	Changed    int   `json:"changed"`
+	DurationMS int64 `json:"durationMs"`
+
+	// Failed counts the receipts left as they were because rescoring them
+	// panicked.
+	Failed int `json:"failed,omitempty"`
+	// Compacted counts the receipts left as they were because their items
+	// were dropped by compaction, so they cannot be rescored.
+	Compacted int `json:"compacted,omitempty"`
+}
+
+// recalculateHandler handles POST /admin/recalculate, rescoring every stored
+// receipt with the current rules. Receipts are read and scored on s.workers
+// goroutines, and saved one at a time in the order they were listed, so
+// that daily caps are awarded as a serial pass would award them.
+func (s *Server) recalculateHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	// Snapshot the IDs first so the store is only locked for the duration
+	// of each individual call, not the whole pass.
+	var ids []string
+	err := s.store.Scan(r.Context(), 0, func(stored StoredReceipt) bool {
+		ids = append(ids, stored.ID)
+		return true
+	})
+	if err != nil {
+		s.writeStoreError(w, r, err)
+		return
+	}
+
+	var summary recalculateSummary
+	var failed error
+	err = runOrdered(r.Context(), s.workers, sliceInputs(len(ids)),
+		func(i int) rescoredReceipt { return s.rescore(r.Context(), ids[i]) },
+		func(i int, v any) rescoredReceipt {
+			s.scoringPanic(r.Context(), v)
+			return rescoredReceipt{panicked: true}
+		},
+		func(i int, rescored rescoredReceipt) bool {
+			if rescored.panicked {
+				summary.Failed++
+				return true
+			}
+			changed, err := s.saveRescored(r.Context(), ids[i], rescored)
+			if errors.Is(err, ErrNotFound) {
+				// Deleted since the snapshot was taken.
+				return true
+			}
+			var compacted *CompactedError
+			if errors.As(err, &compacted) {
+				summary.Compacted++
+				return true
+			}
+			if err != nil {
+				failed = err
+				return false
+			}
+			summary.Receipts++
+			if changed {
+				summary.Changed++
+			}
+			return true
+		})
+	if err != nil {
+		return
+	}
+	if failed != nil {
+		s.writeStoreError(w, r, failed)
+		return
+	}
+	summary.DurationMS = time.Since(start).Milliseconds()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
+
+// rescoredReceipt is a stored receipt scored with the current rules, and
+// the breakdown it was stored with.
+type rescoredReceipt struct {
+	receipt   points.Receipt
+	old       points.Breakdown
+	breakdown points.Breakdown
+	err       error
+	panicked  bool
+}
+
+// rescore recomputes the breakdown of the receipt stored under id.
+func (s *Server) rescore(ctx context.Context, id string) rescoredReceipt {
+	receipt, err := s.store.GetReceipt(ctx, id)
+	if err != nil {
+		return rescoredReceipt{err: err}
+	}
+	old, err := s.store.GetBreakdown(ctx, id)
+	if err != nil {
+		return rescoredReceipt{err: err}
+	}
+	return rescoredReceipt{receipt: receipt, old: old, breakdown: s.scoringRules().Breakdown(receipt)}
+}
+
+// saveRescored saves the breakdown rescore recomputed for the receipt stored
+// under id, capped as it would be if the receipt were stored now, if it
+// differs from the stored one. changed reports whether the points awarded
+// changed.
+func (s *Server) saveRescored(ctx context.Context, id string, rescored rescoredReceipt) (changed bool, err error) {
+	if rescored.err != nil {
+		return false, rescored.err
+	}
+	breakdown := rescored.breakdown
+	undo := func() {}
+	if s.caps != nil {
+		breakdown, _, undo = s.caps.reaward(id, rescored.receipt, breakdown)
+	}
+	if reflect.DeepEqual(breakdown, rescored.old) {
+		return false, nil
+	}
+	if err := s.store.UpdateBreakdown(ctx, id, breakdown); err != nil {
+		undo()
+		return false, err
+	}
+	s.retailers.rescored(id, breakdown.Total)
+	s.audit.record(ctx, auditRescored, id, receiptChanges(rescored.receipt, rescored.old.Total, rescored.receipt, breakdown.Total))
+	return breakdown.Total != rescored.old.Total, nil
+}
+
+// purgeHandler handles DELETE /admin/receipts, removing every stored receipt
+// along with their images, the deduplication and retailer indexes, daily cap
+// counts and recorded idempotent responses that refer to them.
+func (s *Server) purgeHandler(w http.ResponseWriter, r *http.Request) {
+	if s.dedup != nil {
+		s.dedup.mu.Lock()
+		defer s.dedup.mu.Unlock()
+	}
+
+	removed, err := s.store.Purge(r.Context())
+	if err != nil {
+		s.writeStoreError(w, r, err)
+		return
+	}
+	if _, err := s.images.Purge(r.Context()); err != nil {
+		// The receipts are gone, so their images can no longer be
+		// reached; only the space they take is lost.
+		s.logger.ErrorContext(r.Context(), "failed to purge receipt images", slog.String("component", componentStore), slog.Any("error", err))
+	}
+	if s.dedup != nil {
+		s.dedup.clear()
+	}
+	s.retailers.clear()
+	if s.caps != nil {
+		s.caps.clear()
+	}
+	s.idempotency.clear()
+	entry := newAuditEntry(r.Context(), auditPurged, "")
+	entry.Receipts = removed
+	s.audit.add(entry)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Deleted int `json:"deleted"`
+	}{removed})
+}
+
+// logLevelBody is the request and response body of /admin/loglevel.
+type logLevelBody struct {
+	Level string `json:"level"`
+}
+
+// logLevelHandler handles GET /admin/loglevel, reporting the level logged at.
+func (s *Server) logLevelHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(logLevelBody{Level: s.logLevel.Level().String()})
+}
+
+// setLogLevelHandler handles PUT /admin/loglevel, changing the level logged
+// at until the next change or restart, e.g. to capture debug logs during an
+// incident.
+func (s *Server) setLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	var body logLevelBody
+	if err := decodeJSON(r, &body, "Body must be a JSON object with a level"); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(body.Level)); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidBody, "Invalid log level",
+			points.FieldError{Field: "level", Message: "must be debug, info, warn or error"})
+		return
+	}
+
+	old := s.logLevel.Level()
+	s.logLevel.Set(level)
+	// Logged at the new level if higher, so the change itself is kept.
+	s.logger.Log(r.Context(), max(level, slog.LevelInfo), "log level changed", slog.String("component", componentHTTP),
+		slog.String("from", old.String()), slog.String("to", level.String()))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(logLevelBody{Level: level.String()})
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// withAdmin enables the admin endpoints under the token "admin".
+func withAdmin(t testing.TB, s *Server) {
+	s.adminToken = "admin"
+}
+
+// sendAdmin sends a request with the admin token of withAdmin.
+func sendAdmin(h http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	return send(h, method, target, body, "Authorization", "Bearer admin")
+}
+
+// TestExportImportRoundTrip exports a store, imports the export into a
+// fresh one, and checks that every receipt has the same points there.
+func TestExportImportRoundTrip(t *testing.T) {
+	from := newTestServer(t, withAdmin).Handler()
+	want := make(map[string]int)
+	for _, receipt := range []string{targetReceipt, marketReceipt, targetReceipt} {
+		id := processReceipt(t, from, receipt)
+		want[id] = receiptPoints(t, from, id)
+	}
+	export := sendAdmin(from, http.MethodGet, "/admin/export", "")
+	if export.Code != http.StatusOK || export.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("GET /admin/export = %d %v %s", export.Code, export.Header(), export.Body)
+	}
+
+	for _, mode := range []string{"recompute", "trust"} {
+		to := newTestServer(t, withAdmin).Handler()
+		rec := sendAdmin(to, http.MethodPost, "/admin/import?points="+mode, export.Body.String())
+		var summary importSummary
+		decodeBody(t, rec, &summary)
+		if rec.Code != http.StatusOK || summary.Created != len(want) || summary.Skipped != 0 || summary.Rejected != 0 {
+			t.Fatalf("POST /admin/import?points=%s = %d %s, want %d created", mode, rec.Code, rec.Body, len(want))
+		}
+		for id, points := range want {
+			if got := receiptPoints(t, to, id); got != points {
+				t.Errorf("points of %s imported with %s = %d, want %d as exported", id, mode, got, points)
+			}
+		}
+
+		// Importing again skips every receipt.
+		decodeBody(t, sendAdmin(to, http.MethodPost, "/admin/import?points="+mode, export.Body.String()), &summary)
+		if summary.Created != 0 || summary.Skipped != len(want) {
+			t.Errorf("second import with %s = %+v, want all %d skipped", mode, summary, len(want))
+		}
+	}
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	h := newTestServer(t, withAdmin).Handler()
+	for _, header := range [][]string{nil, {"Authorization", "Bearer wrong"}, {"Authorization", "admin"}} {
+		rec := send(h, http.MethodDelete, "/admin/receipts", "", header...)
+		if rec.Code != http.StatusUnauthorized || errorCode(t, rec) != codeUnauthorized {
+			t.Errorf("DELETE /admin/receipts with %q = %d %s, want 401", header, rec.Code, rec.Body)
+		}
+	}
+
+	// Without a token the endpoints do not exist.
+	rec := send(newTestServer(t).Handler(), http.MethodGet, "/admin/stats", "", "Authorization", "Bearer admin")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("GET /admin/stats on a server without a token = %d, want 404", rec.Code)
+	}
+}
+
+func TestAdminStatsEmpty(t *testing.T) {
+	h := newTestServer(t, withAdmin).Handler()
+	rec := sendAdmin(h, http.MethodGet, "/admin/stats", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /admin/stats = %d %s, want 200", rec.Code, rec.Body)
+	}
+	for _, field := range []string{`"receipts":0`, `"totalPoints":0`, `"averagePoints":0`, `"topRetailers":[]`, `"approxBytes":0`} {
+		if !strings.Contains(rec.Body.String(), field) {
+			t.Errorf("stats %s lack %s", rec.Body, field)
+		}
+	}
+	for _, field := range []string{"minPoints", "maxPoints"} {
+		if strings.Contains(rec.Body.String(), field) {
+			t.Errorf("stats of an empty store %s have %s", rec.Body, field)
+		}
+	}
+}
+
+func TestAdminStats(t *testing.T) {
+	h := newTestServer(t, withAdmin).Handler()
+	processReceipt(t, h, targetReceipt)
+	processReceipt(t, h, marketReceipt)
+	processReceipt(t, h, marketReceipt)
+	// Eleven retailers with a receipt each, one too many for the ranking.
+	for i := range 11 {
+		processReceipt(t, h, strings.Replace(targetReceipt, `"Target"`, fmt.Sprintf(`"Shop %02d"`, i), 1))
+	}
+
+	rec := sendAdmin(h, http.MethodGet, "/admin/stats", "")
+	var stats storeStats
+	decodeBody(t, rec, &stats)
+	// Each "Shop NN" scores 28 - 6 + 6 for its name.
+	const total = 28 + 2*109 + 11*28
+	if stats.Receipts != 14 || stats.TotalPoints != total || stats.AveragePoints != float64(total)/14 {
+		t.Errorf("receipts %d, total %d, average %g, want 14, %d, %g", stats.Receipts, stats.TotalPoints, stats.AveragePoints, total, float64(total)/14)
+	}
+	if stats.MinPoints == nil || *stats.MinPoints != 28 || stats.MaxPoints == nil || *stats.MaxPoints != 109 {
+		t.Errorf("min %v, max %v, want 28 and 109", stats.MinPoints, stats.MaxPoints)
+	}
+	if len(stats.TopRetailers) != topRetailersCount {
+		t.Fatalf("%d top retailers, want %d", len(stats.TopRetailers), topRetailersCount)
+	}
+	if top := stats.TopRetailers[0]; top.Retailer != "M&M Corner Market" || top.Receipts != 2 {
+		t.Errorf("top retailer = %+v, want M&M Corner Market with 2", top)
+	}
+	// Ties are broken by name.
+	if second := stats.TopRetailers[1]; second.Retailer != "Shop 00" {
+		t.Errorf("second retailer = %+v, want Shop 00", second)
+	}
+	if stats.ApproxBytes <= 0 || stats.BytesPerReceipt != float64(stats.ApproxBytes)/14 {
+		t.Errorf("approx bytes %d, per receipt %g", stats.ApproxBytes, stats.BytesPerReceipt)
+	}
+}
+
+// TestAdminStatsWhileWriting gathers stats while receipts are processed,
+// which they must not wait for. Run it with -race.
+func TestAdminStatsWhileWriting(t *testing.T) {
+	h := newTestServer(t, withAdmin).Handler()
+	const writes = 200
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range writes {
+			if rec := send(h, http.MethodPost, "/receipts/process", targetReceipt); rec.Code != http.StatusCreated {
+				t.Errorf("POST /receipts/process = %d %s, want 201", rec.Code, rec.Body)
+			}
+		}
+	}()
+	for range 20 {
+		var stats storeStats
+		decodeBody(t, sendAdmin(h, http.MethodGet, "/admin/stats", ""), &stats)
+		if stats.Receipts < 0 || stats.Receipts > writes || stats.TotalPoints != 28*stats.Receipts {
+			t.Errorf("stats of %d receipts total %d points, want 28 each", stats.Receipts, stats.TotalPoints)
+		}
+	}
+	wg.Wait()
+}
+
+func TestAdminPurge(t *testing.T) {
+	h := newTestServer(t, withAdmin).Handler()
+	// Purging an empty store removes nothing.
+	rec := sendAdmin(h, http.MethodDelete, "/admin/receipts", "")
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != `{"deleted":0}` {
+		t.Errorf("DELETE /admin/receipts of nothing = %d %s, want 200 {\"deleted\":0}", rec.Code, rec.Body)
+	}
+
+	ids := []string{processReceipt(t, h, targetReceipt), processReceipt(t, h, marketReceipt), processReceipt(t, h, targetReceipt)}
+	rec = sendAdmin(h, http.MethodDelete, "/admin/receipts", "")
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != `{"deleted":3}` {
+		t.Errorf("DELETE /admin/receipts = %d %s, want 200 {\"deleted\":3}", rec.Code, rec.Body)
+	}
+	for _, id := range ids {
+		if rec := send(h, http.MethodGet, "/receipts/"+id+"/points", ""); rec.Code != http.StatusNotFound {
+			t.Errorf("GET points of purged %s = %d, want 404", id, rec.Code)
+		}
+	}
+	var stats storeStats
+	decodeBody(t, sendAdmin(h, http.MethodGet, "/admin/stats", ""), &stats)
+	if stats.Receipts != 0 || stats.TotalPoints != 0 {
+		t.Errorf("stats after a purge = %+v, want an empty store", stats)
+	}
+}
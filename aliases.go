@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// retailerNames maps the names receipts give their retailer to the
+// canonical name they are grouped under in listings, statistics and the
+// leaderboard, so that "M&M CORNER MARKET " and "M and M Corner Market"
+// count as one store. Receipts keep the name they were submitted with,
+// which is what they are scored and shown by.
+//
+// A nil *retailerNames leaves names as they are, apart from surrounding
+// whitespace.
+type retailerNames struct {
+	aliases map[string]string // normalized name -> canonical name
+}
+
+// loadRetailerNames returns names normalized by collapsing whitespace and
+// ignoring case, and mapped to a canonical name by the aliases file at path,
+// if path is set. The file is a JSON object listing the variants of each
+// canonical name:
+//
+//	{"M&M Corner Market": ["M and M Corner Market", "M & M Corner Market"]}
+func loadRetailerNames(path string) (*retailerNames, error) {
+	names := &retailerNames{aliases: make(map[string]string)}
+	if path == "" {
+		return names, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var variants map[string][]string
+	if err := json.Unmarshal(data, &variants); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for canonical, aliases := range variants {
+		canonical = collapseSpaces(canonical)
+		if canonical == "" {
+			return nil, fmt.Errorf("parsing %s: canonical retailer names must not be empty", path)
+		}
+		for _, alias := range append(aliases, canonical) {
+			key := retailerKey(collapseSpaces(alias))
+			if previous, ok := names.aliases[key]; ok && previous != canonical {
+				return nil, fmt.Errorf("parsing %s: %q is an alias of both %q and %q", path, alias, previous, canonical)
+			}
+			names.aliases[key] = canonical
+		}
+	}
+	return names, nil
+}
+
+// canonical returns the name receipts from retailer are grouped under.
+func (n *retailerNames) canonical(retailer string) string {
+	if n == nil {
+		return strings.TrimSpace(retailer)
+	}
+	name := collapseSpaces(retailer)
+	if canonical, ok := n.aliases[retailerKey(name)]; ok {
+		return canonical
+	}
+	return name
+}
+
+// key returns the key receipts from retailer are grouped by.
+func (n *retailerNames) key(retailer string) string {
+	return retailerKey(n.canonical(retailer))
+}
+
+// collapseSpaces trims s and replaces each run of whitespace inside it with
+// a single space.
+func collapseSpaces(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
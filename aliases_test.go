@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testAliases lists two variants of the market receipt's retailer.
+const testAliases = `{"M&M Corner Market": ["M and M Corner Market", "M & M Corner Market"]}`
+
+// writeAliases writes aliases to a file and returns its path.
+func writeAliases(t testing.TB, aliases string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "aliases.json")
+	if err := os.WriteFile(path, []byte(aliases), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// withAliases normalizes retailer names, grouping the variants testAliases
+// lists under their canonical name.
+func withAliases(t testing.TB, s *Server) {
+	names, err := loadRetailerNames(writeAliases(t, testAliases))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.names = names
+	s.retailers.names = names
+}
+
+func TestRetailerNamesCanonical(t *testing.T) {
+	names, err := loadRetailerNames(writeAliases(t, testAliases))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unaliased, err := loadRetailerNames("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		names     *retailerNames
+		retailer  string
+		canonical string
+	}{
+		{names, "M&M Corner Market", "M&M Corner Market"},
+		{names, "  m&m CORNER market ", "M&M Corner Market"},
+		{names, "M and M Corner Market", "M&M Corner Market"},
+		{names, "m  and  m\tcorner market", "M&M Corner Market"},
+		{names, "M & M Corner Market", "M&M Corner Market"},
+		{names, "Target", "Target"},
+		{names, " Corner   Shop ", "Corner Shop"},
+		// Without an aliases file, names are only normalized.
+		{unaliased, "M and M Corner Market", "M and M Corner Market"},
+		{unaliased, " Corner   Shop ", "Corner Shop"},
+		// Without normalizing, they are only trimmed.
+		{nil, " Corner   Shop ", "Corner   Shop"},
+	}
+	for _, tt := range tests {
+		if got := tt.names.canonical(tt.retailer); got != tt.canonical {
+			t.Errorf("canonical(%q) = %q, want %q", tt.retailer, got, tt.canonical)
+		}
+	}
+	if names.key("M AND M corner market") != names.key("M&M Corner Market") {
+		t.Error("an alias and its canonical name have different keys")
+	}
+}
+
+func TestLoadRetailerNamesErrors(t *testing.T) {
+	for _, aliases := range []string{
+		`["M&M Corner Market"]`,
+		`{" ": ["Blank"]}`,
+		`{"M&M Corner Market": ["Corner Market"], "Corner Market Inc": ["corner  market"]}`,
+	} {
+		if _, err := loadRetailerNames(writeAliases(t, aliases)); err == nil {
+			t.Errorf("loadRetailerNames accepted %s", aliases)
+		}
+	}
+	if _, err := loadRetailerNames(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("loadRetailerNames accepted a missing file")
+	}
+}
+
+// TestRetailerVariantsGroupTogether submits receipts under variants of one
+// retailer and checks that the leaderboard and the retailer filter count
+// them as one store.
+func TestRetailerVariantsGroupTogether(t *testing.T) {
+	h := newTestServer(t, withAliases).Handler()
+	want := 0
+	for _, retailer := range []string{"M&M Corner Market", "M&M CORNER  MARKET ", "M and M Corner Market", "m & m corner market"} {
+		id := processReceipt(t, h, strings.Replace(marketReceipt, `"M&M Corner Market"`, `"`+retailer+`"`, 1))
+		want += receiptPoints(t, h, id)
+	}
+	processReceipt(t, h, targetReceipt)
+
+	board := leaderboard(t, h)
+	if len(board) != 2 {
+		t.Fatalf("leaderboard = %+v, want two retailers", board)
+	}
+	market := board[0]
+	if market.CanonicalRetailer != "M&M Corner Market" || market.ReceiptCount != 4 || market.TotalPoints != want {
+		t.Errorf("leaderboard entry = %+v, want 4 receipts under M&M Corner Market for %d points", market, want)
+	}
+
+	var list listResponse
+	decodeBody(t, send(h, http.MethodGet, "/receipts?retailer="+url.QueryEscape("M AND M corner market"), ""), &list)
+	if len(list.Receipts) != 4 {
+		t.Errorf("GET /receipts by an alias lists %d receipts, want 4", len(list.Receipts))
+	}
+	for _, r := range list.Receipts {
+		if r.CanonicalRetailer != "M&M Corner Market" {
+			t.Errorf("receipt from %q is listed under %q, want M&M Corner Market", r.Retailer, r.CanonicalRetailer)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+const (
+	// defaultAnomalyWindow is how far back the baseline that fire rates are
+	// compared with reaches, unless configured otherwise.
+	defaultAnomalyWindow = time.Hour
+	// defaultAnomalyThreshold is how many times higher or lower than its
+	// baseline the fire rate of a rule must be to be flagged, unless
+	// configured otherwise.
+	defaultAnomalyThreshold = 3.0
+	// anomalyMinReceipts is how many receipts the assessed minute and the
+	// baseline must each have before a rule is flagged, so that a quiet
+	// minute or a server just started cannot raise an alarm.
+	anomalyMinReceipts = 20
+)
+
+// anomalyTracker counts, minute by minute, how many stored receipts each rule
+// awarded points to, so that a sudden shift in how receipts score, such as a
+// burst of receipts all hitting the round-dollar rule, can be flagged. A
+// rule's fire rate is the share of a minute's receipts it fired on. The last
+// complete minute is assessed against the baseline of the window before it.
+//
+// observe runs for every stored receipt, so it takes no lock: the counts are
+// atomic, and a minute's slot in the ring is replaced by compare-and-swap
+// when the minute comes round. A receipt counted in a slot just as it is
+// replaced is lost, which does not matter at the scale of a minute.
+type anomalyTracker struct {
+	window    int     // minutes in the baseline
+	threshold float64 // multiple of the baseline a rate is flagged at
+	now       func() time.Time
+
+	// slots holds the minute in progress, the last complete one and the
+	// window before it, indexed by Unix minute modulo their number.
+	slots []atomic.Pointer[anomalyMinute]
+}
+
+// anomalyMinute holds the counts of one minute.
+type anomalyMinute struct {
+	minute   int64 // Unix minute
+	receipts atomic.Int64
+	fires    sync.Map // rule name -> *atomic.Int64
+}
+
+func newAnomalyTracker(window time.Duration, threshold float64) *anomalyTracker {
+	minutes := max(int(window/time.Minute), 1)
+	return &anomalyTracker{window: minutes, threshold: threshold, now: time.Now, slots: make([]atomic.Pointer[anomalyMinute], minutes+2)}
+}
+
+// slot returns the counts of minute, starting them afresh if the slot they go
+// in still holds an earlier minute.
+func (t *anomalyTracker) slot(minute int64) *anomalyMinute {
+	ptr := &t.slots[minute%int64(len(t.slots))]
+	for {
+		current := ptr.Load()
+		if current != nil && current.minute >= minute {
+			return current
+		}
+		fresh := &anomalyMinute{minute: minute}
+		if ptr.CompareAndSwap(current, fresh) {
+			return fresh
+		}
+	}
+}
+
+// observe counts a stored receipt and the rules that awarded it points.
+func (t *anomalyTracker) observe(breakdown points.Breakdown) {
+	m := t.slot(t.now().Unix() / 60)
+	m.receipts.Add(1)
+	for _, result := range breakdown.Rules {
+		if result.Points == 0 {
+			continue
+		}
+		counter, ok := m.fires.Load(result.Rule)
+		if !ok {
+			counter, _ = m.fires.LoadOrStore(result.Rule, new(atomic.Int64))
+		}
+		counter.(*atomic.Int64).Add(1)
+	}
+}
+
+// ruleAnomaly is how one rule fired in the assessed minute, against its
+// baseline.
+type ruleAnomaly struct {
+	Rule         string  `json:"rule"`
+	Rate         float64 `json:"rate"`
+	BaselineRate float64 `json:"baselineRate"`
+	// Ratio is Rate over BaselineRate, omitted when the rule never fired
+	// in the baseline.
+	Ratio     *float64 `json:"ratio,omitempty"`
+	Anomalous bool     `json:"anomalous"`
+}
+
+// anomalyReport is the response to GET /admin/anomalies.
+type anomalyReport struct {
+	// Minute is the start of the minute assessed, the last complete one.
+	Minute           time.Time     `json:"minute"`
+	WindowMinutes    int           `json:"windowMinutes"`
+	Threshold        float64       `json:"threshold"`
+	Receipts         int64         `json:"receipts"`
+	BaselineReceipts int64         `json:"baselineReceipts"`
+	Anomalous        bool          `json:"anomalous"`
+	Rules            []ruleAnomaly `json:"rules"`
+}
+
+// report assesses the last complete minute. A rule is anomalous when its rate
+// is more than threshold times its baseline rate, or less than its baseline
+// rate divided by threshold, and both the minute and the baseline have at
+// least anomalyMinReceipts receipts.
+func (t *anomalyTracker) report() anomalyReport {
+	assessed := t.now().Unix()/60 - 1
+	report := anomalyReport{Minute: time.Unix(assessed*60, 0).UTC(), WindowMinutes: t.window, Threshold: t.threshold, Rules: []ruleAnomaly{}}
+
+	fires := make(map[string]int64)
+	baseline := make(map[string]int64)
+	for i := range t.slots {
+		m := t.slots[i].Load()
+		if m == nil || m.minute > assessed || m.minute < assessed-int64(t.window) {
+			continue
+		}
+		counts := baseline
+		if m.minute == assessed {
+			counts = fires
+			report.Receipts += m.receipts.Load()
+		} else {
+			report.BaselineReceipts += m.receipts.Load()
+		}
+		m.fires.Range(func(rule, counter any) bool {
+			counts[rule.(string)] += counter.(*atomic.Int64).Load()
+			return true
+		})
+	}
+
+	enough := report.Receipts >= anomalyMinReceipts && report.BaselineReceipts >= anomalyMinReceipts
+	// Rules that stopped firing are assessed too.
+	for rule := range baseline {
+		if _, ok := fires[rule]; !ok {
+			fires[rule] = 0
+		}
+	}
+	for rule, n := range fires {
+		anomaly := ruleAnomaly{Rule: rule, Rate: share(n, report.Receipts), BaselineRate: share(baseline[rule], report.BaselineReceipts)}
+		if anomaly.BaselineRate > 0 {
+			ratio := anomaly.Rate / anomaly.BaselineRate
+			anomaly.Ratio = &ratio
+			anomaly.Anomalous = enough && (ratio > t.threshold || ratio < 1/t.threshold)
+		} else {
+			anomaly.Anomalous = enough && anomaly.Rate > 0
+		}
+		report.Anomalous = report.Anomalous || anomaly.Anomalous
+		report.Rules = append(report.Rules, anomaly)
+	}
+	sort.Slice(report.Rules, func(i, j int) bool { return report.Rules[i].Rule < report.Rules[j].Rule })
+	return report
+}
+
+// share returns n as a share of total, or 0 if total is.
+func share(n, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) / float64(total)
+}
+
+// anomaliesHandler handles GET /admin/anomalies, reporting how often each
+// rule fired in the last complete minute against its baseline, and flagging
+// the rules whose rate has shifted.
+func (s *Server) anomaliesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(s.anomalies.report())
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+// fakeClock is a clock for an anomalyTracker, moved on by hand.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// newAnomalyClock returns a clock for an anomaly tracker, starting on the
+// hour.
+func newAnomalyClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, time.June, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+// withAnomalies tracks anomalies with a window of window, on clock.
+func withAnomalies(window time.Duration, clock *fakeClock) serverOption {
+	return func(t testing.TB, s *Server) {
+		s.anomalies = newAnomalyTracker(window, defaultAnomalyThreshold)
+		s.anomalies.now = clock.Now
+		s.metrics.watchAnomalies(s.anomalies)
+	}
+}
+
+// ruleOf returns the assessment of rule in report.
+func ruleOf(report anomalyReport, rule string) ruleAnomaly {
+	for _, r := range report.Rules {
+		if r.Rule == rule {
+			return r
+		}
+	}
+	return ruleAnomaly{Rule: rule}
+}
+
+// TestAnomalySpike stores receipts of which one in ten has a round-dollar
+// total for ten minutes, then a minute of nothing but round-dollar totals,
+// and checks that the spike is reported at /admin/anomalies and in the
+// metrics.
+func TestAnomalySpike(t *testing.T) {
+	clock := newAnomalyClock()
+	s := newTestServer(t, withAdmin, withAnomalies(10*time.Minute, clock))
+	h := s.Handler()
+	round := strings.Replace(targetReceipt, `"35.35"`, `"35.00"`, 1)
+
+	for range 10 {
+		for i := range 10 {
+			body := targetReceipt
+			if i == 0 {
+				body = round
+			}
+			processReceipt(t, h, body)
+		}
+		clock.advance(time.Minute)
+	}
+	var report anomalyReport
+	decodeBody(t, sendAdmin(h, http.MethodGet, "/admin/anomalies", ""), &report)
+	if report.Anomalous || report.Receipts != 10 || report.BaselineReceipts != 90 {
+		t.Fatalf("report of steady traffic = %+v, want nothing anomalous", report)
+	}
+
+	for range 30 {
+		processReceipt(t, h, round)
+	}
+	clock.advance(time.Minute)
+	decodeBody(t, sendAdmin(h, http.MethodGet, "/admin/anomalies", ""), &report)
+	if !report.Anomalous || report.Receipts != 30 || report.BaselineReceipts != 100 || report.WindowMinutes != 10 ||
+		!report.Minute.Equal(clock.Now().Add(-time.Minute)) {
+		t.Fatalf("report after the spike = %+v, want it anomalous", report)
+	}
+	for _, rule := range []string{"round-dollar-total", "quarter-multiple-total"} {
+		got := ruleOf(report, rule)
+		if !got.Anomalous || got.Rate != 1 || got.BaselineRate != 0.1 || got.Ratio == nil || *got.Ratio < 9.99 {
+			t.Errorf("%s after the spike = %+v, want rate 1 against 0.1, anomalous", rule, got)
+		}
+	}
+	// The rules that fire on every receipt fire on these too.
+	for _, rule := range []string{"retailer-name", "item-pairs", "odd-purchase-day"} {
+		if got := ruleOf(report, rule); got.Anomalous || got.Rate != 1 || got.BaselineRate != 1 {
+			t.Errorf("%s after the spike = %+v, want it steady", rule, got)
+		}
+	}
+
+	metrics := send(h, http.MethodGet, "/metrics", "").Body.String()
+	for _, line := range []string{
+		`receipt_processor_rule_anomaly{rule="round-dollar-total"} 1`,
+		`receipt_processor_rule_anomaly{rule="retailer-name"} 0`,
+		`receipt_processor_rule_fire_rate{rule="round-dollar-total"} 1`,
+		`receipt_processor_rule_fire_rate_baseline{rule="round-dollar-total"} 0.1`,
+	} {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Errorf("metrics lack %q", line)
+		}
+	}
+}
+
+// TestAnomalyDrop checks that a rule that stops firing is flagged too.
+func TestAnomalyDrop(t *testing.T) {
+	clock := newAnomalyClock()
+	s := newTestServer(t, withAdmin, withAnomalies(5*time.Minute, clock))
+	rules := func(fired ...string) points.Breakdown {
+		var b points.Breakdown
+		for _, rule := range fired {
+			b.Rules = append(b.Rules, points.RuleResult{Rule: rule, Points: 1})
+		}
+		return b
+	}
+	for range 5 {
+		for range anomalyMinReceipts {
+			s.anomalies.observe(rules("retailer-name", "round-dollar-total"))
+		}
+		clock.advance(time.Minute)
+	}
+	for range anomalyMinReceipts {
+		s.anomalies.observe(rules("retailer-name"))
+	}
+	clock.advance(time.Minute)
+
+	report := s.anomalies.report()
+	if got := ruleOf(report, "round-dollar-total"); !got.Anomalous || got.Rate != 0 || got.BaselineRate != 1 {
+		t.Errorf("rule that stopped firing = %+v, want it anomalous", got)
+	}
+	if got := ruleOf(report, "retailer-name"); got.Anomalous {
+		t.Errorf("rule that kept firing = %+v, want it steady", got)
+	}
+}
+
+// TestAnomalyNeedsEnoughReceipts checks that a minute or a baseline with
+// fewer than anomalyMinReceipts receipts flags nothing, however it scored.
+func TestAnomalyNeedsEnoughReceipts(t *testing.T) {
+	fired := points.Breakdown{Rules: []points.RuleResult{{Rule: "round-dollar-total", Points: 50}}}
+	quiet := points.Breakdown{Rules: []points.RuleResult{{Rule: "round-dollar-total", Points: 0}}}
+	tests := []struct {
+		name               string
+		baseline, assessed int
+	}{
+		{"quiet minute", 100, anomalyMinReceipts - 1},
+		{"just started", anomalyMinReceipts - 1, 100},
+	}
+	for _, tt := range tests {
+		clock := newAnomalyClock()
+		s := newTestServer(t, withAdmin, withAnomalies(5*time.Minute, clock))
+		for range tt.baseline {
+			s.anomalies.observe(quiet)
+		}
+		clock.advance(time.Minute)
+		for range tt.assessed {
+			s.anomalies.observe(fired)
+		}
+		clock.advance(time.Minute)
+		if report := s.anomalies.report(); report.Anomalous {
+			t.Errorf("%s: report = %+v, want nothing anomalous", tt.name, report)
+		}
+	}
+}
+
+// TestAnomalyWindowSlides checks that minutes older than the window drop out
+// of the baseline as the ring comes round.
+func TestAnomalyWindowSlides(t *testing.T) {
+	clock := newAnomalyClock()
+	s := newTestServer(t, withAdmin, withAnomalies(3*time.Minute, clock))
+	fired := points.Breakdown{Rules: []points.RuleResult{{Rule: "round-dollar-total", Points: 50}}}
+	quiet := points.Breakdown{Rules: []points.RuleResult{{Rule: "retailer-name", Points: 6}}}
+	for range 3 {
+		for range anomalyMinReceipts {
+			s.anomalies.observe(fired)
+		}
+		clock.advance(time.Minute)
+	}
+	// Ten quiet minutes go round the ring of five slots twice.
+	for range 10 {
+		for range anomalyMinReceipts {
+			s.anomalies.observe(quiet)
+		}
+		clock.advance(time.Minute)
+	}
+	report := s.anomalies.report()
+	if report.Receipts != anomalyMinReceipts || report.BaselineReceipts != 3*anomalyMinReceipts {
+		t.Errorf("report = %+v, want one minute assessed against three", report)
+	}
+	if got := ruleOf(report, "round-dollar-total"); got.Rate != 0 || got.BaselineRate != 0 {
+		t.Errorf("round-dollar-total fired %+v, want not within the window", got)
+	}
+}
+
+// TestAnomalyObserveConcurrently counts receipts from many goroutines at
+// once, as the scoring path does, and checks that none is lost within a
+// minute.
+func TestAnomalyObserveConcurrently(t *testing.T) {
+	clock := newAnomalyClock()
+	s := newTestServer(t, withAdmin, withAnomalies(time.Minute, clock))
+	breakdown := points.Breakdown{Rules: []points.RuleResult{{Rule: "retailer-name", Points: 6}, {Rule: "odd-purchase-day", Points: 6}}}
+	var wg sync.WaitGroup
+	for range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 500 {
+				s.anomalies.observe(breakdown)
+			}
+		}()
+	}
+	wg.Wait()
+	clock.advance(time.Minute)
+
+	report := s.anomalies.report()
+	if report.Receipts != 16*500 {
+		t.Errorf("counted %d receipts, want %d", report.Receipts, 16*500)
+	}
+	for _, rule := range []string{"retailer-name", "odd-purchase-day"} {
+		if got := ruleOf(report, rule); got.Rate != 1 {
+			t.Errorf("%s = %+v, want rate 1", rule, got)
+		}
+	}
+}
+
+func TestAnomalyConfig(t *testing.T) {
+	for _, args := range [][]string{
+		{"-anomaly-window", "30s"},
+		{"-anomaly-threshold", "1"},
+		{"-anomaly-threshold", "0.5"},
+	} {
+		if _, err := parseConfig(args, envOf(nil)); err == nil {
+			t.Errorf("parseConfig %v succeeded, want an error", args)
+		}
+	}
+	cfg, err := parseConfig(nil, envOf(map[string]string{"ANOMALY_WINDOW": "15m", "ANOMALY_THRESHOLD": "2.5"}))
+	if err != nil || cfg.AnomalyWindow != 15*time.Minute || cfg.AnomalyRatio != 2.5 {
+		t.Errorf("parseConfig from the environment = %s, %g, %v, want 15m and 2.5", cfg.AnomalyWindow, cfg.AnomalyRatio, err)
+	}
+}
@@ -0,0 +1,75 @@
+// Package api defines the bodies of the receipt processor API's responses,
+// shared by the server and the client so that the two cannot drift apart.
+// Every body is a struct, whose fields are encoded in the order they are
+// declared, so a response is the same byte for byte each time it is served.
+// Bodies that can also be served as XML have xml tags naming their elements
+// as in JSON.
+package api
+
+import (
+	"time"
+
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+// ProcessResponse is the body of POST /receipts/process.
+type ProcessResponse struct {
+	ID string `json:"id"`
+	// Cap is set when a daily cap reduced the receipt's points.
+	Cap *DailyCap `json:"cap,omitempty"`
+}
+
+// DailyCap reports how a daily cap reduced the points of a receipt.
+type DailyCap struct {
+	Limit    int `json:"limit"`
+	Uncapped int `json:"uncapped"`
+	Points   int `json:"points"`
+}
+
+// PointsResponse is the body of GET /receipts/{id}/points. Receipt and
+// Breakdown are only set when asked for with ?include=, and ExpiresOn when
+// points were counted ?at= a date and expire.
+type PointsResponse struct {
+	Points    int                  `json:"points" xml:"points"`
+	ExpiresOn string               `json:"expiresOn,omitempty" xml:"expiresOn,omitempty"`
+	Receipt   *points.Receipt      `json:"receipt,omitempty" xml:"receipt,omitempty"`
+	Breakdown *[]points.RuleResult `json:"breakdown,omitempty" xml:"breakdown>rule,omitempty"`
+}
+
+// PreviewResponse is the body of POST /receipts/points. Breakdown is only set
+// when asked for with ?breakdown=true.
+type PreviewResponse struct {
+	Points    int               `json:"points"`
+	Breakdown *points.Breakdown `json:"breakdown,omitempty"`
+}
+
+// RestoreResponse is the body of POST /receipts/{id}/restore.
+type RestoreResponse struct {
+	ID     string `json:"id"`
+	Points int    `json:"points"`
+}
+
+// ErrorResponse is the body of every error response.
+type ErrorResponse struct {
+	Error *ErrorBody `json:"error"`
+}
+
+// ErrorBody describes why a request failed.
+type ErrorBody struct {
+	// Code identifies the error, such as "invalid_receipt". Clients should
+	// branch on it rather than on Message, which is translated.
+	Code    string              `json:"code"`
+	Message string              `json:"message"`
+	Details []points.FieldError `json:"details,omitempty"`
+	// DeletedAt is when the receipt asked for was deleted, for a
+	// receipt_deleted error.
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
+	// CompactedAt is when the items of the receipt asked for were
+	// dropped, for a receipt_compacted error.
+	CompactedAt *time.Time `json:"compactedAt,omitempty"`
+	// ResetsAt is when the quota of the caller's API key next has room,
+	// for a quota_exceeded error.
+	ResetsAt *time.Time `json:"resetsAt,omitempty"`
+	// RequestID lets users quote a failed request in bug reports.
+	RequestID string `json:"requestId,omitempty"`
+}
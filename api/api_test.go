@@ -0,0 +1,134 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+// TestGoldenJSON checks that each response body encodes to exactly its
+// golden JSON, with every field set and with none, and that the golden JSON
+// decodes, without unknown fields, back to the same body.
+func TestGoldenJSON(t *testing.T) {
+	quantity := 2
+	at := time.Date(2024, time.March, 10, 14, 30, 0, 0, time.UTC)
+	receipt := &points.Receipt{
+		Retailer:     "Target",
+		PurchaseDate: "2022-01-01",
+		PurchaseTime: "13:01",
+		Items:        []points.Item{{ShortDescription: "Mountain Dew 12PK", Price: "6.49", Quantity: &quantity}},
+		Total:        "6.49",
+		Timezone:     "America/New_York",
+	}
+	rules := []points.RuleResult{
+		{Rule: "retailer-name", Description: "One point for every alphanumeric character in the retailer name", Points: 6, Details: []string{"Target"}},
+		{Rule: "round-dollar-total", Description: "50 points if the total is a round dollar amount with no cents", Points: 0},
+	}
+
+	tests := []struct {
+		name  string
+		value any
+		json  string
+	}{
+		{"ProcessResponse", &ProcessResponse{ID: "7fb1377b-b223-49d9-a31a-5a02701dd310"},
+			`{"id":"7fb1377b-b223-49d9-a31a-5a02701dd310"}`},
+		{"ProcessResponse capped", &ProcessResponse{ID: "7fb1377b-b223-49d9-a31a-5a02701dd310", Cap: &DailyCap{Limit: 100, Uncapped: 109, Points: 12}},
+			`{"id":"7fb1377b-b223-49d9-a31a-5a02701dd310","cap":{"limit":100,"uncapped":109,"points":12}}`},
+		{"DailyCap", &DailyCap{}, `{"limit":0,"uncapped":0,"points":0}`},
+		{"PointsResponse", &PointsResponse{Points: 28}, `{"points":28}`},
+		{"PointsResponse included", &PointsResponse{Points: 6, ExpiresOn: "2025-01-01", Receipt: receipt, Breakdown: &rules},
+			`{"points":6,"expiresOn":"2025-01-01",` +
+				`"receipt":{"retailer":"Target","purchaseDate":"2022-01-01","purchaseTime":"13:01",` +
+				`"items":[{"shortDescription":"Mountain Dew 12PK","price":"6.49","quantity":2}],"total":"6.49","timezone":"America/New_York"},` +
+				`"breakdown":[{"rule":"retailer-name","description":"One point for every alphanumeric character in the retailer name","points":6,"details":["Target"]},` +
+				`{"rule":"round-dollar-total","description":"50 points if the total is a round dollar amount with no cents","points":0}]}`},
+		{"PreviewResponse", &PreviewResponse{Points: 109}, `{"points":109}`},
+		{"PreviewResponse with breakdown", &PreviewResponse{Points: 6, Breakdown: &points.Breakdown{Rules: rules[:1], Total: 6}},
+			`{"points":6,"breakdown":{"rules":[{"rule":"retailer-name","description":"One point for every alphanumeric character in the retailer name","points":6,"details":["Target"]}],"total":6}}`},
+		{"RestoreResponse", &RestoreResponse{ID: "7fb1377b-b223-49d9-a31a-5a02701dd310", Points: 28},
+			`{"id":"7fb1377b-b223-49d9-a31a-5a02701dd310","points":28}`},
+		{"ErrorResponse", &ErrorResponse{Error: &ErrorBody{Code: "receipt_not_found", Message: "No receipt found for that ID"}},
+			`{"error":{"code":"receipt_not_found","message":"No receipt found for that ID"}}`},
+		{"ErrorResponse with every field", &ErrorResponse{Error: &ErrorBody{
+			Code:    "invalid_receipt",
+			Message: "The receipt is invalid",
+			Details: []points.FieldError{
+				{Field: "items[3].price", Message: "must be a decimal amount with two places", Pointer: "/items/3/price", Constraint: points.ConstraintFormat, Value: "1.5"},
+				{Field: "retailer", Message: "is required"},
+			},
+			DeletedAt:   &at,
+			CompactedAt: &at,
+			ResetsAt:    &at,
+			RequestID:   "req-95",
+		}}, `{"error":{"code":"invalid_receipt","message":"The receipt is invalid",` +
+			`"details":[{"field":"items[3].price","message":"must be a decimal amount with two places","pointer":"/items/3/price","constraint":"format","value":"1.5"},` +
+			`{"field":"retailer","message":"is required"}],` +
+			`"deletedAt":"2024-03-10T14:30:00Z","compactedAt":"2024-03-10T14:30:00Z","resetsAt":"2024-03-10T14:30:00Z","requestId":"req-95"}}`},
+		{"ErrorResponse empty", &ErrorResponse{}, `{"error":null}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Encoding twice must give the golden bytes both times.
+			for range 2 {
+				got, err := json.Marshal(tt.value)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != tt.json {
+					t.Fatalf("encoded as\n%s\nwant\n%s", got, tt.json)
+				}
+			}
+
+			decoded := reflect.New(reflect.TypeOf(tt.value).Elem()).Interface()
+			dec := json.NewDecoder(bytes.NewReader([]byte(tt.json)))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(decoded); err != nil {
+				t.Fatalf("decoding the golden JSON: %v", err)
+			}
+			if !reflect.DeepEqual(decoded, tt.value) {
+				t.Errorf("golden JSON decodes to %+v, want %+v", decoded, tt.value)
+			}
+		})
+	}
+}
+
+// TestDisallowUnknownFields checks that a body with a field this package
+// does not know of is refused, so that the round trips above would catch a
+// field the server adds without the client.
+func TestDisallowUnknownFields(t *testing.T) {
+	dec := json.NewDecoder(bytes.NewReader([]byte(`{"points":28,"bonus":5}`)))
+	dec.DisallowUnknownFields()
+	var body PointsResponse
+	if err := dec.Decode(&body); err == nil {
+		t.Error("decoded a PointsResponse with an unknown field")
+	}
+}
+
+func TestGoldenXML(t *testing.T) {
+	rules := []points.RuleResult{{Rule: "retailer-name", Description: "Alphanumeric characters", Points: 6, Details: []string{"Target"}}}
+	tests := []struct {
+		name  string
+		value PointsResponse
+		xml   string
+	}{
+		{"bare", PointsResponse{Points: 28}, `<PointsResponse><points>28</points></PointsResponse>`},
+		{"with breakdown", PointsResponse{Points: 6, ExpiresOn: "2025-01-01", Breakdown: &rules},
+			`<PointsResponse><points>6</points><expiresOn>2025-01-01</expiresOn>` +
+				`<breakdown><rule><rule>retailer-name</rule><description>Alphanumeric characters</description><points>6</points>` +
+				`<details><detail>Target</detail></details></rule></breakdown></PointsResponse>`},
+	}
+	for _, tt := range tests {
+		got, err := xml.Marshal(tt.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.xml {
+			t.Errorf("%s: encoded as\n%s\nwant\n%s", tt.name, got, tt.xml)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+const (
+	// defaultAsyncQueueSize is how many receipts may wait to be stored in
+	// async mode before new ones are turned away.
+	defaultAsyncQueueSize = 1000
+	// defaultAsyncWorkers is how many receipts are stored concurrently in
+	// async mode.
+	defaultAsyncWorkers = 4
+)
+
+// asyncJob is a validated and scored receipt waiting to be stored.
+type asyncJob struct {
+	id        string
+	receipt   points.Receipt
+	breakdown points.Breakdown
+	tenant    string     // the tenant that submitted it
+	audit     auditEntry // recorded once it is stored
+}
+
+// asyncQueue holds receipts accepted by POST /receipts/process?async=true
+// until a worker stores them. A receipt is pending from when it is queued
+// until it has been stored.
+type asyncQueue struct {
+	workers int
+	jobs    chan asyncJob
+	wg      sync.WaitGroup
+
+	mu      sync.Mutex
+	pending map[string]string // receipt ID -> tenant
+	closed  bool
+}
+
+func newAsyncQueue(size, workers int) *asyncQueue {
+	return &asyncQueue{
+		workers: workers,
+		jobs:    make(chan asyncJob, size),
+		pending: make(map[string]string),
+	}
+}
+
+// enqueue queues job, reporting false if the queue is full or closed.
+func (q *asyncQueue) enqueue(job asyncJob) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return false
+	}
+	select {
+	case q.jobs <- job:
+		q.pending[job.id] = job.tenant
+		return true
+	default:
+		return false
+	}
+}
+
+// isPending reports whether the receipt with id is queued or being stored,
+// for a tenant that a call made with ctx may see.
+func (q *asyncQueue) isPending(ctx context.Context, id string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	tenant, ok := q.pending[id]
+	return ok && canSee(ctx, tenant)
+}
+
+// queued returns how many receipts are waiting for a worker.
+func (q *asyncQueue) queued() int {
+	return len(q.jobs)
+}
+
+// run starts the workers, which call process for each queued job until the
+// queue is closed and empty.
+func (q *asyncQueue) run(process func(asyncJob)) {
+	for range q.workers {
+		q.wg.Add(1)
+		go func() {
+			defer q.wg.Done()
+			for job := range q.jobs {
+				process(job)
+				q.mu.Lock()
+				delete(q.pending, job.id)
+				q.mu.Unlock()
+			}
+		}()
+	}
+}
+
+// drain stops the queue accepting jobs and waits for those already queued to
+// be processed, or for ctx to be done.
+func (q *asyncQueue) drain(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.jobs)
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// storeQueued stores a receipt accepted in async mode. Nobody is waiting on
+// the result, so a failure can only be logged; the receipt then reads as not
+// found.
+func (s *Server) storeQueued(job asyncJob) {
+	ctx, deliveries := s.webhooks.prepare(withTenant(context.Background(), job.tenant), s.webhookEvent(job.id, job.tenant, job.receipt, job.breakdown))
+	if err := s.store.SaveReceipt(withNewID(ctx), job.id, job.receipt, job.breakdown); err != nil {
+		s.logger.Error("failed to store queued receipt",
+			slog.String("component", componentAsync),
+			slog.String("receipt_id", job.id),
+			slog.Any("error", err))
+		if s.caps != nil {
+			s.caps.remove(job.id)
+		}
+		return
+	}
+	s.receiptStored(job.id, job.tenant, job.receipt, job.breakdown, deliveries)
+	s.audit.add(job.audit)
+}
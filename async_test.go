@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+// blockedStore holds every SaveReceipt until release is closed.
+type blockedStore struct {
+	Store
+	saving  chan struct{} // receives once per SaveReceipt
+	release chan struct{}
+}
+
+func (s *blockedStore) SaveReceipt(ctx context.Context, id string, receipt points.Receipt, breakdown points.Breakdown) error {
+	s.saving <- struct{}{}
+	<-s.release
+	return s.Store.SaveReceipt(ctx, id, receipt, breakdown)
+}
+
+// withAsyncQueue queues async receipts for one worker, holding at most size
+// of them while it is busy.
+func withAsyncQueue(size int) serverOption {
+	return func(t testing.TB, s *Server) {
+		s.async = newAsyncQueue(size, 1)
+		s.async.run(s.storeQueued)
+	}
+}
+
+// processAsync posts receipt with async=true, expecting it to be queued.
+func processAsync(t *testing.T, h http.Handler, receipt string) string {
+	t.Helper()
+	rec := send(h, http.MethodPost, "/receipts/process?async=true", receipt)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("POST /receipts/process?async=true = %d %s, want 202", rec.Code, rec.Body)
+	}
+	var body struct{ ID string }
+	decodeBody(t, rec, &body)
+	return body.ID
+}
+
+// TestAsyncQueueFullAndDrain fills the queue behind a blocked worker, then
+// shuts it down and checks that what was queued is still stored.
+func TestAsyncQueueFullAndDrain(t *testing.T) {
+	store := &blockedStore{Store: newMemoryStore(), saving: make(chan struct{}, 2), release: make(chan struct{})}
+	s := newStoreServer(t, store, withAsyncQueue(1))
+	h := s.Handler()
+
+	working := processAsync(t, h, targetReceipt)
+	<-store.saving
+	queued := processAsync(t, h, marketReceipt)
+	for _, id := range []string{working, queued} {
+		rec := send(h, http.MethodGet, "/receipts/"+id+"/points", "")
+		if rec.Code != http.StatusNotFound || errorCode(t, rec) != codeReceiptPending || rec.Header().Get("Retry-After") != "1" {
+			t.Errorf("GET points of a pending receipt = %d %v %s, want 404 receipt_pending", rec.Code, rec.Header(), rec.Body)
+		}
+	}
+
+	rec := send(h, http.MethodPost, "/receipts/process?async=true", targetReceipt)
+	if rec.Code != http.StatusServiceUnavailable || errorCode(t, rec) != codeQueueFull || rec.Header().Get("Retry-After") != "1" {
+		t.Errorf("POST to a full queue = %d %v %s, want 503 queue_full", rec.Code, rec.Header(), rec.Body)
+	}
+
+	// Draining stops the queue at once, even when it gives up waiting.
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.Drain(canceled); !errors.Is(err, context.Canceled) {
+		t.Errorf("Drain with a canceled context = %v, want %v", err, context.Canceled)
+	}
+	rec = send(h, http.MethodPost, "/receipts/process?async=true", targetReceipt)
+	if rec.Code != http.StatusServiceUnavailable || errorCode(t, rec) != codeQueueFull {
+		t.Errorf("POST while draining = %d %s, want 503 queue_full", rec.Code, rec.Body)
+	}
+
+	close(store.release)
+	if err := s.Drain(context.Background()); err != nil {
+		t.Fatalf("Drain = %v", err)
+	}
+	if got := receiptPoints(t, h, working); got != 28 {
+		t.Errorf("points of the receipt being stored = %d, want 28", got)
+	}
+	if got := receiptPoints(t, h, queued); got != 109 {
+		t.Errorf("points of the queued receipt = %d, want 109", got)
+	}
+}
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+const (
+	// auditQueueSize is how many audit entries may wait to be written
+	// before new ones are dropped.
+	auditQueueSize = 10000
+	// auditBatchSize is how many queued entries are written at a time.
+	auditBatchSize = 100
+)
+
+// The actions audit entries record.
+const (
+	auditCreated  = "created"
+	auditUpdated  = "updated"
+	auditRescored = "rescored"
+	auditDeleted  = "deleted"
+	auditRestored = "restored"
+	auditImported = "imported"
+	auditEvicted  = "evicted"
+	auditPurged   = "purged"  // every receipt, by an admin
+	auditExpired  = "expired" // deleted receipts, once they can no longer be restored
+)
+
+var auditActions = []string{auditCreated, auditUpdated, auditRescored, auditDeleted, auditRestored, auditImported, auditEvicted, auditPurged, auditExpired}
+
+// auditEntry records one change to the stored receipts: who made it, through
+// which request, and what changed.
+type auditEntry struct {
+	Seq       uint64    `json:"seq"`
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	ReceiptID string    `json:"receiptId,omitempty"`
+	RequestID string    `json:"requestId,omitempty"`
+	Client    string    `json:"client,omitempty"` // the API key's name, or "admin"
+	Tenant    string    `json:"tenant,omitempty"`
+	Receipts  int       `json:"receipts,omitempty"` // how many receipts a purge removed
+	// Changes summarizes an update or rescore.
+	Changes *auditChanges `json:"changes,omitempty"`
+}
+
+// auditChanges summarizes how an update or rescore changed a receipt.
+type auditChanges struct {
+	// Fields lists the receipt fields an update changed.
+	Fields []string   `json:"fields,omitempty"`
+	Before auditState `json:"before"`
+	After  auditState `json:"after"`
+}
+
+type auditState struct {
+	Total  points.Money `json:"total"`
+	Points int          `json:"points"`
+}
+
+// newAuditEntry returns an entry for action on the receipt with id, made by
+// the request ctx belongs to.
+func newAuditEntry(ctx context.Context, action, id string) auditEntry {
+	return auditEntry{
+		Time:      time.Now().UTC(),
+		Action:    action,
+		ReceiptID: id,
+		RequestID: requestIDFrom(ctx),
+		Client:    requestInfoFrom(ctx).client,
+		Tenant:    ownerFrom(ctx),
+	}
+}
+
+// receiptChanges summarizes the change from one stored version of a
+// receipt to another.
+func receiptChanges(before points.Receipt, beforePoints int, after points.Receipt, afterPoints int) *auditChanges {
+	changes := &auditChanges{
+		Before: auditState{Total: before.Total, Points: beforePoints},
+		After:  auditState{Total: after.Total, Points: afterPoints},
+	}
+	for _, field := range []struct {
+		name          string
+		before, after any
+	}{
+		{"retailer", before.Retailer, after.Retailer},
+		{"purchaseDate", before.PurchaseDate, after.PurchaseDate},
+		{"purchaseTime", before.PurchaseTime, after.PurchaseTime},
+		{"total", before.Total, after.Total},
+		{"items", before.Items, after.Items},
+		{"timezone", before.Timezone, after.Timezone},
+	} {
+		if !reflect.DeepEqual(field.before, field.after) {
+			changes.Fields = append(changes.Fields, field.name)
+		}
+	}
+	return changes
+}
+
+// auditLog writes audit entries to a sink in the background, so that
+// recording a change never waits on the sink. Entries recorded while the
+// queue is full are dropped and counted instead. A nil *auditLog records
+// nothing.
+type auditLog struct {
+	sink   auditSink
+	queue  chan auditEntry
+	done   chan struct{}
+	logger *slog.Logger
+	// onDrop, if set, is told of each entry dropped.
+	onDrop  func()
+	dropped atomic.Uint64
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func newAuditLog(sink auditSink) *auditLog {
+	return &auditLog{
+		sink:   sink,
+		queue:  make(chan auditEntry, auditQueueSize),
+		done:   make(chan struct{}),
+		logger: slog.Default().With(slog.String("component", componentAudit)),
+	}
+}
+
+// record queues an entry for action on the receipt with id, made by the
+// request ctx belongs to.
+func (a *auditLog) record(ctx context.Context, action, id string, changes *auditChanges) {
+	if a == nil {
+		return
+	}
+	entry := newAuditEntry(ctx, action, id)
+	entry.Changes = changes
+	a.add(entry)
+}
+
+// add queues entry, dropping it if the queue is full or closed.
+func (a *auditLog) add(entry auditEntry) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.closed {
+		select {
+		case a.queue <- entry:
+			return
+		default:
+		}
+	}
+	a.dropped.Add(1)
+	if a.onDrop != nil {
+		a.onDrop()
+	}
+}
+
+// run writes queued entries until the log is closed and its queue empty.
+func (a *auditLog) run() {
+	defer close(a.done)
+	for entry := range a.queue {
+		batch := []auditEntry{entry}
+	fill:
+		for len(batch) < auditBatchSize {
+			select {
+			case entry, ok := <-a.queue:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, entry)
+			default:
+				break fill
+			}
+		}
+		if err := a.sink.append(batch); err != nil {
+			a.logger.Error("failed to write audit entries", slog.Int("entries", len(batch)), slog.Any("error", err))
+			a.dropped.Add(uint64(len(batch)))
+			for range batch {
+				if a.onDrop != nil {
+					a.onDrop()
+				}
+			}
+		}
+	}
+}
+
+// close stops the log accepting entries and waits for those queued to be
+// written, or for ctx to be done, then closes the sink.
+func (a *auditLog) close(ctx context.Context) error {
+	a.mu.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.queue)
+	}
+	a.mu.Unlock()
+
+	select {
+	case <-a.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return a.sink.Close()
+}
+
+// auditFilter selects audit entries by the receiptId, action, from and to
+// query parameters of GET /admin/audit.
+type auditFilter struct {
+	receiptID string
+	action    string
+	from, to  time.Time // inclusive; zero is unbounded
+}
+
+func (f auditFilter) matches(entry auditEntry) bool {
+	return (f.receiptID == "" || entry.ReceiptID == f.receiptID) &&
+		(f.action == "" || entry.Action == f.action) &&
+		(f.from.IsZero() || !entry.Time.Before(f.from)) &&
+		(f.to.IsZero() || !entry.Time.After(f.to))
+}
+
+// auditSink is where an auditLog keeps its entries, alongside the receipts
+// in the configured store.
+type auditSink interface {
+	// append stores entries, numbering them after those stored before.
+	append(entries []auditEntry) error
+	// query returns up to limit entries matching filter numbered after
+	// after, in order, and whether there are more.
+	query(ctx context.Context, filter auditFilter, after uint64, limit int) ([]auditEntry, bool, error)
+	Close() error
+}
+
+// openAuditSink returns the sink for the audit entries of store: a table of
+// its database, a log next to its own, or for a memory store, memory.
+func openAuditSink(store Store) (auditSink, error) {
+	switch store := store.(type) {
+	case *sqliteStore:
+		return &sqliteAudit{db: store.db}, nil
+	case *fileStore:
+		return openFileAudit(store.file.Name() + ".audit")
+	}
+	return &memoryAudit{}, nil
+}
+
+// memoryAudit keeps audit entries in memory.
+type memoryAudit struct {
+	mu      sync.RWMutex
+	entries []auditEntry // in order of Seq, from 1
+}
+
+func (m *memoryAudit) append(entries []auditEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, entry := range entries {
+		entry.Seq = uint64(len(m.entries)) + 1
+		m.entries = append(m.entries, entry)
+	}
+	return nil
+}
+
+func (m *memoryAudit) query(ctx context.Context, filter auditFilter, after uint64, limit int) ([]auditEntry, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var matched []auditEntry
+	for _, entry := range m.entries[min(after, uint64(len(m.entries))):] {
+		if !filter.matches(entry) {
+			continue
+		}
+		if len(matched) == limit {
+			return matched, true, nil
+		}
+		matched = append(matched, entry)
+	}
+	return matched, false, nil
+}
+
+func (m *memoryAudit) Close() error { return nil }
+
+// fileAudit keeps audit entries in memory and appends them to a JSON-lines
+// file, which is read back on startup.
+type fileAudit struct {
+	*memoryAudit
+	file *os.File
+}
+
+// openFileAudit opens the audit log at path, creating it if needed. As with
+// the fileStore log, a final line without a trailing newline is the remains
+// of an interrupted write and is discarded.
+func openFileAudit(path string) (*fileAudit, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	a := &fileAudit{memoryAudit: &memoryAudit{}, file: file}
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("reading %s: %w", path, err)
+		}
+		var entry auditEntry
+		if err := json.Unmarshal(bytes.TrimSpace(line), &entry); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("reading %s: offset %d: %w", path, offset, err)
+		}
+		a.entries = append(a.entries, entry)
+		offset += int64(len(line))
+	}
+	if err := file.Truncate(offset); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+func (f *fileAudit) append(entries []auditEntry) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var buf bytes.Buffer
+	numbered := make([]auditEntry, len(entries))
+	for i, entry := range entries {
+		entry.Seq = uint64(len(f.entries)+i) + 1
+		numbered[i] = entry
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(line, '\n'))
+	}
+	if _, err := f.file.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	f.entries = append(f.entries, numbered...)
+	return nil
+}
+
+func (f *fileAudit) Close() error {
+	return f.file.Close()
+}
+
+// sqliteAudit keeps audit entries in the audit_log table of the store's
+// database.
+type sqliteAudit struct {
+	db *sql.DB
+}
+
+func (s *sqliteAudit) append(entries []auditEntry) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO audit_log (at, action, receipt_id, entry) VALUES (?, ?, ?, ?)`,
+			entry.Time.UnixNano(), entry.Action, entry.ReceiptID, string(data)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteAudit) query(ctx context.Context, filter auditFilter, after uint64, limit int) ([]auditEntry, bool, error) {
+	var from, to int64
+	if !filter.from.IsZero() {
+		from = filter.from.UnixNano()
+	}
+	if !filter.to.IsZero() {
+		to = filter.to.UnixNano()
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT seq, entry FROM audit_log
+		WHERE seq > ? AND (? = '' OR receipt_id = ?) AND (? = '' OR action = ?) AND (? = 0 OR at >= ?) AND (? = 0 OR at <= ?)
+		ORDER BY seq LIMIT ?`,
+		after, filter.receiptID, filter.receiptID, filter.action, filter.action, from, from, to, to, limit+1)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	var entries []auditEntry
+	for rows.Next() {
+		var seq uint64
+		var data string
+		if err := rows.Scan(&seq, &data); err != nil {
+			return nil, false, err
+		}
+		var entry auditEntry
+		if err := json.Unmarshal([]byte(data), &entry); err != nil {
+			return nil, false, fmt.Errorf("audit entry %d: %w", seq, err)
+		}
+		entry.Seq = seq
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+	if len(entries) > limit {
+		return entries[:limit], true, nil
+	}
+	return entries, false, nil
+}
+
+// Close does nothing: the database is the store's to close.
+func (s *sqliteAudit) Close() error { return nil }
+
+type auditResponse struct {
+	Entries []auditEntry `json:"entries"`
+	// NextCursor is passed as ?cursor= to fetch the following page. It is
+	// omitted on the last page.
+	NextCursor string `json:"nextCursor,omitempty"`
+	// Dropped counts the entries dropped since the server started, because
+	// they came faster than they could be written.
+	Dropped uint64 `json:"dropped"`
+}
+
+// auditHandler handles GET /admin/audit, returning audit entries oldest
+// first, filtered by receiptId, action and a from and to time range, and
+// paged by cursor as GET /receipts is. Entries are written in the
+// background, so a change may take a moment to show up. The route only
+// exists when auditing is enabled.
+func (s *Server) auditHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	var errs []points.FieldError
+	filter := auditFilter{receiptID: query.Get("receiptId"), action: query.Get("action")}
+	if id, ok := s.idgen.ParseID(filter.receiptID); ok {
+		filter.receiptID = id
+	} else if filter.receiptID != "" {
+		errs = append(errs, points.FieldError{Field: "receiptId", Message: "must be a receipt ID"})
+	}
+	if filter.action != "" && !slices.Contains(auditActions, filter.action) {
+		errs = append(errs, points.FieldError{Field: "action", Message: fmt.Sprintf("must be one of %s", strings.Join(auditActions, ", "))})
+	}
+	for _, bound := range []struct {
+		name string
+		t    *time.Time
+	}{{"from", &filter.from}, {"to", &filter.to}} {
+		if v := query.Get(bound.name); v != "" {
+			t, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				errs = append(errs, points.FieldError{Field: bound.name, Message: "must be a timestamp in RFC 3339 format"})
+			}
+			*bound.t = t
+		}
+	}
+
+	limit := defaultListLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxListLimit {
+			errs = append(errs, points.FieldError{Field: "limit", Message: fmt.Sprintf("must be an integer between 1 and %d", maxListLimit)})
+		}
+		limit = n
+	}
+
+	var cursor uint64
+	if v := query.Get("cursor"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			errs = append(errs, points.FieldError{Field: "cursor", Message: "is not a cursor returned by this endpoint"})
+		}
+		cursor = n
+	}
+
+	if len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, codeInvalidQuery, "The query parameters are invalid.", errs...)
+		return
+	}
+
+	entries, more, err := s.audit.sink.query(r.Context(), filter, cursor, limit)
+	if err != nil {
+		s.writeStoreError(w, r, err)
+		return
+	}
+	response := auditResponse{Entries: entries, Dropped: s.audit.dropped.Load()}
+	if response.Entries == nil {
+		response.Entries = []auditEntry{}
+	}
+	if more {
+		response.NextCursor = strconv.FormatUint(entries[len(entries)-1].Seq, 10)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
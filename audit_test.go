@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// withAudit audits the server's changes to its store.
+func withAudit(t testing.TB, s *Server) {
+	sink, err := openAuditSink(s.store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.audit = newAuditLog(sink)
+	go s.audit.run()
+}
+
+// closeAudit writes out the audit entries s has queued, as shutdown does.
+func closeAudit(t *testing.T, s *Server) {
+	t.Helper()
+	if err := s.audit.close(context.Background()); err != nil {
+		t.Fatalf("closing the audit log: %v", err)
+	}
+}
+
+// auditEntries returns the entries GET /admin/audit?query returns.
+func auditEntries(t *testing.T, h http.Handler, query string) auditResponse {
+	t.Helper()
+	rec := sendAdmin(h, http.MethodGet, "/admin/audit?"+query, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /admin/audit?%s = %d %s", query, rec.Code, rec.Body)
+	}
+	var response auditResponse
+	decodeBody(t, rec, &response)
+	return response
+}
+
+func TestAuditUpdate(t *testing.T) {
+	eachStore(t, func(t *testing.T, store Store) {
+		s := newStoreServer(t, store, withAdmin, withAudit)
+		h := s.Handler()
+		id := processReceipt(t, h, targetReceipt)
+		if rec := send(h, http.MethodPut, "/receipts/"+id, marketReceipt, requestIDHeader, "the-update"); rec.Code != http.StatusOK {
+			t.Fatalf("PUT /receipts/%s = %d %s", id, rec.Code, rec.Body)
+		}
+		closeAudit(t, s)
+
+		response := auditEntries(t, h, "receiptId="+id)
+		if len(response.Entries) != 2 || response.Dropped != 0 {
+			t.Fatalf("audit of %s = %+v, want 2 entries", id, response)
+		}
+		created, updated := response.Entries[0], response.Entries[1]
+		if created.Action != auditCreated || created.Changes != nil {
+			t.Errorf("first entry = %+v, want its creation", created)
+		}
+		if updated.Action != auditUpdated || updated.ReceiptID != id || updated.RequestID != "the-update" || updated.Seq <= created.Seq {
+			t.Errorf("second entry = %+v, want the update by request the-update", updated)
+		}
+		changes := updated.Changes
+		if changes == nil {
+			t.Fatal("the update's entry has no changes")
+		}
+		if changes.Before != (auditState{Total: "35.35", Points: 28}) || changes.After != (auditState{Total: "9.00", Points: 109}) {
+			t.Errorf("update changed %+v to %+v, want 35.35 at 28 points to 9.00 at 109", changes.Before, changes.After)
+		}
+		if want := []string{"retailer", "purchaseDate", "purchaseTime", "total", "items"}; !slices.Equal(changes.Fields, want) {
+			t.Errorf("update changed fields %v, want %v", changes.Fields, want)
+		}
+	})
+}
+
+func TestAuditQuery(t *testing.T) {
+	s := newTestServer(t, withAdmin, withAudit)
+	h := s.Handler()
+	start := time.Now().UTC()
+	var ids []string
+	for range 3 {
+		ids = append(ids, processReceipt(t, h, targetReceipt))
+	}
+	if rec := send(h, http.MethodDelete, "/receipts/"+ids[1], ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE /receipts/%s = %d %s", ids[1], rec.Code, rec.Body)
+	}
+	closeAudit(t, s)
+
+	tests := []struct {
+		query   string
+		actions []string
+	}{
+		{"", []string{auditCreated, auditCreated, auditCreated, auditDeleted}},
+		{"action=deleted", []string{auditDeleted}},
+		{"receiptId=" + ids[1], []string{auditCreated, auditDeleted}},
+		{"receiptId=" + ids[1] + "&action=created", []string{auditCreated}},
+		{"from=" + url.QueryEscape(start.Format(time.RFC3339Nano)), []string{auditCreated, auditCreated, auditCreated, auditDeleted}},
+		{"to=" + url.QueryEscape(start.Add(-time.Second).Format(time.RFC3339Nano)), nil},
+	}
+	for _, tt := range tests {
+		var actions []string
+		for _, entry := range auditEntries(t, h, tt.query).Entries {
+			actions = append(actions, entry.Action)
+		}
+		if !slices.Equal(actions, tt.actions) {
+			t.Errorf("GET /admin/audit?%s actions = %v, want %v", tt.query, actions, tt.actions)
+		}
+	}
+
+	// Pages of one carry on where the last left off.
+	var seqs []uint64
+	for cursor := ""; ; {
+		response := auditEntries(t, h, "limit=1&cursor="+cursor)
+		for _, entry := range response.Entries {
+			seqs = append(seqs, entry.Seq)
+		}
+		if cursor = response.NextCursor; cursor == "" {
+			break
+		}
+	}
+	if !slices.Equal(seqs, []uint64{1, 2, 3, 4}) {
+		t.Errorf("paged entries %v, want 1 to 4", seqs)
+	}
+
+	for _, query := range []string{"action=edited", "receiptId=not-an-id", "from=yesterday", "limit=0", "cursor=abc"} {
+		if rec := sendAdmin(h, http.MethodGet, "/admin/audit?"+query, ""); rec.Code != http.StatusBadRequest || errorCode(t, rec) != codeInvalidQuery {
+			t.Errorf("GET /admin/audit?%s = %d %s, want 400", query, rec.Code, rec.Body)
+		}
+	}
+}
+
+// TestAuditSurvivesRestart checks that the entries of a file store's audit
+// log are read back when it is reopened, and numbered on from there.
+func TestAuditSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "receipts")
+	store := openTestStore(t, "file", path)
+	s := newStoreServer(t, store, withAdmin, withAudit)
+	id := processReceipt(t, s.Handler(), targetReceipt)
+	closeAudit(t, s)
+	store.Close()
+
+	s = newStoreServer(t, openTestStore(t, "file", path), withAdmin, withAudit)
+	h := s.Handler()
+	if rec := send(h, http.MethodDelete, "/receipts/"+id, ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE /receipts/%s = %d %s", id, rec.Code, rec.Body)
+	}
+	closeAudit(t, s)
+	entries := auditEntries(t, h, "receiptId="+id).Entries
+	if len(entries) != 2 || entries[0].Action != auditCreated || entries[1].Action != auditDeleted || entries[1].Seq != 2 {
+		t.Errorf("audit after a restart = %+v, want the creation then deletion", entries)
+	}
+}
+
+// TestAuditDropsWhenFull checks that recording never blocks: entries past a
+// full queue are counted and dropped.
+func TestAuditDropsWhenFull(t *testing.T) {
+	a := newAuditLog(&memoryAudit{})
+	var told int
+	a.onDrop = func() { told++ }
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range auditQueueSize + 5 {
+			a.record(context.Background(), auditCreated, "id", nil)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("recording blocked on a full queue")
+	}
+	if a.dropped.Load() != 5 || told != 5 {
+		t.Errorf("dropped %d, told of %d, want 5", a.dropped.Load(), told)
+	}
+
+	// Entries queued are written once the log runs, and closing waits
+	// for them.
+	go a.run()
+	if err := a.close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	entries, _, _ := a.sink.query(context.Background(), auditFilter{}, 0, auditQueueSize+5)
+	if len(entries) != auditQueueSize {
+		t.Errorf("wrote %d entries, want the %d queued", len(entries), auditQueueSize)
+	}
+	a.record(context.Background(), auditCreated, "id", nil)
+	if a.dropped.Load() != 6 {
+		t.Errorf("dropped %d after closing, want the entry recorded since", a.dropped.Load())
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// apiKey is a key accepted by the API-key middleware. Name identifies the
+// client in logs; the key itself is only kept as a hash.
+type apiKey struct {
+	Name  string
+	hash  [sha256.Size]byte
+	quota *keyQuota // nil for the -quota default
+}
+
+// parseAPIKeys parses comma- or newline-separated key entries. Each entry is
+// either "name:key" or a bare key, which is named after its position,
+// optionally followed by whitespace and the key's quota, as parseQuota
+// reads it: "basic:s3cret 1000/month". Blank entries and lines starting
+// with # are ignored.
+func parseAPIKeys(spec string) ([]apiKey, error) {
+	var keys []apiKey
+	spec = strings.ReplaceAll(spec, "\n", ",")
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		var quota *keyQuota
+		if fields := strings.Fields(entry); len(fields) > 1 {
+			if len(fields) > 2 {
+				return nil, fmt.Errorf("invalid API key entry %q", entry)
+			}
+			q, err := parseQuota(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("API key entry %q: %w", fields[0], err)
+			}
+			entry, quota = fields[0], &q
+		}
+		name, key, named := strings.Cut(entry, ":")
+		if !named {
+			name, key = fmt.Sprintf("key%d", len(keys)+1), entry
+		}
+		name, key = strings.TrimSpace(name), strings.TrimSpace(key)
+		if name == "" || key == "" {
+			return nil, fmt.Errorf("invalid API key entry %q", entry)
+		}
+		keys = append(keys, apiKey{Name: name, hash: sha256.Sum256([]byte(key)), quota: quota})
+	}
+	return keys, nil
+}
+
+// loadAPIKeys combines the keys listed in spec with those in the file at
+// path, if path is not empty.
+func loadAPIKeys(spec, path string) ([]apiKey, error) {
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		spec += "\n" + string(data)
+	}
+	return parseAPIKeys(spec)
+}
+
+// authRule selects requests that need an API key: those with the given
+// method ("*" for any) whose path starts with prefix.
+type authRule struct {
+	method string
+	prefix string
+}
+
+// parseAuthRules parses a comma-separated list of rules, each a method
+// optionally followed by a space and a path prefix, e.g. "POST,GET /admin".
+func parseAuthRules(spec string) ([]authRule, error) {
+	var rules []authRule
+	for _, entry := range strings.Split(spec, ",") {
+		fields := strings.Fields(entry)
+		switch len(fields) {
+		case 0:
+			continue
+		case 1:
+			rules = append(rules, authRule{method: strings.ToUpper(fields[0]), prefix: "/"})
+		case 2:
+			if !strings.HasPrefix(fields[1], "/") {
+				return nil, fmt.Errorf("invalid auth rule %q: path must start with /", entry)
+			}
+			rules = append(rules, authRule{method: strings.ToUpper(fields[0]), prefix: fields[1]})
+		default:
+			return nil, fmt.Errorf("invalid auth rule %q", entry)
+		}
+	}
+	return rules, nil
+}
+
+func (rule authRule) matches(method, path string) bool {
+	return (rule.method == "*" || rule.method == method) && strings.HasPrefix(path, rule.prefix)
+}
+
+// authenticate requires requests matching one of s.authRules to carry one of
+// s.apiKeys, either as a bearer token or in X-Api-Key. It is a no-op when no
+// keys are configured.
+//
+// With tenant isolation, every request is scoped to a tenant: the key's, or
+// the anonymous tenant if a request that needs no key carries none. A key
+// sent where none is needed must then still be valid.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		required := s.requiresAuth(r.Method, r.URL.Path)
+		if len(s.apiKeys) == 0 || (!required && !s.features.get().IsolateTenants) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := r.Header.Get("X-Api-Key")
+		if key == "" {
+			key, _ = strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		}
+		if key == "" && !required {
+			next.ServeHTTP(w, r.WithContext(withTenant(r.Context(), "")))
+			return
+		}
+		if key == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+			writeError(w, http.StatusUnauthorized, codeUnauthorized, "An API key is required")
+			return
+		}
+		name, ok := s.lookupAPIKey(key)
+		if !ok {
+			writeError(w, http.StatusForbidden, codeForbidden, "The API key is not valid")
+			return
+		}
+		requestInfoFrom(r.Context()).client = name
+		ctx := withAPIKey(r.Context(), name)
+		if s.features.get().IsolateTenants {
+			ctx = withTenant(ctx, name)
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requiresAuth reports whether a request with method and path needs an API
+// key. GET /quota reports on the caller's key, so it always does.
+func (s *Server) requiresAuth(method, path string) bool {
+	if path == "/quota" {
+		return true
+	}
+	for _, rule := range s.authRules {
+		if rule.matches(method, path) {
+			return true
+		}
+	}
+	return false
+}
+
+type apiKeyNameKey struct{}
+
+// withAPIKey returns a copy of ctx for a request authenticated with the API
+// key named name.
+func withAPIKey(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, apiKeyNameKey{}, name)
+}
+
+// apiKeyFrom returns the name of the API key the request ctx belongs to was
+// authenticated with, or "" if it carried none.
+func apiKeyFrom(ctx context.Context) string {
+	name, _ := ctx.Value(apiKeyNameKey{}).(string)
+	return name
+}
+
+// lookupAPIKey returns the name of the key matching key. Every configured key
+// is compared, in constant time, so timing does not reveal which one
+// matched or how close a guess came.
+func (s *Server) lookupAPIKey(key string) (string, bool) {
+	hash := sha256.Sum256([]byte(key))
+	name, found := "", false
+	for _, k := range s.apiKeys {
+		if subtle.ConstantTimeCompare(hash[:], k.hash[:]) == 1 {
+			name, found = k.Name, true
+		}
+	}
+	return name, found
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+// batchResult is the outcome for one receipt of a batch, reported in the
+// same position as the receipt in the request.
+type batchResult struct {
+	ID        string     `json:"id,omitempty"`
+	Duplicate bool       `json:"duplicate,omitempty"`
+	Cap       *capResult `json:"cap,omitempty"`
+	Index     *int       `json:"index,omitempty"`
+	Error     *apiError  `json:"error,omitempty"`
+}
+
+// processBatchHandler handles POST /receipts/process/batch. Each receipt is
+// validated and stored independently, so one bad receipt does not reject
+// the rest of the batch. The receipts are scored on s.workers goroutines and
+// stored in order, so that which of two identical receipts is the duplicate
+// does not depend on which was scored first, and results are written as
+// they are stored.
+func (s *Server) processBatchHandler(w http.ResponseWriter, r *http.Request) {
+	var batch []json.RawMessage
+	if err := decodeJSON(r, &batch, "Batch must be a JSON array of receipts"); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if len(batch) == 0 {
+		writeError(w, http.StatusBadRequest, codeInvalidBody, "Batch must contain at least one receipt")
+		return
+	}
+	if len(batch) > s.batchLimit {
+		writeError(w, http.StatusRequestEntityTooLarge, codeBatchTooLarge,
+			fmt.Sprintf("Batch contains %d receipts; the limit is %d", len(batch), s.batchLimit))
+		return
+	}
+
+	ctx := r.Context()
+	strict := s.strictTotalsFor(r)
+	w.Header().Set("Content-Type", "application/json")
+	results := &jsonArrayWriter{w: w}
+	write := func(i int, result batchResult) {
+		if result.Error != nil {
+			index := i
+			result.Index = &index
+			result.Error = result.Error.in(responseLocale(w))
+		}
+		results.write(result)
+	}
+
+	stored := 0
+	err := runOrdered(ctx, s.workers, sliceInputs(len(batch)),
+		func(i int) scoredReceipt { return s.scoreBatchItem(batch[i], strict) },
+		func(i int, v any) scoredReceipt { return scoredReceipt{err: s.scoringPanic(ctx, v)} },
+		func(i int, scored scoredReceipt) bool {
+			write(i, s.storeBatchItem(ctx, scored))
+			stored++
+			return true
+		})
+	if err != nil {
+		// The receipts not yet stored are reported as timed out, as they
+		// would have been by the store.
+		for i := stored; i < len(batch); i++ {
+			write(i, batchResult{Error: s.storeError(ctx, err)})
+		}
+	}
+	results.close()
+}
+
+// scoredReceipt is a receipt of a batch or upload as scoreReceipt left it,
+// ready to be stored.
+type scoredReceipt struct {
+	receipt   points.Receipt
+	breakdown points.Breakdown
+	err       *apiError
+}
+
+func (s *Server) scoreBatchItem(raw json.RawMessage, strict bool) scoredReceipt {
+	var receipt points.Receipt
+	if err := json.Unmarshal(raw, &receipt); err != nil {
+		return scoredReceipt{err: newAPIError(http.StatusBadRequest, codeInvalidBody, "Invalid receipt format")}
+	}
+	receipt, breakdown, err := s.scoreReceipt(receipt, strict)
+	return scoredReceipt{receipt: receipt, breakdown: breakdown, err: err}
+}
+
+func (s *Server) storeBatchItem(ctx context.Context, scored scoredReceipt) batchResult {
+	if scored.err != nil {
+		return batchResult{Error: scored.err}
+	}
+	result, err := s.storeScored(ctx, scored.receipt, scored.breakdown)
+	if err != nil {
+		return batchResult{Error: err}
+	}
+	return batchResult{ID: s.ids.external(result.ID), Duplicate: result.Duplicate, Cap: result.Cap}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+// invalidItemsReceipt is targetReceipt with its fourth item's price and its
+// last item's description invalid.
+var invalidItemsReceipt = strings.NewReplacer(`"3.35"`, `"3.5"`, "Klarbrunn 12-PK 12 FL OZ", "Klarbrunn 12-PK 12 FL OZ!").Replace(targetReceipt)
+
+// checkItemPointers checks that details are those of invalidItemsReceipt.
+func checkItemPointers(t *testing.T, where string, details []points.FieldError) {
+	t.Helper()
+	var pointers []string
+	for _, detail := range details {
+		pointers = append(pointers, detail.Pointer+" "+detail.Constraint)
+	}
+	if got, want := strings.Join(pointers, ", "), "/items/3/price format, /items/4/shortDescription pattern"; got != want {
+		t.Errorf("%s details = %s, want %s", where, got, want)
+	}
+}
+
+func TestBatchFieldPointers(t *testing.T) {
+	h := newTestServer(t).Handler()
+	rec := send(h, http.MethodPost, "/receipts/process/batch", "["+targetReceipt+","+invalidItemsReceipt+","+marketReceipt+"]")
+	var results []batchResult
+	decodeBody(t, rec, &results)
+	if rec.Code != http.StatusOK || len(results) != 3 || results[0].ID == "" || results[2].ID == "" ||
+		results[1].Error == nil || results[1].Index == nil || *results[1].Index != 1 {
+		t.Fatalf("POST /receipts/process/batch = %d %s, want the second receipt refused", rec.Code, rec.Body)
+	}
+	checkItemPointers(t, "batch result 1", results[1].Error.Details)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrBlobNotFound is returned by a BlobStore when nothing is stored under the
+// requested key.
+var ErrBlobNotFound = errors.New("blob not found")
+
+// Blob describes the contents stored under a key of a BlobStore.
+type Blob struct {
+	ContentType string    `json:"contentType"`
+	Size        int64     `json:"size"`
+	SHA256      string    `json:"sha256"` // hex
+	ModTime     time.Time `json:"modTime"`
+}
+
+// BlobStore holds opaque contents, such as receipt images, by key. Keys are
+// chosen by the caller and must be usable as file names. Implementations
+// must be safe for concurrent use.
+type BlobStore interface {
+	// Put stores data under key with its media type, replacing anything
+	// stored there before.
+	Put(ctx context.Context, key, contentType string, data []byte) (Blob, error)
+	// Stat describes what is stored under key, or returns ErrBlobNotFound.
+	Stat(ctx context.Context, key string) (Blob, error)
+	// Open returns what is stored under key and a reader of its contents,
+	// which the caller must close, or ErrBlobNotFound.
+	Open(ctx context.Context, key string) (Blob, io.ReadSeekCloser, error)
+	// Delete removes what is stored under key. It is not an error if
+	// nothing is.
+	Delete(ctx context.Context, key string) error
+	// Purge removes everything, returning how many blobs were removed.
+	Purge(ctx context.Context) (int, error)
+}
+
+// newBlob describes data stored now with contentType.
+func newBlob(contentType string, data []byte) Blob {
+	sum := sha256.Sum256(data)
+	return Blob{ContentType: contentType, Size: int64(len(data)), SHA256: hex.EncodeToString(sum[:]), ModTime: time.Now().UTC()}
+}
+
+// memoryBlobStore is a BlobStore backed by an in-process map, whose contents
+// are lost on restart.
+type memoryBlobStore struct {
+	mu    sync.RWMutex
+	blobs map[string]memoryBlob
+}
+
+type memoryBlob struct {
+	Blob
+	data []byte
+}
+
+func newMemoryBlobStore() *memoryBlobStore {
+	return &memoryBlobStore{blobs: make(map[string]memoryBlob)}
+}
+
+func (s *memoryBlobStore) Put(ctx context.Context, key, contentType string, data []byte) (Blob, error) {
+	blob := newBlob(contentType, data)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blobs[key] = memoryBlob{Blob: blob, data: bytes.Clone(data)}
+	return blob, nil
+}
+
+func (s *memoryBlobStore) Stat(ctx context.Context, key string) (Blob, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	stored, ok := s.blobs[key]
+	if !ok {
+		return Blob{}, ErrBlobNotFound
+	}
+	return stored.Blob, nil
+}
+
+func (s *memoryBlobStore) Open(ctx context.Context, key string) (Blob, io.ReadSeekCloser, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	stored, ok := s.blobs[key]
+	if !ok {
+		return Blob{}, nil, ErrBlobNotFound
+	}
+	// The data is never written to once stored, so it can be read after
+	// the lock is released.
+	return stored.Blob, nopSeekCloser{bytes.NewReader(stored.data)}, nil
+}
+
+func (s *memoryBlobStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.blobs, key)
+	return nil
+}
+
+func (s *memoryBlobStore) Purge(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := len(s.blobs)
+	clear(s.blobs)
+	return n, nil
+}
+
+type nopSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopSeekCloser) Close() error { return nil }
+
+// fileBlobStore is a BlobStore that keeps each blob in a file of its own in
+// dir, named by its key, with a description of it beside it in key.json.
+type fileBlobStore struct {
+	dir string
+}
+
+// blobMetaSuffix ends the names of the files describing blobs.
+const blobMetaSuffix = ".json"
+
+// openFileBlobStore returns a BlobStore keeping blobs in dir, creating dir if
+// it does not exist.
+func openFileBlobStore(dir string) (*fileBlobStore, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("creating blob directory: %w", err)
+	}
+	return &fileBlobStore{dir: dir}, nil
+}
+
+// path returns the path of the file holding the blob stored under key.
+func (s *fileBlobStore) path(key string) (string, error) {
+	if key == "" || strings.HasPrefix(key, ".") || strings.ContainsAny(key, `/\`) || strings.HasSuffix(key, blobMetaSuffix) {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return filepath.Join(s.dir, key), nil
+}
+
+// Put writes the contents before the description, so that a blob is only
+// found once it is whole; a crash in between leaves a file that a later Put
+// or Delete of the key replaces.
+func (s *fileBlobStore) Put(ctx context.Context, key, contentType string, data []byte) (Blob, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return Blob{}, err
+	}
+	blob := newBlob(contentType, data)
+	meta, err := json.Marshal(blob)
+	if err != nil {
+		return Blob{}, err
+	}
+	if err := writeFileAtomic(path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	}); err != nil {
+		return Blob{}, err
+	}
+	if err := writeFileAtomic(path+blobMetaSuffix, func(w io.Writer) error {
+		_, err := w.Write(meta)
+		return err
+	}); err != nil {
+		return Blob{}, err
+	}
+	return blob, nil
+}
+
+func (s *fileBlobStore) Stat(ctx context.Context, key string) (Blob, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return Blob{}, err
+	}
+	data, err := os.ReadFile(path + blobMetaSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return Blob{}, ErrBlobNotFound
+	}
+	if err != nil {
+		return Blob{}, err
+	}
+	var blob Blob
+	if err := json.Unmarshal(data, &blob); err != nil {
+		return Blob{}, fmt.Errorf("reading description of blob %s: %w", key, err)
+	}
+	return blob, nil
+}
+
+func (s *fileBlobStore) Open(ctx context.Context, key string) (Blob, io.ReadSeekCloser, error) {
+	blob, err := s.Stat(ctx, key)
+	if err != nil {
+		return Blob{}, nil, err
+	}
+	path, _ := s.path(key)
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		// Deleted since it was described.
+		return Blob{}, nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return Blob{}, nil, err
+	}
+	return blob, f, nil
+}
+
+// Delete removes the description first, so that the blob is not found even
+// if removing its contents fails.
+func (s *fileBlobStore) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{path + blobMetaSuffix, path} {
+		if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fileBlobStore) Purge(ctx context.Context) (int, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, entry := range entries {
+		key, ok := strings.CutSuffix(entry.Name(), blobMetaSuffix)
+		if !ok || entry.IsDir() {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return removed, err
+		}
+		if err := s.Delete(ctx, key); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/y1zhuo/receipt-processor-challenge/api"
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+// dailyCapRule names the breakdown entry of a receipt whose points were
+// capped.
+const dailyCapRule = "daily-cap"
+
+// capKey identifies the receipts that share a daily cap: those of one
+// tenant from one retailer with the same purchase date.
+type capKey struct {
+	tenant   string
+	retailer string // as normalized by retailerKey
+	date     string
+}
+
+// dailyCaps holds the receipts of each retailer to at most limit points per
+// purchase date. It counts the points awarded to every stored receipt, and
+// is rebuilt from the store on startup like the retailer index, so it
+// persists as the store does.
+type dailyCaps struct {
+	limit int
+
+	mu       sync.Mutex
+	earned   map[capKey]int
+	receipts map[string]cappedReceipt // receipt ID -> what it counts toward
+}
+
+type cappedReceipt struct {
+	key    capKey
+	points int
+}
+
+// capResult reports how a daily cap reduced the points of a receipt.
+type capResult = api.DailyCap
+
+func newDailyCaps(limit int) *dailyCaps {
+	return &dailyCaps{limit: limit, earned: make(map[capKey]int), receipts: make(map[string]cappedReceipt)}
+}
+
+// load counts every receipt in store.
+func (c *dailyCaps) load(store Store) error {
+	return scanPaged(context.Background(), store, func(stored StoredReceipt) error {
+		c.add(stored.ID, stored.Tenant, stored.Receipt, stored.Points)
+		return nil
+	})
+}
+
+func newCapKey(tenant string, receipt points.Receipt) capKey {
+	return capKey{tenant: tenant, retailer: retailerKey(receipt.Retailer), date: receipt.PurchaseDate}
+}
+
+// award caps breakdown, the score of the receipt to be stored under id for
+// tenant, to what is left of its retailer's cap for the day, and counts the
+// points awarded. The result is nil unless the points were reduced. undo
+// puts the counts back as they were, for when the receipt is not stored
+// after all.
+func (c *dailyCaps) award(id, tenant string, receipt points.Receipt, breakdown points.Breakdown) (capped points.Breakdown, result *capResult, undo func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.awardLocked(id, newCapKey(tenant, receipt), receipt, breakdown)
+}
+
+// reaward is award for a receipt already counted, whose new score replaces
+// its old one. The receipt keeps the tenant it was counted for.
+func (c *dailyCaps) reaward(id string, receipt points.Receipt, breakdown points.Breakdown) (points.Breakdown, *capResult, func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.awardLocked(id, newCapKey(c.receipts[id].key.tenant, receipt), receipt, breakdown)
+}
+
+func (c *dailyCaps) awardLocked(id string, key capKey, receipt points.Receipt, breakdown points.Breakdown) (points.Breakdown, *capResult, func()) {
+	previous, counted := c.receipts[id]
+	c.removeLocked(id)
+
+	earned := c.earned[key]
+	if left := max(c.limit-earned, 0); breakdown.Total > left {
+		result := &capResult{Limit: c.limit, Uncapped: breakdown.Total, Points: left}
+		// The rules are copied, so the caller's breakdown is left as it
+		// was.
+		breakdown.Rules = append(breakdown.Rules[:len(breakdown.Rules):len(breakdown.Rules)], points.RuleResult{
+			Rule:        dailyCapRule,
+			Description: fmt.Sprintf("At most %d points a day from each retailer's receipts.", c.limit),
+			Points:      left - breakdown.Total,
+			Details: []string{
+				fmt.Sprintf("receipts from %q dated %s had already earned %d points", strings.TrimSpace(receipt.Retailer), receipt.PurchaseDate, earned),
+				fmt.Sprintf("%d points capped to %d", breakdown.Total, left),
+			},
+		})
+		breakdown.Total = left
+		c.addLocked(id, key, left)
+		return breakdown, result, c.undo(id, previous, counted)
+	}
+	c.addLocked(id, key, breakdown.Total)
+	return breakdown, nil, c.undo(id, previous, counted)
+}
+
+func (c *dailyCaps) undo(id string, previous cappedReceipt, counted bool) func() {
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.removeLocked(id)
+		if counted {
+			c.addLocked(id, previous.key, previous.points)
+		}
+	}
+}
+
+// add counts points as awarded to the receipt stored under id for tenant,
+// whether or not they fit its cap, as for a receipt restored or loaded as
+// it was.
+func (c *dailyCaps) add(id, tenant string, receipt points.Receipt, points int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(id)
+	c.addLocked(id, newCapKey(tenant, receipt), points)
+}
+
+func (c *dailyCaps) addLocked(id string, key capKey, points int) {
+	c.earned[key] += points
+	c.receipts[id] = cappedReceipt{key: key, points: points}
+}
+
+// remove stops counting the receipt with id, if it is counted.
+func (c *dailyCaps) remove(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(id)
+}
+
+func (c *dailyCaps) removeLocked(id string) {
+	entry, ok := c.receipts[id]
+	if !ok {
+		return
+	}
+	delete(c.receipts, id)
+	if c.earned[entry.key] -= entry.points; c.earned[entry.key] <= 0 {
+		delete(c.earned, entry.key)
+	}
+}
+
+func (c *dailyCaps) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.earned = make(map[capKey]int)
+	c.receipts = make(map[string]cappedReceipt)
+}
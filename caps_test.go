@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/y1zhuo/receipt-processor-challenge/api"
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+// capLimit is the daily cap of withCaps, which a third targetReceipt, worth
+// 28 points, straddles.
+const capLimit = 60
+
+// withCaps caps each retailer's points a day at capLimit, counting the
+// receipts the store already holds.
+func withCaps(t testing.TB, s *Server) {
+	s.caps = newDailyCaps(capLimit)
+	if err := s.caps.load(s.store); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// processCapped processes receipt, returning its ID and how a cap reduced
+// its points.
+func processCapped(t *testing.T, h http.Handler, receipt string, header ...string) (string, *api.DailyCap) {
+	t.Helper()
+	rec := send(h, http.MethodPost, "/receipts/process", receipt, header...)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST /receipts/process = %d %s, want 201", rec.Code, rec.Body)
+	}
+	var body api.ProcessResponse
+	decodeBody(t, rec, &body)
+	return body.ID, body.Cap
+}
+
+func TestDailyCapStraddlesBoundary(t *testing.T) {
+	h := newTestServer(t, withAdmin, withCaps).Handler()
+
+	var ids []string
+	for i, want := range []*api.DailyCap{nil, nil, {Limit: capLimit, Uncapped: 28, Points: 4}} {
+		id, capped := processCapped(t, h, targetReceipt)
+		if (capped == nil) != (want == nil) || (capped != nil && *capped != *want) {
+			t.Errorf("receipt %d capped %+v, want %+v", i+1, capped, want)
+		}
+		ids = append(ids, id)
+	}
+	for i, want := range []int{28, 28, 4} {
+		if got := receiptPoints(t, h, ids[i]); got != want {
+			t.Errorf("receipt %d has %d points, want %d", i+1, got, want)
+		}
+	}
+
+	var breakdown points.Breakdown
+	decodeBody(t, send(h, http.MethodGet, "/receipts/"+ids[2]+"/breakdown", ""), &breakdown)
+	last := breakdown.Rules[len(breakdown.Rules)-1]
+	if breakdown.Total != 4 || last.Rule != dailyCapRule || last.Points != -24 {
+		t.Errorf("capped breakdown totals %d ending with %+v, want the cap taking 24 points", breakdown.Total, last)
+	}
+
+	// Once the cap is reached, receipts earn nothing, but receipts of
+	// another day or retailer are not held to it.
+	if _, capped := processCapped(t, h, targetReceipt); capped == nil || capped.Points != 0 {
+		t.Errorf("receipt past the cap capped %+v, want 0 points", capped)
+	}
+	if _, capped := processCapped(t, h, strings.Replace(targetReceipt, "2022-01-01", "2022-01-03", 1)); capped != nil {
+		t.Errorf("receipt of another day capped %+v", capped)
+	}
+	if _, capped := processCapped(t, h, strings.Replace(targetReceipt, `"Target"`, `"Walgreens"`, 1)); capped != nil {
+		t.Errorf("receipt of another retailer capped %+v", capped)
+	}
+}
+
+func TestDailyCapFollowsChanges(t *testing.T) {
+	s := newTestServer(t, withAdmin, withCaps)
+	h := s.Handler()
+	first, _ := processCapped(t, h, targetReceipt)
+	processCapped(t, h, targetReceipt)
+	third, _ := processCapped(t, h, targetReceipt)
+
+	// Deleting a receipt gives its points back to the day.
+	if rec := send(h, http.MethodDelete, "/receipts/"+first, ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE = %d %s, want 204", rec.Code, rec.Body)
+	}
+	if _, capped := processCapped(t, h, targetReceipt); capped != nil {
+		t.Errorf("receipt after a delete capped %+v, want the 28 points freed", capped)
+	}
+
+	// An update is capped against the others alone, not its old score.
+	rec := send(h, http.MethodPut, "/receipts/"+third, strings.Replace(targetReceipt, `"total": "35.35"`, `"total": "36.00"`, 1))
+	var updated struct {
+		Points int
+		Cap    *api.DailyCap
+	}
+	decodeBody(t, rec, &updated)
+	if updated.Points != 4 || updated.Cap == nil || updated.Cap.Uncapped != 103 {
+		t.Errorf("PUT = %d %s, want 103 points capped to 4", rec.Code, rec.Body)
+	}
+
+	// Recalculating scores every receipt higher, but the day still earns
+	// no more than the cap.
+	old := rules.get()
+	t.Cleanup(func() { rules.set(old) })
+	config := old
+	config.Version = "double-retailer"
+	config.RetailerName.PointsPerCharacter = 2
+	rules.set(config)
+	if rec := sendAdmin(h, http.MethodPost, "/admin/recalculate", ""); rec.Code != http.StatusOK {
+		t.Fatalf("POST /admin/recalculate = %d %s, want 200", rec.Code, rec.Body)
+	}
+	total := 0
+	for id := range s.caps.receipts {
+		total += receiptPoints(t, h, id)
+	}
+	if total != capLimit || s.caps.earned[newCapKey("", parseReceipt(t, targetReceipt))] != capLimit {
+		t.Errorf("the day earned %d points after recalculating, counted %v, want %d", total, s.caps.earned, capLimit)
+	}
+}
+
+func TestDailyCapPerTenant(t *testing.T) {
+	h := newTestServer(t, withAdmin, withTenants, withCaps).Handler()
+
+	processCapped(t, h, targetReceipt, "X-Api-Key", "key-a")
+	processCapped(t, h, targetReceipt, "X-Api-Key", "key-a")
+	if _, capped := processCapped(t, h, targetReceipt, "X-Api-Key", "key-b"); capped != nil {
+		t.Errorf("b's receipt capped %+v by a's", capped)
+	}
+	if _, capped := processCapped(t, h, targetReceipt, "X-Api-Key", "key-a"); capped == nil || capped.Points != 4 {
+		t.Errorf("a's third receipt capped %+v, want 4 points", capped)
+	}
+}
+
+func TestDailyCapAcrossRestart(t *testing.T) {
+	for _, kind := range []string{"file", "sqlite"} {
+		t.Run(kind, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "receipts")
+			store, err := openStore(kind, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := newStoreServer(t, store, withCaps).Handler()
+			processCapped(t, h, targetReceipt)
+			processCapped(t, h, targetReceipt)
+			store.Close()
+
+			h = newStoreServer(t, openTestStore(t, kind, path), withCaps).Handler()
+			if _, capped := processCapped(t, h, targetReceipt); capped == nil || capped.Points != 4 {
+				t.Errorf("third receipt after a restart capped %+v, want 4 points", capped)
+			}
+		})
+	}
+}
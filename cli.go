@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+// Exit codes of the score command.
+const (
+	scoreExitOK      = 0
+	scoreExitInvalid = 1 // at least one receipt was invalid
+	scoreExitUsage   = 2 // bad arguments or unreadable input
+)
+
+// scoreResult is the outcome of scoring one receipt file.
+type scoreResult struct {
+	File      string            `json:"file"`
+	Points    *int              `json:"points,omitempty"`
+	Breakdown *points.Breakdown `json:"breakdown,omitempty"`
+	Error     *apiError         `json:"error,omitempty"`
+}
+
+// scoreSummary totals the results of a score run.
+type scoreSummary struct {
+	Files   int `json:"files"`
+	Valid   int `json:"valid"`
+	Invalid int `json:"invalid"`
+	Points  int `json:"points"`
+}
+
+// runScore implements "receipt-processor score": it scores receipt files
+// offline, through the same validation and scoring as POST /receipts/process,
+// and returns the process exit code. Arguments are files, directories (every
+// *.json file in them) or glob patterns; with none, or "-", the receipt is
+// read from stdin.
+func runScore(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("receipt-processor score", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var files []string
+	fs.Func("f", "receipt file, directory or glob to score; may be repeated", func(v string) error {
+		files = append(files, v)
+		return nil
+	})
+	format := fs.String("format", "table", "output format: table or json")
+	withBreakdown := fs.Bool("breakdown", false, "include the points awarded by each rule")
+	strictTotals := fs.Bool("strict-totals", false, "reject receipts whose total is not the sum of their item prices")
+	rulesPath := fs.String("rules", "", "path to a JSON file overriding the default scoring rules")
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: receipt-processor score [flags] [file|dir|glob ...]\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return scoreExitOK
+		}
+		return scoreExitUsage
+	}
+	if *format != "table" && *format != "json" {
+		fmt.Fprintf(stderr, "score: unknown format %q\n", *format)
+		return scoreExitUsage
+	}
+	if *rulesPath != "" {
+		config, err := points.LoadRulesConfig(*rulesPath)
+		if err != nil {
+			fmt.Fprintf(stderr, "score: loading rules: %v\n", err)
+			return scoreExitUsage
+		}
+		rules.set(config)
+	}
+
+	paths, err := expandScorePaths(append(files, fs.Args()...))
+	if err != nil {
+		fmt.Fprintf(stderr, "score: %v\n", err)
+		return scoreExitUsage
+	}
+
+	scorer := newServer(newMemoryStore())
+	var results []scoreResult
+	var summary scoreSummary
+	for _, path := range paths {
+		data, err := readScoreInput(path, stdin)
+		if err != nil {
+			fmt.Fprintf(stderr, "score: %v\n", err)
+			return scoreExitUsage
+		}
+
+		result := scoreResult{File: path}
+		var receipt points.Receipt
+		if apiErr := decodeStrict(bytes.NewReader(data), &receipt, "Invalid receipt format"); apiErr != nil {
+			result.Error = apiErr
+		} else if _, breakdown, apiErr := scorer.scoreReceipt(receipt, *strictTotals); apiErr != nil {
+			result.Error = apiErr
+		} else {
+			result.Points = &breakdown.Total
+			if *withBreakdown {
+				result.Breakdown = &breakdown
+			}
+		}
+
+		summary.Files++
+		if result.Error != nil {
+			summary.Invalid++
+		} else {
+			summary.Valid++
+			summary.Points += *result.Points
+		}
+		results = append(results, result)
+	}
+
+	if *format == "json" {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(struct {
+			Results []scoreResult `json:"results"`
+			Summary scoreSummary  `json:"summary"`
+		}{results, summary})
+	} else {
+		writeScoreTable(stdout, results, summary)
+	}
+
+	if summary.Invalid > 0 {
+		return scoreExitInvalid
+	}
+	return scoreExitOK
+}
+
+// expandScorePaths resolves the score command's arguments to a list of files,
+// with "-" standing for stdin.
+func expandScorePaths(args []string) ([]string, error) {
+	if len(args) == 0 {
+		return []string{"-"}, nil
+	}
+
+	var paths []string
+	for _, arg := range args {
+		if arg == "-" {
+			paths = append(paths, arg)
+			continue
+		}
+		if strings.ContainsAny(arg, "*?[") {
+			matches, err := filepath.Glob(arg)
+			if err != nil {
+				return nil, fmt.Errorf("bad pattern %q: %w", arg, err)
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no files match %q", arg)
+			}
+			paths = append(paths, matches...)
+			continue
+		}
+
+		info, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			paths = append(paths, arg)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(arg, "*.json"))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(matches)
+		paths = append(paths, matches...)
+	}
+	return paths, nil
+}
+
+func readScoreInput(path string, stdin io.Reader) ([]byte, error) {
+	if path == "-" {
+		return io.ReadAll(stdin)
+	}
+	return os.ReadFile(path)
+}
+
+// writeScoreTable writes results in a human-readable form, followed by a
+// summary line when more than one file was scored.
+func writeScoreTable(w io.Writer, results []scoreResult, summary scoreSummary) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, result := range results {
+		if result.Error != nil {
+			fmt.Fprintf(tw, "%s\tinvalid\t%s\n", result.File, result.Error.Message)
+			for _, detail := range result.Error.Details {
+				fmt.Fprintf(tw, "\t\t%s\n", detail.Error())
+			}
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%d points\t\n", result.File, *result.Points)
+		if result.Breakdown != nil {
+			for _, rule := range result.Breakdown.Rules {
+				fmt.Fprintf(tw, "\t%s\t%d\n", rule.Rule, rule.Points)
+				if rule.Rule == "retailer-name" && result.Breakdown.Retailer != nil {
+					excluded := 0
+					for _, char := range result.Breakdown.Retailer.Excluded {
+						excluded += char.Count
+					}
+					fmt.Fprintf(tw, "\t  %d characters counted, %d not\t\n", result.Breakdown.Retailer.Counted, excluded)
+				}
+				if rule.Rule != "item-description-length" {
+					continue
+				}
+				for _, item := range result.Breakdown.Items {
+					fmt.Fprintf(tw, "\t  %q (%d characters)\t%d\n", item.Description, item.Length, item.Points)
+				}
+			}
+		}
+	}
+	tw.Flush()
+
+	if summary.Files > 1 {
+		fmt.Fprintf(w, "\n%d files: %d valid, %d invalid, %d points in total\n",
+			summary.Files, summary.Valid, summary.Invalid, summary.Points)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// score runs the score command on args with stdin as its input, returning
+// its exit code and what it wrote to stdout and stderr.
+func score(args []string, stdin string) (code int, stdout, stderr string) {
+	var out, errOut bytes.Buffer
+	code = runScore(args, strings.NewReader(stdin), &out, &errOut)
+	return code, out.String(), errOut.String()
+}
+
+func TestScoreStdin(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		stdin  string
+		code   int
+		stdout string
+	}{
+		{"valid", nil, targetReceipt, scoreExitOK, "-  28 points"},
+		{"dash", []string{"-"}, marketReceipt, scoreExitOK, "-  109 points"},
+		{"invalid", nil, `{"retailer": "Target"}`, scoreExitInvalid, "-  invalid  The receipt is invalid."},
+		{"not JSON", nil, "{", scoreExitInvalid, "-  invalid  Invalid receipt format"},
+	}
+	for _, tt := range tests {
+		code, stdout, stderr := score(tt.args, tt.stdin)
+		if code != tt.code || !strings.HasPrefix(stdout, tt.stdout) || stderr != "" {
+			t.Errorf("%s: exit %d, stdout %q, stderr %q; want exit %d, stdout starting %q", tt.name, code, stdout, stderr, tt.code, tt.stdout)
+		}
+	}
+}
+
+// TestScoreFiles scores a directory holding a valid and an invalid receipt.
+func TestScoreFiles(t *testing.T) {
+	dir := t.TempDir()
+	for name, receipt := range map[string]string{"a.json": targetReceipt, "b.json": `{"retailer": "Target"}`, "notes.txt": "not scored"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(receipt), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	code, stdout, stderr := score([]string{"-format", "json", dir}, "")
+	var got struct {
+		Results []struct {
+			File   string
+			Points *int
+			Error  *struct{ Code string }
+		}
+		Summary scoreSummary
+	}
+	if err := json.Unmarshal([]byte(stdout), &got); err != nil {
+		t.Fatalf("decoding %q: %v", stdout, err)
+	}
+	if code != scoreExitInvalid || stderr != "" || got.Summary != (scoreSummary{Files: 2, Valid: 1, Invalid: 1, Points: 28}) {
+		t.Errorf("exit %d, summary %+v, stderr %q; want exit 1 with one of two valid", code, got.Summary, stderr)
+	}
+	if len(got.Results) != 2 || got.Results[0].Points == nil || *got.Results[0].Points != 28 ||
+		got.Results[1].Error == nil || got.Results[1].Error.Code != codeInvalidReceipt {
+		t.Errorf("results = %s, want a.json with 28 points and b.json invalid", stdout)
+	}
+
+	// The table ends with a summary line.
+	code, stdout, _ = score([]string{filepath.Join(dir, "*.json")}, "")
+	if code != scoreExitInvalid || !strings.HasSuffix(stdout, "\n2 files: 1 valid, 1 invalid, 28 points in total\n") {
+		t.Errorf("table = exit %d\n%s\nwant exit 1 and a summary", code, stdout)
+	}
+
+	// Valid files alone exit 0.
+	code, _, _ = score([]string{"-f", filepath.Join(dir, "a.json")}, "")
+	if code != scoreExitOK {
+		t.Errorf("scoring a valid file exited %d, want 0", code)
+	}
+}
+
+func TestScoreUsageErrors(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing.json")
+	for _, args := range [][]string{
+		{"-format", "yaml"},
+		{"-no-such-flag"},
+		{missing},
+		{filepath.Join(t.TempDir(), "*.json")},
+		{"-rules", missing},
+	} {
+		code, stdout, stderr := score(args, targetReceipt)
+		if code != scoreExitUsage || stdout != "" || stderr == "" {
+			t.Errorf("score %q: exit %d, stdout %q, stderr %q; want exit 2 with an error", args, code, stdout, stderr)
+		}
+	}
+}
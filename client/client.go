@@ -0,0 +1,224 @@
+// Package client is a Go client for the receipt processor API.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/y1zhuo/receipt-processor-challenge/api"
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+// Defaults used by New.
+const (
+	DefaultTimeout    = 10 * time.Second
+	DefaultMaxRetries = 3
+	DefaultBackoff    = 200 * time.Millisecond
+)
+
+// maxErrorBody bounds how much of an error response is read.
+const maxErrorBody = 1 << 16
+
+// Client calls the receipt processor API. Its fields may be changed until it
+// is first used; it is then safe for concurrent use.
+type Client struct {
+	// BaseURL is the URL the API is served at, such as
+	// "https://receipts.example.com".
+	BaseURL string
+	// APIKey, if set, is sent as a bearer token with every request.
+	APIKey string
+	// HTTPClient sends the requests. Its Timeout bounds each attempt.
+	HTTPClient *http.Client
+	// MaxRetries is how many times a call is retried after a 429 or 5xx
+	// response or a network error. Zero means calls are tried once.
+	MaxRetries int
+	// Backoff is the wait before the first retry, doubled before each one
+	// after. A Retry-After header from the server takes precedence.
+	Backoff time.Duration
+}
+
+// New returns a Client for the API at baseURL with the default timeout and
+// retries.
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    baseURL,
+		HTTPClient: &http.Client{Timeout: DefaultTimeout},
+		MaxRetries: DefaultMaxRetries,
+		Backoff:    DefaultBackoff,
+	}
+}
+
+// APIError is an error response from the API.
+type APIError struct {
+	// StatusCode is the HTTP status of the response.
+	StatusCode int
+	// Code identifies the error, such as "invalid_receipt" or
+	// "receipt_not_found". It is empty if the response body was not an
+	// API error.
+	Code    string
+	Message string
+	// Details lists the invalid fields of a rejected request.
+	Details []FieldError
+	// RequestID identifies the request in the server's logs.
+	RequestID string
+}
+
+// FieldError describes an invalid field of a rejected request. For a field
+// of a receipt, Pointer locates it, as in /items/3/price, and Constraint
+// names the check it failed, one of the points.Constraint constants. A
+// number sent as Value decodes as a float64.
+type FieldError = points.FieldError
+
+// Detail returns the detail about the field at pointer, such as
+// /items/3/price, if there is one.
+func (e *APIError) Detail(pointer string) (FieldError, bool) {
+	for _, detail := range e.Details {
+		if detail.Pointer == pointer {
+			return detail, true
+		}
+	}
+	return FieldError{}, false
+}
+
+func (e *APIError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("receipt processor: %d %s", e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("receipt processor: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// ProcessReceipt submits receipt for processing and returns the ID it was
+// stored under. Each call sends its own Idempotency-Key, so a retried
+// submission is stored at most once.
+func (c *Client) ProcessReceipt(ctx context.Context, receipt points.Receipt) (string, error) {
+	body, err := json.Marshal(receipt)
+	if err != nil {
+		return "", err
+	}
+	key, err := idempotencyKey()
+	if err != nil {
+		return "", err
+	}
+
+	var response api.ProcessResponse
+	header := http.Header{"Content-Type": {"application/json"}, "Idempotency-Key": {key}}
+	if err := c.do(ctx, http.MethodPost, "/receipts/process", header, body, &response); err != nil {
+		return "", err
+	}
+	return response.ID, nil
+}
+
+// GetPoints returns the points awarded to the receipt stored under id.
+func (c *Client) GetPoints(ctx context.Context, id string) (int, error) {
+	var response api.PointsResponse
+	if err := c.do(ctx, http.MethodGet, "/receipts/"+url.PathEscape(id)+"/points", nil, nil, &response); err != nil {
+		return 0, err
+	}
+	return response.Points, nil
+}
+
+// do sends a request, retrying as c allows, and decodes a successful JSON
+// response into out. Only calls that are safe to repeat may use it.
+func (c *Client) do(ctx context.Context, method, path string, header http.Header, body []byte, out any) error {
+	backoff := c.Backoff
+	for attempt := 0; ; attempt++ {
+		wait, err := c.attempt(ctx, method, path, header, body, out)
+		if err == nil || wait < 0 || attempt >= c.MaxRetries {
+			return err
+		}
+		if wait == 0 {
+			wait = backoff
+			backoff *= 2
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// attempt sends one request. If it fails in a way worth retrying, it
+// returns how long the server asked to wait, or zero if it did not say;
+// otherwise the wait is negative.
+func (c *Client) attempt(ctx context.Context, method, path string, header http.Header, body []byte, out any) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(c.BaseURL, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return -1, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.APIKey)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return -1, ctx.Err()
+		}
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return -1, fmt.Errorf("receipt processor: decoding response: %w", err)
+		}
+		return -1, nil
+	}
+
+	apiErr := readError(resp)
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+		return -1, apiErr
+	}
+	wait := time.Duration(0)
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		wait = time.Duration(seconds) * time.Second
+	}
+	return wait, apiErr
+}
+
+// readError builds an APIError from an error response.
+func readError(resp *http.Response) *APIError {
+	apiErr := &APIError{StatusCode: resp.StatusCode, Message: http.StatusText(resp.StatusCode)}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+
+	var body api.ErrorResponse
+	if json.Unmarshal(data, &body) == nil && body.Error != nil {
+		apiErr.Code, apiErr.Message = body.Error.Code, body.Error.Message
+		apiErr.Details, apiErr.RequestID = body.Error.Details, body.Error.RequestID
+	}
+	if apiErr.RequestID == "" {
+		apiErr.RequestID = resp.Header.Get("X-Request-ID")
+	}
+	return apiErr
+}
+
+// idempotencyKey returns a random key for an Idempotency-Key header.
+func idempotencyKey() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
@@ -0,0 +1,179 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+// scriptedServer answers each request with the next of statuses, then with
+// 200 and body, recording the Idempotency-Key of every request.
+type scriptedServer struct {
+	mu       sync.Mutex
+	statuses []int
+	header   http.Header // sent with the scripted statuses
+	body     string
+	keys     []string
+}
+
+func (s *scriptedServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = append(s.keys, r.Header.Get("Idempotency-Key"))
+	if len(s.statuses) > 0 {
+		status := s.statuses[0]
+		s.statuses = s.statuses[1:]
+		for name, values := range s.header {
+			w.Header()[name] = values
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `{"error":{"code":"scripted","message":"scripted %d","requestId":"r%d"}}`, status, len(s.keys))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, s.body)
+}
+
+func (s *scriptedServer) requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.keys)
+}
+
+// newTestClient returns a client for script with a short backoff.
+func newTestClient(t *testing.T, script *scriptedServer) *Client {
+	t.Helper()
+	srv := httptest.NewServer(script)
+	t.Cleanup(srv.Close)
+	c := New(srv.URL)
+	c.Backoff = time.Millisecond
+	return c
+}
+
+func TestRetriesServerErrors(t *testing.T) {
+	script := &scriptedServer{statuses: []int{503, 500, 429}, body: `{"points":28}`}
+	c := newTestClient(t, script)
+	if got, err := c.GetPoints(context.Background(), "a"); err != nil || got != 28 {
+		t.Fatalf("GetPoints = %d, %v, want 28 after retrying", got, err)
+	}
+	if n := script.requests(); n != 4 {
+		t.Errorf("sent %d requests, want 4", n)
+	}
+}
+
+func TestGivesUpAfterMaxRetries(t *testing.T) {
+	script := &scriptedServer{statuses: []int{503, 503, 503}, body: `{"points":28}`}
+	c := newTestClient(t, script)
+	c.MaxRetries = 2
+	_, err := c.GetPoints(context.Background(), "a")
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != 503 || apiErr.Code != "scripted" || apiErr.RequestID != "r3" {
+		t.Errorf("GetPoints = %v, want the last 503", err)
+	}
+	if n := script.requests(); n != 3 {
+		t.Errorf("sent %d requests, want 3", n)
+	}
+}
+
+func TestDoesNotRetryClientErrors(t *testing.T) {
+	for _, status := range []int{400, 401, 404, 409, 422} {
+		script := &scriptedServer{statuses: []int{status}, body: `{"points":28}`}
+		c := newTestClient(t, script)
+		_, err := c.GetPoints(context.Background(), "a")
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != status {
+			t.Errorf("GetPoints answered %d = %v, want an APIError", status, err)
+		}
+		if n := script.requests(); n != 1 {
+			t.Errorf("sent %d requests after a %d, want 1", n, status)
+		}
+	}
+}
+
+func TestRetriesKeepTheIdempotencyKey(t *testing.T) {
+	script := &scriptedServer{statuses: []int{502, 503}, body: `{"id":"abc"}`}
+	c := newTestClient(t, script)
+	receipt := points.Receipt{Retailer: "Target", PurchaseDate: "2022-01-01", PurchaseTime: "13:01", Total: "1.00"}
+	if id, err := c.ProcessReceipt(context.Background(), receipt); err != nil || id != "abc" {
+		t.Fatalf("ProcessReceipt = %q, %v, want abc", id, err)
+	}
+	keys := script.keys
+	if len(keys) != 3 || keys[0] == "" || keys[1] != keys[0] || keys[2] != keys[0] {
+		t.Errorf("Idempotency-Keys %q, want the same key on every attempt", keys)
+	}
+
+	// Another call is another submission.
+	c.ProcessReceipt(context.Background(), receipt)
+	if script.keys[3] == keys[0] {
+		t.Error("two calls sent the same Idempotency-Key")
+	}
+}
+
+func TestWaitsForRetryAfter(t *testing.T) {
+	script := &scriptedServer{statuses: []int{429}, header: http.Header{"Retry-After": {"1"}}, body: `{"points":28}`}
+	c := newTestClient(t, script)
+
+	// A context ending before the server's wait is over ends the call.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := c.GetPoints(ctx, "a")
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != 429 {
+		t.Errorf("GetPoints = %v, want the 429", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("GetPoints took %s, want it to stop with its context", elapsed)
+	}
+	if n := script.requests(); n != 1 {
+		t.Errorf("sent %d requests, want 1", n)
+	}
+}
+
+func TestAPIKeyAndBaseURL(t *testing.T) {
+	var got *http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		fmt.Fprint(w, `{"points":5}`)
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL + "/")
+	c.APIKey = "s3cret"
+	if _, err := c.GetPoints(context.Background(), "a/b c"); err != nil {
+		t.Fatal(err)
+	}
+	if got.URL.EscapedPath() != "/receipts/a%2Fb%20c/points" {
+		t.Errorf("path = %s, want the ID escaped as one segment", got.URL.EscapedPath())
+	}
+	if auth := got.Header.Get("Authorization"); auth != "Bearer s3cret" {
+		t.Errorf("Authorization = %q, want the key as a bearer token", auth)
+	}
+}
+
+func TestNonAPIErrorBodies(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Request-ID", "from-header")
+		http.Error(w, "upstream gone", http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL)
+	c.MaxRetries = 0
+	_, err := c.GetPoints(context.Background(), "a")
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Code != "" || apiErr.Message != "Bad Gateway" || apiErr.RequestID != "from-header" {
+		t.Errorf("GetPoints = %#v, want a 502 without a code", err)
+	}
+	if err.Error() != "receipt processor: 502 Bad Gateway" {
+		t.Errorf("Error() = %q", err.Error())
+	}
+}
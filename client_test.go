@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/y1zhuo/receipt-processor-challenge/client"
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+// newClient serves s and returns a client for it.
+func newClient(t *testing.T, s *Server) *client.Client {
+	t.Helper()
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(srv.Close)
+	c := client.New(srv.URL)
+	c.HTTPClient = srv.Client()
+	return c
+}
+
+func TestClientRoundTrip(t *testing.T) {
+	c := newClient(t, newTestServer(t))
+	ctx := context.Background()
+
+	for _, tt := range []struct {
+		receipt string
+		points  int
+	}{{targetReceipt, 28}, {marketReceipt, 109}} {
+		id, err := c.ProcessReceipt(ctx, parseReceipt(t, tt.receipt))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := c.GetPoints(ctx, id); err != nil || got != tt.points {
+			t.Errorf("GetPoints = %d, %v, want %d", got, err, tt.points)
+		}
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	c := newClient(t, newTestServer(t))
+	ctx := context.Background()
+
+	receipt := parseReceipt(t, targetReceipt)
+	receipt.Items[2].Price = "1.2"
+	_, err := c.ProcessReceipt(ctx, receipt)
+	var apiErr *client.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest || apiErr.Code != codeInvalidReceipt || apiErr.RequestID == "" {
+		t.Fatalf("ProcessReceipt of an invalid receipt = %v, want a 400 %s", err, codeInvalidReceipt)
+	}
+	if detail, ok := apiErr.Detail("/items/2/price"); !ok || detail.Constraint != points.ConstraintFormat {
+		t.Errorf("details = %+v, want a format error at /items/2/price", apiErr.Details)
+	}
+
+	for _, tt := range []struct {
+		id     string
+		status int
+		code   string
+	}{
+		{"00000000-0000-4000-8000-000000000000", http.StatusNotFound, codeReceiptNotFound},
+		{"not an id", http.StatusBadRequest, codeInvalidID},
+		{"a/b", http.StatusBadRequest, codeInvalidID},
+	} {
+		_, err := c.GetPoints(ctx, tt.id)
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != tt.status || apiErr.Code != tt.code {
+			t.Errorf("GetPoints(%q) = %v, want %d %s", tt.id, err, tt.status, tt.code)
+		}
+	}
+}
+
+func TestClientAPIKey(t *testing.T) {
+	s := newTestServer(t)
+	keys, err := loadAPIKeys("team:s3cret", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := parseAuthRules("POST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.apiKeys, s.authRules = keys, rules
+	c := newClient(t, s)
+	ctx := context.Background()
+
+	_, err = c.ProcessReceipt(ctx, parseReceipt(t, targetReceipt))
+	var apiErr *client.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized || apiErr.Code != codeUnauthorized {
+		t.Errorf("ProcessReceipt without a key = %v, want 401", err)
+	}
+	c.APIKey = "s3cret"
+	if _, err := c.ProcessReceipt(ctx, parseReceipt(t, targetReceipt)); err != nil {
+		t.Errorf("ProcessReceipt with a key: %v", err)
+	}
+}
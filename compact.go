@@ -0,0 +1,128 @@
+package main
+
+import (
+	"sort"
+	"time"
+	"unsafe"
+
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+// compactBatch is how many receipts a compaction pass looks at each time it
+// takes the memory store's lock, so that requests are only held up briefly
+// however many receipts come due at once.
+const compactBatch = 256
+
+// compacted reports whether the body of the receipt was dropped.
+func (r *memoryRecord) compacted() bool {
+	return !r.compactedAt.IsZero()
+}
+
+// compactedReceipt returns receipt without its items, keeping the fields
+// listings, stats and the expiry policy read.
+func compactedReceipt(receipt points.Receipt) points.Receipt {
+	return points.Receipt{
+		Retailer:     receipt.Retailer,
+		PurchaseDate: receipt.PurchaseDate,
+		PurchaseTime: receipt.PurchaseTime,
+		Total:        receipt.Total,
+		Timezone:     receipt.Timezone,
+	}
+}
+
+// compactedBreakdown returns a summary of breakdown: the points of each rule
+// and the total, without the details and per-item results that repeat the
+// receipt's items.
+func compactedBreakdown(breakdown points.Breakdown) points.Breakdown {
+	summary := breakdown
+	summary.Rules = make([]points.RuleResult, len(breakdown.Rules))
+	for i, result := range breakdown.Rules {
+		result.Details = nil
+		summary.Rules[i] = result
+	}
+	summary.Items = nil
+	return summary
+}
+
+// compactLocked drops the body of record, the receipt of id, counting the
+// bytes it frees. s.mu must be held for writing.
+func (s *memoryStore) compactLocked(id string, record *memoryRecord, now time.Time) {
+	before := receiptSize(record.receipt) + breakdownSize(record.breakdown)
+	record.receipt = compactedReceipt(record.receipt)
+	record.breakdown = compactedBreakdown(record.breakdown)
+	if !record.compacted() {
+		record.compactedAt = now
+	}
+	s.freedBytes += before - receiptSize(record.receipt) - breakdownSize(record.breakdown)
+	s.items.remove(id)
+	s.changes++
+}
+
+// recompactLocked compacts record again after a write gave it a new body, if
+// the compaction sweep has already passed it. s.mu must be held for writing.
+func (s *memoryStore) recompactLocked(id string, record *memoryRecord) {
+	if s.compactAfter > 0 && record.seq <= s.compactedSeq {
+		s.compactLocked(id, record, s.now())
+	}
+}
+
+// compact drops the bodies of the receipts stored at least compactAfter
+// before now. It takes up where the last pass left off, compactBatch
+// receipts at a time, releasing the lock in between.
+func (s *memoryStore) compact(now time.Time) {
+	for s.compactStep(now) {
+	}
+}
+
+// compactStep compacts up to compactBatch receipts, reporting whether more
+// may be due.
+func (s *memoryStore) compactStep(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// order is sorted by when receipts were first stored, so those due
+	// are the ones after the last compacted, up to the first that is not.
+	start := sort.Search(len(s.order), func(i int) bool { return s.order[i].seq > s.compactedSeq })
+	end := min(start+compactBatch, len(s.order))
+	for _, entry := range s.order[start:end] {
+		record, live := s.recordLocked(entry)
+		if live {
+			if now.Sub(record.storedAt) < s.compactAfter {
+				return false
+			}
+			s.compactLocked(entry.id, record, now)
+		}
+		s.compactedSeq = entry.seq
+	}
+	return end < len(s.order)
+}
+
+// compactionStats reports what compaction has freed, and is nil unless it
+// is enabled.
+func (s *memoryStore) compactionStats() *compactionStats {
+	if s.compactAfter <= 0 {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return &compactionStats{After: s.compactAfter.String(), FreedBytes: s.freedBytes}
+}
+
+// breakdownSize estimates the bytes breakdown occupies in memory: its
+// struct, rule results, item results and string contents.
+func breakdownSize(breakdown points.Breakdown) int64 {
+	size := int64(unsafe.Sizeof(breakdown))
+	for _, result := range breakdown.Rules {
+		size += int64(unsafe.Sizeof(result)) + int64(len(result.Rule)+len(result.Description))
+		for _, detail := range result.Details {
+			size += int64(unsafe.Sizeof(detail)) + int64(len(detail))
+		}
+	}
+	for _, item := range breakdown.Items {
+		size += int64(unsafe.Sizeof(item)) + int64(len(item.Description))
+	}
+	for _, warning := range breakdown.Warnings {
+		size += int64(unsafe.Sizeof(warning)) + int64(len(warning))
+	}
+	return size
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/y1zhuo/receipt-processor-challenge/api"
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+// newCompactingStore returns a memory store that compacts receipts an hour
+// after they are stored, on the clock it returns.
+func newCompactingStore() (*memoryStore, *fakeClock) {
+	store := newMemoryStore()
+	clock := &fakeClock{now: time.Date(2024, time.June, 1, 12, 0, 0, 0, time.UTC)}
+	store.now, store.compactAfter = clock.Now, time.Hour
+	return store, clock
+}
+
+func TestCompaction(t *testing.T) {
+	store, clock := newCompactingStore()
+	s := newStoreServer(t, store, withAdmin)
+	h := s.Handler()
+	old := processReceipt(t, h, targetReceipt)
+	clock.advance(2 * time.Hour)
+	recent := processReceipt(t, h, marketReceipt)
+	store.compact(clock.Now())
+
+	rec := send(h, http.MethodGet, "/receipts/"+old, "")
+	var gone api.ErrorResponse
+	decodeBody(t, rec, &gone)
+	if rec.Code != http.StatusGone || gone.Error == nil || gone.Error.Code != codeReceiptCompacted ||
+		gone.Error.CompactedAt == nil || !gone.Error.CompactedAt.Equal(clock.Now()) {
+		t.Errorf("GET /receipts/%s once compacted = %d %s, want 410 receipt_compacted at %s", old, rec.Code, rec.Body, clock.Now())
+	}
+	if got := receiptPoints(t, h, old); got != 28 {
+		t.Errorf("points once compacted = %d, want 28", got)
+	}
+	var breakdown points.Breakdown
+	decodeBody(t, send(h, http.MethodGet, "/receipts/"+old+"/breakdown", ""), &breakdown)
+	if breakdown.Total != 28 || len(breakdown.Rules) == 0 || breakdown.Items != nil {
+		t.Errorf("breakdown once compacted = %+v, want the rules' points without items", breakdown)
+	}
+	for _, result := range breakdown.Rules {
+		if result.Details != nil {
+			t.Errorf("rule %s kept its details %q", result.Rule, result.Details)
+		}
+	}
+	if rec := send(h, http.MethodGet, "/receipts/"+recent, ""); rec.Code != http.StatusOK {
+		t.Errorf("GET of a receipt not yet due = %d %s, want 200", rec.Code, rec.Body)
+	}
+
+	var stats storeStats
+	decodeBody(t, sendAdmin(h, http.MethodGet, "/admin/stats", ""), &stats)
+	if stats.Receipts != 2 || stats.TotalPoints != 28+109 || stats.Compaction == nil || stats.Compaction.After != "1h0m0s" ||
+		stats.Compaction.Receipts != 1 || stats.Compaction.FreedBytes <= 0 || stats.BytesPerReceipt != float64(stats.ApproxBytes)/2 {
+		t.Errorf("GET /admin/stats = %+v, compaction %+v, want one receipt compacted", stats, stats.Compaction)
+	}
+
+	// A receipt compacted and then corrected is compacted again.
+	if rec := send(h, http.MethodPut, "/receipts/"+old, marketReceipt); rec.Code != http.StatusOK {
+		t.Fatalf("PUT of a compacted receipt = %d %s", rec.Code, rec.Body)
+	}
+	if rec := send(h, http.MethodGet, "/receipts/"+old, ""); rec.Code != http.StatusGone {
+		t.Errorf("GET of a corrected compacted receipt = %d %s, want 410", rec.Code, rec.Body)
+	}
+	if got := receiptPoints(t, h, old); got != 109 {
+		t.Errorf("points of a corrected compacted receipt = %d, want 109", got)
+	}
+}
+
+// TestCompactionIsIncremental checks that a step compacts at most
+// compactBatch receipts, and that a pass stops at the first not yet due.
+func TestCompactionIsIncremental(t *testing.T) {
+	store, clock := newCompactingStore()
+	ctx := context.Background()
+	receipt, breakdown := scored(parseReceipt(t, targetReceipt))
+	save := func(n int) {
+		for range n {
+			id, _ := generateUniqueID()
+			if err := store.SaveReceipt(ctx, id, receipt, breakdown); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	save(compactBatch + 10)
+	clock.advance(2 * time.Hour)
+	save(5)
+
+	compacted := func() int {
+		n := 0
+		store.Scan(ctx, 0, func(stored StoredReceipt) bool {
+			if !stored.CompactedAt.IsZero() {
+				n++
+			}
+			return true
+		})
+		return n
+	}
+	if more := store.compactStep(clock.Now()); !more || compacted() != compactBatch {
+		t.Errorf("one step compacted %d receipts, reporting more %v; want %d and more", compacted(), more, compactBatch)
+	}
+	store.compact(clock.Now())
+	if got := compacted(); got != compactBatch+10 {
+		t.Errorf("compacted %d receipts, want the %d due", got, compactBatch+10)
+	}
+}
+
+// TestCompactionWithConcurrentReaders compacts receipts while readers fetch
+// them, checking that each reader sees a receipt whole until it sees it
+// compacted, and never whole again, and its points throughout.
+func TestCompactionWithConcurrentReaders(t *testing.T) {
+	store, clock := newCompactingStore()
+	s := newStoreServer(t, store, withAdmin)
+	h := s.Handler()
+	ctx := context.Background()
+	receipt, breakdown := scored(parseReceipt(t, targetReceipt))
+	ids := make([]string, 8*compactBatch)
+	for i := range ids {
+		ids[i], _ = generateUniqueID()
+		if err := store.SaveReceipt(ctx, ids[i], receipt, breakdown); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clock.advance(2 * time.Hour)
+
+	done := make(chan struct{})
+	var started, wg sync.WaitGroup
+	for r := range 8 {
+		started.Add(1)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			gone := make(map[string]bool)
+			for pass := 0; ; pass++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				// Each reader starts at a different receipt.
+				id := ids[(r*len(ids)/8+pass)%len(ids)]
+				rec := send(h, http.MethodGet, "/receipts/"+id, "")
+				switch rec.Code {
+				case http.StatusOK:
+					var got points.Receipt
+					decodeBody(t, rec, &got)
+					if gone[id] || len(got.Items) != len(receipt.Items) {
+						t.Errorf("GET /receipts/%s = %d items, compacted before %v", id, len(got.Items), gone[id])
+					}
+				case http.StatusGone:
+					if code := errorCode(t, rec); code != codeReceiptCompacted {
+						t.Errorf("GET /receipts/%s = 410 %s, want receipt_compacted", id, code)
+					}
+					gone[id] = true
+				default:
+					t.Errorf("GET /receipts/%s = %d %s", id, rec.Code, rec.Body)
+				}
+				if rec := send(h, http.MethodGet, "/receipts/"+id+"/points", ""); rec.Code != http.StatusOK {
+					t.Errorf("GET /receipts/%s/points while compacting = %d %s", id, rec.Code, rec.Body)
+				}
+				if pass == 0 {
+					started.Done()
+				}
+			}
+		}()
+	}
+	started.Wait()
+	store.compact(clock.Now())
+	close(done)
+	wg.Wait()
+
+	for _, id := range ids {
+		if rec := send(h, http.MethodGet, "/receipts/"+id, ""); rec.Code != http.StatusGone {
+			t.Fatalf("GET /receipts/%s after compaction = %d, want 410", id, rec.Code)
+		}
+	}
+	if got := receiptPoints(t, h, ids[len(ids)-1]); got != 28 {
+		t.Errorf("points after compaction = %d, want 28", got)
+	}
+}
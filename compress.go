@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// minCompressBytes is the smallest response body worth compressing; below
+// it the gzip framing outweighs the saving.
+const minCompressBytes = 1024
+
+// decompressBody transparently decodes request bodies sent with
+// Content-Encoding: gzip. maxBytes, unless nil, caps the decompressed size
+// as limitBody caps the size on the wire, so a small compressed body cannot
+// expand without bound. Other encodings are rejected with 415.
+func decompressBody(maxBytes func(*http.Request) int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+		case "", "identity":
+			next.ServeHTTP(w, r)
+			return
+		case "gzip":
+		default:
+			writeError(w, http.StatusUnsupportedMediaType, codeUnsupportedMediaType,
+				"Content-Encoding must be gzip or identity")
+			return
+		}
+
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			writeAPIError(w, bodyReadError(err, "The request body is not valid gzip"))
+			return
+		}
+		defer gz.Close()
+
+		var body io.ReadCloser = gz
+		if maxBytes != nil {
+			body = http.MaxBytesReader(w, gz, maxBytes(r))
+		}
+		r.Body = body
+		r.Header.Del("Content-Encoding")
+		r.Header.Del("Content-Length")
+		r.ContentLength = -1
+		next.ServeHTTP(w, r)
+	})
+}
+
+// compressResponses gzips response bodies of at least minCompressBytes for
+// clients that accept it. Bodies are compressed as they are written, so
+// streamed responses stay streamed.
+func compressResponses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == http.MethodHead || !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(gw, r)
+		gw.close()
+	})
+}
+
+// acceptsGzip reports whether an Accept-Encoding header value allows gzip.
+// A gzip entry decides by its q-value, whatever a * entry says, and a *
+// entry decides only if there is no gzip entry, so that "*, gzip;q=0"
+// refuses gzip. Entries with a q-value that cannot be parsed are ignored.
+func acceptsGzip(header string) bool {
+	gzipQ, anyQ := -1.0, -1.0
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		q, ok := qValue(params)
+		if !ok {
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(coding)) {
+		case "gzip", "x-gzip":
+			gzipQ = max(gzipQ, q)
+		case "*":
+			anyQ = max(anyQ, q)
+		}
+	}
+	if gzipQ >= 0 {
+		return gzipQ > 0
+	}
+	return anyQ > 0
+}
+
+// qValue returns the q-value among params, the ";"-separated parameters of
+// a header entry, or 1 if there is none. It reports false if the q-value is
+// not a number from 0 to 1.
+func qValue(params string) (float64, bool) {
+	if strings.TrimSpace(params) == "" {
+		return 1, true
+	}
+	for _, param := range strings.Split(params, ";") {
+		name, value, _ := strings.Cut(param, "=")
+		if !strings.EqualFold(strings.TrimSpace(name), "q") {
+			continue
+		}
+		q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || q < 0 || q > 1 {
+			return 0, false
+		}
+		return q, true
+	}
+	return 1, true
+}
+
+// gzipResponseWriter holds back the start of a response until it has seen
+// minCompressBytes of body, then decides whether to compress. Until then
+// the status is only recorded.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	buf         bytes.Buffer
+	gz          *gzip.Writer
+	decided     bool // whether the headers have gone out
+}
+
+func (g *gzipResponseWriter) WriteHeader(status int) {
+	if !g.wroteHeader {
+		g.status, g.wroteHeader = status, true
+	}
+}
+
+func (g *gzipResponseWriter) Write(p []byte) (int, error) {
+	g.wroteHeader = true
+	if g.decided {
+		if g.gz != nil {
+			return g.gz.Write(p)
+		}
+		return g.ResponseWriter.Write(p)
+	}
+
+	g.buf.Write(p)
+	if g.buf.Len() >= minCompressBytes {
+		if err := g.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// decide sends the headers, compressed if compress is set and the response
+// is eligible, followed by whatever body has been held back.
+func (g *gzipResponseWriter) decide(compress bool) error {
+	g.decided = true
+	header := g.Header()
+	// Images are compressed already.
+	if compress && header.Get("Content-Encoding") == "" && !strings.HasPrefix(header.Get("Content-Type"), "image/") &&
+		g.status != http.StatusNoContent && g.status != http.StatusNotModified {
+		header.Set("Content-Encoding", "gzip")
+		header.Del("Content-Length")
+		g.gz = gzip.NewWriter(g.ResponseWriter)
+	}
+	g.ResponseWriter.WriteHeader(g.status)
+
+	held := g.buf.Bytes()
+	g.buf = bytes.Buffer{}
+	if len(held) == 0 {
+		return nil
+	}
+	var err error
+	if g.gz != nil {
+		_, err = g.gz.Write(held)
+	} else {
+		_, err = g.ResponseWriter.Write(held)
+	}
+	return err
+}
+
+// close sends a response too small to compress as it is, or finishes the
+// compressed stream.
+func (g *gzipResponseWriter) close() {
+	if !g.decided {
+		g.decide(false)
+		return
+	}
+	if g.gz != nil {
+		g.gz.Close()
+	}
+}
+
+// Flush sends everything written so far. A response flushed before it
+// reaches minCompressBytes is sent uncompressed.
+func (g *gzipResponseWriter) Flush() {
+	if !g.decided {
+		g.decide(false)
+	}
+	if g.gz != nil {
+		g.gz.Flush()
+	}
+	http.NewResponseController(g.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (g *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"GZIP", true},
+		{"x-gzip", true},
+		{"deflate, gzip", true},
+		{"deflate, br", false},
+		{"identity", false},
+		{"gzip;q=0", false},
+		{"gzip; q=0", false},
+		{"gzip;Q=0", false},
+		{"gzip;q=0.001", true},
+		{"gzip;q=0.5, deflate", true},
+		{"*", true},
+		{"*;q=0", false},
+		// An explicit gzip entry overrides *, in either order.
+		{"*;q=1, gzip;q=0", false},
+		{"gzip;q=0, *", false},
+		{"*;q=0, gzip", true},
+		{"gzip, *;q=0", true},
+		// q is found among any other parameters.
+		{"gzip;level=1;q=0", false},
+		{"gzip;q=0;level=1", false},
+		{"gzip;level=1", true},
+		// Entries with a q-value that cannot be parsed are ignored.
+		{"gzip;q=abc", false},
+		{"gzip;q=1.5", false},
+		{"gzip;q=-1", false},
+		{"gzip;q=abc, *", true},
+		{"gzip;q=", false},
+	}
+	for _, tt := range tests {
+		if got := acceptsGzip(tt.header); got != tt.want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+// gzipped returns data compressed with gzip.
+func gzipped(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// sendGzipped posts body gzipped to h at target, accepting acceptEncoding.
+func sendGzipped(t *testing.T, h http.Handler, target string, body []byte, acceptEncoding string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, target, bytes.NewReader(gzipped(t, body)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// batchOf returns a JSON array of n copies of receipt.
+func batchOf(receipt string, n int) []byte {
+	receipts := make([]string, n)
+	for i := range receipts {
+		receipts[i] = receipt
+	}
+	return []byte("[" + strings.Join(receipts, ",") + "]")
+}
+
+func TestGzipBatchRoundTrip(t *testing.T) {
+	h := newTestServer(t).Handler()
+	const n = 50
+	for _, accept := range []string{"gzip", "", "*;q=1, gzip;q=0"} {
+		t.Run("accept "+accept, func(t *testing.T) {
+			rec := sendGzipped(t, h, "/receipts/process/batch", batchOf(marketReceipt, n), accept)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("POST /receipts/process/batch = %d %s, want 200", rec.Code, rec.Body)
+			}
+			if vary := rec.Header().Values("Vary"); !slices.Contains(vary, "Accept-Encoding") {
+				t.Errorf("Vary = %q, want Accept-Encoding among them", vary)
+			}
+			body := rec.Body.Bytes()
+			if compressed := rec.Header().Get("Content-Encoding") == "gzip"; compressed != acceptsGzip(accept) {
+				t.Fatalf("Content-Encoding = %q with Accept-Encoding %q", rec.Header().Get("Content-Encoding"), accept)
+			} else if compressed {
+				gz, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if body, err = io.ReadAll(gz); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var results []batchResult
+			if err := json.Unmarshal(body, &results); err != nil {
+				t.Fatalf("decoding %q: %v", body, err)
+			}
+			if len(results) != n {
+				t.Fatalf("%d results, want %d", len(results), n)
+			}
+			for _, result := range []batchResult{results[0], results[n-1]} {
+				if result.Error != nil || receiptPoints(t, h, result.ID) != 109 {
+					t.Errorf("result %+v, want a receipt of 109 points", result)
+				}
+			}
+		})
+	}
+}
+
+func TestGzipRequestLimits(t *testing.T) {
+	s := newTestServer(t)
+	s.maxBatchBody = 4096
+	h := s.Handler()
+
+	// Compressed, the batch fits the limit many times over; the limit
+	// applies to it decompressed.
+	batch := batchOf(targetReceipt, 100)
+	if len(gzipped(t, batch)) >= 4096 {
+		t.Fatal("the batch does not compress below the limit")
+	}
+	rec := sendGzipped(t, h, "/receipts/process/batch", batch, "")
+	if rec.Code != http.StatusRequestEntityTooLarge || errorCode(t, rec) != codeBodyTooLarge {
+		t.Errorf("POST of a gzipped batch too large decompressed = %d %s, want 413", rec.Code, rec.Body)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/receipts/process", strings.NewReader("not gzip"))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest || errorCode(t, rec) != codeInvalidBody {
+		t.Errorf("POST of a body that is not gzip = %d %s, want 400", rec.Code, rec.Body)
+	}
+
+	req.Header.Set("Content-Encoding", "br")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("POST with Content-Encoding br = %d %s, want 415", rec.Code, rec.Body)
+	}
+}
+
+func TestSmallResponsesAreNotCompressed(t *testing.T) {
+	h := newTestServer(t).Handler()
+	id := processReceipt(t, h, targetReceipt)
+	rec := send(h, http.MethodGet, "/receipts/"+id+"/points", "", "Accept-Encoding", "gzip")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != "{\"points\":28}\n" {
+		t.Errorf("GET points = %d %q %q, want an uncompressed body", rec.Code, rec.Header().Get("Content-Encoding"), rec.Body)
+	}
+}
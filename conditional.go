@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+// pointsETag returns a strong ETag for the points awarded to the receipt
+// with id. It covers the ruleset version as well as the points, so it
+// changes whenever the receipt is rescored, even to the same total under
+// new rules.
+func pointsETag(id string, points int) string {
+	sum := sha256.Sum256([]byte(id + "\x00" + strconv.Itoa(points) + "\x00" + rules.get().Version))
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// embeddedPointsETag returns a strong ETag for a points response with the
+// given body that embeds what variant says, the include set as listed by
+// pointsInclude.String and the date counted at, if any. A receipt can be
+// replaced without its points changing, so the ETag covers the body served
+// rather than the points alone; it covers variant as well, so each include
+// set and date has ETags of its own.
+func embeddedPointsETag(id, variant string, body []byte) string {
+	sum := sha256.Sum256([]byte(id + "\x00" + variant + "\x00" + rules.get().Version + "\x00" + string(body)))
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// revisionETag returns the strong ETag of a receipt at revision.
+func revisionETag(revision uint64) string {
+	return `"` + strconv.FormatUint(revision, 10) + `"`
+}
+
+// etagMatchesStrongly reports whether an If-Match header value matches etag.
+// As RFC 9110 requires for If-Match, the comparison is strong: weak ETags
+// match nothing.
+func etagMatchesStrongly(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// etagMatches reports whether an If-None-Match header value matches etag.
+// As RFC 9110 requires for If-None-Match, the comparison is weak.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPointsConditionalGet(t *testing.T) {
+	s := newTestServer(t)
+	s.pointsMaxAge = 30 * time.Second
+	h := s.Handler()
+	id := processReceipt(t, h, targetReceipt)
+
+	rec := send(h, http.MethodGet, "/receipts/"+id+"/points", "")
+	etag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || etag == "" {
+		t.Fatalf("GET points = %d with ETag %q, want 200 with an ETag", rec.Code, etag)
+	}
+	if got := rec.Header().Get("Cache-Control"); got != "max-age=30" {
+		t.Errorf("Cache-Control = %q, want max-age=30", got)
+	}
+	if again := send(h, http.MethodGet, "/receipts/"+id+"/points", "").Header().Get("ETag"); again != etag {
+		t.Errorf("ETag changed from %s to %s between requests", etag, again)
+	}
+
+	tests := []struct {
+		ifNoneMatch string
+		want        int
+	}{
+		{etag, http.StatusNotModified},
+		{"W/" + etag, http.StatusNotModified},
+		{`"other", ` + etag, http.StatusNotModified},
+		{"*", http.StatusNotModified},
+		{`"other"`, http.StatusOK},
+		{`"` + etag + `"`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			rec := send(h, method, "/receipts/"+id+"/points", "", "If-None-Match", tt.ifNoneMatch)
+			if rec.Code != tt.want {
+				t.Errorf("%s with If-None-Match %s = %d, want %d", method, tt.ifNoneMatch, rec.Code, tt.want)
+			}
+			if rec.Header().Get("ETag") != etag {
+				t.Errorf("%s with If-None-Match %s has ETag %q, want %s", method, tt.ifNoneMatch, rec.Header().Get("ETag"), etag)
+			}
+			if tt.want == http.StatusNotModified && rec.Body.Len() != 0 {
+				t.Errorf("%s with If-None-Match %s has body %q, want none", method, tt.ifNoneMatch, rec.Body)
+			}
+		}
+	}
+}
+
+func TestPointsHead(t *testing.T) {
+	h := newTestServer(t).Handler()
+	id := processReceipt(t, h, targetReceipt)
+
+	get := send(h, http.MethodGet, "/receipts/"+id+"/points", "")
+	head := send(h, http.MethodHead, "/receipts/"+id+"/points", "")
+	if head.Code != http.StatusOK {
+		t.Fatalf("HEAD points = %d, want 200", head.Code)
+	}
+	for _, name := range []string{"ETag", "Cache-Control", "Content-Type"} {
+		if head.Header().Get(name) != get.Header().Get(name) {
+			t.Errorf("HEAD %s = %q, GET %s = %q", name, head.Header().Get(name), name, get.Header().Get(name))
+		}
+	}
+
+	if rec := send(h, http.MethodHead, "/receipts/00000000-0000-4000-8000-000000000000/points", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("HEAD points of an unknown receipt = %d, want 404", rec.Code)
+	}
+}
+
+func TestPointsETagVaries(t *testing.T) {
+	h := newTestServer(t).Handler()
+	target := processReceipt(t, h, targetReceipt)
+	market := processReceipt(t, h, marketReceipt)
+
+	etag := func(target string, header ...string) string {
+		return send(h, http.MethodGet, target, "", header...).Header().Get("ETag")
+	}
+	plain := etag("/receipts/" + target + "/points")
+	for _, other := range []string{
+		etag("/receipts/" + market + "/points"),
+		etag("/receipts/" + target + "/points?include=breakdown"),
+		etag("/receipts/" + target + "/points?include=receipt"),
+		etag("/receipts/"+target+"/points", "Accept", mediaXML),
+	} {
+		if other == plain {
+			t.Errorf("ETag %s is shared by two different responses", plain)
+		}
+	}
+}
+
+func TestPointsETagChangesOnRecalculate(t *testing.T) {
+	h := newTestServer(t, withAdmin).Handler()
+	id := processReceipt(t, h, targetReceipt)
+	before := send(h, http.MethodGet, "/receipts/"+id+"/points", "").Header().Get("ETag")
+
+	old := rules.get()
+	t.Cleanup(func() { rules.set(old) })
+	config := old
+	config.Version = "double-retailer"
+	config.RetailerName.PointsPerCharacter = 2
+	rules.set(config)
+	if rec := sendAdmin(h, http.MethodPost, "/admin/recalculate", ""); rec.Code != http.StatusOK {
+		t.Fatalf("POST /admin/recalculate = %d %s, want 200", rec.Code, rec.Body)
+	}
+
+	if got := receiptPoints(t, h, id); got != 34 {
+		t.Fatalf("points after recalculating = %d, want 34", got)
+	}
+	rec := send(h, http.MethodGet, "/receipts/"+id+"/points", "", "If-None-Match", before)
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") == before {
+		t.Errorf("GET with the ETag from before recalculating = %d with ETag %s, want 200 with a new ETag", rec.Code, rec.Header().Get("ETag"))
+	}
+}
+
+// TestIfMatchRace sends pairs of updates to one receipt at once, both made
+// with the ETag read before either, and checks that exactly one of each pair
+// succeeds and the other is refused with 412, whichever gets there first.
+func TestIfMatchRace(t *testing.T) {
+	corrected := strings.Replace(targetReceipt, `"total": "35.35"`, `"total": "36.00"`, 1)
+	eachStore(t, func(t *testing.T, store Store) {
+		h := newStoreServer(t, store).Handler()
+		id := processReceipt(t, h, targetReceipt)
+
+		type write struct {
+			body   string
+			points int
+		}
+		rounds := make([][2]write, 20)
+		for i := range rounds {
+			rounds[i] = [2]write{{marketReceipt, 109}, {corrected, 103}}
+		}
+
+		for i, round := range rounds {
+			etag := send(h, http.MethodGet, "/receipts/"+id, "").Header().Get("ETag")
+			if etag == "" {
+				t.Fatalf("round %d: GET /receipts/%s has no ETag", i, id)
+			}
+			var recs [2]*httptest.ResponseRecorder
+			start := make(chan struct{})
+			var wg sync.WaitGroup
+			for j, w := range round {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					<-start
+					recs[j] = send(h, http.MethodPut, "/receipts/"+id, w.body, "If-Match", etag)
+				}()
+			}
+			close(start)
+			wg.Wait()
+
+			var winner write
+			wins := 0
+			for j, rec := range recs {
+				switch rec.Code {
+				case http.StatusOK:
+					winner = round[j]
+					wins++
+				case http.StatusPreconditionFailed:
+					if code := errorCode(t, rec); code != codeReceiptChanged {
+						t.Errorf("round %d: update refused with code %q, want %q", i, code, codeReceiptChanged)
+					}
+				default:
+					t.Fatalf("round %d: PUT /receipts/%s = %d %s", i, id, rec.Code, rec.Body)
+				}
+			}
+			if wins != 1 {
+				t.Fatalf("round %d: %d of the writes won, want exactly one: %d and %d", i, wins, recs[0].Code, recs[1].Code)
+			}
+			if got := receiptPoints(t, h, id); got != winner.points {
+				t.Errorf("round %d: points = %d, want %d from the update that won", i, got, winner.points)
+			}
+		}
+	})
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // so -timezone works on hosts without a zoneinfo database
+
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+// config holds the startup settings. Each one can be given as a flag, falling
+// back to an environment variable and then to a built-in default.
+type config struct {
+	Addr            string
+	TLSCert         string
+	TLSKey          string
+	AutocertHosts   string
+	AutocertCache   string
+	HTTPAddr        string
+	GRPCAddr        string
+	Debug           bool
+	DebugAddr       string
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	IdleTimeout     time.Duration
+	ShutdownTimeout time.Duration
+	RequestTimeout  time.Duration
+	MaxBodyBytes    int64
+	MaxBatchBytes   int64
+	MaxImageBytes   int64
+	ImageDir        string
+	BatchLimit      int
+	ScoreWorkers    int
+	RulesPath       string
+	StoreKind       string
+	StorePath       string
+	DBPath          string
+	SnapshotPath    string
+	SnapshotEvery   time.Duration
+	MaxReceiptAge   int
+	Timezone        string
+	InputFormats    string
+	MaxItems        int
+	MaxAmount       string
+	MaxDescription  int
+	DailyCap        int
+	RetailerAliases string
+	DenylistPath    string
+	AsyncQueue      int
+	AsyncWorkers    int
+	IdempotencyTTL  time.Duration
+	PointsMaxAge    time.Duration
+	PointsExpiry    int
+	ExpiryUndated   string
+	AdminToken      string
+	APIKeys         string
+	APIKeysFile     string
+	AuthRoutes      string
+	Quota           string
+	QuotaTimezone   string
+	RateLimit       float64
+	RateBurst       int
+	MaxReceipts     int
+	ReceiptTTL      time.Duration
+	CompactAfter    time.Duration
+	DeleteRetention time.Duration
+	CORSOrigins     string
+	CORSMethods     string
+	CORSHeaders     string
+	CORSMaxAge      time.Duration
+	CORSCredentials bool
+	WebhookURLs     string
+	WebhookSecret   string
+	WebhookRetain   time.Duration
+	IDFormat        string
+	IDSecret        string
+	IDPrevSecret    string
+	AnomalyWindow   time.Duration
+	AnomalyRatio    float64
+	LogOutput       string
+	LogLevel        string
+	Features        features
+	FeaturesFile    string
+
+	// featureSources records where the value of each feature came from.
+	featureSources map[string]string
+	flags          *flag.FlagSet
+}
+
+// parseConfig parses command-line args, consulting getenv for any setting
+// not given as a flag.
+func parseConfig(args []string, getenv func(string) string) (config, error) {
+	var cfg config
+	env := envDefaults{getenv: getenv}
+
+	fs := flag.NewFlagSet("receipt-processor", flag.ContinueOnError)
+	cfg.flags = fs
+	fs.SetOutput(os.Stderr)
+	fs.StringVar(&cfg.Addr, "addr", env.string("ADDR", ":8080"), "address to listen on (env ADDR)")
+	fs.StringVar(&cfg.TLSCert, "tls-cert", env.string("TLS_CERT", ""), "PEM certificate file; serves HTTPS on -addr together with -tls-key (env TLS_CERT)")
+	fs.StringVar(&cfg.TLSKey, "tls-key", env.string("TLS_KEY", ""), "PEM private key file for -tls-cert (env TLS_KEY)")
+	fs.StringVar(&cfg.AutocertHosts, "autocert-hosts", env.string("AUTOCERT_HOSTS", ""), "comma-separated hostnames to get Let's Encrypt certificates for; serves HTTPS on -addr (env AUTOCERT_HOSTS)")
+	fs.StringVar(&cfg.AutocertCache, "autocert-cache", env.string("AUTOCERT_CACHE", "autocert-cache"), "directory to keep automatic certificates in (env AUTOCERT_CACHE)")
+	fs.StringVar(&cfg.HTTPAddr, "http-addr", env.string("HTTP_ADDR", ""), "with TLS, address of a plain-HTTP listener that redirects to HTTPS; defaults to :80 with -autocert-hosts, which needs it for ACME challenges (env HTTP_ADDR)")
+	fs.StringVar(&cfg.GRPCAddr, "grpc-addr", env.string("GRPC_ADDR", ""), "address to serve the gRPC API on; off if unset (env GRPC_ADDR)")
+	fs.BoolVar(&cfg.Debug, "debug", env.bool("DEBUG_ENDPOINTS", false), "serve pprof profiles and runtime statistics under /debug/ on -debug-addr (env DEBUG_ENDPOINTS)")
+	fs.StringVar(&cfg.DebugAddr, "debug-addr", env.string("DEBUG_ADDR", defaultDebugAddr), "loopback address of the -debug listener (env DEBUG_ADDR)")
+	fs.DurationVar(&cfg.ReadTimeout, "read-timeout", env.duration("READ_TIMEOUT", 10*time.Second), "maximum time to read a request (env READ_TIMEOUT)")
+	fs.DurationVar(&cfg.WriteTimeout, "write-timeout", env.duration("WRITE_TIMEOUT", 10*time.Second), "maximum time to write a response (env WRITE_TIMEOUT)")
+	fs.DurationVar(&cfg.IdleTimeout, "idle-timeout", env.duration("IDLE_TIMEOUT", 60*time.Second), "maximum time to keep an idle connection open (env IDLE_TIMEOUT)")
+	fs.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", env.duration("SHUTDOWN_TIMEOUT", 10*time.Second), "how long to wait for in-flight requests when shutting down (env SHUTDOWN_TIMEOUT)")
+	fs.DurationVar(&cfg.RequestTimeout, "request-timeout", env.duration("REQUEST_TIMEOUT", 5*time.Second), "maximum time spent on an API request, after which work on it is abandoned, and the most clients can ask for with X-Request-Timeout; 0 for no limit (env REQUEST_TIMEOUT)")
+	fs.Int64Var(&cfg.MaxBodyBytes, "max-body-bytes", env.int64("MAX_BODY_BYTES", defaultMaxBodyBytes), "maximum size of a request body in bytes (env MAX_BODY_BYTES)")
+	fs.Int64Var(&cfg.MaxBatchBytes, "max-batch-body-bytes", env.int64("MAX_BATCH_BODY_BYTES", defaultMaxBatchBodyBytes), "maximum size of a request body in bytes for /receipts/process/batch and /receipts/process/csv (env MAX_BATCH_BODY_BYTES)")
+	fs.Int64Var(&cfg.MaxImageBytes, "max-image-bytes", env.int64("MAX_IMAGE_BYTES", defaultMaxImageBytes), "maximum size of a receipt image uploaded to /receipts/{id}/image in bytes (env MAX_IMAGE_BYTES)")
+	fs.StringVar(&cfg.ImageDir, "image-dir", env.string("IMAGE_DIR", ""), "directory to keep receipt images in; if unset they are kept in memory and lost on restart (env IMAGE_DIR)")
+	fs.IntVar(&cfg.BatchLimit, "batch-limit", int(env.int64("BATCH_LIMIT", defaultBatchLimit)), "maximum number of receipts accepted by /receipts/process/batch (env BATCH_LIMIT)")
+	fs.IntVar(&cfg.ScoreWorkers, "score-workers", int(env.int64("SCORE_WORKERS", int64(runtime.GOMAXPROCS(0)))), "number of receipts scored at once by batches, CSV uploads, imports and recalculations (env SCORE_WORKERS)")
+	fs.StringVar(&cfg.RulesPath, "rules", env.string("RULES", ""), "path to a JSON file overriding the default scoring rules, reloaded on SIGHUP (env RULES)")
+	fs.StringVar(&cfg.StoreKind, "store", env.string("STORE", "memory"), "receipt storage backend: memory, file or sqlite (env STORE)")
+	fs.StringVar(&cfg.StorePath, "store-path", env.string("STORE_PATH", "receipts.jsonl"), "path of the file store log or SQLite database (env STORE_PATH)")
+	fs.IntVar(&cfg.MaxReceipts, "max-receipts", int(env.int64("MAX_RECEIPTS", 0)), "evict the oldest receipts beyond this many; 0 for no limit, memory store only (env MAX_RECEIPTS)")
+	fs.DurationVar(&cfg.ReceiptTTL, "receipt-ttl", env.duration("RECEIPT_TTL", 0), "evict receipts this long after they are stored; 0 to keep them, memory store only (env RECEIPT_TTL)")
+	fs.DurationVar(&cfg.CompactAfter, "compact-after", env.duration("COMPACT_AFTER", 0), "drop the items and breakdown details of receipts this long after they are stored, keeping their points, retailer, date and a breakdown summary; GET /receipts/{id} then answers 410. 0 to keep them whole, memory store only (env COMPACT_AFTER)")
+	fs.DurationVar(&cfg.DeleteRetention, "deleted-retention", env.duration("DELETED_RETENTION", defaultDeletedRetention), "how long deleted receipts can be restored before they are purged (env DELETED_RETENTION)")
+	fs.StringVar(&cfg.SnapshotPath, "snapshot-path", env.string("SNAPSHOT_PATH", ""), "file to snapshot the memory store to every -snapshot-interval and load it from on startup; off if unset (env SNAPSHOT_PATH)")
+	fs.DurationVar(&cfg.SnapshotEvery, "snapshot-interval", env.duration("SNAPSHOT_INTERVAL", defaultSnapshotInterval), "how often to snapshot the memory store, if it has changed (env SNAPSHOT_INTERVAL)")
+	fs.StringVar(&cfg.DBPath, "db", env.string("RECEIPTS_DB", ""), "path of a SQLite database to store receipts in; overrides -store (env RECEIPTS_DB)")
+
+	fs.StringVar(&cfg.FeaturesFile, "features-file", env.string("FEATURES_FILE", ""), "JSON file of feature flags, such as {\"dedup\": true}, for those not given as a flag or environment variable; see /admin/features (env FEATURES_FILE)")
+	fs.BoolVar(&cfg.Features.Index, "index", env.bool("INDEX", false), "keep an index of item description words so that /receipts/search does not read every receipt; memory and file stores only (env INDEX)")
+	fs.BoolVar(&cfg.Features.Dedup, "dedup", env.bool("DEDUP", false), "return the existing ID when an identical receipt is resubmitted (env DEDUP)")
+	fs.BoolVar(&cfg.Features.DedupIgnoreItemOrder, "dedup-ignore-item-order", env.bool("DEDUP_IGNORE_ITEM_ORDER", false), "treat receipts whose items differ only in order as duplicates (env DEDUP_IGNORE_ITEM_ORDER)")
+	fs.BoolVar(&cfg.Features.Audit, "audit", env.bool("AUDIT", false), "record every change to the stored receipts in an audit log kept with the store, served at /admin/audit (env AUDIT)")
+	fs.BoolVar(&cfg.Features.StrictTotals, "strict-totals", env.bool("STRICT_TOTALS", false), "reject receipts whose total is not the sum of their item prices; clients can ask for this per request with X-Strict-Totals (env STRICT_TOTALS)")
+	fs.BoolVar(&cfg.Features.StrictDates, "strict-dates", env.bool("STRICT_DATES", false), "reject receipts dated in the future or more than -max-receipt-age days ago, rather than flag them in the breakdown's warnings (env STRICT_DATES)")
+	fs.IntVar(&cfg.MaxReceiptAge, "max-receipt-age", int(env.int64("MAX_RECEIPT_AGE", 0)), "days before today a receipt may be dated; 0 for any age (env MAX_RECEIPT_AGE)")
+	fs.BoolVar(&cfg.Features.ZoneAwareScoring, "zone-aware-scoring", env.bool("ZONE_AWARE_SCORING", false), "for receipts that name a timezone, read their purchase date and time in that zone: an offset purchaseDateTime is converted to it, the odd day and afternoon rules resolve times skipped by daylight saving changes, and -strict-dates compares against its clock (env ZONE_AWARE_SCORING)")
+	fs.StringVar(&cfg.Timezone, "timezone", env.string("TIMEZONE", "UTC"), "IANA time zone that receipt dates and times are compared in, e.g. America/New_York (env TIMEZONE)")
+	fs.StringVar(&cfg.InputFormats, "input-formats", env.string("INPUT_FORMATS", "us-date,12-hour,datetime"), "purchase date and time layouts accepted besides YYYY-MM-DD and HH:MM: comma-separated us-date (MM/DD/YYYY), 12-hour (2:05 PM) and datetime (an ISO 8601 purchaseDateTime), or none (env INPUT_FORMATS)")
+	fs.BoolVar(&cfg.Features.RetailerAlphanumeric, "require-retailer-alphanumeric", env.bool("REQUIRE_RETAILER_ALPHANUMERIC", false), "reject retailer names without a letter or digit, such as \"&\" or \"-\", which otherwise pass validation but score nothing for the name (env REQUIRE_RETAILER_ALPHANUMERIC)")
+	fs.BoolVar(&cfg.Features.ItemlessReceipts, "allow-itemless-receipts", env.bool("ALLOW_ITEMLESS_RECEIPTS", false), "accept receipts with no items, such as those for a service charge alone, which the spec's minItems of 1 otherwise refuses; the item pairs and item description rules award them nothing (env ALLOW_ITEMLESS_RECEIPTS)")
+	fs.IntVar(&cfg.MaxItems, "max-items", int(env.int64("MAX_ITEMS", int64(points.DefaultLimits().MaxItems))), "most items a receipt may have; 0 for no limit (env MAX_ITEMS)")
+	fs.StringVar(&cfg.MaxAmount, "max-amount", env.string("MAX_AMOUNT", "100000.00"), "largest item price or total accepted, e.g. 100000.00; 0.00 for no limit (env MAX_AMOUNT)")
+	fs.IntVar(&cfg.MaxDescription, "max-description-length", int(env.int64("MAX_DESCRIPTION_LENGTH", int64(points.DefaultLimits().MaxDescriptionLength))), "most characters an item description may have; 0 for no limit (env MAX_DESCRIPTION_LENGTH)")
+	fs.BoolVar(&cfg.Features.NormalizeRetailers, "normalize-retailers", env.bool("NORMALIZE_RETAILERS", false), "group receipts in listings, stats and the leaderboard by retailer name with whitespace collapsed and case ignored; scoring still uses the name as submitted (env NORMALIZE_RETAILERS)")
+	fs.StringVar(&cfg.RetailerAliases, "retailer-aliases", env.string("RETAILER_ALIASES", ""), "path to a JSON file mapping canonical retailer names to lists of their variants; implies -normalize-retailers (env RETAILER_ALIASES)")
+	fs.StringVar(&cfg.DenylistPath, "denylist", env.string("DENYLIST", ""), "path to a file of words and /regexps/ that retailer names and item descriptions must not contain, each marked reject or mask, reloaded on SIGHUP (env DENYLIST)")
+	fs.IntVar(&cfg.PointsExpiry, "points-expiry-months", int(env.int64("POINTS_EXPIRY_MONTHS", 0)), "months after the purchase date that points stop counting toward totals asked for with ?at=; 0 for never (env POINTS_EXPIRY_MONTHS)")
+	fs.StringVar(&cfg.ExpiryUndated, "points-expiry-undated", env.string("POINTS_EXPIRY_UNDATED", "never"), "what points expiry does with receipts whose purchase date is not valid: never (they never expire) or reject (env POINTS_EXPIRY_UNDATED)")
+	fs.IntVar(&cfg.DailyCap, "daily-cap", int(env.int64("DAILY_CAP", 0)), "most points the receipts of one retailer can earn per purchase date and tenant; later receipts get what is left; 0 for no cap (env DAILY_CAP)")
+	fs.BoolVar(&cfg.Features.Async, "async", env.bool("ASYNC", false), "queue receipts to be stored in the background and answer 202, unless a request sets async=false (env ASYNC)")
+	fs.IntVar(&cfg.AsyncQueue, "async-queue", int(env.int64("ASYNC_QUEUE", defaultAsyncQueueSize)), "receipts that may wait to be stored in async mode before requests get 503 (env ASYNC_QUEUE)")
+	fs.IntVar(&cfg.AsyncWorkers, "async-workers", int(env.int64("ASYNC_WORKERS", defaultAsyncWorkers)), "receipts stored concurrently in async mode (env ASYNC_WORKERS)")
+	fs.BoolVar(&cfg.Features.ReadOnly, "read-only", env.bool("READ_ONLY", false), "refuse every write to the stored receipts with a 503 read_only, for maintenance, while still serving reads; can be turned off with PATCH /admin/features (env READ_ONLY)")
+	fs.DurationVar(&cfg.IdempotencyTTL, "idempotency-ttl", env.duration("IDEMPOTENCY_TTL", defaultIdempotencyTTL), "how long responses are kept for Idempotency-Key replay (env IDEMPOTENCY_TTL)")
+	fs.DurationVar(&cfg.PointsMaxAge, "points-max-age", env.duration("POINTS_MAX_AGE", 0), "how long clients may cache GET /receipts/{id}/points before revalidating (env POINTS_MAX_AGE)")
+	fs.StringVar(&cfg.AdminToken, "admin-token", env.string("ADMIN_TOKEN", ""), "bearer token required by the /admin endpoints, which are disabled if unset (env ADMIN_TOKEN)")
+	fs.StringVar(&cfg.APIKeys, "api-keys", env.string("API_KEYS", ""), "comma-separated API keys, each \"name:key\" or a bare key, optionally followed by a space and the key's quota, such as 1000/month, 50/day or unlimited; enables API-key auth (env API_KEYS)")
+	fs.StringVar(&cfg.APIKeysFile, "api-keys-file", env.string("API_KEYS_FILE", ""), "file of API keys, one per line in the -api-keys format (env API_KEYS_FILE)")
+	fs.StringVar(&cfg.AuthRoutes, "auth-routes", env.string("AUTH_ROUTES", "POST,PUT,DELETE"), "requests that need an API key: comma-separated methods, each optionally followed by a path prefix (env AUTH_ROUTES)")
+	fs.BoolVar(&cfg.Features.IsolateTenants, "isolate-tenants", env.bool("ISOLATE_TENANTS", false), "scope receipts to the API key that submitted them, hiding them from other keys; needs API keys (env ISOLATE_TENANTS)")
+	fs.StringVar(&cfg.Quota, "quota", env.string("QUOTA", ""), "receipts each API key without a quota of its own may process per period, such as 1000/month or 50/day; unlimited if unset (env QUOTA)")
+	fs.StringVar(&cfg.QuotaTimezone, "quota-timezone", env.string("QUOTA_TIMEZONE", ""), "IANA time zone whose midnights quota periods start at; defaults to -timezone (env QUOTA_TIMEZONE)")
+	fs.Float64Var(&cfg.RateLimit, "rate-limit", env.float64("RATE_LIMIT", 0), "requests per second allowed per client, by API key or IP; 0 disables rate limiting (env RATE_LIMIT)")
+	fs.IntVar(&cfg.RateBurst, "rate-burst", int(env.int64("RATE_BURST", 20)), "requests a client may make at once before -rate-limit applies (env RATE_BURST)")
+	fs.StringVar(&cfg.CORSOrigins, "cors-origins", env.string("CORS_ORIGINS", ""), "comma-separated browser origins allowed to call the API, or * for any; CORS is off if unset (env CORS_ORIGINS)")
+	fs.StringVar(&cfg.CORSMethods, "cors-methods", env.string("CORS_METHODS", "GET,POST,PUT,DELETE"), "methods allowed in cross-origin requests (env CORS_METHODS)")
+	fs.StringVar(&cfg.CORSHeaders, "cors-headers", env.string("CORS_HEADERS", "Content-Type,Authorization,X-Api-Key,Idempotency-Key,X-Strict-Totals,X-Request-Timeout,If-Match"), "request headers allowed in cross-origin requests (env CORS_HEADERS)")
+	fs.DurationVar(&cfg.CORSMaxAge, "cors-max-age", env.duration("CORS_MAX_AGE", 10*time.Minute), "how long browsers may cache a preflight response (env CORS_MAX_AGE)")
+	fs.BoolVar(&cfg.CORSCredentials, "cors-credentials", env.bool("CORS_CREDENTIALS", false), "let cross-origin requests carry credentials; not allowed with -cors-origins=* (env CORS_CREDENTIALS)")
+	fs.StringVar(&cfg.WebhookURLs, "webhook-urls", env.string("WEBHOOK_URLS", ""), "comma-separated URLs to POST each processed receipt to (env WEBHOOK_URLS)")
+	fs.StringVar(&cfg.IDFormat, "id-format", env.string("ID_FORMAT", idFormatUUID), "format of new receipt IDs: uuid4, ulid (sorted by when they were made) or nano (10 characters); receipts are only found by IDs of this format (env ID_FORMAT)")
+	fs.StringVar(&cfg.IDSecret, "id-secret", env.string("ID_SECRET", ""), "key for signing the receipt IDs given to clients, which then get opaque tokens in place of the IDs themselves (env ID_SECRET)")
+	fs.StringVar(&cfg.IDPrevSecret, "id-previous-secret", env.string("ID_PREVIOUS_SECRET", ""), "the -id-secret being rotated out; tokens signed with it are still accepted until it is removed (env ID_PREVIOUS_SECRET)")
+	fs.StringVar(&cfg.WebhookSecret, "webhook-secret", env.string("WEBHOOK_SECRET", ""), "key for the HMAC-SHA256 signature on webhook requests; required with -webhook-urls (env WEBHOOK_SECRET)")
+	fs.DurationVar(&cfg.WebhookRetain, "webhook-retention", env.duration("WEBHOOK_RETENTION", defaultWebhookRetention), "how long delivered webhook events are kept in the outbox of a sqlite or file store (env WEBHOOK_RETENTION)")
+	fs.DurationVar(&cfg.AnomalyWindow, "anomaly-window", env.duration("ANOMALY_WINDOW", defaultAnomalyWindow), "how far back the baseline that each rule's fire rate in the last minute is compared with at /admin/anomalies reaches, in whole minutes (env ANOMALY_WINDOW)")
+	fs.Float64Var(&cfg.AnomalyRatio, "anomaly-threshold", env.float64("ANOMALY_THRESHOLD", defaultAnomalyThreshold), "how many times higher or lower than its baseline a rule's fire rate must be to be flagged as anomalous (env ANOMALY_THRESHOLD)")
+	fs.StringVar(&cfg.LogOutput, "log-output", env.string("LOG_OUTPUT", "stderr"), "where to write JSON logs: stderr, stdout or a file path (env LOG_OUTPUT)")
+	fs.StringVar(&cfg.LogLevel, "log-level", env.string("LOG_LEVEL", "info"), "minimum level logged: debug, info, warn or error (env LOG_LEVEL)")
+
+	if env.err != nil {
+		return cfg, env.err
+	}
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+	sources, err := applyFeaturesFile(fs, cfg.FeaturesFile, getenv)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.featureSources = sources
+
+	if cfg.DBPath != "" {
+		fs.Set("store", "sqlite")
+		fs.Set("store-path", cfg.DBPath)
+	}
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		return cfg, fmt.Errorf("-tls-cert and -tls-key must be given together")
+	}
+	if cfg.TLSCert != "" && cfg.AutocertHosts != "" {
+		return cfg, fmt.Errorf("-tls-cert and -autocert-hosts cannot both be used")
+	}
+	if cfg.AutocertHosts != "" && cfg.HTTPAddr == "" {
+		fs.Set("http-addr", ":80")
+	}
+	if cfg.HTTPAddr != "" && cfg.TLSCert == "" && cfg.AutocertHosts == "" {
+		return cfg, fmt.Errorf("-http-addr is only used with TLS")
+	}
+	if cfg.Debug && !isLoopback(cfg.DebugAddr) {
+		// Profiles expose memory contents and command lines.
+		return cfg, fmt.Errorf("-debug-addr must be a loopback address, got %q", cfg.DebugAddr)
+	}
+	if cfg.MaxReceipts < 0 || cfg.ReceiptTTL < 0 {
+		return cfg, fmt.Errorf("max receipts and receipt TTL must not be negative")
+	}
+	if (cfg.MaxReceipts > 0 || cfg.ReceiptTTL > 0) && cfg.StoreKind != "memory" {
+		// The other stores persist receipts, and silently dropping
+		// persisted data is not what a size cap is for.
+		return cfg, fmt.Errorf("max receipts and receipt TTL are only supported by the memory store")
+	}
+	if cfg.CompactAfter < 0 {
+		return cfg, fmt.Errorf("compact after must not be negative, got %s", cfg.CompactAfter)
+	}
+	if cfg.CompactAfter > 0 && cfg.StoreKind != "memory" {
+		return cfg, fmt.Errorf("-compact-after is only supported by the memory store")
+	}
+	if cfg.SnapshotPath != "" && cfg.StoreKind != "memory" {
+		return cfg, fmt.Errorf("-snapshot-path is only supported by the memory store; the other stores persist receipts already")
+	}
+	if cfg.Features.Index && cfg.StoreKind == "sqlite" {
+		return cfg, fmt.Errorf("-index is only supported by the memory and file stores")
+	}
+	if cfg.PointsExpiry < 0 {
+		return cfg, fmt.Errorf("points expiry must not be negative, got %d", cfg.PointsExpiry)
+	}
+	if cfg.ExpiryUndated != "never" && cfg.ExpiryUndated != "reject" {
+		return cfg, fmt.Errorf("-points-expiry-undated must be never or reject, got %q", cfg.ExpiryUndated)
+	}
+	if cfg.DailyCap < 0 {
+		return cfg, fmt.Errorf("daily cap must not be negative, got %d", cfg.DailyCap)
+	}
+	if cfg.DeleteRetention <= 0 {
+		return cfg, fmt.Errorf("deleted receipt retention must be positive, got %s", cfg.DeleteRetention)
+	}
+	if cfg.SnapshotEvery <= 0 {
+		return cfg, fmt.Errorf("snapshot interval must be positive, got %s", cfg.SnapshotEvery)
+	}
+	if cfg.MaxBodyBytes <= 0 {
+		return cfg, fmt.Errorf("max body bytes must be positive, got %d", cfg.MaxBodyBytes)
+	}
+	if cfg.MaxBatchBytes <= 0 {
+		return cfg, fmt.Errorf("max batch body bytes must be positive, got %d", cfg.MaxBatchBytes)
+	}
+	if cfg.MaxImageBytes <= 0 {
+		return cfg, fmt.Errorf("max image bytes must be positive, got %d", cfg.MaxImageBytes)
+	}
+	if cfg.IdempotencyTTL <= 0 {
+		return cfg, fmt.Errorf("idempotency TTL must be positive, got %s", cfg.IdempotencyTTL)
+	}
+	if cfg.RequestTimeout < 0 {
+		return cfg, fmt.Errorf("request timeout must not be negative, got %s", cfg.RequestTimeout)
+	}
+	if cfg.PointsMaxAge < 0 {
+		return cfg, fmt.Errorf("points max age must not be negative, got %s", cfg.PointsMaxAge)
+	}
+	if cfg.Features.IsolateTenants && cfg.APIKeys == "" && cfg.APIKeysFile == "" {
+		return cfg, fmt.Errorf("-isolate-tenants needs -api-keys or -api-keys-file")
+	}
+	if cfg.Quota != "" {
+		if _, err := parseQuota(cfg.Quota); err != nil {
+			return cfg, err
+		}
+		if cfg.APIKeys == "" && cfg.APIKeysFile == "" {
+			return cfg, fmt.Errorf("-quota needs -api-keys or -api-keys-file")
+		}
+	}
+	if cfg.QuotaTimezone == "" {
+		cfg.QuotaTimezone = cfg.Timezone
+	}
+	if _, err := time.LoadLocation(cfg.QuotaTimezone); err != nil {
+		return cfg, fmt.Errorf("invalid quota timezone: %w", err)
+	}
+	if cfg.RateLimit < 0 {
+		return cfg, fmt.Errorf("rate limit must not be negative, got %g", cfg.RateLimit)
+	}
+	if cfg.RateLimit > 0 && cfg.RateBurst <= 0 {
+		return cfg, fmt.Errorf("rate burst must be positive, got %d", cfg.RateBurst)
+	}
+	if cfg.WebhookURLs != "" && cfg.WebhookSecret == "" {
+		return cfg, fmt.Errorf("webhook URLs need a webhook secret to sign deliveries with")
+	}
+	if cfg.AnomalyWindow < time.Minute {
+		return cfg, fmt.Errorf("anomaly window must be at least a minute, got %s", cfg.AnomalyWindow)
+	}
+	if !(cfg.AnomalyRatio > 1) {
+		return cfg, fmt.Errorf("anomaly threshold must be greater than 1, got %g", cfg.AnomalyRatio)
+	}
+	if cfg.WebhookRetain <= 0 {
+		return cfg, fmt.Errorf("webhook retention must be positive, got %s", cfg.WebhookRetain)
+	}
+	if cfg.IDPrevSecret != "" && cfg.IDSecret == "" {
+		return cfg, fmt.Errorf("-id-previous-secret needs -id-secret")
+	}
+	if cfg.IDSecret != "" && cfg.IDFormat != idFormatUUID {
+		return cfg, fmt.Errorf("-id-secret needs -id-format=%s", idFormatUUID)
+	}
+	if cfg.AsyncQueue <= 0 || cfg.AsyncWorkers <= 0 {
+		return cfg, fmt.Errorf("async queue size and workers must be positive")
+	}
+	if cfg.MaxReceiptAge < 0 {
+		return cfg, fmt.Errorf("max receipt age must not be negative, got %d", cfg.MaxReceiptAge)
+	}
+	if cfg.MaxItems < 0 || cfg.MaxDescription < 0 {
+		return cfg, fmt.Errorf("max items and max description length must not be negative")
+	}
+	if _, ok := points.Money(cfg.MaxAmount).Cents(); !ok {
+		return cfg, fmt.Errorf("max amount must be an amount with two decimal places, got %q", cfg.MaxAmount)
+	}
+	if _, err := time.LoadLocation(cfg.Timezone); err != nil {
+		return cfg, fmt.Errorf("invalid timezone: %w", err)
+	}
+	if cfg.BatchLimit <= 0 {
+		return cfg, fmt.Errorf("batch limit must be positive, got %d", cfg.BatchLimit)
+	}
+	if cfg.ScoreWorkers <= 0 {
+		return cfg, fmt.Errorf("score workers must be positive, got %d", cfg.ScoreWorkers)
+	}
+	return cfg, nil
+}
+
+// String lists the effective settings, one "name=value" per line. Secrets
+// are redacted.
+func (cfg config) String() string {
+	var lines []string
+	cfg.visit(func(name, value string) {
+		lines = append(lines, name+"="+value)
+	})
+	return strings.Join(lines, "\n")
+}
+
+// LogValue logs the effective settings as a group, with secrets redacted.
+func (cfg config) LogValue() slog.Value {
+	var attrs []slog.Attr
+	cfg.visit(func(name, value string) {
+		attrs = append(attrs, slog.String(name, value))
+	})
+	return slog.GroupValue(attrs...)
+}
+
+// visit calls fn with the name and value of every setting, in name order.
+// Secrets are redacted.
+func (cfg config) visit(fn func(name, value string)) {
+	cfg.flags.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if (f.Name == "admin-token" || f.Name == "api-keys" || f.Name == "webhook-secret" || f.Name == "id-secret" || f.Name == "id-previous-secret") && value != "" {
+			value = "<redacted>"
+		}
+		fn(f.Name, value)
+	})
+}
+
+// envDefaults reads flag defaults from environment variables, remembering the
+// first value that fails to parse.
+type envDefaults struct {
+	getenv func(string) string
+	err    error
+}
+
+func (e *envDefaults) string(key, fallback string) string {
+	if v := e.getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func (e *envDefaults) duration(key string, fallback time.Duration) time.Duration {
+	v := e.getenv(key)
+	if v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		e.fail(key, v)
+		return fallback
+	}
+	return d
+}
+
+func (e *envDefaults) int64(key string, fallback int64) int64 {
+	v := e.getenv(key)
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		e.fail(key, v)
+		return fallback
+	}
+	return n
+}
+
+func (e *envDefaults) float64(key string, fallback float64) float64 {
+	v := e.getenv(key)
+	if v == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		e.fail(key, v)
+		return fallback
+	}
+	return f
+}
+
+func (e *envDefaults) bool(key string, fallback bool) bool {
+	v := e.getenv(key)
+	if v == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		e.fail(key, v)
+		return fallback
+	}
+	return b
+}
+
+func (e *envDefaults) fail(key, value string) {
+	if e.err == nil {
+		e.err = fmt.Errorf("invalid value %q for environment variable %s", value, key)
+	}
+}
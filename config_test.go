@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// envOf returns a getenv looking variables up in env.
+func envOf(env map[string]string) func(string) string {
+	return func(key string) string { return env[key] }
+}
+
+func TestParseConfigDefaults(t *testing.T) {
+	cfg, err := parseConfig(nil, envOf(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Addr != ":8080" || cfg.ReadTimeout != 10*time.Second || cfg.WriteTimeout != 10*time.Second ||
+		cfg.ShutdownTimeout != 10*time.Second || cfg.MaxBodyBytes != defaultMaxBodyBytes {
+		t.Errorf("defaults = addr %q, read %s, write %s, shutdown %s, max body %d",
+			cfg.Addr, cfg.ReadTimeout, cfg.WriteTimeout, cfg.ShutdownTimeout, cfg.MaxBodyBytes)
+	}
+}
+
+func TestParseConfigEnvironment(t *testing.T) {
+	env := envOf(map[string]string{
+		"ADDR":             ":9090",
+		"READ_TIMEOUT":     "3s",
+		"WRITE_TIMEOUT":    "4s",
+		"MAX_BODY_BYTES":   "2048",
+		"SHUTDOWN_TIMEOUT": "1m",
+	})
+	cfg, err := parseConfig(nil, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Addr != ":9090" || cfg.ReadTimeout != 3*time.Second || cfg.WriteTimeout != 4*time.Second ||
+		cfg.MaxBodyBytes != 2048 || cfg.ShutdownTimeout != time.Minute {
+		t.Errorf("from the environment = addr %q, read %s, write %s, shutdown %s, max body %d",
+			cfg.Addr, cfg.ReadTimeout, cfg.WriteTimeout, cfg.ShutdownTimeout, cfg.MaxBodyBytes)
+	}
+
+	// Flags win over the environment.
+	cfg, err = parseConfig([]string{"-addr", ":7070", "-read-timeout", "5s", "-max-body-bytes", "100"}, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Addr != ":7070" || cfg.ReadTimeout != 5*time.Second || cfg.MaxBodyBytes != 100 || cfg.WriteTimeout != 4*time.Second {
+		t.Errorf("from flags = addr %q, read %s, write %s, max body %d",
+			cfg.Addr, cfg.ReadTimeout, cfg.WriteTimeout, cfg.MaxBodyBytes)
+	}
+}
+
+func TestParseConfigRejectsBadValues(t *testing.T) {
+	tests := []struct {
+		env  map[string]string
+		args []string
+		want string
+	}{
+		{map[string]string{"READ_TIMEOUT": "soon"}, nil, "READ_TIMEOUT"},
+		{map[string]string{"MAX_BODY_BYTES": "1MB"}, nil, "MAX_BODY_BYTES"},
+		{map[string]string{"MAX_BODY_BYTES": "0"}, nil, "max body bytes"},
+		{nil, []string{"-max-body-bytes", "-1"}, "max body bytes"},
+		{map[string]string{"DEBUG_ENDPOINTS": "true", "DEBUG_ADDR": ":6060"}, nil, "loopback"},
+	}
+	for _, tt := range tests {
+		_, err := parseConfig(tt.args, envOf(tt.env))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseConfig(%v) with %v: error %v, want one mentioning %s", tt.args, tt.env, err, tt.want)
+		}
+	}
+}
+
+func TestConfigStringRedactsSecrets(t *testing.T) {
+	cfg, err := parseConfig([]string{"-admin-token", "hunter2", "-addr", ":9090"}, envOf(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := cfg.String()
+	if strings.Contains(s, "hunter2") || !strings.Contains(s, "admin-token=<redacted>") {
+		t.Errorf("String() does not redact the admin token:\n%s", s)
+	}
+	if !strings.Contains(s, "addr=:9090\n") {
+		t.Errorf("String() lacks the effective address:\n%s", s)
+	}
+}
+
+func TestOversizedBodyIsRefused(t *testing.T) {
+	s := newTestServer(t)
+	s.maxBodyBytes = 64
+	rec := send(s.Handler(), http.MethodPost, "/receipts/process", targetReceipt)
+	if rec.Code != http.StatusRequestEntityTooLarge || errorCode(t, rec) != codeBodyTooLarge {
+		t.Errorf("POST of a %d-byte body = %d %s, want 413 %s", len(targetReceipt), rec.Code, rec.Body, codeBodyTooLarge)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// corsExposedHeaders are the response headers browsers may show to scripts,
+// beyond the always-safe ones.
+const corsExposedHeaders = "ETag, Location, Retry-After, X-Request-ID, X-Receipt-Duplicate, Idempotent-Replayed"
+
+// corsPolicy decides which browser origins may call the API.
+type corsPolicy struct {
+	anyOrigin   bool
+	origins     []string
+	methods     []string
+	headers     string
+	maxAge      time.Duration
+	credentials bool
+}
+
+// newCORSPolicy builds a policy from comma-separated lists of origins ("*"
+// for any), methods and request headers. Credentials cannot be allowed for
+// any origin, since browsers refuse that combination anyway.
+func newCORSPolicy(origins, methods, headers string, maxAge time.Duration, credentials bool) (*corsPolicy, error) {
+	p := &corsPolicy{
+		methods:     splitList(strings.ToUpper(methods)),
+		headers:     strings.Join(splitList(headers), ", "),
+		maxAge:      maxAge,
+		credentials: credentials,
+	}
+	for _, origin := range splitList(origins) {
+		if origin == "*" {
+			p.anyOrigin = true
+			continue
+		}
+		p.origins = append(p.origins, strings.TrimSuffix(origin, "/"))
+	}
+	if len(p.origins) == 0 && !p.anyOrigin {
+		return nil, errors.New("no origins given")
+	}
+	if p.anyOrigin && credentials {
+		return nil, errors.New("credentials cannot be allowed for any origin (*)")
+	}
+	return p, nil
+}
+
+// splitList splits a comma-separated list, dropping empty entries.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (p *corsPolicy) allowsOrigin(origin string) bool {
+	return p.anyOrigin || slices.Contains(p.origins, origin)
+}
+
+// handleCORS adds CORS headers to requests from allowed origins and answers
+// preflight requests itself, ahead of routing, so they never meet the
+// method checks or authentication.
+func (s *Server) handleCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if s.cors == nil || origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		header := w.Header()
+		header.Add("Vary", "Origin")
+		requestMethod := r.Header.Get("Access-Control-Request-Method")
+		if r.Method == http.MethodOptions && requestMethod != "" {
+			header.Add("Vary", "Access-Control-Request-Method")
+			header.Add("Vary", "Access-Control-Request-Headers")
+			// A refused preflight gets no CORS headers, which is how
+			// the browser learns of the refusal.
+			if s.cors.allowsOrigin(origin) && slices.Contains(s.cors.methods, requestMethod) {
+				s.cors.setOrigin(header, origin)
+				header.Set("Access-Control-Allow-Methods", strings.Join(s.cors.methods, ", "))
+				if s.cors.headers != "" {
+					header.Set("Access-Control-Allow-Headers", s.cors.headers)
+				}
+				if s.cors.maxAge > 0 {
+					header.Set("Access-Control-Max-Age", strconv.Itoa(int(s.cors.maxAge.Seconds())))
+				}
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if s.cors.allowsOrigin(origin) {
+			s.cors.setOrigin(header, origin)
+			header.Set("Access-Control-Expose-Headers", corsExposedHeaders)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (p *corsPolicy) setOrigin(header http.Header, origin string) {
+	if p.anyOrigin {
+		header.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		header.Set("Access-Control-Allow-Origin", origin)
+	}
+	if p.credentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+// withCORS allows the given origins.
+func withCORS(origins string, credentials bool) serverOption {
+	return func(t testing.TB, s *Server) {
+		var err error
+		if s.cors, err = newCORSPolicy(origins, "GET,POST", "Content-Type, Authorization", 10*time.Minute, credentials); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestNewCORSPolicy(t *testing.T) {
+	if _, err := newCORSPolicy("*", "GET", "", 0, true); err == nil {
+		t.Error("credentials were allowed for any origin")
+	}
+	if _, err := newCORSPolicy(" , ", "GET", "", 0, false); err == nil {
+		t.Error("a policy without origins was accepted")
+	}
+	p, err := newCORSPolicy("https://a.example/, https://b.example", "get, post", "", 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.allowsOrigin("https://a.example") || !p.allowsOrigin("https://b.example") || p.allowsOrigin("https://c.example") {
+		t.Errorf("origins = %q", p.origins)
+	}
+	if !slices.Equal(p.methods, []string{"GET", "POST"}) {
+		t.Errorf("methods = %q, want GET and POST", p.methods)
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	h := newTestServer(t, withCORS("https://dash.example", false)).Handler()
+	// Preflights are answered ahead of routing, so the 405 a plain OPTIONS
+	// might meet and the API key a POST might need do not apply.
+	rec := send(h, http.MethodOptions, "/receipts/process", "",
+		"Origin", "https://dash.example", "Access-Control-Request-Method", "POST", "Access-Control-Request-Headers", "Content-Type")
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("preflight = %d %s, want 204", rec.Code, rec.Body)
+	}
+	want := map[string]string{
+		"Access-Control-Allow-Origin":      "https://dash.example",
+		"Access-Control-Allow-Methods":     "GET, POST",
+		"Access-Control-Allow-Headers":     "Content-Type, Authorization",
+		"Access-Control-Max-Age":           "600",
+		"Access-Control-Allow-Credentials": "",
+	}
+	for name, value := range want {
+		if got := rec.Header().Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+	if vary := rec.Header().Values("Vary"); !slices.Contains(vary, "Origin") || !slices.Contains(vary, "Access-Control-Request-Method") {
+		t.Errorf("Vary = %q, want Origin and Access-Control-Request-Method", vary)
+	}
+
+	// Refusals are told by the headers' absence.
+	for _, header := range [][]string{
+		{"Origin", "https://evil.example", "Access-Control-Request-Method", "POST"},
+		{"Origin", "https://dash.example", "Access-Control-Request-Method", "DELETE"},
+	} {
+		rec := send(h, http.MethodOptions, "/receipts/process", "", header...)
+		if rec.Code != http.StatusNoContent || rec.Header().Get("Access-Control-Allow-Origin") != "" || rec.Header().Get("Access-Control-Allow-Methods") != "" {
+			t.Errorf("preflight with %q = %d %v, want 204 without CORS headers", header, rec.Code, rec.Header())
+		}
+	}
+}
+
+func TestCORSActualRequest(t *testing.T) {
+	h := newTestServer(t, withCORS("https://dash.example", true)).Handler()
+	rec := send(h, http.MethodPost, "/receipts/process", targetReceipt, "Origin", "https://dash.example")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST = %d %s, want 201", rec.Code, rec.Body)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://dash.example" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want the origin", got)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Credentials"); got != "true" {
+		t.Errorf("Access-Control-Allow-Credentials = %q, want true", got)
+	}
+	if got := rec.Header().Get("Access-Control-Expose-Headers"); got != corsExposedHeaders {
+		t.Errorf("Access-Control-Expose-Headers = %q, want %q", got, corsExposedHeaders)
+	}
+	if rec.Header().Get("Access-Control-Allow-Methods") != "" {
+		t.Error("an actual request got preflight headers")
+	}
+
+	// Other origins are served, but browsers keep the response from them.
+	rec = send(h, http.MethodPost, "/receipts/process", targetReceipt, "Origin", "https://evil.example")
+	if rec.Code != http.StatusCreated || rec.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("POST from another origin = %d with Access-Control-Allow-Origin %q, want 201 without it",
+			rec.Code, rec.Header().Get("Access-Control-Allow-Origin"))
+	}
+	// So are requests without an origin, which browsers send same-origin.
+	rec = send(h, http.MethodPost, "/receipts/process", targetReceipt)
+	if rec.Code != http.StatusCreated || rec.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("POST without an origin = %d with Access-Control-Allow-Origin %q", rec.Code, rec.Header().Get("Access-Control-Allow-Origin"))
+	}
+}
+
+func TestCORSAnyOrigin(t *testing.T) {
+	h := newTestServer(t, withCORS("*", false)).Handler()
+	rec := send(h, http.MethodGet, "/receipts", "", "Origin", "https://anywhere.example")
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want *", got)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Credentials"); got != "" {
+		t.Errorf("Access-Control-Allow-Credentials = %q, want none", got)
+	}
+}
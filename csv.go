@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+// csvReceiptColumns are the receipt columns a CSV upload must have.
+var csvReceiptColumns = []string{"retailer", "purchaseDate", "purchaseTime", "total"}
+
+// csvItemColumn matches the repeated item columns of the single-file format,
+// item1ShortDescription, item1Price, item2ShortDescription and so on.
+var csvItemColumn = regexp.MustCompile(`^(?i)item([1-9][0-9]*)(shortDescription|price)$`)
+
+// lineResult is the outcome for one receipt of an upload that is read line
+// by line: a row of a CSV upload, whose Line counts the header of the
+// receipts file as line 1, or a line of an NDJSON stream.
+type lineResult struct {
+	Line      int        `json:"line"`
+	ID        string     `json:"id,omitempty"`
+	Duplicate bool       `json:"duplicate,omitempty"`
+	Cap       *capResult `json:"cap,omitempty"`
+	Error     *apiError  `json:"error,omitempty"`
+}
+
+// csvTable is a parsed CSV file: its header, with names folded to lower
+// case, and its data rows.
+type csvTable struct {
+	columns map[string]int
+	header  []string
+	rows    []csvRow
+}
+
+type csvRow struct {
+	line   int
+	fields []string
+}
+
+func (t *csvTable) field(row csvRow, column string) string {
+	i, ok := t.columns[strings.ToLower(column)]
+	if !ok || i >= len(row.fields) {
+		return ""
+	}
+	return row.fields[i]
+}
+
+// processCSVHandler handles POST /receipts/process/csv, for point-of-sale
+// systems that export CSV rather than JSON. The body is either a text/csv
+// file with one receipt per row and its items in repeated item columns, or a
+// multipart/form-data upload with a "receipts" file and, optionally, an
+// "items" file listing the items of each receipt by its "ref" column. Rows
+// are processed independently, as in a batch.
+func (s *Server) processCSVHandler(w http.ResponseWriter, r *http.Request) {
+	receipts, apiErr := s.parseCSVUpload(r)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	if len(receipts) > s.batchLimit {
+		writeError(w, http.StatusRequestEntityTooLarge, codeBatchTooLarge,
+			fmt.Sprintf("Upload contains %d receipts; the limit is %d", len(receipts), s.batchLimit))
+		return
+	}
+
+	ctx := r.Context()
+	strict := s.strictTotalsFor(r)
+	w.Header().Set("Content-Type", "application/json")
+	results := &jsonArrayWriter{w: w}
+	write := func(line int, result batchResult) {
+		if result.Error != nil {
+			result.Error = result.Error.in(responseLocale(w))
+		}
+		results.write(lineResult{Line: line, ID: result.ID, Duplicate: result.Duplicate, Cap: result.Cap, Error: result.Error})
+	}
+
+	// As in a batch, the rows are scored in parallel and stored in order.
+	stored := 0
+	err := runOrdered(ctx, s.workers, sliceInputs(len(receipts)),
+		func(i int) scoredReceipt {
+			parsed := receipts[i]
+			if parsed.err != nil {
+				return scoredReceipt{err: parsed.err}
+			}
+			receipt, breakdown, err := s.scoreReceipt(parsed.receipt, strict)
+			return scoredReceipt{receipt: receipt, breakdown: breakdown, err: err}
+		},
+		func(i int, v any) scoredReceipt { return scoredReceipt{err: s.scoringPanic(ctx, v)} },
+		func(i int, scored scoredReceipt) bool {
+			write(receipts[i].line, s.storeBatchItem(ctx, scored))
+			stored++
+			return true
+		})
+	if err != nil {
+		for _, parsed := range receipts[stored:] {
+			write(parsed.line, batchResult{Error: s.storeError(ctx, err)})
+		}
+	}
+	results.close()
+}
+
+// csvReceipt is a receipt parsed from a row of a CSV upload, or the reason
+// the row could not be parsed.
+type csvReceipt struct {
+	line    int
+	receipt points.Receipt
+	err     *apiError
+}
+
+// parseCSVUpload reads the receipts of a CSV upload in either format.
+func (s *Server) parseCSVUpload(r *http.Request) ([]csvReceipt, *apiError) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch {
+	case err == nil && mediaType == "text/csv":
+		table, apiErr := readCSVTable("receipts", r.Body)
+		if apiErr != nil {
+			return nil, apiErr
+		}
+		return parseCSVReceipts(table, nil)
+	case err == nil && mediaType == "multipart/form-data":
+	default:
+		return nil, newAPIError(http.StatusUnsupportedMediaType, codeUnsupportedMediaType,
+			"Content-Type must be text/csv or multipart/form-data")
+	}
+
+	if err := r.ParseMultipartForm(s.maxBodyBytes); err != nil {
+		return nil, bodyReadError(err, "The request body is not valid multipart/form-data")
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	receipts, apiErr := readCSVPart(r, "receipts")
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	if receipts == nil {
+		return nil, newAPIError(http.StatusBadRequest, codeInvalidBody, `The upload must include a "receipts" file`)
+	}
+	items, apiErr := readCSVPart(r, "items")
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	return parseCSVReceipts(receipts, items)
+}
+
+// readCSVPart reads the named file of a multipart upload, returning nil if
+// there is none.
+func readCSVPart(r *http.Request, name string) (*csvTable, *apiError) {
+	file, _, err := r.FormFile(name)
+	if errors.Is(err, http.ErrMissingFile) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, bodyReadError(err, fmt.Sprintf("The %q file could not be read", name))
+	}
+	defer file.Close()
+	return readCSVTable(name, file)
+}
+
+// readCSVTable parses a CSV file whose first row is a header. A leading
+// byte order mark is skipped, and the delimiter is a semicolon if the header
+// has more semicolons than commas, as in exports from locales that use the
+// comma as a decimal separator.
+func readCSVTable(name string, body io.Reader) (*csvTable, *apiError) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, bodyReadError(err, "The request body could not be read")
+	}
+	data = bytes.TrimPrefix(data, []byte("\ufeff"))
+	firstLine, _, _ := bytes.Cut(data, []byte("\n"))
+
+	reader := csv.NewReader(bytes.NewReader(data))
+	if bytes.Count(firstLine, []byte(";")) > bytes.Count(firstLine, []byte(",")) {
+		reader.Comma = ';'
+	}
+	reader.FieldsPerRecord = -1
+
+	table := &csvTable{columns: make(map[string]int)}
+	for {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, newAPIError(http.StatusBadRequest, codeInvalidBody, fmt.Sprintf("The %s file is not valid CSV: %v", name, err))
+		}
+		line, _ := reader.FieldPos(0)
+		if table.header == nil {
+			table.header = fields
+			for i, column := range fields {
+				column = strings.ToLower(strings.TrimSpace(column))
+				if _, dup := table.columns[column]; dup {
+					return nil, newAPIError(http.StatusBadRequest, codeInvalidBody,
+						fmt.Sprintf("The %s file has more than one %q column", name, column))
+				}
+				table.columns[column] = i
+			}
+			continue
+		}
+		table.rows = append(table.rows, csvRow{line: line, fields: fields})
+	}
+	if table.header == nil {
+		return nil, newAPIError(http.StatusBadRequest, codeEmptyBody, fmt.Sprintf("The %s file is empty", name))
+	}
+	return table, nil
+}
+
+// parseCSVReceipts turns the rows of receipts into receipts, taking their
+// items from items if given and otherwise from the repeated item columns.
+// Unknown columns are rejected rather than ignored, since a misspelt item
+// column would otherwise silently cost receipts their points.
+func parseCSVReceipts(receipts, items *csvTable) ([]csvReceipt, *apiError) {
+	required := csvReceiptColumns
+	if items != nil {
+		required = append([]string{"ref"}, required...)
+	}
+	for _, column := range required {
+		if _, ok := receipts.columns[strings.ToLower(column)]; !ok {
+			return nil, newAPIError(http.StatusBadRequest, codeInvalidBody,
+				fmt.Sprintf("The receipts file has no %q column", column))
+		}
+	}
+
+	// itemColumns[n] holds the column indexes of item n+1's description and
+	// price, or -1 where a column is absent.
+	var itemColumns [][2]int
+	for i, column := range receipts.header {
+		column = strings.TrimSpace(column)
+		if isCSVColumn(column, required) {
+			continue
+		}
+		match := csvItemColumn.FindStringSubmatch(column)
+		if match == nil || items != nil {
+			return nil, newAPIError(http.StatusBadRequest, codeInvalidBody,
+				fmt.Sprintf("The receipts file has an unknown column %q", column))
+		}
+		n, err := strconv.Atoi(match[1])
+		if err != nil || n > len(receipts.header) {
+			return nil, newAPIError(http.StatusBadRequest, codeInvalidBody,
+				fmt.Sprintf("The receipts file has too few columns for %q", column))
+		}
+		for len(itemColumns) < n {
+			itemColumns = append(itemColumns, [2]int{-1, -1})
+		}
+		if strings.EqualFold(match[2], "price") {
+			itemColumns[n-1][1] = i
+		} else {
+			itemColumns[n-1][0] = i
+		}
+	}
+
+	parsed := make([]csvReceipt, len(receipts.rows))
+	refs := make(map[string]int)
+	for i, row := range receipts.rows {
+		parsed[i].line = row.line
+		if items != nil {
+			// Rows are matched up with their items even when they are
+			// rejected, so their items are not reported as orphans.
+			ref := receipts.field(row, "ref")
+			if _, dup := refs[ref]; dup {
+				parsed[i].err = newAPIError(http.StatusBadRequest, codeInvalidBody,
+					fmt.Sprintf("Another row has the ref %q", ref))
+				continue
+			}
+			refs[ref] = i
+		}
+		if len(row.fields) != len(receipts.header) {
+			parsed[i].err = newAPIError(http.StatusBadRequest, codeInvalidBody,
+				fmt.Sprintf("The row has %d fields but the header has %d", len(row.fields), len(receipts.header)))
+			continue
+		}
+		parsed[i].receipt = points.Receipt{
+			Retailer:     receipts.field(row, "retailer"),
+			PurchaseDate: receipts.field(row, "purchaseDate"),
+			PurchaseTime: receipts.field(row, "purchaseTime"),
+			Total:        points.Money(receipts.field(row, "total")),
+		}
+		for _, columns := range itemColumns {
+			var item points.Item
+			if columns[0] >= 0 {
+				item.ShortDescription = row.fields[columns[0]]
+			}
+			if columns[1] >= 0 {
+				item.Price = points.Money(row.fields[columns[1]])
+			}
+			// Rows with fewer items than the widest leave the rest blank.
+			if item != (points.Item{}) {
+				parsed[i].receipt.Items = append(parsed[i].receipt.Items, item)
+			}
+		}
+	}
+
+	if items != nil {
+		if err := addCSVItems(parsed, refs, items); err != nil {
+			return nil, err
+		}
+	}
+	return parsed, nil
+}
+
+// addCSVItems adds the items of the two-file format to the receipts they
+// reference.
+func addCSVItems(parsed []csvReceipt, refs map[string]int, items *csvTable) *apiError {
+	columns := []string{"ref", "shortDescription", "price"}
+	for _, column := range items.header {
+		if !isCSVColumn(strings.TrimSpace(column), columns) {
+			return newAPIError(http.StatusBadRequest, codeInvalidBody,
+				fmt.Sprintf("The items file has an unknown column %q", column))
+		}
+	}
+	for _, column := range columns {
+		if _, ok := items.columns[strings.ToLower(column)]; !ok {
+			return newAPIError(http.StatusBadRequest, codeInvalidBody,
+				fmt.Sprintf("The items file has no %q column", column))
+		}
+	}
+
+	for _, row := range items.rows {
+		if len(row.fields) != len(items.header) {
+			return newAPIError(http.StatusBadRequest, codeInvalidBody,
+				fmt.Sprintf("Line %d of the items file has %d fields but the header has %d", row.line, len(row.fields), len(items.header)))
+		}
+		ref := items.field(row, "ref")
+		i, ok := refs[ref]
+		if !ok {
+			return newAPIError(http.StatusBadRequest, codeInvalidBody,
+				fmt.Sprintf("Line %d of the items file refers to unknown receipt %q", row.line, ref))
+		}
+		parsed[i].receipt.Items = append(parsed[i].receipt.Items, points.Item{
+			ShortDescription: items.field(row, "shortDescription"),
+			Price:            points.Money(items.field(row, "price")),
+		})
+	}
+	return nil
+}
+
+func isCSVColumn(column string, columns []string) bool {
+	for _, c := range columns {
+		if strings.EqualFold(column, c) {
+			return true
+		}
+	}
+	return false
+}
+
+// csvExportHeader is the header row of GET /receipts/export.csv.
+var csvExportHeader = []string{"id", "retailer", "purchaseDate", "purchaseTime", "total", "itemCount", "points"}
+
+// exportCSVHandler handles GET /receipts/export.csv, streaming one row per
+// stored receipt, in the order they were stored, for loading into a
+// spreadsheet. It takes the listing's retailer, from and to filters.
+func (s *Server) exportCSVHandler(w http.ResponseWriter, r *http.Request) {
+	filter, errs := parseReceiptFilter(r.URL.Query(), s.names)
+	if len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, codeInvalidQuery, "The query parameters are invalid.", errs...)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="receipts.csv"`)
+	cw := csv.NewWriter(w)
+	cw.Write(csvExportHeader)
+
+	err := scanPaged(r.Context(), s.store, func(stored StoredReceipt) error {
+		if !filter.matches(stored.Receipt) {
+			return nil
+		}
+		return cw.Write([]string{
+			s.ids.external(stored.ID),
+			s.denylist.mask(stored.Receipt.Retailer),
+			stored.Receipt.PurchaseDate,
+			stored.Receipt.PurchaseTime,
+			string(stored.Receipt.Total),
+			strconv.Itoa(len(stored.Receipt.Items)),
+			strconv.Itoa(stored.Points),
+		})
+	})
+	if err != nil {
+		// As with the admin export, the status line has likely gone out,
+		// so the download can only be cut short.
+		s.logger.ErrorContext(r.Context(), "CSV export failed", slog.String("component", componentStore), slog.Any("error", err))
+		return
+	}
+	cw.Flush()
+}
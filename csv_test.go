@@ -0,0 +1,114 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadCSVTable(t *testing.T) {
+	tests := []struct {
+		name   string
+		csv    string
+		header []string
+		rows   []csvRow
+	}{
+		{
+			name:   "plain",
+			csv:    "retailer,total\nTarget,35.35\n",
+			header: []string{"retailer", "total"},
+			rows:   []csvRow{{2, []string{"Target", "35.35"}}},
+		},
+		{
+			name:   "quoted comma",
+			csv:    "retailer,total\n\"M&M Corner Market, Inc.\",9.00\n",
+			header: []string{"retailer", "total"},
+			rows:   []csvRow{{2, []string{"M&M Corner Market, Inc.", "9.00"}}},
+		},
+		{
+			name:   "quoted newline",
+			csv:    "retailer,total\n\"Target\nDowntown\",35.35\nWalgreens,2.65\n",
+			header: []string{"retailer", "total"},
+			// A row's line is where it starts.
+			rows: []csvRow{{2, []string{"Target\nDowntown", "35.35"}}, {4, []string{"Walgreens", "2.65"}}},
+		},
+		{
+			name:   "quoted quote",
+			csv:    "retailer,total\n\"The \"\"Corner\"\" Shop\",1.00\n",
+			header: []string{"retailer", "total"},
+			rows:   []csvRow{{2, []string{`The "Corner" Shop`, "1.00"}}},
+		},
+		{
+			name:   "byte order mark",
+			csv:    "\ufeffretailer,total\nTarget,35.35\n",
+			header: []string{"retailer", "total"},
+			rows:   []csvRow{{2, []string{"Target", "35.35"}}},
+		},
+		{
+			name:   "semicolons",
+			csv:    "retailer;total;item1Price\nTarget, Inc.;35,35;6,49\n",
+			header: []string{"retailer", "total", "item1Price"},
+			rows:   []csvRow{{2, []string{"Target, Inc.", "35,35", "6,49"}}},
+		},
+		{
+			name:   "semicolons and a byte order mark",
+			csv:    "\ufeffretailer;total\r\nTarget;35,35\r\n",
+			header: []string{"retailer", "total"},
+			rows:   []csvRow{{2, []string{"Target", "35,35"}}},
+		},
+		{
+			// A header with as many semicolons as commas is comma-separated.
+			name:   "commas and a semicolon",
+			csv:    "retailer,total\nA;B,1.00\n",
+			header: []string{"retailer", "total"},
+			rows:   []csvRow{{2, []string{"A;B", "1.00"}}},
+		},
+		{
+			name:   "ragged rows",
+			csv:    "retailer,total\nTarget\nWalgreens,2.65,extra\n",
+			header: []string{"retailer", "total"},
+			rows:   []csvRow{{2, []string{"Target"}}, {3, []string{"Walgreens", "2.65", "extra"}}},
+		},
+		{
+			name:   "header only",
+			csv:    "retailer,total\n",
+			header: []string{"retailer", "total"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table, err := readCSVTable("receipts", strings.NewReader(tt.csv))
+			if err != nil {
+				t.Fatalf("readCSVTable = %v", err)
+			}
+			if !reflect.DeepEqual(table.header, tt.header) || !reflect.DeepEqual(table.rows, tt.rows) {
+				t.Errorf("readCSVTable = header %q, rows %q; want %q, %q", table.header, table.rows, tt.header, tt.rows)
+			}
+			for i, column := range tt.header {
+				if table.columns[strings.ToLower(column)] != i {
+					t.Errorf("column %q is at %d, want %d", column, table.columns[strings.ToLower(column)], i)
+				}
+			}
+		})
+	}
+}
+
+func TestReadCSVTableErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		csv  string
+		code string
+	}{
+		{"empty", "", codeEmptyBody},
+		{"byte order mark only", "\ufeff", codeEmptyBody},
+		{"unterminated quote", "retailer,total\n\"Target,35.35\n", codeInvalidBody},
+		{"bare quote", "retailer,total\nTar\"get,35.35\n", codeInvalidBody},
+		{"duplicate column", "retailer,total,Retailer\nTarget,35.35,Target\n", codeInvalidBody},
+	}
+	for _, tt := range tests {
+		table, err := readCSVTable("receipts", strings.NewReader(tt.csv))
+		if err == nil || err.Code != tt.code {
+			t.Errorf("%s: readCSVTable = %+v, %v; want a %s error", tt.name, table, err, tt.code)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+)
+
+// defaultDebugAddr is where the -debug listener serves unless told otherwise.
+const defaultDebugAddr = "localhost:6060"
+
+// debugHandler serves the -debug endpoints: the net/http/pprof profiles under
+// /debug/pprof/ and a runtime summary at /debug/vars. It is served on its own
+// listener, never alongside the API.
+func (s *Server) debugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /debug/pprof/", pprof.Index)
+	mux.HandleFunc("GET /debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("GET /debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("GET /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("POST /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("GET /debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("GET /debug/vars", s.debugVarsHandler)
+	return s.logRequests(s.recoverPanics(mux))
+}
+
+// debugVars is the body of the GET /debug/vars response.
+type debugVars struct {
+	Store struct {
+		// Receipts is omitted if the store could not be listed.
+		Receipts *int `json:"receipts,omitempty"`
+	} `json:"store"`
+	Retailers          int `json:"retailers"`
+	AsyncQueued        int `json:"asyncQueued"`
+	IdempotencyEntries int `json:"idempotencyEntries"`
+	Goroutines         int `json:"goroutines"`
+	Memory             struct {
+		HeapAllocBytes uint64 `json:"heapAllocBytes"`
+		HeapObjects    uint64 `json:"heapObjects"`
+		SysBytes       uint64 `json:"sysBytes"`
+	} `json:"memory"`
+	GC struct {
+		Cycles      uint32     `json:"cycles"`
+		PauseTotal  float64    `json:"pauseTotalSeconds"`
+		LastPause   float64    `json:"lastPauseSeconds"`
+		LastCycleAt *time.Time `json:"lastCycleAt,omitempty"`
+		NextGCBytes uint64     `json:"nextGCBytes"`
+	} `json:"gc"`
+}
+
+// debugVarsHandler handles GET /debug/vars, summarizing what the process
+// holds: store and index sizes, goroutines, and memory and GC statistics.
+func (s *Server) debugVarsHandler(w http.ResponseWriter, r *http.Request) {
+	var vars debugVars
+	if ids, err := s.store.List(r.Context()); err == nil {
+		n := len(ids)
+		vars.Store.Receipts = &n
+	}
+	vars.Retailers = s.retailers.size()
+	vars.AsyncQueued = s.async.queued()
+	vars.IdempotencyEntries = s.idempotency.size()
+	vars.Goroutines = runtime.NumGoroutine()
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	vars.Memory.HeapAllocBytes = mem.HeapAlloc
+	vars.Memory.HeapObjects = mem.HeapObjects
+	vars.Memory.SysBytes = mem.Sys
+	vars.GC.Cycles = mem.NumGC
+	vars.GC.PauseTotal = time.Duration(mem.PauseTotalNs).Seconds()
+	vars.GC.NextGCBytes = mem.NextGC
+	if mem.NumGC > 0 {
+		vars.GC.LastPause = time.Duration(mem.PauseNs[(mem.NumGC+255)%256]).Seconds()
+		last := time.Unix(0, int64(mem.LastGC)).UTC()
+		vars.GC.LastCycleAt = &last
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(vars)
+}
+
+// newDebugServer returns the server for the -debug listener. It has no write
+// timeout, since CPU profiles and traces take as long as the client asks.
+func (s *Server) newDebugServer(addr string, readTimeout time.Duration) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           s.debugHandler(),
+		ReadHeaderTimeout: readTimeout,
+		ReadTimeout:       readTimeout,
+	}
+}
+
+// isLoopback reports whether addr listens only on the loopback interface.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
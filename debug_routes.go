@@ -0,0 +1,15 @@
+//go:build debugroutes
+
+package main
+
+import "net/http"
+
+// Routes that exist only to exercise the server's failure handling. They are
+// compiled in with -tags debugroutes and must never ship in a release build.
+func init() {
+	debugRoutes = append(debugRoutes, func(mux *http.ServeMux) {
+		mux.HandleFunc("GET /debug/panic", func(w http.ResponseWriter, r *http.Request) {
+			panic("deliberate panic from /debug/panic")
+		})
+	})
+}
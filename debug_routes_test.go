@@ -0,0 +1,19 @@
+//go:build debugroutes
+
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestDebugPanicRoute(t *testing.T) {
+	h := newTestServer(t).Handler()
+	rec := send(h, http.MethodGet, "/debug/panic", "")
+	if rec.Code != http.StatusInternalServerError || errorCode(t, rec) != codeInternal {
+		t.Errorf("GET /debug/panic = %d %s, want 500 %s", rec.Code, rec.Body, codeInternal)
+	}
+	if rec := send(h, http.MethodGet, "/healthz", ""); rec.Code != http.StatusOK {
+		t.Errorf("GET /healthz after a recovered panic = %d, want 200", rec.Code)
+	}
+}
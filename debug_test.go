@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDebugEndpointsOffTheAPI(t *testing.T) {
+	h := newTestServer(t, withAdmin).Handler()
+	for _, target := range []string{"/debug/pprof/", "/debug/pprof/heap", "/debug/pprof/cmdline", "/debug/vars"} {
+		for _, header := range [][]string{nil, {"Authorization", "Bearer admin"}} {
+			if rec := send(h, http.MethodGet, target, "", header...); rec.Code != http.StatusNotFound {
+				t.Errorf("GET %s on the API = %d, want 404", target, rec.Code)
+			}
+		}
+	}
+}
+
+func TestDebugEndpoints(t *testing.T) {
+	s := newTestServer(t)
+	api := s.Handler()
+	processReceipt(t, api, targetReceipt)
+	processReceipt(t, api, marketReceipt)
+	h := s.debugHandler()
+
+	rec := send(h, http.MethodGet, "/debug/pprof/", "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "heap") {
+		t.Errorf("GET /debug/pprof/ = %d, want 200 with an index of the profiles", rec.Code)
+	}
+	rec = send(h, http.MethodGet, "/debug/pprof/heap?debug=1", "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "heap profile") {
+		t.Errorf("GET /debug/pprof/heap = %d, want 200 with a heap profile", rec.Code)
+	}
+
+	rec = send(h, http.MethodGet, "/debug/vars", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /debug/vars = %d %s, want 200", rec.Code, rec.Body)
+	}
+	if got := rec.Header().Get("Cache-Control"); got != "no-store" {
+		t.Errorf("Cache-Control = %q, want no-store", got)
+	}
+	var vars debugVars
+	decodeBody(t, rec, &vars)
+	if vars.Store.Receipts == nil || *vars.Store.Receipts != 2 {
+		t.Errorf("store receipts = %v, want 2", vars.Store.Receipts)
+	}
+	if vars.Retailers != 2 || vars.Goroutines == 0 || vars.Memory.HeapAllocBytes == 0 || vars.GC.NextGCBytes == 0 {
+		t.Errorf("vars = %+v, want 2 retailers and the runtime's statistics", vars)
+	}
+
+	// The API's routes are not served alongside.
+	if rec := send(h, http.MethodGet, "/receipts/export.csv", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("GET /receipts/export.csv on the debug listener = %d, want 404", rec.Code)
+	}
+}
+
+func TestDebugConfig(t *testing.T) {
+	cfg, err := parseConfig(nil, envOf(nil))
+	if err != nil || cfg.Debug {
+		t.Fatalf("default config = %+v, %v, want debug endpoints off", cfg, err)
+	}
+	cfg, err = parseConfig(nil, envOf(map[string]string{"DEBUG_ENDPOINTS": "true"}))
+	if err != nil || !cfg.Debug || cfg.DebugAddr != defaultDebugAddr {
+		t.Errorf("DEBUG_ENDPOINTS=true gives debug %v on %q, %v, want on %s", cfg.Debug, cfg.DebugAddr, err, defaultDebugAddr)
+	}
+
+	for _, addr := range []string{"localhost:7070", "127.0.0.1:7070", "[::1]:7070"} {
+		if _, err := parseConfig([]string{"-debug", "-debug-addr", addr}, envOf(nil)); err != nil {
+			t.Errorf("-debug-addr %s: %v", addr, err)
+		}
+	}
+	// Profiles must never be reachable from outside the host.
+	for _, addr := range []string{":6060", "0.0.0.0:6060", "10.0.0.1:6060", "example.com:6060"} {
+		if _, err := parseConfig([]string{"-debug", "-debug-addr", addr}, envOf(nil)); err == nil {
+			t.Errorf("-debug-addr %s was accepted", addr)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+// dedupIndex maps the content hash of every stored receipt to its ID so that
+// resubmissions of an identical receipt return the original ID. Receipts
+// are only duplicates of those stored by the same tenant.
+type dedupIndex struct {
+	ignoreItemOrder bool
+
+	// mu is held across the lookup and the store write, so two identical
+	// receipts submitted concurrently cannot both be stored.
+	mu     sync.Mutex
+	ids    map[string]string // hash -> receipt ID
+	hashes map[string]string // receipt ID -> hash
+}
+
+// newDedupIndex builds an index over the receipts already in store.
+func newDedupIndex(store Store, ignoreItemOrder bool) (*dedupIndex, error) {
+	d := &dedupIndex{
+		ignoreItemOrder: ignoreItemOrder,
+		ids:             make(map[string]string),
+		hashes:          make(map[string]string),
+	}
+
+	err := scanPaged(context.Background(), store, func(stored StoredReceipt) error {
+		d.add(d.hash(stored.Tenant, stored.Receipt), stored.ID)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// hash returns a canonical content hash of receipt as stored by tenant.
+// Surrounding whitespace and letter case in text fields are ignored, as is
+// item order if the index was configured to ignore it.
+func (d *dedupIndex) hash(tenant string, receipt points.Receipt) string {
+	type canonicalItem struct {
+		Description string       `json:"d"`
+		Price       points.Money `json:"p"`
+		Units       int          `json:"u,omitempty"` // 0 for the default of 1
+	}
+	canonical := struct {
+		Tenant   string          `json:"n,omitempty"`
+		Retailer string          `json:"r"`
+		Date     string          `json:"d"`
+		Time     string          `json:"t"`
+		Total    points.Money    `json:"s"`
+		Items    []canonicalItem `json:"i"`
+		Zone     string          `json:"z,omitempty"`
+	}{
+		Tenant:   tenant,
+		Retailer: strings.ToLower(strings.TrimSpace(receipt.Retailer)),
+		Date:     receipt.PurchaseDate,
+		Time:     receipt.PurchaseTime,
+		Total:    receipt.Total,
+		Zone:     receipt.Timezone,
+	}
+	for _, item := range receipt.Items {
+		entry := canonicalItem{
+			Description: strings.ToLower(strings.TrimSpace(item.ShortDescription)),
+			Price:       item.Price,
+		}
+		// A quantity of 1 is the same as none.
+		if units := item.Units(); units != 1 {
+			entry.Units = units
+		}
+		canonical.Items = append(canonical.Items, entry)
+	}
+	if d.ignoreItemOrder {
+		sort.Slice(canonical.Items, func(i, j int) bool {
+			a, b := canonical.Items[i], canonical.Items[j]
+			if a.Description != b.Description {
+				return a.Description < b.Description
+			}
+			return a.Price < b.Price || (a.Price == b.Price && a.Units < b.Units)
+		})
+	}
+
+	data, _ := json.Marshal(canonical)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// add, remove and clear must be called with mu held.
+func (d *dedupIndex) add(hash, id string) {
+	d.ids[hash] = id
+	d.hashes[id] = hash
+}
+
+func (d *dedupIndex) remove(id string) {
+	if hash, ok := d.hashes[id]; ok {
+		delete(d.ids, hash)
+		delete(d.hashes, id)
+	}
+}
+
+func (d *dedupIndex) clear() {
+	d.ids = make(map[string]string)
+	d.hashes = make(map[string]string)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+// maskedContent replaces a retailer name that matches the denylist wherever
+// receipts are shown to others.
+const maskedContent = "***"
+
+// denyPolicy is what is done with a receipt whose retailer or an item
+// description matches a denylist pattern.
+type denyPolicy int
+
+const (
+	// denyMask accepts the receipt, scoring it as sent, but shows its
+	// retailer as maskedContent in listings, the leaderboard and the CSV
+	// export.
+	denyMask denyPolicy = iota
+	// denyReject refuses the receipt.
+	denyReject
+)
+
+// denyPattern is one line of a denylist file.
+type denyPattern struct {
+	policy denyPolicy
+	// word is matched against text lower-cased and stripped of
+	// whitespace, so that "B A D" and " bad" match the word bad. It is ""
+	// for a regexp pattern.
+	word string
+	// re is matched against text with its whitespace trimmed and
+	// collapsed, ignoring case.
+	re *regexp.Regexp
+}
+
+// denylist holds the patterns of offensive strings that retailer names and
+// item descriptions are checked against at intake. The file it is loaded
+// from can be reloaded while receipts are being checked.
+//
+// A nil *denylist matches nothing.
+type denylist struct {
+	path     string
+	patterns atomic.Pointer[[]denyPattern]
+	reload   sync.Mutex // serializes reloads, so they are logged in order
+}
+
+// loadDenylist returns the denylist in the file at path, which lists one
+// pattern per line: a policy, reject or mask, followed by either a word or a
+// regular expression between slashes. Blank lines and lines starting with #
+// are ignored.
+//
+//	reject badword
+//	mask /^shady\s*(shop|store)$/
+func loadDenylist(path string) (*denylist, error) {
+	d := &denylist{path: path}
+	if _, err := d.load(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// load reads the file again and checks receipts against its patterns from
+// then on, returning how many there are. If the file does not load, the
+// patterns in use are kept.
+func (d *denylist) load() (int, error) {
+	data, err := os.ReadFile(d.path)
+	if err != nil {
+		return 0, err
+	}
+	patterns, err := parseDenyPatterns(data)
+	if err != nil {
+		return 0, fmt.Errorf("parsing %s: %w", d.path, err)
+	}
+	d.patterns.Store(&patterns)
+	return len(patterns), nil
+}
+
+func parseDenyPatterns(data []byte) ([]denyPattern, error) {
+	patterns := []denyPattern{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, pattern, _ := strings.Cut(line, " ")
+		var p denyPattern
+		switch name {
+		case "reject":
+			p.policy = denyReject
+		case "mask":
+			p.policy = denyMask
+		default:
+			return nil, fmt.Errorf("line %d: policy must be reject or mask, got %q", n, name)
+		}
+		pattern = strings.TrimSpace(pattern)
+		if len(pattern) >= 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+			re, err := regexp.Compile("(?i)" + pattern[1:len(pattern)-1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			p.re = re
+		} else if p.word = compactText(pattern); p.word == "" {
+			return nil, fmt.Errorf("line %d: missing pattern", n)
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, scanner.Err()
+}
+
+// compactText returns s lower-cased, with all whitespace removed.
+func compactText(s string) string {
+	return strings.ToLower(strings.Join(strings.Fields(s), ""))
+}
+
+// match returns the policy of the patterns text matches, reject if any of
+// them rejects, and reports whether it matches any.
+func (d *denylist) match(text string) (denyPolicy, bool) {
+	if d == nil {
+		return 0, false
+	}
+	compact, collapsed := compactText(text), collapseSpaces(text)
+	policy, matched := denyMask, false
+	for _, p := range *d.patterns.Load() {
+		if p.re != nil && p.re.MatchString(collapsed) || p.re == nil && strings.Contains(compact, p.word) {
+			matched = true
+			policy = max(policy, p.policy)
+		}
+	}
+	return policy, matched
+}
+
+// check returns the error a receipt whose retailer or an item description
+// matches a reject pattern is refused with. The message is the same whatever
+// matched, so as not to echo or hint at the pattern; the details only name
+// the fields, without their values.
+func (d *denylist) check(receipt points.Receipt) *apiError {
+	var errs []points.FieldError
+	if policy, ok := d.match(receipt.Retailer); ok && policy == denyReject {
+		errs = append(errs, points.NewFieldError("retailer", points.ConstraintNotAllowed, nil, "is not allowed"))
+	}
+	for i, item := range receipt.Items {
+		if policy, ok := d.match(item.ShortDescription); ok && policy == denyReject {
+			errs = append(errs, points.NewFieldError(fmt.Sprintf("items[%d].shortDescription", i), points.ConstraintNotAllowed, nil, "is not allowed"))
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return newAPIError(http.StatusUnprocessableEntity, codeContentNotAllowed, "The receipt contains content that is not allowed.", errs...)
+}
+
+// mask returns retailer as it is shown to others: maskedContent if it matches
+// any pattern, whatever its policy, so that receipts stored before a reject
+// pattern was added are hidden too.
+func (d *denylist) mask(retailer string) string {
+	if _, ok := d.match(retailer); ok {
+		return maskedContent
+	}
+	return retailer
+}
+
+// reloadDenylist reloads the denylist file, logging the outcome.
+func (s *Server) reloadDenylist() (int, error) {
+	s.denylist.reload.Lock()
+	defer s.denylist.reload.Unlock()
+
+	n, err := s.denylist.load()
+	if err != nil {
+		s.logger.Error("failed to reload denylist", slog.String("component", componentDenylist), slog.String("path", s.denylist.path), slog.Any("error", err))
+		return 0, err
+	}
+	s.logger.Info("reloaded denylist", slog.String("component", componentDenylist), slog.Int("patterns", n))
+	return n, nil
+}
+
+// reloadDenylistHandler handles POST /admin/denylist/reload, reloading the
+// denylist file as SIGHUP does and reporting how many patterns it has.
+func (s *Server) reloadDenylistHandler(w http.ResponseWriter, r *http.Request) {
+	if s.denylist == nil {
+		writeError(w, http.StatusConflict, codeNoDenylist, "The server was started without a denylist")
+		return
+	}
+	n, err := s.reloadDenylist()
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, codeInvalidDenylist, "The denylist could not be loaded; the patterns in use are unchanged: "+err.Error())
+		return
+	}
+
+	response := struct {
+		Patterns int `json:"patterns"`
+	}{n}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeDenylist writes patterns to a denylist file and returns its path.
+func writeDenylist(t testing.TB, patterns string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "denylist")
+	if err := os.WriteFile(path, []byte(patterns), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// withDenylist checks receipts against the denylist file at path.
+func withDenylist(path string) serverOption {
+	return func(t testing.TB, s *Server) {
+		list, err := loadDenylist(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.denylist = list
+	}
+}
+
+// withRetailer returns targetReceipt from retailer.
+func withRetailer(retailer string) string {
+	return strings.Replace(targetReceipt, `"Target"`, `"`+retailer+`"`, 1)
+}
+
+func TestDenylistReject(t *testing.T) {
+	h := newTestServer(t, withDenylist(writeDenylist(t, "# offensive\nreject badword\n\nreject /^evil\\s+corp$/\nmask shady\n"))).Handler()
+
+	tests := []struct {
+		receipt string
+		fields  []string
+	}{
+		{withRetailer("Badword Mart"), []string{"retailer"}},
+		{withRetailer("  B a D  w O r D  "), []string{"retailer"}},
+		{withRetailer("EVIL   Corp"), []string{"retailer"}},
+		{strings.Replace(targetReceipt, "Mountain Dew 12PK", "  evil corp ", 1), []string{"items[0].shortDescription"}},
+		// A reject pattern outweighs a mask one.
+		{withRetailer("Shady Badword"), []string{"retailer"}},
+		{strings.Replace(withRetailer("Badwords"), "Doritos Nacho Cheese", "BADWORD", 1), []string{"retailer", "items[3].shortDescription"}},
+	}
+	for _, tt := range tests {
+		rec := send(h, http.MethodPost, "/receipts/process", tt.receipt)
+		var body struct {
+			Error struct {
+				Code    string
+				Message string
+				Details []struct{ Field string }
+			}
+		}
+		decodeBody(t, rec, &body)
+		var fields []string
+		for _, detail := range body.Error.Details {
+			fields = append(fields, detail.Field)
+		}
+		if rec.Code != http.StatusUnprocessableEntity || body.Error.Code != codeContentNotAllowed || strings.Join(fields, ",") != strings.Join(tt.fields, ",") {
+			t.Errorf("POST of a receipt with denied content = %d %s, want 422 naming %v", rec.Code, rec.Body, tt.fields)
+		}
+		// The response gives away nothing of what matched.
+		if lower := strings.ToLower(rec.Body.String()); strings.Contains(lower, "badword") || strings.Contains(lower, "evil") {
+			t.Errorf("refusal %s echoes the denied content", rec.Body)
+		}
+	}
+
+	for _, retailer := range []string{"Target", "Bad Weather Co", "Evil Corporation"} {
+		if rec := send(h, http.MethodPost, "/receipts/process", withRetailer(retailer)); rec.Code != http.StatusCreated {
+			t.Errorf("POST with retailer %q = %d %s, want 201", retailer, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestDenylistMask(t *testing.T) {
+	h := newTestServer(t, withDenylist(writeDenylist(t, "mask shady\n"))).Handler()
+	id := processReceipt(t, h, withRetailer("Shady Shop"))
+
+	// The receipt is scored as sent: "ShadyShop" is 9 characters where
+	// "Target" is 6.
+	if got := receiptPoints(t, h, id); got != 31 {
+		t.Errorf("points of the masked receipt = %d, want 31", got)
+	}
+	rec := send(h, http.MethodGet, "/receipts/"+id, "")
+	if !strings.Contains(rec.Body.String(), `"Shady Shop"`) {
+		t.Errorf("GET /receipts/%s = %s, want the retailer as sent", id, rec.Body)
+	}
+	for _, target := range []string{"/receipts", "/retailers/points", "/receipts/export.csv"} {
+		body := send(h, http.MethodGet, target, "").Body.String()
+		if strings.Contains(strings.ToLower(body), "shady") || !strings.Contains(body, maskedContent) {
+			t.Errorf("GET %s = %s, want the retailer masked", target, body)
+		}
+	}
+}
+
+func TestDenylistReload(t *testing.T) {
+	path := writeDenylist(t, "mask shady\n")
+	h := newTestServer(t, withAdmin, withDenylist(path)).Handler()
+	if rec := send(h, http.MethodPost, "/receipts/process", withRetailer("Shady Shop")); rec.Code != http.StatusCreated {
+		t.Fatalf("POST before reloading = %d %s, want 201", rec.Code, rec.Body)
+	}
+
+	if err := os.WriteFile(path, []byte("reject shady\nreject grubby\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var reloaded struct{ Patterns int }
+	rec := sendAdmin(h, http.MethodPost, "/admin/denylist/reload", "")
+	decodeBody(t, rec, &reloaded)
+	if rec.Code != http.StatusOK || reloaded.Patterns != 2 {
+		t.Fatalf("POST /admin/denylist/reload = %d %s, want 2 patterns", rec.Code, rec.Body)
+	}
+	for _, retailer := range []string{"Shady Shop", "Grubby Grill"} {
+		if rec := send(h, http.MethodPost, "/receipts/process", withRetailer(retailer)); rec.Code != http.StatusUnprocessableEntity {
+			t.Errorf("POST with retailer %q after reloading = %d %s, want 422", retailer, rec.Code, rec.Body)
+		}
+	}
+
+	// A file that does not load leaves the patterns in use alone.
+	for _, bad := range []string{"ban shady\n", "reject /(/\n", "reject\n"} {
+		if err := os.WriteFile(path, []byte(bad), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if rec := sendAdmin(h, http.MethodPost, "/admin/denylist/reload", ""); rec.Code != http.StatusUnprocessableEntity || errorCode(t, rec) != codeInvalidDenylist {
+			t.Errorf("reloading %q = %d %s, want 422", bad, rec.Code, rec.Body)
+		}
+		if rec := send(h, http.MethodPost, "/receipts/process", withRetailer("Shady Shop")); rec.Code != http.StatusUnprocessableEntity {
+			t.Errorf("POST after failing to reload %q = %d %s, want 422", bad, rec.Code, rec.Body)
+		}
+	}
+
+	if rec := sendAdmin(newTestServer(t, withAdmin).Handler(), http.MethodPost, "/admin/denylist/reload", ""); rec.Code != http.StatusConflict || errorCode(t, rec) != codeNoDenylist {
+		t.Errorf("reloading without a denylist = %d %s, want 409", rec.Code, rec.Body)
+	}
+}
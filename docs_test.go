@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+// yamlLine is a line of a YAML document with its indentation.
+type yamlLine struct {
+	indent int
+	text   string
+}
+
+// parseYAML parses the block-style subset of YAML the API specs are written
+// in: nested mappings and sequences of scalars. Block scalars are read as
+// empty strings and flow collections as plain strings, since the tests only
+// look at the examples and paths.
+func parseYAML(t *testing.T, data []byte) map[string]any {
+	t.Helper()
+	var lines []yamlLine
+	for _, line := range strings.Split(string(data), "\n") {
+		text := strings.TrimLeft(line, " ")
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		lines = append(lines, yamlLine{len(line) - len(text), strings.TrimRight(text, " ")})
+	}
+	doc, _ := parseYAMLBlock(lines, 0)
+	spec, ok := doc.(map[string]any)
+	if !ok {
+		t.Fatal("the document is not a mapping")
+	}
+	return spec
+}
+
+// parseYAMLBlock parses the mapping or sequence starting at lines[i],
+// returning it and the index of the line after it.
+func parseYAMLBlock(lines []yamlLine, i int) (any, int) {
+	indent := lines[i].indent
+	if isYAMLItem(lines[i].text) {
+		var seq []any
+		for i < len(lines) && lines[i].indent == indent && isYAMLItem(lines[i].text) {
+			rest := strings.TrimSpace(lines[i].text[1:])
+			switch {
+			case rest == "":
+				var v any
+				v, i = parseYAMLBlock(lines, i+1)
+				seq = append(seq, v)
+			case strings.Contains(rest, ": ") || strings.HasSuffix(rest, ":"):
+				// A mapping starting on the item's line; read
+				// that line as the first of the mapping.
+				lines = append([]yamlLine(nil), lines...)
+				lines[i] = yamlLine{indent + 2, rest}
+				var v any
+				v, i = parseYAMLBlock(lines, i)
+				seq = append(seq, v)
+			default:
+				seq = append(seq, yamlScalar(rest))
+				i++
+			}
+		}
+		return seq, i
+	}
+
+	m := make(map[string]any)
+	for i < len(lines) && lines[i].indent == indent && !isYAMLItem(lines[i].text) {
+		key, value, _ := strings.Cut(lines[i].text, ":")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if k, err := strconv.Unquote(key); err == nil {
+			key = k
+		}
+		i++
+		switch {
+		case value == "|" || value == ">" || strings.HasPrefix(value, "|-") || strings.HasPrefix(value, ">-"):
+			for i < len(lines) && lines[i].indent > indent {
+				i++
+			}
+			m[key] = ""
+		case value != "":
+			m[key] = yamlScalar(value)
+		case i < len(lines) && (lines[i].indent > indent || (lines[i].indent == indent && isYAMLItem(lines[i].text))):
+			m[key], i = parseYAMLBlock(lines, i)
+		default:
+			m[key] = nil
+		}
+	}
+	return m, i
+}
+
+func isYAMLItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// yamlScalar returns the value of a scalar: a string, unless it is a plain
+// integer or boolean.
+func yamlScalar(s string) any {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		if v, err := strconv.Unquote(s); err == nil {
+			return v
+		}
+	case strings.HasPrefix(s, "'"):
+		return strings.ReplaceAll(strings.Trim(s, "'"), "''", "'")
+	case s == "true" || s == "false":
+		return s == "true"
+	}
+	if n, err := strconv.Atoi(s); err == nil {
+		return n
+	}
+	return s
+}
+
+// yamlPath returns the node at the path of keys below node, or nil.
+func yamlPath(node any, keys ...string) any {
+	for _, key := range keys {
+		m, ok := node.(map[string]any)
+		if !ok {
+			return nil
+		}
+		node = m[key]
+	}
+	return node
+}
+
+// schemaExample builds an example of the object schema named name in spec
+// from the examples of its properties. Array properties hold one example of
+// the schema their items refer to.
+func schemaExample(t *testing.T, spec map[string]any, name string) map[string]any {
+	t.Helper()
+	properties, ok := yamlPath(spec, "components", "schemas", name, "properties").(map[string]any)
+	if !ok {
+		t.Fatalf("schema %s has no properties", name)
+	}
+	required, _ := yamlPath(spec, "components", "schemas", name, "required").([]any)
+	example := make(map[string]any)
+	for _, field := range required {
+		property := properties[field.(string)]
+		if ref, ok := yamlPath(property, "items", "$ref").(string); ok {
+			example[field.(string)] = []any{schemaExample(t, spec, strings.TrimPrefix(ref, "#/components/schemas/"))}
+			continue
+		}
+		value := yamlPath(property, "example")
+		if value == nil {
+			t.Fatalf("property %s of %s has no example", field, name)
+		}
+		example[field.(string)] = value
+	}
+	return example
+}
+
+// TestSpecExamples processes the example receipts of the original challenge
+// specification and of the one the server serves, checking that they are
+// accepted and awarded the points the scoring rules give them.
+func TestSpecExamples(t *testing.T) {
+	original, err := os.ReadFile("api.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	examples := make(map[string]any)
+	for file, data := range map[string][]byte{"api.yml": original, "openapi.yaml": openAPISpec} {
+		spec := parseYAML(t, data)
+		examples[file+" schema example"] = schemaExample(t, spec, "Receipt")
+		named, _ := yamlPath(spec, "components", "examples").(map[string]any)
+		for name := range named {
+			examples[file+" "+name] = yamlPath(named, name, "value")
+		}
+	}
+	if len(examples) < 3 {
+		t.Fatalf("found only %d examples", len(examples))
+	}
+
+	h := newTestServer(t).Handler()
+	for name, example := range examples {
+		t.Run(name, func(t *testing.T) {
+			body, err := json.Marshal(example)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var receipt points.Receipt
+			if err := json.Unmarshal(body, &receipt); err != nil {
+				t.Fatal(err)
+			}
+			want, err := points.Calculate(receipt)
+			if err != nil {
+				t.Fatalf("the example is invalid: %v", err)
+			}
+
+			rec := send(h, http.MethodPost, "/receipts/process", string(body))
+			if rec.Code != http.StatusCreated {
+				t.Fatalf("POST /receipts/process = %d %s, want 201", rec.Code, rec.Body)
+			}
+			var processed struct{ ID string }
+			decodeBody(t, rec, &processed)
+			if processed.ID == "" || strings.ContainsAny(processed.ID, " \t\n") {
+				t.Errorf("id %q does not match the spec's pattern", processed.ID)
+			}
+			if got := rec.Header().Get("Location"); got != "/receipts/"+processed.ID {
+				t.Errorf("Location = %q, want /receipts/%s", got, processed.ID)
+			}
+			if got := receiptPoints(t, h, processed.ID); got != want {
+				t.Errorf("points = %d, want %d", got, want)
+			}
+
+			rec = send(h, http.MethodPost, "/receipts/points", string(body))
+			var preview struct{ Points int }
+			decodeBody(t, rec, &preview)
+			if rec.Code != http.StatusOK || preview.Points != want {
+				t.Errorf("POST /receipts/points = %d %s, want 200 with %d points", rec.Code, rec.Body, want)
+			}
+		})
+	}
+}
+
+// TestSpecPathsAreRouted checks that every operation of the served spec
+// reaches a route of the server, whatever the route then makes of the
+// request.
+func TestSpecPathsAreRouted(t *testing.T) {
+	store := openTestStore(t, "sqlite", filepath.Join(t.TempDir(), "receipts.db"))
+	// The quota, audit and webhook endpoints exist only with those
+	// features on.
+	clock := time.Now()
+	s := newStoreServer(t, store, withAdmin, withQuotas(&clock), withAudit, withWebhookOutbox("http://127.0.0.1:1/"))
+	h := s.Handler()
+
+	paths, _ := yamlPath(parseYAML(t, openAPISpec), "paths").(map[string]any)
+	if len(paths) == 0 {
+		t.Fatal("the spec has no paths")
+	}
+	for path, item := range paths {
+		target := strings.NewReplacer("{id}", "00000000-0000-4000-8000-000000000000", "{eventId}", "missing").Replace(path)
+		for method := range item.(map[string]any) {
+			method = strings.ToUpper(method)
+			if !strings.Contains(" GET POST PUT PATCH DELETE HEAD ", " "+method+" ") {
+				continue
+			}
+			// Streams last until the client goes away.
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			req := httptest.NewRequest(method, target, nil).WithContext(ctx)
+			req.Header.Set("Authorization", "Bearer admin")
+			req.Header.Set("X-Api-Key", "key-basic")
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			cancel()
+
+			if rec.Code == http.StatusMethodNotAllowed {
+				t.Errorf("%s %s = 405, but the spec documents it", method, path)
+			}
+			if rec.Code == http.StatusNotFound && strings.HasPrefix(rec.Header().Get("Content-Type"), "application/json") {
+				if code := errorCode(t, rec); code == codeNotFound || code == codeUnknownRoute {
+					t.Errorf("%s %s = 404 %s, but the spec documents it", method, path, code)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/y1zhuo/receipt-processor-challenge/api"
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+// Error codes returned in the "code" field of error responses. They are part
+// of the API contract, so existing values must not change.
+const (
+	codeMethodNotAllowed      = "method_not_allowed"
+	codeNotFound              = "not_found"
+	codeUnknownRoute          = "unknown_route"
+	codeInvalidBody           = "invalid_body"
+	codeEmptyBody             = "empty_body"
+	codeUnsupportedMediaType  = "unsupported_media_type"
+	codeNotAcceptable         = "not_acceptable"
+	codeBodyTooLarge          = "body_too_large"
+	codeInvalidReceipt        = "invalid_receipt"
+	codeTotalMismatch         = "total_mismatch"
+	codeDateOutOfRange        = "date_out_of_range"
+	codeContentNotAllowed     = "content_not_allowed"
+	codeLimitExceeded         = "limit_exceeded"
+	codeInvalidQuery          = "invalid_query"
+	codeInvalidID             = "invalid_id"
+	codeBatchTooLarge         = "batch_too_large"
+	codeReceiptNotFound       = "receipt_not_found"
+	codeReceiptPending        = "receipt_pending"
+	codeReceiptDeleted        = "receipt_deleted"
+	codeReceiptCompacted      = "receipt_compacted"
+	codeReceiptChanged        = "receipt_changed"
+	codeImageNotFound         = "image_not_found"
+	codeWebhookEventNotFound  = "webhook_event_not_found"
+	codeWebhookEventNotFailed = "webhook_event_not_failed"
+	codeQueueFull             = "queue_full"
+	codeIDUnavailable         = "id_unavailable"
+	codeInvalidIdempotencyKey = "invalid_idempotency_key"
+	codeIdempotencyKeyReused  = "idempotency_key_reused"
+	codeUnauthorized          = "unauthorized"
+	codeForbidden             = "forbidden"
+	codeRateLimited           = "rate_limited"
+	codeQuotaExceeded         = "quota_exceeded"
+	codeTimeout               = "timeout"
+	codeInvalidRequestTimeout = "invalid_request_timeout"
+	codeShuttingDown          = "shutting_down"
+	codeReadOnly              = "read_only"
+	codeNoRulesFile           = "no_rules_file"
+	codeInvalidRules          = "invalid_rules"
+	codeNoDenylist            = "no_denylist"
+	codeInvalidDenylist       = "invalid_denylist"
+	codeFeatureReadOnly       = "feature_read_only"
+	codeInternal              = "internal_error"
+)
+
+// apiError is an error reported to clients as the body of an error response.
+// Its RequestID is filled in by writeAPIError from the X-Request-ID response
+// header.
+type apiError struct {
+	status int
+	api.ErrorBody
+}
+
+// newAPIError returns an error with an English message. Messages are
+// translated by their entry in locales/en.json, so a new message needs
+// entries there and in the other catalogs to be translated.
+func newAPIError(status int, code, message string, details ...points.FieldError) *apiError {
+	return &apiError{status: status, ErrorBody: api.ErrorBody{Code: code, Message: message, Details: details}}
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+// writeError writes a JSON error response with the given status.
+func writeError(w http.ResponseWriter, status int, code, message string, details ...points.FieldError) {
+	writeAPIError(w, newAPIError(status, code, message, details...))
+}
+
+// writeAPIError writes err as a JSON error response, in the language
+// negotiateLanguage chose for it.
+func writeAPIError(w http.ResponseWriter, err *apiError) {
+	body := *err.in(responseLocale(w))
+	body.RequestID = w.Header().Get(requestIDHeader)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(err.status)
+	json.NewEncoder(w).Encode(api.ErrorResponse{Error: &body.ErrorBody})
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter) {
+	writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+}
+
+func writeInvalidID(w http.ResponseWriter) {
+	writeError(w, http.StatusBadRequest, codeInvalidID, "Invalid receipt ID")
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// TestErrorResponses checks the status, code and JSON shape of the response
+// to each kind of bad request.
+func TestErrorResponses(t *testing.T) {
+	const missing = "/receipts/00000000-0000-4000-8000-000000000000/points"
+	tests := []struct {
+		name           string
+		method, target string
+		body           string
+		header         []string
+		status         int
+		code           string
+		details        bool
+	}{
+		{"method not allowed", http.MethodGet, "/receipts/process", "", nil, http.StatusMethodNotAllowed, codeMethodNotAllowed, false},
+		{"method not allowed on points", http.MethodDelete, missing, "", nil, http.StatusMethodNotAllowed, codeMethodNotAllowed, false},
+		{"malformed JSON", http.MethodPost, "/receipts/process", "{", nil, http.StatusBadRequest, codeInvalidBody, false},
+		{"wrong JSON type", http.MethodPost, "/receipts/process", "[]", nil, http.StatusBadRequest, codeInvalidBody, false},
+		{"empty body", http.MethodPost, "/receipts/process", "", []string{"Content-Type", "application/json"}, http.StatusBadRequest, codeEmptyBody, false},
+		{"not JSON", http.MethodPost, "/receipts/process", targetReceipt, []string{"Content-Type", "text/plain"}, http.StatusUnsupportedMediaType, codeUnsupportedMediaType, false},
+		{"invalid receipt", http.MethodPost, "/receipts/process", "{}", nil, http.StatusBadRequest, codeInvalidReceipt, true},
+		{"receipt not found", http.MethodGet, missing, "", nil, http.StatusNotFound, codeReceiptNotFound, false},
+		{"invalid ID", http.MethodGet, "/receipts/not%20an%20id/points", "", nil, http.StatusBadRequest, codeInvalidID, false},
+		{"unknown route", http.MethodGet, "/nowhere", "", nil, http.StatusNotFound, codeNotFound, false},
+	}
+	h := newTestServer(t).Handler()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := send(h, tt.method, tt.target, tt.body, tt.header...)
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if got := rec.Header().Get("Content-Type"); got != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", got)
+			}
+
+			var body map[string]map[string]json.RawMessage
+			decodeBody(t, rec, &body)
+			errBody, ok := body["error"]
+			if !ok || len(body) != 1 {
+				t.Fatalf("body = %s, want an object holding only error", rec.Body)
+			}
+			for field := range errBody {
+				switch field {
+				case "code", "message", "details", "requestId":
+				default:
+					t.Errorf("error has unexpected field %q", field)
+				}
+			}
+			var code, message string
+			json.Unmarshal(errBody["code"], &code)
+			json.Unmarshal(errBody["message"], &message)
+			if code != tt.code {
+				t.Errorf("code = %q, want %q", code, tt.code)
+			}
+			if message == "" {
+				t.Error("message is empty")
+			}
+			var details []struct{ Field, Message string }
+			if raw, ok := errBody["details"]; ok {
+				if err := json.Unmarshal(raw, &details); err != nil {
+					t.Fatalf("details = %s: %v", raw, err)
+				}
+			}
+			if tt.details != (len(details) > 0) {
+				t.Errorf("details = %v, want some: %v", details, tt.details)
+			}
+			for _, detail := range details {
+				if detail.Field == "" || detail.Message == "" {
+					t.Errorf("detail %+v lacks a field or message", detail)
+				}
+			}
+		})
+	}
+}
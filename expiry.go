@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+// errUndated is returned by pointsExpiry.effective for a receipt whose
+// purchase date does not parse, when the policy rejects such receipts.
+var errUndated = errors.New("purchase date is not a valid date")
+
+// pointsExpiry is the policy by which points stop counting some time after
+// the purchase they were awarded for. It only applies to totals asked for
+// at a date, with ?at=; points are otherwise reported as awarded.
+type pointsExpiry struct {
+	// months is how long points count from the purchase date; zero means
+	// they never expire.
+	months int
+	// rejectUndated is whether receipts whose purchase date does not parse
+	// are refused an effective total, rather than never expiring. Only
+	// receipts imported as they were can have such dates.
+	rejectUndated bool
+}
+
+// expiresOn returns the date the points of receipt stop counting, the same
+// day of the month months after the purchase, or the month's last day if it
+// is shorter. It reports false if they never expire.
+func (e pointsExpiry) expiresOn(receipt points.Receipt) (time.Time, bool, error) {
+	if e.months == 0 {
+		return time.Time{}, false, nil
+	}
+	purchased, err := time.Parse("2006-01-02", receipt.PurchaseDate)
+	if err != nil {
+		if e.rejectUndated {
+			return time.Time{}, false, errUndated
+		}
+		return time.Time{}, false, nil
+	}
+	expires := purchased.AddDate(0, e.months, 0)
+	if expires.Day() != purchased.Day() {
+		// AddDate carried into the next month; go back to the end of
+		// the month meant.
+		expires = expires.AddDate(0, 0, -expires.Day())
+	}
+	return expires, true, nil
+}
+
+// effective returns the points, of total awarded for receipt, that still
+// count on at, and when they expire, if they do.
+func (e pointsExpiry) effective(receipt points.Receipt, total int, at time.Time) (int, time.Time, bool, error) {
+	expires, ok, err := e.expiresOn(receipt)
+	if err != nil || !ok {
+		return total, expires, ok, err
+	}
+	if !at.Before(expires) {
+		return 0, expires, true, nil
+	}
+	return total, expires, true, nil
+}
+
+// parseAt parses the at query parameter, the date to count unexpired points
+// at. It returns the zero time if at is not set.
+func parseAt(query url.Values) (time.Time, *points.FieldError) {
+	v := query.Get("at")
+	if v == "" {
+		return time.Time{}, nil
+	}
+	at, err := time.Parse("2006-01-02", v)
+	if err != nil {
+		return time.Time{}, &points.FieldError{Field: "at", Message: "must be a date in YYYY-MM-DD format"}
+	}
+	return at, nil
+}
+
+// undatedError is the error reported for a receipt refused an effective
+// total by a policy rejecting undated receipts.
+func undatedError() *apiError {
+	return newAPIError(http.StatusUnprocessableEntity, codeInvalidReceipt,
+		"The receipt has no valid purchase date, so its points cannot be counted at a date",
+		points.FieldError{Field: "purchaseDate", Message: "must be a calendar date in YYYY-MM-DD format"})
+}
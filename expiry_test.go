@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+func TestPointsExpiresOn(t *testing.T) {
+	tests := []struct {
+		months    int
+		purchased string
+		want      string // "" for never
+	}{
+		{0, "2022-01-01", ""},
+		{12, "2022-01-01", "2023-01-01"},
+		{1, "2022-01-31", "2022-02-28"},
+		{1, "2024-01-31", "2024-02-29"},
+		{3, "2022-11-30", "2023-02-28"},
+		{6, "2022-08-31", "2023-02-28"},
+		{1, "2022-03-15", "2022-04-15"},
+		{12, "someday", ""},
+	}
+	for _, tt := range tests {
+		e := pointsExpiry{months: tt.months}
+		expires, ok, err := e.expiresOn(points.Receipt{PurchaseDate: tt.purchased})
+		got := ""
+		if ok {
+			got = expires.Format("2006-01-02")
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%d months from %s: expires %q, %v; want %q", tt.months, tt.purchased, got, err, tt.want)
+		}
+	}
+}
+
+func TestPointsExpiryEffective(t *testing.T) {
+	receipt := points.Receipt{PurchaseDate: "2022-01-31"}
+	e := pointsExpiry{months: 1}
+	for at, want := range map[string]int{"2022-01-31": 28, "2022-02-27": 28, "2022-02-28": 0, "2023-01-01": 0} {
+		day, _ := time.Parse("2006-01-02", at)
+		if got, _, _, err := e.effective(receipt, 28, day); err != nil || got != want {
+			t.Errorf("points at %s = %d, %v; want %d", at, got, err, want)
+		}
+	}
+
+	// Undated receipts never expire unless the policy rejects them.
+	undated := points.Receipt{PurchaseDate: "someday"}
+	day, _ := time.Parse("2006-01-02", "2100-01-01")
+	if got, _, ok, err := e.effective(undated, 28, day); err != nil || ok || got != 28 {
+		t.Errorf("undated receipt = %d, %v, %v; want 28 never expiring", got, ok, err)
+	}
+	e.rejectUndated = true
+	if _, _, _, err := e.effective(undated, 28, day); err != errUndated {
+		t.Errorf("undated receipt under reject = %v, want errUndated", err)
+	}
+}
+
+// newExpiryServer returns a server whose points expire after 12 months,
+// storing targetReceipt, marketReceipt and an undated receipt, and their IDs.
+func newExpiryServer(t *testing.T, rejectUndated bool) (s *Server, target, market, undated string) {
+	t.Helper()
+	s = newTestServer(t, withAdmin)
+	s.expiry = pointsExpiry{months: 12, rejectUndated: rejectUndated}
+	h := s.Handler()
+	target = processReceipt(t, h, targetReceipt)
+	market = processReceipt(t, h, marketReceipt)
+	// Only an import keeps a purchase date that does not parse.
+	undated = "7fb1377b-b223-49d9-a31a-5a02701dd310"
+	saveReceipt(t, s.store, "", undated, strings.Replace(targetReceipt, `"2022-01-01"`, `"someday"`, 1))
+	return s, target, market, undated
+}
+
+func TestPointsAt(t *testing.T) {
+	s, target, market, undated := newExpiryServer(t, false)
+	h := s.Handler()
+	tests := []struct {
+		id, at    string
+		points    int
+		expiresOn string
+	}{
+		{target, "", 28, ""},
+		{target, "2022-12-31", 28, "2023-01-01"},
+		{target, "2023-01-01", 0, "2023-01-01"},
+		{market, "2023-02-01", 109, "2023-03-20"},
+		{undated, "2100-01-01", 22, ""},
+	}
+	etags := make(map[string]string)
+	for _, tt := range tests {
+		target := "/receipts/" + tt.id + "/points"
+		if tt.at != "" {
+			target += "?at=" + tt.at
+		}
+		rec := send(h, http.MethodGet, target, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s = %d %s, want 200", target, rec.Code, rec.Body)
+		}
+		var body pointsResponse
+		decodeBody(t, rec, &body)
+		if body.Points != tt.points || body.ExpiresOn != tt.expiresOn {
+			t.Errorf("GET %s = %+v, want %d points expiring %q", target, body, tt.points, tt.expiresOn)
+		}
+		if other, ok := etags[rec.Header().Get("ETag")]; ok {
+			t.Errorf("GET %s has the ETag of GET %s", target, other)
+		}
+		etags[rec.Header().Get("ETag")] = target
+	}
+
+	rec := send(h, http.MethodGet, "/receipts/"+target+"/points?at=tomorrow", "")
+	if rec.Code != http.StatusBadRequest || errorCode(t, rec) != codeInvalidQuery {
+		t.Errorf("GET points?at=tomorrow = %d %s, want 400", rec.Code, rec.Body)
+	}
+}
+
+func TestPointsAtRejectsUndated(t *testing.T) {
+	s, _, _, undated := newExpiryServer(t, true)
+	h := s.Handler()
+	rec := send(h, http.MethodGet, "/receipts/"+undated+"/points?at=2022-06-01", "")
+	if rec.Code != http.StatusUnprocessableEntity || errorCode(t, rec) != codeInvalidReceipt {
+		t.Errorf("GET points at a date of an undated receipt = %d %s, want 422", rec.Code, rec.Body)
+	}
+	// Without a date the policy does not apply.
+	if got := receiptPoints(t, h, undated); got != 22 {
+		t.Errorf("points of an undated receipt = %d, want 22", got)
+	}
+
+	// Totals leave the undated receipt out.
+	rec = send(h, http.MethodGet, "/retailers/points?at=2023-02-01", "")
+	var board leaderboardResponse
+	decodeBody(t, rec, &board)
+	want := []retailerPoints{
+		{Retailer: "M&M Corner Market", ReceiptCount: 1, TotalPoints: 109, AveragePoints: 109},
+		{Retailer: "Target", ReceiptCount: 1, TotalPoints: 0, AveragePoints: 0},
+	}
+	if !reflect.DeepEqual(board.Retailers, want) {
+		t.Errorf("leaderboard at 2023-02-01 = %+v, want %+v", board.Retailers, want)
+	}
+
+	rec = sendAdmin(h, http.MethodGet, "/admin/stats?at=2023-02-01", "")
+	var stats storeStats
+	decodeBody(t, rec, &stats)
+	if stats.Receipts != 2 || stats.TotalPoints != 109 {
+		t.Errorf("stats at 2023-02-01 = %d receipts, %d points; want 2 and 109", stats.Receipts, stats.TotalPoints)
+	}
+}
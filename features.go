@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+// features are the opt-in behaviors that are simply on or off. Each has a
+// flag and an environment variable like any other setting, and can also be
+// given in a -features-file, which both override. Those featureFlags marks
+// live can be changed with PATCH /admin/features while the server runs.
+type features struct {
+	Async                bool
+	Audit                bool
+	Dedup                bool
+	DedupIgnoreItemOrder bool
+	Index                bool
+	IsolateTenants       bool
+	ItemlessReceipts     bool
+	NormalizeRetailers   bool
+	ReadOnly             bool
+	RetailerAlphanumeric bool
+	StrictDates          bool
+	StrictTotals         bool
+	ZoneAwareScoring     bool
+}
+
+// Where the value of a feature came from, from the least to the most
+// authoritative.
+const (
+	featureFromDefault = "default"
+	featureFromFile    = "file"
+	featureFromEnv     = "env"
+	featureFromFlag    = "flag"
+	featureFromRuntime = "runtime"
+)
+
+// featureFlag describes a field of features.
+type featureFlag struct {
+	name  string // also the name of its flag
+	env   string
+	field func(*features) *bool
+	// live is set for features the server reads on every request, rather
+	// than builds state for at startup, so that they can be changed while
+	// it runs.
+	live bool
+}
+
+var featureFlags = []featureFlag{
+	{name: "allow-itemless-receipts", env: "ALLOW_ITEMLESS_RECEIPTS", field: func(f *features) *bool { return &f.ItemlessReceipts }, live: true},
+	{name: "async", env: "ASYNC", field: func(f *features) *bool { return &f.Async }, live: true},
+	{name: "audit", env: "AUDIT", field: func(f *features) *bool { return &f.Audit }},
+	{name: "dedup", env: "DEDUP", field: func(f *features) *bool { return &f.Dedup }},
+	{name: "dedup-ignore-item-order", env: "DEDUP_IGNORE_ITEM_ORDER", field: func(f *features) *bool { return &f.DedupIgnoreItemOrder }},
+	{name: "index", env: "INDEX", field: func(f *features) *bool { return &f.Index }},
+	{name: "isolate-tenants", env: "ISOLATE_TENANTS", field: func(f *features) *bool { return &f.IsolateTenants }},
+	{name: "normalize-retailers", env: "NORMALIZE_RETAILERS", field: func(f *features) *bool { return &f.NormalizeRetailers }},
+	{name: "read-only", env: "READ_ONLY", field: func(f *features) *bool { return &f.ReadOnly }, live: true},
+	{name: "require-retailer-alphanumeric", env: "REQUIRE_RETAILER_ALPHANUMERIC", field: func(f *features) *bool { return &f.RetailerAlphanumeric }, live: true},
+	{name: "strict-dates", env: "STRICT_DATES", field: func(f *features) *bool { return &f.StrictDates }, live: true},
+	{name: "strict-totals", env: "STRICT_TOTALS", field: func(f *features) *bool { return &f.StrictTotals }, live: true},
+	{name: "zone-aware-scoring", env: "ZONE_AWARE_SCORING", field: func(f *features) *bool { return &f.ZoneAwareScoring }, live: true},
+}
+
+func lookupFeature(name string) (featureFlag, bool) {
+	for _, flag := range featureFlags {
+		if flag.name == name {
+			return flag, true
+		}
+	}
+	return featureFlag{}, false
+}
+
+// applyFeaturesFile sets the features named in the JSON object of booleans
+// at path, except those already given as a flag or an environment variable,
+// and returns where the value of each feature came from.
+func applyFeaturesFile(fs *flag.FlagSet, path string, getenv func(string) string) (map[string]string, error) {
+	values := make(map[string]bool)
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading features file: %w", err)
+		}
+		if err := json.Unmarshal(data, &values); err != nil {
+			return nil, fmt.Errorf("features file %s must be a JSON object of true and false values: %w", path, err)
+		}
+		for name := range values {
+			if _, ok := lookupFeature(name); !ok {
+				return nil, fmt.Errorf("features file %s names unknown feature %q", path, name)
+			}
+		}
+	}
+
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	sources := make(map[string]string, len(featureFlags))
+	for _, feature := range featureFlags {
+		value, inFile := values[feature.name]
+		switch {
+		case given[feature.name]:
+			sources[feature.name] = featureFromFlag
+		case getenv(feature.env) != "":
+			sources[feature.name] = featureFromEnv
+		case inFile:
+			fs.Set(feature.name, fmt.Sprint(value))
+			sources[feature.name] = featureFromFile
+		default:
+			sources[feature.name] = featureFromDefault
+		}
+	}
+	return sources, nil
+}
+
+// featureSwitch holds the features in effect. Requests read them without
+// locking; PATCH /admin/features replaces them whole.
+type featureSwitch struct {
+	current atomic.Pointer[features]
+	mu      sync.Mutex // serializes changes, and guards sources
+	sources map[string]string
+}
+
+func newFeatureSwitch(initial features, sources map[string]string) *featureSwitch {
+	f := &featureSwitch{sources: make(map[string]string, len(featureFlags))}
+	for _, feature := range featureFlags {
+		f.sources[feature.name] = featureFromDefault
+	}
+	for name, source := range sources {
+		f.sources[name] = source
+	}
+	f.current.Store(&initial)
+	return f
+}
+
+func (f *featureSwitch) get() features {
+	return *f.current.Load()
+}
+
+// featureState is how GET /admin/features reports a feature.
+type featureState struct {
+	Enabled  bool   `json:"enabled"`
+	ReadOnly bool   `json:"readOnly"`
+	Source   string `json:"source"`
+}
+
+// states returns the state of every feature, by name.
+func (f *featureSwitch) states() map[string]featureState {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	current := f.get()
+	states := make(map[string]featureState, len(featureFlags))
+	for _, feature := range featureFlags {
+		states[feature.name] = featureState{Enabled: *feature.field(&current), ReadOnly: !feature.live, Source: f.sources[feature.name]}
+	}
+	return states
+}
+
+// featuresHandler handles GET /admin/features, reporting the value of every
+// feature, whether it can be changed at runtime and where its value came
+// from.
+func (s *Server) featuresHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.features.states())
+}
+
+// patchFeaturesHandler handles PATCH /admin/features, whose body maps
+// feature names to the values to give them until the next change or
+// restart. Either every change is made or, if any is refused, none is.
+func (s *Server) patchFeaturesHandler(w http.ResponseWriter, r *http.Request) {
+	var changes map[string]bool
+	if err := decodeJSON(r, &changes, "Body must be a JSON object of feature names and true or false"); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	names := make([]string, 0, len(changes))
+	for name := range changes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var unknown, readOnly []points.FieldError
+	for _, name := range names {
+		feature, ok := lookupFeature(name)
+		switch {
+		case !ok:
+			unknown = append(unknown, points.FieldError{Field: name, Message: "is not a known feature"})
+		case !feature.live:
+			readOnly = append(readOnly, points.FieldError{Field: name, Message: "cannot be changed while the server runs"})
+		}
+	}
+	if len(unknown) > 0 {
+		writeError(w, http.StatusBadRequest, codeInvalidBody, "Body must be a JSON object of feature names and true or false", unknown...)
+		return
+	}
+	if len(readOnly) > 0 {
+		writeError(w, http.StatusConflict, codeFeatureReadOnly, "Some of the features cannot be changed while the server runs.", readOnly...)
+		return
+	}
+
+	f := s.features
+	f.mu.Lock()
+	updated := f.get()
+	for _, name := range names {
+		feature, _ := lookupFeature(name)
+		field := feature.field(&updated)
+		if *field != changes[name] {
+			s.logger.InfoContext(r.Context(), "feature changed", slog.String("component", componentHTTP),
+				slog.String("feature", name), slog.Bool("from", *field), slog.Bool("to", changes[name]))
+		}
+		*field = changes[name]
+		f.sources[name] = featureFromRuntime
+	}
+	f.current.Store(&updated)
+	f.mu.Unlock()
+
+	s.featuresHandler(w, r)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/y1zhuo/receipt-processor-challenge/api"
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+// TestFeaturePrecedence checks that a feature given in the features file
+// is overridden by its environment variable, that by its flag, and all of
+// them by PATCH /admin/features.
+func TestFeaturePrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "features.json")
+	file := `{"strict-totals": true, "strict-dates": true, "async": true, "dedup": true, "index": false}`
+	if err := os.WriteFile(path, []byte(file), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	env := envOf(map[string]string{"FEATURES_FILE": path, "STRICT_TOTALS": "false", "ASYNC": "false", "INDEX": "true"})
+	cfg, err := parseConfig([]string{"-async=true"}, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, withAdmin)
+	s.features = newFeatureSwitch(cfg.Features, cfg.featureSources)
+	h := s.Handler()
+
+	check := func(when string, want map[string]featureState) {
+		t.Helper()
+		var states map[string]featureState
+		decodeBody(t, sendAdmin(h, http.MethodGet, "/admin/features", ""), &states)
+		for name, state := range want {
+			if states[name] != state {
+				t.Errorf("%s, %s = %+v, want %+v", when, name, states[name], state)
+			}
+		}
+	}
+	check("at startup", map[string]featureState{
+		"strict-dates":  {Enabled: true, Source: featureFromFile},
+		"strict-totals": {Enabled: false, Source: featureFromEnv},
+		"index":         {Enabled: true, ReadOnly: true, Source: featureFromEnv},
+		"async":         {Enabled: true, Source: featureFromFlag},
+		"dedup":         {Enabled: true, ReadOnly: true, Source: featureFromFile},
+		"audit":         {Enabled: false, ReadOnly: true, Source: featureFromDefault},
+	})
+
+	mismatched := strings.Replace(targetReceipt, `"35.35"`, `"35.00"`, 1)
+	if rec := send(h, http.MethodPost, "/receipts/process?async=false", mismatched); rec.Code != http.StatusCreated {
+		t.Fatalf("POST of a mismatched total before the patch = %d %s, want 201", rec.Code, rec.Body)
+	}
+	rec := sendAdmin(h, http.MethodPatch, "/admin/features", `{"strict-totals": true, "async": false, "strict-dates": true}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PATCH /admin/features = %d %s", rec.Code, rec.Body)
+	}
+	check("after the patch", map[string]featureState{
+		"strict-dates":  {Enabled: true, Source: featureFromRuntime},
+		"strict-totals": {Enabled: true, Source: featureFromRuntime},
+		"async":         {Enabled: false, Source: featureFromRuntime},
+		"index":         {Enabled: true, ReadOnly: true, Source: featureFromEnv},
+	})
+	if rec := send(h, http.MethodPost, "/receipts/process", mismatched); rec.Code != http.StatusUnprocessableEntity || errorCode(t, rec) != codeTotalMismatch {
+		t.Errorf("POST of a mismatched total after the patch = %d %s, want 422", rec.Code, rec.Body)
+	}
+}
+
+func TestPatchFeaturesRefusals(t *testing.T) {
+	s := newTestServer(t, withAdmin)
+	h := s.Handler()
+	tests := []struct {
+		body   string
+		status int
+		code   string
+	}{
+		// Naming one read-only feature refuses the live ones with it.
+		{`{"strict-totals": true, "dedup": true}`, http.StatusConflict, codeFeatureReadOnly},
+		{`{"index": false}`, http.StatusConflict, codeFeatureReadOnly},
+		{`{"strict-totals": true, "turbo": true}`, http.StatusBadRequest, codeInvalidBody},
+		{`{"strict-totals": "yes"}`, http.StatusBadRequest, codeInvalidBody},
+		{`["strict-totals"]`, http.StatusBadRequest, codeInvalidBody},
+	}
+	for _, tt := range tests {
+		rec := sendAdmin(h, http.MethodPatch, "/admin/features", tt.body)
+		if rec.Code != tt.status || errorCode(t, rec) != tt.code {
+			t.Errorf("PATCH /admin/features with %s = %d %s, want %d %s", tt.body, rec.Code, rec.Body, tt.status, tt.code)
+		}
+	}
+	if got := s.features.get(); got != (features{}) {
+		t.Errorf("features after refused patches = %+v, want none on", got)
+	}
+	if rec := send(h, http.MethodPatch, "/admin/features", `{"strict-totals": true}`); rec.Code != http.StatusUnauthorized {
+		t.Errorf("PATCH /admin/features without the admin token = %d %s, want 401", rec.Code, rec.Body)
+	}
+}
+
+func TestFeaturesFileErrors(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"unknown.json": `{"turbo": true}`,
+		"notbool.json": `{"dedup": "on"}`,
+		"notjson.json": `dedup=true`,
+		"missing.json": "",
+	} {
+		path := filepath.Join(dir, name)
+		if content != "" {
+			if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := parseConfig([]string{"-features-file", path}, envOf(nil)); err == nil {
+			t.Errorf("parseConfig with features file %s succeeded, want an error", name)
+		}
+	}
+}
+
+// TestItemlessReceiptsSwitch posts a receipt without items with itemless
+// receipts refused, as they are by default, and then allowed.
+func TestItemlessReceiptsSwitch(t *testing.T) {
+	s := newTestServer(t, withAdmin)
+	h := s.Handler()
+	itemless := `{"retailer": "Target", "purchaseDate": "2022-01-01", "purchaseTime": "13:01", "total": "10.00", "items": []}`
+	missing := `{"retailer": "Target", "purchaseDate": "2022-01-01", "purchaseTime": "13:01", "total": "10.00"}`
+
+	for _, body := range []string{itemless, missing} {
+		rec := send(h, http.MethodPost, "/receipts/process", body)
+		var failure api.ErrorResponse
+		decodeBody(t, rec, &failure)
+		if rec.Code != http.StatusBadRequest || failure.Error == nil || len(failure.Error.Details) != 1 ||
+			failure.Error.Details[0].Pointer != "/items" || !strings.Contains(failure.Error.Details[0].Message, "minItems 1") {
+			t.Errorf("POST of %s = %d %s, want 400 naming minItems", body, rec.Code, rec.Body)
+		}
+	}
+	if rec := send(h, http.MethodPost, "/receipts/points", itemless); rec.Code != http.StatusBadRequest {
+		t.Errorf("POST /receipts/points of an itemless receipt = %d %s, want 400", rec.Code, rec.Body)
+	}
+
+	if rec := sendAdmin(h, http.MethodPatch, "/admin/features", `{"allow-itemless-receipts": true}`); rec.Code != http.StatusOK {
+		t.Fatalf("PATCH /admin/features = %d %s", rec.Code, rec.Body)
+	}
+	for _, body := range []string{itemless, missing} {
+		id := processReceipt(t, h, body)
+		var breakdown points.Breakdown
+		decodeBody(t, send(h, http.MethodGet, "/receipts/"+id+"/breakdown", ""), &breakdown)
+		if !breakdown.Itemless || breakdown.Total != 87 {
+			t.Errorf("breakdown of %s = %+v, want 87 points, itemless", body, breakdown)
+		}
+	}
+	// Receipts with items are scored as before.
+	if got := receiptPoints(t, h, processReceipt(t, h, targetReceipt)); got != 28 {
+		t.Errorf("points of a receipt with items = %d, want 28", got)
+	}
+}
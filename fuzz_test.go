@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+func FuzzProcessReceiptBody(f *testing.F) {
+	f.Add([]byte(targetReceipt), false, false)
+	f.Add([]byte(marketReceipt), true, false)
+	f.Add([]byte(`{}`), false, false)
+	f.Add([]byte(`[]`), false, false)
+	f.Add([]byte(`null`), false, false)
+	f.Add([]byte(`{"retailer":"Target","items":[{}]}`), false, false)
+	f.Add([]byte(`{"retailer":1e400}`), false, false)
+	f.Add([]byte("\xff\xfe{"), false, false)
+
+	// Every server shares the store, so inputs see receipts stored by
+	// earlier ones, as duplicates for instance.
+	store := newMemoryStore()
+	limited := newStoreServer(f, store)
+	unlimited := newStoreServer(f, store)
+	unlimited.limits = points.Limits{}
+	handlers := map[bool]http.Handler{false: limited.Handler(), true: unlimited.Handler()}
+
+	f.Fuzz(func(t *testing.T, body []byte, strict, noLimits bool) {
+		req := httptest.NewRequest(http.MethodPost, "/receipts/process", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if strict {
+			req.Header.Set("X-Strict-Totals", "true")
+		}
+		rec := httptest.NewRecorder()
+		handlers[noLimits].ServeHTTP(rec, req)
+		if rec.Code < 200 || rec.Code >= 500 || (rec.Code >= 300 && rec.Code < 400) {
+			t.Errorf("POST %q = %d %s, want 2xx or 4xx", body, rec.Code, rec.Body)
+		}
+	})
+}
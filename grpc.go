@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/protoadapt"
+
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+	"github.com/y1zhuo/receipt-processor-challenge/receiptpb"
+)
+
+// grpcErrorDomain is the ErrorInfo domain of errors returned over gRPC.
+const grpcErrorDomain = "receipt-processor"
+
+// grpcService serves the ReceiptProcessor gRPC service from the same store
+// and scoring path as the HTTP API.
+type grpcService struct {
+	receiptpb.UnimplementedReceiptProcessorServer
+	server *Server
+}
+
+// newGRPCServer returns a gRPC server for s. Calls need an API key in the
+// same cases as the HTTP requests they mirror.
+func (s *Server) newGRPCServer() *grpc.Server {
+	srv := grpc.NewServer(grpc.UnaryInterceptor(s.authenticateGRPC))
+	receiptpb.RegisterReceiptProcessorServer(srv, &grpcService{server: s})
+	return srv
+}
+
+func (g *grpcService) ProcessReceipt(ctx context.Context, in *receiptpb.Receipt) (*receiptpb.ReceiptId, error) {
+	receipt := points.Receipt{
+		Retailer:     in.GetRetailer(),
+		PurchaseDate: in.GetPurchaseDate(),
+		PurchaseTime: in.GetPurchaseTime(),
+		Total:        points.Money(in.GetTotal()),
+	}
+	for _, item := range in.GetItems() {
+		receipt.Items = append(receipt.Items, points.Item{
+			ShortDescription: item.GetShortDescription(),
+			Price:            points.Money(item.GetPrice()),
+		})
+	}
+
+	features := g.server.features.get()
+	if features.ReadOnly {
+		return nil, grpcError(errReadOnly())
+	}
+	result, apiErr := g.server.processReceipt(ctx, receipt, features.StrictTotals)
+	if apiErr != nil {
+		return nil, grpcError(apiErr)
+	}
+	return &receiptpb.ReceiptId{Id: g.server.ids.external(result.ID)}, nil
+}
+
+func (g *grpcService) GetPoints(ctx context.Context, in *receiptpb.ReceiptId) (*receiptpb.Points, error) {
+	id, ok := g.server.internalID(in.GetId())
+	if !ok {
+		if g.server.ids != nil {
+			return nil, grpcError(newAPIError(http.StatusNotFound, codeReceiptNotFound, "No receipt found for that ID"))
+		}
+		return nil, grpcError(newAPIError(http.StatusBadRequest, codeInvalidID, "Invalid receipt ID"))
+	}
+
+	pending := g.server.async.isPending(ctx, id)
+	total, err := g.server.store.GetPoints(ctx, id)
+	if err != nil {
+		if pending {
+			return nil, grpcError(newAPIError(http.StatusNotFound, codeReceiptPending, "Receipt is still being processed"))
+		}
+		return nil, grpcError(g.server.storeError(ctx, err))
+	}
+	return &receiptpb.Points{Points: int64(total)}, nil
+}
+
+// grpcRoute returns the method and path of the HTTP request that a call
+// mirrors, for applying -auth-routes. Unknown methods have none.
+func grpcRoute(fullMethod string, req any) (method, path string, ok bool) {
+	switch fullMethod {
+	case receiptpb.ReceiptProcessor_ProcessReceipt_FullMethodName:
+		return http.MethodPost, "/receipts/process", true
+	case receiptpb.ReceiptProcessor_GetPoints_FullMethodName:
+		id, _ := req.(*receiptpb.ReceiptId)
+		return http.MethodGet, "/receipts/" + id.GetId() + "/points", true
+	}
+	return "", "", false
+}
+
+// authenticateGRPC is the gRPC counterpart of authenticate. The key is read
+// from the x-api-key or authorization (bearer) metadata.
+func (s *Server) authenticateGRPC(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	method, path, ok := grpcRoute(info.FullMethod, req)
+	required := !ok || s.requiresAuth(method, path)
+	if len(s.apiKeys) == 0 || (!required && !s.features.get().IsolateTenants) {
+		return handler(ctx, req)
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	var key string
+	if values := md.Get("x-api-key"); len(values) > 0 {
+		key = values[0]
+	} else if values := md.Get("authorization"); len(values) > 0 {
+		key, _ = strings.CutPrefix(values[0], "Bearer ")
+	}
+	if key == "" && !required {
+		return handler(withTenant(ctx, ""), req)
+	}
+	if key == "" {
+		return nil, grpcError(newAPIError(http.StatusUnauthorized, codeUnauthorized, "An API key is required"))
+	}
+	name, ok := s.lookupAPIKey(key)
+	if !ok {
+		return nil, grpcError(newAPIError(http.StatusForbidden, codeForbidden, "The API key is not valid"))
+	}
+	ctx = withAPIKey(ctx, name)
+	if s.features.get().IsolateTenants {
+		ctx = withTenant(ctx, name)
+	}
+	return handler(ctx, req)
+}
+
+// grpcError converts an error response into a gRPC status. The HTTP error
+// code travels as an ErrorInfo reason and field errors as a BadRequest, so
+// clients get the same detail as over HTTP.
+func grpcError(e *apiError) error {
+	code := codes.Internal
+	switch e.status {
+	case http.StatusBadRequest:
+		code = codes.InvalidArgument
+	case http.StatusUnprocessableEntity:
+		code = codes.FailedPrecondition
+	case http.StatusUnauthorized:
+		code = codes.Unauthenticated
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusNotFound, http.StatusGone:
+		code = codes.NotFound
+	case http.StatusTooManyRequests:
+		code = codes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		code = codes.Unavailable
+	case http.StatusGatewayTimeout:
+		code = codes.DeadlineExceeded
+	}
+
+	details := []protoadapt.MessageV1{&errdetails.ErrorInfo{Reason: e.Code, Domain: grpcErrorDomain}}
+	if len(e.Details) > 0 {
+		badRequest := &errdetails.BadRequest{}
+		for _, d := range e.Details {
+			badRequest.FieldViolations = append(badRequest.FieldViolations,
+				&errdetails.BadRequest_FieldViolation{Field: d.Field, Description: d.Message})
+		}
+		details = append(details, badRequest)
+	}
+
+	st := status.New(code, e.Message)
+	if withDetails, err := st.WithDetails(details...); err == nil {
+		st = withDetails
+	}
+	return st.Err()
+}
+
+// grpcListener runs a gRPC server under serve, alongside the HTTP servers.
+type grpcListener struct {
+	addr   string
+	server *grpc.Server
+}
+
+func (l grpcListener) serve() error {
+	lis, err := net.Listen("tcp", l.addr)
+	if err != nil {
+		return err
+	}
+	if err := l.server.Serve(lis); err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+		return err
+	}
+	return nil
+}
+
+// shutdown stops accepting calls and waits for those in flight to finish,
+// cutting them off if ctx is done first.
+func (l grpcListener) shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		l.server.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		l.server.Stop()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	"github.com/y1zhuo/receipt-processor-challenge/receiptpb"
+)
+
+// newGRPCClient serves s over gRPC on an in-memory listener and returns a
+// client connected to it.
+func newGRPCClient(t *testing.T, s *Server) receiptpb.ReceiptProcessorClient {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	srv := s.newGRPCServer()
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("dialing the gRPC server: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return receiptpb.NewReceiptProcessorClient(conn)
+}
+
+// grpcReceipt converts a receipt in the JSON of the HTTP API to its gRPC
+// form.
+func grpcReceipt(t *testing.T, receipt string) *receiptpb.Receipt {
+	t.Helper()
+	var pb receiptpb.Receipt
+	if err := protojson.Unmarshal([]byte(receipt), &pb); err != nil {
+		t.Fatalf("converting receipt: %v", err)
+	}
+	return &pb
+}
+
+func TestGRPCRoundTrip(t *testing.T) {
+	s := newTestServer(t)
+	client := newGRPCClient(t, s)
+	h := s.Handler()
+	ctx := context.Background()
+
+	for _, tt := range []struct {
+		name    string
+		receipt string
+		points  int64
+	}{
+		{"Target", targetReceipt, 28},
+		{"M&M Corner Market", marketReceipt, 109},
+	} {
+		id, err := client.ProcessReceipt(ctx, grpcReceipt(t, tt.receipt))
+		if err != nil {
+			t.Fatalf("%s: ProcessReceipt: %v", tt.name, err)
+		}
+		got, err := client.GetPoints(ctx, id)
+		if err != nil {
+			t.Fatalf("%s: GetPoints: %v", tt.name, err)
+		}
+		if got.GetPoints() != tt.points {
+			t.Errorf("%s: GetPoints = %d, want %d", tt.name, got.GetPoints(), tt.points)
+		}
+		// Both APIs share a store.
+		if points := receiptPoints(t, h, id.GetId()); int64(points) != tt.points {
+			t.Errorf("%s: GET points over HTTP = %d, want %d", tt.name, points, tt.points)
+		}
+	}
+
+	// And receipts processed over HTTP can be read over gRPC.
+	id := processReceipt(t, h, marketReceipt)
+	got, err := client.GetPoints(ctx, &receiptpb.ReceiptId{Id: id})
+	if err != nil || got.GetPoints() != 109 {
+		t.Errorf("GetPoints of a receipt processed over HTTP = %v, %v, want 109", got, err)
+	}
+}
+
+func TestGRPCErrors(t *testing.T) {
+	client := newGRPCClient(t, newTestServer(t))
+	ctx := context.Background()
+
+	invalid := grpcReceipt(t, targetReceipt)
+	invalid.PurchaseDate = "2022-13-01"
+	_, err := client.ProcessReceipt(ctx, invalid)
+	st := status.Convert(err)
+	if st.Code() != codes.InvalidArgument {
+		t.Fatalf("ProcessReceipt of an invalid receipt = %v, want InvalidArgument", err)
+	}
+	var reason string
+	var violations []*errdetails.BadRequest_FieldViolation
+	for _, detail := range st.Details() {
+		switch d := detail.(type) {
+		case *errdetails.ErrorInfo:
+			reason = d.GetReason()
+		case *errdetails.BadRequest:
+			violations = d.GetFieldViolations()
+		}
+	}
+	if reason != codeInvalidReceipt {
+		t.Errorf("ErrorInfo reason = %q, want %q", reason, codeInvalidReceipt)
+	}
+	if len(violations) != 1 || violations[0].GetField() != "purchaseDate" {
+		t.Errorf("field violations = %v, want one on purchaseDate", violations)
+	}
+
+	for _, tt := range []struct {
+		id   string
+		code codes.Code
+	}{
+		{"not an id", codes.InvalidArgument},
+		{"00000000-0000-4000-8000-000000000000", codes.NotFound},
+	} {
+		if _, err := client.GetPoints(ctx, &receiptpb.ReceiptId{Id: tt.id}); status.Code(err) != tt.code {
+			t.Errorf("GetPoints(%q) = %v, want %v", tt.id, err, tt.code)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+// healthResponse is the body of the /healthz and /readyz responses.
+type healthResponse struct {
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+	// Mode is read-only while the server refuses writes, so that load
+	// balancers can send them elsewhere, and read-write otherwise.
+	Mode string `json:"mode"`
+}
+
+// healthzHandler reports liveness: the process is up and serving HTTP.
+func (s *Server) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, healthResponse{Status: "ok", Mode: s.mode()})
+}
+
+// readyzHandler reports readiness: the store can be reached.
+func (s *Server) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if err := s.store.Ping(r.Context()); err != nil {
+		s.logger.WarnContext(r.Context(), "readiness check failed", slog.String("component", componentStore), slog.Any("error", err))
+		writeHealth(w, http.StatusServiceUnavailable, healthResponse{Status: "unavailable", Reason: "store unreachable: " + err.Error(), Mode: s.mode()})
+		return
+	}
+	writeHealth(w, http.StatusOK, healthResponse{Status: "ok", Mode: s.mode()})
+}
+
+func writeHealth(w http.ResponseWriter, status int, response healthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
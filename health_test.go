@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+// unreachableStore is a memory store whose Ping fails, as a remote one's
+// would when it cannot be reached.
+type unreachableStore struct {
+	*memoryStore
+}
+
+func (unreachableStore) Ping(ctx context.Context) error {
+	return errors.New("connection refused")
+}
+
+func TestHealthz(t *testing.T) {
+	rec := send(newStoreServer(t, unreachableStore{newMemoryStore()}).Handler(), http.MethodGet, "/healthz", "")
+	var body healthResponse
+	decodeBody(t, rec, &body)
+	// Liveness does not depend on the store.
+	if rec.Code != http.StatusOK || body.Status != "ok" {
+		t.Errorf("GET /healthz = %d %+v, want 200 ok", rec.Code, body)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	rec := send(newTestServer(t).Handler(), http.MethodGet, "/readyz", "")
+	var body healthResponse
+	decodeBody(t, rec, &body)
+	if rec.Code != http.StatusOK || body.Status != "ok" || body.Reason != "" {
+		t.Errorf("GET /readyz = %d %+v, want 200 ok", rec.Code, body)
+	}
+}
+
+func TestReadyzWithStoreDown(t *testing.T) {
+	closed := func(t *testing.T) Store {
+		store, err := openStore("sqlite", filepath.Join(t.TempDir(), "receipts.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		store.Close()
+		return store
+	}
+	stores := map[string]func(t *testing.T) Store{
+		"unreachable":   func(*testing.T) Store { return unreachableStore{newMemoryStore()} },
+		"closed sqlite": closed,
+	}
+	for name, open := range stores {
+		t.Run(name, func(t *testing.T) {
+			rec := send(newStoreServer(t, open(t)).Handler(), http.MethodGet, "/readyz", "")
+			var body healthResponse
+			decodeBody(t, rec, &body)
+			if rec.Code != http.StatusServiceUnavailable || body.Status != "unavailable" || body.Reason == "" {
+				t.Errorf("GET /readyz = %d %+v, want 503 unavailable with a reason", rec.Code, body)
+			}
+			if got := rec.Header().Get("Cache-Control"); got != "no-store" {
+				t.Errorf("Cache-Control = %q, want no-store", got)
+			}
+		})
+	}
+}
+
+// TestHealthChecksSkipAuthAndRateLimits checks that probes get through when
+// every GET needs an API key and clients are allowed a single request.
+func TestHealthChecksSkipAuthAndRateLimits(t *testing.T) {
+	s := newTestServer(t)
+	var err error
+	if s.apiKeys, err = loadAPIKeys("probe:secret", ""); err != nil {
+		t.Fatal(err)
+	}
+	if s.authRules, err = parseAuthRules("GET"); err != nil {
+		t.Fatal(err)
+	}
+	s.rateLimiter = newRateLimiter(0.001, 1)
+	h := s.Handler()
+
+	for range 3 {
+		for _, path := range []string{"/healthz", "/readyz"} {
+			if rec := send(h, http.MethodGet, path, ""); rec.Code != http.StatusOK {
+				t.Errorf("GET %s = %d %s, want 200", path, rec.Code, rec.Body)
+			}
+		}
+	}
+	if rec := send(h, http.MethodGet, "/receipts", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("GET /receipts without a key = %d, want 401", rec.Code)
+	}
+}
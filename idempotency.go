@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultIdempotencyTTL is how long a response is kept for replay.
+	defaultIdempotencyTTL = 24 * time.Hour
+	// maxIdempotencyKeyLength bounds the memory a single key can use.
+	maxIdempotencyKeyLength = 255
+)
+
+// idempotencyCache replays the recorded response of a request carrying an
+// Idempotency-Key header when the same key is sent again, instead of running
+// the handler a second time.
+type idempotencyCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+}
+
+type idempotencyEntry struct {
+	bodyHash [sha256.Size]byte
+	// done is closed once the response below has been recorded, or the
+	// entry abandoned because the handler failed.
+	done    chan struct{}
+	failed  bool
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+func newIdempotencyCache(ttl time.Duration) *idempotencyCache {
+	return &idempotencyCache{ttl: ttl, entries: make(map[string]*idempotencyEntry)}
+}
+
+// wrap applies idempotency-key handling to next. Requests without the header
+// pass straight through.
+func (c *idempotencyCache) wrap(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			writeError(w, http.StatusBadRequest, codeInvalidIdempotencyKey, "Idempotency-Key must be at most 255 characters")
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeAPIError(w, bodyReadError(err, "Failed to read request body"))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		bodyHash := sha256.Sum256(body)
+		// Keys are per tenant, so one tenant cannot replay another's
+		// response by guessing its key.
+		key = ownerFrom(r.Context()) + "\x00" + key
+
+		for {
+			entry, owner := c.claim(key, bodyHash)
+			if owner {
+				c.record(w, r, key, entry, next)
+				return
+			}
+
+			select {
+			case <-entry.done:
+			case <-r.Context().Done():
+				return
+			}
+			if entry.failed {
+				// The first request did not produce a replayable
+				// response; try to claim the key ourselves.
+				continue
+			}
+			if entry.bodyHash != bodyHash {
+				writeError(w, http.StatusUnprocessableEntity, codeIdempotencyKeyReused,
+					"Idempotency-Key was already used with a different request body")
+				return
+			}
+			replay(w, entry)
+			return
+		}
+	}
+}
+
+// claim returns the entry for key, reporting whether the caller created it
+// and is therefore responsible for running the handler.
+func (c *idempotencyCache) claim(key string, bodyHash [sha256.Size]byte) (*idempotencyEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entry, ok := c.entries[key]; ok && !entry.failed {
+		return entry, false
+	}
+	entry := &idempotencyEntry{bodyHash: bodyHash, done: make(chan struct{})}
+	c.entries[key] = entry
+	return entry, true
+}
+
+// record runs next, buffering its response so it can be replayed later.
+// Server errors and panics are not recorded, so a retry gets a fresh attempt.
+// Nor are responses that tell the client to come back later, such as a 429
+// for a used-up quota or a 409 for a pending receipt: replaying them after
+// the wait would refuse the retry they invite.
+func (c *idempotencyCache) record(w http.ResponseWriter, r *http.Request, key string, entry *idempotencyEntry, next http.HandlerFunc) {
+	// Headers already set by middleware, such as X-Request-ID, are carried
+	// over so the handler sees them.
+	buf := &bufferedResponse{header: w.Header().Clone(), status: http.StatusOK}
+	completed := false
+	defer func() {
+		c.mu.Lock()
+		if !completed || !replayable(buf) {
+			entry.failed = true
+			delete(c.entries, key)
+		} else {
+			entry.status, entry.header, entry.body = buf.status, buf.header, buf.body.Bytes()
+			entry.expires = time.Now().Add(c.ttl)
+		}
+		c.mu.Unlock()
+		close(entry.done)
+	}()
+
+	next(buf, r)
+	completed = true
+
+	for name, values := range buf.header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(buf.status)
+	w.Write(buf.body.Bytes())
+}
+
+// replayable reports whether the response in buf may be replayed for the
+// rest of the TTL.
+func replayable(buf *bufferedResponse) bool {
+	return buf.status < http.StatusInternalServerError &&
+		buf.status != http.StatusTooManyRequests &&
+		buf.header.Get("Retry-After") == ""
+}
+
+func replay(w http.ResponseWriter, entry *idempotencyEntry) {
+	requestID := w.Header().Get(requestIDHeader)
+	for name, values := range entry.header {
+		w.Header()[name] = values
+	}
+	if requestID != "" {
+		w.Header().Set(requestIDHeader, requestID)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	// Nothing is created by a replay, whatever the original response said.
+	status := entry.status
+	if status == http.StatusCreated {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	w.Write(entry.body)
+}
+
+// sweep evicts entries whose TTL has passed.
+func (c *idempotencyCache) sweep(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, entry := range c.entries {
+		if !entry.expires.IsZero() && now.After(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// clear forgets every recorded response. Requests already running under a
+// key still finish normally.
+func (c *idempotencyCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*idempotencyEntry)
+}
+
+// size returns how many responses are recorded, including expired ones not
+// yet swept.
+func (c *idempotencyCache) size() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// run sweeps expired entries every interval until ctx is canceled.
+func (c *idempotencyCache) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			c.sweep(now)
+		}
+	}
+}
+
+// bufferedResponse is a ResponseWriter that holds the whole response in
+// memory.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	wrote  bool
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if !b.wrote {
+		b.status, b.wrote = status, true
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	b.wrote = true
+	return b.body.Write(p)
+}
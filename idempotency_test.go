@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// heldHandler counts its calls and holds each until release is closed,
+// failing the calls numbered in fail with a 500.
+type heldHandler struct {
+	started chan struct{} // receives once per call
+	release chan struct{}
+	fail    map[int]bool
+
+	mu    sync.Mutex
+	calls int
+}
+
+func newHeldHandler(fail ...int) *heldHandler {
+	h := &heldHandler{started: make(chan struct{}, 16), release: make(chan struct{}), fail: make(map[int]bool)}
+	for _, call := range fail {
+		h.fail[call] = true
+	}
+	return h
+}
+
+func (h *heldHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	h.calls++
+	call := h.calls
+	h.mu.Unlock()
+	h.started <- struct{}{}
+	<-h.release
+
+	io.ReadAll(r.Body)
+	if h.fail[call] {
+		writeError(w, http.StatusInternalServerError, codeInternal, "Internal server error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `{"id":"call-%d"}`, call)
+}
+
+// signalingReader closes read once it has been read to the end.
+type signalingReader struct {
+	io.Reader
+	once sync.Once
+	read chan struct{}
+}
+
+func (r *signalingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err == io.EOF {
+		r.once.Do(func() { close(r.read) })
+	}
+	return n, err
+}
+
+// sendKeyed sends body to h with key as its Idempotency-Key, returning a
+// channel that is closed once h has read the whole body.
+func sendKeyed(h http.Handler, key, body string) (<-chan *httptest.ResponseRecorder, <-chan struct{}) {
+	reader := &signalingReader{Reader: strings.NewReader(body), read: make(chan struct{})}
+	req := httptest.NewRequest(http.MethodPost, "/receipts/process", reader)
+	req.Header.Set("Idempotency-Key", key)
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		done <- rec
+	}()
+	return done, reader.read
+}
+
+// TestIdempotencyRunsHandlerOnce sends one key from many goroutines at once
+// and checks that the handler runs once and every response is its response.
+func TestIdempotencyRunsHandlerOnce(t *testing.T) {
+	next := newHeldHandler()
+	h := newIdempotencyCache(time.Hour).wrap(next.ServeHTTP)
+
+	const n = 16
+	var responses []<-chan *httptest.ResponseRecorder
+	for range n {
+		done, _ := sendKeyed(h, "key", targetReceipt)
+		responses = append(responses, done)
+	}
+	<-next.started
+	close(next.release)
+
+	replayed := 0
+	for _, done := range responses {
+		rec := <-done
+		if rec.Code != http.StatusOK || rec.Body.String() != `{"id":"call-1"}` || rec.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("response = %d %v %s, want the first call's", rec.Code, rec.Header(), rec.Body)
+		}
+		if rec.Header().Get("Idempotent-Replayed") == "true" {
+			replayed++
+		}
+	}
+	if next.calls != 1 || replayed != n-1 {
+		t.Errorf("handler ran %d times with %d responses replayed, want once and %d", next.calls, replayed, n-1)
+	}
+
+	// The key is kept for a different body, which is refused.
+	done, _ := sendKeyed(h, "key", marketReceipt)
+	if rec := <-done; rec.Code != http.StatusUnprocessableEntity || errorCode(t, rec) != codeIdempotencyKeyReused {
+		t.Errorf("key reused with another body = %d %s, want 422", rec.Code, rec.Body)
+	}
+}
+
+// TestIdempotencyWaiterTakesOver fails the first request for a key while
+// others wait on it, and checks that one of them runs the handler in its
+// place and the rest replay that response.
+func TestIdempotencyWaiterTakesOver(t *testing.T) {
+	next := newHeldHandler(1)
+	h := newIdempotencyCache(time.Hour).wrap(next.ServeHTTP)
+
+	owner, _ := sendKeyed(h, "key", targetReceipt)
+	<-next.started
+	const waiters = 8
+	var responses []<-chan *httptest.ResponseRecorder
+	for range waiters {
+		done, read := sendKeyed(h, "key", targetReceipt)
+		<-read
+		responses = append(responses, done)
+	}
+	close(next.release)
+
+	if rec := <-owner; rec.Code != http.StatusInternalServerError {
+		t.Errorf("failing first request = %d %s, want 500", rec.Code, rec.Body)
+	}
+	replayed := 0
+	for _, done := range responses {
+		rec := <-done
+		if rec.Code != http.StatusOK || rec.Body.String() != `{"id":"call-2"}` {
+			t.Errorf("waiter's response = %d %s, want the second call's", rec.Code, rec.Body)
+		}
+		if rec.Header().Get("Idempotent-Replayed") == "true" {
+			replayed++
+		}
+	}
+	if next.calls != 2 || replayed != waiters-1 {
+		t.Errorf("handler ran %d times with %d responses replayed, want twice and %d", next.calls, replayed, waiters-1)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The formats of receipt IDs -id-format may name.
+const (
+	idFormatUUID = "uuid4" // random RFC 4122 UUIDs
+	idFormatULID = "ulid"  // ULIDs, which sort in the order they were made
+	idFormatNano = "nano"  // short random codes, easy to read out
+)
+
+// maxIDAttempts is how many IDs a receipt is tried under before it is
+// refused. Only the short nano IDs are at all likely to be taken.
+const maxIDAttempts = 5
+
+// IDGenerator makes the IDs of new receipts and recognizes them in requests.
+// Implementations must be safe for concurrent use.
+type IDGenerator interface {
+	// NewID returns a new receipt ID. It need not be unique: one that is
+	// already taken is replaced by another.
+	NewID() (string, error)
+	// ParseID returns the receipt ID s names, in the form NewID returns,
+	// reporting false if it is not an ID of this format.
+	ParseID(s string) (string, bool)
+}
+
+// newIDGenerator returns the IDGenerator for format.
+func newIDGenerator(format string) (IDGenerator, error) {
+	switch format {
+	case idFormatUUID:
+		return uuidGenerator{}, nil
+	case idFormatULID:
+		return ulidGenerator{}, nil
+	case idFormatNano:
+		return nanoGenerator{}, nil
+	}
+	return nil, fmt.Errorf("unknown ID format %q; want %s, %s or %s", format, idFormatUUID, idFormatULID, idFormatNano)
+}
+
+// uuidGenerator makes random UUIDs. They are case-insensitive, so one given in
+// upper case still finds its receipt.
+type uuidGenerator struct{}
+
+func (uuidGenerator) NewID() (string, error) {
+	return generateUniqueID()
+}
+
+func (uuidGenerator) ParseID(s string) (string, bool) {
+	id := strings.ToLower(s)
+	return id, uuidPattern.MatchString(id)
+}
+
+// crockford is the alphabet of Crockford's base32, which leaves out I, L, O
+// and U so that IDs cannot be misread.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// inCrockford reports whether s is made of characters of crockford, in upper
+// case.
+func inCrockford(s string) bool {
+	for _, c := range []byte(s) {
+		if strings.IndexByte(crockford, c) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// ulidGenerator makes ULIDs: 26 characters of base32 encoding the millisecond
+// they were made in 48 bits, followed by 80 random bits, so that they sort in
+// the order receipts were stored (to the millisecond). They are
+// case-insensitive.
+type ulidGenerator struct{}
+
+func (ulidGenerator) NewID() (string, error) {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(time.Now().UnixMilli())<<16)
+	if _, err := rand.Read(b[6:]); err != nil {
+		return "", err
+	}
+	// 128 bits make 26 characters of 5 bits, the first holding only 3.
+	hi, lo := binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])
+	var id [26]byte
+	for i := len(id) - 1; i >= 0; i-- {
+		id[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(id[:]), nil
+}
+
+func (ulidGenerator) ParseID(s string) (string, bool) {
+	id := strings.ToUpper(s)
+	// A first character past 7 would overflow the 128 bits.
+	return id, len(id) == 26 && id[0] <= '7' && inCrockford(id)
+}
+
+// nanoIDLength is how many characters a nano ID has. 50 random bits make a
+// clash rare until millions of receipts are stored, and then it is retried.
+const nanoIDLength = 10
+
+// nanoGenerator makes short IDs of nanoIDLength random base32 characters.
+// They are case-insensitive.
+type nanoGenerator struct{}
+
+func (nanoGenerator) NewID() (string, error) {
+	var b [nanoIDLength]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	for i := range b {
+		// 32 divides 256, so every character is as likely.
+		b[i] = crockford[b[i]&31]
+	}
+	return string(b[:]), nil
+}
+
+func (nanoGenerator) ParseID(s string) (string, bool) {
+	id := strings.ToUpper(s)
+	return id, len(id) == nanoIDLength && inCrockford(id)
+}
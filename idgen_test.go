@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubGenerator hands out its IDs in turn, repeating the last, and parses
+// IDs as nano IDs.
+type stubGenerator struct {
+	nanoGenerator
+
+	mu    sync.Mutex
+	ids   []string
+	calls int
+}
+
+func (g *stubGenerator) NewID() (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	id := g.ids[min(g.calls, len(g.ids)-1)]
+	g.calls++
+	return id, nil
+}
+
+func TestIDCollisionRetry(t *testing.T) {
+	eachStore(t, func(t *testing.T, store Store) {
+		s := newStoreServer(t, store)
+		h := s.Handler()
+		s.idgen = &stubGenerator{ids: []string{"AAAAAAAAAA"}}
+		taken := processReceipt(t, h, targetReceipt)
+
+		// The next receipt clashes twice before it is given a free ID.
+		gen := &stubGenerator{ids: []string{"AAAAAAAAAA", "AAAAAAAAAA", "BBBBBBBBBB"}}
+		s.idgen = gen
+		if id := processReceipt(t, h, marketReceipt); id != "BBBBBBBBBB" || gen.calls != 3 {
+			t.Errorf("receipt stored as %s after %d IDs, want BBBBBBBBBB after 3", id, gen.calls)
+		}
+		if got := receiptPoints(t, h, taken); got != 28 {
+			t.Errorf("points of %s after the clashes = %d, want the first receipt's 28", taken, got)
+		}
+
+		// Once every ID tried is taken, the receipt is refused.
+		gen = &stubGenerator{ids: []string{"BBBBBBBBBB"}}
+		s.idgen = gen
+		rec := send(h, http.MethodPost, "/receipts/process", sparklingReceipt)
+		if rec.Code != http.StatusServiceUnavailable || errorCode(t, rec) != codeIDUnavailable || gen.calls != maxIDAttempts {
+			t.Errorf("POST with only taken IDs = %d %s after %d IDs, want 503 after %d", rec.Code, rec.Body, gen.calls, maxIDAttempts)
+		}
+		if ids, _ := store.List(context.Background()); len(ids) != 2 {
+			t.Errorf("store holds %d receipts, want 2", len(ids))
+		}
+	})
+}
+
+// TestIDCollisionRetryAsync checks that a queued receipt's ID counts as
+// taken. Without Start, queued receipts stay pending.
+func TestIDCollisionRetryAsync(t *testing.T) {
+	s := newTestServer(t)
+	h := s.Handler()
+	s.idgen = &stubGenerator{ids: []string{"AAAAAAAAAA", "AAAAAAAAAA", "CCCCCCCCCC"}}
+	var ids []string
+	for _, body := range []string{targetReceipt, marketReceipt} {
+		rec := send(h, http.MethodPost, "/receipts/process?async=true", body)
+		var queued struct{ ID string }
+		decodeBody(t, rec, &queued)
+		if rec.Code != http.StatusAccepted {
+			t.Fatalf("POST ?async=true = %d %s, want 202", rec.Code, rec.Body)
+		}
+		ids = append(ids, queued.ID)
+	}
+	if !slices.Equal(ids, []string{"AAAAAAAAAA", "CCCCCCCCCC"}) {
+		t.Errorf("queued receipts as %v, want AAAAAAAAAA and CCCCCCCCCC", ids)
+	}
+
+	s.idgen = &stubGenerator{ids: []string{"CCCCCCCCCC"}}
+	if rec := send(h, http.MethodPost, "/receipts/process?async=true", sparklingReceipt); rec.Code != http.StatusServiceUnavailable || errorCode(t, rec) != codeIDUnavailable {
+		t.Errorf("POST ?async=true with only taken IDs = %d %s, want 503", rec.Code, rec.Body)
+	}
+}
+
+func TestIDFormats(t *testing.T) {
+	tests := []struct {
+		format string
+		length int
+	}{
+		{idFormatUUID, 36},
+		{idFormatULID, 26},
+		{idFormatNano, nanoIDLength},
+	}
+	for _, tt := range tests {
+		gen, err := newIDGenerator(tt.format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen := make(map[string]bool)
+		for range 1000 {
+			id, err := gen.NewID()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(id) != tt.length || seen[id] || strings.ContainsAny(id, " \t\n") {
+				t.Fatalf("%s ID %q is not %d characters, or repeated", tt.format, id, tt.length)
+			}
+			seen[id] = true
+			// IDs are found in any case.
+			for _, given := range []string{id, strings.ToLower(id), strings.ToUpper(id)} {
+				if parsed, ok := gen.ParseID(given); !ok || parsed != id {
+					t.Fatalf("%s ParseID(%q) = %q, %v, want %q", tt.format, given, parsed, ok, id)
+				}
+			}
+		}
+	}
+	if _, err := newIDGenerator("snowflake"); err == nil {
+		t.Error("newIDGenerator(snowflake) succeeded, want an error")
+	}
+}
+
+func TestULIDsSortByTime(t *testing.T) {
+	var gen ulidGenerator
+	first, _ := gen.NewID()
+	time.Sleep(2 * time.Millisecond)
+	second, _ := gen.NewID()
+	if first >= second {
+		t.Errorf("ULID %s made before %s does not sort first", first, second)
+	}
+}
+
+func TestParseIDRejects(t *testing.T) {
+	tests := []struct {
+		gen IDGenerator
+		ids []string
+	}{
+		{uuidGenerator{}, []string{"", "AAAAAAAAAA", "01ARZ3NDEKTSV4RRFFQ69G5FAV", "00000000-0000-4000-8000-00000000000g"}},
+		// A first character past 7 would overflow 128 bits, and I, L, O
+		// and U are not base32.
+		{ulidGenerator{}, []string{"", "81ARZ3NDEKTSV4RRFFQ69G5FAV", "01ARZ3NDEKTSV4RRFFQ69G5FA", "01ARZ3NDEKTSV4RRFFQ69G5FAU", "00000000-0000-4000-8000-000000000000"}},
+		{nanoGenerator{}, []string{"", "AAAAAAAAA", "AAAAAAAAAAA", "AAAAAAAAAI", "AAAA AAAAA", "00000000-0000-4000-8000-000000000000"}},
+	}
+	for _, tt := range tests {
+		for _, id := range tt.ids {
+			if _, ok := tt.gen.ParseID(id); ok {
+				t.Errorf("%T.ParseID(%q) accepted it", tt.gen, id)
+			}
+		}
+	}
+}
+
+// TestPointsRouteFollowsIDFormat checks that receipts are only found by IDs
+// of the configured format.
+func TestPointsRouteFollowsIDFormat(t *testing.T) {
+	s := newTestServer(t)
+	s.idgen = nanoGenerator{}
+	h := s.Handler()
+	id := processReceipt(t, h, targetReceipt)
+	if got := receiptPoints(t, h, strings.ToLower(id)); got != 28 {
+		t.Errorf("points of %s in lower case = %d, want 28", id, got)
+	}
+	for _, other := range []string{"00000000-0000-4000-8000-000000000000", "01ARZ3NDEKTSV4RRFFQ69G5FAV", id + "A"} {
+		if rec := send(h, http.MethodGet, "/receipts/"+other+"/points", ""); rec.Code != http.StatusBadRequest || errorCode(t, rec) != codeInvalidID {
+			t.Errorf("GET /receipts/%s/points with nano IDs = %d %s, want 400", other, rec.Code, rec.Body)
+		}
+	}
+	if rec := send(h, http.MethodGet, "/receipts/ZZZZZZZZZZ/points", ""); rec.Code != http.StatusNotFound || errorCode(t, rec) != codeReceiptNotFound {
+		t.Errorf("GET of an unknown nano ID = %d %s, want 404", rec.Code, rec.Body)
+	}
+}
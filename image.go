@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"slices"
+)
+
+const (
+	// defaultMaxImageBytes is the default limit on the size of a receipt
+	// image.
+	defaultMaxImageBytes = 5 << 20
+	// imageFormOverhead is how much larger than the image limit the body of
+	// an image upload may be, for its multipart framing.
+	imageFormOverhead = 64 << 10
+)
+
+// imageTypes are the media types receipt images may have, as sniffed from
+// their contents.
+var imageTypes = []string{"image/jpeg", "image/png"}
+
+// imageRef describes the image of a receipt, in the response to an upload
+// and in exports that ask for images.
+type imageRef struct {
+	URL         string `json:"url"`
+	ContentType string `json:"contentType"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
+}
+
+// imageRef describes blob, the image of the receipt with id.
+func (s *Server) imageRef(id string, blob Blob) *imageRef {
+	return &imageRef{URL: "/receipts/" + s.ids.external(id) + "/image", ContentType: blob.ContentType, Size: blob.Size, SHA256: blob.SHA256}
+}
+
+// uploadImageHandler handles POST /receipts/{id}/image, attaching a photo of
+// the receipt. The body is multipart/form-data with an "image" file of at
+// most maxImageSize, which must be a JPEG or PNG; its type is sniffed from
+// its contents, whatever the upload says it is. An image already attached is
+// replaced.
+func (s *Server) uploadImageHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.receiptID(w, r)
+	if !ok {
+		return
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" {
+		writeError(w, http.StatusUnsupportedMediaType, codeUnsupportedMediaType,
+			"Content-Type must be multipart/form-data")
+		return
+	}
+
+	// The receipt is looked up before the upload is read, so that an image
+	// for a receipt that does not exist is refused without storing it.
+	ctx := r.Context()
+	pending := s.async.isPending(ctx, id)
+	if _, err := s.store.GetRevision(ctx, id); err != nil {
+		s.writeLookupError(w, r, err, pending)
+		return
+	}
+
+	if err := r.ParseMultipartForm(s.maxImageSize); err != nil {
+		writeAPIError(w, bodyReadError(err, "The request body is not valid multipart/form-data"))
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+	file, header, err := r.FormFile("image")
+	if errors.Is(err, http.ErrMissingFile) {
+		writeError(w, http.StatusBadRequest, codeInvalidBody, `The upload must include an "image" file`)
+		return
+	}
+	if err != nil {
+		writeAPIError(w, bodyReadError(err, `The "image" file could not be read`))
+		return
+	}
+	defer file.Close()
+	if header.Size > s.maxImageSize {
+		writeError(w, http.StatusRequestEntityTooLarge, codeBodyTooLarge,
+			fmt.Sprintf("Image exceeds the limit of %d bytes", s.maxImageSize))
+		return
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		writeAPIError(w, bodyReadError(err, `The "image" file could not be read`))
+		return
+	}
+	contentType := http.DetectContentType(data)
+	if !slices.Contains(imageTypes, contentType) {
+		writeError(w, http.StatusUnsupportedMediaType, codeUnsupportedMediaType,
+			"The image must be a JPEG or PNG file")
+		return
+	}
+
+	blob, err := s.images.Put(ctx, id, contentType, data)
+	if err != nil {
+		s.writeStoreError(w, r, err)
+		return
+	}
+	// A receipt deleted while its image was uploaded would otherwise keep
+	// an image no one can see.
+	if _, err := s.store.GetRevision(ctx, id); err != nil {
+		s.deleteImage(context.WithoutCancel(ctx), id)
+		s.writeStoreError(w, r, err)
+		return
+	}
+
+	ref := s.imageRef(id, blob)
+	w.Header().Set("Location", ref.URL)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(ref)
+}
+
+// getImageHandler handles GET /receipts/{id}/image, serving the image
+// attached to the receipt. Its ETag is the SHA-256 of its contents, and
+// clients must revalidate before reusing a cached copy, since the image can
+// be replaced. Range requests are served. The Accept header is matched
+// against the type of the stored image, since that is the only one served.
+func (s *Server) getImageHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.receiptID(w, r)
+	if !ok {
+		return
+	}
+
+	ctx := r.Context()
+	pending := s.async.isPending(ctx, id)
+	if _, err := s.store.GetRevision(ctx, id); err != nil {
+		s.writeLookupError(w, r, err, pending)
+		return
+	}
+	blob, content, err := s.images.Open(ctx, id)
+	if errors.Is(err, ErrBlobNotFound) {
+		writeError(w, http.StatusNotFound, codeImageNotFound, "The receipt has no image")
+		return
+	}
+	if err != nil {
+		s.writeStoreError(w, r, err)
+		return
+	}
+	defer content.Close()
+	if _, ok := acceptMediaType(w, r, []string{blob.ContentType}); !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", blob.ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("ETag", `"`+blob.SHA256+`"`)
+	// Private, as receipts may be visible to one API key only.
+	w.Header().Set("Cache-Control", "private, no-cache")
+	http.ServeContent(w, r, "", blob.ModTime, content)
+}
+
+// deleteImage removes the image of the receipt with id, if it has one. A
+// failure is only logged: the receipt is gone either way.
+func (s *Server) deleteImage(ctx context.Context, id string) {
+	if err := s.images.Delete(ctx, id); err != nil {
+		s.logger.ErrorContext(ctx, "failed to delete receipt image", slog.String("component", componentStore),
+			slog.String("receipt_id", id), slog.Any("error", err))
+	}
+}
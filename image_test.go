@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// pngHeader and jpegHeader start images of each type, enough for their type
+// to be sniffed.
+const (
+	pngHeader  = "\x89PNG\r\n\x1a\n"
+	jpegHeader = "\xff\xd8\xff\xe0"
+)
+
+// imageOf returns an image of size bytes starting with header.
+func imageOf(header string, size int) string {
+	return header + strings.Repeat("\x00", size-len(header))
+}
+
+// uploadImage posts data to /receipts/{id}/image as the file of field,
+// declared as contentType.
+func uploadImage(t *testing.T, h http.Handler, id, field, contentType, data string) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreatePart(textproto.MIMEHeader{
+		"Content-Disposition": {`form-data; name="` + field + `"; filename="receipt"`},
+		"Content-Type":        {contentType},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte(data))
+	form.Close()
+	return send(h, http.MethodPost, "/receipts/"+id+"/image", body.String(), "Content-Type", form.FormDataContentType())
+}
+
+func TestImageUpload(t *testing.T) {
+	s := newTestServer(t)
+	h := s.Handler()
+	id := processReceipt(t, h, targetReceipt)
+
+	// The type is sniffed, whatever the upload says it is.
+	image := imageOf(pngHeader, 100)
+	rec := uploadImage(t, h, id, "image", "image/jpeg", image)
+	var ref imageRef
+	decodeBody(t, rec, &ref)
+	if rec.Code != http.StatusCreated || ref.ContentType != "image/png" || ref.Size != 100 || rec.Header().Get("Location") != ref.URL {
+		t.Fatalf("POST /receipts/%s/image = %d %s, want 201 for a PNG", id, rec.Code, rec.Body)
+	}
+
+	rec = send(h, http.MethodGet, ref.URL, "")
+	if rec.Code != http.StatusOK || rec.Body.String() != image || rec.Header().Get("Content-Type") != "image/png" ||
+		rec.Header().Get("ETag") != `"`+ref.SHA256+`"` || rec.Header().Get("Cache-Control") != "private, no-cache" {
+		t.Errorf("GET %s = %d %v, want the image", ref.URL, rec.Code, rec.Header())
+	}
+	if rec := send(h, http.MethodGet, ref.URL, "", "If-None-Match", `"`+ref.SHA256+`"`); rec.Code != http.StatusNotModified {
+		t.Errorf("GET %s with its ETag = %d, want 304", ref.URL, rec.Code)
+	}
+
+	// An image replaces the one before it, and goes with its receipt.
+	if rec := uploadImage(t, h, id, "image", "image/jpeg", imageOf(jpegHeader, 50)); rec.Code != http.StatusCreated {
+		t.Fatalf("replacing the image = %d %s", rec.Code, rec.Body)
+	}
+	if rec := send(h, http.MethodGet, ref.URL, ""); rec.Header().Get("Content-Type") != "image/jpeg" || rec.Body.Len() != 50 {
+		t.Errorf("GET %s after replacing it = %v, %d bytes, want the JPEG", ref.URL, rec.Header(), rec.Body.Len())
+	}
+	if rec := send(h, http.MethodDelete, "/receipts/"+id, ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE /receipts/%s = %d %s", id, rec.Code, rec.Body)
+	}
+	if _, err := s.images.Stat(context.Background(), id); !errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("image of a deleted receipt: %v, want ErrBlobNotFound", err)
+	}
+}
+
+func TestImageUploadTooLarge(t *testing.T) {
+	s := newTestServer(t)
+	s.maxImageSize = 1024
+	h := s.Handler()
+	id := processReceipt(t, h, targetReceipt)
+
+	tests := []struct {
+		size   int
+		status int
+	}{
+		{1024, http.StatusCreated},
+		// Larger than the limit, within what the form may add to it.
+		{1025, http.StatusRequestEntityTooLarge},
+		// Larger than the body may be at all.
+		{1024 + imageFormOverhead + 1, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		rec := uploadImage(t, h, id, "image", "image/png", imageOf(pngHeader, tt.size))
+		if rec.Code != tt.status || tt.status != http.StatusCreated && errorCode(t, rec) != codeBodyTooLarge {
+			t.Errorf("uploading %d bytes = %d %s, want %d", tt.size, rec.Code, rec.Body, tt.status)
+		}
+		if blob, _ := s.images.Stat(context.Background(), id); blob.Size != 1024 {
+			t.Errorf("after uploading %d bytes the image has %d, want the 1024 first uploaded", tt.size, blob.Size)
+		}
+	}
+}
+
+func TestImageUploadWrongType(t *testing.T) {
+	s := newTestServer(t)
+	h := s.Handler()
+	id := processReceipt(t, h, targetReceipt)
+
+	for _, tt := range []struct {
+		name, contentType, data string
+	}{
+		{"GIF", "image/gif", "GIF89a" + strings.Repeat("\x00", 20)},
+		{"WebP", "image/webp", "RIFF\x00\x00\x00\x00WEBPVP8 " + strings.Repeat("\x00", 20)},
+		{"PDF", "application/pdf", "%PDF-1.7\n"},
+		{"text declared a PNG", "image/png", "a photo of a receipt"},
+		{"HTML declared a JPEG", "image/jpeg", "<html><script>alert(1)</script></html>"},
+		{"empty file", "image/png", ""},
+	} {
+		rec := uploadImage(t, h, id, "image", tt.contentType, tt.data)
+		if rec.Code != http.StatusUnsupportedMediaType || errorCode(t, rec) != codeUnsupportedMediaType {
+			t.Errorf("uploading a %s = %d %s, want 415", tt.name, rec.Code, rec.Body)
+		}
+	}
+	if _, err := s.images.Stat(context.Background(), id); !errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("after refused uploads: %v, want no image", err)
+	}
+
+	// The body must be a form, not the image itself.
+	for _, contentType := range []string{"image/png", "application/json", "multipart/mixed; boundary=x", ""} {
+		rec := send(h, http.MethodPost, "/receipts/"+id+"/image", imageOf(pngHeader, 100), "Content-Type", contentType)
+		if rec.Code != http.StatusUnsupportedMediaType || errorCode(t, rec) != codeUnsupportedMediaType {
+			t.Errorf("POST with Content-Type %q = %d %s, want 415", contentType, rec.Code, rec.Body)
+		}
+	}
+	if rec := uploadImage(t, h, id, "photo", "image/png", imageOf(pngHeader, 100)); rec.Code != http.StatusBadRequest || errorCode(t, rec) != codeInvalidBody {
+		t.Errorf("uploading without an image field = %d %s, want 400", rec.Code, rec.Body)
+	}
+	unknown := "00000000-0000-4000-8000-000000000000"
+	if rec := uploadImage(t, h, unknown, "image", "image/png", imageOf(pngHeader, 100)); rec.Code != http.StatusNotFound || errorCode(t, rec) != codeReceiptNotFound {
+		t.Errorf("uploading to an unknown receipt = %d %s, want 404", rec.Code, rec.Body)
+	}
+	if rec := send(h, http.MethodGet, "/receipts/"+id+"/image", ""); rec.Code != http.StatusNotFound || errorCode(t, rec) != codeImageNotFound {
+		t.Errorf("GET of a receipt without an image = %d %s, want 404", rec.Code, rec.Body)
+	}
+}
+
+// TestImageRemovedOnEviction checks that the image of a receipt evicted
+// for the store's limit goes with it.
+func TestImageRemovedOnEviction(t *testing.T) {
+	store := newMemoryStore()
+	s := newStoreServer(t, store)
+	store.maxReceipts, store.onEvict = 1, s.receiptEvicted
+	h := s.Handler()
+	id := processReceipt(t, h, targetReceipt)
+	if rec := uploadImage(t, h, id, "image", "image/png", imageOf(pngHeader, 100)); rec.Code != http.StatusCreated {
+		t.Fatalf("POST /receipts/%s/image = %d %s", id, rec.Code, rec.Body)
+	}
+	processReceipt(t, h, marketReceipt)
+	if _, err := s.images.Stat(context.Background(), id); !errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("image of an evicted receipt: %v, want ErrBlobNotFound", err)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+// itemIndex maps the words of item descriptions to the receipts with an item
+// using them, so that a search only reads the receipts that could match
+// instead of every stored one. A word is a run of letters and digits in a
+// lower-cased description.
+//
+// A nil *itemIndex indexes nothing.
+type itemIndex struct {
+	ids   map[string]map[string]bool // word -> receipt IDs
+	words map[string][]string        // receipt ID -> the words of its items
+}
+
+func newItemIndex() *itemIndex {
+	return &itemIndex{
+		ids:   make(map[string]map[string]bool),
+		words: make(map[string][]string),
+	}
+}
+
+// itemWords returns the distinct words of s, lower-cased.
+func itemWords(s string) []string {
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	slices.Sort(words)
+	return slices.Compact(words)
+}
+
+// add indexes the items of receipt under id, replacing what was indexed for
+// id before.
+func (x *itemIndex) add(id string, receipt points.Receipt) {
+	if x == nil {
+		return
+	}
+	x.remove(id)
+	var words []string
+	for _, item := range receipt.Items {
+		words = append(words, itemWords(item.ShortDescription)...)
+	}
+	slices.Sort(words)
+	words = slices.Compact(words)
+	for _, word := range words {
+		if x.ids[word] == nil {
+			x.ids[word] = make(map[string]bool)
+		}
+		x.ids[word][id] = true
+	}
+	x.words[id] = words
+}
+
+func (x *itemIndex) remove(id string) {
+	if x == nil {
+		return
+	}
+	for _, word := range x.words[id] {
+		delete(x.ids[word], id)
+		if len(x.ids[word]) == 0 {
+			delete(x.ids, word)
+		}
+	}
+	delete(x.words, id)
+}
+
+func (x *itemIndex) clear() {
+	if x == nil {
+		return
+	}
+	x.ids = make(map[string]map[string]bool)
+	x.words = make(map[string][]string)
+}
+
+// candidates returns the IDs of the receipts that may have an item whose
+// lower-cased description contains term, which must be lower case. Each
+// word of term lies within a word of any description containing it, so the
+// receipts returned are those with, for every word of term, an indexed word
+// containing it; some may still not match. It reports false if term has no
+// words to narrow the receipts down by.
+func (x *itemIndex) candidates(term string) (map[string]bool, bool) {
+	fragments := itemWords(term)
+	if len(fragments) == 0 {
+		return nil, false
+	}
+	var candidates map[string]bool
+	for _, fragment := range fragments {
+		matched := make(map[string]bool)
+		for word, ids := range x.ids {
+			if !strings.Contains(word, fragment) {
+				continue
+			}
+			for id := range ids {
+				if candidates == nil || candidates[id] {
+					matched[id] = true
+				}
+			}
+		}
+		candidates = matched
+		if len(candidates) == 0 {
+			break
+		}
+	}
+	return candidates, true
+}
+
+// indexItems starts keeping an index of item descriptions, built over the
+// receipts stored so far, for scanItems to search.
+func (s *memoryStore) indexItems() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.items = newItemIndex()
+	for id, record := range s.records {
+		s.items.add(id, record.receipt)
+	}
+}
+
+// scanItems is Scan, skipping receipts the item index shows have no item
+// whose lower-cased description contains term. It reports false, having
+// called fn for nothing, if the store keeps no index or it cannot narrow
+// down the receipts for term.
+func (s *memoryStore) scanItems(ctx context.Context, term string, after uint64, fn func(StoredReceipt) bool) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.items == nil {
+		return false, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return true, err
+	}
+	candidates, ok := s.items.candidates(term)
+	if !ok {
+		return false, nil
+	}
+
+	entries := make([]orderEntry, 0, len(candidates))
+	for id := range candidates {
+		if record, exists := s.records[id]; exists && record.seq > after {
+			entries = append(entries, orderEntry{seq: record.seq, id: id})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].seq < entries[j].seq })
+
+	now := s.now()
+	for _, entry := range entries {
+		record := s.records[entry.id]
+		if !s.listedLocked(ctx, record, now) {
+			continue
+		}
+		if !fn(record.stored(entry.id)) {
+			break
+		}
+	}
+	return true, nil
+}
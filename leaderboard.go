@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+// retailerIndex keeps running point totals per retailer, and how many of
+// their receipts were awarded each number of points, so that neither the
+// leaderboard nor the points statistics have to scan the store. Retailers
+// are grouped by name, trimmed and compared case-insensitively, or by their
+// canonical name if names is set, and counted separately for each tenant.
+type retailerIndex struct {
+	names *retailerNames // nil unless retailer names are normalized
+
+	mu        sync.Mutex
+	receipts  map[string]indexedReceipt // receipt ID -> what it contributes
+	retailers map[retailerID]*retailerTotals
+}
+
+type retailerID struct {
+	tenant string
+	key    string // from retailerKey
+}
+
+type indexedReceipt struct {
+	retailer retailerID
+	points   int
+}
+
+type retailerTotals struct {
+	name      string // as first seen, for display
+	canonical string
+	receipts  int
+	points    int
+	byPoints  map[int]int // receipts by the points they were awarded
+}
+
+func newRetailerIndex() *retailerIndex {
+	return &retailerIndex{
+		receipts:  make(map[string]indexedReceipt),
+		retailers: make(map[retailerID]*retailerTotals),
+	}
+}
+
+// load adds the receipts already in store to the index.
+func (x *retailerIndex) load(store Store) error {
+	return scanPaged(context.Background(), store, func(stored StoredReceipt) error {
+		x.add(stored.ID, stored.Tenant, stored.Receipt.Retailer, stored.Points)
+		return nil
+	})
+}
+
+func retailerKey(retailer string) string {
+	return strings.ToLower(strings.TrimSpace(retailer))
+}
+
+// add counts a receipt stored for tenant. Adding an ID already counted
+// replaces it.
+func (x *retailerIndex) add(id, tenant, retailer string, total int) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.addLocked(id, tenant, retailer, total)
+}
+
+func (x *retailerIndex) addLocked(id, tenant, retailer string, total int) {
+	x.removeLocked(id)
+	rid := retailerID{tenant: tenant, key: x.names.key(retailer)}
+	totals, ok := x.retailers[rid]
+	if !ok {
+		totals = &retailerTotals{name: strings.TrimSpace(retailer), canonical: x.names.canonical(retailer), byPoints: make(map[int]int)}
+		x.retailers[rid] = totals
+	}
+	totals.receipts++
+	totals.points += total
+	totals.byPoints[total]++
+	x.receipts[id] = indexedReceipt{retailer: rid, points: total}
+}
+
+// rescored records that the receipt with id is now awarded total points.
+func (x *retailerIndex) rescored(id string, total int) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	entry, ok := x.receipts[id]
+	if !ok {
+		return
+	}
+	totals := x.retailers[entry.retailer]
+	totals.points += total - entry.points
+	totals.uncount(entry.points)
+	totals.byPoints[total]++
+	entry.points = total
+	x.receipts[id] = entry
+}
+
+// replaced records that the receipt with id, if it is counted, is now from
+// retailer and awarded total points. It stays counted for the same tenant.
+func (x *retailerIndex) replaced(id, retailer string, total int) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if entry, ok := x.receipts[id]; ok {
+		x.addLocked(id, entry.retailer.tenant, retailer, total)
+	}
+}
+
+// remove stops counting the receipt with id, if it is counted.
+func (x *retailerIndex) remove(id string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.removeLocked(id)
+}
+
+func (x *retailerIndex) removeLocked(id string) {
+	entry, ok := x.receipts[id]
+	if !ok {
+		return
+	}
+	delete(x.receipts, id)
+	totals := x.retailers[entry.retailer]
+	totals.receipts--
+	totals.points -= entry.points
+	totals.uncount(entry.points)
+	if totals.receipts == 0 {
+		delete(x.retailers, entry.retailer)
+	}
+}
+
+// uncount takes a receipt awarded points out of byPoints.
+func (t *retailerTotals) uncount(points int) {
+	if t.byPoints[points]--; t.byPoints[points] == 0 {
+		delete(t.byPoints, points)
+	}
+}
+
+func (x *retailerIndex) clear() {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.receipts = make(map[string]indexedReceipt)
+	x.retailers = make(map[retailerID]*retailerTotals)
+}
+
+// size returns how many retailers are counted, once for each tenant with
+// receipts from them.
+func (x *retailerIndex) size() int {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return len(x.retailers)
+}
+
+// pointsCounts returns how many receipts were awarded each number of points,
+// counting those of the retailer whose key is retailer, or of every retailer
+// if it is empty. Only receipts a store call made with ctx could see are
+// counted.
+func (x *retailerIndex) pointsCounts(ctx context.Context, retailer string) map[int]int {
+	counts := make(map[int]int)
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for rid, totals := range x.retailers {
+		if !canSee(ctx, rid.tenant) || retailer != "" && rid.key != retailer {
+			continue
+		}
+		for points, n := range totals.byPoints {
+			counts[points] += n
+		}
+	}
+	return counts
+}
+
+// retailerPoints is one entry of the GET /retailers/points leaderboard.
+type retailerPoints struct {
+	Retailer      string  `json:"retailer"`
+	ReceiptCount  int     `json:"receiptCount"`
+	TotalPoints   int     `json:"totalPoints"`
+	AveragePoints float64 `json:"averagePoints"`
+
+	// CanonicalRetailer is the name the receipts are grouped under, set
+	// when retailer names are normalized.
+	CanonicalRetailer string `json:"canonicalRetailer,omitempty"`
+}
+
+type leaderboardResponse struct {
+	Retailers []retailerPoints `json:"retailers"`
+}
+
+// leaderboard returns the retailers with at least minReceipts receipts, most
+// points first, keeping at most limit of them. Only receipts a store call
+// made with ctx could see are counted.
+func (x *retailerIndex) leaderboard(ctx context.Context, limit, minReceipts int) []retailerPoints {
+	// Without a tenant, each retailer's totals for every tenant are merged.
+	merged := make(map[string]*retailerTotals)
+	x.mu.Lock()
+	for rid, totals := range x.retailers {
+		if !canSee(ctx, rid.tenant) {
+			continue
+		}
+		if m, ok := merged[rid.key]; ok {
+			m.receipts += totals.receipts
+			m.points += totals.points
+		} else {
+			copied := *totals
+			merged[rid.key] = &copied
+		}
+	}
+	x.mu.Unlock()
+
+	board := []retailerPoints{}
+	for _, totals := range merged {
+		if totals.receipts < minReceipts {
+			continue
+		}
+		entry := retailerPoints{
+			Retailer:      totals.name,
+			ReceiptCount:  totals.receipts,
+			TotalPoints:   totals.points,
+			AveragePoints: float64(totals.points) / float64(totals.receipts),
+		}
+		if x.names != nil {
+			entry.CanonicalRetailer = totals.canonical
+		}
+		board = append(board, entry)
+	}
+
+	sort.Slice(board, func(i, j int) bool {
+		a, b := board[i], board[j]
+		if a.TotalPoints != b.TotalPoints {
+			return a.TotalPoints > b.TotalPoints
+		}
+		if a.ReceiptCount != b.ReceiptCount {
+			return a.ReceiptCount > b.ReceiptCount
+		}
+		return x.names.key(a.Retailer) < x.names.key(b.Retailer)
+	})
+	return board[:min(limit, len(board))]
+}
+
+// leaderboardHandler handles GET /retailers/points, ranking retailers by the
+// points their receipts were awarded or, with ?at=, those still counting at
+// that date.
+func (s *Server) leaderboardHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var errs []points.FieldError
+
+	limit := defaultListLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxListLimit {
+			errs = append(errs, points.FieldError{Field: "limit", Message: fmt.Sprintf("must be an integer between 1 and %d", maxListLimit)})
+		}
+		limit = n
+	}
+
+	minReceipts := 1
+	if v := query.Get("minReceipts"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			errs = append(errs, points.FieldError{Field: "minReceipts", Message: "must be a positive integer"})
+		}
+		minReceipts = n
+	}
+
+	at, fieldErr := parseAt(query)
+	if fieldErr != nil {
+		errs = append(errs, *fieldErr)
+	}
+
+	if len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, codeInvalidQuery, "The query parameters are invalid.", errs...)
+		return
+	}
+
+	index := s.retailers
+	if !at.IsZero() && s.expiry.months > 0 {
+		var err error
+		if index, err = s.effectiveRetailers(r.Context(), at); err != nil {
+			s.writeStoreError(w, r, err)
+			return
+		}
+	}
+
+	board := index.leaderboard(r.Context(), limit, minReceipts)
+	for i := range board {
+		board[i].Retailer = s.denylist.mask(board[i].Retailer)
+		if board[i].CanonicalRetailer != "" {
+			board[i].CanonicalRetailer = s.denylist.mask(board[i].CanonicalRetailer)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(leaderboardResponse{Retailers: board})
+}
+
+// effectiveRetailers returns an index of the points that still count at at,
+// built by reading the store, since the running totals of s.retailers are of
+// the points as awarded. Receipts the expiry policy rejects are left out.
+func (s *Server) effectiveRetailers(ctx context.Context, at time.Time) (*retailerIndex, error) {
+	index := newRetailerIndex()
+	index.names = s.names
+	err := scanPaged(ctx, s.store, func(stored StoredReceipt) error {
+		effective, _, _, err := s.expiry.effective(stored.Receipt, stored.Points, at)
+		if err == nil {
+			index.add(stored.ID, stored.Tenant, stored.Receipt.Retailer, effective)
+		}
+		return nil
+	})
+	return index, err
+}
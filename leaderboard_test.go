@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// leaderboard fetches GET /retailers/points from h.
+func leaderboard(t *testing.T, h http.Handler) []retailerPoints {
+	t.Helper()
+	rec := send(h, http.MethodGet, "/retailers/points", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /retailers/points = %d %s, want 200", rec.Code, rec.Body)
+	}
+	var board leaderboardResponse
+	decodeBody(t, rec, &board)
+	return board.Retailers
+}
+
+// TestLeaderboardFollowsDeletes deletes receipts one at a time and checks
+// that their retailer's count and total drop with each.
+func TestLeaderboardFollowsDeletes(t *testing.T) {
+	h := newTestServer(t).Handler()
+	first := processReceipt(t, h, targetReceipt)
+	// Names differing in case and surrounding space are one retailer.
+	second := processReceipt(t, h, strings.Replace(targetReceipt, `"Target"`, `" TARGET "`, 1))
+	processReceipt(t, h, marketReceipt)
+
+	market := retailerPoints{Retailer: "M&M Corner Market", ReceiptCount: 1, TotalPoints: 109, AveragePoints: 109}
+	steps := []struct {
+		delete string
+		want   []retailerPoints
+	}{
+		{"", []retailerPoints{market, {Retailer: "Target", ReceiptCount: 2, TotalPoints: 56, AveragePoints: 28}}},
+		{first, []retailerPoints{market, {Retailer: "Target", ReceiptCount: 1, TotalPoints: 28, AveragePoints: 28}}},
+		{second, []retailerPoints{market}},
+	}
+	for _, step := range steps {
+		if step.delete != "" {
+			if rec := send(h, http.MethodDelete, "/receipts/"+step.delete, ""); rec.Code != http.StatusNoContent {
+				t.Fatalf("DELETE /receipts/%s = %d %s, want 204", step.delete, rec.Code, rec.Body)
+			}
+		}
+		if got := leaderboard(t, h); !reflect.DeepEqual(got, step.want) {
+			t.Errorf("after deleting %q, leaderboard = %+v, want %+v", step.delete, got, step.want)
+		}
+	}
+
+	// Deleting it again changes nothing.
+	send(h, http.MethodDelete, "/receipts/"+first, "")
+	if got := leaderboard(t, h); !reflect.DeepEqual(got, []retailerPoints{market}) {
+		t.Errorf("after deleting a receipt twice, leaderboard = %+v, want %+v", got, []retailerPoints{market})
+	}
+}
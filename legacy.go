@@ -0,0 +1,60 @@
+package main
+
+import (
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+// Before each receipt was kept as a single record, the memory store held
+// receipts and their points in two maps, written one after the other. Data
+// persisted in that layout, by a snapshot or the file log, is merged into
+// records as it is loaded. A receipt without its points, or points without
+// their receipt, are the remains of a write cut short, and are dropped
+// rather than loaded as a partial record.
+
+// legacyMerge pairs receipts with their points as they are read.
+type legacyMerge struct {
+	receipts map[string]legacyReceipt
+	points   map[string]int
+}
+
+type legacyReceipt struct {
+	tenant  string
+	receipt points.Receipt
+}
+
+func newLegacyMerge() *legacyMerge {
+	return &legacyMerge{receipts: make(map[string]legacyReceipt), points: make(map[string]int)}
+}
+
+// addReceipt reads the receipt stored under id for tenant. If its points
+// have been read, the record they make is returned.
+func (m *legacyMerge) addReceipt(id, tenant string, receipt points.Receipt) (snapshotRecord, bool) {
+	if total, ok := m.points[id]; ok {
+		delete(m.points, id)
+		return snapshotRecord{ID: id, Tenant: tenant, Points: total, Receipt: receipt}, true
+	}
+	m.receipts[id] = legacyReceipt{tenant: tenant, receipt: receipt}
+	return snapshotRecord{}, false
+}
+
+// addPoints reads the points of the receipt stored under id. If the
+// receipt has been read, the record they make is returned.
+func (m *legacyMerge) addPoints(id string, total int) (snapshotRecord, bool) {
+	if stored, ok := m.receipts[id]; ok {
+		delete(m.receipts, id)
+		return snapshotRecord{ID: id, Tenant: stored.tenant, Points: total, Receipt: stored.receipt}, true
+	}
+	m.points[id] = total
+	return snapshotRecord{}, false
+}
+
+// unpaired returns how many receipts and points read have not been paired.
+func (m *legacyMerge) unpaired() int {
+	return len(m.receipts) + len(m.points)
+}
+
+// legacyBreakdown is the breakdown of a record merged from the two-map
+// layout, which kept no more of a score than its points.
+func legacyBreakdown(total int) points.Breakdown {
+	return points.Breakdown{Rules: []points.RuleResult{}, Total: total}
+}
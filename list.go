@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 500
+)
+
+// receiptSummary is one entry of the GET /receipts listing.
+type receiptSummary struct {
+	ID           string       `json:"id"`
+	Retailer     string       `json:"retailer"`
+	PurchaseDate string       `json:"purchaseDate"`
+	Total        points.Money `json:"total"`
+	Points       int          `json:"points"`
+
+	// CanonicalRetailer is the name the receipt is grouped under, set
+	// when retailer names are normalized.
+	CanonicalRetailer string `json:"canonicalRetailer,omitempty"`
+}
+
+type listResponse struct {
+	Receipts []receiptSummary `json:"receipts"`
+	// NextCursor is passed as ?cursor= to fetch the following page. It is
+	// omitted on the last page.
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// receiptFilter selects receipts by the retailer, from and to query
+// parameters shared by the listing and export endpoints.
+type receiptFilter struct {
+	retailer string // compared by the key names gives it; empty matches all
+	from, to string // inclusive YYYY-MM-DD bounds; empty is unbounded
+	names    *retailerNames
+}
+
+func parseReceiptFilter(query url.Values, names *retailerNames) (receiptFilter, []points.FieldError) {
+	filter := receiptFilter{
+		retailer: names.key(query.Get("retailer")),
+		from:     query.Get("from"),
+		to:       query.Get("to"),
+		names:    names,
+	}
+
+	var errs []points.FieldError
+	for _, bound := range []struct{ name, value string }{{"from", filter.from}, {"to", filter.to}} {
+		if bound.value == "" {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", bound.value); err != nil {
+			errs = append(errs, points.FieldError{Field: bound.name, Message: "must be a date in YYYY-MM-DD format"})
+		}
+	}
+	return filter, errs
+}
+
+// matches reports whether receipt passes the filter. Purchase dates are
+// validated as YYYY-MM-DD, so they compare correctly as strings.
+func (f receiptFilter) matches(receipt points.Receipt) bool {
+	if f.retailer != "" && f.names.key(receipt.Retailer) != f.retailer {
+		return false
+	}
+	if f.from != "" && receipt.PurchaseDate < f.from {
+		return false
+	}
+	if f.to != "" && receipt.PurchaseDate > f.to {
+		return false
+	}
+	return true
+}
+
+// parsePage parses the limit and cursor query parameters of a paged
+// listing.
+func parsePage(query url.Values) (limit int, cursor uint64, errs []points.FieldError) {
+	limit = defaultListLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxListLimit {
+			errs = append(errs, points.FieldError{Field: "limit", Message: fmt.Sprintf("must be an integer between 1 and %d", maxListLimit)})
+		}
+		limit = n
+	}
+	if v := query.Get("cursor"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			errs = append(errs, points.FieldError{Field: "cursor", Message: "is not a cursor returned by this endpoint"})
+		}
+		cursor = n
+	}
+	return limit, cursor, errs
+}
+
+// summarize returns the listing entry for stored.
+func (s *Server) summarize(stored StoredReceipt) receiptSummary {
+	summary := receiptSummary{
+		ID:           s.ids.external(stored.ID),
+		Retailer:     s.denylist.mask(stored.Receipt.Retailer),
+		PurchaseDate: stored.Receipt.PurchaseDate,
+		Total:        stored.Receipt.Total,
+		Points:       stored.Points,
+	}
+	if s.names != nil {
+		summary.CanonicalRetailer = s.denylist.mask(s.names.canonical(stored.Receipt.Retailer))
+	}
+	return summary
+}
+
+// listReceiptsHandler handles GET /receipts, returning receipt summaries in
+// the order they were processed. Paging by cursor rather than offset keeps
+// pages stable while new receipts arrive.
+func (s *Server) listReceiptsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	filter, errs := parseReceiptFilter(query, s.names)
+	limit, cursor, pageErrs := parsePage(query)
+	errs = append(errs, pageErrs...)
+	if len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, codeInvalidQuery, "The query parameters are invalid.", errs...)
+		return
+	}
+
+	response := listResponse{Receipts: []receiptSummary{}}
+	var lastSeq uint64
+	more := false
+	err := s.store.Scan(r.Context(), cursor, func(stored StoredReceipt) bool {
+		if !filter.matches(stored.Receipt) {
+			return true
+		}
+		if len(response.Receipts) == limit {
+			more = true
+			return false
+		}
+		response.Receipts = append(response.Receipts, s.summarize(stored))
+		lastSeq = stored.Seq
+		return true
+	})
+	if err != nil {
+		s.writeStoreError(w, r, err)
+		return
+	}
+	if more {
+		response.NextCursor = strconv.FormatUint(lastSeq, 10)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/y1zhuo/receipt-processor-challenge/client"
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+// Exit codes of the loadtest command.
+const (
+	loadtestExitOK     = 0
+	loadtestExitFailed = 1 // the error rate or latency went over its limit
+	loadtestExitUsage  = 2 // bad arguments or unreadable input
+)
+
+// loadtestPendingWait bounds how long the points of a receipt the server is
+// still processing asynchronously are waited for.
+const loadtestPendingWait = 5 * time.Second
+
+// loadtestDescriptions are the item descriptions of synthetic receipts.
+var loadtestDescriptions = []string{
+	"Mountain Dew 12PK", "Emils Cheese Pizza", "Knorr Creamy Chicken", "Doritos Nacho Cheese",
+	"Klarbrunn 12-PK 12 FL OZ", "Gatorade", "Pepsi 12PK", "Dasani", "Sourdough Bread", "Bananas",
+}
+
+// loadReceipt is a receipt the loadtest command submits, with the points it
+// is expected to be awarded.
+type loadReceipt struct {
+	receipt points.Receipt
+	points  int
+}
+
+// loadtestLatency summarizes the latencies of one kind of request, in
+// milliseconds, as nearest-rank percentiles.
+type loadtestLatency struct {
+	P50 float64 `json:"p50Ms"`
+	P90 float64 `json:"p90Ms"`
+	P99 float64 `json:"p99Ms"`
+	Max float64 `json:"maxMs"`
+}
+
+// loadtestReport is the outcome of a loadtest run. A request is a receipt
+// submitted and, unless verification is off, its points read back; it fails
+// if either call does, or the points are not those expected.
+type loadtestReport struct {
+	Requests        int     `json:"requests"`
+	Errors          int     `json:"errors"`
+	ErrorRate       float64 `json:"errorRate"`
+	DurationSeconds float64 `json:"durationSeconds"`
+	Throughput      float64 `json:"throughput"` // requests per second
+	// Process is the latency of POST /receipts/process, and Points that of
+	// GET /receipts/{id}/points, omitted unless points were verified.
+	Process loadtestLatency  `json:"process"`
+	Points  *loadtestLatency `json:"points,omitempty"`
+	// ErrorsByKind counts the errors by API error code, by HTTP status
+	// for responses that are not API errors, or as network errors or
+	// points mismatches.
+	ErrorsByKind map[string]int `json:"errorsByKind,omitempty"`
+	// Failed lists the limits the run went over.
+	Failed []string `json:"failed,omitempty"`
+}
+
+// loadtestWorker is what one goroutine of a run records, merged into the
+// report once the run is over.
+type loadtestWorker struct {
+	requests, errors int
+	process, points  []time.Duration
+	kinds            map[string]int
+}
+
+// runLoadtest implements "receipt-processor loadtest": it submits receipts
+// to a running server as fast as -concurrency goroutines can, for -duration
+// or -requests, checks that each ID serves the points the receipt scores
+// locally, and reports throughput, latency and errors. It returns
+// loadtestExitFailed if the error rate or the 99th percentile latency of
+// submissions goes over its limit, so that CI can gate on it.
+func runLoadtest(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("receipt-processor loadtest", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	target := fs.String("url", "http://localhost:8080", "base URL of the server to load")
+	apiKey := fs.String("api-key", "", "API key to send as a bearer token")
+	file := fs.String("f", "", "export file (from GET /admin/export) whose receipts are replayed; synthetic receipts are generated if not given")
+	count := fs.Int("receipts", 1000, "how many synthetic receipts to generate")
+	minItems := fs.Int("min-items", 1, "fewest items on a synthetic receipt")
+	maxItems := fs.Int("max-items", 5, "most items on a synthetic receipt")
+	retailers := fs.String("retailers", "Target,Walgreens,M&M Corner Market,Walmart", "comma-separated retailer names of synthetic receipts")
+	seed := fs.Uint64("seed", 1, "seed of the synthetic receipts, so that runs can be repeated")
+	concurrency := fs.Int("concurrency", 8, "how many requests are in flight at once")
+	duration := fs.Duration("duration", 30*time.Second, "how long to keep submitting receipts")
+	requests := fs.Int("requests", 0, "stop after this many requests, if sooner than -duration; 0 for no limit")
+	verify := fs.Bool("verify", true, "read back the points of each receipt and check them against those scored locally; turn off against servers with daily caps")
+	rulesPath := fs.String("rules", "", "path to the JSON rules file the server scores with, for the expected points")
+	retries := fs.Int("retries", 0, "how many times the client retries a request after a 429 or 5xx; 0 so that every failure counts")
+	maxErrorRate := fs.Float64("max-error-rate", 0.01, "fail if more than this fraction of requests fail")
+	maxP99 := fs.Duration("max-p99", 0, "fail if the 99th percentile latency of POST /receipts/process is over this; 0 for no limit")
+	format := fs.String("format", "table", "output format: table or json")
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: receipt-processor loadtest [flags]\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return loadtestExitOK
+		}
+		return loadtestExitUsage
+	}
+	usage := func(format string, args ...any) int {
+		fmt.Fprintf(stderr, "loadtest: "+format+"\n", args...)
+		return loadtestExitUsage
+	}
+	switch {
+	case *format != "table" && *format != "json":
+		return usage("unknown format %q", *format)
+	case *concurrency <= 0:
+		return usage("-concurrency must be positive, got %d", *concurrency)
+	case *duration <= 0:
+		return usage("-duration must be positive, got %s", *duration)
+	case *requests < 0 || *retries < 0:
+		return usage("-requests and -retries must not be negative")
+	case *minItems < 1 || *maxItems < *minItems:
+		return usage("-min-items must be at least 1 and at most -max-items")
+	case *file == "" && *count <= 0:
+		return usage("-receipts must be positive, got %d", *count)
+	case *file == "" && len(splitList(*retailers)) == 0:
+		return usage("-retailers must name at least one retailer")
+	}
+	if *rulesPath != "" {
+		config, err := points.LoadRulesConfig(*rulesPath)
+		if err != nil {
+			return usage("loading rules: %v", err)
+		}
+		rules.set(config)
+	}
+
+	var receipts []loadReceipt
+	if *file != "" {
+		var skipped int
+		var err error
+		receipts, skipped, err = loadExportedReceipts(*file)
+		if err != nil {
+			return usage("%v", err)
+		}
+		if skipped > 0 {
+			fmt.Fprintf(stderr, "loadtest: skipped %d deleted, compacted or invalid receipts in %s\n", skipped, *file)
+		}
+		if len(receipts) == 0 {
+			return usage("%s holds no receipts to replay", *file)
+		}
+	} else {
+		rng := rand.New(rand.NewPCG(*seed, *seed))
+		var err error
+		receipts, err = syntheticReceipts(rng, *count, *minItems, *maxItems, splitList(*retailers), time.Now())
+		if err != nil {
+			return usage("%v", err)
+		}
+	}
+
+	c := client.New(*target)
+	c.APIKey = *apiKey
+	c.MaxRetries = *retries
+	// Keep a connection open for every goroutine, rather than the
+	// default two, so that connections are not churned through.
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = *concurrency
+	c.HTTPClient.Transport = transport
+
+	report := loadtest(c, receipts, *concurrency, *duration, *requests, *verify)
+	if report.ErrorRate > *maxErrorRate {
+		report.Failed = append(report.Failed, fmt.Sprintf("error rate %.4f is over -max-error-rate %g", report.ErrorRate, *maxErrorRate))
+	}
+	if p99 := time.Duration(report.Process.P99 * float64(time.Millisecond)); *maxP99 > 0 && p99 > *maxP99 {
+		report.Failed = append(report.Failed, fmt.Sprintf("p99 latency %s is over -max-p99 %s", p99, *maxP99))
+	}
+
+	if *format == "json" {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		writeLoadtestTable(stdout, report)
+	}
+	if len(report.Failed) > 0 {
+		return loadtestExitFailed
+	}
+	return loadtestExitOK
+}
+
+// loadtest submits receipts, in turn and over again, from concurrency
+// goroutines until duration has passed or limit requests have been made.
+func loadtest(c *client.Client, receipts []loadReceipt, concurrency int, duration time.Duration, limit int, verify bool) loadtestReport {
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	defer cancel()
+
+	var next atomic.Int64
+	workers := make([]loadtestWorker, concurrency)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := range workers {
+		wg.Add(1)
+		go func(w *loadtestWorker) {
+			defer wg.Done()
+			w.kinds = make(map[string]int)
+			for ctx.Err() == nil {
+				n := next.Add(1) - 1
+				if limit > 0 && n >= int64(limit) {
+					return
+				}
+				kind, ok := loadtestRequest(ctx, c, receipts[n%int64(len(receipts))], verify, w)
+				if !ok && ctx.Err() != nil {
+					// Cut short by the end of the run, not failed.
+					return
+				}
+				w.requests++
+				if !ok {
+					w.errors++
+					w.kinds[kind]++
+				}
+			}
+		}(&workers[i])
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	report := loadtestReport{DurationSeconds: elapsed.Seconds(), ErrorsByKind: make(map[string]int)}
+	var process, pointsRead []time.Duration
+	for _, w := range workers {
+		report.Requests += w.requests
+		report.Errors += w.errors
+		process = append(process, w.process...)
+		pointsRead = append(pointsRead, w.points...)
+		for kind, n := range w.kinds {
+			report.ErrorsByKind[kind] += n
+		}
+	}
+	if report.Requests > 0 {
+		report.ErrorRate = float64(report.Errors) / float64(report.Requests)
+	}
+	report.Throughput = float64(report.Requests) / elapsed.Seconds()
+	report.Process = summarizeLatencies(process)
+	if verify {
+		latency := summarizeLatencies(pointsRead)
+		report.Points = &latency
+	}
+	return report
+}
+
+// loadtestRequest submits one receipt and, if verify is set, checks the
+// points its ID serves, recording the latencies in w. If the request fails,
+// it returns the kind of error.
+func loadtestRequest(ctx context.Context, c *client.Client, load loadReceipt, verify bool, w *loadtestWorker) (string, bool) {
+	start := time.Now()
+	id, err := c.ProcessReceipt(ctx, load.receipt)
+	w.process = append(w.process, time.Since(start))
+	if err != nil {
+		return loadtestErrorKind(err), false
+	}
+	if !verify {
+		return "", true
+	}
+
+	// A server processing receipts asynchronously answers 404
+	// receipt_pending until the receipt is stored.
+	deadline := time.Now().Add(loadtestPendingWait)
+	for {
+		start = time.Now()
+		got, err := c.GetPoints(ctx, id)
+		var apiErr *client.APIError
+		if errors.As(err, &apiErr) && apiErr.Code == codeReceiptPending && time.Now().Before(deadline) {
+			time.Sleep(50 * time.Millisecond)
+			continue
+		}
+		if err != nil {
+			return "points " + loadtestErrorKind(err), false
+		}
+		w.points = append(w.points, time.Since(start))
+		if got != load.points {
+			return "points_mismatch", false
+		}
+		return "", true
+	}
+}
+
+// loadtestErrorKind names the kind of a failed call for the report.
+func loadtestErrorKind(err error) string {
+	var apiErr *client.APIError
+	switch {
+	case errors.As(err, &apiErr) && apiErr.Code != "":
+		return apiErr.Code
+	case errors.As(err, &apiErr):
+		return "http_" + strconv.Itoa(apiErr.StatusCode)
+	}
+	return "network"
+}
+
+// summarizeLatencies returns the nearest-rank percentiles of latencies.
+func summarizeLatencies(latencies []time.Duration) loadtestLatency {
+	if len(latencies) == 0 {
+		return loadtestLatency{}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p int) float64 {
+		rank := (len(latencies)*p + 99) / 100
+		return float64(latencies[rank-1]) / float64(time.Millisecond)
+	}
+	return loadtestLatency{P50: percentile(50), P90: percentile(90), P99: percentile(99), Max: percentile(100)}
+}
+
+// loadExportedReceipts reads the receipts of an export, scoring each one
+// with the current rules for the points the server is expected to award. It
+// also returns how many it skipped as deleted, compacted or invalid.
+func loadExportedReceipts(path string) ([]loadReceipt, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	scorer := newServer(newMemoryStore())
+	var receipts []loadReceipt
+	skipped := 0
+	reader := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if len(data) > 0 {
+			var record snapshotRecord
+			if err := json.Unmarshal(data, &record); err != nil {
+				return nil, 0, fmt.Errorf("%s: line %d is not an exported receipt: %w", path, line, err)
+			}
+			if record.DeletedAt != nil || record.CompactedAt != nil {
+				skipped++
+			} else if receipt, breakdown, apiErr := scorer.scoreReceipt(record.Receipt, false); apiErr != nil {
+				skipped++
+			} else {
+				receipts = append(receipts, loadReceipt{receipt: receipt, points: breakdown.Total})
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return receipts, skipped, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+}
+
+// syntheticReceipts generates n receipts from rng, each from one of retailers
+// with between minItems and maxItems items, dated in the 30 days before now,
+// and scores them with the current rules. Only a retailer name can make one
+// invalid, which is reported as an error.
+func syntheticReceipts(rng *rand.Rand, n, minItems, maxItems int, retailers []string, now time.Time) ([]loadReceipt, error) {
+	scorer := newServer(newMemoryStore())
+	receipts := make([]loadReceipt, 0, n)
+	for len(receipts) < n {
+		receipt := points.Receipt{
+			Retailer:     retailers[rng.IntN(len(retailers))],
+			PurchaseDate: now.AddDate(0, 0, -1-rng.IntN(30)).Format(points.DateLayout),
+			PurchaseTime: fmt.Sprintf("%02d:%02d", rng.IntN(24), rng.IntN(60)),
+		}
+		var total int64
+		for range minItems + rng.IntN(maxItems-minItems+1) {
+			cents := 50 + rng.Int64N(1950)
+			total += cents
+			receipt.Items = append(receipt.Items, points.Item{
+				ShortDescription: loadtestDescriptions[rng.IntN(len(loadtestDescriptions))],
+				Price:            points.Money(fmt.Sprintf("%d.%02d", cents/100, cents%100)),
+			})
+		}
+		receipt.Total = points.Money(fmt.Sprintf("%d.%02d", total/100, total%100))
+		scored, breakdown, apiErr := scorer.scoreReceipt(receipt, true)
+		if apiErr != nil {
+			return nil, fmt.Errorf("synthetic receipt from %q is invalid: %s", receipt.Retailer, apiErr.Message)
+		}
+		receipts = append(receipts, loadReceipt{receipt: scored, points: breakdown.Total})
+	}
+	return receipts, nil
+}
+
+// writeLoadtestTable writes report in a human-readable form.
+func writeLoadtestTable(w io.Writer, report loadtestReport) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "requests\t%d in %.1fs (%.1f/s)\n", report.Requests, report.DurationSeconds, report.Throughput)
+	fmt.Fprintf(tw, "errors\t%d (%.2f%%)\n", report.Errors, report.ErrorRate*100)
+	kinds := make([]string, 0, len(report.ErrorsByKind))
+	for kind := range report.ErrorsByKind {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		fmt.Fprintf(tw, "  %s\t%d\n", kind, report.ErrorsByKind[kind])
+	}
+	latency := func(name string, l loadtestLatency) {
+		fmt.Fprintf(tw, "%s\tp50 %.1fms\tp90 %.1fms\tp99 %.1fms\tmax %.1fms\n", name, l.P50, l.P90, l.P99, l.Max)
+	}
+	latency("process", report.Process)
+	if report.Points != nil {
+		latency("points", *report.Points)
+	}
+	tw.Flush()
+	for _, failed := range report.Failed {
+		fmt.Fprintf(w, "FAIL: %s\n", failed)
+	}
+}
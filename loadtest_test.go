@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runLoadtestAgainst runs the loadtest command on args against a test
+// server whose POST /receipts/process takes at least delay, returning its
+// exit code and report.
+func runLoadtestAgainst(t *testing.T, delay time.Duration, args ...string) (int, loadtestReport) {
+	t.Helper()
+	h := newTestServer(t).Handler()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && r.URL.Path == "/receipts/process" {
+			time.Sleep(delay)
+		}
+		h.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	var stdout, stderr bytes.Buffer
+	args = append([]string{"-url", srv.URL, "-format", "json", "-receipts", "5", "-requests", "5", "-concurrency", "1", "-duration", "10s"}, args...)
+	code := runLoadtest(args, &stdout, &stderr)
+	var report loadtestReport
+	if err := json.Unmarshal(stdout.Bytes(), &report); err != nil {
+		t.Fatalf("decoding report %q (stderr %q): %v", stdout.String(), stderr.String(), err)
+	}
+	return code, report
+}
+
+func TestLoadtestPasses(t *testing.T) {
+	code, report := runLoadtestAgainst(t, 0, "-max-p99", "10s")
+	if code != loadtestExitOK || report.Requests != 5 || report.Errors != 0 || len(report.Failed) != 0 {
+		t.Errorf("loadtest = exit %d, %+v; want exit 0 with 5 requests and no errors", code, report)
+	}
+	if report.Points == nil {
+		t.Error("report has no points latencies, want them with -verify")
+	}
+}
+
+// TestLoadtestSLOBreach checks that a server slower than -max-p99 fails
+// the run, though every request succeeded.
+func TestLoadtestSLOBreach(t *testing.T) {
+	code, report := runLoadtestAgainst(t, 20*time.Millisecond, "-max-p99", "5ms")
+	if code != loadtestExitFailed || report.Errors != 0 {
+		t.Errorf("loadtest past its SLO = exit %d, %d errors; want exit %d and no errors", code, report.Errors, loadtestExitFailed)
+	}
+	if len(report.Failed) != 1 || !strings.Contains(report.Failed[0], "-max-p99") {
+		t.Errorf("failed limits = %q, want only -max-p99", report.Failed)
+	}
+}
+
+func TestLoadtestUsage(t *testing.T) {
+	for _, args := range [][]string{
+		{"-format", "yaml"},
+		{"-concurrency", "0"},
+		{"-min-items", "3", "-max-items", "2"},
+		{"-retailers", ","},
+		{"-f", "no-such-file"},
+	} {
+		var stdout, stderr bytes.Buffer
+		if code := runLoadtest(args, &stdout, &stderr); code != loadtestExitUsage || stdout.Len() != 0 {
+			t.Errorf("loadtest %q = exit %d, stdout %q; want exit %d and no report", args, code, stdout.String(), loadtestExitUsage)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultLocale is the language of the messages the code writes, and of
+// error responses to clients that do not ask for another.
+const defaultLocale = "en"
+
+// locales holds a message catalog per language, named by its ISO 639-1 code.
+// Each maps a message ID to its text, with {0}, {1} and so on standing for
+// the values interpolated into it.
+//
+//go:embed locales/*.json
+var locales embed.FS
+
+var (
+	catalogs = loadCatalogs()
+	// messages recognizes the English messages of the default catalog,
+	// most specific first, so that they can be translated after the fact.
+	messages = compileMessages(catalogs[defaultLocale])
+)
+
+var placeholderPattern = regexp.MustCompile(`\{(\d+)\}`)
+
+func loadCatalogs() map[string]map[string]string {
+	files, err := locales.ReadDir("locales")
+	if err != nil {
+		panic(err)
+	}
+	catalogs := make(map[string]map[string]string)
+	for _, file := range files {
+		data, err := locales.ReadFile("locales/" + file.Name())
+		if err != nil {
+			panic(err)
+		}
+		var catalog map[string]string
+		if err := json.Unmarshal(data, &catalog); err != nil {
+			panic(fmt.Sprintf("locales/%s: %v", file.Name(), err))
+		}
+		catalogs[strings.TrimSuffix(file.Name(), path.Ext(file.Name()))] = catalog
+	}
+	return catalogs
+}
+
+// message is an English message recognized by pattern, whose groups
+// capture, in order, the values given by args.
+type message struct {
+	id      string
+	pattern *regexp.Regexp
+	args    []int
+	literal int // length of the text around the values
+}
+
+func compileMessages(catalog map[string]string) []message {
+	var compiled []message
+	for id, text := range catalog {
+		m := message{id: id}
+		var expr strings.Builder
+		expr.WriteString("^")
+		last := 0
+		for _, loc := range placeholderPattern.FindAllStringSubmatchIndex(text, -1) {
+			expr.WriteString(regexp.QuoteMeta(text[last:loc[0]]))
+			expr.WriteString("(.+)")
+			n, _ := strconv.Atoi(text[loc[2]:loc[3]])
+			m.args = append(m.args, n)
+			m.literal += loc[0] - last
+			last = loc[1]
+		}
+		expr.WriteString(regexp.QuoteMeta(text[last:]))
+		expr.WriteString("$")
+		m.literal += len(text) - last
+		m.pattern = regexp.MustCompile(expr.String())
+		compiled = append(compiled, m)
+	}
+	// "is {0} but the item prices sum to {1}" also matches the messages
+	// of "is {0} but the item prices sum to more than {1}", so the message
+	// with more fixed text is tried first.
+	sort.Slice(compiled, func(i, j int) bool {
+		if compiled[i].literal != compiled[j].literal {
+			return compiled[i].literal > compiled[j].literal
+		}
+		return compiled[i].id < compiled[j].id
+	})
+	return compiled
+}
+
+// translate returns text, a message of the default catalog with its values
+// filled in, in locale. Messages the locale has no translation for are
+// returned as they are.
+func translate(locale, text string) string {
+	catalog, ok := catalogs[locale]
+	if !ok || locale == defaultLocale {
+		return text
+	}
+	for _, m := range messages {
+		match := m.pattern.FindStringSubmatch(text)
+		if match == nil {
+			continue
+		}
+		translated, ok := catalog[m.id]
+		if !ok {
+			return text
+		}
+		values := make(map[string]string, len(m.args))
+		for i, n := range m.args {
+			values[strconv.Itoa(n)] = match[i+1]
+		}
+		return placeholderPattern.ReplaceAllStringFunc(translated, func(placeholder string) string {
+			return values[placeholder[1:len(placeholder)-1]]
+		})
+	}
+	return text
+}
+
+// in returns e with its message and those of its details translated into
+// locale.
+func (e *apiError) in(locale string) *apiError {
+	if locale == "" || locale == defaultLocale {
+		return e
+	}
+	translated := *e
+	translated.Message = translate(locale, e.Message)
+	if len(e.Details) > 0 {
+		translated.Details = append(translated.Details[:0:0], e.Details...)
+		for i := range translated.Details {
+			translated.Details[i].Message = translate(locale, translated.Details[i].Message)
+		}
+	}
+	return &translated
+}
+
+// responseLocale returns the language negotiateLanguage chose for the
+// response written to w.
+func responseLocale(w http.ResponseWriter) string {
+	return w.Header().Get("Content-Language")
+}
+
+// negotiateLanguage picks the language of error messages from the request's
+// Accept-Language header and reports it in the Content-Language header,
+// where writeAPIError looks for it. Error codes are the same in every
+// language, so clients can still branch on them.
+func negotiateLanguage(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Language")
+		if accept := r.Header.Values("Accept-Language"); len(accept) > 0 {
+			w.Header().Set("Content-Language", negotiateLocale(strings.Join(accept, ",")))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// negotiateLocale returns the catalog best matching accept, the value of an
+// Accept-Language header, or the default one if none is acceptable. A
+// language range such as fr-CA matches the catalog of its primary language,
+// and * any catalog, the default first, not refused with q=0.
+func negotiateLocale(accept string) string {
+	type languageRange struct {
+		tag string
+		q   float64
+	}
+	var ranges []languageRange
+	refused := make(map[string]bool)
+	for _, part := range strings.Split(accept, ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" {
+			continue
+		}
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil || parsed < 0 || parsed > 1 {
+				continue
+			}
+			q = parsed
+		}
+		if q == 0 {
+			refused[tag] = true
+			continue
+		}
+		ranges = append(ranges, languageRange{tag, q})
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].q > ranges[j].q })
+
+	for _, r := range ranges {
+		if r.tag == "*" {
+			if !refused[defaultLocale] {
+				return defaultLocale
+			}
+			for _, locale := range supportedLocales() {
+				if !refused[locale] {
+					return locale
+				}
+			}
+			continue
+		}
+		primary, _, _ := strings.Cut(r.tag, "-")
+		if _, ok := catalogs[primary]; ok && !refused[primary] {
+			return primary
+		}
+	}
+	return defaultLocale
+}
+
+// supportedLocales returns the languages there are catalogs for, in order.
+func supportedLocales() []string {
+	supported := make([]string, 0, len(catalogs))
+	for locale := range catalogs {
+		supported = append(supported, locale)
+	}
+	sort.Strings(supported)
+	return supported
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateLocale(t *testing.T) {
+	tests := []struct{ accept, want string }{
+		{"", "en"},
+		{"fr", "fr"},
+		{"fr-CA", "fr"},
+		{"FR-ca", "fr"},
+		{"en-US,en;q=0.9,fr;q=0.8", "en"},
+		{"en;q=0.1, fr;q=0.9", "fr"},
+		{" fr-CA ; q=0.5 , de", "fr"},
+		// Ties keep the client's order.
+		{"fr;q=0.5, en;q=0.5", "fr"},
+		// Unsupported languages are passed over.
+		{"de", "en"},
+		{"de, ja;q=0.9, fr;q=0.1", "fr"},
+		{"frr", "en"},
+		// The wildcard means the default, unless that is refused.
+		{"*", "en"},
+		{"de, *;q=0.5", "en"},
+		{"*, en;q=0", "fr"},
+		{"*, en;q=0, fr;q=0", "en"},
+		// Refused and malformed ranges count for nothing.
+		{"fr;q=0", "en"},
+		{"fr;q=0.0, en-GB;q=0.3", "en"},
+		{"fr;q=abc", "en"},
+		{"fr;q=2", "en"},
+		{"fr;q=-1, de", "en"},
+		{",,;q=1,", "en"},
+	}
+	for _, tt := range tests {
+		if got := negotiateLocale(tt.accept); got != tt.want {
+			t.Errorf("negotiateLocale(%q) = %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestCatalogsMatch(t *testing.T) {
+	placeholders := func(text string) []string {
+		found := placeholderPattern.FindAllString(text, -1)
+		slices.Sort(found)
+		return found
+	}
+	en := catalogs[defaultLocale]
+	for _, locale := range supportedLocales() {
+		for id, text := range catalogs[locale] {
+			if _, ok := en[id]; !ok {
+				t.Errorf("%s has %s, which %s does not", locale, id, defaultLocale)
+			} else if !slices.Equal(placeholders(text), placeholders(en[id])) {
+				t.Errorf("%s %s has placeholders %v, %s has %v", locale, id, placeholders(text), defaultLocale, placeholders(en[id]))
+			}
+		}
+		for id := range en {
+			if _, ok := catalogs[locale][id]; !ok {
+				t.Errorf("%s has no %s", locale, id)
+			}
+		}
+	}
+}
+
+// fill replaces the placeholders of text with values told apart by id.
+func fill(id, text string) string {
+	return placeholderPattern.ReplaceAllStringFunc(text, func(placeholder string) string {
+		return fmt.Sprintf("<%s%s>", id, placeholder[1:len(placeholder)-1])
+	})
+}
+
+func TestTranslateEveryMessage(t *testing.T) {
+	for _, locale := range supportedLocales() {
+		for id, text := range catalogs[defaultLocale] {
+			want := fill(id, catalogs[locale][id])
+			if got := translate(locale, fill(id, text)); got != want {
+				t.Errorf("translate(%s, %q) = %q, want %q", locale, fill(id, text), got, want)
+			}
+		}
+	}
+	if got := translate("fr", "Not a message of the catalog"); got != "Not a message of the catalog" {
+		t.Errorf("translate of an unknown message = %q, want it unchanged", got)
+	}
+	if got := translate("de", "Not found"); got != "Not found" {
+		t.Errorf("translate into an unsupported language = %q, want it unchanged", got)
+	}
+}
+
+func TestErrorMessagesFollowAcceptLanguage(t *testing.T) {
+	h := newTestServer(t).Handler()
+	type errorBody struct {
+		Error struct {
+			Code, Message string
+			Details       []struct{ Field, Message string }
+		}
+	}
+	post := func(body string, header ...string) (*http.Response, errorBody) {
+		t.Helper()
+		rec := send(h, http.MethodPost, "/receipts/process", body, header...)
+		var decoded errorBody
+		decodeBody(t, rec, &decoded)
+		return rec.Result(), decoded
+	}
+
+	// An item over the price limit has its field and the limit interpolated
+	// into the detail.
+	overLimit := strings.Replace(targetReceipt, `"6.49"`, `"100000.01"`, 1)
+	en, enBody := post(overLimit)
+	fr, frBody := post(overLimit, "Accept-Language", "fr-CA, en;q=0.5")
+	if en.StatusCode != fr.StatusCode || enBody.Error.Code != frBody.Error.Code || enBody.Error.Code != codeLimitExceeded {
+		t.Fatalf("errors %d %s and %d %s, want the same %s in both languages", en.StatusCode, enBody.Error.Code, fr.StatusCode, frBody.Error.Code, codeLimitExceeded)
+	}
+	if got := fr.Header.Get("Content-Language"); got != "fr" {
+		t.Errorf("Content-Language = %q, want fr", got)
+	}
+	if !slices.Contains(fr.Header.Values("Vary"), "Accept-Language") {
+		t.Errorf("Vary = %q, want Accept-Language", fr.Header.Values("Vary"))
+	}
+	if frBody.Error.Message != catalogs["fr"]["limit_exceeded"] {
+		t.Errorf("message = %q, want %q", frBody.Error.Message, catalogs["fr"]["limit_exceeded"])
+	}
+	if len(frBody.Error.Details) == 0 || len(frBody.Error.Details) != len(enBody.Error.Details) {
+		t.Fatalf("details %+v, want those of %+v", frBody.Error.Details, enBody.Error.Details)
+	}
+	for i, detail := range frBody.Error.Details {
+		if detail.Field != enBody.Error.Details[i].Field || detail.Message == enBody.Error.Details[i].Message || !strings.Contains(detail.Message, "100000.00") {
+			t.Errorf("detail %+v, want %+v in French with the limit", detail, enBody.Error.Details[i])
+		}
+	}
+
+	// Without a supported language, messages stay in English.
+	for _, accept := range []string{"de", "*", "fr;q=0"} {
+		resp, body := post(overLimit, "Accept-Language", accept)
+		if body.Error.Message != enBody.Error.Message || resp.Header.Get("Content-Language") != "en" {
+			t.Errorf("Accept-Language %q answered %q in %q, want English", accept, body.Error.Message, resp.Header.Get("Content-Language"))
+		}
+	}
+}
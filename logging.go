@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// requestIDHeader carries the ID that ties a request to its log line.
+const requestIDHeader = "X-Request-ID"
+
+// Values of the "component" attribute, naming the part of the service a log
+// entry comes from.
+const (
+	componentHTTP     = "http"
+	componentStore    = "store"
+	componentRules    = "rules"
+	componentDenylist = "denylist"
+	componentWebhook  = "webhook"
+	componentAsync    = "async"
+	componentAudit    = "audit"
+)
+
+// maxRequestIDLength bounds client-supplied request IDs so they cannot bloat
+// the logs.
+const maxRequestIDLength = 128
+
+// requestInfo is what logRequests knows about a request. Middleware further
+// down the chain fills in fields that are only known once it has run.
+type requestInfo struct {
+	id     string
+	client string // name of the API key the request authenticated with
+}
+
+type requestInfoKey struct{}
+
+// requestInfoFrom returns the requestInfo logRequests attached to ctx, or a
+// throwaway one if there is none, so callers never need to check for nil.
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		return info
+	}
+	return &requestInfo{}
+}
+
+// requestIDFrom returns the ID assigned to the request by logRequests.
+func requestIDFrom(ctx context.Context) string {
+	return requestInfoFrom(ctx).id
+}
+
+// logRequests assigns every request an ID, echoed in the X-Request-ID
+// response header, and logs one line per request once it completes. A valid
+// X-Request-ID sent by the client is used instead of generating a new one.
+func (s *Server) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		info := &requestInfo{id: id}
+		r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+
+		rec := newResponseRecorder(w)
+		next.ServeHTTP(rec, r)
+
+		// Server errors stand out at error level. Probes are polled
+		// constantly, so they are only logged at debug.
+		level := slog.LevelInfo
+		switch {
+		case rec.status >= http.StatusInternalServerError:
+			level = slog.LevelError
+		case r.URL.Path == "/healthz" || r.URL.Path == "/readyz":
+			level = slog.LevelDebug
+		}
+		attrs := []slog.Attr{
+			slog.String("component", componentHTTP),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", rec.status),
+			slog.Int64("bytes", rec.bytes),
+			slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("remote_addr", r.RemoteAddr),
+		}
+		if info.client != "" {
+			attrs = append(attrs, slog.String("client", info.client))
+		}
+		s.logger.LogAttrs(r.Context(), level, "request", attrs...)
+	})
+}
+
+// validRequestID reports whether id is a usable client-supplied request ID:
+// non-empty, not too long, and printable ASCII without spaces.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// newLogger returns a JSON logger writing to output, which is "stderr",
+// "stdout" or the path of a file to append to, starting at the named level.
+// The returned LevelVar changes the level while the logger is in use, and
+// the io.Closer closes the file, if one was opened.
+func newLogger(output, level string) (*slog.Logger, *slog.LevelVar, io.Closer, error) {
+	lvl := new(slog.LevelVar)
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid log level %q", level)
+	}
+
+	var w io.WriteCloser
+	switch strings.ToLower(output) {
+	case "stderr", "":
+		w = nopCloser{os.Stderr}
+	case "stdout":
+		w = nopCloser{os.Stdout}
+	default:
+		file, err := os.OpenFile(output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		w = file
+	}
+	handler := requestIDHandler{slog.NewJSONHandler(w, &slog.HandlerOptions{Level: lvl})}
+	return slog.New(handler), lvl, w, nil
+}
+
+// requestIDHandler adds the request ID to every entry logged with the
+// context of a request, so that entries logged deep inside a handler can be
+// tied to the request's own log line.
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := requestIDFrom(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// withLogs logs JSON to logs, at the level of the server's LevelVar, as
+// newLogger sets it up.
+func withLogs(logs *bytes.Buffer) serverOption {
+	return func(t testing.TB, s *Server) {
+		s.logger = slog.New(requestIDHandler{slog.NewJSONHandler(logs, &slog.HandlerOptions{Level: s.logLevel})})
+	}
+}
+
+// logEntries returns the entries of logs with the message msg.
+func logEntries(t *testing.T, logs *bytes.Buffer, msg string) []map[string]any {
+	t.Helper()
+	var entries []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line %q is not JSON: %v", line, err)
+		}
+		if entry["msg"] == msg {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// brokenStore is a Store whose reads of points fail.
+type brokenStore struct {
+	*memoryStore
+}
+
+func (brokenStore) GetPoints(ctx context.Context, id string) (int, error) {
+	return 0, errors.New("disk on fire")
+}
+
+func TestRequestLog(t *testing.T) {
+	var logs bytes.Buffer
+	h := newTestServer(t, withLogs(&logs)).Handler()
+
+	rec := send(h, http.MethodPost, "/receipts/process", targetReceipt, requestIDHeader, "client-chosen-id")
+	if got := rec.Header().Get(requestIDHeader); got != "client-chosen-id" {
+		t.Errorf("%s = %q, want the one sent", requestIDHeader, got)
+	}
+	entries := logEntries(t, &logs, "request")
+	if len(entries) != 1 {
+		t.Fatalf("logged %d request entries, want 1\n%s", len(entries), &logs)
+	}
+	want := map[string]any{
+		"level":      "INFO",
+		"component":  componentHTTP,
+		"method":     http.MethodPost,
+		"path":       "/receipts/process",
+		"status":     float64(http.StatusCreated),
+		"request_id": "client-chosen-id",
+	}
+	for key, value := range want {
+		if entries[0][key] != value {
+			t.Errorf("request entry %s = %v, want %v", key, entries[0][key], value)
+		}
+	}
+	for _, key := range []string{"time", "bytes", "duration_ms", "remote_addr"} {
+		if _, ok := entries[0][key]; !ok {
+			t.Errorf("request entry lacks %s: %v", key, entries[0])
+		}
+	}
+
+	// A request ID that could forge log lines is replaced.
+	rec = send(h, http.MethodGet, "/healthz", "", requestIDHeader, "two words")
+	if got := rec.Header().Get(requestIDHeader); got == "two words" || len(got) != 32 {
+		t.Errorf("%s = %q, want a generated ID", requestIDHeader, got)
+	}
+}
+
+func TestStoreErrorsAreLogged(t *testing.T) {
+	var logs bytes.Buffer
+	h := newStoreServer(t, brokenStore{newMemoryStore()}, withLogs(&logs)).Handler()
+
+	rec := send(h, http.MethodGet, "/receipts/00000000-0000-4000-8000-000000000000/points", "", requestIDHeader, "failing-request")
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("GET points from a broken store = %d, want 500", rec.Code)
+	}
+	if strings.Contains(rec.Body.String(), "disk on fire") {
+		t.Errorf("response %s reveals the store's error", rec.Body)
+	}
+	entries := logEntries(t, &logs, "store call failed")
+	if len(entries) != 1 {
+		t.Fatalf("logged %d store errors, want 1\n%s", len(entries), &logs)
+	}
+	entry := entries[0]
+	if entry["level"] != "ERROR" || entry["component"] != componentStore || entry["error"] != "disk on fire" || entry["request_id"] != "failing-request" {
+		t.Errorf("store error logged as %v, want an error from the store with the request ID", entry)
+	}
+	if requests := logEntries(t, &logs, "request"); len(requests) != 1 || requests[0]["level"] != "ERROR" {
+		t.Errorf("request entries %v, want one at error level", requests)
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	var logs bytes.Buffer
+	s := newTestServer(t, withAdmin, withLogs(&logs))
+	h := s.Handler()
+
+	rec := sendAdmin(h, http.MethodGet, "/admin/loglevel", "")
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != `{"level":"INFO"}` {
+		t.Errorf("GET /admin/loglevel = %d %s, want INFO", rec.Code, rec.Body)
+	}
+	// Probes are logged at debug, so not yet.
+	send(h, http.MethodGet, "/healthz", "")
+	if n := len(logEntries(t, &logs, "request")); n != 1 {
+		t.Errorf("logged %d requests at info, want only the GET of the level", n)
+	}
+
+	rec = sendAdmin(h, http.MethodPut, "/admin/loglevel", `{"level":"debug"}`)
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != `{"level":"DEBUG"}` {
+		t.Fatalf("PUT /admin/loglevel = %d %s, want DEBUG", rec.Code, rec.Body)
+	}
+	changes := logEntries(t, &logs, "log level changed")
+	if len(changes) != 1 || changes[0]["from"] != "INFO" || changes[0]["to"] != "DEBUG" {
+		t.Errorf("level change logged as %v, want from INFO to DEBUG", changes)
+	}
+	logs.Reset()
+	send(h, http.MethodGet, "/healthz", "")
+	if entries := logEntries(t, &logs, "request"); len(entries) != 1 || entries[0]["level"] != "DEBUG" || entries[0]["path"] != "/healthz" {
+		t.Errorf("probe logged as %v after turning on debug, want one debug entry", entries)
+	}
+
+	// Raising the level logs the change at the new level, so it is kept.
+	logs.Reset()
+	sendAdmin(h, http.MethodPut, "/admin/loglevel", `{"level":"error"}`)
+	if changes := logEntries(t, &logs, "log level changed"); len(changes) != 1 || changes[0]["level"] != "ERROR" {
+		t.Errorf("level change logged as %v, want an error entry", changes)
+	}
+
+	for _, body := range []string{`{"level":"loud"}`, `{}`, `"debug"`} {
+		rec := sendAdmin(h, http.MethodPut, "/admin/loglevel", body)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("PUT /admin/loglevel %s = %d, want 400", body, rec.Code)
+		}
+	}
+	if got := s.logLevel.Level(); got != slog.LevelError {
+		t.Errorf("level after bad requests = %v, want ERROR", got)
+	}
+}
@@ -1,143 +1,343 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
-	"math"
-	"math/rand"
+	"log/slog"
 	"net/http"
-	"strconv"
-	"strings"
-	"sync"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
 	"time"
-)
-
-// Receipt structure to hold the receipt data
-type Receipt struct {
-	Retailer     string  `json:"retailer"`
-	PurchaseDate string  `json:"purchaseDate"`
-	PurchaseTime string  `json:"purchaseTime"`
-	Items        []Item  `json:"items"`
-	Total        float64 `json:"total,string"`
-}
-
-type Item struct {
-	ShortDescription string  `json:"shortDescription"`
-	Price            float64 `json:"price,string"`
-}
 
-var (
-	receiptStore = make(map[string]Receipt)
-	scoreStore   = make(map[string]int)
-	mu           sync.Mutex
+	"github.com/y1zhuo/receipt-processor-challenge/points"
 )
 
 func main() {
-	http.HandleFunc("/receipts/process", processReceiptHandler)
-	http.HandleFunc("/receipts/", getPointsHandler)
-
-	fmt.Println("Server is running on port 8080...")
-	log.Fatal(http.ListenAndServe(":8080", nil))
-}
-
-func processReceiptHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+	if len(os.Args) > 1 && os.Args[1] == "score" {
+		os.Exit(runScore(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
 	}
-
-	var receipt Receipt
-	if err := json.NewDecoder(r.Body).Decode(&receipt); err != nil {
-		http.Error(w, "Invalid receipt format", http.StatusBadRequest)
-		return
+	if len(os.Args) > 1 && os.Args[1] == "loadtest" {
+		os.Exit(runLoadtest(os.Args[2:], os.Stdout, os.Stderr))
 	}
 
-	 // Generate a unique ID using timestamp and random number
-	 id := generateUniqueID()
-
-	mu.Lock()
-	receiptStore[id] = receipt
-	scoreStore[id] = calculatePoints(receipt)
-	mu.Unlock()
-
-	response := map[string]string{"id": id}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
-}
+	cfg, err := parseConfig(os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
 
-func generateUniqueID() string {
-    rand.Seed(time.Now().UnixNano())
-    timestamp := strconv.FormatInt(time.Now().UnixNano(), 10)
-    randomNum := strconv.Itoa(rand.Intn(10000))
-    return timestamp + randomNum
-}
+	logger, logLevel, logCloser, err := newLogger(cfg.LogOutput, cfg.LogLevel)
+	if err != nil {
+		log.Fatalf("Failed to set up logging: %v", err)
+	}
+	defer logCloser.Close()
+	// Route the standard logger through slog too, so every line is JSON.
+	slog.SetDefault(logger)
+	fatal := func(msg string, err error, component string) {
+		logger.Error(msg, slog.String("component", component), slog.Any("error", err))
+		os.Exit(1)
+	}
 
+	if cfg.RulesPath != "" {
+		config, err := points.LoadRulesConfig(cfg.RulesPath)
+		if err != nil {
+			fatal("failed to load rules", err, componentRules)
+		}
+		rules.set(config)
+	}
+	logger.Info("scoring with ruleset", slog.String("component", componentRules), slog.String("version", rules.get().Version))
 
-func calculatePoints(receipt Receipt) int {
-	points := 0
+	store, err := openStore(cfg.StoreKind, cfg.StorePath)
+	if err != nil {
+		fatal("failed to open store", err, componentStore)
+	}
 
-	// 1. One point for every alphanumeric character in the retailer name.
-	for _, char := range receipt.Retailer {
-		if (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z') || (char >= '0' && char <= '9') {
-			points++
+	server := newServer(store)
+	server.batchLimit = cfg.BatchLimit
+	server.workers = cfg.ScoreWorkers
+	server.maxBodyBytes = cfg.MaxBodyBytes
+	server.maxBatchBody = cfg.MaxBatchBytes
+	server.maxImageSize = cfg.MaxImageBytes
+	if cfg.ImageDir != "" {
+		if server.images, err = openFileBlobStore(cfg.ImageDir); err != nil {
+			fatal("failed to open image directory", err, componentStore)
 		}
 	}
-
-	// 2. 50 points if the total is a round dollar amount with no cents.
-	if receipt.Total == float64(int(receipt.Total)) {
-		points += 50
+	server.features = newFeatureSwitch(cfg.Features, cfg.featureSources)
+	// parseConfig has checked that the timezone loads.
+	server.dates.Location, _ = time.LoadLocation(cfg.Timezone)
+	server.dates.MaxAgeDays = cfg.MaxReceiptAge
+	// parseConfig has checked that the amount parses.
+	maxAmount, _ := points.Money(cfg.MaxAmount).Cents()
+	server.limits = points.Limits{MaxItems: cfg.MaxItems, MaxAmount: maxAmount, MaxDescriptionLength: cfg.MaxDescription}
+	if server.inputFormats, err = parseInputFormats(cfg.InputFormats); err != nil {
+		fatal("invalid -input-formats", err, componentHTTP)
+	}
+	server.inputFormats.Location = server.dates.Location
+	server.async = newAsyncQueue(cfg.AsyncQueue, cfg.AsyncWorkers)
+	server.pointsMaxAge = cfg.PointsMaxAge
+	server.expiry = pointsExpiry{months: cfg.PointsExpiry, rejectUndated: cfg.ExpiryUndated == "reject"}
+	server.rulesPath = cfg.RulesPath
+	server.keepDeleted = cfg.DeleteRetention
+	server.requestTimeout = cfg.RequestTimeout
+	server.idempotency.ttl = cfg.IdempotencyTTL
+	server.adminToken = cfg.AdminToken
+	if server.apiKeys, err = loadAPIKeys(cfg.APIKeys, cfg.APIKeysFile); err != nil {
+		fatal("failed to load API keys", err, componentHTTP)
+	}
+	if cfg.Features.IsolateTenants && len(server.apiKeys) == 0 {
+		fatal("invalid -isolate-tenants", errors.New("no API keys were loaded"), componentHTTP)
+	}
+	if cfg.Quota != "" || slices.ContainsFunc(server.apiKeys, func(k apiKey) bool { return k.quota != nil }) {
+		// parseConfig has checked the default quota and the time zone.
+		var fallback keyQuota
+		if cfg.Quota != "" {
+			fallback, _ = parseQuota(cfg.Quota)
+		}
+		location, _ := time.LoadLocation(cfg.QuotaTimezone)
+		if server.quotas, err = newQuotaTracker(server.apiKeys, fallback, location, openQuotaSink(store), logger); err != nil {
+			fatal("failed to set up API key quotas", err, componentHTTP)
+		}
+	}
+	if server.authRules, err = parseAuthRules(cfg.AuthRoutes); err != nil {
+		fatal("invalid -auth-routes", err, componentHTTP)
+	}
+	if cfg.RateLimit > 0 {
+		server.rateLimiter = newRateLimiter(cfg.RateLimit, cfg.RateBurst)
+	}
+	if cfg.CORSOrigins != "" {
+		if server.cors, err = newCORSPolicy(cfg.CORSOrigins, cfg.CORSMethods, cfg.CORSHeaders, cfg.CORSMaxAge, cfg.CORSCredentials); err != nil {
+			fatal("invalid CORS settings", err, componentHTTP)
+		}
+	}
+	if cfg.WebhookURLs != "" {
+		urls, err := parseWebhookURLs(cfg.WebhookURLs)
+		if err != nil {
+			fatal("invalid -webhook-urls", err, componentWebhook)
+		}
+		server.webhooks = newWebhookNotifier(urls, cfg.WebhookSecret)
+		server.webhooks.onFailure = server.metrics.observeWebhookFailure
+		server.webhooks.outbox = openWebhookOutbox(store)
+		server.webhooks.retention = cfg.WebhookRetain
+	}
+	if server.idgen, err = newIDGenerator(cfg.IDFormat); err != nil {
+		fatal("invalid -id-format", err, componentHTTP)
+	}
+	server.anomalies = newAnomalyTracker(cfg.AnomalyWindow, cfg.AnomalyRatio)
+	server.metrics.watchAnomalies(server.anomalies)
+	if cfg.IDSecret != "" {
+		server.ids = newIDSigner(cfg.IDSecret, cfg.IDPrevSecret)
+	}
+	server.logger = logger
+	server.logLevel = logLevel
+	memory, _ := store.(*memoryStore)
+	if memory != nil {
+		memory.maxReceipts, memory.ttl = cfg.MaxReceipts, cfg.ReceiptTTL
+		memory.compactAfter = cfg.CompactAfter
+		memory.onEvict = server.receiptEvicted
+	}
+	if cfg.Features.Index {
+		switch store := store.(type) {
+		case *memoryStore:
+			store.indexItems()
+		case *fileStore:
+			store.indexItems()
+		}
+	}
+	if cfg.SnapshotPath != "" {
+		server.snapshots = newSnapshotter(memory, cfg.SnapshotPath, cfg.SnapshotEvery)
+		server.snapshots.logger = logger
+		server.metrics.watchSnapshots(server.snapshots)
+		loaded, err := server.snapshots.load()
+		if err != nil {
+			fatal("failed to load snapshot", err, componentStore)
+		}
+		logger.Info("loaded snapshot", slog.String("component", componentStore), slog.String("path", cfg.SnapshotPath), slog.Int("receipts", loaded))
+	}
+	if cfg.Features.NormalizeRetailers || cfg.RetailerAliases != "" {
+		if server.names, err = loadRetailerNames(cfg.RetailerAliases); err != nil {
+			fatal("failed to load retailer aliases", err, componentStore)
+		}
+		server.retailers.names = server.names
+	}
+	if cfg.DenylistPath != "" {
+		if server.denylist, err = loadDenylist(cfg.DenylistPath); err != nil {
+			fatal("failed to load denylist", err, componentDenylist)
+		}
+	}
+	if err := server.retailers.load(store); err != nil {
+		fatal("failed to build retailer index", err, componentStore)
+	}
+	if cfg.DailyCap > 0 {
+		server.caps = newDailyCaps(cfg.DailyCap)
+		if err := server.caps.load(store); err != nil {
+			fatal("failed to count points toward daily caps", err, componentStore)
+		}
+	}
+	if cfg.Features.Dedup {
+		if server.dedup, err = newDedupIndex(store, cfg.Features.DedupIgnoreItemOrder); err != nil {
+			fatal("failed to build deduplication index", err, componentStore)
+		}
+	}
+	if cfg.Features.Audit {
+		sink, err := openAuditSink(store)
+		if err != nil {
+			fatal("failed to open audit log", err, componentAudit)
+		}
+		server.audit = newAuditLog(sink)
+		server.metrics.watchAudit(server.audit)
 	}
 
-	// 3. 25 points if the total is a multiple of 0.25.
-	if math.Mod(receipt.Total, 0.25) == 0 {
-		points += 25
+	httpServer := &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           server.Handler(),
+		ReadHeaderTimeout: cfg.ReadTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
 	}
 
-	// 4. 5 points for every two items on the receipt.
-	points += (len(receipt.Items) / 2) * 5
+	redirectServer, err := setupTLS(cfg, httpServer)
+	if err != nil {
+		fatal("failed to set up TLS", err, componentHTTP)
+	}
+	servers := []listener{httpListener{httpServer}}
+	if redirectServer != nil {
+		servers = append(servers, httpListener{redirectServer})
+	}
+	if cfg.GRPCAddr != "" {
+		servers = append(servers, grpcListener{addr: cfg.GRPCAddr, server: server.newGRPCServer()})
+	}
+	if cfg.Debug {
+		servers = append(servers, httpListener{server.newDebugServer(cfg.DebugAddr, cfg.ReadTimeout)})
+	}
 
-	// 5. If the trimmed length of the item description is a multiple of 3, multiply the price by 0.2 and round up to the nearest integer.
-	for _, item := range receipt.Items {
-		descLength := len(strings.TrimSpace(item.ShortDescription))
-		if descLength%3 == 0 {
-			points += int(math.Ceil(item.Price * 0.2))
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	server.Start(ctx)
+	if server.rulesPath != "" || server.denylist != nil {
+		go server.reloadOnHangup(ctx)
+	}
+	if memory != nil && (memory.ttl > 0 || memory.compactAfter > 0) {
+		interval := time.Minute
+		for _, d := range []time.Duration{memory.ttl, memory.compactAfter} {
+			if d > 0 {
+				interval = min(interval, d)
+			}
 		}
+		go memory.run(ctx, interval)
 	}
-
-	// 6. 6 points if the day in the purchase date is odd.
-	if day, err := strconv.Atoi(strings.Split(receipt.PurchaseDate, "-")[2]); err == nil && day%2 != 0 {
-		points += 6
+	if server.snapshots != nil {
+		go server.snapshots.run(ctx)
 	}
 
-	// 7. 10 points if the time of purchase is after 2:00pm and before 4:00pm.
-	if purchaseTime, err := time.Parse("15:04", receipt.PurchaseTime); err == nil {
-		if purchaseTime.After(time.Date(0, 1, 1, 14, 0, 0, 0, time.UTC)) && purchaseTime.Before(time.Date(0, 1, 1, 16, 0, 0, 0, time.UTC)) {
-			points += 10
+	logger.Info("server starting", slog.String("component", componentHTTP),
+		slog.String("addr", cfg.Addr), slog.String("grpc_addr", cfg.GRPCAddr), slog.Bool("debug", cfg.Debug), slog.Any("config", cfg))
+	err = serve(ctx, cfg.ShutdownTimeout, servers...)
+	drainCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	if drainErr := server.Drain(drainCtx); drainErr != nil {
+		logger.Error("gave up waiting for queued receipts to be stored", slog.String("component", componentAsync), slog.Any("error", drainErr))
+	}
+	if server.audit != nil {
+		// After the queued receipts, whose entries are recorded as
+		// they are stored.
+		if auditErr := server.audit.close(drainCtx); auditErr != nil {
+			logger.Error("failed to write audit log", slog.String("component", componentAudit), slog.Any("error", auditErr))
 		}
 	}
+	cancel()
+	if server.snapshots != nil {
+		if snapshotErr := server.snapshots.save(); snapshotErr != nil {
+			logger.Error("failed to write final snapshot", slog.String("component", componentStore), slog.Any("error", snapshotErr))
+		}
+	}
+	if closeErr := store.Close(); closeErr != nil {
+		logger.Error("failed to close store", slog.String("component", componentStore), slog.Any("error", closeErr))
+	}
+	if err != nil {
+		fatal("server failed", err, componentHTTP)
+	}
+	logger.Info("server stopped", slog.String("component", componentHTTP))
+}
 
-	return points
+// listener is a server run by serve.
+type listener interface {
+	// serve accepts connections until the server fails or is shut down.
+	serve() error
+	// shutdown stops the server, giving in-flight requests until ctx is
+	// done to complete.
+	shutdown(ctx context.Context) error
 }
 
-func getPointsHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// httpListener runs an HTTP server, serving HTTPS if it has a TLSConfig.
+type httpListener struct {
+	*http.Server
+}
+
+func (l httpListener) serve() error {
+	if l.TLSConfig != nil {
+		return l.ListenAndServeTLS("", "")
 	}
+	return l.ListenAndServe()
+}
+
+func (l httpListener) shutdown(ctx context.Context) error {
+	return l.Shutdown(ctx)
+}
 
-	id := r.URL.Path[len("/receipts/"):len(r.URL.Path)-len("/points")]
+// serve runs servers until ctx is canceled or one of them fails, then shuts
+// them all down, giving in-flight requests up to timeout to complete.
+func serve(ctx context.Context, timeout time.Duration, servers ...listener) error {
+	errc := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func() { errc <- srv.serve() }()
+	}
 
-	mu.Lock()
-	points, exists := scoreStore[id]
-	mu.Unlock()
+	var err error
+	running := len(servers)
+	select {
+	case err = <-errc:
+		running--
+	case <-ctx.Done():
+	}
 
-	if !exists {
-		http.Error(w, "Receipt not found", http.StatusNotFound)
-		return
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	shutdownErrs := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func() { shutdownErrs <- srv.shutdown(shutdownCtx) }()
+	}
+	for range servers {
+		if shutdownErr := <-shutdownErrs; shutdownErr != nil && err == nil {
+			err = fmt.Errorf("shutting down: %w", shutdownErr)
+		}
 	}
+	for range running {
+		// A gRPC server returns nil once stopped.
+		if serveErr := <-errc; err == nil && serveErr != nil && !errors.Is(serveErr, http.ErrServerClosed) {
+			err = serveErr
+		}
+	}
+	return err
+}
 
-	response := map[string]int{"points": points}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+// openStore creates the Store selected by the -store flag.
+func openStore(kind, path string) (Store, error) {
+	switch kind {
+	case "memory":
+		return newMemoryStore(), nil
+	case "file":
+		return openFileStore(path)
+	case "sqlite":
+		return openSQLiteStore(path)
+	default:
+		return nil, fmt.Errorf("unknown store %q", kind)
+	}
 }
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// freeAddr returns a local address nothing is listening on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// TestServeDrainsOnSignal starts serving, begins a request the handler holds
+// open, sends the process SIGTERM, and checks the request still completes
+// before serve returns.
+func TestServeDrainsOnSignal(t *testing.T) {
+	server := newTestServer(t)
+	started, release := make(chan struct{}), make(chan struct{})
+	shuttingDown := make(chan struct{})
+	httpServer := &http.Server{
+		Addr: freeAddr(t),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+			server.Handler().ServeHTTP(w, r)
+		}),
+	}
+	httpServer.RegisterOnShutdown(func() { close(shuttingDown) })
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	served := make(chan error, 1)
+	go func() { served <- serve(ctx, 10*time.Second, httpListener{httpServer}) }()
+
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		url := "http://" + httpServer.Addr + "/receipts/process"
+		for {
+			resp, err := http.Post(url, "application/json", strings.NewReader(targetReceipt))
+			if err != nil && ctx.Err() == nil && strings.Contains(err.Error(), "connection refused") {
+				// Not listening yet.
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			results <- result{resp, err}
+			return
+		}
+	}()
+
+	<-started
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-shuttingDown:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server was not shut down on SIGTERM")
+	}
+	select {
+	case err := <-served:
+		t.Fatalf("serve returned %v before the request in flight completed", err)
+	default:
+	}
+
+	close(release)
+	res := <-results
+	if res.err != nil {
+		t.Fatalf("request in flight failed: %v", res.err)
+	}
+	res.resp.Body.Close()
+	if res.resp.StatusCode != http.StatusCreated {
+		t.Errorf("request in flight = %d, want 201", res.resp.StatusCode)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("serve = %v, want nil", err)
+	}
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+// metrics holds the Prometheus metrics exported at /metrics.
+type metrics struct {
+	requests           *counterVec
+	requestDuration    *histogramVec
+	receiptsProcessed  *counterVec
+	validationFailures *counterVec
+	flaggedDates       *counterVec
+	awardedPoints      *histogramVec
+	storedReceipts     *gaugeFunc
+	evictedReceipts    *counterVec
+	webhookFailures    *counterVec
+	buildInfo          *infoGauge
+
+	collectors []collector
+}
+
+func newMetrics(store Store) *metrics {
+	m := &metrics{
+		requests: newCounterVec("receipt_processor_http_requests_total",
+			"HTTP requests by route, method and status code.", "handler", "method", "status"),
+		requestDuration: newHistogramVec("receipt_processor_http_request_duration_seconds",
+			"HTTP request latency by route.", []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5}, "handler"),
+		receiptsProcessed: newCounterVec("receipt_processor_receipts_processed_total",
+			"Receipts successfully validated, scored and stored."),
+		validationFailures: newCounterVec("receipt_processor_validation_failures_total",
+			"Receipt validation failures by field.", "field"),
+		flaggedDates: newCounterVec("receipt_processor_flagged_dates_total",
+			"Receipts scored with a warning for being dated outside the accepted range, by field.", "field"),
+		awardedPoints: newHistogramVec("receipt_processor_awarded_points",
+			"Points awarded per processed receipt.", []float64{10, 25, 50, 75, 100, 150, 200, 500}),
+		storedReceipts: newGaugeFunc("receipt_processor_stored_receipts",
+			"Number of receipts currently held by the store.", func() float64 {
+				ids, err := store.List(context.Background())
+				if err != nil {
+					return math.NaN()
+				}
+				return float64(len(ids))
+			}),
+		evictedReceipts: newCounterVec("receipt_processor_receipts_evicted_total",
+			"Receipts evicted from the memory store, by reason (capacity or expired).", "reason"),
+		webhookFailures: newCounterVec("receipt_processor_webhook_failures_total",
+			"Webhook deliveries given up on, after retries or because the queue was full."),
+		buildInfo: newInfoGauge("receipt_processor_build_info",
+			"Always 1, labelled with the running build and ruleset.", func() []string {
+				current := rules.get()
+				return []string{
+					"version", build.Version,
+					"revision", build.Revision,
+					"goversion", build.GoVersion,
+					"rules_version", current.Version,
+					"rules_hash", current.Hash(),
+				}
+			}),
+	}
+	m.collectors = []collector{m.requests, m.requestDuration, m.receiptsProcessed, m.validationFailures, m.flaggedDates, m.awardedPoints, m.storedReceipts, m.evictedReceipts, m.webhookFailures, m.buildInfo}
+	return m
+}
+
+// itemIndexPattern matches the index in field names like "items[3].price".
+var itemIndexPattern = regexp.MustCompile(`\[\d+\]`)
+
+// observeValidation counts each failing field, folding item indexes together
+// so the label set stays small.
+func (m *metrics) observeValidation(errs []points.FieldError) {
+	for _, err := range errs {
+		m.validationFailures.inc(itemIndexPattern.ReplaceAllString(err.Field, "[]"))
+	}
+}
+
+func (m *metrics) observeDateFlagged(field string) {
+	m.flaggedDates.inc(field)
+}
+
+func (m *metrics) observeProcessed(breakdown points.Breakdown) {
+	m.receiptsProcessed.inc()
+	m.awardedPoints.observe(float64(breakdown.Total))
+}
+
+func (m *metrics) observeEviction(reason string) {
+	m.evictedReceipts.inc(reason)
+}
+
+func (m *metrics) observeWebhookFailure() {
+	m.webhookFailures.inc()
+}
+
+// watchAudit adds a metric counting the audit entries a drops.
+func (m *metrics) watchAudit(a *auditLog) {
+	dropped := newCounterVec("receipt_processor_audit_entries_dropped_total",
+		"Audit entries dropped because the queue to write them was full, or writing them failed.")
+	a.onDrop = func() { dropped.inc() }
+	m.collectors = append(m.collectors, dropped)
+}
+
+// watchSnapshots adds metrics describing the snapshots p writes.
+func (m *metrics) watchSnapshots(p *snapshotter) {
+	failures := newCounterVec("receipt_processor_snapshot_failures_total",
+		"Snapshots of the memory store that failed to be written.")
+	p.onFailure = func() { failures.inc() }
+	m.collectors = append(m.collectors,
+		newGaugeFunc("receipt_processor_snapshot_last_success_timestamp_seconds",
+			"Unix time the last snapshot of the memory store was written, or 0 if none has been.", func() float64 {
+				status := p.status()
+				if status.LastAt == nil {
+					return 0
+				}
+				return float64(status.LastAt.UnixNano()) / 1e9
+			}),
+		newGaugeFunc("receipt_processor_snapshot_duration_seconds",
+			"How long the last snapshot of the memory store took to write.", func() float64 {
+				return p.status().DurationSeconds
+			}),
+		failures)
+}
+
+// watchAnomalies adds metrics of the rule fire rates t tracks, so that
+// alerts can fire on the anomalies it flags.
+func (m *metrics) watchAnomalies(t *anomalyTracker) {
+	rules := func(value func(ruleAnomaly) float64) func() map[string]float64 {
+		return func() map[string]float64 {
+			values := make(map[string]float64)
+			for _, rule := range t.report().Rules {
+				values[rule.Rule] = value(rule)
+			}
+			return values
+		}
+	}
+	m.collectors = append(m.collectors,
+		newGaugeVecFunc("receipt_processor_rule_fire_rate",
+			"Share of the receipts stored in the last complete minute that each rule awarded points to.", "rule",
+			rules(func(rule ruleAnomaly) float64 { return rule.Rate })),
+		newGaugeVecFunc("receipt_processor_rule_fire_rate_baseline",
+			"Share of the receipts stored in the anomaly window before the last complete minute that each rule awarded points to.", "rule",
+			rules(func(rule ruleAnomaly) float64 { return rule.BaselineRate })),
+		newGaugeVecFunc("receipt_processor_rule_anomaly",
+			"1 if the fire rate of the rule in the last complete minute is flagged as anomalous against its baseline, else 0.", "rule",
+			rules(func(rule ruleAnomaly) float64 {
+				if rule.Anomalous {
+					return 1
+				}
+				return 0
+			})))
+}
+
+// instrument records request counts and latency for every request served by
+// mux, labelled with the matched route pattern.
+func (m *metrics) instrument(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		if pattern == "" {
+			pattern = "unmatched"
+		}
+
+		start := time.Now()
+		rec := newResponseRecorder(w)
+		next.ServeHTTP(rec, r)
+
+		m.requests.inc(pattern, r.Method, strconv.Itoa(rec.status))
+		m.requestDuration.observe(time.Since(start).Seconds(), pattern)
+	})
+}
+
+// ServeHTTP writes all metrics in the Prometheus text exposition format.
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	for _, c := range m.collectors {
+		c.collect(bw)
+	}
+	bw.Flush()
+}
+
+// collector is a metric family that can write itself in exposition format.
+type collector interface {
+	collect(w io.Writer)
+}
+
+// labelSet keys a vector's series by their label values.
+type labelSet struct {
+	names []string
+}
+
+func (ls labelSet) key(values []string) string {
+	if len(values) != len(ls.names) {
+		panic(fmt.Sprintf("metrics: got %d label values for %d labels", len(values), len(ls.names)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// format renders the labels for key, plus any extra name/value pairs.
+func (ls labelSet) format(key string, extra ...string) string {
+	var pairs []string
+	if len(ls.names) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			pairs = append(pairs, ls.names[i]+`="`+escapeLabel(value)+`"`)
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escapeLabel(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// counterVec is a counter partitioned by labels.
+type counterVec struct {
+	name, help string
+	labels     labelSet
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labelSet{labels}, values: make(map[string]float64)}
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	c.add(1, labelValues...)
+}
+
+func (c *counterVec) add(v float64, labelValues ...string) {
+	key := c.labels.key(labelValues)
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+func (c *counterVec) collect(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	writeHeader(w, c.name, c.help, "counter")
+	if len(c.labels.names) == 0 && len(c.values) == 0 {
+		fmt.Fprintf(w, "%s 0\n", c.name)
+	}
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labels.format(key), formatValue(c.values[key]))
+	}
+}
+
+// histogramVec is a histogram partitioned by labels.
+type histogramVec struct {
+	name, help string
+	labels     labelSet
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labelSet{labels}, buckets: buckets, series: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	key := h.labels.key(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := h.series[key]
+	if s == nil {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *histogramVec) collect(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	writeHeader(w, h.name, h.help, "histogram")
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labels.format(key, "le", formatValue(upper)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labels.format(key, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labels.format(key), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labels.format(key), s.count)
+	}
+}
+
+// gaugeFunc is an unlabelled gauge whose value is computed at scrape time.
+type gaugeFunc struct {
+	name, help string
+	value      func() float64
+}
+
+func newGaugeFunc(name, help string, value func() float64) *gaugeFunc {
+	return &gaugeFunc{name: name, help: help, value: value}
+}
+
+func (g *gaugeFunc) collect(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatValue(g.value()))
+}
+
+// gaugeVecFunc is a gauge with one label, whose series and values are
+// computed at scrape time.
+type gaugeVecFunc struct {
+	name, help string
+	label      string
+	values     func() map[string]float64
+}
+
+func newGaugeVecFunc(name, help, label string, values func() map[string]float64) *gaugeVecFunc {
+	return &gaugeVecFunc{name: name, help: help, label: label, values: values}
+}
+
+func (g *gaugeVecFunc) collect(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	values := g.values()
+	labels := labelSet{[]string{g.label}}
+	for _, key := range sortedKeys(values) {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, labels.format(key), formatValue(values[key]))
+	}
+}
+
+// infoGauge is a gauge that is always 1, carrying information in its
+// labels. The labels are name/value pairs computed at scrape time.
+type infoGauge struct {
+	name, help string
+	labels     func() []string
+}
+
+func newInfoGauge(name, help string, labels func() []string) *infoGauge {
+	return &infoGauge{name: name, help: help, labels: labels}
+}
+
+func (g *infoGauge) collect(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s%s 1\n", g.name, labelSet{}.format("", g.labels()...))
+}
+
+// responseRecorder wraps a ResponseWriter to remember the status code and
+// the number of body bytes written.
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func newResponseRecorder(w http.ResponseWriter) *responseRecorder {
+	return &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status, rec.wroteHeader = status, true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	rec.wroteHeader = true
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scrape returns the samples h serves at /metrics, keyed by series: the
+// metric name and its labels, as written.
+func scrape(t testing.TB, h http.Handler) map[string]float64 {
+	t.Helper()
+	rec := send(h, http.MethodGet, "/metrics", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /metrics = %d %s, want 200", rec.Code, rec.Body)
+	}
+	samples := make(map[string]float64)
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if i < 0 || err != nil {
+			t.Fatalf("metrics line %q has no value", line)
+		}
+		samples[line[:i]] = value
+	}
+	return samples
+}
+
+// TestMetricsCountRequests scrapes /metrics, processes a receipt, and
+// checks that the second scrape counts it.
+func TestMetricsCountRequests(t *testing.T) {
+	h := newTestServer(t).Handler()
+	processed := `receipt_processor_http_requests_total{handler="POST /receipts/process",method="POST",status="201"}`
+	invalid := `receipt_processor_validation_failures_total{field="items[].price"}`
+
+	before := scrape(t, h)
+	processReceipt(t, h, targetReceipt)
+	send(h, http.MethodPost, "/receipts/process", strings.Replace(targetReceipt, `"6.49"`, `"6.4"`, 1))
+	after := scrape(t, h)
+
+	for _, tt := range []struct {
+		series string
+		rise   float64
+	}{
+		{processed, 1},
+		{"receipt_processor_receipts_processed_total", 1},
+		{"receipt_processor_stored_receipts", 1},
+		{"receipt_processor_awarded_points_count", 1},
+		{"receipt_processor_awarded_points_sum", 28},
+		{invalid, 1},
+		// The first scrape counts itself once it is done.
+		{`receipt_processor_http_requests_total{handler="GET /metrics",method="GET",status="200"}`, 1},
+	} {
+		if got := after[tt.series] - before[tt.series]; got != tt.rise {
+			t.Errorf("%s rose by %g, from %g to %g, want %g", tt.series, got, before[tt.series], after[tt.series], tt.rise)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ndjsonFlushInterval is how often the results of POST
+// /receipts/process/stream written so far are sent, when fewer than fill
+// the write buffer.
+const ndjsonFlushInterval = 250 * time.Millisecond
+
+// ndjsonLine is a line of an NDJSON upload, numbered from 1, or the reason it
+// could not be read.
+type ndjsonLine struct {
+	number int
+	data   []byte
+	err    *apiError
+}
+
+// processStreamHandler handles POST /receipts/process/stream, for uploads too
+// large to send as a batch. The body is application/x-ndjson, one receipt per
+// line, and the response has one result line per receipt line, in the same
+// order, written while the upload is still being read. Lines are scored on
+// s.workers goroutines and stored in order, as in a batch, and only those
+// being worked on are held in memory, so there is no limit on how many lines
+// an upload has; each line is held to the -max-body-bytes limit instead.
+// Blank lines are skipped. A line that is not a valid receipt, or is too
+// long, gets an error result and the rest of the upload carries on.
+func (s *Server) processStreamHandler(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/x-ndjson" {
+		writeError(w, http.StatusUnsupportedMediaType, codeUnsupportedMediaType,
+			"Content-Type must be application/x-ndjson")
+		return
+	}
+
+	ctx := r.Context()
+	strict := s.strictTotalsFor(r)
+	rc := http.NewResponseController(w)
+	// Results are written before the upload has been read, and an upload
+	// may take far longer than the server's read and write timeouts.
+	rc.EnableFullDuplex()
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	// Results are buffered, and the buffer is sent every
+	// ndjsonFlushInterval, so that neither each result is a write of its
+	// own nor a slow upload leaves the client waiting for its results.
+	var mu sync.Mutex
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	write := func(line int, result batchResult) {
+		if result.Error != nil {
+			result.Error = result.Error.in(responseLocale(w))
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		enc.Encode(lineResult{Line: line, ID: result.ID, Duplicate: result.Duplicate, Cap: result.Cap, Error: result.Error})
+	}
+	flush := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if bw.Flush() == nil {
+			rc.Flush()
+		}
+	}
+	stopFlushing := make(chan struct{})
+	flusherDone := make(chan struct{})
+	go func() {
+		defer close(flusherDone)
+		ticker := time.NewTicker(ndjsonFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopFlushing:
+				return
+			case <-ticker.C:
+				flush()
+			}
+		}
+	}()
+
+	reader := bufio.NewReaderSize(r.Body, int(s.maxBodyBytes))
+	number := 0
+	var readErr error
+	next := func() (ndjsonLine, bool) {
+		for readErr == nil {
+			data, tooLong, err := readLine(reader)
+			if err != nil {
+				readErr = err
+				break
+			}
+			number++
+			if tooLong {
+				return ndjsonLine{number: number, err: newAPIError(http.StatusRequestEntityTooLarge, codeBodyTooLarge,
+					fmt.Sprintf("Line exceeds the limit of %d bytes", s.maxBodyBytes))}, true
+			}
+			if data = bytes.TrimSpace(data); len(data) > 0 {
+				// The reader reuses its buffer for the next line.
+				return ndjsonLine{number: number, data: bytes.Clone(data)}, true
+			}
+		}
+		return ndjsonLine{}, false
+	}
+
+	err = runOrdered(ctx, s.workers, next,
+		func(in ndjsonLine) scoredReceipt {
+			if in.err != nil {
+				return scoredReceipt{err: in.err}
+			}
+			return s.scoreBatchItem(in.data, strict)
+		},
+		func(in ndjsonLine, v any) scoredReceipt { return scoredReceipt{err: s.scoringPanic(ctx, v)} },
+		func(in ndjsonLine, scored scoredReceipt) bool {
+			write(in.number, s.storeBatchItem(ctx, scored))
+			return true
+		})
+	switch {
+	case err != nil:
+		// The client has gone, so there is no one to tell.
+		s.logger.WarnContext(ctx, "receipt stream stopped", slog.String("component", componentHTTP),
+			slog.Int("lines", number), slog.Any("error", err))
+	case !errors.Is(readErr, io.EOF):
+		// The line that could not be read is reported as rejected, so
+		// that the client knows where the upload was cut short.
+		write(number+1, batchResult{Error: bodyReadError(readErr, "The request body could not be read")})
+	}
+	close(stopFlushing)
+	<-flusherDone
+	flush()
+}
+
+// readLine reads the next line of r, line ending included. A line longer
+// than r's buffer is skipped, and reported as tooLong in its place. err is
+// io.EOF once r is used up; a last line without a line ending is still
+// returned first.
+func readLine(r *bufio.Reader) (line []byte, tooLong bool, err error) {
+	line, err = r.ReadSlice('\n')
+	for errors.Is(err, bufio.ErrBufferFull) {
+		tooLong, line = true, nil
+		_, err = r.ReadSlice('\n')
+	}
+	if errors.Is(err, io.EOF) && (len(line) > 0 || tooLong) {
+		err = nil
+	}
+	return line, tooLong, err
+}
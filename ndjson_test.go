@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// ndjsonUpload is an NDJSON body of lines receipts, made up as it is read so
+// that the upload itself takes no memory. Every badEvery-th line is not
+// valid JSON.
+type ndjsonUpload struct {
+	receipt  []byte
+	lines    int
+	badEvery int
+	sent     int
+	pending  []byte
+}
+
+func (u *ndjsonUpload) Read(p []byte) (int, error) {
+	if len(u.pending) == 0 {
+		if u.sent == u.lines {
+			return 0, io.EOF
+		}
+		u.sent++
+		if u.sent%u.badEvery == 0 {
+			u.pending = []byte("{\"retailer\":\n")
+		} else {
+			u.pending = u.receipt
+		}
+	}
+	n := copy(p, u.pending)
+	u.pending = u.pending[n:]
+	return n, nil
+}
+
+// ndjsonResults is a response writer checking, as they are written, that
+// the results of an ndjsonUpload are for its lines in order, without holding
+// on to them.
+type ndjsonResults struct {
+	badEvery int
+	header   http.Header
+	partial  []byte
+	prefix   []byte
+	lines    int
+	err      string
+}
+
+func (r *ndjsonResults) Header() http.Header { return r.header }
+
+func (r *ndjsonResults) WriteHeader(int) {}
+
+func (r *ndjsonResults) Flush() {}
+
+func (r *ndjsonResults) Write(p []byte) (int, error) {
+	r.partial = append(r.partial, p...)
+	for {
+		end := bytes.IndexByte(r.partial, '\n')
+		if end < 0 {
+			break
+		}
+		r.check(r.partial[:end])
+		r.partial = r.partial[end+1:]
+	}
+	// Move what is left of a line to the front, so that the buffer does
+	// not grow with the response.
+	r.partial = append(r.partial[:0:0], r.partial...)
+	return len(p), nil
+}
+
+func (r *ndjsonResults) check(result []byte) {
+	if r.err != "" {
+		return
+	}
+	r.lines++
+	r.prefix = strconv.AppendInt(append(r.prefix[:0], `{"line":`...), int64(r.lines), 10)
+	want := `,"id":"`
+	if r.lines%r.badEvery == 0 {
+		want = `,"error":{"code":"invalid_body"`
+	}
+	if !bytes.HasPrefix(result, r.prefix) || !bytes.HasPrefix(result[len(r.prefix):], []byte(want)) {
+		r.err = "result " + strconv.Itoa(r.lines) + " is " + string(result)
+	}
+}
+
+// streamLines posts an upload of lines receipts to s and checks the
+// results.
+func streamLines(t testing.TB, s *Server, receipt []byte, lines int) {
+	t.Helper()
+	const badEvery = 97
+	req := httptest.NewRequest(http.MethodPost, "/receipts/process/stream", &ndjsonUpload{receipt: receipt, lines: lines, badEvery: badEvery})
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	results := &ndjsonResults{badEvery: badEvery, header: http.Header{}}
+	s.processStreamHandler(results, req)
+	if results.err == "" && results.lines != lines {
+		results.err = strconv.Itoa(results.lines) + " results"
+	}
+	if results.err != "" {
+		t.Fatalf("streaming %d lines: %s", lines, results.err)
+	}
+}
+
+// TestProcessStream checks that 10,000 lines come back as results in the
+// order they were sent, and that the allocations per line do not grow with
+// the size of the upload.
+func TestProcessStream(t *testing.T) {
+	var receipt bytes.Buffer
+	if err := json.Compact(&receipt, []byte(targetReceipt)); err != nil {
+		t.Fatal(err)
+	}
+	receipt.WriteByte('\n')
+	s := newTestServer(t)
+	perLine := func(lines int) float64 {
+		return testing.AllocsPerRun(2, func() { streamLines(t, s, receipt.Bytes(), lines) }) / float64(lines)
+	}
+
+	small, large := perLine(1000), perLine(10000)
+	t.Logf("allocations per line: %.1f for 1,000 lines, %.1f for 10,000", small, large)
+	if large > small*1.1 {
+		t.Errorf("allocations per line = %.1f for 10,000 lines, %.1f for 1,000, want no more", large, small)
+	}
+}
+
+func TestProcessStreamCanceled(t *testing.T) {
+	s := newTestServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	body, upload := io.Pipe()
+	req := httptest.NewRequest(http.MethodPost, "/receipts/process/stream", body).WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Handler().ServeHTTP(rec, req)
+	}()
+
+	line := strings.ReplaceAll(targetReceipt, "\n", "") + "\n"
+	for range 3 {
+		io.WriteString(upload, line)
+	}
+	waitFor(t, "the first lines to be stored", func() bool {
+		ids, _ := s.store.List(context.Background())
+		return len(ids) == 3
+	})
+	cancel()
+	// The handler stops reading once the request is canceled, while the
+	// upload is still open.
+	go io.WriteString(upload, line)
+	<-done
+	upload.Close()
+	if got := strings.Count(rec.Body.String(), "\n"); got > 4 {
+		t.Errorf("response to a canceled upload has %d results, want at most 4", got)
+	}
+}
+
+func TestProcessStreamFieldPointers(t *testing.T) {
+	h := newTestServer(t).Handler()
+	var upload strings.Builder
+	for _, receipt := range []string{targetReceipt, invalidItemsReceipt} {
+		upload.WriteString(strings.ReplaceAll(receipt, "\n", "") + "\n")
+	}
+	rec := send(h, http.MethodPost, "/receipts/process/stream", upload.String(), "Content-Type", "application/x-ndjson")
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	if rec.Code != http.StatusOK || len(lines) != 2 {
+		t.Fatalf("POST /receipts/process/stream = %d %s, want 2 results", rec.Code, rec.Body)
+	}
+	var result lineResult
+	if err := json.Unmarshal([]byte(lines[1]), &result); err != nil || result.Line != 2 || result.Error == nil {
+		t.Fatalf("second result = %s, want an error for line 2", lines[1])
+	}
+	checkItemPointers(t, "NDJSON line 2", result.Error.Details)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+// The media types of the API's bodies.
+const (
+	mediaJSON = "application/json"
+	mediaXML  = "application/xml"
+)
+
+// produces lists, by route pattern, the media types of the routes that do not
+// serve JSON alone, in the order the server prefers them. Every other route
+// serves only JSON, so a new route needs an entry here only if it serves
+// something else. A nil entry marks a route whose handler negotiates for
+// itself, because it serves one type that depends on what it looks up.
+var produces = map[string][]string{
+	"GET /receipts/{id}":            {mediaJSON, mediaXML},
+	"GET /receipts/{id}/points":     {mediaJSON, mediaXML},
+	"GET /receipts/{id}/image":      nil, // the type of the stored image
+	"GET /receipts/export.csv":      {"text/csv"},
+	"GET /receipts/stream":          {"text/event-stream"},
+	"POST /receipts/process/stream": {"application/x-ndjson"},
+	"GET /admin/export":             {"application/x-ndjson"},
+	"GET /metrics":                  {"text/plain"},
+	"GET /openapi.yaml":             {"application/yaml"},
+	"GET /docs":                     {"text/html"},
+}
+
+// negotiateContent picks the media type of the response from the request's
+// Accept header, among those the route of mux it is for produces, and
+// refuses the request with 406 if the header allows none of them. Handlers
+// serving more than one type find the one chosen with responseType. Requests
+// no route matches are passed on untouched, for the mux to answer, and error
+// responses are JSON whatever the header says.
+func negotiateContent(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		if pattern == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		offers, ok := produces[pattern]
+		switch {
+		case !ok:
+			offers = []string{mediaJSON}
+		case offers == nil:
+			next.ServeHTTP(w, r)
+			return
+		}
+		mediaType, ok := acceptMediaType(w, r, offers)
+		if !ok {
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withResponseType(r.Context(), mediaType)))
+	})
+}
+
+// acceptMediaType returns the offer best matching the Accept header of r,
+// or writes a 406 response and returns false if the header allows none of
+// them. Either way the response is marked as varying by Accept.
+func acceptMediaType(w http.ResponseWriter, r *http.Request, offers []string) (string, bool) {
+	w.Header().Add("Vary", "Accept")
+	mediaType := negotiateMediaType(strings.Join(r.Header.Values("Accept"), ","), offers)
+	if mediaType == "" {
+		writeError(w, http.StatusNotAcceptable, codeNotAcceptable, "The response cannot be served as any of the media types accepted",
+			points.FieldError{Field: "Accept", Message: "must allow one of " + strings.Join(offers, ", ")})
+		return "", false
+	}
+	return mediaType, true
+}
+
+// negotiateMediaType returns the offer best matching accept, the value of an
+// Accept header, or "" if it allows none. Each offer takes the quality of the
+// most specific media range matching it, so that text/plain;q=0 refuses
+// text/plain even alongside */*, and offers of equal quality go in the order
+// given. Media range parameters other than q are ignored, as are ranges
+// that cannot be parsed; a header with none left allows anything, as if it
+// were not sent.
+func negotiateMediaType(accept string, offers []string) string {
+	type mediaRange struct {
+		typ, subtype string
+		q            float64
+	}
+	var ranges []mediaRange
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, _ := strings.Cut(part, ";")
+		typ, subtype, ok := strings.Cut(strings.ToLower(strings.TrimSpace(mediaType)), "/")
+		if !ok || typ == "" || subtype == "" || (typ == "*" && subtype != "*") {
+			continue
+		}
+		q := 1.0
+		valid := true
+		for _, param := range strings.Split(params, ";") {
+			name, value, _ := strings.Cut(param, "=")
+			if strings.ToLower(strings.TrimSpace(name)) != "q" {
+				continue
+			}
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil || parsed < 0 || parsed > 1 {
+				valid = false
+				break
+			}
+			q = parsed
+		}
+		if valid {
+			ranges = append(ranges, mediaRange{typ, subtype, q})
+		}
+	}
+	if len(ranges) == 0 {
+		return offers[0]
+	}
+
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		typ, subtype, _ := strings.Cut(offer, "/")
+		q, specificity := 0.0, -1
+		for _, r := range ranges {
+			var s int
+			switch {
+			case r.typ == typ && r.subtype == subtype:
+				s = 2
+			case r.typ == typ && r.subtype == "*":
+				s = 1
+			case r.typ == "*":
+				s = 0
+			default:
+				continue
+			}
+			if s > specificity {
+				q, specificity = r.q, s
+			}
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+type responseTypeKey struct{}
+
+// withResponseType returns a copy of ctx recording that the response is to
+// be served as mediaType.
+func withResponseType(ctx context.Context, mediaType string) context.Context {
+	return context.WithValue(ctx, responseTypeKey{}, mediaType)
+}
+
+// responseType returns the media type negotiateContent chose for the response
+// to the request of ctx, or JSON if it did not run.
+func responseType(ctx context.Context) string {
+	if mediaType, ok := ctx.Value(responseTypeKey{}).(string); ok {
+		return mediaType
+	}
+	return mediaJSON
+}
+
+// encodeResponse encodes v, the body of the response to r, as the media type
+// negotiateContent chose, returning that type and the body without a
+// trailing newline. XML bodies have a root element called name.
+func encodeResponse(r *http.Request, name string, v any) (string, []byte) {
+	if responseType(r.Context()) != mediaXML {
+		body, _ := json.Marshal(v)
+		return mediaJSON, body
+	}
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	xml.NewEncoder(&buf).EncodeElement(v, xml.StartElement{Name: xml.Name{Local: name}})
+	return mediaXML, buf.Bytes()
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/y1zhuo/receipt-processor-challenge/api"
+)
+
+func TestNegotiateMediaType(t *testing.T) {
+	both := []string{mediaJSON, mediaXML}
+	tests := []struct {
+		accept string
+		offers []string
+		want   string
+	}{
+		// No preference, or none that can be read, takes the first offer.
+		{"", both, mediaJSON},
+		{"*/*", both, mediaJSON},
+		{"garbage", both, mediaJSON},
+		{"text/html;q=2, application/xml;q=abc", both, mediaJSON},
+		{"*/json", both, mediaJSON},
+		{"application/xml", both, mediaXML},
+		{"APPLICATION/XML", both, mediaXML},
+		{"application/*", both, mediaJSON},
+		{"text/plain", both, ""},
+		{"text/*", both, ""},
+		{"text/plain", []string{mediaJSON}, ""},
+
+		// Quality values.
+		{"application/json;q=0.5, application/xml;q=0.9", both, mediaXML},
+		{"application/xml;q=0.9, application/json", both, mediaJSON},
+		{"application/xml;q=1.0, application/json;q=1", both, mediaJSON},
+		{"application/xml; Q=0.8, application/json; q=0.2", both, mediaXML},
+		{"application/json;q=0, */*", both, mediaXML},
+		{"application/json;q=0, application/xml;q=0", both, ""},
+		{"*/*;q=0", both, ""},
+		{"application/json;q=0.001", both, mediaJSON},
+		// The most specific range matching an offer sets its quality,
+		// wherever it is in the header.
+		{"*/*;q=0.9, application/json;q=0.1", both, mediaXML},
+		{"application/*;q=0.2, */*;q=1, application/xml;q=0.3", both, mediaXML},
+		{"application/*;q=0, */*", both, ""},
+		{"text/plain, application/*;q=0.4", both, mediaJSON},
+		// Parameters other than q are ignored.
+		{"application/xml;charset=utf-8;q=0.7, application/json;version=2;q=0.6", both, mediaXML},
+		// A range with a bad quality is dropped, leaving the rest.
+		{"application/json;q=1.5, application/xml", both, mediaXML},
+		{"application/json;q=-1, text/plain", both, ""},
+
+		// Several entries, as joined from several Accept lines.
+		{"text/html, application/xhtml+xml, application/xml;q=0.9, */*;q=0.8", both, mediaXML},
+		{"text/plain,,application/json", both, mediaJSON},
+		{"text/plain, text/csv", []string{mediaJSON, "text/csv"}, "text/csv"},
+		{"image/*", []string{"image/png"}, "image/png"},
+		{"image/jpeg", []string{"image/png"}, ""},
+	}
+	for _, tt := range tests {
+		if got := negotiateMediaType(tt.accept, tt.offers); got != tt.want {
+			t.Errorf("negotiateMediaType(%q, %q) = %q, want %q", tt.accept, tt.offers, got, tt.want)
+		}
+	}
+}
+
+func TestContentNegotiation(t *testing.T) {
+	h := newTestServer(t).Handler()
+	id := processReceipt(t, h, targetReceipt)
+	points := "/receipts/" + id + "/points"
+
+	tests := []struct {
+		target      string
+		accept      []string // one Accept line each
+		status      int
+		contentType string
+	}{
+		{points, nil, http.StatusOK, mediaJSON},
+		{points, []string{"*/*"}, http.StatusOK, mediaJSON},
+		{points, []string{"application/xml"}, http.StatusOK, mediaXML},
+		{points, []string{"application/json;q=0.1, application/xml;q=0.5"}, http.StatusOK, mediaXML},
+		{points, []string{"text/plain", "application/xml;q=0.2"}, http.StatusOK, mediaXML},
+		{points, []string{"application/xml;q=0", "*/*;q=0.1"}, http.StatusOK, mediaJSON},
+		{points, []string{"text/plain"}, http.StatusNotAcceptable, mediaJSON},
+		{points, []string{"text/plain", "text/html;q=0.9"}, http.StatusNotAcceptable, mediaJSON},
+		{"/receipts/" + id, []string{"application/xml"}, http.StatusOK, mediaXML},
+		// A route serving only JSON refuses XML.
+		{"/receipts/" + id + "/breakdown", []string{"application/xml"}, http.StatusNotAcceptable, mediaJSON},
+		{"/receipts/" + id + "/breakdown", []string{"application/xml;q=1, application/json;q=0.1"}, http.StatusOK, mediaJSON},
+	}
+	for _, tt := range tests {
+		var header []string
+		for _, accept := range tt.accept {
+			header = append(header, "Accept", accept)
+		}
+		rec := send(h, http.MethodGet, tt.target, "", header...)
+		if rec.Code != tt.status || rec.Header().Get("Content-Type") != tt.contentType || !strings.Contains(strings.Join(rec.Header().Values("Vary"), ","), "Accept") {
+			t.Errorf("GET %s with Accept %q = %d %v, want %d %s", tt.target, tt.accept, rec.Code, rec.Header(), tt.status, tt.contentType)
+		}
+	}
+}
+
+// TestImageNegotiation checks that an image is only served if Accept allows
+// the type it is stored as, rather than any type an image may have.
+func TestImageNegotiation(t *testing.T) {
+	h := newTestServer(t).Handler()
+	id := processReceipt(t, h, targetReceipt)
+	if rec := uploadImage(t, h, id, "image", "image/png", imageOf(pngHeader, 100)); rec.Code != http.StatusCreated {
+		t.Fatalf("uploading the image = %d %s", rec.Code, rec.Body)
+	}
+
+	target := "/receipts/" + id + "/image"
+	tests := []struct {
+		accept      string
+		status      int
+		contentType string
+	}{
+		{"", http.StatusOK, "image/png"},
+		{"image/*", http.StatusOK, "image/png"},
+		{"image/jpeg, image/png;q=0.1", http.StatusOK, "image/png"},
+		{"image/jpeg", http.StatusNotAcceptable, mediaJSON},
+		{"image/png;q=0, image/*", http.StatusNotAcceptable, mediaJSON},
+		{mediaJSON, http.StatusNotAcceptable, mediaJSON},
+	}
+	for _, tt := range tests {
+		var header []string
+		if tt.accept != "" {
+			header = []string{"Accept", tt.accept}
+		}
+		rec := send(h, http.MethodGet, target, "", header...)
+		if rec.Code != tt.status || rec.Header().Get("Content-Type") != tt.contentType || !strings.Contains(strings.Join(rec.Header().Values("Vary"), ","), "Accept") {
+			t.Errorf("GET %s with Accept %q = %d %v, want %d %s", target, tt.accept, rec.Code, rec.Header(), tt.status, tt.contentType)
+		}
+		if rec.Code == http.StatusNotAcceptable && !strings.Contains(rec.Body.String(), "must allow one of image/png") {
+			t.Errorf("GET %s with Accept %q = %s, want image/png listed", target, tt.accept, rec.Body)
+		}
+	}
+}
+
+func TestNotAcceptableListsTypes(t *testing.T) {
+	h := newTestServer(t).Handler()
+	id := processReceipt(t, h, targetReceipt)
+	rec := send(h, http.MethodGet, "/receipts/"+id+"/points", "", "Accept", "text/plain")
+	var failure api.ErrorResponse
+	decodeBody(t, rec, &failure)
+	if rec.Code != http.StatusNotAcceptable || failure.Error == nil || failure.Error.Code != codeNotAcceptable ||
+		len(failure.Error.Details) != 1 || failure.Error.Details[0].Message != "must allow one of application/json, application/xml" {
+		t.Errorf("GET with Accept text/plain = %d %s, want 406 listing JSON and XML", rec.Code, rec.Body)
+	}
+}
+
+func TestXMLPoints(t *testing.T) {
+	h := newTestServer(t).Handler()
+	id := processReceipt(t, h, targetReceipt)
+	rec := send(h, http.MethodGet, "/receipts/"+id+"/points", "", "Accept", "application/xml")
+	want := xml.Header + "<receiptPoints><points>28</points></receiptPoints>\n"
+	if rec.Code != http.StatusOK || rec.Body.String() != want {
+		t.Errorf("GET points as XML = %d %q, want %q", rec.Code, rec.Body, want)
+	}
+
+	// Errors are JSON whatever was asked for.
+	unknown := "/receipts/00000000-0000-4000-8000-000000000000/points"
+	if rec := send(h, http.MethodGet, unknown, "", "Accept", "application/xml"); rec.Code != http.StatusNotFound ||
+		rec.Header().Get("Content-Type") != mediaJSON || errorCode(t, rec) != codeReceiptNotFound {
+		t.Errorf("GET of an unknown receipt as XML = %d %v %s, want a JSON 404", rec.Code, rec.Header(), rec.Body)
+	}
+}
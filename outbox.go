@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// defaultWebhookRetention is how long delivered webhook events are kept in
+// the outbox unless configured otherwise.
+const defaultWebhookRetention = 7 * 24 * time.Hour
+
+// errOutboxEventNotFound is returned by a webhookOutbox when no event has the
+// requested ID.
+var errOutboxEventNotFound = errors.New("webhook event not found")
+
+// The states of an outbox event.
+const (
+	outboxPending   = "pending"
+	outboxDelivered = "delivered"
+	outboxFailed    = "failed" // given up on until retried by an admin
+)
+
+// outboxEvent is the delivery of a webhook event to one URL, as the outbox
+// keeps it.
+type outboxEvent struct {
+	ID        string          `json:"id"`
+	URL       string          `json:"url"`
+	ReceiptID string          `json:"receiptId"`
+	Body      json.RawMessage `json:"body"`
+	Status    string          `json:"status"`
+	// Attempts counts the delivery attempts made so far, across
+	// restarts and retries.
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"lastError,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+func (e outboxEvent) delivery() webhookDelivery {
+	return webhookDelivery{id: e.ID, url: e.URL, body: e.Body, attempts: e.Attempts}
+}
+
+// webhookOutbox keeps the webhook events of a persistent store until they
+// are delivered, so that none is lost if the process stops first. Events are
+// added by SaveReceipt, together with their receipt (see withOutbox).
+type webhookOutbox interface {
+	// list returns the events in status, oldest first.
+	list(ctx context.Context, status string) ([]outboxEvent, error)
+	// get returns the event with id, or errOutboxEventNotFound.
+	get(ctx context.Context, id string) (outboxEvent, error)
+	// settle records the Status, Attempts, LastError and UpdatedAt of
+	// event, returning errOutboxEventNotFound if it is not kept.
+	settle(ctx context.Context, event outboxEvent) error
+	// prune removes the events delivered before before, returning how
+	// many were removed.
+	prune(ctx context.Context, before time.Time) (int, error)
+}
+
+// openWebhookOutbox returns the outbox of store: a table of its database or,
+// for a file store, entries in its log. A memory store has none, since its
+// events would be lost with it.
+func openWebhookOutbox(store Store) webhookOutbox {
+	switch store := store.(type) {
+	case *sqliteStore:
+		return &sqliteOutbox{db: store.db}
+	case *fileStore:
+		return &fileOutbox{store: store}
+	}
+	return nil
+}
+
+type outboxKey struct{}
+
+// withOutbox returns a copy of ctx whose SaveReceipt call also adds events
+// to the store's outbox, in the same write as the receipt.
+func withOutbox(ctx context.Context, events []outboxEvent) context.Context {
+	return context.WithValue(ctx, outboxKey{}, events)
+}
+
+// outboxFrom returns the events ctx carries for the outbox.
+func outboxFrom(ctx context.Context) []outboxEvent {
+	events, _ := ctx.Value(outboxKey{}).([]outboxEvent)
+	return events
+}
+
+// sqliteOutbox keeps outbox events in the webhook_outbox table of the
+// store's database.
+type sqliteOutbox struct {
+	db *sql.DB
+}
+
+// sqliteOutboxColumns are the columns scanOutboxEvent reads, in order.
+const sqliteOutboxColumns = `id, url, receipt_id, body, status, attempts, last_error, created_at, updated_at`
+
+// insertOutbox adds events to the outbox in tx.
+func insertOutbox(ctx context.Context, tx *sql.Tx, events []outboxEvent) error {
+	for _, event := range events {
+		_, err := tx.ExecContext(ctx, `INSERT INTO webhook_outbox (`+sqliteOutboxColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			event.ID, event.URL, event.ReceiptID, string(event.Body), event.Status, event.Attempts, event.LastError,
+			event.CreatedAt.UnixNano(), event.UpdatedAt.UnixNano())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func scanOutboxEvent(row interface{ Scan(...any) error }) (outboxEvent, error) {
+	var event outboxEvent
+	var body string
+	var created, updated int64
+	if err := row.Scan(&event.ID, &event.URL, &event.ReceiptID, &body, &event.Status, &event.Attempts, &event.LastError, &created, &updated); err != nil {
+		return outboxEvent{}, err
+	}
+	event.Body = json.RawMessage(body)
+	event.CreatedAt, event.UpdatedAt = time.Unix(0, created).UTC(), time.Unix(0, updated).UTC()
+	return event, nil
+}
+
+func (o *sqliteOutbox) list(ctx context.Context, status string) ([]outboxEvent, error) {
+	rows, err := o.db.QueryContext(ctx, `SELECT `+sqliteOutboxColumns+` FROM webhook_outbox WHERE status = ? ORDER BY created_at, id`, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var events []outboxEvent
+	for rows.Next() {
+		event, err := scanOutboxEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+func (o *sqliteOutbox) get(ctx context.Context, id string) (outboxEvent, error) {
+	event, err := scanOutboxEvent(o.db.QueryRowContext(ctx, `SELECT `+sqliteOutboxColumns+` FROM webhook_outbox WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return outboxEvent{}, errOutboxEventNotFound
+	}
+	return event, err
+}
+
+func (o *sqliteOutbox) settle(ctx context.Context, event outboxEvent) error {
+	result, err := o.db.ExecContext(ctx, `UPDATE webhook_outbox SET status = ?, attempts = ?, last_error = ?, updated_at = ? WHERE id = ?`,
+		event.Status, event.Attempts, event.LastError, event.UpdatedAt.UnixNano(), event.ID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return errOutboxEventNotFound
+	}
+	return nil
+}
+
+func (o *sqliteOutbox) prune(ctx context.Context, before time.Time) (int, error) {
+	result, err := o.db.ExecContext(ctx, `DELETE FROM webhook_outbox WHERE status = ? AND updated_at < ?`, outboxDelivered, before.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	return int(n), err
+}
+
+// fileOutbox keeps outbox events in the log of a file store: new events in
+// the entry saving their receipt, and each change to one in an entry of its
+// own. Pruning only forgets events in memory, so those pruned since the log
+// was last replayed are pruned again after a restart.
+type fileOutbox struct {
+	store *fileStore
+}
+
+func (o *fileOutbox) list(ctx context.Context, status string) ([]outboxEvent, error) {
+	o.store.mu.Lock()
+	defer o.store.mu.Unlock()
+	var events []outboxEvent
+	for _, event := range o.store.outbox {
+		if event.Status == status {
+			events = append(events, *event)
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		a, b := events[i], events[j]
+		return a.CreatedAt.Before(b.CreatedAt) || a.CreatedAt.Equal(b.CreatedAt) && a.ID < b.ID
+	})
+	return events, nil
+}
+
+func (o *fileOutbox) get(ctx context.Context, id string) (outboxEvent, error) {
+	o.store.mu.Lock()
+	defer o.store.mu.Unlock()
+	event, ok := o.store.outbox[id]
+	if !ok {
+		return outboxEvent{}, errOutboxEventNotFound
+	}
+	return *event, nil
+}
+
+func (o *fileOutbox) settle(ctx context.Context, event outboxEvent) error {
+	o.store.mu.Lock()
+	defer o.store.mu.Unlock()
+	kept, ok := o.store.outbox[event.ID]
+	if !ok {
+		return errOutboxEventNotFound
+	}
+	settled := *kept
+	settled.Status, settled.Attempts, settled.LastError, settled.UpdatedAt = event.Status, event.Attempts, event.LastError, event.UpdatedAt
+	if err := o.store.append(ctx, fileEntry{Op: fileOpWebhook, ID: settled.ReceiptID, Webhooks: []outboxEvent{settled}}); err != nil {
+		return err
+	}
+	*kept = settled
+	return nil
+}
+
+func (o *fileOutbox) prune(ctx context.Context, before time.Time) (int, error) {
+	o.store.mu.Lock()
+	defer o.store.mu.Unlock()
+	pruned := 0
+	for id, event := range o.store.outbox {
+		if event.Status == outboxDelivered && event.UpdatedAt.Before(before) {
+			delete(o.store.outbox, id)
+			pruned++
+		}
+	}
+	return pruned, nil
+}
+
+// outboxEventsResponse is the response to GET /admin/webhooks/failed.
+type outboxEventsResponse struct {
+	Events []outboxEvent `json:"events"`
+}
+
+// failedWebhooksHandler handles GET /admin/webhooks/failed, listing the
+// webhook events given up on, oldest first.
+func (s *Server) failedWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	events, err := s.webhooks.outbox.list(r.Context(), outboxFailed)
+	if err != nil {
+		s.writeStoreError(w, r, err)
+		return
+	}
+	if events == nil {
+		events = []outboxEvent{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(outboxEventsResponse{Events: events})
+}
+
+// retryWebhookHandler handles POST /admin/webhooks/{eventId}/retry, queuing
+// a failed webhook event to be delivered again.
+func (s *Server) retryWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	outbox := s.webhooks.outbox
+	event, err := outbox.get(r.Context(), r.PathValue("eventId"))
+	if errors.Is(err, errOutboxEventNotFound) {
+		writeError(w, http.StatusNotFound, codeWebhookEventNotFound, "No webhook event found for that ID")
+		return
+	}
+	if err != nil {
+		s.writeStoreError(w, r, err)
+		return
+	}
+	if event.Status != outboxFailed {
+		writeError(w, http.StatusConflict, codeWebhookEventNotFailed, "Only failed webhook events can be retried")
+		return
+	}
+
+	event.Status, event.UpdatedAt = outboxPending, time.Now().UTC()
+	if err := outbox.settle(r.Context(), event); err != nil {
+		s.writeStoreError(w, r, err)
+		return
+	}
+	s.webhooks.enqueue(event.delivery())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(event)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// persistentStoreKinds are the kinds of Store with a webhook outbox.
+var persistentStoreKinds = []string{"file", "sqlite"}
+
+// withWebhookOutbox delivers webhooks to url through the store's outbox. The
+// worker is not started.
+func withWebhookOutbox(url string) serverOption {
+	return func(t testing.TB, s *Server) {
+		s.webhooks = newWebhookNotifier([]string{url}, "secret")
+		s.webhooks.backoff = time.Millisecond
+		s.webhooks.logger = s.logger
+		s.webhooks.outbox = openWebhookOutbox(s.store)
+		if s.webhooks.outbox == nil {
+			t.Fatalf("%T has no webhook outbox", s.store)
+		}
+	}
+}
+
+// startWebhooks runs the webhook worker of s until the returned function
+// is called or the test ends.
+func startWebhooks(t *testing.T, s *Server) (kill func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s.webhooks.run(ctx)
+	return cancel
+}
+
+// outboxStatus waits for the event with id to be in status in outbox.
+func outboxStatus(t *testing.T, outbox webhookOutbox, id, status string) outboxEvent {
+	t.Helper()
+	var event outboxEvent
+	waitFor(t, "webhook event "+id+" to be "+status, func() bool {
+		var err error
+		event, err = outbox.get(context.Background(), id)
+		return err == nil && event.Status == status
+	})
+	return event
+}
+
+// TestOutboxDeliversAfterRestart stops the webhook worker after a receipt
+// is stored and before its event is delivered, then restarts the server on
+// the same store and checks that the event is delivered then.
+func TestOutboxDeliversAfterRestart(t *testing.T) {
+	for _, kind := range persistentStoreKinds {
+		for _, killed := range []string{"before delivery", "during delivery"} {
+			t.Run(kind+" "+killed, func(t *testing.T) {
+				// The first delivery is held until the worker gives up
+				// on it; later ones are taken.
+				var mu sync.Mutex
+				var requests int
+				held := make(chan struct{}, 1)
+				delivered := make(chan string, 10)
+				rcv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					mu.Lock()
+					requests++
+					first := requests == 1
+					mu.Unlock()
+					if first && killed == "during delivery" {
+						// The server only notices the client hang up
+						// once the body is read.
+						io.ReadAll(r.Body)
+						held <- struct{}{}
+						<-r.Context().Done()
+						return
+					}
+					delivered <- r.Header.Get(webhookEventIDHeader)
+				}))
+				defer rcv.Close()
+
+				path := filepath.Join(t.TempDir(), "receipts")
+				store, err := openStore(kind, path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				s := newStoreServer(t, store, withAdmin, withWebhookOutbox(rcv.URL))
+				kill := startWebhooks(t, s)
+				if killed == "before delivery" {
+					// The process dies before the worker takes the event.
+					kill()
+				}
+				id := processReceipt(t, s.Handler(), targetReceipt)
+				if killed == "during delivery" {
+					<-held
+					kill()
+				}
+				pending, err := s.webhooks.outbox.list(context.Background(), outboxPending)
+				if err != nil || len(pending) != 1 || pending[0].ReceiptID != id {
+					t.Fatalf("outbox before the restart = %+v, %v, want the event of %s pending", pending, err, id)
+				}
+				event := pending[0]
+				if err := store.Close(); err != nil {
+					t.Fatal(err)
+				}
+
+				s = newStoreServer(t, openTestStore(t, kind, path), withAdmin, withWebhookOutbox(rcv.URL))
+				startWebhooks(t, s)
+				select {
+				case got := <-delivered:
+					if got != event.ID {
+						t.Errorf("delivered event %s after the restart, want %s", got, event.ID)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("the event was not delivered after the restart")
+				}
+				if got := outboxStatus(t, s.webhooks.outbox, event.ID, outboxDelivered); got.Attempts != 1 {
+					t.Errorf("delivered event = %+v, want 1 attempt", got)
+				}
+			})
+		}
+	}
+}
+
+func TestOutboxFailedAndRetry(t *testing.T) {
+	for _, kind := range persistentStoreKinds {
+		t.Run(kind, func(t *testing.T) {
+			// The receiver refuses the first delivery outright, so it
+			// fails without retries.
+			rcv := newWebhookReceiver(t, http.StatusBadRequest)
+			s := newStoreServer(t, openTestStore(t, kind, filepath.Join(t.TempDir(), "receipts")), withAdmin, withWebhookOutbox(rcv.URL))
+			startWebhooks(t, s)
+			h := s.Handler()
+			processReceipt(t, h, targetReceipt)
+			rcv.wait(t, 1)
+			eventID := rcv.recorded()[0].eventID
+			outboxStatus(t, s.webhooks.outbox, eventID, outboxFailed)
+
+			var failed outboxEventsResponse
+			decodeBody(t, sendAdmin(h, http.MethodGet, "/admin/webhooks/failed", ""), &failed)
+			if len(failed.Events) != 1 || failed.Events[0].ID != eventID || failed.Events[0].Attempts != 1 || failed.Events[0].LastError == "" {
+				t.Fatalf("GET /admin/webhooks/failed = %+v, want event %s", failed, eventID)
+			}
+
+			if rec := sendAdmin(h, http.MethodPost, "/admin/webhooks/"+eventID+"/retry", ""); rec.Code != http.StatusAccepted {
+				t.Fatalf("POST /admin/webhooks/%s/retry = %d %s, want 202", eventID, rec.Code, rec.Body)
+			}
+			rcv.wait(t, 1)
+			if got := rcv.recorded()[1]; got.eventID != eventID {
+				t.Errorf("retry delivered event %s, want %s", got.eventID, eventID)
+			}
+			if got := outboxStatus(t, s.webhooks.outbox, eventID, outboxDelivered); got.Attempts != 2 {
+				t.Errorf("retried event = %+v, want 2 attempts", got)
+			}
+			decodeBody(t, sendAdmin(h, http.MethodGet, "/admin/webhooks/failed", ""), &failed)
+			if len(failed.Events) != 0 {
+				t.Errorf("GET /admin/webhooks/failed after the retry = %+v, want none", failed)
+			}
+
+			if rec := sendAdmin(h, http.MethodPost, "/admin/webhooks/"+eventID+"/retry", ""); rec.Code != http.StatusConflict || errorCode(t, rec) != codeWebhookEventNotFailed {
+				t.Errorf("retrying a delivered event = %d %s, want 409", rec.Code, rec.Body)
+			}
+			if rec := sendAdmin(h, http.MethodPost, "/admin/webhooks/nope/retry", ""); rec.Code != http.StatusNotFound || errorCode(t, rec) != codeWebhookEventNotFound {
+				t.Errorf("retrying an unknown event = %d %s, want 404", rec.Code, rec.Body)
+			}
+		})
+	}
+}
+
+// TestOutboxPrune checks that only delivered events last settled before
+// the cutoff are pruned.
+func TestOutboxPrune(t *testing.T) {
+	for _, kind := range persistentStoreKinds {
+		t.Run(kind, func(t *testing.T) {
+			ctx := context.Background()
+			store := openTestStore(t, kind, filepath.Join(t.TempDir(), "receipts"))
+			outbox := openWebhookOutbox(store)
+			now := time.Now().UTC()
+			old := now.Add(-time.Hour)
+			settled := []outboxEvent{
+				{ID: "old-delivered", Status: outboxDelivered, UpdatedAt: old},
+				{ID: "new-delivered", Status: outboxDelivered, UpdatedAt: now},
+				{ID: "old-pending", Status: outboxPending, UpdatedAt: old},
+				{ID: "old-failed", Status: outboxFailed, UpdatedAt: old},
+			}
+			var events []outboxEvent
+			for _, event := range settled {
+				events = append(events, outboxEvent{ID: event.ID, URL: "http://example.com", ReceiptID: "a", Body: []byte(`{}`), Status: outboxPending, CreatedAt: old, UpdatedAt: old})
+			}
+			receipt, breakdown := scored(parseReceipt(t, targetReceipt))
+			if err := store.SaveReceipt(withOutbox(ctx, events), "a", receipt, breakdown); err != nil {
+				t.Fatal(err)
+			}
+			for _, event := range settled {
+				if err := outbox.settle(ctx, event); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if pruned, err := outbox.prune(ctx, now.Add(-time.Minute)); err != nil || pruned != 1 {
+				t.Fatalf("prune = %d, %v, want 1", pruned, err)
+			}
+			for _, event := range settled {
+				_, err := outbox.get(ctx, event.ID)
+				if want := event.ID != "old-delivered"; (err == nil) != want {
+					t.Errorf("get %s after pruning: %v, want kept %v", event.ID, err, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+// Snapshots persist the memory store between runs without a database: the
+// whole store is written to a file every -snapshot-interval and loaded back
+// on startup.
+
+const (
+	// snapshotFormat identifies a snapshot file in its header.
+	snapshotFormat = "receipt-processor-snapshot"
+	// snapshotVersion is the version of the layout written. Snapshots of a
+	// later version are refused rather than misread.
+	snapshotVersion = 1
+	// defaultSnapshotInterval is how often snapshots are written unless
+	// told otherwise.
+	defaultSnapshotInterval = time.Minute
+)
+
+// snapshotHeader is the first line of a snapshot file. A snapshotRecord
+// follows on each line for every receipt, as in an export.
+type snapshotHeader struct {
+	Format    string    `json:"format"`
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+	Receipts  int       `json:"receipts"`
+}
+
+// snapshotter writes snapshots of a memory store to path.
+type snapshotter struct {
+	store    *memoryStore
+	path     string
+	interval time.Duration
+	logger   *slog.Logger
+	// onFailure, if set, is called each time a snapshot fails.
+	onFailure func()
+
+	saving sync.Mutex // serializes saves
+
+	mu       sync.Mutex
+	saved    uint64 // the store's change count as of the last snapshot
+	lastAt   time.Time
+	duration time.Duration
+	receipts int
+	lastErr  error
+}
+
+func newSnapshotter(store *memoryStore, path string, interval time.Duration) *snapshotter {
+	return &snapshotter{store: store, path: path, interval: interval, logger: slog.Default()}
+}
+
+// load fills the store from the snapshot at path, if there is one, and
+// returns how many receipts it held. Receipts are stored under the IDs and
+// tenants they had, with the scores they were given, and deleted ones are
+// left deleted.
+func (p *snapshotter) load() (int, error) {
+	file, err := os.Open(p.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	line, err := reader.ReadBytes('\n')
+	if (err != nil && !errors.Is(err, io.EOF)) || len(line) == 0 {
+		return 0, fmt.Errorf("reading %s: missing header", p.path)
+	}
+	var header snapshotHeader
+	if err := json.Unmarshal(line, &header); err != nil || header.Format != snapshotFormat {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+		if loaded, ok := p.loadLegacy(file); ok {
+			return loaded, nil
+		}
+		return 0, fmt.Errorf("reading %s: not a receipt processor snapshot", p.path)
+	}
+	if header.Version > snapshotVersion {
+		return 0, fmt.Errorf("reading %s: snapshot version %d is newer than the supported version %d", p.path, header.Version, snapshotVersion)
+	}
+
+	ctx := context.Background()
+	loaded := 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return loaded, err
+		}
+		var record snapshotRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return loaded, fmt.Errorf("reading %s: record %d: %w", p.path, loaded+1, err)
+		}
+		breakdown := points.Breakdown{Rules: []points.RuleResult{}, Total: record.Points}
+		if record.Breakdown != nil {
+			breakdown = *record.Breakdown
+		}
+		p.store.SaveReceipt(withTenant(ctx, record.Tenant), record.ID, record.Receipt, breakdown)
+		if record.DeletedAt != nil {
+			p.store.deleteAt(ctx, record.ID, 0, *record.DeletedAt)
+		}
+		if record.Revision != 0 {
+			p.store.setRevision(record.ID, record.Revision)
+		}
+		if record.CompactedAt != nil {
+			p.store.setCompacted(record.ID, *record.CompactedAt)
+		}
+		loaded++
+	}
+	// Records are only ever written whole, so a count that does not
+	// match means the file was changed by something else.
+	if loaded != header.Receipts {
+		return loaded, fmt.Errorf("reading %s: header promises %d receipts, found %d", p.path, header.Receipts, loaded)
+	}
+
+	p.mu.Lock()
+	p.saved = p.store.changeCount()
+	p.mu.Unlock()
+	return loaded, nil
+}
+
+// legacySnapshot is a snapshot of the two-map layout (see legacyMerge): the
+// receipts and the points of the memory store, each keyed by receipt ID, in
+// one JSON object.
+type legacySnapshot struct {
+	Receipts map[string]points.Receipt `json:"receipts"`
+	Points   map[string]int            `json:"points"`
+}
+
+// loadLegacy fills the store from r if it holds a legacySnapshot, reporting
+// whether it did. The maps keep no order, so receipts are stored in the
+// order of their IDs. The snapshot is left as it is until the next save
+// replaces it with one of the current layout.
+func (p *snapshotter) loadLegacy(r io.Reader) (int, bool) {
+	var legacy legacySnapshot
+	if err := json.NewDecoder(r).Decode(&legacy); err != nil || legacy.Receipts == nil && legacy.Points == nil {
+		return 0, false
+	}
+
+	merge := newLegacyMerge()
+	for id, total := range legacy.Points {
+		merge.addPoints(id, total)
+	}
+	var records []snapshotRecord
+	for id, receipt := range legacy.Receipts {
+		if record, ok := merge.addReceipt(id, "", receipt); ok {
+			records = append(records, record)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].ID < records[j].ID })
+
+	ctx := context.Background()
+	for _, record := range records {
+		p.store.SaveReceipt(ctx, record.ID, record.Receipt, legacyBreakdown(record.Points))
+	}
+	if dropped := merge.unpaired(); dropped > 0 {
+		p.logger.Warn("dropped partial records from a two-map snapshot", slog.String("component", componentStore),
+			slog.String("path", p.path), slog.Int("dropped", dropped))
+	}
+	return len(records), true
+}
+
+// save writes a snapshot of the store unless nothing has changed since the
+// last one. The snapshot is written to a temporary file that is renamed over
+// path once complete, so path always holds a whole snapshot.
+func (p *snapshotter) save() error {
+	p.saving.Lock()
+	defer p.saving.Unlock()
+
+	p.mu.Lock()
+	saved := p.saved
+	p.mu.Unlock()
+	if p.store.changeCount() == saved {
+		return nil
+	}
+
+	start := time.Now()
+	records, changes := p.store.dump()
+	err := writeFileAtomic(p.path, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		if err := enc.Encode(snapshotHeader{Format: snapshotFormat, Version: snapshotVersion, CreatedAt: start.UTC(), Receipts: len(records)}); err != nil {
+			return err
+		}
+		for _, record := range records {
+			if err := enc.Encode(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastErr = err
+	if err != nil {
+		if p.onFailure != nil {
+			p.onFailure()
+		}
+		return err
+	}
+	p.saved = changes
+	p.lastAt, p.duration, p.receipts = start, time.Since(start), len(records)
+	return nil
+}
+
+// run saves a snapshot every interval until ctx is canceled. The final
+// snapshot is left to the caller, once nothing more can be stored.
+func (p *snapshotter) run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := p.save(); err != nil {
+				p.logger.Error("failed to write snapshot", slog.String("component", componentStore), slog.String("path", p.path), slog.Any("error", err))
+			}
+		}
+	}
+}
+
+// snapshotStatus describes the last snapshot, as reported by GET
+// /admin/stats.
+type snapshotStatus struct {
+	Path string `json:"path"`
+	// LastAt is omitted until a snapshot has been written.
+	LastAt          *time.Time `json:"lastAt,omitempty"`
+	DurationSeconds float64    `json:"durationSeconds"`
+	Receipts        int        `json:"receipts"`
+	// Error is why the latest attempt failed, if it did.
+	Error string `json:"error,omitempty"`
+}
+
+func (p *snapshotter) status() snapshotStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	status := snapshotStatus{Path: p.path, DurationSeconds: p.duration.Seconds(), Receipts: p.receipts}
+	if !p.lastAt.IsZero() {
+		last := p.lastAt.UTC()
+		status.LastAt = &last
+	}
+	if p.lastErr != nil {
+		status.Error = p.lastErr.Error()
+	}
+	return status
+}
+
+// writeFileAtomic replaces path with what write writes, by way of a
+// temporary file in the same directory. Readers of path see either its old
+// contents or all of the new, even if the process dies midway.
+func writeFileAtomic(path string, write func(io.Writer) error) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	// Once renamed, there is nothing left here to remove.
+	defer os.Remove(tmp.Name())
+
+	bw := bufio.NewWriter(tmp)
+	if err := write(bw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	// The data must be on disk before the rename is, or a crash could
+	// leave path naming an empty file.
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	// Make the rename itself durable. Not every platform can sync a
+	// directory, and the snapshot is complete either way.
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestSnapshotter returns a snapshotter of a new memory store to path.
+func newTestSnapshotter(path string) *snapshotter {
+	p := newSnapshotter(newMemoryStore(), path, time.Minute)
+	p.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	return p
+}
+
+// saveReceipt stores receipt under id in store for tenant.
+func saveReceipt(t *testing.T, store Store, tenant, id, receipt string) {
+	t.Helper()
+	r, breakdown := scored(parseReceipt(t, receipt))
+	if err := store.SaveReceipt(withTenant(context.Background(), tenant), id, r, breakdown); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot")
+	p := newTestSnapshotter(path)
+	saveReceipt(t, p.store, "", "a", targetReceipt)
+	saveReceipt(t, p.store, "tenant", "b", marketReceipt)
+	if err := p.save(); err != nil {
+		t.Fatal(err)
+	}
+	if status := p.status(); status.LastAt == nil || status.Receipts != 2 || status.Error != "" {
+		t.Errorf("status after saving = %+v, want 2 receipts saved", status)
+	}
+
+	loaded := newTestSnapshotter(path)
+	if n, err := loaded.load(); err != nil || n != 2 {
+		t.Fatalf("load = %d, %v, want 2", n, err)
+	}
+	if got, want := snapshot(t, loaded.store), map[string]int{"a": 28, "b": 109}; !maps.Equal(got, want) {
+		t.Errorf("loaded store holds %v, want %v", got, want)
+	}
+	// Receipts keep their tenant.
+	if _, err := loaded.store.GetPoints(withTenant(context.Background(), "other"), "b"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("another tenant's GetPoints of a loaded receipt = %v, want ErrNotFound", err)
+	}
+}
+
+// TestSnapshotSkipsCleanStore checks that a store with no writes since the
+// last snapshot, or since it was loaded, is not written again.
+func TestSnapshotSkipsCleanStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot")
+	p := newTestSnapshotter(path)
+	saveReceipt(t, p.store, "", "a", targetReceipt)
+	if err := p.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Were the snapshot rewritten, the file would be back.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("a clean store was written again: %v", err)
+	}
+
+	if err := p.store.Delete(context.Background(), "a", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("a store with a receipt deleted was not written: %v", err)
+	}
+
+	loaded := newTestSnapshotter(path)
+	if _, err := loaded.load(); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(path)
+	if err := loaded.save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("a store just loaded was written again: %v", err)
+	}
+}
+
+// TestSnapshotFailedWriteKeepsOld fails a snapshot and checks that the last
+// one is left whole, the failure is reported, and the store is still written
+// once writes work again.
+func TestSnapshotFailedWriteKeepsOld(t *testing.T) {
+	dir := t.TempDir()
+	old := filepath.Join(dir, "old")
+	first := newTestSnapshotter(old)
+	saveReceipt(t, first.store, "", "a", targetReceipt)
+	if err := first.save(); err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A name this long leaves no room for the temporary file's suffix, so
+	// the write fails even as root, whom directory permissions would not.
+	path := filepath.Join(dir, strings.Repeat("s", 250))
+	if err := os.Rename(old, path); err != nil {
+		t.Fatal(err)
+	}
+	p := newTestSnapshotter(path)
+	failures := 0
+	p.onFailure = func() { failures++ }
+	if _, err := p.load(); err != nil {
+		t.Fatal(err)
+	}
+	saveReceipt(t, p.store, "", "b", marketReceipt)
+	if err := p.save(); err == nil {
+		t.Fatal("save succeeded, want the temporary file refused")
+	}
+	if got, err := os.ReadFile(path); err != nil || string(got) != string(want) {
+		t.Errorf("snapshot after a failed save = %q, %v, want it unchanged", got, err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("directory holds %d files after a failed save, want only the snapshot", len(entries))
+	}
+	if status := p.status(); failures != 1 || status.Error == "" || status.LastAt != nil {
+		t.Errorf("after a failed save: %d failures, status %+v; want 1 and the error", failures, status)
+	}
+
+	// The failed snapshot left the store dirty, so it is written next time.
+	p.path = old
+	if err := p.save(); err != nil {
+		t.Fatal(err)
+	}
+	loaded := newTestSnapshotter(old)
+	if _, err := loaded.load(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := snapshot(t, loaded.store), map[string]int{"a": 28, "b": 109}; !maps.Equal(got, want) {
+		t.Errorf("snapshot after a failed one holds %v, want %v", got, want)
+	}
+	if status := p.status(); status.Error != "" {
+		t.Errorf("status after a good save still has error %q", status.Error)
+	}
+}
+
+func TestSnapshotMigratesTwoMapLayout(t *testing.T) {
+	legacy := `{
+  "receipts": {"b": ` + marketReceipt + `, "a": ` + targetReceipt + `, "torn": ` + targetReceipt + `},
+  "points": {"a": 28, "b": 109, "orphan": 5}
+}`
+	for name, data := range map[string]string{"indented": legacy, "compact": compactJSON(t, legacy)} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "snapshot")
+			if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			p := newTestSnapshotter(path)
+			loaded, err := p.load()
+			if err != nil || loaded != 2 {
+				t.Fatalf("load = %d, %v, want the 2 whole records", loaded, err)
+			}
+			want := map[string]int{"a": 28, "b": 109}
+			if got := snapshot(t, p.store); !maps.Equal(got, want) {
+				t.Errorf("store holds %v, want %v", got, want)
+			}
+
+			// The next save writes the current layout, which loads the
+			// same.
+			if err := p.save(); err != nil {
+				t.Fatal(err)
+			}
+			file, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			var header snapshotHeader
+			line, _ := bufio.NewReader(file).ReadBytes('\n')
+			if err := json.Unmarshal(line, &header); err != nil || header.Format != snapshotFormat || header.Version != snapshotVersion || header.Receipts != 2 {
+				t.Errorf("saved snapshot starts %s, want a header for 2 receipts", line)
+			}
+			reloaded := newTestSnapshotter(path)
+			if n, err := reloaded.load(); err != nil || n != 2 {
+				t.Fatalf("loading the migrated snapshot = %d, %v", n, err)
+			}
+			if got := snapshot(t, reloaded.store); !maps.Equal(got, want) {
+				t.Errorf("migrated snapshot holds %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// compactJSON returns data on one line.
+func compactJSON(t *testing.T, data string) string {
+	t.Helper()
+	var v any
+	if err := json.Unmarshal([]byte(data), &v); err != nil {
+		t.Fatal(err)
+	}
+	compact, _ := json.Marshal(v)
+	return string(compact)
+}
+
+func TestSnapshotRefusesOtherFiles(t *testing.T) {
+	for _, data := range []string{"", "\n", "hello\n", `{"format":"other"}` + "\n", `{"receipts":"nope"}`, `[1,2]`} {
+		path := filepath.Join(t.TempDir(), "snapshot")
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		p := newTestSnapshotter(path)
+		if n, err := p.load(); err == nil {
+			t.Errorf("load of %q = %d, nil, want an error", data, n)
+		}
+		if n := len(snapshot(t, p.store)); n != 0 {
+			t.Errorf("load of %q stored %d receipts", data, n)
+		}
+	}
+}
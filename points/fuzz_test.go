@@ -0,0 +1,43 @@
+package points
+
+import "testing"
+
+// maxFuzzItems bounds the items FuzzCalculatePoints scores, keeping each
+// input quick while still well past DefaultLimits.
+const maxFuzzItems = 5000
+
+func FuzzCalculatePoints(f *testing.F) {
+	f.Add("Target", "2022-01-01", "13:01", "Mountain Dew 12PK", "6.49", "6.49", uint16(1))
+	f.Add("M&M Corner Market", "2022-03-20", "14:33", "Gatorade", "2.25", "9.00", uint16(4))
+	f.Add("", "2022-02-29", "24:00", "", "0.00", "0.00", uint16(0))
+	f.Add("日本の店 🧾", "2024-02-29", "15:59", "ＭＯＵＮＴＡＩＮ　ＤＥＷ", "0.01", "0.01", uint16(3))
+	f.Add("\u200b\u0301", "9999-12-31", "00:00", "\t  abc ", "1.00", "1.00", uint16(maxFuzzItems))
+	f.Add("Target", "2022-01-xx", "1:01", "abc", "-1.00", "1e9", uint16(2))
+
+	f.Fuzz(func(t *testing.T, retailer, date, clock, description, price, total string, items uint16) {
+		receipt := Receipt{Retailer: retailer, PurchaseDate: date, PurchaseTime: clock, Total: Money(total)}
+		for range min(int(items), maxFuzzItems) {
+			receipt.Items = append(receipt.Items, Item{ShortDescription: description, Price: Money(price)})
+		}
+
+		points, err := Calculate(receipt)
+		if err != nil {
+			return
+		}
+		if points < 0 {
+			t.Errorf("Calculate = %d, want a non-negative total", points)
+		}
+		breakdown := DefaultRulesConfig().Breakdown(receipt)
+		if breakdown.Total != points {
+			t.Errorf("breakdown total %d, Calculate %d", breakdown.Total, points)
+		}
+		for _, rule := range breakdown.Rules {
+			if rule.Points < 0 {
+				t.Errorf("rule %s awarded %d points", rule.Rule, rule.Points)
+			}
+		}
+		// Neither check may panic, however large the amounts.
+		CheckTotal(receipt)
+		DefaultLimits().Check(receipt)
+	})
+}
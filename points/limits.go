@@ -0,0 +1,77 @@
+package points
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"unicode/utf8"
+)
+
+// Limits bounds the size of a receipt, so that absurd values are refused
+// rather than scored. A zero field means no limit.
+type Limits struct {
+	MaxItems int
+	// MaxAmount is the largest price or total accepted, in cents.
+	MaxAmount int64
+	// MaxDescriptionLength is the most characters an item's trimmed
+	// description may have.
+	MaxDescriptionLength int
+}
+
+// DefaultLimits returns the limits a receipt is held to unless configured
+// otherwise.
+func DefaultLimits() Limits {
+	return Limits{MaxItems: 1000, MaxAmount: 100000_00, MaxDescriptionLength: 500}
+}
+
+// Check returns a FieldError, naming the limit, for every field of a receipt
+// that has passed Validate and exceeds l.
+func (l Limits) Check(receipt Receipt) []FieldError {
+	var errs []FieldError
+	fail := func(field, constraint string, value any, message string) {
+		errs = append(errs, NewFieldError(field, constraint, value, message))
+	}
+
+	if l.MaxItems > 0 && len(receipt.Items) > l.MaxItems {
+		// Each item is not checked as well, or a receipt with millions
+		// of items would get as many errors.
+		fail("items", ConstraintMax, nil, fmt.Sprintf("has %d items, more than the limit of %d", len(receipt.Items), l.MaxItems))
+		return errs
+	}
+	for i, item := range receipt.Items {
+		if n := utf8.RuneCountInString(strings.TrimSpace(item.ShortDescription)); l.MaxDescriptionLength > 0 && n > l.MaxDescriptionLength {
+			fail(fmt.Sprintf("items[%d].shortDescription", i), ConstraintMaxLength, item.ShortDescription, fmt.Sprintf("is %d characters, more than the limit of %d", n, l.MaxDescriptionLength))
+		}
+		if price, _ := item.Price.Cents(); l.MaxAmount > 0 && price > l.MaxAmount {
+			fail(fmt.Sprintf("items[%d].price", i), ConstraintMax, string(item.Price), fmt.Sprintf("is more than the limit of %s", formatCents(l.MaxAmount)))
+		}
+	}
+	if total, _ := receipt.Total.Cents(); l.MaxAmount > 0 && total > l.MaxAmount {
+		fail("total", ConstraintMax, string(receipt.Total), fmt.Sprintf("is more than the limit of %s", formatCents(l.MaxAmount)))
+	}
+	return errs
+}
+
+// addPoints returns a + b, or the largest int64 instead of wrapping past
+// it. Points are never negative.
+func addPoints(a, b int64) int64 {
+	if b > math.MaxInt64-a {
+		return math.MaxInt64
+	}
+	return a + b
+}
+
+// mulPoints returns n * each, or the largest int64 instead of wrapping past
+// it. Neither may be negative.
+func mulPoints(n, each int64) int64 {
+	if n != 0 && each > math.MaxInt64/n {
+		return math.MaxInt64
+	}
+	return n * each
+}
+
+// toInt converts an accumulated number of points to an int, capping it at
+// the largest one.
+func toInt(points int64) int {
+	return int(min(points, math.MaxInt))
+}
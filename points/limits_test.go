@@ -0,0 +1,117 @@
+package points
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestLimitsCheck(t *testing.T) {
+	limits := DefaultLimits()
+	withItems := func(n int) Receipt {
+		receipt := testReceipt()
+		receipt.Items = nil
+		for range n {
+			receipt.Items = append(receipt.Items, Item{ShortDescription: "Gum", Price: "0.01"})
+		}
+		return receipt
+	}
+	withPrice := func(price Money) Receipt {
+		receipt := testReceipt()
+		receipt.Items[0].Price, receipt.Total = price, price
+		return receipt
+	}
+	withDescription := func(n int) Receipt {
+		receipt := testReceipt()
+		// Surrounding spaces are not counted, and runes are counted rather
+		// than bytes.
+		receipt.Items[0].ShortDescription = "  " + strings.Repeat("é", n) + "  "
+		return receipt
+	}
+
+	tests := []struct {
+		name    string
+		receipt Receipt
+		fields  []string
+	}{
+		{"1000 items", withItems(1000), nil},
+		{"1001 items", withItems(1001), []string{"items"}},
+		{"price of 100000.00", withPrice("100000.00"), nil},
+		{"price of 100000.01", withPrice("100000.01"), []string{"items[0].price", "total"}},
+		{"description of 500 characters", withDescription(500), nil},
+		{"description of 501 characters", withDescription(501), []string{"items[0].shortDescription"}},
+	}
+	for _, tt := range tests {
+		errs := limits.Check(tt.receipt)
+		if len(errs) != len(tt.fields) {
+			t.Errorf("%s: Check = %+v, want errors on %v", tt.name, errs, tt.fields)
+			continue
+		}
+		for i, err := range errs {
+			if err.Field != tt.fields[i] || !strings.Contains(err.Message, "limit") {
+				t.Errorf("%s: error %+v, want one on %s naming the limit", tt.name, err, tt.fields[i])
+			}
+		}
+	}
+
+	// An amount too large to count in cents never gets as far as the
+	// limits.
+	if _, invalid := fieldError(Validate(withPrice("999999999999999999.99")), "items[0].price"); !invalid {
+		t.Error("Validate accepted a price of 999999999999999999.99")
+	}
+
+	// Without limits anything goes.
+	for _, tt := range tests {
+		if errs := (Limits{}).Check(tt.receipt); len(errs) != 0 {
+			t.Errorf("%s: Check with no limits = %+v", tt.name, errs)
+		}
+	}
+}
+
+func TestLimitsCheckTotalAlone(t *testing.T) {
+	receipt := testReceipt()
+	receipt.Total = "100000.01"
+	errs := DefaultLimits().Check(receipt)
+	if len(errs) != 1 || errs[0].Field != "total" || errs[0].Constraint != ConstraintMax || errs[0].Message != "is more than the limit of 100000.00" {
+		t.Errorf("Check = %+v, want the total over the limit", errs)
+	}
+}
+
+func TestSaturatingArithmetic(t *testing.T) {
+	if got := addPoints(math.MaxInt64-1, 1); got != math.MaxInt64 {
+		t.Errorf("addPoints to the limit = %d", got)
+	}
+	if got := addPoints(math.MaxInt64-1, 2); got != math.MaxInt64 {
+		t.Errorf("addPoints past the limit = %d, want it capped", got)
+	}
+	if got := mulPoints(math.MaxInt64/2, 2); got != math.MaxInt64-1 {
+		t.Errorf("mulPoints below the limit = %d", got)
+	}
+	if got := mulPoints(math.MaxInt64/2+1, 2); got != math.MaxInt64 {
+		t.Errorf("mulPoints past the limit = %d, want it capped", got)
+	}
+	if got := mulPoints(0, math.MaxInt64); got != 0 {
+		t.Errorf("mulPoints by 0 = %d", got)
+	}
+	if got := toInt(math.MaxInt64); got != math.MaxInt {
+		t.Errorf("toInt = %d", got)
+	}
+}
+
+// TestHugeReceiptsSaturate scores receipts no limit stops, checking that
+// their points are capped rather than wrapped negative.
+func TestHugeReceiptsSaturate(t *testing.T) {
+	receipt := testReceipt()
+	receipt.Items = nil
+	for range 10000 {
+		receipt.Items = append(receipt.Items, Item{ShortDescription: "abc", Price: "92233720368547758.07"})
+	}
+	receipt.Total = "92233720368547758.00"
+	points, err := Calculate(receipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if points != math.MaxInt {
+		t.Errorf("Calculate = %d, want the largest int", points)
+	}
+}
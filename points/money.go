@@ -0,0 +1,34 @@
+package points
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// amountPattern is the pattern api.yml requires for price and total.
+var amountPattern = regexp.MustCompile(`^\d+\.\d{2}$`)
+
+// Money is a monetary amount in its wire form, a string such as "35.35".
+// Scoring works on its value in integer cents so that rules like "multiple
+// of 0.25" are exact rather than subject to floating point error.
+type Money string
+
+// Cents returns the amount in integer cents. ok is false if m does not match
+// amountPattern or does not fit in an int64.
+func (m Money) Cents() (cents int64, ok bool) {
+	if !amountPattern.MatchString(string(m)) {
+		return 0, false
+	}
+	cents, err := strconv.ParseInt(strings.Replace(string(m), ".", "", 1), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return cents, true
+}
+
+// formatCents formats an amount in cents in Money's wire form.
+func formatCents(cents int64) Money {
+	return Money(fmt.Sprintf("%d.%02d", cents/100, cents%100))
+}
@@ -0,0 +1,44 @@
+package points
+
+import "testing"
+
+func TestMoneyCents(t *testing.T) {
+	tests := []struct {
+		money Money
+		cents int64
+		ok    bool
+	}{
+		{"0.00", 0, true},
+		{"0.10", 10, true},
+		{"1.15", 115, true},
+		{"2.00", 200, true},
+		{"35.35", 3535, true},
+		{"100.75", 10075, true},
+		{"0.29", 29, true},
+		{"92233720368547758.07", 9223372036854775807, true},
+		{"92233720368547758.08", 0, false}, // past the largest int64
+		{"", 0, false},
+		{"1", 0, false},
+		{"1.5", 0, false},
+		{"1.500", 0, false},
+		{".50", 0, false},
+		{"-1.00", 0, false},
+		{"1,00", 0, false},
+		{"1e2", 0, false},
+		{" 1.00", 0, false},
+	}
+	for _, tt := range tests {
+		cents, ok := tt.money.Cents()
+		if cents != tt.cents || ok != tt.ok {
+			t.Errorf("Money(%q).Cents() = %d, %v, want %d, %v", tt.money, cents, ok, tt.cents, tt.ok)
+		}
+	}
+}
+
+func TestFormatCents(t *testing.T) {
+	for cents, want := range map[int64]Money{0: "0.00", 5: "0.05", 10: "0.10", 3535: "35.35", 10075: "100.75"} {
+		if got := formatCents(cents); got != want {
+			t.Errorf("formatCents(%d) = %q, want %q", cents, got, want)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package points
+
+import (
+	"strings"
+	"time"
+)
+
+// Canonical layouts of the purchaseDate and purchaseTime fields. Receipts
+// are scored and stored in these forms.
+const (
+	DateLayout = "2006-01-02"
+	TimeLayout = "15:04"
+)
+
+// InputFormats selects the layouts beyond the canonical ones that
+// Normalize accepts.
+type InputFormats struct {
+	// USDates accepts purchaseDate as MM/DD/YYYY, with or without leading
+	// zeros. A date such as 03/04/2022 is always read month first, as
+	// March 4.
+	USDates bool
+	// TwelveHourTimes accepts purchaseTime as a 12-hour time followed by
+	// AM or PM, such as "2:05 PM" or "02:05pm".
+	TwelveHourTimes bool
+	// DateTimes accepts a single ISO 8601 purchaseDateTime in place of
+	// purchaseDate and purchaseTime, such as "2022-01-01T13:01" or
+	// "2022-01-01T13:01:00-05:00". Seconds are dropped.
+	DateTimes bool
+	// Location is where a purchaseDateTime with a UTC offset is converted
+	// to local time. If nil, the date and time are kept as written.
+	Location *time.Location
+	// ReceiptZones converts a purchaseDateTime with a UTC offset to the
+	// local time of the receipt's own Timezone instead of Location, when
+	// the receipt names one.
+	ReceiptZones bool
+	// RetailerAlphanumeric rejects retailer names with no letter or digit,
+	// such as "&" or " - ", which the schema allows but which score no
+	// points for the name.
+	RetailerAlphanumeric bool
+	// Itemless accepts receipts with no items, which the schema's minItems
+	// of 1 otherwise refuses. The rules that count items award them
+	// nothing.
+	Itemless bool
+}
+
+var (
+	usDateLayouts     = []string{"1/2/2006"}
+	twelveHourLayouts = []string{"3:04PM", "3:04 PM"}
+	// dateTimeLayouts pair with whether the layout carries a UTC offset.
+	dateTimeLayouts = []struct {
+		layout string
+		zoned  bool
+	}{
+		{time.RFC3339, true},
+		{"2006-01-02T15:04Z07:00", true},
+		{"2006-01-02T15:04:05", false},
+		{"2006-01-02T15:04", false},
+	}
+)
+
+// Normalize rewrites the purchase date and time of receipt into the
+// canonical layouts, from whichever layout f accepts they are written in.
+// Fields it cannot read are reported and left as they were.
+func (f InputFormats) Normalize(receipt Receipt) (Receipt, []FieldError) {
+	var errs []FieldError
+	fail := func(field, constraint string, value any, message string) {
+		errs = append(errs, NewFieldError(field, constraint, value, message))
+	}
+
+	if receipt.PurchaseDateTime != "" {
+		switch {
+		case !f.DateTimes:
+			fail("purchaseDateTime", ConstraintNotAllowed, receipt.PurchaseDateTime, "is not accepted; send purchaseDate and purchaseTime")
+		case receipt.PurchaseDate != "" || receipt.PurchaseTime != "":
+			fail("purchaseDateTime", ConstraintConflict, receipt.PurchaseDateTime, "cannot be used together with purchaseDate or purchaseTime")
+		default:
+			t, ok := f.parseDateTime(receipt.PurchaseDateTime, receipt.Timezone)
+			if !ok {
+				fail("purchaseDateTime", ConstraintFormat, receipt.PurchaseDateTime, "must be an ISO 8601 date and time, e.g. 2022-01-01T13:01")
+				break
+			}
+			receipt.PurchaseDate, receipt.PurchaseTime = t.Format(DateLayout), t.Format(TimeLayout)
+			receipt.PurchaseDateTime = ""
+		}
+		return receipt, errs
+	}
+
+	layouts := []string{DateLayout}
+	message := "must be a calendar date in YYYY-MM-DD format"
+	if f.USDates {
+		layouts = append(layouts, usDateLayouts...)
+		message = "must be a calendar date in YYYY-MM-DD or MM/DD/YYYY format"
+	}
+	if t, ok := parseAny(layouts, strings.TrimSpace(receipt.PurchaseDate)); ok {
+		receipt.PurchaseDate = t.Format(DateLayout)
+	} else {
+		errs = append(errs, stringFieldError("purchaseDate", ConstraintFormat, receipt.PurchaseDate, message))
+	}
+
+	// An hour without its leading zero is not canonical, so HH:MM is
+	// matched exactly as well as parsed.
+	if _, err := time.Parse(TimeLayout, receipt.PurchaseTime); err == nil && timePattern.MatchString(receipt.PurchaseTime) {
+		return receipt, errs
+	}
+	if f.TwelveHourTimes {
+		clock := strings.ToUpper(strings.TrimSpace(receipt.PurchaseTime))
+		if t, ok := parseAny(twelveHourLayouts, clock); ok {
+			receipt.PurchaseTime = t.Format(TimeLayout)
+			return receipt, errs
+		}
+		errs = append(errs, stringFieldError("purchaseTime", ConstraintFormat, receipt.PurchaseTime,
+			"must be a 24-hour time in HH:MM format or a 12-hour time such as 2:05 PM"))
+		return receipt, errs
+	}
+	errs = append(errs, stringFieldError("purchaseTime", ConstraintFormat, receipt.PurchaseTime, "must be a 24-hour time in HH:MM format"))
+	return receipt, errs
+}
+
+func (f InputFormats) parseDateTime(value, zone string) (time.Time, bool) {
+	loc := f.Location
+	if receiptLoc, ok := LoadZone(zone); ok && f.ReceiptZones {
+		loc = receiptLoc
+	}
+	for _, l := range dateTimeLayouts {
+		t, err := time.Parse(l.layout, value)
+		if err != nil {
+			continue
+		}
+		if l.zoned && loc != nil {
+			t = t.In(loc)
+		}
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+func parseAny(layouts []string, value string) (time.Time, bool) {
+	for _, layout := range layouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// ValidateInput normalizes receipt with f and validates the result, as
+// Validate does. Each failing field is reported once, with the message that
+// names the layouts f accepts.
+func (f InputFormats) ValidateInput(receipt Receipt) (Receipt, []FieldError) {
+	receipt, errs := f.Normalize(receipt)
+	reported := make(map[string]bool, len(errs))
+	for _, err := range errs {
+		reported[err.Field] = true
+	}
+	if receipt.PurchaseDateTime != "" {
+		// It could not be split, so the fields it stands in for are
+		// missing because of it.
+		reported["purchaseDate"], reported["purchaseTime"] = true, true
+	}
+	for _, err := range validate(receipt, f.RetailerAlphanumeric, f.Itemless) {
+		if !reported[err.Field] {
+			errs = append(errs, err)
+		}
+	}
+	return receipt, errs
+}
@@ -0,0 +1,109 @@
+package points
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestNormalize(t *testing.T) {
+	all := InputFormats{USDates: true, TwelveHourTimes: true, DateTimes: true}
+	tests := []struct {
+		name               string
+		formats            InputFormats
+		date, time, either string
+		wantDate, wantTime string
+		wantErrs           []string
+	}{
+		{"canonical", InputFormats{}, "2022-01-01", "13:01", "", "2022-01-01", "13:01", nil},
+		{"canonical with every format", all, "2022-01-01", "13:01", "", "2022-01-01", "13:01", nil},
+		{"US date", all, "01/02/2022", "13:01", "", "2022-01-02", "13:01", nil},
+		{"US date without zeros", all, "1/2/2022", "13:01", "", "2022-01-02", "13:01", nil},
+		// An ambiguous date is read month first: March 4, not April 3.
+		{"ambiguous US date", all, "03/04/2022", "13:01", "", "2022-03-04", "13:01", nil},
+		{"US date with day first", all, "13/04/2022", "13:01", "", "13/04/2022", "13:01", []string{"purchaseDate"}},
+		{"US date not accepted", InputFormats{}, "01/02/2022", "13:01", "", "01/02/2022", "13:01", []string{"purchaseDate"}},
+		{"12-hour time", all, "2022-01-01", "2:05 PM", "", "2022-01-01", "14:05", nil},
+		{"12-hour time without a space", all, "2022-01-01", "02:05pm", "", "2022-01-01", "14:05", nil},
+		{"midnight", all, "2022-01-01", "12:00 AM", "", "2022-01-01", "00:00", nil},
+		{"noon", all, "2022-01-01", "12:00 PM", "", "2022-01-01", "12:00", nil},
+		{"12-hour time past 12", all, "2022-01-01", "13:05 PM", "", "2022-01-01", "13:05 PM", []string{"purchaseTime"}},
+		{"12-hour time not accepted", InputFormats{}, "2022-01-01", "2:05 PM", "", "2022-01-01", "2:05 PM", []string{"purchaseTime"}},
+		{"hour without its zero", InputFormats{}, "2022-01-01", "9:05", "", "2022-01-01", "9:05", []string{"purchaseTime"}},
+		{"date and time", all, "", "", "2022-01-01T13:01", "2022-01-01", "13:01", nil},
+		{"date and time with seconds", all, "", "", "2022-01-01T13:01:59", "2022-01-01", "13:01", nil},
+		{"date and time with an offset", all, "", "", "2022-01-01T13:01:00-05:00", "2022-01-01", "13:01", nil},
+		{"date and time not accepted", InputFormats{}, "", "", "2022-01-01T13:01", "", "", []string{"purchaseDateTime"}},
+		{"date and time with a date", all, "2022-01-01", "", "2022-01-01T13:01", "2022-01-01", "", []string{"purchaseDateTime"}},
+		{"unreadable date and time", all, "", "", "01/01/2022 1:01 PM", "", "", []string{"purchaseDateTime"}},
+		{"unreadable", all, "Jan 1 2022", "1pm", "", "Jan 1 2022", "1pm", []string{"purchaseDate", "purchaseTime"}},
+	}
+	for _, tt := range tests {
+		receipt := testReceipt()
+		receipt.PurchaseDate, receipt.PurchaseTime, receipt.PurchaseDateTime = tt.date, tt.time, tt.either
+		got, errs := tt.formats.Normalize(receipt)
+		if got.PurchaseDate != tt.wantDate || got.PurchaseTime != tt.wantTime {
+			t.Errorf("%s: Normalize = %q %q, want %q %q", tt.name, got.PurchaseDate, got.PurchaseTime, tt.wantDate, tt.wantTime)
+		}
+		var fields []string
+		for _, err := range errs {
+			fields = append(fields, err.Field)
+		}
+		if !slices.Equal(fields, tt.wantErrs) {
+			t.Errorf("%s: errors on %v, want %v", tt.name, fields, tt.wantErrs)
+		}
+	}
+}
+
+func TestNormalizeDateTimeLocation(t *testing.T) {
+	formats := InputFormats{DateTimes: true, Location: time.UTC}
+	receipt := testReceipt()
+	receipt.PurchaseDate, receipt.PurchaseTime = "", ""
+	receipt.PurchaseDateTime = "2022-01-01T21:30:00-05:00"
+	got, errs := formats.Normalize(receipt)
+	if len(errs) > 0 || got.PurchaseDate != "2022-01-02" || got.PurchaseTime != "02:30" || got.PurchaseDateTime != "" {
+		t.Errorf("Normalize = %q %q %q, %v, want 2022-01-02 02:30 in UTC", got.PurchaseDate, got.PurchaseTime, got.PurchaseDateTime, errs)
+	}
+
+	// Without an offset there is nothing to convert from.
+	receipt.PurchaseDateTime = "2022-01-01T21:30"
+	if got, _ := formats.Normalize(receipt); got.PurchaseDate != "2022-01-01" || got.PurchaseTime != "21:30" {
+		t.Errorf("Normalize without an offset = %q %q, want it as written", got.PurchaseDate, got.PurchaseTime)
+	}
+}
+
+// TestNormalizedReceiptsScore checks that receipts written in the other
+// layouts keep the odd day and afternoon bonuses their canonical forms get.
+func TestNormalizedReceiptsScore(t *testing.T) {
+	formats := InputFormats{USDates: true, TwelveHourTimes: true}
+	canonical, err := Calculate(targetReceipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receipt := targetReceipt
+	receipt.PurchaseDate, receipt.PurchaseTime = "1/1/2022", "2:30 PM"
+	normalized, errs := formats.ValidateInput(receipt)
+	if len(errs) > 0 {
+		t.Fatalf("ValidateInput: %v", errs)
+	}
+	if got, err := Calculate(normalized); err != nil || got != canonical+10 {
+		t.Errorf("points of the normalized receipt = %d, %v, want %d with the afternoon bonus", got, err, canonical+10)
+	}
+}
+
+func TestValidateInputReportsEachFieldOnce(t *testing.T) {
+	receipt := testReceipt()
+	receipt.PurchaseDate = "02/30/2022"
+	_, errs := InputFormats{USDates: true}.ValidateInput(receipt)
+	if len(errs) != 1 || errs[0].Field != "purchaseDate" || errs[0].Message != "must be a calendar date in YYYY-MM-DD or MM/DD/YYYY format" {
+		t.Errorf("errors = %+v, want one naming both layouts", errs)
+	}
+
+	receipt = testReceipt()
+	receipt.PurchaseDate, receipt.PurchaseTime, receipt.PurchaseDateTime = "", "", "soon"
+	_, errs = InputFormats{DateTimes: true}.ValidateInput(receipt)
+	if len(errs) != 1 || errs[0].Field != "purchaseDateTime" {
+		t.Errorf("errors = %+v, want one on purchaseDateTime alone", errs)
+	}
+}
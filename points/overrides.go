@@ -0,0 +1,114 @@
+package points
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// retailerOverrideRule names the breakdown entry of each override applied.
+const retailerOverrideRule = "retailer-override"
+
+// RetailerOverride adjusts the points of receipts from matching retailers
+// once the rules have scored them, so that partners can be given boosted
+// earn rates. It either multiplies the points awarded so far by Multiplier
+// or adds Bonus to them.
+type RetailerOverride struct {
+	// Name identifies the override in breakdowns. It defaults to the
+	// retailer or pattern matched.
+	Name string `json:"name,omitempty"`
+	// Retailer matches the retailer name exactly, ignoring case and
+	// surrounding whitespace. Pattern instead matches names containing a
+	// match of a regular expression, such as "^Walmart". Exactly one of
+	// them is set.
+	Retailer   string `json:"retailer,omitempty"`
+	Pattern    string `json:"pattern,omitempty"`
+	Multiplier int    `json:"multiplier,omitempty"`
+	Bonus      int    `json:"bonus,omitempty"`
+
+	pattern *regexp.Regexp // Pattern compiled, once validated
+}
+
+// prepare validates o and compiles its pattern.
+func (o *RetailerOverride) prepare() error {
+	switch {
+	case o.Retailer == "" && o.Pattern == "":
+		return errors.New("one of retailer and pattern must be set")
+	case o.Retailer != "" && o.Pattern != "":
+		return errors.New("retailer and pattern cannot both be set")
+	case (o.Multiplier == 0) == (o.Bonus == 0):
+		return errors.New("exactly one of multiplier and bonus must be set")
+	case o.Multiplier < 0:
+		return errors.New("multiplier must be positive")
+	case o.Bonus < 0:
+		return errors.New("bonus must be positive")
+	}
+	if o.Pattern != "" {
+		pattern, err := regexp.Compile(o.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern: %w", err)
+		}
+		o.pattern = pattern
+	}
+	return nil
+}
+
+// name returns the name o is shown under.
+func (o RetailerOverride) name() string {
+	switch {
+	case o.Name != "":
+		return o.Name
+	case o.Retailer != "":
+		return o.Retailer
+	}
+	return o.Pattern
+}
+
+// matches reports whether o applies to receipts from retailer.
+func (o RetailerOverride) matches(retailer string) bool {
+	retailer = strings.TrimSpace(retailer)
+	if o.Pattern == "" {
+		return strings.EqualFold(retailer, strings.TrimSpace(o.Retailer))
+	}
+	pattern := o.pattern
+	if pattern == nil {
+		// Not loaded from a rules file, so not yet compiled.
+		var err error
+		if pattern, err = regexp.Compile(o.Pattern); err != nil {
+			return false
+		}
+	}
+	return pattern.MatchString(retailer)
+}
+
+// target describes the retailers o matches.
+func (o RetailerOverride) target() string {
+	if o.Pattern != "" {
+		return fmt.Sprintf("pattern %q", o.Pattern)
+	}
+	return fmt.Sprintf("retailer %q", strings.TrimSpace(o.Retailer))
+}
+
+// Description explains o as the breakdown does.
+func (o RetailerOverride) Description() string {
+	retailers := fmt.Sprintf("retailer %s", strings.TrimSpace(o.Retailer))
+	if o.Pattern != "" {
+		retailers = fmt.Sprintf("retailers matching %s", o.Pattern)
+	}
+	if o.Multiplier != 0 {
+		return fmt.Sprintf("%s: multiply the points by %d for %s.", o.name(), o.Multiplier, retailers)
+	}
+	return fmt.Sprintf("%s: %d bonus points for %s.", o.name(), o.Bonus, retailers)
+}
+
+// apply adjusts points, the points awarded so far, returning the points
+// awarded with o and how they were derived.
+func (o RetailerOverride) apply(points int64) (int64, string) {
+	if o.Multiplier != 0 {
+		adjusted := mulPoints(points, int64(o.Multiplier))
+		return adjusted, fmt.Sprintf("%d points * %d is %d points", points, o.Multiplier, adjusted)
+	}
+	adjusted := addPoints(points, int64(o.Bonus))
+	return adjusted, fmt.Sprintf("%d points + %d is %d points", points, o.Bonus, adjusted)
+}
@@ -0,0 +1,96 @@
+package points
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestRetailerOverridesApplyInOrder checks that each matching override
+// adjusts the points the ones before it left, and is named in the breakdown.
+func TestRetailerOverridesApplyInOrder(t *testing.T) {
+	bonus := RetailerOverride{Name: "launch-bonus", Retailer: " target ", Bonus: 10}
+	double := RetailerOverride{Pattern: "^Tar", Multiplier: 2}
+	other := RetailerOverride{Retailer: "Walgreens", Bonus: 100}
+	tests := []struct {
+		name      string
+		overrides []RetailerOverride
+		total     int
+		applied   []RuleResult
+	}{
+		{"none", nil, 28, nil},
+		{"bonus then double", []RetailerOverride{bonus, other, double}, 76, []RuleResult{
+			{Rule: retailerOverrideRule, Description: "launch-bonus: 10 bonus points for retailer target.", Points: 10},
+			{Rule: retailerOverrideRule, Description: "^Tar: multiply the points by 2 for retailers matching ^Tar.", Points: 38},
+		}},
+		{"double then bonus", []RetailerOverride{double, bonus}, 66, []RuleResult{
+			{Rule: retailerOverrideRule, Description: "^Tar: multiply the points by 2 for retailers matching ^Tar.", Points: 28},
+			{Rule: retailerOverrideRule, Description: "launch-bonus: 10 bonus points for retailer target.", Points: 10},
+		}},
+		{"no match", []RetailerOverride{other}, 28, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultRulesConfig()
+			config.RetailerOverrides = tt.overrides
+			breakdown := config.Breakdown(targetReceipt)
+			if breakdown.Total != tt.total {
+				t.Errorf("total = %d, want %d", breakdown.Total, tt.total)
+			}
+
+			var applied []RuleResult
+			for _, result := range breakdown.Rules {
+				if result.Rule == retailerOverrideRule {
+					applied = append(applied, result)
+				}
+			}
+			if len(applied) != len(tt.applied) {
+				t.Fatalf("breakdown lists %d overrides, want %d: %+v", len(applied), len(tt.applied), applied)
+			}
+			for i, want := range tt.applied {
+				got := applied[i]
+				if got.Description != want.Description || got.Points != want.Points {
+					t.Errorf("override %d = %q for %d points, want %q for %d", i, got.Description, got.Points, want.Description, want.Points)
+				}
+				if len(got.Details) == 0 || !strings.Contains(got.Details[0], `"Target" matches`) {
+					t.Errorf("override %d details %q do not say what matched", i, got.Details)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadRulesConfigRetailerOverrides(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	write := func(overrides string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(`{"retailerOverrides": `+overrides+`}`), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`[{"pattern": "(?i)^m&m", "multiplier": 3}]`)
+	config, err := LoadRulesConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := config.Calculate(marketReceipt); got != 327 {
+		t.Errorf("points with the loaded override = %d, want 327", got)
+	}
+
+	for _, overrides := range []string{
+		`[{"multiplier": 2}]`,
+		`[{"retailer": "Target", "pattern": "^T", "bonus": 1}]`,
+		`[{"retailer": "Target"}]`,
+		`[{"retailer": "Target", "multiplier": 2, "bonus": 1}]`,
+		`[{"retailer": "Target", "multiplier": -2}]`,
+		`[{"retailer": "Target", "bonus": -1}]`,
+		`[{"pattern": "(", "bonus": 1}]`,
+	} {
+		write(overrides)
+		if _, err := LoadRulesConfig(path); err == nil {
+			t.Errorf("LoadRulesConfig accepted overrides %s", overrides)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package points
+
+import (
+	"errors"
+	"testing"
+)
+
+// The two examples of the challenge's README, scored by hand there.
+var (
+	targetReceipt = Receipt{
+		Retailer:     "Target",
+		PurchaseDate: "2022-01-01",
+		PurchaseTime: "13:01",
+		Items: []Item{
+			{ShortDescription: "Mountain Dew 12PK", Price: "6.49"},
+			{ShortDescription: "Emils Cheese Pizza", Price: "12.25"},
+			{ShortDescription: "Knorr Creamy Chicken", Price: "1.26"},
+			{ShortDescription: "Doritos Nacho Cheese", Price: "3.35"},
+			{ShortDescription: "   Klarbrunn 12-PK 12 FL OZ  ", Price: "12.00"},
+		},
+		Total: "35.35",
+	}
+	marketReceipt = Receipt{
+		Retailer:     "M&M Corner Market",
+		PurchaseDate: "2022-03-20",
+		PurchaseTime: "14:33",
+		Items: []Item{
+			{ShortDescription: "Gatorade", Price: "2.25"},
+			{ShortDescription: "Gatorade", Price: "2.25"},
+			{ShortDescription: "Gatorade", Price: "2.25"},
+			{ShortDescription: "Gatorade", Price: "2.25"},
+		},
+		Total: "9.00",
+	}
+)
+
+func TestCalculate(t *testing.T) {
+	tests := []struct {
+		name    string
+		receipt Receipt
+		want    int
+		// rules holds the points of each rule, by name.
+		rules map[string]int
+	}{
+		{
+			name:    "target",
+			receipt: targetReceipt,
+			want:    28,
+			rules: map[string]int{
+				"retailer-name":           6,
+				"round-dollar-total":      0,
+				"quarter-multiple-total":  0,
+				"item-pairs":              10,
+				"item-description-length": 6,
+				"odd-purchase-day":        6,
+				"afternoon-purchase-time": 0,
+			},
+		},
+		{
+			name:    "m&m corner market",
+			receipt: marketReceipt,
+			want:    109,
+			rules: map[string]int{
+				"retailer-name":           14,
+				"round-dollar-total":      50,
+				"quarter-multiple-total":  25,
+				"item-pairs":              10,
+				"item-description-length": 0,
+				"odd-purchase-day":        0,
+				"afternoon-purchase-time": 10,
+			},
+		},
+		{
+			name: "single item",
+			receipt: Receipt{
+				Retailer:     "Walgreens",
+				PurchaseDate: "2022-01-02",
+				PurchaseTime: "08:13",
+				Items:        []Item{{ShortDescription: "Pepsi - 12-oz", Price: "1.25"}},
+				Total:        "1.25",
+			},
+			// 9 for the name and 25 for a multiple of 0.25; one item
+			// is no pair, and 13 characters no multiple of 3.
+			want: 34,
+		},
+		{
+			name: "three items",
+			receipt: Receipt{
+				Retailer:     "Walgreens",
+				PurchaseDate: "2022-01-03",
+				PurchaseTime: "15:59",
+				Items: []Item{
+					{ShortDescription: "Pepsi - 12-oz", Price: "1.25"},
+					{ShortDescription: "Dasani", Price: "1.40"},
+					{ShortDescription: "Dasani", Price: "1.40"},
+				},
+				Total: "4.05",
+			},
+			// 9 for the name, 5 for a pair, 1 for each Dasani (0.28
+			// rounded up), 6 for the day and 10 for the time.
+			want: 32,
+		},
+		{
+			name: "no alphanumeric retailer characters",
+			receipt: Receipt{
+				Retailer:     "&-&",
+				PurchaseDate: "2022-01-02",
+				PurchaseTime: "10:00",
+				Items:        []Item{{ShortDescription: "Gum", Price: "1.00"}},
+				Total:        "1.00",
+			},
+			// 50 and 25 for a round total, and 1 for "Gum" (0.2
+			// rounded up).
+			want: 76,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Calculate(tt.receipt)
+			if err != nil || got != tt.want {
+				t.Fatalf("Calculate = %d, %v, want %d", got, err, tt.want)
+			}
+			breakdown := DefaultRulesConfig().Breakdown(tt.receipt)
+			if breakdown.Total != tt.want {
+				t.Errorf("Breakdown total = %d, want %d", breakdown.Total, tt.want)
+			}
+			for _, result := range breakdown.Rules {
+				if want, ok := tt.rules[result.Rule]; ok && result.Points != want {
+					t.Errorf("rule %s awarded %d, want %d (%v)", result.Rule, result.Points, want, result.Details)
+				}
+			}
+		})
+	}
+}
+
+func TestCalculateRejectsInvalidReceipts(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(*Receipt)
+		field  string
+	}{
+		{"no retailer", func(r *Receipt) { r.Retailer = "" }, "retailer"},
+		{"bad date", func(r *Receipt) { r.PurchaseDate = "2022-02-30" }, "purchaseDate"},
+		{"bad time", func(r *Receipt) { r.PurchaseTime = "25:00" }, "purchaseTime"},
+		{"no items", func(r *Receipt) { r.Items = nil }, "items"},
+		{"bad price", func(r *Receipt) { r.Items = []Item{{ShortDescription: "Gum", Price: "1"}} }, "items[0].price"},
+		{"bad total", func(r *Receipt) { r.Total = "35.3" }, "total"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receipt := targetReceipt
+			receipt.Items = append([]Item(nil), targetReceipt.Items...)
+			tt.change(&receipt)
+			got, err := Calculate(receipt)
+			var invalid ValidationError
+			if !errors.As(err, &invalid) || got != 0 {
+				t.Fatalf("Calculate = %d, %v, want a ValidationError", got, err)
+			}
+			if _, ok := fieldError(invalid, tt.field); !ok {
+				t.Errorf("errors %v do not name %s", invalid, tt.field)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+// Package points implements the receipt scoring rules of the receipt
+// processor challenge: validating receipts and calculating the points they
+// are awarded.
+package points
+
+import "fmt"
+
+// Receipt is a purchase receipt as submitted to the API.
+type Receipt struct {
+	Retailer     string `json:"retailer" xml:"retailer"`
+	PurchaseDate string `json:"purchaseDate" xml:"purchaseDate"`
+	PurchaseTime string `json:"purchaseTime" xml:"purchaseTime"`
+	// PurchaseDateTime may be sent instead of PurchaseDate and
+	// PurchaseTime; InputFormats.Normalize splits it into them.
+	PurchaseDateTime string `json:"purchaseDateTime,omitempty" xml:"purchaseDateTime,omitempty"`
+	Items            []Item `json:"items" xml:"items>item"`
+	Total            Money  `json:"total" xml:"total"`
+	// Timezone is the IANA name of the time zone the purchase date and
+	// time are local to, such as America/Denver, if the client gave one.
+	Timezone string `json:"timezone,omitempty" xml:"timezone,omitempty"`
+}
+
+// Item is a single line of a receipt. Price is the price of the whole line,
+// whatever its Quantity.
+type Item struct {
+	ShortDescription string `json:"shortDescription" xml:"shortDescription"`
+	Price            Money  `json:"price" xml:"price"`
+	// Quantity is how many units the line is for, if the point-of-sale
+	// system said; see Units.
+	Quantity *int `json:"quantity,omitempty" xml:"quantity,omitempty"`
+}
+
+// Units returns how many units the item is for: its Quantity, or 1 if it
+// has none.
+func (i Item) Units() int {
+	if i.Quantity == nil {
+		return 1
+	}
+	return *i.Quantity
+}
+
+// RuleResult records how a single scoring rule applied to a receipt.
+type RuleResult struct {
+	Rule        string   `json:"rule" xml:"rule"`
+	Description string   `json:"description" xml:"description"`
+	Points      int      `json:"points" xml:"points"`
+	Details     []string `json:"details,omitempty" xml:"details>detail,omitempty"`
+}
+
+// RetailerResult records how the retailer name rule (rule 1) counted the
+// characters of the retailer name.
+type RetailerResult struct {
+	// Counted is how many characters were counted as alphanumeric.
+	Counted int `json:"counted"`
+	// Excluded lists every other character, once, in the order they first
+	// appear.
+	Excluded []ExcludedCharacter `json:"excluded,omitempty"`
+}
+
+// ExcludedCharacter is a character the retailer name rule did not count,
+// with how many times it appears in the name. Code is its code point, such
+// as U+00A0, so that spaces and invisible characters can be told apart.
+type ExcludedCharacter struct {
+	Character string `json:"character"`
+	Code      string `json:"code"`
+	Count     int    `json:"count"`
+}
+
+// ItemResult records how the item description length rule (rule 5) applied
+// to a single item.
+type ItemResult struct {
+	// Description is the item's description with surrounding whitespace
+	// trimmed, and Length its length in characters.
+	Description string `json:"description"`
+	Length      int    `json:"length"`
+	// Matched reports whether Length is a multiple of the rule's length
+	// multiple, so that the item earned Points.
+	Matched bool `json:"matched"`
+	Points  int  `json:"points"`
+}
+
+// Breakdown explains how the points awarded to a receipt were derived.
+// Items lists each item in receipt order; its points are already counted in
+// the item description length rule. Warnings point out anything suspicious
+// about the receipt that did not stop it from being scored.
+type Breakdown struct {
+	Rules    []RuleResult `json:"rules"`
+	Items    []ItemResult `json:"items,omitempty"`
+	Total    int          `json:"total"`
+	Warnings []string     `json:"warnings,omitempty"`
+
+	// Retailer shows which characters of the retailer name the retailer
+	// name rule counted. It is omitted from breakdowns stored before it
+	// was added.
+	Retailer *RetailerResult `json:"retailer,omitempty"`
+
+	// Itemless is set for a receipt without items, accepted because
+	// itemless receipts are allowed (see InputFormats.Itemless). The rules
+	// that count items award it nothing.
+	Itemless bool `json:"itemless,omitempty"`
+}
+
+// Calculate validates a receipt and scores it with the default rules. The
+// error is a ValidationError if the receipt is invalid.
+func Calculate(receipt Receipt) (int, error) {
+	return defaultRules.Calculate(receipt)
+}
+
+// Calculate validates a receipt and scores it with c. The error is a
+// ValidationError if the receipt is invalid.
+func (c RulesConfig) Calculate(receipt Receipt) (int, error) {
+	if errs := Validate(receipt); len(errs) > 0 {
+		return 0, ValidationError(errs)
+	}
+	return c.Breakdown(receipt).Total, nil
+}
+
+// Breakdown scores a receipt that has passed Validate with the enabled rules
+// of c, explaining how each one applied. Each retailer override that matches
+// is listed after the rules, with the points it added.
+func (c RulesConfig) Breakdown(receipt Receipt) Breakdown {
+	breakdown := Breakdown{Rules: []RuleResult{}}
+	// Each rule's points are capped rather than wrapped, and so is their
+	// sum, so no receipt scores negative.
+	var total int64
+	for _, rule := range c.Rules() {
+		points, details := rule.Evaluate(receipt)
+		breakdown.Rules = append(breakdown.Rules, RuleResult{
+			Rule:        rule.Name(),
+			Description: rule.Description(),
+			Points:      points,
+			Details:     details,
+		})
+		total = addPoints(total, int64(points))
+	}
+	for _, override := range c.RetailerOverrides {
+		if !override.matches(receipt.Retailer) {
+			continue
+		}
+		adjusted, detail := override.apply(total)
+		breakdown.Rules = append(breakdown.Rules, RuleResult{
+			Rule:        retailerOverrideRule,
+			Description: override.Description(),
+			Points:      toInt(adjusted - total),
+			Details:     []string{fmt.Sprintf("%q matches %s", receipt.Retailer, override.target()), detail},
+		})
+		total = adjusted
+	}
+	breakdown.Total = toInt(total)
+	breakdown.Items = c.ItemDescriptionLength.items(receipt)
+	retailer := countRetailer(receipt.Retailer)
+	breakdown.Retailer = &retailer
+	breakdown.Itemless = len(receipt.Items) == 0
+	if mismatch, ok := CheckTotal(receipt); !ok {
+		breakdown.Warnings = append(breakdown.Warnings, mismatch.Error())
+	}
+	return breakdown
+}
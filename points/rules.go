@@ -0,0 +1,531 @@
+package points
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// defaultRulesVersion is the version reported for the compiled-in rules.
+const defaultRulesVersion = "default"
+
+// Rule is a single scoring rule. Evaluate is only called on receipts that
+// have passed Validate; details explain how the points were derived.
+type Rule interface {
+	Name() string
+	Description() string
+	Evaluate(receipt Receipt) (points int, details []string)
+}
+
+// RulesConfig holds the tunable parameters of the scoring rules. Fields left
+// out of a rules file keep their defaults.
+type RulesConfig struct {
+	// Version identifies the ruleset. A rules file that does not set it is
+	// identified by a hash of its contents.
+	Version               string                    `json:"version"`
+	RetailerName          RetailerNameRule          `json:"retailerName"`
+	RoundDollarTotal      RoundDollarTotalRule      `json:"roundDollarTotal"`
+	QuarterMultipleTotal  QuarterMultipleTotalRule  `json:"quarterMultipleTotal"`
+	ItemPairs             ItemPairsRule             `json:"itemPairs"`
+	ItemDescriptionLength ItemDescriptionLengthRule `json:"itemDescriptionLength"`
+	OddPurchaseDay        OddPurchaseDayRule        `json:"oddPurchaseDay"`
+	TimeWindow            TimeWindowRule            `json:"timeWindow"`
+	// RetailerOverrides apply after the rules, in order, to the receipts of
+	// the retailers they match.
+	RetailerOverrides []RetailerOverride `json:"retailerOverrides,omitempty"`
+	// ZoneAware has the odd purchase day and time window rules read the
+	// purchase date and time of receipts that name a Timezone in that
+	// zone. It is a server setting rather than part of a rules file.
+	ZoneAware bool `json:"-"`
+}
+
+// defaultRules is the configuration the package-level Calculate scores with.
+var defaultRules = DefaultRulesConfig()
+
+// DefaultRulesConfig returns the rules as published in the challenge.
+func DefaultRulesConfig() RulesConfig {
+	return RulesConfig{
+		Version:               defaultRulesVersion,
+		RetailerName:          RetailerNameRule{Enabled: true, PointsPerCharacter: 1},
+		RoundDollarTotal:      RoundDollarTotalRule{Enabled: true, Points: 50},
+		QuarterMultipleTotal:  QuarterMultipleTotalRule{Enabled: true, Points: 25},
+		ItemPairs:             ItemPairsRule{Enabled: true, PointsPerPair: 5},
+		ItemDescriptionLength: ItemDescriptionLengthRule{Enabled: true, LengthMultiple: 3, PricePercent: 20},
+		OddPurchaseDay:        OddPurchaseDayRule{Enabled: true, Points: 6},
+		TimeWindow:            TimeWindowRule{Enabled: true, Points: 10, Start: "14:00", End: "16:00"},
+	}
+}
+
+// LoadRulesConfig reads a JSON rules file over the default configuration.
+func LoadRulesConfig(path string) (RulesConfig, error) {
+	config := DefaultRulesConfig()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	config.Version = ""
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if err := config.validate(); err != nil {
+		return config, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if config.Version == "" {
+		sum := sha256.Sum256(data)
+		config.Version = "sha256:" + hex.EncodeToString(sum[:6])
+	}
+	return config, nil
+}
+
+// Hash identifies the scoring parameters of c, ignoring Version, so
+// rulesets that score alike hash alike.
+func (c RulesConfig) Hash() string {
+	c.Version = ""
+	data, _ := json.Marshal(c)
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:6])
+}
+
+func (c RulesConfig) validate() error {
+	checks := []struct {
+		name string
+		err  error
+	}{
+		{"retailerName", nonNegative("pointsPerCharacter", c.RetailerName.PointsPerCharacter)},
+		{"roundDollarTotal", nonNegative("points", c.RoundDollarTotal.Points)},
+		{"quarterMultipleTotal", nonNegative("points", c.QuarterMultipleTotal.Points)},
+		{"itemPairs", nonNegative("pointsPerPair", c.ItemPairs.PointsPerPair)},
+		{"itemDescriptionLength", c.ItemDescriptionLength.validate()},
+		{"oddPurchaseDay", nonNegative("points", c.OddPurchaseDay.Points)},
+		{"timeWindow", c.TimeWindow.validate()},
+	}
+	for _, check := range checks {
+		if check.err != nil {
+			return fmt.Errorf("%s: %w", check.name, check.err)
+		}
+	}
+	// The overrides share their backing array with the caller's config, so
+	// the patterns compiled here are kept.
+	for i := range c.RetailerOverrides {
+		if err := c.RetailerOverrides[i].prepare(); err != nil {
+			return fmt.Errorf("retailerOverrides[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func nonNegative(name string, value int) error {
+	if value < 0 {
+		return fmt.Errorf("%s must not be negative", name)
+	}
+	return nil
+}
+
+// Rules returns the enabled rules in the order they are applied.
+func (c RulesConfig) Rules() []Rule {
+	c.OddPurchaseDay.zoneAware = c.ZoneAware
+	c.TimeWindow.zoneAware = c.ZoneAware
+	all := []struct {
+		enabled bool
+		rule    Rule
+	}{
+		{c.RetailerName.Enabled, c.RetailerName},
+		{c.RoundDollarTotal.Enabled, c.RoundDollarTotal},
+		{c.QuarterMultipleTotal.Enabled, c.QuarterMultipleTotal},
+		{c.ItemPairs.Enabled, c.ItemPairs},
+		{c.ItemDescriptionLength.Enabled, c.ItemDescriptionLength},
+		{c.OddPurchaseDay.Enabled, c.OddPurchaseDay},
+		{c.TimeWindow.Enabled, c.TimeWindow},
+	}
+	var enabled []Rule
+	for _, r := range all {
+		if r.enabled {
+			enabled = append(enabled, r.rule)
+		}
+	}
+	return enabled
+}
+
+// RetailerNameRule awards points for every alphanumeric character in the
+// retailer name (rule 1).
+type RetailerNameRule struct {
+	Enabled            bool `json:"enabled"`
+	PointsPerCharacter int  `json:"pointsPerCharacter"`
+}
+
+func (RetailerNameRule) Name() string { return "retailer-name" }
+
+func (r RetailerNameRule) Description() string {
+	if r.PointsPerCharacter == 1 {
+		return "One point for every alphanumeric character in the retailer name."
+	}
+	return fmt.Sprintf("%d points for every alphanumeric character in the retailer name.", r.PointsPerCharacter)
+}
+
+func (r RetailerNameRule) Evaluate(receipt Receipt) (int, []string) {
+	result := countRetailer(receipt.Retailer)
+	details := []string{fmt.Sprintf("%q has %d alphanumeric characters", receipt.Retailer, result.Counted)}
+	if len(result.Excluded) > 0 {
+		excluded := make([]string, len(result.Excluded))
+		for i, char := range result.Excluded {
+			excluded[i] = fmt.Sprintf("%q (%s) x%d", char.Character, char.Code, char.Count)
+		}
+		details = append(details, "not counted: "+strings.Join(excluded, ", "))
+	}
+	return toInt(mulPoints(int64(result.Counted), int64(r.PointsPerCharacter))), details
+}
+
+// countRetailer counts the alphanumeric characters of retailer, noting
+// those excluded. Whitespace of every kind is excluded alike.
+func countRetailer(retailer string) RetailerResult {
+	var result RetailerResult
+	excluded := make(map[rune]int) // index in result.Excluded
+	for _, char := range retailer {
+		if unicode.IsLetter(char) || unicode.IsDigit(char) {
+			result.Counted++
+			continue
+		}
+		i, ok := excluded[char]
+		if !ok {
+			i = len(result.Excluded)
+			excluded[char] = i
+			result.Excluded = append(result.Excluded, ExcludedCharacter{Character: string(char), Code: fmt.Sprintf("U+%04X", char)})
+		}
+		result.Excluded[i].Count++
+	}
+	return result
+}
+
+// RoundDollarTotalRule awards points if the total has no cents (rule 2).
+type RoundDollarTotalRule struct {
+	Enabled bool `json:"enabled"`
+	Points  int  `json:"points"`
+}
+
+func (RoundDollarTotalRule) Name() string { return "round-dollar-total" }
+
+func (r RoundDollarTotalRule) Description() string {
+	return fmt.Sprintf("%d points if the total is a round dollar amount with no cents.", r.Points)
+}
+
+func (r RoundDollarTotalRule) Evaluate(receipt Receipt) (int, []string) {
+	if total, _ := receipt.Total.Cents(); total%100 == 0 {
+		return r.Points, []string{fmt.Sprintf("total %s is a round dollar amount", receipt.Total)}
+	}
+	return 0, nil
+}
+
+// QuarterMultipleTotalRule awards points if the total is a multiple of 0.25
+// (rule 3).
+type QuarterMultipleTotalRule struct {
+	Enabled bool `json:"enabled"`
+	Points  int  `json:"points"`
+}
+
+func (QuarterMultipleTotalRule) Name() string { return "quarter-multiple-total" }
+
+func (r QuarterMultipleTotalRule) Description() string {
+	return fmt.Sprintf("%d points if the total is a multiple of 0.25.", r.Points)
+}
+
+func (r QuarterMultipleTotalRule) Evaluate(receipt Receipt) (int, []string) {
+	if total, _ := receipt.Total.Cents(); total%25 == 0 {
+		return r.Points, []string{fmt.Sprintf("total %s is a multiple of 0.25", receipt.Total)}
+	}
+	return 0, nil
+}
+
+// ItemPairsRule awards points for every two items on the receipt (rule 4).
+// With CountUnits, it counts the units of every item instead, so that six
+// sodas on one line with a quantity of 6 score as six lines of one would.
+type ItemPairsRule struct {
+	Enabled       bool `json:"enabled"`
+	PointsPerPair int  `json:"pointsPerPair"`
+	CountUnits    bool `json:"countUnits,omitempty"`
+}
+
+func (ItemPairsRule) Name() string { return "item-pairs" }
+
+func (r ItemPairsRule) Description() string {
+	if r.CountUnits {
+		return fmt.Sprintf("%d points for every two units on the receipt.", r.PointsPerPair)
+	}
+	return fmt.Sprintf("%d points for every two items on the receipt.", r.PointsPerPair)
+}
+
+func (r ItemPairsRule) Evaluate(receipt Receipt) (int, []string) {
+	if !r.CountUnits {
+		pairs := len(receipt.Items) / 2
+		return toInt(mulPoints(int64(pairs), int64(r.PointsPerPair))), []string{fmt.Sprintf("%d items (%d pairs @ %d points each)", len(receipt.Items), pairs, r.PointsPerPair)}
+	}
+	var units int64
+	for _, item := range receipt.Items {
+		units = addPoints(units, int64(item.Units()))
+	}
+	pairs := units / 2
+	return toInt(mulPoints(pairs, int64(r.PointsPerPair))), []string{fmt.Sprintf("%d units on %d items (%d pairs @ %d points each)", units, len(receipt.Items), pairs, r.PointsPerPair)}
+}
+
+// ItemDescriptionLengthRule awards PricePercent percent of an item's price,
+// rounded as Rounding says, for every item whose trimmed description length
+// is a multiple of LengthMultiple (rule 5).
+type ItemDescriptionLengthRule struct {
+	Enabled        bool `json:"enabled"`
+	LengthMultiple int  `json:"lengthMultiple"`
+	PricePercent   int  `json:"pricePercent"`
+	// Rounding defaults to RoundCeil.
+	Rounding Rounding `json:"rounding,omitempty"`
+	// PerUnit awards the points of an item with a Quantity for each unit,
+	// rounding each unit's share of the price separately, as if every unit
+	// were a line of its own, rather than once for the line.
+	PerUnit bool `json:"perUnit,omitempty"`
+}
+
+// Rounding is how a fractional number of points is rounded to a whole one.
+type Rounding string
+
+const (
+	RoundCeil   Rounding = "ceil"          // up
+	RoundHalfUp Rounding = "round-half-up" // to the nearest, halves up
+	RoundFloor  Rounding = "floor"         // down
+)
+
+func (r ItemDescriptionLengthRule) validate() error {
+	if r.LengthMultiple <= 0 {
+		return errors.New("lengthMultiple must be positive")
+	}
+	switch r.Rounding {
+	case "", RoundCeil, RoundHalfUp, RoundFloor:
+	default:
+		return fmt.Errorf("rounding must be %s, %s or %s", RoundCeil, RoundHalfUp, RoundFloor)
+	}
+	return nonNegative("pricePercent", r.PricePercent)
+}
+
+func (ItemDescriptionLengthRule) Name() string { return "item-description-length" }
+
+func (r ItemDescriptionLengthRule) Description() string {
+	rounding := "round up to the nearest integer"
+	switch r.Rounding {
+	case RoundHalfUp:
+		rounding = "round to the nearest integer, halves up"
+	case RoundFloor:
+		rounding = "round down to the nearest integer"
+	}
+	price := "the price"
+	if r.PerUnit {
+		price = "the price of each unit"
+	}
+	return fmt.Sprintf("If the trimmed length of the item description is a multiple of %d, multiply %s by %s and %s.",
+		r.LengthMultiple, price, r.multiplier(), rounding)
+}
+
+// rounded describes the rounding in the details of the points awarded.
+func (r ItemDescriptionLengthRule) rounded() string {
+	switch r.Rounding {
+	case RoundHalfUp:
+		return "rounded"
+	case RoundFloor:
+		return "rounded down"
+	}
+	return "rounded up"
+}
+
+// multiplier formats PricePercent as a decimal fraction, e.g. "0.2".
+func (r ItemDescriptionLengthRule) multiplier() string {
+	return strconv.FormatFloat(float64(r.PricePercent)/100, 'f', -1, 64)
+}
+
+func (r ItemDescriptionLengthRule) Evaluate(receipt Receipt) (int, []string) {
+	var points int64
+	var details []string
+	for i, result := range r.items(receipt) {
+		if !result.Matched {
+			continue
+		}
+		points = addPoints(points, int64(result.Points))
+		item := receipt.Items[i]
+		if units := item.Units(); r.PerUnit && units > 1 {
+			details = append(details, fmt.Sprintf("%q is %d characters; %s split over %d units, each * %s %s, is %d points",
+				result.Description, result.Length, item.Price, units, r.multiplier(), r.rounded(), result.Points))
+			continue
+		}
+		details = append(details, fmt.Sprintf("%q is %d characters; %s * %s %s is %d points",
+			result.Description, result.Length, item.Price, r.multiplier(), r.rounded(), result.Points))
+	}
+	return toInt(points), details
+}
+
+// items scores each item of receipt. No item matches while the rule is
+// disabled.
+func (r ItemDescriptionLengthRule) items(receipt Receipt) []ItemResult {
+	results := make([]ItemResult, len(receipt.Items))
+	for i, item := range receipt.Items {
+		description := strings.TrimSpace(item.ShortDescription)
+		results[i] = ItemResult{Description: description, Length: utf8.RuneCountInString(description)}
+		if r.Enabled && results[i].Length%r.LengthMultiple == 0 {
+			price, _ := item.Price.Cents()
+			results[i].Matched = true
+			if units := item.Units(); r.PerUnit && units > 1 {
+				results[i].Points = r.perUnit(price, int64(units))
+			} else {
+				results[i].Points = percentOfCents(price, r.PricePercent, r.Rounding)
+			}
+		}
+	}
+	return results
+}
+
+// perUnit returns the points for a line of units units costing cents in
+// all, each unit's points rounded on its own. A price that does not divide
+// evenly is split as separate lines adding up to it would be: the first
+// cents % units units cost a cent more than the rest.
+func (r ItemDescriptionLengthRule) perUnit(cents, units int64) int {
+	each, extra := cents/units, cents%units
+	points := mulPoints(units-extra, int64(percentOfCents(each, r.PricePercent, r.Rounding)))
+	points = addPoints(points, mulPoints(extra, int64(percentOfCents(each+1, r.PricePercent, r.Rounding))))
+	return toInt(points)
+}
+
+// percentOfCents returns percent percent of a non-negative amount in cents,
+// in dollars rounded as rounding says, so that the default of 20% rounded
+// up is exactly ceil(cents / 500): no floating point is involved, and 5.00
+// earns 1 point, not 2. The product is taken in 128 bits, since a price near
+// the int64 limit times the percentage overflows 64; results too large for
+// an int are capped at the largest one.
+func percentOfCents(cents int64, percent int, rounding Rounding) int {
+	// The product is in hundredths of a cent; adding just under, or half
+	// of, a dollar's worth before dividing rounds up, or half up.
+	var bias uint64
+	switch rounding {
+	case "", RoundCeil:
+		bias = 9999
+	case RoundHalfUp:
+		bias = 5000
+	}
+	hi, lo := bits.Mul64(uint64(cents), uint64(percent))
+	lo, carry := bits.Add64(lo, bias, 0)
+	hi += carry
+	if hi >= 10000 {
+		return math.MaxInt
+	}
+	quo, _ := bits.Div64(hi, lo, 10000)
+	if quo > math.MaxInt {
+		return math.MaxInt
+	}
+	return int(quo)
+}
+
+// OddPurchaseDayRule awards points if the day in the purchase date is odd
+// (rule 6).
+type OddPurchaseDayRule struct {
+	Enabled bool `json:"enabled"`
+	Points  int  `json:"points"`
+
+	zoneAware bool // see RulesConfig.ZoneAware
+}
+
+func (OddPurchaseDayRule) Name() string { return "odd-purchase-day" }
+
+func (r OddPurchaseDayRule) Description() string {
+	return fmt.Sprintf("%d points if the day in the purchase date is odd.", r.Points)
+}
+
+func (r OddPurchaseDayRule) Evaluate(receipt Receipt) (int, []string) {
+	clock, note, ok := purchaseClock(receipt, r.zoneAware)
+	if !ok || clock.Day()%2 == 0 {
+		return 0, nil
+	}
+	details := []string{fmt.Sprintf("purchase day %d is odd", clock.Day())}
+	if note != "" {
+		details = append(details, note)
+	}
+	return r.Points, details
+}
+
+// TimeWindowRule describes the purchase time window for rule 7. Start and End
+// are 24-hour HH:MM times; the inclusive flags control whether a purchase at
+// exactly that time falls inside the window.
+type TimeWindowRule struct {
+	Enabled        bool   `json:"enabled"`
+	Points         int    `json:"points"`
+	Start          string `json:"start"`
+	End            string `json:"end"`
+	StartInclusive bool   `json:"startInclusive"`
+	EndInclusive   bool   `json:"endInclusive"`
+
+	zoneAware bool // see RulesConfig.ZoneAware
+}
+
+func (tw TimeWindowRule) validate() error {
+	if err := nonNegative("points", tw.Points); err != nil {
+		return err
+	}
+	start, err := time.Parse("15:04", tw.Start)
+	if err != nil {
+		return fmt.Errorf("invalid start %q", tw.Start)
+	}
+	end, err := time.Parse("15:04", tw.End)
+	if err != nil {
+		return fmt.Errorf("invalid end %q", tw.End)
+	}
+	if !start.Before(end) {
+		return fmt.Errorf("start %s is not before end %s", tw.Start, tw.End)
+	}
+	return nil
+}
+
+func (TimeWindowRule) Name() string { return "afternoon-purchase-time" }
+
+func (tw TimeWindowRule) Description() string {
+	return fmt.Sprintf("%d points if the time of purchase is %s.", tw.Points, tw)
+}
+
+func (tw TimeWindowRule) Evaluate(receipt Receipt) (int, []string) {
+	clock, note, ok := purchaseClock(receipt, tw.zoneAware)
+	if !ok || !tw.Contains(clock.Format(TimeLayout)) {
+		return 0, nil
+	}
+	details := []string{fmt.Sprintf("%s is %s", clock.Format(TimeLayout), tw)}
+	if note != "" {
+		details = append(details, note)
+	}
+	return tw.Points, details
+}
+
+// Contains reports whether purchaseTime, an HH:MM string, is inside the window.
+func (tw TimeWindowRule) Contains(purchaseTime string) bool {
+	t, err := time.Parse("15:04", purchaseTime)
+	if err != nil {
+		return false
+	}
+	start, _ := time.Parse("15:04", tw.Start)
+	end, _ := time.Parse("15:04", tw.End)
+
+	afterStart := t.After(start) || (tw.StartInclusive && t.Equal(start))
+	beforeEnd := t.Before(end) || (tw.EndInclusive && t.Equal(end))
+	return afterStart && beforeEnd
+}
+
+// String describes the window, e.g. "after 14:00 and before 16:00".
+func (tw TimeWindowRule) String() string {
+	start, end := "after "+tw.Start, "before "+tw.End
+	if tw.StartInclusive {
+		start = "at or after " + tw.Start
+	}
+	if tw.EndInclusive {
+		end = "at or before " + tw.End
+	}
+	return start + " and " + end
+}
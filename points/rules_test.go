@@ -0,0 +1,426 @@
+package points
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestTotalRulesInCents checks the round dollar and quarter multiple rules
+// on totals that binary floating point gets wrong.
+func TestTotalRulesInCents(t *testing.T) {
+	config := DefaultRulesConfig()
+	tests := []struct {
+		total          Money
+		round, quarter int
+	}{
+		{"0.00", 50, 25},
+		{"0.10", 0, 0},
+		{"0.25", 0, 25},
+		{"1.15", 0, 0},
+		{"2.00", 50, 25},
+		{"9.00", 50, 25},
+		{"35.10", 0, 0},
+		{"35.35", 0, 0},
+		{"35.50", 0, 25},
+		{"100.75", 0, 25},
+		{"0.29", 0, 0},
+		{"4.35", 0, 0},
+		{"1000000.00", 50, 25},
+		{"92233720368547758.00", 50, 25},
+	}
+	for _, tt := range tests {
+		receipt := testReceipt()
+		receipt.Total = tt.total
+		if got, _ := config.RoundDollarTotal.Evaluate(receipt); got != tt.round {
+			t.Errorf("round dollar rule on %s = %d, want %d", tt.total, got, tt.round)
+		}
+		if got, _ := config.QuarterMultipleTotal.Evaluate(receipt); got != tt.quarter {
+			t.Errorf("quarter multiple rule on %s = %d, want %d", tt.total, got, tt.quarter)
+		}
+	}
+}
+
+// TestItemDescriptionLengthRuleInCents checks that 20% of a price is rounded
+// up exactly: a price that is a whole number of points earns no more.
+func TestItemDescriptionLengthRuleInCents(t *testing.T) {
+	rule := DefaultRulesConfig().ItemDescriptionLength
+	tests := []struct {
+		price  Money
+		points int
+	}{
+		{"0.00", 0},
+		{"0.01", 1},
+		{"0.10", 1},
+		{"1.15", 1},
+		{"2.00", 1},
+		{"5.00", 1},
+		{"5.01", 2},
+		{"10.00", 2},
+		{"12.25", 3},
+		{"15.00", 3},
+		{"100.75", 21},
+		{"35.35", 8},
+	}
+	for _, tt := range tests {
+		receipt := testReceipt()
+		// Three characters, a multiple of three.
+		receipt.Items = []Item{{ShortDescription: "Tea", Price: tt.price}}
+		if got, _ := rule.Evaluate(receipt); got != tt.points {
+			t.Errorf("item description rule on price %s = %d, want %d", tt.price, got, tt.points)
+		}
+	}
+}
+
+// TestItemDescriptionLengthRuleRounding locks in the points of each rounding
+// for prices and percentages that floating point gets wrong: 30.00 * 0.1 is
+// 3.0000000000000004, which rounds up to 4, and 1.15 * 0.2 falls short of
+// 0.23.
+func TestItemDescriptionLengthRuleRounding(t *testing.T) {
+	tests := []struct {
+		price               Money
+		percent             int
+		ceil, halfUp, floor int
+	}{
+		{"0.00", 20, 0, 0, 0},
+		{"0.01", 20, 1, 0, 0},
+		{"1.15", 20, 1, 0, 0},
+		{"2.49", 20, 1, 0, 0},
+		{"2.50", 20, 1, 1, 0},
+		{"4.35", 20, 1, 1, 0},
+		{"5.00", 20, 1, 1, 1},
+		{"5.01", 20, 2, 1, 1},
+		{"7.49", 20, 2, 1, 1},
+		{"7.50", 20, 2, 2, 1},
+		{"12.25", 20, 3, 2, 2},
+		{"12.50", 20, 3, 3, 2},
+		{"35.35", 20, 8, 7, 7},
+		{"100.75", 20, 21, 20, 20},
+		{"92233720368547758.07", 20, 18446744073709552, 18446744073709552, 18446744073709551},
+		{"0.30", 10, 1, 0, 0},
+		{"15.00", 10, 2, 2, 1},
+		{"30.00", 10, 3, 3, 3},
+		{"70.00", 10, 7, 7, 7},
+		{"1.00", 35, 1, 0, 0},
+		{"1.43", 35, 1, 1, 0},
+		{"10.00", 35, 4, 4, 3},
+		{"14.30", 35, 6, 5, 5},
+		{"20.00", 35, 7, 7, 7},
+		{"0.01", 100, 1, 0, 0},
+		{"2.50", 100, 3, 3, 2},
+		{"35.35", 0, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		receipt := testReceipt()
+		receipt.Items = []Item{{ShortDescription: "Tea", Price: tt.price}}
+		for rounding, want := range map[Rounding]int{"": tt.ceil, RoundCeil: tt.ceil, RoundHalfUp: tt.halfUp, RoundFloor: tt.floor} {
+			rule := ItemDescriptionLengthRule{Enabled: true, LengthMultiple: 3, PricePercent: tt.percent, Rounding: rounding}
+			if got, _ := rule.Evaluate(receipt); got != want {
+				t.Errorf("%d%% of %s, rounding %q = %d, want %d", tt.percent, tt.price, rounding, got, want)
+			}
+		}
+	}
+}
+
+// TestRetailerNameRuleCountsUnicode checks that letters and digits of every
+// script count, and that emoji, which are neither, do not.
+func TestRetailerNameRuleCountsUnicode(t *testing.T) {
+	rule := DefaultRulesConfig().RetailerName
+	tests := []struct {
+		retailer string
+		points   int
+	}{
+		{"Target", 6},
+		{"M&M Corner Market", 14},
+		{"Café Über", 8},
+		{"Crème Brûlée 2", 12},
+		{"東京マート", 5},
+		{"서울 마트", 4},
+		{"Ⅻ Shop", 4},   // a Roman numeral is a number, not a digit
+		{"٣ Market", 7}, // an Arabic-Indic digit is one
+		{"Pizza 🍕", 5},
+		{"🍕🍺", 0},
+	}
+	for _, tt := range tests {
+		receipt := testReceipt()
+		receipt.Retailer = tt.retailer
+		if got, _ := rule.Evaluate(receipt); got != tt.points {
+			t.Errorf("retailer name rule on %q = %d, want %d", tt.retailer, got, tt.points)
+		}
+	}
+}
+
+func TestValidateUnicodeRetailer(t *testing.T) {
+	for retailer, valid := range map[string]bool{
+		"Café Über": true,
+		"東京マート":     true,
+		"Pizza 🍕":   false, // emoji are not letters
+	} {
+		receipt := testReceipt()
+		receipt.Retailer = retailer
+		if _, invalid := fieldError(Validate(receipt), "retailer"); invalid == valid {
+			t.Errorf("Validate with retailer %q: valid %v, want %v", retailer, !invalid, valid)
+		}
+	}
+}
+
+// TestRetailerNameWhitespace checks that non-breaking, zero-width and other
+// spaces validate and score as a plain space does, and that the breakdown
+// names each one left uncounted.
+func TestRetailerNameWhitespace(t *testing.T) {
+	config := DefaultRulesConfig()
+	tests := []struct {
+		retailer string
+		counted  int
+		excluded []ExcludedCharacter
+	}{
+		{"M&M Corner Market", 14, []ExcludedCharacter{{"&", "U+0026", 1}, {" ", "U+0020", 2}}},
+		{"M&M\u00a0Corner\u00a0Market", 14, []ExcludedCharacter{{"&", "U+0026", 1}, {"\u00a0", "U+00A0", 2}}},
+		{"Target\tStore", 11, []ExcludedCharacter{{"\t", "U+0009", 1}}},
+		{"Tar\u200bget", 6, []ExcludedCharacter{{"\u200b", "U+200B", 1}}},
+		{"\ufeffTarget\u2060", 6, []ExcludedCharacter{{"\ufeff", "U+FEFF", 1}, {"\u2060", "U+2060", 1}}},
+		{"Café\u3000Über", 8, []ExcludedCharacter{{"\u3000", "U+3000", 1}}},
+		{"Corner\u00a0-\t\u200bMarket", 12, []ExcludedCharacter{{"\u00a0", "U+00A0", 1}, {"-", "U+002D", 1}, {"\t", "U+0009", 1}, {"\u200b", "U+200B", 1}}},
+	}
+	for _, tt := range tests {
+		receipt := testReceipt()
+		receipt.Retailer = tt.retailer
+		if err, invalid := fieldError(Validate(receipt), "retailer"); invalid {
+			t.Errorf("Validate with retailer %q: %s", tt.retailer, err.Message)
+		}
+		if got, _ := config.RetailerName.Evaluate(receipt); got != tt.counted {
+			t.Errorf("retailer name rule on %q = %d, want %d", tt.retailer, got, tt.counted)
+		}
+		retailer := config.Breakdown(receipt).Retailer
+		if retailer == nil || retailer.Counted != tt.counted || !reflect.DeepEqual(retailer.Excluded, tt.excluded) {
+			t.Errorf("breakdown of retailer %q = %+v, want %d counted and %v excluded", tt.retailer, retailer, tt.counted, tt.excluded)
+		}
+	}
+}
+
+// TestRetailerAlphanumeric checks that names of nothing but spaces,
+// ampersands and hyphens pass validation unless a letter or digit is
+// required.
+func TestRetailerAlphanumeric(t *testing.T) {
+	for retailer, alphanumeric := range map[string]bool{
+		"Target":          true,
+		"M&M":             true,
+		"7-Eleven":        true,
+		"&":               false,
+		" - ":             false,
+		"&\u00a0&":        false,
+		"\u00a0\t\u200b-": false,
+	} {
+		receipt := testReceipt()
+		receipt.Retailer = retailer
+		if _, invalid := fieldError(Validate(receipt), "retailer"); invalid {
+			t.Errorf("Validate with retailer %q fails, want it to pass", retailer)
+		}
+		_, errs := InputFormats{RetailerAlphanumeric: true}.ValidateInput(receipt)
+		if _, invalid := fieldError(errs, "retailer"); invalid == alphanumeric {
+			t.Errorf("ValidateInput requiring a letter or digit, retailer %q: valid %v, want %v", retailer, !invalid, alphanumeric)
+		}
+	}
+}
+
+// TestItemDescriptionLengthRuleCountsRunes checks that a description's length
+// is in characters, not bytes.
+func TestItemDescriptionLengthRuleCountsRunes(t *testing.T) {
+	rule := DefaultRulesConfig().ItemDescriptionLength
+	tests := []struct {
+		description string
+		matched     bool
+	}{
+		{"Tea", true},
+		{"Thé", true}, // 3 characters, 4 bytes
+		{"お茶だ", true}, // 3 characters, 9 bytes
+		{"Café au lait", true},
+		{"Crème", false},  // 5 characters, 6 bytes
+		{"  緑茶  ", false}, // trimmed to 2 characters
+	}
+	for _, tt := range tests {
+		receipt := testReceipt()
+		receipt.Items = []Item{{ShortDescription: tt.description, Price: "10.00"}}
+		if points, _ := rule.Evaluate(receipt); (points > 0) != tt.matched {
+			t.Errorf("item description rule on %q = %d points, want matched %v", tt.description, points, tt.matched)
+		}
+	}
+}
+
+func TestTimeWindowRuleBoundaries(t *testing.T) {
+	exclusive := DefaultRulesConfig().TimeWindow
+	inclusive := exclusive
+	inclusive.StartInclusive, inclusive.EndInclusive = true, true
+	tests := []struct {
+		time                 string
+		exclusive, inclusive int
+	}{
+		{"13:59", 0, 0},
+		{"14:00", 0, 10},
+		{"14:01", 10, 10},
+		{"15:59", 10, 10},
+		{"16:00", 0, 10},
+		{"16:01", 0, 0},
+	}
+	for _, tt := range tests {
+		receipt := testReceipt()
+		receipt.PurchaseTime = tt.time
+		if got, _ := exclusive.Evaluate(receipt); got != tt.exclusive {
+			t.Errorf("exclusive window at %s = %d, want %d", tt.time, got, tt.exclusive)
+		}
+		if got, _ := inclusive.Evaluate(receipt); got != tt.inclusive {
+			t.Errorf("inclusive window at %s = %d, want %d", tt.time, got, tt.inclusive)
+		}
+	}
+}
+
+func TestLoadRulesConfigTimeWindow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	if err := os.WriteFile(path, []byte(`{"timeWindow": {"enabled": true, "points": 10, "start": "14:00", "end": "16:00", "startInclusive": true}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := LoadRulesConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.TimeWindow.StartInclusive || config.TimeWindow.EndInclusive {
+		t.Errorf("window = %s, want inclusive of its start only", config.TimeWindow)
+	}
+	if !config.TimeWindow.Contains("14:00") || config.TimeWindow.Contains("16:00") {
+		t.Errorf("window %s contains 14:00 %v and 16:00 %v, want true and false",
+			config.TimeWindow, config.TimeWindow.Contains("14:00"), config.TimeWindow.Contains("16:00"))
+	}
+}
+
+func TestLoadRulesConfigRejectsBadTimeWindow(t *testing.T) {
+	for _, window := range []string{
+		`{"start": "4pm", "end": "16:00"}`,
+		`{"start": "14:00", "end": "25:00"}`,
+		`{"start": "16:00", "end": "14:00"}`,
+		`{"start": "14:00", "end": "14:00"}`,
+	} {
+		path := filepath.Join(t.TempDir(), "rules.json")
+		if err := os.WriteFile(path, []byte(`{"timeWindow": `+window+`}`), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadRulesConfig(path); err == nil {
+			t.Errorf("LoadRulesConfig accepted time window %s", window)
+		}
+	}
+}
+
+// quantity returns a pointer to n, for Item.Quantity.
+func quantity(n int) *int {
+	return &n
+}
+
+// TestQuantitiesLeaveDefaultScoringAlone checks that, with the unit options
+// off, quantities change nothing, and that receipts without them score as
+// they did before there were quantities, whatever the options.
+func TestQuantitiesLeaveDefaultScoringAlone(t *testing.T) {
+	if got := DefaultRulesConfig().Hash(); got != "sha256:013f65f0f053" {
+		t.Errorf("default rules hash = %s, want the one from before quantities", got)
+	}
+
+	units := DefaultRulesConfig()
+	units.ItemPairs.CountUnits, units.ItemDescriptionLength.PerUnit = true, true
+	for _, tt := range []struct {
+		receipt Receipt
+		want    int
+	}{{targetReceipt, 28}, {marketReceipt, 109}} {
+		if got := units.Breakdown(tt.receipt).Total; got != tt.want {
+			t.Errorf("%s with the unit options = %d, want %d", tt.receipt.Retailer, got, tt.want)
+		}
+
+		withQuantities := tt.receipt
+		withQuantities.Items = append([]Item(nil), tt.receipt.Items...)
+		for i := range withQuantities.Items {
+			withQuantities.Items[i].Quantity = quantity(i + 1)
+		}
+		if got, err := Calculate(withQuantities); err != nil || got != tt.want {
+			t.Errorf("%s with quantities and default rules = %d, %v, want %d", tt.receipt.Retailer, got, err, tt.want)
+		}
+		for i := range withQuantities.Items {
+			withQuantities.Items[i].Quantity = quantity(1)
+		}
+		if got := units.Breakdown(withQuantities).Total; got != tt.want {
+			t.Errorf("%s with quantities of 1 and the unit options = %d, want %d", tt.receipt.Retailer, got, tt.want)
+		}
+	}
+}
+
+func TestQuantitiesCountUnits(t *testing.T) {
+	lines := Receipt{Retailer: "Shop", PurchaseDate: "2022-01-02", PurchaseTime: "10:00", Total: "6.00"}
+	for range 6 {
+		lines.Items = append(lines.Items, Item{ShortDescription: "Pop", Price: "1.00"})
+	}
+	line := lines
+	line.Items = []Item{{ShortDescription: "Pop", Price: "6.00", Quantity: quantity(6)}}
+
+	units := DefaultRulesConfig()
+	units.ItemPairs.CountUnits, units.ItemDescriptionLength.PerUnit = true, true
+	// 4 for the name, 75 for the total, 15 for three pairs and 1 for each
+	// unit's 0.20 rounded up.
+	for name, receipt := range map[string]Receipt{"six lines": lines, "one line of six": line} {
+		if got := units.Breakdown(receipt).Total; got != 100 {
+			t.Errorf("%s with the unit options = %d, want 100", name, got)
+		}
+	}
+	// Without them the line is one item of 1.20 points, rounded up.
+	if got, _ := Calculate(line); got != 81 {
+		t.Errorf("one line of six = %d, want 81", got)
+	}
+	pairsOnly := DefaultRulesConfig()
+	pairsOnly.ItemPairs.CountUnits = true
+	if got := pairsOnly.Breakdown(line).Total; got != 96 {
+		t.Errorf("one line of six counting units only = %d, want 96", got)
+	}
+}
+
+// TestPerUnitSplitsAsLines checks that a line scored per unit gets what
+// separate lines of its units would, a price that does not divide evenly
+// going a cent more to the first units.
+func TestPerUnitSplitsAsLines(t *testing.T) {
+	for _, rounding := range []Rounding{RoundCeil, RoundHalfUp, RoundFloor} {
+		perUnit := DefaultRulesConfig().ItemDescriptionLength
+		perUnit.Rounding, perUnit.PerUnit = rounding, true
+		perLine := perUnit
+		perLine.PerUnit = false
+		for _, cents := range []int64{1, 7, 100, 1249, 500, 99999} {
+			for _, units := range []int64{2, 3, 7, 10} {
+				var lines Receipt
+				for i := range units {
+					each := cents / units
+					if i < cents%units {
+						each++
+					}
+					lines.Items = append(lines.Items, Item{ShortDescription: "Pop", Price: Money(fmt.Sprintf("%d.%02d", each/100, each%100))})
+				}
+				line := Receipt{Items: []Item{{ShortDescription: "Pop", Price: Money(fmt.Sprintf("%d.%02d", cents/100, cents%100)), Quantity: quantity(int(units))}}}
+				got, _ := perUnit.Evaluate(line)
+				want, _ := perLine.Evaluate(lines)
+				if got != want {
+					t.Errorf("%s rounding %s of %d cents over %d units = %d, want %d as lines", perUnit.Name(), rounding, cents, units, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestValidateQuantity(t *testing.T) {
+	for _, n := range []int{0, -1, -1 << 31} {
+		receipt := testReceipt()
+		receipt.Items[0].Quantity = quantity(n)
+		err, ok := fieldError(Validate(receipt), "items[0].quantity")
+		if !ok || err.Pointer != "/items/0/quantity" || err.Constraint != ConstraintMin || err.Value != n {
+			t.Errorf("Validate with quantity %d = %+v, want a min error", n, err)
+		}
+	}
+	receipt := testReceipt()
+	receipt.Items[0].Quantity = quantity(1 << 20)
+	if errs := Validate(receipt); len(errs) > 0 {
+		t.Errorf("Validate with a large quantity = %v, want none", errs)
+	}
+}
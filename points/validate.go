@@ -0,0 +1,240 @@
+package points
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Patterns from the Receipt and Item schemas in api.yml. RE2's \w only
+// covers ASCII, so it is spelled out with Unicode classes to accept names
+// such as "Café Über".
+var (
+	retailerPattern    = regexp.MustCompile(`^[\p{L}\p{N}_\s\-&]+$`)
+	descriptionPattern = regexp.MustCompile(`^[\p{L}\p{N}_\s\-]+$`)
+	timePattern        = regexp.MustCompile(`^\d{2}:\d{2}$`)
+)
+
+// normalizeSpaces replaces every kind of whitespace in s with a plain
+// space, since \s in a pattern only matches ASCII whitespace. Zero-width
+// spaces and joiners count as whitespace too: they are invisible, so they
+// end up in names pasted from elsewhere without anyone knowing.
+func normalizeSpaces(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsSpace(r), r == '\u200b', r == '\u200c', r == '\u200d', r == '\u2060', r == '\ufeff':
+			return ' '
+		}
+		return r
+	}, s)
+}
+
+// FieldError describes why a single field failed validation. Field names it
+// the way messages do, such as items[3].price. Errors about the fields of a
+// receipt, made by NewFieldError, also locate the field with a JSON Pointer
+// (RFC 6901), name the Constraint it failed, and give the Value sent, which
+// is left out when nothing was.
+type FieldError struct {
+	Field      string `json:"field"`
+	Message    string `json:"message"`
+	Pointer    string `json:"pointer,omitempty"`
+	Constraint string `json:"constraint,omitempty"`
+	Value      any    `json:"value,omitempty"`
+}
+
+func (e FieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// The constraints a field of a receipt can fail.
+const (
+	ConstraintRequired   = "required"   // missing or empty
+	ConstraintPattern    = "pattern"    // has characters it may not
+	ConstraintFormat     = "format"     // not a date, time or amount written as required
+	ConstraintEnum       = "enum"       // not one of the values known
+	ConstraintMin        = "min"        // too small, too early or too few
+	ConstraintMax        = "max"        // too large, too late or too many
+	ConstraintMaxLength  = "maxLength"  // too long
+	ConstraintSum        = "sum"        // the total is not the sum of the prices
+	ConstraintConflict   = "conflict"   // sent with a field it excludes
+	ConstraintNotAllowed = "notAllowed" // refused whatever its value
+)
+
+// maxValueLength is the most characters of a string value a FieldError
+// repeats; a longer one is cut short and ends in an ellipsis.
+const maxValueLength = 64
+
+// NewFieldError returns the FieldError for field of a receipt, written as in
+// items[3].price, which failed constraint with value. value is nil if the
+// field was not sent.
+func NewFieldError(field, constraint string, value any, message string) FieldError {
+	if s, ok := value.(string); ok && utf8.RuneCountInString(s) > maxValueLength {
+		value = string([]rune(s)[:maxValueLength]) + "…"
+	}
+	return FieldError{Field: field, Message: message, Pointer: fieldPointer(field), Constraint: constraint, Value: value}
+}
+
+// stringFieldError is NewFieldError for a string field, which failed
+// ConstraintRequired instead of constraint if it is empty.
+func stringFieldError(field, constraint, value, message string) FieldError {
+	if value == "" {
+		return NewFieldError(field, ConstraintRequired, nil, message)
+	}
+	return NewFieldError(field, constraint, value, message)
+}
+
+// fieldPointer returns the JSON Pointer to field, written as in
+// items[3].price: /items/3/price.
+func fieldPointer(field string) string {
+	escape := strings.NewReplacer("~", "~0", "/", "~1")
+	var pointer strings.Builder
+	for _, name := range strings.FieldsFunc(field, func(r rune) bool { return r == '.' || r == '[' || r == ']' }) {
+		pointer.WriteString("/" + escape.Replace(name))
+	}
+	return pointer.String()
+}
+
+// ValidationError lists every failing field of an invalid receipt.
+type ValidationError []FieldError
+
+func (e ValidationError) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return "invalid receipt: " + strings.Join(messages, "; ")
+}
+
+// Validate checks a receipt against the API spec and returns every failing
+// field, or nil if the receipt is valid.
+func Validate(receipt Receipt) []FieldError {
+	return validate(receipt, false, false)
+}
+
+// validate is Validate, also requiring a letter or digit in the retailer
+// name if alphanumeric is set, and accepting receipts without items if
+// itemless is.
+func validate(receipt Receipt, alphanumeric, itemless bool) []FieldError {
+	var errs []FieldError
+	fail := func(field, constraint string, value any, message string) {
+		errs = append(errs, NewFieldError(field, constraint, value, message))
+	}
+	failString := func(field, constraint, value, message string) {
+		errs = append(errs, stringFieldError(field, constraint, value, message))
+	}
+
+	if retailer := normalizeSpaces(receipt.Retailer); !retailerPattern.MatchString(retailer) {
+		failString("retailer", ConstraintPattern, receipt.Retailer, "must be non-empty and contain only letters, digits, spaces, '-' and '&'")
+	} else if alphanumeric && countRetailer(retailer).Counted == 0 {
+		fail("retailer", ConstraintPattern, receipt.Retailer, "must contain at least one letter or digit")
+	}
+
+	if _, err := time.Parse("2006-01-02", receipt.PurchaseDate); err != nil {
+		failString("purchaseDate", ConstraintFormat, receipt.PurchaseDate, "must be a calendar date in YYYY-MM-DD format")
+	}
+
+	if _, err := time.Parse("15:04", receipt.PurchaseTime); err != nil || !timePattern.MatchString(receipt.PurchaseTime) {
+		failString("purchaseTime", ConstraintFormat, receipt.PurchaseTime, "must be a 24-hour time in HH:MM format")
+	}
+
+	if receipt.Timezone != "" {
+		if _, ok := LoadZone(receipt.Timezone); !ok {
+			fail("timezone", ConstraintEnum, receipt.Timezone, "must be an IANA time zone name, e.g. America/New_York")
+		}
+	}
+
+	switch {
+	case itemless:
+	case receipt.Items == nil:
+		fail("items", ConstraintRequired, nil, "must contain at least one item (minItems 1)")
+	case len(receipt.Items) == 0:
+		fail("items", ConstraintMin, nil, "must contain at least one item (minItems 1)")
+	}
+	for i, item := range receipt.Items {
+		if !descriptionPattern.MatchString(item.ShortDescription) {
+			failString(fmt.Sprintf("items[%d].shortDescription", i), ConstraintPattern, item.ShortDescription, "must be non-empty and contain only letters, digits, spaces and '-'")
+		}
+		if _, ok := item.Price.Cents(); !ok {
+			failString(fmt.Sprintf("items[%d].price", i), ConstraintFormat, string(item.Price), "must be an amount with two decimal places, e.g. 6.49")
+		}
+		if item.Quantity != nil && *item.Quantity <= 0 {
+			fail(fmt.Sprintf("items[%d].quantity", i), ConstraintMin, *item.Quantity, "must be a positive integer")
+		}
+	}
+
+	if _, ok := receipt.Total.Cents(); !ok {
+		failString("total", ConstraintFormat, string(receipt.Total), "must be an amount with two decimal places, e.g. 6.49")
+	}
+
+	return errs
+}
+
+// CheckTotal reports whether the total of a receipt that has passed Validate
+// is exactly the sum of its item prices. If not, the FieldError gives both
+// amounts. The total of a receipt without items, such as one for a service
+// charge accepted with InputFormats.Itemless, has nothing to be checked
+// against.
+func CheckTotal(receipt Receipt) (FieldError, bool) {
+	if len(receipt.Items) == 0 {
+		return FieldError{}, true
+	}
+	var sum int64
+	for _, item := range receipt.Items {
+		cents, _ := item.Price.Cents()
+		if sum > math.MaxInt64-cents {
+			// No total can match a sum past the largest amount.
+			return NewFieldError("total", ConstraintSum, string(receipt.Total),
+				fmt.Sprintf("is %s but the item prices sum to more than %s", receipt.Total, formatCents(math.MaxInt64))), false
+		}
+		sum += cents
+	}
+	if total, _ := receipt.Total.Cents(); total == sum {
+		return FieldError{}, true
+	}
+	return NewFieldError("total", ConstraintSum, string(receipt.Total),
+		fmt.Sprintf("is %s but the item prices sum to %s", receipt.Total, formatCents(sum))), false
+}
+
+// DateWindow bounds when receipts may be dated. The current day and time are
+// those of Location, since a receipt's date and time are local to the store
+// that printed it.
+type DateWindow struct {
+	Location *time.Location
+	// MaxAgeDays is how many days before today a receipt may be dated;
+	// zero means any age.
+	MaxAgeDays int
+}
+
+// Check reports whether a receipt that has passed Validate is dated within
+// w as of now: no later than now, and no earlier than MaxAgeDays before
+// today. If not, the FieldError says which way it is out.
+func (w DateWindow) Check(receipt Receipt, now time.Time) (FieldError, bool) {
+	loc := w.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	now = now.In(loc)
+	purchased, err := time.ParseInLocation("2006-01-02 15:04", receipt.PurchaseDate+" "+receipt.PurchaseTime, loc)
+	if err != nil {
+		return FieldError{}, true
+	}
+
+	today := now.Format("2006-01-02")
+	switch {
+	case receipt.PurchaseDate > today:
+		return NewFieldError("purchaseDate", ConstraintMax, receipt.PurchaseDate, "is in the future"), false
+	case purchased.After(now):
+		return NewFieldError("purchaseTime", ConstraintMax, receipt.PurchaseTime, "is later than the current time"), false
+	}
+	if w.MaxAgeDays > 0 {
+		oldest := time.Date(now.Year(), now.Month(), now.Day()-w.MaxAgeDays, 0, 0, 0, 0, loc).Format("2006-01-02")
+		if receipt.PurchaseDate < oldest {
+			return NewFieldError("purchaseDate", ConstraintMin, receipt.PurchaseDate, fmt.Sprintf("is more than %d days ago", w.MaxAgeDays)), false
+		}
+	}
+	return FieldError{}, true
+}
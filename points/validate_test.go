@@ -0,0 +1,293 @@
+package points
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// testReceipt returns a valid receipt for tests to change a field of.
+func testReceipt() Receipt {
+	return Receipt{
+		Retailer:     "Target",
+		PurchaseDate: "2022-01-01",
+		PurchaseTime: "13:01",
+		Items:        []Item{{ShortDescription: "Mountain Dew 12PK", Price: "6.49"}},
+		Total:        "6.49",
+	}
+}
+
+// fieldError returns the error errs has for field, if any.
+func fieldError(errs []FieldError, field string) (FieldError, bool) {
+	for _, err := range errs {
+		if err.Field == field {
+			return err, true
+		}
+	}
+	return FieldError{}, false
+}
+
+func TestValidatePurchaseDate(t *testing.T) {
+	tests := []struct {
+		date  string
+		valid bool
+	}{
+		{"2022-01-01", true},
+		{"2024-02-29", true}, // leap day
+		{"2000-02-29", true}, // leap day of a century divisible by 400
+		{"", false},
+		{"2022-01", false},
+		{"2022", false},
+		{"20220101", false},
+		{"2022/01/01", false},
+		{"2022-01-xx", false},
+		{"2022-01-1", false},
+		{"2022-01-", false},
+		{"2022-13-01", false},
+		{"2022-04-31", false},
+		{"2023-02-29", false}, // not a leap year
+		{"1900-02-29", false}, // nor is a century not divisible by 400
+		{"-01-01", false},
+	}
+	for _, tt := range tests {
+		receipt := testReceipt()
+		receipt.PurchaseDate = tt.date
+		err, invalid := fieldError(Validate(receipt), "purchaseDate")
+		if invalid == tt.valid {
+			t.Errorf("Validate with purchaseDate %q: error %v, want valid %v", tt.date, err, tt.valid)
+		}
+	}
+}
+
+func TestValidateEmptyPurchaseDateIsRequired(t *testing.T) {
+	receipt := testReceipt()
+	receipt.PurchaseDate = ""
+	err, _ := fieldError(Validate(receipt), "purchaseDate")
+	if err.Constraint != ConstraintRequired || err.Value != nil {
+		t.Errorf("error = %+v, want constraint %s without a value", err, ConstraintRequired)
+	}
+}
+
+// TestOddPurchaseDayRuleOnBadDates checks that the rule awards nothing, rather
+// than panicking, for dates that could never pass Validate.
+func TestOddPurchaseDayRuleOnBadDates(t *testing.T) {
+	rule := DefaultRulesConfig().OddPurchaseDay
+	for _, date := range []string{"", "2022-01", "20220101", "2022-01-xx", "2022-1-", "-", "2023-02-29"} {
+		receipt := testReceipt()
+		receipt.PurchaseDate = date
+		if points, _ := rule.Evaluate(receipt); points != 0 {
+			t.Errorf("Evaluate with purchaseDate %q = %d, want 0", date, points)
+		}
+	}
+}
+
+func TestOddPurchaseDayRuleOnLeapDays(t *testing.T) {
+	rule := DefaultRulesConfig().OddPurchaseDay
+	for date, want := range map[string]int{"2024-02-29": 6, "2024-02-28": 0, "2024-03-01": 6} {
+		receipt := testReceipt()
+		receipt.PurchaseDate = date
+		if points, _ := rule.Evaluate(receipt); points != want {
+			t.Errorf("Evaluate with purchaseDate %s = %d, want %d", date, points, want)
+		}
+	}
+}
+
+func TestCheckTotal(t *testing.T) {
+	tests := []struct {
+		name   string
+		prices []Money
+		total  Money
+		ok     bool
+	}{
+		{"exact", []Money{"6.49", "12.25"}, "18.74", true},
+		{"one cent over", []Money{"6.49", "12.25"}, "18.75", false},
+		{"one cent under", []Money{"6.49", "12.25"}, "18.73", false},
+		// Ten dimes sum to 0.9999999999999999 in float64.
+		{"ten dimes", []Money{"0.10", "0.10", "0.10", "0.10", "0.10", "0.10", "0.10", "0.10", "0.10", "0.10"}, "1.00", true},
+		{"three dimes", []Money{"0.10", "0.10", "0.10"}, "0.30", true},
+		{"0.1 plus 0.2", []Money{"0.10", "0.20"}, "0.30", true},
+		{"many small prices", []Money{"0.01", "0.02", "0.03", "0.04", "0.05", "0.06", "0.07", "0.08", "0.09"}, "0.45", true},
+		{"large", []Money{"99999.99", "0.01"}, "100000.00", true},
+		{"tampered", []Money{"2.50", "2.50"}, "100.00", false},
+	}
+	for _, tt := range tests {
+		receipt := testReceipt()
+		receipt.Items = nil
+		for _, price := range tt.prices {
+			receipt.Items = append(receipt.Items, Item{ShortDescription: "Gum", Price: price})
+		}
+		receipt.Total = tt.total
+		err, ok := CheckTotal(receipt)
+		if ok != tt.ok {
+			t.Errorf("%s: CheckTotal = %v, %v, want ok %v", tt.name, err, ok, tt.ok)
+			continue
+		}
+		if !ok && (err.Field != "total" || err.Constraint != ConstraintSum) {
+			t.Errorf("%s: error %+v, want a %s error on total", tt.name, err, ConstraintSum)
+		}
+	}
+}
+
+func TestCheckTotalNamesBothAmounts(t *testing.T) {
+	receipt := testReceipt()
+	receipt.Items = []Item{{ShortDescription: "Gum", Price: "2.50"}, {ShortDescription: "Gum", Price: "2.50"}}
+	receipt.Total = "100.00"
+	err, _ := CheckTotal(receipt)
+	if err.Value != "100.00" || err.Message != "is 100.00 but the item prices sum to 5.00" {
+		t.Errorf("error = %+v, want the total and the sum of the prices", err)
+	}
+}
+
+func TestDateWindowCheck(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 21:30 on March 10 in New York, and already March 11 in UTC.
+	now := time.Date(2026, time.March, 10, 21, 30, 0, 0, newYork)
+	window := DateWindow{Location: newYork, MaxAgeDays: 30}
+
+	tests := []struct {
+		name  string
+		date  string
+		time  string
+		field string // empty if the receipt is within the window
+	}{
+		{"earlier today", "2026-03-10", "09:00", ""},
+		{"this minute", "2026-03-10", "21:30", ""},
+		{"later today", "2026-03-10", "21:31", "purchaseTime"},
+		{"late tonight", "2026-03-10", "23:59", "purchaseTime"},
+		{"yesterday late", "2026-03-09", "23:59", ""},
+		{"tomorrow", "2026-03-11", "00:00", "purchaseDate"},
+		{"next year", "2027-01-01", "12:00", "purchaseDate"},
+		{"oldest allowed", "2026-02-08", "00:00", ""},
+		{"a day too old", "2026-02-07", "23:59", "purchaseDate"},
+	}
+	for _, tt := range tests {
+		receipt := testReceipt()
+		receipt.PurchaseDate, receipt.PurchaseTime = tt.date, tt.time
+		err, ok := window.Check(receipt, now)
+		if ok != (tt.field == "") || err.Field != tt.field {
+			t.Errorf("%s: Check of %s %s = %+v, %v; want an error on %q", tt.name, tt.date, tt.time, err, ok, tt.field)
+		}
+	}
+
+	// Without a location the window is in UTC, where it is already
+	// tomorrow, and without a maximum age any past date is allowed.
+	receipt := testReceipt()
+	receipt.PurchaseDate, receipt.PurchaseTime = "2026-03-11", "00:15"
+	if err, ok := (DateWindow{}).Check(receipt, now); !ok {
+		t.Errorf("Check in UTC of a receipt dated just after midnight = %+v, want it allowed", err)
+	}
+	receipt.PurchaseDate = "1999-12-31"
+	if err, ok := (DateWindow{}).Check(receipt, now); !ok {
+		t.Errorf("Check without a maximum age of a receipt from 1999 = %+v, want it allowed", err)
+	}
+}
+
+// TestFieldErrorPointers checks the pointer, constraint and value of each
+// failure of a receipt with many, deep in its items among them.
+func TestFieldErrorPointers(t *testing.T) {
+	receipt := testReceipt()
+	receipt.Retailer = ""
+	receipt.PurchaseTime = "1:01 PM"
+	for range 11 {
+		receipt.Items = append(receipt.Items, Item{ShortDescription: "Gum", Price: "1.00"})
+	}
+	receipt.Items[3].Quantity = new(int)
+	receipt.Items[10].ShortDescription = "Gum!"
+	receipt.Items[11].Price = "1.2"
+	receipt.Items[11].ShortDescription = ""
+
+	want := []FieldError{
+		{Field: "retailer", Pointer: "/retailer", Constraint: ConstraintRequired},
+		{Field: "purchaseTime", Pointer: "/purchaseTime", Constraint: ConstraintFormat, Value: "1:01 PM"},
+		{Field: "items[3].quantity", Pointer: "/items/3/quantity", Constraint: ConstraintMin, Value: 0},
+		{Field: "items[10].shortDescription", Pointer: "/items/10/shortDescription", Constraint: ConstraintPattern, Value: "Gum!"},
+		{Field: "items[11].shortDescription", Pointer: "/items/11/shortDescription", Constraint: ConstraintRequired},
+		{Field: "items[11].price", Pointer: "/items/11/price", Constraint: ConstraintFormat, Value: "1.2"},
+	}
+	got := Validate(receipt)
+	if len(got) != len(want) {
+		t.Fatalf("Validate = %+v, want %d errors", got, len(want))
+	}
+	for i := range want {
+		got[i].Message = ""
+		if got[i] != want[i] {
+			t.Errorf("error %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestFieldErrorValueIsCut(t *testing.T) {
+	receipt := testReceipt()
+	receipt.Items = append(receipt.Items, Item{ShortDescription: strings.Repeat("é", 100), Price: "1.00"})
+	limits := DefaultLimits()
+	limits.MaxDescriptionLength = 80
+	err, ok := fieldError(limits.Check(receipt), "items[1].shortDescription")
+	if want := strings.Repeat("é", 64) + "…"; !ok || err.Pointer != "/items/1/shortDescription" || err.Constraint != ConstraintMaxLength || err.Value != want {
+		t.Errorf("error = %+v, want the description cut to 64 characters", err)
+	}
+}
+
+func TestFieldPointer(t *testing.T) {
+	for field, want := range map[string]string{
+		"total":                      "/total",
+		"items":                      "/items",
+		"items[0].price":             "/items/0/price",
+		"items[12].shortDescription": "/items/12/shortDescription",
+		"a/b~c":                      "/a~1b~0c",
+	} {
+		if got := fieldPointer(field); got != want {
+			t.Errorf("fieldPointer(%q) = %q, want %q", field, got, want)
+		}
+	}
+}
+
+// TestItemlessReceipts checks that a receipt without items fails the
+// schema's minItems unless itemless receipts are allowed, and then scores
+// nothing for items.
+func TestItemlessReceipts(t *testing.T) {
+	tests := []struct {
+		name  string
+		items []Item
+		want  FieldError
+	}{
+		{"missing", nil, FieldError{Field: "items", Message: "must contain at least one item (minItems 1)", Pointer: "/items", Constraint: ConstraintRequired}},
+		{"empty", []Item{}, FieldError{Field: "items", Message: "must contain at least one item (minItems 1)", Pointer: "/items", Constraint: ConstraintMin}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receipt := testReceipt()
+			receipt.Items, receipt.Total = tt.items, "10.00"
+			if errs := Validate(receipt); len(errs) != 1 || errs[0] != tt.want {
+				t.Errorf("Validate = %+v, want %+v", errs, tt.want)
+			}
+			if _, errs := (InputFormats{}).ValidateInput(receipt); len(errs) != 1 || errs[0] != tt.want {
+				t.Errorf("ValidateInput = %+v, want %+v", errs, tt.want)
+			}
+
+			normalized, errs := (InputFormats{Itemless: true}).ValidateInput(receipt)
+			if len(errs) > 0 {
+				t.Fatalf("ValidateInput allowing itemless receipts = %+v, want none", errs)
+			}
+			if _, ok := CheckTotal(normalized); !ok {
+				t.Error("CheckTotal of an itemless receipt failed")
+			}
+			breakdown := DefaultRulesConfig().Breakdown(normalized)
+			// Retailer 6, round dollar 50, multiple of 0.25 25, odd day 6.
+			if !breakdown.Itemless || breakdown.Total != 87 {
+				t.Errorf("breakdown = %+v, want 87 points, itemless", breakdown)
+			}
+			for _, result := range breakdown.Rules {
+				if (result.Rule == "item-pairs" || result.Rule == "item-description-length") && result.Points != 0 {
+					t.Errorf("%s awarded %d points to an itemless receipt", result.Rule, result.Points)
+				}
+			}
+		})
+	}
+
+	if breakdown := DefaultRulesConfig().Breakdown(testReceipt()); breakdown.Itemless {
+		t.Error("breakdown of a receipt with items is marked itemless")
+	}
+}
@@ -0,0 +1,64 @@
+package points
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// zones caches the locations LoadZone has loaded, by name, since loading one
+// reads and parses its tz database file.
+var zones sync.Map
+
+// LoadZone returns the location of the IANA time zone named name, such as
+// America/New_York, and whether there is one. "Local", which names whatever
+// zone the server runs in, is not accepted.
+func LoadZone(name string) (*time.Location, bool) {
+	if loc, ok := zones.Load(name); ok {
+		return loc.(*time.Location), true
+	}
+	if name == "" || name == "Local" {
+		return nil, false
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, false
+	}
+	zones.Store(name, loc)
+	return loc, true
+}
+
+// purchaseClock returns the purchase date and time of a receipt that has
+// passed Validate. With inZone set and a Timezone on the receipt, they are
+// resolved in that zone: a time the zone skipped, in a daylight saving change
+// or a day dropped from its calendar, is moved on by the time skipped, 02:30
+// to 03:30 on a day clocks go from 02:00 to 03:00, and note says so.
+// Otherwise they are read as written. ok is false if the date and time do
+// not parse.
+func purchaseClock(receipt Receipt, inZone bool) (clock time.Time, note string, ok bool) {
+	written, err := time.Parse(DateLayout+" "+TimeLayout, receipt.PurchaseDate+" "+receipt.PurchaseTime)
+	if err != nil {
+		return time.Time{}, "", false
+	}
+	loc, zoned := LoadZone(receipt.Timezone)
+	if !inZone || !zoned {
+		return written, "", true
+	}
+	clock = time.Date(written.Year(), written.Month(), written.Day(), written.Hour(), written.Minute(), 0, 0, loc)
+	if wall := wallClock(clock); wall.Before(written) {
+		// time.Date reads a skipped time with the offset from after the
+		// change, which puts it before the change.
+		clock = clock.Add(written.Sub(wall))
+	}
+	if wall := wallClock(clock); !wall.Equal(written) {
+		note = fmt.Sprintf("%s %s does not exist in %s; it is read as %s",
+			receipt.PurchaseDate, receipt.PurchaseTime, receipt.Timezone, wall.Format(DateLayout+" "+TimeLayout))
+	}
+	return clock, note, true
+}
+
+// wallClock returns the date and time t shows, in UTC, to compare with
+// times parsed without a zone.
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC)
+}
@@ -0,0 +1,168 @@
+package points
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+	_ "time/tzdata" // so the zones below load on hosts without a zoneinfo database
+)
+
+// TestZoneAwareRulesAcrossDST scores purchases on days whose zones change
+// their clocks, with and without zone-aware scoring.
+func TestZoneAwareRulesAcrossDST(t *testing.T) {
+	night := DefaultRulesConfig()
+	night.TimeWindow.Start, night.TimeWindow.End = "02:00", "03:00"
+	night.TimeWindow.StartInclusive = true
+	midnight := DefaultRulesConfig().TimeWindow
+	midnight.Start, midnight.End = "01:00", "02:00"
+
+	tests := []struct {
+		name                string
+		zone, date, clock   string
+		window              TimeWindowRule
+		oddDay, inWindow    int // points when zone-aware
+		plainDay, plainTime int // points when not
+		note                string
+	}{
+		{
+			name: "New York spring forward skips 02:30",
+			zone: "America/New_York", date: "2024-03-10", clock: "02:30", window: night.TimeWindow,
+			oddDay: 0, inWindow: 0, plainDay: 0, plainTime: 10,
+			note: "2024-03-10 02:30 does not exist in America/New_York; it is read as 2024-03-10 03:30",
+		},
+		{
+			name: "New York spring forward keeps 01:59",
+			zone: "America/New_York", date: "2024-03-10", clock: "01:59", window: night.TimeWindow,
+			oddDay: 0, inWindow: 0, plainDay: 0, plainTime: 0,
+		},
+		{
+			name: "New York spring forward keeps 03:00",
+			zone: "America/New_York", date: "2024-03-10", clock: "03:00", window: night.TimeWindow,
+			oddDay: 0, inWindow: 0, plainDay: 0, plainTime: 0,
+		},
+		{
+			// 01:30 happens twice, and is the same wall clock either time.
+			name: "New York fall back repeats 01:30",
+			zone: "America/New_York", date: "2024-11-03", clock: "01:30", window: night.TimeWindow,
+			oddDay: 6, inWindow: 0, plainDay: 6, plainTime: 0,
+		},
+		{
+			name: "Santiago spring forward at midnight",
+			zone: "America/Santiago", date: "2024-09-08", clock: "00:30", window: midnight,
+			oddDay: 0, inWindow: 10, plainDay: 0, plainTime: 0,
+			note: "2024-09-08 00:30 does not exist in America/Santiago; it is read as 2024-09-08 01:30",
+		},
+		{
+			// Samoa skipped 30 December 2011 to cross the date line, so an
+			// afternoon purchase that day lands on the odd 31st.
+			name: "Apia skipped day",
+			zone: "Pacific/Apia", date: "2011-12-30", clock: "14:30", window: DefaultRulesConfig().TimeWindow,
+			oddDay: 6, inWindow: 10, plainDay: 0, plainTime: 10,
+			note: "2011-12-30 14:30 does not exist in Pacific/Apia; it is read as 2011-12-31 14:30",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receipt := testReceipt()
+			receipt.Timezone, receipt.PurchaseDate, receipt.PurchaseTime = tt.zone, tt.date, tt.clock
+			config := DefaultRulesConfig()
+			config.TimeWindow = tt.window
+			for _, zoneAware := range []bool{true, false} {
+				config.ZoneAware = zoneAware
+				wantDay, wantTime := tt.oddDay, tt.inWindow
+				if !zoneAware {
+					wantDay, wantTime = tt.plainDay, tt.plainTime
+				}
+				var day, window int
+				var details []string
+				for _, rule := range config.Rules() {
+					points, ruleDetails := rule.Evaluate(receipt)
+					switch rule.Name() {
+					case "odd-purchase-day":
+						day = points
+					case "afternoon-purchase-time":
+						window = points
+					default:
+						continue
+					}
+					details = append(details, ruleDetails...)
+				}
+				if day != wantDay || window != wantTime {
+					t.Errorf("zone-aware %v: odd day %d, time window %d, want %d and %d", zoneAware, day, window, wantDay, wantTime)
+				}
+				// The note goes with whichever rule awards points.
+				noted := slices.ContainsFunc(details, func(d string) bool { return strings.Contains(d, "does not exist") })
+				if wantNote := zoneAware && tt.note != "" && (wantDay != 0 || wantTime != 0); noted != wantNote ||
+					wantNote && !slices.Contains(details, tt.note) {
+					t.Errorf("zone-aware %v: details %q, want note %q", zoneAware, details, tt.note)
+				}
+			}
+		})
+	}
+}
+
+func TestPurchaseClockNote(t *testing.T) {
+	receipt := testReceipt()
+	receipt.Timezone, receipt.PurchaseDate, receipt.PurchaseTime = "America/New_York", "2024-03-10", "02:30"
+	clock, note, ok := purchaseClock(receipt, true)
+	want := time.Date(2024, time.March, 10, 3, 30, 0, 0, clock.Location())
+	if !ok || !clock.Equal(want) || clock.Location().String() != "America/New_York" ||
+		note != "2024-03-10 02:30 does not exist in America/New_York; it is read as 2024-03-10 03:30" {
+		t.Errorf("purchaseClock = %s, %q, %v, want 03:30 EDT with a note", clock, note, ok)
+	}
+	if clock, note, _ := purchaseClock(receipt, false); clock.Hour() != 2 || note != "" {
+		t.Errorf("purchaseClock not zone-aware = %s, %q, want 02:30 as written", clock, note)
+	}
+}
+
+// TestNormalizeDateTimeInReceiptZone converts instants either side of New
+// York's spring-forward hour into the receipt's zone.
+func TestNormalizeDateTimeInReceiptZone(t *testing.T) {
+	tests := []struct {
+		dateTime     string
+		receiptZones bool
+		date, clock  string
+	}{
+		{"2024-03-10T06:59:00Z", true, "2024-03-10", "01:59"},
+		{"2024-03-10T07:00:00Z", true, "2024-03-10", "03:00"},
+		{"2024-03-10T02:30:00-05:00", true, "2024-03-10", "03:30"},
+		{"2024-11-03T05:30:00Z", true, "2024-11-03", "01:30"},
+		{"2024-11-03T06:30:00Z", true, "2024-11-03", "01:30"},
+		{"2024-03-10T07:00:00Z", false, "2024-03-10", "07:00"},
+		// Without an offset, the date and time are the zone's already.
+		{"2024-03-10T02:30", true, "2024-03-10", "02:30"},
+	}
+	for _, tt := range tests {
+		formats := InputFormats{DateTimes: true, Location: time.UTC, ReceiptZones: tt.receiptZones}
+		receipt := testReceipt()
+		receipt.PurchaseDate, receipt.PurchaseTime = "", ""
+		receipt.PurchaseDateTime, receipt.Timezone = tt.dateTime, "America/New_York"
+		got, errs := formats.Normalize(receipt)
+		if len(errs) > 0 || got.PurchaseDate != tt.date || got.PurchaseTime != tt.clock {
+			t.Errorf("Normalize %s with receipt zones %v = %s %s, %v, want %s %s",
+				tt.dateTime, tt.receiptZones, got.PurchaseDate, got.PurchaseTime, errs, tt.date, tt.clock)
+		}
+	}
+}
+
+func TestValidateTimezone(t *testing.T) {
+	for zone, valid := range map[string]bool{
+		"":                  true,
+		"America/New_York":  true,
+		"Pacific/Apia":      true,
+		"UTC":               true,
+		"Local":             false,
+		"Mars/Olympus_Mons": false,
+		"New York":          false,
+		"../../etc/passwd":  false,
+		"+05:00":            false,
+	} {
+		receipt := testReceipt()
+		receipt.Timezone = zone
+		_, found := fieldError(Validate(receipt), "timezone")
+		if found == valid {
+			t.Errorf("Validate with timezone %q: error %v, want %v", zone, found, !valid)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"sync"
+)
+
+// runOrdered calls work on each input next returns, until it reports there
+// are no more, on up to workers goroutines at once, and calls emit with each
+// result in the order the inputs came. Inputs are only read about workers
+// ahead of emit, so a long stream of them is never held in memory at once,
+// and emit can store results as they come while the next ones are worked
+// on.
+//
+// A panic in work is recovered, and recovered's result emitted in place of
+// work's. Once ctx is done or emit returns false no more inputs are read;
+// runOrdered returns when the work already started is done, with ctx.Err().
+func runOrdered[In, Out any](ctx context.Context, workers int, next func() (In, bool), work func(In) Out, recovered func(In, any) Out, emit func(In, Out) bool) error {
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type job struct {
+		in  In
+		out chan Out
+	}
+	jobs := make(chan job)
+	queue := make(chan job, workers) // started jobs in input order
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				j.out <- runRecovered(j.in, work, recovered)
+			}
+		}()
+	}
+
+	go func() {
+		defer close(queue)
+		defer close(jobs)
+		for ctx.Err() == nil {
+			in, ok := next()
+			if !ok {
+				return
+			}
+			// A job is queued only once a worker has it, so that every
+			// queued job gets a result.
+			j := job{in: in, out: make(chan Out, 1)}
+			select {
+			case jobs <- j:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case queue <- j:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for j := range queue {
+		if !emit(j.in, <-j.out) {
+			cancel()
+			break
+		}
+	}
+	// Wait for the reader to stop, so that next is not called after
+	// runOrdered returns, then for the workers.
+	for range queue {
+	}
+	wg.Wait()
+	return parent.Err()
+}
+
+func runRecovered[In, Out any](in In, work func(In) Out, recovered func(In, any) Out) (out Out) {
+	defer func() {
+		if v := recover(); v != nil {
+			out = recovered(in, v)
+		}
+	}()
+	return work(in)
+}
+
+// sliceInputs returns a next function for runOrdered that yields the
+// indexes of a slice of length n in order.
+func sliceInputs(n int) func() (int, bool) {
+	i := -1
+	return func() (int, bool) {
+		i++
+		return i, i < n
+	}
+}
+
+// scoringPanic logs a panic recovered while scoring on the worker pool, and
+// returns the error reported for the receipt in its place.
+func (s *Server) scoringPanic(ctx context.Context, v any) *apiError {
+	s.logger.ErrorContext(ctx, "panic scoring receipt",
+		slog.String("component", componentHTTP),
+		slog.Any("panic", v),
+		slog.String("stack", string(debug.Stack())),
+	)
+	return newAPIError(http.StatusInternalServerError, codeInternal, "Internal server error")
+}
+
+// jsonArrayWriter writes a JSON array an element at a time, producing the
+// same bytes as encoding the whole array with a json.Encoder.
+type jsonArrayWriter struct {
+	w     io.Writer
+	wrote bool
+}
+
+func (a *jsonArrayWriter) write(v any) {
+	element, _ := json.Marshal(v)
+	separator := ","
+	if !a.wrote {
+		separator = "["
+	}
+	a.wrote = true
+	io.WriteString(a.w, separator)
+	a.w.Write(element)
+}
+
+func (a *jsonArrayWriter) close() {
+	if !a.wrote {
+		io.WriteString(a.w, "[")
+	}
+	io.WriteString(a.w, "]\n")
+}
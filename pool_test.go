@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+// benchBatch returns n receipts of varied sizes to score.
+func benchBatch(tb testing.TB, n int) []points.Receipt {
+	tb.Helper()
+	base := parseReceipt(tb, targetReceipt)
+	batch := make([]points.Receipt, n)
+	for i := range batch {
+		receipt := base
+		receipt.Items = nil
+		for j := range 1 + i%20 {
+			receipt.Items = append(receipt.Items, base.Items[j%len(base.Items)])
+		}
+		batch[i] = receipt
+	}
+	return batch
+}
+
+// scorePooled scores batch with runOrdered on workers goroutines.
+func scorePooled(batch []points.Receipt, config points.RulesConfig, workers int) []int {
+	totals := make([]int, 0, len(batch))
+	runOrdered(context.Background(), workers, sliceInputs(len(batch)),
+		func(i int) int { return config.Breakdown(batch[i]).Total },
+		func(int, any) int { return -1 },
+		func(_ int, total int) bool {
+			totals = append(totals, total)
+			return true
+		})
+	return totals
+}
+
+func TestPooledScoringMatchesSerial(t *testing.T) {
+	batch := benchBatch(t, 500)
+	config := points.DefaultRulesConfig()
+	serial := make([]int, len(batch))
+	for i, receipt := range batch {
+		serial[i] = config.Breakdown(receipt).Total
+	}
+	for _, workers := range []int{1, 4, 64} {
+		if pooled := scorePooled(batch, config, workers); !slices.Equal(pooled, serial) {
+			t.Errorf("scores on %d workers differ from serial scores", workers)
+		}
+	}
+}
+
+// BenchmarkBatchScoring compares scoring a batch serially with scoring it
+// on the worker pool, which pays for goroutines and channels per receipt.
+func BenchmarkBatchScoring(b *testing.B) {
+	config := points.DefaultRulesConfig()
+	for _, size := range []int{10, 1000} {
+		batch := benchBatch(b, size)
+		b.Run(fmt.Sprintf("serial/%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				for _, receipt := range batch {
+					config.Breakdown(receipt)
+				}
+			}
+		})
+		for _, workers := range []int{1, 4, 16} {
+			b.Run(fmt.Sprintf("pooled-%d/%d", workers, size), func(b *testing.B) {
+				b.ReportAllocs()
+				for range b.N {
+					scorePooled(batch, config, workers)
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkBatchEndpoint posts a batch of 100 receipts to a server scoring
+// on one worker and on several.
+func BenchmarkBatchEndpoint(b *testing.B) {
+	receipts := make([]string, 100)
+	for i := range receipts {
+		receipts[i] = targetReceipt
+	}
+	body := "[" + strings.Join(receipts, ",") + "]"
+	for _, workers := range []int{1, 8} {
+		b.Run(fmt.Sprintf("workers-%d", workers), func(b *testing.B) {
+			s := newTestServer(b)
+			s.workers = workers
+			h := s.Handler()
+			b.ReportAllocs()
+			for range b.N {
+				if rec := send(h, http.MethodPost, "/receipts/process/batch", body); rec.Code != http.StatusOK {
+					b.Fatalf("POST /receipts/process/batch = %d %s", rec.Code, rec.Body)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Quota periods, as written in quota specs.
+const (
+	quotaDay   = "day"
+	quotaMonth = "month"
+)
+
+// keyQuota is how many receipts the holder of an API key may process per
+// period.
+type keyQuota struct {
+	limit     int
+	period    string // quotaDay or quotaMonth
+	unlimited bool
+}
+
+// parseQuota parses a quota spec: a limit and a period, such as 1000/month
+// or 50/day, or unlimited.
+func parseQuota(spec string) (keyQuota, error) {
+	if spec == "unlimited" {
+		return keyQuota{unlimited: true}, nil
+	}
+	count, period, ok := strings.Cut(spec, "/")
+	limit, err := strconv.Atoi(count)
+	if !ok || err != nil || limit < 1 {
+		return keyQuota{}, fmt.Errorf("invalid quota %q: want a positive limit and a period, such as 1000/month, or unlimited", spec)
+	}
+	if period != quotaDay && period != quotaMonth {
+		return keyQuota{}, fmt.Errorf("invalid quota %q: period must be day or month", spec)
+	}
+	return keyQuota{limit: limit, period: period}, nil
+}
+
+func (q keyQuota) String() string {
+	if q.unlimited {
+		return "unlimited"
+	}
+	return strconv.Itoa(q.limit) + "/" + q.period
+}
+
+// quotaUsage is how many receipts a key has processed in the period that
+// started at Start.
+type quotaUsage struct {
+	Start time.Time `json:"start"`
+	Used  int       `json:"used"`
+}
+
+// quotaTracker counts the receipts processed with each API key against the
+// key's quota. Keys are counted by name, so the keys sharing a name share a
+// quota. Periods start at midnight, on the first of the month for monthly
+// quotas, in location.
+//
+// A nil *quotaTracker limits nothing.
+type quotaTracker struct {
+	mu       sync.Mutex
+	quotas   map[string]keyQuota // key name -> its quota
+	fallback keyQuota            // for keys without a quota of their own
+	location *time.Location
+	usage    map[string]quotaUsage
+	sink     quotaSink
+	logger   *slog.Logger
+	now      func() time.Time
+}
+
+// newQuotaTracker returns a tracker of the quotas of keys, falling back to
+// fallback for keys without one, resuming from the usage saved in sink.
+func newQuotaTracker(keys []apiKey, fallback keyQuota, location *time.Location, sink quotaSink, logger *slog.Logger) (*quotaTracker, error) {
+	usage, err := sink.load()
+	if err != nil {
+		return nil, err
+	}
+	t := &quotaTracker{
+		quotas:   make(map[string]keyQuota),
+		fallback: fallback,
+		location: location,
+		usage:    usage,
+		sink:     sink,
+		logger:   logger,
+		now:      time.Now,
+	}
+	for _, key := range keys {
+		if key.quota == nil {
+			continue
+		}
+		if previous, ok := t.quotas[key.Name]; ok && previous != *key.quota {
+			return nil, fmt.Errorf("API key %q is given two quotas, %s and %s", key.Name, previous, key.quota)
+		}
+		t.quotas[key.Name] = *key.quota
+	}
+	return t, nil
+}
+
+// quotaOf returns the quota of the key named name.
+func (t *quotaTracker) quotaOf(name string) keyQuota {
+	if q, ok := t.quotas[name]; ok {
+		return q
+	}
+	if t.fallback == (keyQuota{}) {
+		return keyQuota{unlimited: true}
+	}
+	return t.fallback
+}
+
+// period returns the start of the period of q that now falls in, and the
+// start of the next one. Unlimited quotas are counted by month.
+func (t *quotaTracker) period(q keyQuota, now time.Time) (time.Time, time.Time) {
+	now = now.In(t.location)
+	if q.period == quotaDay {
+		start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, t.location)
+		return start, start.AddDate(0, 0, 1)
+	}
+	start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, t.location)
+	return start, start.AddDate(0, 1, 0)
+}
+
+// currentLocked returns the usage of the key named name in the current
+// period of q, which is zero once a new period has begun, and when the next
+// period starts. t.mu must be held.
+func (t *quotaTracker) currentLocked(name string, q keyQuota) (quotaUsage, time.Time) {
+	start, next := t.period(q, t.now())
+	usage := t.usage[name]
+	if !usage.Start.Equal(start) {
+		usage = quotaUsage{Start: start}
+	}
+	return usage, next
+}
+
+// take counts one receipt against the quota of the API key ctx was
+// authenticated with, if any, returning the error the receipt is refused
+// with once the quota is used up. undo gives the receipt back, for one that
+// ends up not being stored.
+func (t *quotaTracker) take(ctx context.Context) (undo func(), apiErr *apiError) {
+	name := apiKeyFrom(ctx)
+	if t == nil || name == "" {
+		return func() {}, nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	q := t.quotaOf(name)
+	usage, next := t.currentLocked(name, q)
+	if !q.unlimited && usage.Used >= q.limit {
+		return nil, quotaExceededError(next)
+	}
+	usage.Used++
+	if err := t.saveLocked(name, usage); err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, codeInternal, "Internal server error")
+	}
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		current, _ := t.currentLocked(name, q)
+		if current.Start.Equal(usage.Start) && current.Used > 0 {
+			current.Used--
+			t.saveLocked(name, current)
+		}
+	}, nil
+}
+
+// saveLocked records usage as the usage of the key named name, in memory
+// only if the sink fails. t.mu must be held.
+func (t *quotaTracker) saveLocked(name string, usage quotaUsage) error {
+	if err := t.sink.save(name, usage); err != nil {
+		t.logger.Error("failed to save quota usage", slog.String("component", componentStore), slog.String("key", name), slog.Any("error", err))
+		return err
+	}
+	t.usage[name] = usage
+	return nil
+}
+
+// quotaExceededError is the error for a receipt refused because its key's
+// quota is used up until resetsAt.
+func quotaExceededError(resetsAt time.Time) *apiError {
+	e := newAPIError(http.StatusTooManyRequests, codeQuotaExceeded,
+		"The receipt quota of this API key is used up until "+resetsAt.Format(time.RFC3339))
+	e.ResetsAt = &resetsAt
+	return e
+}
+
+// quotaResponse is the body of GET /quota.
+type quotaResponse struct {
+	Key       string `json:"key"`
+	Unlimited bool   `json:"unlimited"`
+	Period    string `json:"period"`
+	Used      int    `json:"used"`
+	// Limit and Remaining are omitted for unlimited keys.
+	Limit     *int      `json:"limit,omitempty"`
+	Remaining *int      `json:"remaining,omitempty"`
+	ResetsAt  time.Time `json:"resetsAt"`
+}
+
+// quotaHandler handles GET /quota, reporting the quota of the caller's API
+// key and how much of it is used. The route only exists when quotas are
+// configured.
+func (s *Server) quotaHandler(w http.ResponseWriter, r *http.Request) {
+	name := apiKeyFrom(r.Context())
+	t := s.quotas
+
+	t.mu.Lock()
+	q := t.quotaOf(name)
+	usage, next := t.currentLocked(name, q)
+	t.mu.Unlock()
+
+	response := quotaResponse{Key: name, Unlimited: q.unlimited, Period: q.period, Used: usage.Used, ResetsAt: next}
+	if q.unlimited {
+		response.Period = quotaMonth
+	} else {
+		remaining := max(q.limit-usage.Used, 0)
+		response.Limit, response.Remaining = &q.limit, &remaining
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// quotaSink is where a quotaTracker keeps the usage of each key, so that it
+// survives restarts.
+type quotaSink interface {
+	// load returns the usage saved for each key.
+	load() (map[string]quotaUsage, error)
+	// save records the usage of the key named name.
+	save(name string, usage quotaUsage) error
+}
+
+// openQuotaSink returns the sink for the quota usage kept alongside store: a
+// table of its database, a file next to its log, or for a memory store,
+// nowhere.
+func openQuotaSink(store Store) quotaSink {
+	switch store := store.(type) {
+	case *sqliteStore:
+		return &sqliteQuotas{db: store.db}
+	case *fileStore:
+		return &fileQuotas{path: store.file.Name() + ".quota"}
+	}
+	return memoryQuotas{}
+}
+
+// memoryQuotas keeps no usage; the tracker's own copy is all there is.
+type memoryQuotas struct{}
+
+func (memoryQuotas) load() (map[string]quotaUsage, error) { return make(map[string]quotaUsage), nil }
+func (memoryQuotas) save(string, quotaUsage) error        { return nil }
+
+// fileQuotas keeps the usage of every key in a JSON file, rewritten whole on
+// each change. There is one entry per key, so the file stays small.
+type fileQuotas struct {
+	path  string
+	usage map[string]quotaUsage
+}
+
+func (f *fileQuotas) load() (map[string]quotaUsage, error) {
+	f.usage = make(map[string]quotaUsage)
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return make(map[string]quotaUsage), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &f.usage); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", f.path, err)
+	}
+	usage := make(map[string]quotaUsage, len(f.usage))
+	for name, u := range f.usage {
+		usage[name] = u
+	}
+	return usage, nil
+}
+
+func (f *fileQuotas) save(name string, usage quotaUsage) error {
+	previous, existed := f.usage[name]
+	f.usage[name] = usage
+	err := writeFileAtomic(f.path, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(f.usage)
+	})
+	if err != nil {
+		if existed {
+			f.usage[name] = previous
+		} else {
+			delete(f.usage, name)
+		}
+	}
+	return err
+}
+
+// sqliteQuotas keeps the usage of every key in the quota_usage table of the
+// store's database.
+type sqliteQuotas struct {
+	db *sql.DB
+}
+
+func (s *sqliteQuotas) load() (map[string]quotaUsage, error) {
+	rows, err := s.db.Query(`SELECT key_name, period_start, used FROM quota_usage`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := make(map[string]quotaUsage)
+	for rows.Next() {
+		var name string
+		var start int64
+		var used int
+		if err := rows.Scan(&name, &start, &used); err != nil {
+			return nil, err
+		}
+		usage[name] = quotaUsage{Start: time.Unix(start, 0), Used: used}
+	}
+	return usage, rows.Err()
+}
+
+func (s *sqliteQuotas) save(name string, usage quotaUsage) error {
+	_, err := s.db.Exec(`INSERT INTO quota_usage (key_name, period_start, used) VALUES (?, ?, ?)
+		ON CONFLICT (key_name) DO UPDATE SET period_start = excluded.period_start, used = excluded.used`,
+		name, usage.Start.Unix(), usage.Used)
+	return err
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// quotaZone is the time zone quota periods start in, five hours behind UTC,
+// so that local midnights fall on a different UTC day.
+var quotaZone = time.FixedZone("UTC-5", -5*60*60)
+
+// withQuotas gives the server's API keys quotas, counted at the time clock
+// holds: key-basic 2 a month, key-daily 1 a day and key-vip without limit.
+func withQuotas(clock *time.Time) serverOption {
+	return func(t testing.TB, s *Server) {
+		keys, err := loadAPIKeys("basic:key-basic 2/month,daily:key-daily 1/day,vip:key-vip unlimited", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.apiKeys = keys
+		if s.authRules, err = parseAuthRules("POST,PUT,DELETE"); err != nil {
+			t.Fatal(err)
+		}
+		if s.quotas, err = newQuotaTracker(keys, keyQuota{}, quotaZone, openQuotaSink(s.store), s.logger); err != nil {
+			t.Fatal(err)
+		}
+		s.quotas.now = func() time.Time { return *clock }
+	}
+}
+
+// processWithQuota posts targetReceipt with key, checking that it is
+// stored, or refused for its quota until resetsAt if that is set.
+func processWithQuota(t *testing.T, h http.Handler, key string, resetsAt time.Time, header ...string) {
+	t.Helper()
+	rec := send(h, http.MethodPost, "/receipts/process", targetReceipt, append([]string{"X-Api-Key", key}, header...)...)
+	if resetsAt.IsZero() {
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("POST with %s = %d %s, want 201", key, rec.Code, rec.Body)
+		}
+		return
+	}
+	var body struct {
+		Error struct {
+			Code     string
+			ResetsAt time.Time
+		}
+	}
+	decodeBody(t, rec, &body)
+	if rec.Code != http.StatusTooManyRequests || body.Error.Code != codeQuotaExceeded || !body.Error.ResetsAt.Equal(resetsAt) || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("POST with %s = %d %s, want 429 until %s", key, rec.Code, rec.Body, resetsAt)
+	}
+}
+
+// usedQuota returns what GET /quota reports for key.
+func usedQuota(t *testing.T, h http.Handler, key string) quotaResponse {
+	t.Helper()
+	var response quotaResponse
+	decodeBody(t, send(h, http.MethodGet, "/quota", "", "X-Api-Key", key), &response)
+	return response
+}
+
+func TestQuotaMonthBoundary(t *testing.T) {
+	// A minute before February in the quota's zone, when it is already
+	// February in UTC.
+	clock := time.Date(2026, time.January, 31, 23, 59, 0, 0, quotaZone)
+	h := newTestServer(t, withQuotas(&clock)).Handler()
+	february := time.Date(2026, time.February, 1, 0, 0, 0, 0, quotaZone)
+
+	processWithQuota(t, h, "key-basic", time.Time{})
+	processWithQuota(t, h, "key-basic", time.Time{})
+	processWithQuota(t, h, "key-basic", february)
+	quota := usedQuota(t, h, "key-basic")
+	if quota.Used != 2 || quota.Limit == nil || *quota.Limit != 2 || quota.Remaining == nil || *quota.Remaining != 0 || !quota.ResetsAt.Equal(february) {
+		t.Errorf("GET /quota in January = %+v, want 2 of 2 used until February", quota)
+	}
+
+	clock = february
+	processWithQuota(t, h, "key-basic", time.Time{})
+	quota = usedQuota(t, h, "key-basic")
+	if quota.Used != 1 || *quota.Remaining != 1 || !quota.ResetsAt.Equal(time.Date(2026, time.March, 1, 0, 0, 0, 0, quotaZone)) {
+		t.Errorf("GET /quota in February = %+v, want 1 used until March", quota)
+	}
+}
+
+func TestQuotaDayBoundary(t *testing.T) {
+	clock := time.Date(2026, time.March, 9, 23, 59, 59, 0, quotaZone)
+	h := newTestServer(t, withQuotas(&clock)).Handler()
+	midnight := time.Date(2026, time.March, 10, 0, 0, 0, 0, quotaZone)
+
+	processWithQuota(t, h, "key-daily", time.Time{})
+	processWithQuota(t, h, "key-daily", midnight)
+	clock = midnight.Add(-time.Nanosecond)
+	processWithQuota(t, h, "key-daily", midnight)
+	clock = midnight
+	processWithQuota(t, h, "key-daily", time.Time{})
+	processWithQuota(t, h, "key-daily", midnight.AddDate(0, 0, 1))
+
+	// Unlimited keys are counted, but never refused.
+	for range 10 {
+		processWithQuota(t, h, "key-vip", time.Time{})
+	}
+	if quota := usedQuota(t, h, "key-vip"); !quota.Unlimited || quota.Used != 10 || quota.Limit != nil || quota.Remaining != nil {
+		t.Errorf("GET /quota of an unlimited key = %+v, want 10 used and no limit", quota)
+	}
+}
+
+func TestQuotaSurvivesRestart(t *testing.T) {
+	for _, kind := range []string{"file", "sqlite"} {
+		t.Run(kind, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "receipts")
+			clock := time.Date(2026, time.April, 30, 12, 0, 0, 0, quotaZone)
+			may := time.Date(2026, time.May, 1, 0, 0, 0, 0, quotaZone)
+			store := openTestStore(t, kind, path)
+			h := newStoreServer(t, store, withQuotas(&clock)).Handler()
+			processWithQuota(t, h, "key-basic", time.Time{})
+			processWithQuota(t, h, "key-basic", time.Time{})
+			store.Close()
+
+			h = newStoreServer(t, openTestStore(t, kind, path), withQuotas(&clock)).Handler()
+			processWithQuota(t, h, "key-basic", may)
+			clock = may
+			processWithQuota(t, h, "key-basic", time.Time{})
+			if quota := usedQuota(t, h, "key-basic"); quota.Used != 1 {
+				t.Errorf("GET /quota after a restart and a new month = %+v, want 1 used", quota)
+			}
+		})
+	}
+}
+
+// TestIdempotentQuotaRefusal checks that a receipt refused for its quota
+// under an Idempotency-Key is processed when retried with the key once the
+// quota resets, rather than refused again by a replay.
+func TestIdempotentQuotaRefusal(t *testing.T) {
+	clock := time.Date(2026, time.June, 30, 23, 0, 0, 0, quotaZone)
+	h := newTestServer(t, withQuotas(&clock)).Handler()
+	july := time.Date(2026, time.July, 1, 0, 0, 0, 0, quotaZone)
+	processWithQuota(t, h, "key-daily", time.Time{})
+
+	processWithQuota(t, h, "key-daily", july, "Idempotency-Key", "retry-me")
+	clock = july
+	processWithQuota(t, h, "key-daily", time.Time{}, "Idempotency-Key", "retry-me")
+
+	// The receipt stored is what the key replays from then on.
+	rec := send(h, http.MethodPost, "/receipts/process", targetReceipt, "X-Api-Key", "key-daily", "Idempotency-Key", "retry-me")
+	if rec.Code != http.StatusOK || rec.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("POST with the key again = %d %s, want the stored receipt replayed", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a set of token buckets, one per client. Each bucket holds
+// up to burst tokens and refills at rate tokens per second; a request spends
+// one token.
+type rateLimiter struct {
+	rate  float64
+	burst int
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: burst, buckets: make(map[string]*tokenBucket)}
+}
+
+// allow spends a token from client's bucket if one is available. Otherwise
+// it reports how long until one will be.
+func (l *rateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: float64(l.burst), last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = min(float64(l.burst), b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// sweep forgets clients whose buckets have refilled completely, since a new
+// bucket would be indistinguishable from theirs.
+func (l *rateLimiter) sweep(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	full := time.Duration(float64(l.burst) / l.rate * float64(time.Second))
+	for client, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// run sweeps idle buckets every interval until ctx is canceled.
+func (l *rateLimiter) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			l.sweep(now)
+		}
+	}
+}
+
+// limitRate rejects requests with 429 once their client has used up its
+// bucket. Clients are identified by API key name when the request was
+// authenticated, and by remote IP otherwise.
+func (s *Server) limitRate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.rateLimiter == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		client := "ip:" + remoteIP(r)
+		if name := requestInfoFrom(r.Context()).client; name != "" {
+			client = "key:" + name
+		}
+		if ok, wait := s.rateLimiter.allow(client, time.Now()); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(w, http.StatusTooManyRequests, codeRateLimited, "Too many requests; retry later")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// remoteIP returns the IP address of the client that sent r.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
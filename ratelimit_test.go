@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestRateLimitConcurrentRequests sends burst+n requests at once from one
+// client and checks exactly n are refused. The rate is low enough that no
+// token is refilled while the test runs.
+func TestRateLimitConcurrentRequests(t *testing.T) {
+	const burst, n = 20, 30
+	s := newTestServer(t)
+	s.rateLimiter = newRateLimiter(0.001, burst)
+	h := s.Handler()
+
+	var ok, limited atomic.Int32
+	var wg sync.WaitGroup
+	for range burst + n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := send(h, http.MethodPost, "/receipts/process", targetReceipt)
+			switch rec.Code {
+			case http.StatusCreated:
+				ok.Add(1)
+			case http.StatusTooManyRequests:
+				limited.Add(1)
+				if retry, err := strconv.Atoi(rec.Header().Get("Retry-After")); err != nil || retry <= 0 {
+					t.Errorf("Retry-After = %q, want a positive number of seconds", rec.Header().Get("Retry-After"))
+				}
+				if code := errorCode(t, rec); code != codeRateLimited {
+					t.Errorf("code = %q, want %q", code, codeRateLimited)
+				}
+			default:
+				t.Errorf("POST /receipts/process = %d %s", rec.Code, rec.Body)
+			}
+		}()
+	}
+	wg.Wait()
+	if ok.Load() != burst || limited.Load() != n {
+		t.Errorf("%d accepted and %d refused, want %d and %d", ok.Load(), limited.Load(), burst, n)
+	}
+
+	// Another client has a bucket of its own.
+	req := httptest.NewRequest(http.MethodGet, "/receipts", nil)
+	req.RemoteAddr = "198.51.100.7:4321"
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("GET /receipts from another client = %d, want 200", rec.Code)
+	}
+}
+
+func TestRateLimiterRefillsAndSweeps(t *testing.T) {
+	l := newRateLimiter(2, 2)
+	start := time.Now()
+	for i, want := range []bool{true, true, false} {
+		if ok, _ := l.allow("a", start); ok != want {
+			t.Errorf("request %d allowed %v, want %v", i, ok, want)
+		}
+	}
+	if ok, wait := l.allow("a", start); ok || wait != 500*time.Millisecond {
+		t.Errorf("allow = %v, %s, want a wait of 500ms", ok, wait)
+	}
+	if ok, _ := l.allow("a", start.Add(500*time.Millisecond)); !ok {
+		t.Error("no token after half a second at 2 a second")
+	}
+
+	l.allow("b", start.Add(time.Second))
+	// a is full a second after its last request; b is not yet.
+	l.sweep(start.Add(1500 * time.Millisecond))
+	if _, kept := l.buckets["a"]; kept {
+		t.Error("the full bucket of an idle client was kept")
+	}
+	if _, kept := l.buckets["b"]; !kept {
+		t.Error("a bucket that was still refilling was swept")
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// readOnlyRetryAfter is the Retry-After, in seconds, of writes refused while
+// the server is read-only. Maintenance windows are minutes long, so clients
+// need not retry any sooner.
+const readOnlyRetryAfter = 60
+
+// Server modes, as the health probes report them.
+const (
+	modeReadWrite = "read-write"
+	modeReadOnly  = "read-only"
+)
+
+// mode returns whether the server takes writes.
+func (s *Server) mode() string {
+	if s.features.get().ReadOnly {
+		return modeReadOnly
+	}
+	return modeReadWrite
+}
+
+// errReadOnly is what writes are refused with while the read-only feature is
+// on.
+func errReadOnly() *apiError {
+	return newAPIError(http.StatusServiceUnavailable, codeReadOnly,
+		"The server is read-only for maintenance; try again later.")
+}
+
+// writable wraps the handler of a route that changes stored receipts,
+// refusing requests while the read-only feature is on. The feature is read
+// once, as the request arrives: a write that got past it is finished even if
+// the server turns read-only meanwhile, and none that arrives after the
+// switch gets through.
+func (s *Server) writable(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.features.get().ReadOnly {
+			w.Header().Set("Retry-After", strconv.Itoa(readOnlyRetryAfter))
+			writeAPIError(w, errReadOnly())
+			return
+		}
+		next(w, r)
+	}
+}
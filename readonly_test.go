@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+// setReadOnly turns the read-only feature of the admin server h on or off.
+func setReadOnly(t *testing.T, h http.Handler, on bool) {
+	t.Helper()
+	body := `{"read-only": false}`
+	if on {
+		body = `{"read-only": true}`
+	}
+	if rec := sendAdmin(h, http.MethodPatch, "/admin/features", body); rec.Code != http.StatusOK {
+		t.Fatalf("PATCH /admin/features %s = %d %s", body, rec.Code, rec.Body)
+	}
+}
+
+func TestReadOnlyRefusesWrites(t *testing.T) {
+	s := newTestServer(t, withAdmin)
+	h := s.Handler()
+	id := processReceipt(t, h, targetReceipt)
+	setReadOnly(t, h, true)
+
+	for _, tt := range []struct {
+		method, target, body string
+		header               []string
+	}{
+		{http.MethodPost, "/receipts/process", marketReceipt, nil},
+		{http.MethodPost, "/receipts/process/batch", "[" + marketReceipt + "]", nil},
+		{http.MethodPost, "/receipts/process/csv", "retailer,purchaseDate,purchaseTime,total,shortDescription,price\n", []string{"Content-Type", "text/csv"}},
+		{http.MethodPost, "/receipts/process/stream", "{}\n", []string{"Content-Type", "application/x-ndjson"}},
+		{http.MethodPut, "/receipts/" + id, marketReceipt, nil},
+		{http.MethodDelete, "/receipts/" + id, "", nil},
+		{http.MethodPost, "/receipts/" + id + "/restore", "", nil},
+		{http.MethodPost, "/receipts/" + id + "/image", "", []string{"Content-Type", "multipart/form-data; boundary=x"}},
+		{http.MethodPost, "/admin/recalculate", "", []string{"Authorization", "Bearer admin"}},
+		{http.MethodPost, "/admin/import", "", []string{"Authorization", "Bearer admin"}},
+		{http.MethodDelete, "/admin/receipts", "", []string{"Authorization", "Bearer admin"}},
+	} {
+		rec := send(h, tt.method, tt.target, tt.body, tt.header...)
+		if rec.Code != http.StatusServiceUnavailable || errorCode(t, rec) != codeReadOnly || rec.Header().Get("Retry-After") != "60" {
+			t.Errorf("%s %s while read-only = %d %v %s, want 503 read_only", tt.method, tt.target, rec.Code, rec.Header(), rec.Body)
+		}
+	}
+	if ids, _ := s.store.List(context.Background()); len(ids) != 1 {
+		t.Errorf("store holds %d receipts after refused writes, want 1", len(ids))
+	}
+
+	// Reads and previews carry on.
+	if got := receiptPoints(t, h, id); got != 28 {
+		t.Errorf("points while read-only = %d, want 28", got)
+	}
+	for _, target := range []string{"/receipts/" + id, "/receipts", "/receipts/" + id + "/breakdown"} {
+		if rec := send(h, http.MethodGet, target, ""); rec.Code != http.StatusOK {
+			t.Errorf("GET %s while read-only = %d %s, want 200", target, rec.Code, rec.Body)
+		}
+	}
+	if rec := send(h, http.MethodPost, "/receipts/points", marketReceipt); rec.Code != http.StatusOK {
+		t.Errorf("POST /receipts/points while read-only = %d %s, want 200", rec.Code, rec.Body)
+	}
+	for _, target := range []string{"/healthz", "/readyz"} {
+		var health healthResponse
+		decodeBody(t, send(h, http.MethodGet, target, ""), &health)
+		if health.Mode != modeReadOnly {
+			t.Errorf("GET %s while read-only = %+v, want mode %s", target, health, modeReadOnly)
+		}
+	}
+
+	setReadOnly(t, h, false)
+	processReceipt(t, h, marketReceipt)
+	var health healthResponse
+	decodeBody(t, send(h, http.MethodGet, "/healthz", ""), &health)
+	if health.Mode != modeReadWrite {
+		t.Errorf("GET /healthz after read-only = %+v, want mode %s", health, modeReadWrite)
+	}
+}
+
+// TestReadOnlyMidTraffic switches the server to read-only while receipts
+// are posted, checking that every write sent after the switch is refused
+// and that only those answered 201 were stored.
+func TestReadOnlyMidTraffic(t *testing.T) {
+	s := newTestServer(t, withAdmin)
+	h := s.Handler()
+
+	var switched atomic.Bool
+	var created, refused, late atomic.Int64
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Each writer keeps on until it has sent 20 writes after the
+			// switch.
+			for sentAfter := 0; sentAfter < 20; {
+				after := switched.Load()
+				if after {
+					sentAfter++
+				}
+				rec := send(h, http.MethodPost, "/receipts/process", targetReceipt)
+				switch {
+				case rec.Code == http.StatusCreated && after:
+					late.Add(1)
+				case rec.Code == http.StatusCreated:
+					created.Add(1)
+				case rec.Code == http.StatusServiceUnavailable:
+					refused.Add(1)
+				default:
+					t.Errorf("POST /receipts/process = %d %s", rec.Code, rec.Body)
+				}
+			}
+		}()
+	}
+	waitFor(t, "receipts to be stored", func() bool { return created.Load() >= 20 })
+	setReadOnly(t, h, true)
+	switched.Store(true)
+	wg.Wait()
+
+	if late.Load() > 0 {
+		t.Errorf("%d writes sent after the switch were stored", late.Load())
+	}
+	if refused.Load() < 8*20 {
+		t.Errorf("%d writes were refused, want at least the %d sent after the switch", refused.Load(), 8*20)
+	}
+	if ids, _ := s.store.List(context.Background()); int64(len(ids)) != created.Load() {
+		t.Errorf("store holds %d receipts, want the %d answered 201", len(ids), created.Load())
+	}
+}
+
+// gatedStore holds SaveReceipt until gate is closed, telling entered once
+// it is waiting.
+type gatedStore struct {
+	Store
+	entered chan struct{}
+	gate    chan struct{}
+}
+
+func (s gatedStore) SaveReceipt(ctx context.Context, id string, receipt points.Receipt, breakdown points.Breakdown) error {
+	s.entered <- struct{}{}
+	<-s.gate
+	return s.Store.SaveReceipt(ctx, id, receipt, breakdown)
+}
+
+// TestReadOnlyFinishesWritesInFlight checks that a write already past the
+// read-only check when the server switches is stored.
+func TestReadOnlyFinishesWritesInFlight(t *testing.T) {
+	store := gatedStore{Store: newMemoryStore(), entered: make(chan struct{}), gate: make(chan struct{})}
+	h := newStoreServer(t, store, withAdmin).Handler()
+
+	done := make(chan int)
+	go func() { done <- send(h, http.MethodPost, "/receipts/process", targetReceipt).Code }()
+	<-store.entered
+	setReadOnly(t, h, true)
+	close(store.gate)
+	if code := <-done; code != http.StatusCreated {
+		t.Errorf("write in flight when the server turned read-only = %d, want 201", code)
+	}
+	if ids, _ := store.List(context.Background()); len(ids) != 1 {
+		t.Errorf("store holds %d receipts, want the one in flight", len(ids))
+	}
+}
@@ -0,0 +1,161 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.4.0
+// - protoc             v5.27.3
+// source: receipts.proto
+
+// Package receipts.v1 is the gRPC form of the receipt processor API. It
+// mirrors POST /receipts/process and GET /receipts/{id}/points.
+
+package receiptpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.62.0 or later.
+const _ = grpc.SupportPackageIsVersion8
+
+const (
+	ReceiptProcessor_ProcessReceipt_FullMethodName = "/receipts.v1.ReceiptProcessor/ProcessReceipt"
+	ReceiptProcessor_GetPoints_FullMethodName      = "/receipts.v1.ReceiptProcessor/GetPoints"
+)
+
+// ReceiptProcessorClient is the client API for ReceiptProcessor service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ReceiptProcessorClient interface {
+	// ProcessReceipt validates, scores and stores a receipt. An invalid
+	// receipt fails with INVALID_ARGUMENT and a google.rpc.BadRequest
+	// detail listing each failing field.
+	ProcessReceipt(ctx context.Context, in *Receipt, opts ...grpc.CallOption) (*ReceiptId, error)
+	// GetPoints returns the points awarded to a stored receipt, or fails
+	// with NOT_FOUND.
+	GetPoints(ctx context.Context, in *ReceiptId, opts ...grpc.CallOption) (*Points, error)
+}
+
+type receiptProcessorClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewReceiptProcessorClient(cc grpc.ClientConnInterface) ReceiptProcessorClient {
+	return &receiptProcessorClient{cc}
+}
+
+func (c *receiptProcessorClient) ProcessReceipt(ctx context.Context, in *Receipt, opts ...grpc.CallOption) (*ReceiptId, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ReceiptId)
+	err := c.cc.Invoke(ctx, ReceiptProcessor_ProcessReceipt_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *receiptProcessorClient) GetPoints(ctx context.Context, in *ReceiptId, opts ...grpc.CallOption) (*Points, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Points)
+	err := c.cc.Invoke(ctx, ReceiptProcessor_GetPoints_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ReceiptProcessorServer is the server API for ReceiptProcessor service.
+// All implementations must embed UnimplementedReceiptProcessorServer
+// for forward compatibility
+type ReceiptProcessorServer interface {
+	// ProcessReceipt validates, scores and stores a receipt. An invalid
+	// receipt fails with INVALID_ARGUMENT and a google.rpc.BadRequest
+	// detail listing each failing field.
+	ProcessReceipt(context.Context, *Receipt) (*ReceiptId, error)
+	// GetPoints returns the points awarded to a stored receipt, or fails
+	// with NOT_FOUND.
+	GetPoints(context.Context, *ReceiptId) (*Points, error)
+	mustEmbedUnimplementedReceiptProcessorServer()
+}
+
+// UnimplementedReceiptProcessorServer must be embedded to have forward compatible implementations.
+type UnimplementedReceiptProcessorServer struct {
+}
+
+func (UnimplementedReceiptProcessorServer) ProcessReceipt(context.Context, *Receipt) (*ReceiptId, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ProcessReceipt not implemented")
+}
+func (UnimplementedReceiptProcessorServer) GetPoints(context.Context, *ReceiptId) (*Points, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetPoints not implemented")
+}
+func (UnimplementedReceiptProcessorServer) mustEmbedUnimplementedReceiptProcessorServer() {}
+
+// UnsafeReceiptProcessorServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ReceiptProcessorServer will
+// result in compilation errors.
+type UnsafeReceiptProcessorServer interface {
+	mustEmbedUnimplementedReceiptProcessorServer()
+}
+
+func RegisterReceiptProcessorServer(s grpc.ServiceRegistrar, srv ReceiptProcessorServer) {
+	s.RegisterService(&ReceiptProcessor_ServiceDesc, srv)
+}
+
+func _ReceiptProcessor_ProcessReceipt_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Receipt)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ReceiptProcessorServer).ProcessReceipt(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ReceiptProcessor_ProcessReceipt_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ReceiptProcessorServer).ProcessReceipt(ctx, req.(*Receipt))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ReceiptProcessor_GetPoints_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReceiptId)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ReceiptProcessorServer).GetPoints(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ReceiptProcessor_GetPoints_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ReceiptProcessorServer).GetPoints(ctx, req.(*ReceiptId))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// ReceiptProcessor_ServiceDesc is the grpc.ServiceDesc for ReceiptProcessor service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ReceiptProcessor_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "receipts.v1.ReceiptProcessor",
+	HandlerType: (*ReceiptProcessorServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ProcessReceipt",
+			Handler:    _ReceiptProcessor_ProcessReceipt_Handler,
+		},
+		{
+			MethodName: "GetPoints",
+			Handler:    _ReceiptProcessor_GetPoints_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "receipts.proto",
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// withJSONFallback serves requests with mux, replacing the plain-text 404 and
+// 405 responses the mux produces for unmatched requests with JSON errors.
+// The mux still decides which applies and sets the Allow header for 405s.
+func withJSONFallback(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h, pattern := mux.Handler(r)
+		if pattern != "" {
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		// h is the mux's own not-found, method-not-allowed or redirect
+		// handler. Run it against a scratch writer to learn its verdict.
+		rec := &headerRecorder{header: make(http.Header)}
+		h.ServeHTTP(rec, r)
+
+		switch rec.status {
+		case http.StatusNotFound:
+			if strings.HasPrefix(r.URL.Path, "/receipts/") {
+				// Most paths under /receipts/ are a receipt's routes,
+				// so say that this one is not, rather than that a
+				// receipt was not found.
+				writeError(w, http.StatusNotFound, codeUnknownRoute, "No route matches the request path")
+				return
+			}
+			notFoundHandler(w, r)
+		case http.StatusMethodNotAllowed:
+			// The mux's own Allow would list the methods that
+			// allowOnly routes refuse.
+			w.Header().Set("Allow", strings.Join(allowedMethods(r, mux), ", "))
+			writeMethodNotAllowed(w)
+		default:
+			// Path-cleaning redirects and the like are passed through.
+			mux.ServeHTTP(w, r)
+		}
+	})
+}
+
+// recoverPanics turns a panic in next into a logged stack trace and a JSON
+// 500 response, so one bad request cannot take down the connection.
+func (s *Server) recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := newResponseRecorder(w)
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				// Deliberate aborts are net/http's to handle.
+				panic(v)
+			}
+			s.logger.ErrorContext(r.Context(), "panic serving request",
+				slog.String("component", componentHTTP),
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.Any("panic", v),
+				slog.String("stack", string(debug.Stack())),
+			)
+			if !rec.wroteHeader {
+				writeError(rec, http.StatusInternalServerError, codeInternal, "Internal server error")
+			}
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// rejectEmptyIDs answers requests whose receipt ID segment is empty, such as
+// GET /receipts//points, with 400. The muxes would otherwise redirect them to
+// the cleaned path, which names a different route or none at all, so this
+// must run ahead of them.
+func rejectEmptyIDs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.EscapedPath()
+		if path == "/receipts/" || strings.HasPrefix(path, "/receipts//") {
+			writeInvalidID(w)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestTimeoutHeader lets clients with a budget of their own, such as a
+// gateway, give a request less time than the server would, in milliseconds.
+const requestTimeoutHeader = "X-Request-Timeout"
+
+// limitTime gives each request a deadline of timeout from when it arrives,
+// unless timeout is zero, or of the X-Request-Timeout the client sent if that
+// is sooner. Handlers see it through the request context, so store calls
+// made after it has passed give up without changing anything. Unlike
+// http.TimeoutHandler, this does not buffer responses, so streamed ones stay
+// streamed.
+func limitTime(timeout time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit, requested := timeout, false
+		if header := r.Header.Get(requestTimeoutHeader); header != "" {
+			ms, err := strconv.ParseInt(header, 10, 64)
+			if err != nil || ms <= 0 || ms > math.MaxInt64/int64(time.Millisecond) {
+				writeError(w, http.StatusBadRequest, codeInvalidRequestTimeout, "X-Request-Timeout must be a positive number of milliseconds")
+				return
+			}
+			if d := time.Duration(ms) * time.Millisecond; timeout <= 0 || d <= timeout {
+				limit, requested = d, true
+			}
+		}
+		if limit <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), limit)
+		defer cancel()
+		if requested {
+			ctx = context.WithValue(ctx, requestedDeadlineKey{}, true)
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+type requestedDeadlineKey struct{}
+
+// deadlineRequested reports whether ctx's deadline is the one the client
+// asked for with X-Request-Timeout, rather than the server's own.
+func deadlineRequested(ctx context.Context) bool {
+	requested, _ := ctx.Value(requestedDeadlineKey{}).(bool)
+	return requested
+}
+
+// trimTrailingSlash serves requests for a path under /receipts/ that ends in
+// a slash, such as POST /receipts/process/, as if it did not, so that they
+// reach the route the path names rather than none. /receipts/ itself is
+// left for rejectEmptyIDs.
+func trimTrailingSlash(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		if strings.HasPrefix(path, "/receipts/") && path != "/receipts/" && strings.HasSuffix(path, "/") {
+			u := *r.URL
+			u.Path = strings.TrimSuffix(u.Path, "/")
+			u.RawPath = strings.TrimSuffix(u.RawPath, "/")
+			r = r.Clone(r.Context())
+			r.URL = &u
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitBody caps the size of every request body at maxBytes(r). Reads past
+// the limit fail with an *http.MaxBytesError, which bodyReadError turns into
+// a 413 naming the limit.
+func limitBody(maxBytes func(*http.Request) int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, maxBytes(r))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowOnly returns a route that rejects every request with 405, listing
+// methods in the Allow header. Such routes are not counted as serving their
+// method when OPTIONS requests are answered.
+func allowOnly(methods ...string) methodRefusal {
+	return methodRefusal{allow: strings.Join(append(methods, http.MethodOptions), ", ")}
+}
+
+type methodRefusal struct {
+	allow string
+}
+
+func (m methodRefusal) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Allow", m.allow)
+	writeMethodNotAllowed(w)
+}
+
+// routeMethods are the methods allowedMethods looks for routes with.
+var routeMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+// allowedMethods lists the methods that routes of muxes serve for the path
+// of r, followed by OPTIONS, or returns nil if there are none. Patterns
+// without a method, which mount one mux on another, and allowOnly routes
+// do not count.
+func allowedMethods(r *http.Request, muxes ...*http.ServeMux) []string {
+	var allowed []string
+	for _, method := range routeMethods {
+		probe := r.WithContext(r.Context())
+		probe.Method = method
+		for _, mux := range muxes {
+			h, pattern := mux.Handler(probe)
+			if _, refused := h.(methodRefusal); refused || !strings.Contains(pattern, " ") {
+				continue
+			}
+			allowed = append(allowed, method)
+			break
+		}
+	}
+	if allowed == nil {
+		return nil
+	}
+	return append(allowed, http.MethodOptions)
+}
+
+// answerOptions answers OPTIONS requests with 204 and an Allow header
+// listing what the routes of muxes serve for the path, or 404 if nothing is
+// served there. HEAD needs no such help, since the muxes route it as GET.
+func answerOptions(next http.Handler, muxes ...*http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		allowed := allowedMethods(r, muxes...)
+		if allowed == nil {
+			notFoundHandler(w, r)
+			return
+		}
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusNotFound, codeNotFound, "Not found")
+}
+
+// headerRecorder is a ResponseWriter that keeps only the status and headers.
+type headerRecorder struct {
+	header http.Header
+	status int
+}
+
+func (rec *headerRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *headerRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return len(b), nil
+}
+
+func (rec *headerRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+func TestReceiptRoutes(t *testing.T) {
+	h := newTestServer(t).Handler()
+	id := processReceipt(t, h, targetReceipt)
+	const missing = "00000000-0000-4000-8000-000000000000"
+
+	tests := []struct {
+		method, target string
+		status         int
+		code           string
+		allow          string
+	}{
+		{http.MethodGet, "/receipts/" + id + "/points", http.StatusOK, "", ""},
+		// Trailing slashes name the same route.
+		{http.MethodGet, "/receipts/" + id + "/points/", http.StatusOK, "", ""},
+		{http.MethodGet, "/receipts/" + id + "/", http.StatusOK, "", ""},
+		// Missing and empty IDs.
+		{http.MethodGet, "/receipts/" + missing + "/points", http.StatusNotFound, codeReceiptNotFound, ""},
+		{http.MethodGet, "/receipts//points", http.StatusBadRequest, codeInvalidID, ""},
+		{http.MethodGet, "/receipts/", http.StatusBadRequest, codeInvalidID, ""},
+		// Extra and unknown path segments.
+		{http.MethodGet, "/receipts/" + id + "/points/extra", http.StatusNotFound, codeUnknownRoute, ""},
+		{http.MethodGet, "/receipts/" + id + "/unknown", http.StatusNotFound, codeUnknownRoute, ""},
+		// Percent-encoded IDs are decoded before they are looked up, and
+		// an encoded slash does not split the segment.
+		{http.MethodGet, "/receipts/" + strings.Replace(id, "-", "%2D", 1) + "/points", http.StatusOK, "", ""},
+		{http.MethodGet, "/receipts/" + strings.ToUpper(strings.Replace(id, "-", "%2d", -1)) + "/points", http.StatusOK, "", ""},
+		{http.MethodGet, "/receipts/a%2Fb/points", http.StatusBadRequest, codeInvalidID, ""},
+		{http.MethodGet, "/receipts/not%20an%20id/points", http.StatusBadRequest, codeInvalidID, ""},
+		// Wrong methods.
+		{http.MethodPost, "/receipts/" + id + "/points", http.StatusMethodNotAllowed, codeMethodNotAllowed, "GET, HEAD, OPTIONS"},
+		{http.MethodGet, "/receipts/process", http.StatusMethodNotAllowed, codeMethodNotAllowed, "POST, OPTIONS"},
+		{http.MethodGet, "/receipts/process/", http.StatusMethodNotAllowed, codeMethodNotAllowed, "POST, OPTIONS"},
+	}
+	for _, tt := range tests {
+		rec := send(h, tt.method, tt.target, "")
+		if rec.Code != tt.status {
+			t.Errorf("%s %s = %d %s, want %d", tt.method, tt.target, rec.Code, rec.Body, tt.status)
+			continue
+		}
+		if tt.code != "" {
+			if code := errorCode(t, rec); code != tt.code {
+				t.Errorf("%s %s: code %q, want %q", tt.method, tt.target, code, tt.code)
+			}
+		}
+		if allow := rec.Header().Get("Allow"); allow != tt.allow {
+			t.Errorf("%s %s: Allow %q, want %q", tt.method, tt.target, allow, tt.allow)
+		}
+	}
+}
+
+// TestReceiptsPrefixRoutes checks paths under /receipts/ that are neither a
+// receipt's routes nor quite those of the collection, which used to fall
+// into the {id} routes and be answered as invalid or unknown IDs.
+func TestReceiptsPrefixRoutes(t *testing.T) {
+	h := newTestServer(t).Handler()
+	id := processReceipt(t, h, targetReceipt)
+
+	tests := []struct {
+		method, target string
+		status         int
+		code           string
+		allow          string
+	}{
+		// The process route, with or without a trailing slash.
+		{http.MethodPost, "/receipts/process", http.StatusCreated, "", ""},
+		{http.MethodPost, "/receipts/process/", http.StatusCreated, "", ""},
+		{http.MethodGet, "/receipts/process", http.StatusMethodNotAllowed, codeMethodNotAllowed, "POST, OPTIONS"},
+		{http.MethodPut, "/receipts/process/", http.StatusMethodNotAllowed, codeMethodNotAllowed, "POST, OPTIONS"},
+		{http.MethodDelete, "/receipts/process", http.StatusMethodNotAllowed, codeMethodNotAllowed, "POST, OPTIONS"},
+		{http.MethodPatch, "/receipts/process", http.StatusMethodNotAllowed, codeMethodNotAllowed, "POST, OPTIONS"},
+		{http.MethodGet, "/receipts/process/stream/", http.StatusMethodNotAllowed, codeMethodNotAllowed, "POST, OPTIONS"},
+		{http.MethodGet, "/receipts/points", http.StatusMethodNotAllowed, codeMethodNotAllowed, "POST, OPTIONS"},
+		{http.MethodGet, "/receipts/points/", http.StatusMethodNotAllowed, codeMethodNotAllowed, "POST, OPTIONS"},
+		// Paths under it that name no route.
+		{http.MethodGet, "/receipts/process/extra", http.StatusNotFound, codeUnknownRoute, ""},
+		{http.MethodPost, "/receipts/process/extra", http.StatusNotFound, codeUnknownRoute, ""},
+		{http.MethodGet, "/receipts/a/b/c", http.StatusNotFound, codeUnknownRoute, ""},
+		{http.MethodGet, "/receipts/" + id + "/points//", http.StatusNotFound, codeUnknownRoute, ""},
+		// A receipt's routes, by methods they do not allow.
+		{http.MethodPost, "/receipts/" + id, http.StatusMethodNotAllowed, codeMethodNotAllowed, "GET, HEAD, PUT, DELETE, OPTIONS"},
+		{http.MethodPost, "/receipts/" + id + "/", http.StatusMethodNotAllowed, codeMethodNotAllowed, "GET, HEAD, PUT, DELETE, OPTIONS"},
+		{http.MethodDelete, "/receipts/" + id + "/points", http.StatusMethodNotAllowed, codeMethodNotAllowed, "GET, HEAD, OPTIONS"},
+		{http.MethodPost, "/receipts", http.StatusMethodNotAllowed, codeMethodNotAllowed, "GET, HEAD, OPTIONS"},
+		// "process" is no receipt ID.
+		{http.MethodGet, "/receipts/process/points", http.StatusBadRequest, codeInvalidID, ""},
+	}
+	for _, tt := range tests {
+		body := ""
+		if tt.method == http.MethodPost {
+			body = targetReceipt
+		}
+		rec := send(h, tt.method, tt.target, body)
+		if rec.Code != tt.status {
+			t.Errorf("%s %s = %d %s, want %d", tt.method, tt.target, rec.Code, rec.Body, tt.status)
+			continue
+		}
+		if tt.code != "" {
+			if code := errorCode(t, rec); code != tt.code {
+				t.Errorf("%s %s: code %q, want %q", tt.method, tt.target, code, tt.code)
+			}
+		}
+		if allow := rec.Header().Get("Allow"); allow != tt.allow {
+			t.Errorf("%s %s: Allow %q, want %q", tt.method, tt.target, allow, tt.allow)
+		}
+		if rec.Code == http.StatusCreated {
+			var response struct{ ID string }
+			decodeBody(t, rec, &response)
+			if got := receiptPoints(t, h, response.ID); got != 28 {
+				t.Errorf("%s %s stored a receipt worth %d, want 28", tt.method, tt.target, got)
+			}
+		}
+	}
+}
+
+// panicRoute registers GET /test/panic, which panics, on the servers whose
+// handlers the test builds.
+func panicRoute(t *testing.T) {
+	saved := debugRoutes
+	t.Cleanup(func() { debugRoutes = saved })
+	debugRoutes = append(slices.Clip(debugRoutes), func(mux *http.ServeMux) {
+		mux.HandleFunc("GET /test/panic", func(w http.ResponseWriter, r *http.Request) {
+			panic("deliberate panic from /test/panic")
+		})
+	})
+}
+
+func TestRecoverPanics(t *testing.T) {
+	panicRoute(t)
+	s := newTestServer(t)
+	var logs bytes.Buffer
+	s.logger = slog.New(requestIDHandler{slog.NewJSONHandler(&logs, nil)})
+	h := s.Handler()
+
+	rec := send(h, http.MethodGet, "/test/panic", "", requestIDHeader, "panicking-request")
+	if rec.Code != http.StatusInternalServerError || errorCode(t, rec) != codeInternal {
+		t.Errorf("GET /test/panic = %d %s, want 500 %s", rec.Code, rec.Body, codeInternal)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+
+	var entry struct {
+		Msg       string
+		Panic     string
+		Stack     string
+		RequestID string `json:"request_id"`
+	}
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if strings.Contains(line, `"panic serving request"`) {
+			json.Unmarshal([]byte(line), &entry)
+		}
+	}
+	if entry.RequestID != "panicking-request" || !strings.Contains(entry.Panic, "deliberate panic") || !strings.Contains(entry.Stack, "goroutine") {
+		t.Errorf("panic logged as %+v, want its request ID, value and stack\nlogs:\n%s", entry, logs.String())
+	}
+
+	// The server carries on as before.
+	id := processReceipt(t, h, targetReceipt)
+	if got := receiptPoints(t, h, id); got != 28 {
+		t.Errorf("points after a recovered panic = %d, want 28", got)
+	}
+}
+
+func TestBadReceiptIDs(t *testing.T) {
+	h := newTestServer(t).Handler()
+	const missing = "00000000-0000-4000-8000-000000000000"
+
+	type errorBody struct {
+		Error struct{ Code, Message string }
+	}
+	for _, route := range []string{"/receipts/%s/points", "/receipts/%s"} {
+		for _, id := range []string{
+			"",
+			"%20",
+			"%09",
+			missing[:len(missing)-1],
+			missing + "0",
+			missing + "%20",
+			strings.ReplaceAll(missing, "-", ""),
+			strings.Replace(missing, "0", "g", 1),
+		} {
+			target := strings.Replace(route, "%s", id, 1)
+			rec := send(h, http.MethodGet, target, "")
+			var body errorBody
+			decodeBody(t, rec, &body)
+			if rec.Code != http.StatusBadRequest || body.Error.Code != codeInvalidID || body.Error.Message != "Invalid receipt ID" {
+				t.Errorf("GET %s = %d %s, want 400 %s", target, rec.Code, rec.Body, codeInvalidID)
+			}
+		}
+
+		// A well-formed ID that is not stored gets the response the
+		// challenge's spec describes, in any case and however encoded.
+		for _, id := range []string{missing, strings.ToUpper(missing), strings.ReplaceAll(missing, "0", "%30")} {
+			target := strings.Replace(route, "%s", id, 1)
+			rec := send(h, http.MethodGet, target, "")
+			var body errorBody
+			decodeBody(t, rec, &body)
+			if rec.Code != http.StatusNotFound || body.Error.Code != codeReceiptNotFound || body.Error.Message != "No receipt found for that ID" {
+				t.Errorf("GET %s = %d %s, want 404 %q", target, rec.Code, rec.Body, "No receipt found for that ID")
+			}
+		}
+	}
+}
+
+// routeAllows lists, for every route, the Allow header OPTIONS and 405s
+// answer with. Receipt routes are given with %s in place of the ID.
+var routeAllows = []struct{ route, allow string }{
+	{"/receipts/process", "POST, OPTIONS"},
+	{"/receipts/process/batch", "POST, OPTIONS"},
+	{"/receipts/process/csv", "POST, OPTIONS"},
+	{"/receipts/process/stream", "POST, OPTIONS"},
+	{"/receipts/points", "POST, OPTIONS"},
+	{"/receipts", "GET, HEAD, OPTIONS"},
+	{"/receipts/export.csv", "GET, HEAD, OPTIONS"},
+	{"/receipts/search", "GET, HEAD, OPTIONS"},
+	{"/receipts/stream", "GET, HEAD, OPTIONS"},
+	{"/receipts/%s", "GET, HEAD, PUT, DELETE, OPTIONS"},
+	{"/receipts/%s/points", "GET, HEAD, OPTIONS"},
+	{"/receipts/%s/breakdown", "GET, HEAD, OPTIONS"},
+	{"/receipts/%s/image", "GET, HEAD, POST, OPTIONS"},
+	{"/receipts/%s/restore", "POST, OPTIONS"},
+	{"/retailers/points", "GET, HEAD, OPTIONS"},
+	{"/rules", "GET, HEAD, OPTIONS"},
+	{"/version", "GET, HEAD, OPTIONS"},
+	{"/openapi.yaml", "GET, HEAD, OPTIONS"},
+	{"/docs", "GET, HEAD, OPTIONS"},
+	{"/healthz", "GET, HEAD, OPTIONS"},
+	{"/readyz", "GET, HEAD, OPTIONS"},
+	{"/metrics", "GET, HEAD, OPTIONS"},
+	{"/admin/stats", "GET, HEAD, OPTIONS"},
+	{"/admin/loglevel", "GET, HEAD, PUT, OPTIONS"},
+	{"/admin/features", "GET, HEAD, PATCH, OPTIONS"},
+	{"/admin/receipts", "DELETE, OPTIONS"},
+}
+
+func TestOptionsAndMethodsPerRoute(t *testing.T) {
+	h := newTestServer(t, withAdmin).Handler()
+	id := processReceipt(t, h, targetReceipt)
+
+	for _, r := range routeAllows {
+		target := strings.Replace(r.route, "%s", id, 1)
+		rec := sendAdmin(h, http.MethodOptions, target, "")
+		if rec.Code != http.StatusNoContent || rec.Header().Get("Allow") != r.allow || rec.Body.Len() != 0 {
+			t.Errorf("OPTIONS %s = %d Allow %q %q, want 204 Allow %q", target, rec.Code, rec.Header().Get("Allow"), rec.Body, r.allow)
+		}
+
+		// Every other method is refused with the same list.
+		allowed := strings.Split(r.allow, ", ")
+		for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete} {
+			if slices.Contains(allowed, method) {
+				continue
+			}
+			rec := sendAdmin(h, method, target, "")
+			if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != r.allow {
+				t.Errorf("%s %s = %d Allow %q, want 405 Allow %q", method, target, rec.Code, rec.Header().Get("Allow"), r.allow)
+			}
+			if method != http.MethodHead && errorCode(t, rec) != codeMethodNotAllowed {
+				t.Errorf("%s %s answered %s, want %s", method, target, rec.Body, codeMethodNotAllowed)
+			}
+		}
+	}
+
+	// Nothing is allowed where there is no route.
+	rec := sendAdmin(h, http.MethodOptions, "/nope", "")
+	if rec.Code != http.StatusNotFound || rec.Header().Get("Allow") != "" {
+		t.Errorf("OPTIONS /nope = %d Allow %q, want 404 without Allow", rec.Code, rec.Header().Get("Allow"))
+	}
+}
+
+func TestHeadMatchesGetPerRoute(t *testing.T) {
+	s := newTestServer(t, withAdmin)
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(srv.Close)
+	id := processReceipt(t, s.Handler(), targetReceipt)
+	const missing = "00000000-0000-4000-8000-000000000000"
+
+	do := func(method, target string) (*http.Response, []byte) {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+target, nil)
+		req.Header.Set("Authorization", "Bearer admin")
+		// Compressed responses have no length to compare.
+		req.Header.Set("Accept-Encoding", "identity")
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, body
+	}
+
+	var targets []string
+	for _, r := range routeAllows {
+		// The stream never ends, so there is no whole GET to compare with.
+		if strings.Contains(r.allow, http.MethodHead) && r.route != "/receipts/stream" {
+			targets = append(targets, strings.Replace(r.route, "%s", id, 1))
+		}
+	}
+	// Errors are answered alike too.
+	targets = append(targets, "/receipts/"+missing, "/receipts/"+missing+"/points", "/receipts/bad%20id/points")
+
+	for _, target := range targets {
+		get, body := do(http.MethodGet, target)
+		head, headBody := do(http.MethodHead, target)
+		if head.StatusCode != get.StatusCode || head.Header.Get("Content-Type") != get.Header.Get("Content-Type") {
+			t.Errorf("HEAD %s = %d %s, GET %d %s", target, head.StatusCode, head.Header.Get("Content-Type"), get.StatusCode, get.Header.Get("Content-Type"))
+		}
+		if len(headBody) != 0 {
+			t.Errorf("HEAD %s sent a body %q", target, headBody)
+		}
+		// Metrics count the requests themselves and the version reports
+		// the uptime, so their lengths may move between the two.
+		if target == "/metrics" || target == "/version" {
+			continue
+		}
+		if cl := head.Header.Get("Content-Length"); cl != strconv.Itoa(len(body)) {
+			t.Errorf("HEAD %s Content-Length = %q, want the %d bytes of GET", target, cl, len(body))
+		}
+	}
+}
+
+func TestPlainOptionsWithCORS(t *testing.T) {
+	h := newTestServer(t, withCORS("https://dash.example", false)).Handler()
+	// Without Access-Control-Request-Method an OPTIONS is no preflight, and
+	// is answered by the router with the route's methods.
+	rec := send(h, http.MethodOptions, "/receipts/process", "", "Origin", "https://dash.example")
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Allow") != "POST, OPTIONS" {
+		t.Errorf("OPTIONS with an Origin = %d Allow %q, want 204 Allow %q", rec.Code, rec.Header().Get("Allow"), "POST, OPTIONS")
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Methods"); got != "" {
+		t.Errorf("Access-Control-Allow-Methods = %q on a plain OPTIONS", got)
+	}
+
+	// A preflight for a route is still answered ahead of routing.
+	rec = send(h, http.MethodOptions, "/receipts/process", "", "Origin", "https://dash.example", "Access-Control-Request-Method", "POST")
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Access-Control-Allow-Methods") != "GET, POST" {
+		t.Errorf("preflight = %d %v, want 204 with the CORS methods", rec.Code, rec.Header())
+	}
+}
+
+// slowStore is a store whose writes take delay, giving up without changing
+// anything if their context is done first, as a remote store's would.
+type slowStore struct {
+	Store
+	delay time.Duration
+}
+
+func (s slowStore) wait(ctx context.Context) error {
+	select {
+	case <-time.After(s.delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s slowStore) SaveReceipt(ctx context.Context, id string, receipt points.Receipt, breakdown points.Breakdown) error {
+	if err := s.wait(ctx); err != nil {
+		return err
+	}
+	return s.Store.SaveReceipt(ctx, id, receipt, breakdown)
+}
+
+func (s slowStore) UpdateReceipt(ctx context.Context, id string, revision uint64, receipt points.Receipt, breakdown points.Breakdown) error {
+	if err := s.wait(ctx); err != nil {
+		return err
+	}
+	return s.Store.UpdateReceipt(ctx, id, revision, receipt, breakdown)
+}
+
+func TestRequestTimeoutHeader(t *testing.T) {
+	inner := newMemoryStore()
+	s := newStoreServer(t, slowStore{Store: inner, delay: 200 * time.Millisecond})
+	s.requestTimeout = 5 * time.Second
+	h := s.Handler()
+	id := processReceipt(t, h, targetReceipt)
+
+	start := time.Now()
+	rec := send(h, http.MethodPost, "/receipts/process", marketReceipt, requestTimeoutHeader, "20")
+	if rec.Code != http.StatusGatewayTimeout || errorCode(t, rec) != codeTimeout {
+		t.Errorf("POST /receipts/process with 20ms to spare = %d %s, want 504", rec.Code, rec.Body)
+	}
+	if elapsed := time.Since(start); elapsed >= 200*time.Millisecond {
+		t.Errorf("POST /receipts/process with 20ms to spare took %v, as long as the store", elapsed)
+	}
+	rec = send(h, http.MethodPut, "/receipts/"+id, marketReceipt, requestTimeoutHeader, "20")
+	if rec.Code != http.StatusGatewayTimeout || errorCode(t, rec) != codeTimeout {
+		t.Errorf("PUT /receipts/%s with 20ms to spare = %d %s, want 504", id, rec.Code, rec.Body)
+	}
+	// Neither write was started.
+	if got, want := snapshot(t, inner), map[string]int{id: 28}; !maps.Equal(got, want) {
+		t.Errorf("after timed out writes the store holds %v, want %v", got, want)
+	}
+
+	// Time enough for the store is no different from sending none.
+	if rec := send(h, http.MethodPost, "/receipts/process", marketReceipt, requestTimeoutHeader, "2000"); rec.Code != http.StatusCreated {
+		t.Errorf("POST /receipts/process with 2s to spare = %d %s, want 201", rec.Code, rec.Body)
+	}
+
+	for _, header := range []string{"0", "-5", "1.5", "soon", "9223372036854775807"} {
+		if rec := send(h, http.MethodGet, "/receipts/"+id+"/points", "", requestTimeoutHeader, header); rec.Code != http.StatusBadRequest || errorCode(t, rec) != codeInvalidRequestTimeout {
+			t.Errorf("%s: %s = %d %s, want 400", requestTimeoutHeader, header, rec.Code, rec.Body)
+		}
+	}
+}
+
+// TestRequestTimeoutHeaderIsCapped checks that a client cannot give a
+// request more time than the server's own timeout, which is reported as
+// the server's rather than the client's.
+func TestRequestTimeoutHeaderIsCapped(t *testing.T) {
+	inner := newMemoryStore()
+	s := newStoreServer(t, slowStore{Store: inner, delay: time.Second})
+	s.requestTimeout = 20 * time.Millisecond
+	rec := send(s.Handler(), http.MethodPost, "/receipts/process", targetReceipt, requestTimeoutHeader, "60000")
+	if rec.Code != http.StatusServiceUnavailable || errorCode(t, rec) != codeTimeout {
+		t.Errorf("POST /receipts/process asking for a minute = %d %s, want 503", rec.Code, rec.Body)
+	}
+	if n := len(snapshot(t, inner)); n != 0 {
+		t.Errorf("store holds %d receipts after the request timed out", n)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+// rules is the scoring configuration receipts are scored with.
+var rules = newRuleset(points.DefaultRulesConfig())
+
+// ruleset holds a scoring configuration that can be replaced while receipts
+// are being scored. Each receipt is scored with the configuration it got
+// from get, never a mix of two.
+type ruleset struct {
+	current atomic.Pointer[points.RulesConfig]
+	reload  sync.Mutex // serializes reloads, so they are logged in order
+}
+
+func newRuleset(config points.RulesConfig) *ruleset {
+	r := &ruleset{}
+	r.set(config)
+	return r
+}
+
+func (r *ruleset) get() points.RulesConfig {
+	return *r.current.Load()
+}
+
+func (r *ruleset) set(config points.RulesConfig) {
+	r.current.Store(&config)
+}
+
+// reloadRules reads the rules file again and scores receipts with it from
+// then on. Receipts already stored keep their points until recalculated. If
+// the file no longer loads, the rules in use are kept.
+func (s *Server) reloadRules() (points.RulesConfig, error) {
+	rules.reload.Lock()
+	defer rules.reload.Unlock()
+
+	config, err := points.LoadRulesConfig(s.rulesPath)
+	if err != nil {
+		s.logger.Error("failed to reload rules", slog.String("component", componentRules), slog.String("path", s.rulesPath), slog.Any("error", err))
+		return rules.get(), err
+	}
+	old := rules.get()
+	rules.set(config)
+	s.logger.Info("reloaded rules", slog.String("component", componentRules),
+		slog.String("from", old.Version), slog.String("to", config.Version), slog.Bool("changed", old.Hash() != config.Hash()))
+	return config, nil
+}
+
+// reloadOnHangup reloads the rules file and the denylist, whichever are
+// configured, each time the process gets SIGHUP, until ctx is canceled.
+func (s *Server) reloadOnHangup(ctx context.Context) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangups:
+			if s.rulesPath != "" {
+				s.reloadRules()
+			}
+			if s.denylist != nil {
+				s.reloadDenylist()
+			}
+		}
+	}
+}
+
+// reloadRulesHandler handles POST /admin/rules/reload, reloading the rules
+// file as SIGHUP does and reporting the ruleset now in use.
+func (s *Server) reloadRulesHandler(w http.ResponseWriter, r *http.Request) {
+	if s.rulesPath == "" {
+		writeError(w, http.StatusConflict, codeNoRulesFile, "The server was started without a rules file")
+		return
+	}
+	config, err := s.reloadRules()
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, codeInvalidRules, "The rules file could not be loaded; the rules in use are unchanged: "+err.Error())
+		return
+	}
+
+	response := struct {
+		Version string `json:"version"`
+		Hash    string `json:"hash"`
+	}{config.Version, config.Hash()}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestReloadRules rewrites the rules file under a running server and checks
+// that receipts are scored with the new overrides once it is reloaded, and
+// that a broken file leaves the rules in use alone.
+func TestReloadRules(t *testing.T) {
+	old := rules.get()
+	t.Cleanup(func() { rules.set(old) })
+	path := filepath.Join(t.TempDir(), "rules.json")
+	write := func(contents string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	unset := newTestServer(t, withAdmin).Handler()
+	if rec := sendAdmin(unset, http.MethodPost, "/admin/rules/reload", ""); rec.Code != http.StatusConflict || errorCode(t, rec) != codeNoRulesFile {
+		t.Errorf("reload without a rules file = %d %s, want 409 %s", rec.Code, rec.Body, codeNoRulesFile)
+	}
+
+	s := newTestServer(t, withAdmin)
+	s.rulesPath = path
+	h := s.Handler()
+	if got := receiptPoints(t, h, processReceipt(t, h, targetReceipt)); got != 28 {
+		t.Fatalf("points before reloading = %d, want 28", got)
+	}
+
+	write(`{"version": "launch", "retailerOverrides": [{"name": "launch-bonus", "retailer": "Target", "bonus": 10}]}`)
+	rec := sendAdmin(h, http.MethodPost, "/admin/rules/reload", "")
+	var reloaded struct{ Version string }
+	decodeBody(t, rec, &reloaded)
+	if rec.Code != http.StatusOK || reloaded.Version != "launch" {
+		t.Fatalf("reload = %d %s, want 200 with version launch", rec.Code, rec.Body)
+	}
+	id := processReceipt(t, h, targetReceipt)
+	if got := receiptPoints(t, h, id); got != 38 {
+		t.Errorf("points after reloading = %d, want 38", got)
+	}
+	var breakdown struct {
+		Rules []struct{ Rule, Description string }
+	}
+	decodeBody(t, send(h, http.MethodGet, "/receipts/"+id+"/breakdown", ""), &breakdown)
+	if last := breakdown.Rules[len(breakdown.Rules)-1]; last.Rule != "retailer-override" || last.Description != "launch-bonus: 10 bonus points for retailer Target." {
+		t.Errorf("last breakdown entry = %+v, want the launch-bonus override", last)
+	}
+
+	write(`{"retailerOverrides": [{"retailer": "Target"}]}`)
+	if rec := sendAdmin(h, http.MethodPost, "/admin/rules/reload", ""); rec.Code != http.StatusUnprocessableEntity || errorCode(t, rec) != codeInvalidRules {
+		t.Errorf("reload of a broken file = %d %s, want 422 %s", rec.Code, rec.Body, codeInvalidRules)
+	}
+	if got := rules.get().Version; got != "launch" {
+		t.Errorf("rules after a failed reload are version %q, want launch", got)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+// searchResult is one entry of the GET /receipts/search results.
+type searchResult struct {
+	receiptSummary
+	// MatchedItems lists the positions in the receipt's items of those
+	// whose description contains the search term.
+	MatchedItems []int `json:"matchedItems"`
+}
+
+type searchResponse struct {
+	Receipts   []searchResult `json:"receipts"`
+	NextCursor string         `json:"nextCursor,omitempty"`
+}
+
+// itemScanner is implemented by stores that can skip receipts without a
+// matching item when searching.
+type itemScanner interface {
+	scanItems(ctx context.Context, term string, after uint64, fn func(StoredReceipt) bool) (bool, error)
+}
+
+// matchingItems returns the positions of receipt's items whose description
+// contains term, ignoring case. term must be lower case.
+func matchingItems(receipt points.Receipt, term string) []int {
+	var matched []int
+	for i, item := range receipt.Items {
+		if strings.Contains(strings.ToLower(item.ShortDescription), term) {
+			matched = append(matched, i)
+		}
+	}
+	return matched
+}
+
+// searchReceiptsHandler handles GET /receipts/search, returning summaries of
+// the receipts with an item whose description contains the item query
+// parameter, in the order they were processed and paged like GET /receipts.
+// With -index the store's item index picks out the receipts to read;
+// otherwise every receipt is read. Both give the same results.
+func (s *Server) searchReceiptsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	filter, errs := parseReceiptFilter(query, s.names)
+	term := strings.ToLower(strings.TrimSpace(query.Get("item")))
+	if term == "" {
+		errs = append(errs, points.FieldError{Field: "item", Message: "is required"})
+	}
+	limit, cursor, pageErrs := parsePage(query)
+	errs = append(errs, pageErrs...)
+	if len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, codeInvalidQuery, "The query parameters are invalid.", errs...)
+		return
+	}
+
+	response := searchResponse{Receipts: []searchResult{}}
+	var lastSeq uint64
+	more := false
+	match := func(stored StoredReceipt) bool {
+		if !filter.matches(stored.Receipt) {
+			return true
+		}
+		matched := matchingItems(stored.Receipt, term)
+		if matched == nil {
+			return true
+		}
+		if len(response.Receipts) == limit {
+			more = true
+			return false
+		}
+		response.Receipts = append(response.Receipts, searchResult{receiptSummary: s.summarize(stored), MatchedItems: matched})
+		lastSeq = stored.Seq
+		return true
+	}
+
+	indexed := false
+	var err error
+	if scanner, ok := s.store.(itemScanner); ok {
+		indexed, err = scanner.scanItems(r.Context(), term, cursor, match)
+	}
+	if !indexed {
+		err = s.store.Scan(r.Context(), cursor, match)
+	}
+	if err != nil {
+		s.writeStoreError(w, r, err)
+		return
+	}
+	if more {
+		response.NextCursor = strconv.FormatUint(lastSeq, 10)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
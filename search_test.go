@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// sparklingReceipt has items matching "klarbrunn" and "12" as targetReceipt
+// does, spelled differently.
+const sparklingReceipt = `{
+  "retailer": "Walgreens",
+  "purchaseDate": "2022-02-02",
+  "purchaseTime": "08:13",
+  "total": "4.50",
+  "items": [
+    {"shortDescription": "KLARBRUNN Sparkling", "price": "2.25"},
+    {"shortDescription": "Pepsi - 12-oz", "price": "2.25"}
+  ]
+}`
+
+// searchPages returns the bodies of GET /receipts/search?query and of each
+// page after it.
+func searchPages(t *testing.T, h http.Handler, query string) []string {
+	t.Helper()
+	var pages []string
+	for cursor := ""; ; {
+		target := "/receipts/search?" + query
+		if cursor != "" {
+			target += "&cursor=" + cursor
+		}
+		rec := send(h, http.MethodGet, target, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s = %d %s", target, rec.Code, rec.Body)
+		}
+		pages = append(pages, rec.Body.String())
+		var response searchResponse
+		decodeBody(t, rec, &response)
+		if cursor = response.NextCursor; cursor == "" {
+			return pages
+		}
+	}
+}
+
+// TestSearchIndexMatchesScan checks that searching with the item index
+// returns exactly what reading every receipt does, after receipts indexed
+// have been updated and deleted.
+func TestSearchIndexMatchesScan(t *testing.T) {
+	for _, kind := range []string{"memory", "file"} {
+		t.Run(kind, func(t *testing.T) {
+			store := openTestStore(t, kind, filepath.Join(t.TempDir(), "receipts"))
+			memory, ok := store.(*memoryStore)
+			if !ok {
+				memory = store.(*fileStore).memoryStore
+			}
+			h := newStoreServer(t, store).Handler()
+			target := processReceipt(t, h, targetReceipt)
+			market := processReceipt(t, h, marketReceipt)
+			memory.indexItems()
+			corrected := processReceipt(t, h, targetReceipt)
+			sparkling := processReceipt(t, h, sparklingReceipt)
+			if rec := send(h, http.MethodPut, "/receipts/"+corrected, marketReceipt); rec.Code != http.StatusOK {
+				t.Fatalf("PUT /receipts/%s = %d %s", corrected, rec.Code, rec.Body)
+			}
+			if rec := send(h, http.MethodDelete, "/receipts/"+market, ""); rec.Code != http.StatusNoContent {
+				t.Fatalf("DELETE /receipts/%s = %d %s", market, rec.Code, rec.Body)
+			}
+
+			var response searchResponse
+			decodeBody(t, send(h, http.MethodGet, "/receipts/search?item=Klarbrunn", ""), &response)
+			var found []string
+			for _, result := range response.Receipts {
+				found = append(found, result.ID)
+			}
+			if !slices.Equal(found, []string{target, sparkling}) ||
+				!slices.Equal(response.Receipts[0].MatchedItems, []int{4}) || !slices.Equal(response.Receipts[1].MatchedItems, []int{0}) {
+				t.Errorf("search for Klarbrunn = %+v, want item 4 of %s and item 0 of %s", response.Receipts, target, sparkling)
+			}
+
+			for _, query := range []string{
+				"item=klarbrunn",
+				"item=KLAR",
+				"item=12-pk",
+				"item=dew+12",
+				"item=12&limit=1",
+				"item=e&limit=2",
+				"item=gatorade",
+				"item=cheese&retailer=Target",
+				"item=e&from=2022-02-01&to=2022-02-28",
+				"item=" + url.QueryEscape(" - "),
+				"item=zzz",
+			} {
+				indexed := searchPages(t, h, query)
+				items := memory.items
+				memory.items = nil
+				scanned := searchPages(t, h, query)
+				memory.items = items
+				if !slices.Equal(indexed, scanned) {
+					t.Errorf("search for %s with the index = %q, without = %q", query, indexed, scanned)
+				}
+			}
+
+			// The index narrows down searches with a word in them, and
+			// leaves the rest to a scan.
+			for term, indexed := range map[string]bool{"klarbrunn": true, "12-pk": true, "-": false, " ": false} {
+				used, err := memory.scanItems(context.Background(), term, 0, func(StoredReceipt) bool { return true })
+				if err != nil || used != indexed {
+					t.Errorf("scanItems(%q) = %v, %v, want %v", term, used, err, indexed)
+				}
+			}
+		})
+	}
+}
+
+func TestSearchRequiresItem(t *testing.T) {
+	h := newTestServer(t).Handler()
+	for _, query := range []string{"", "item=", "item=+++", "item=tea&from=yesterday", "item=tea&limit=0"} {
+		rec := send(h, http.MethodGet, "/receipts/search?"+query, "")
+		if rec.Code != http.StatusBadRequest || errorCode(t, rec) != codeInvalidQuery {
+			t.Errorf("GET /receipts/search?%s = %d %s, want 400", query, rec.Code, rec.Body)
+		}
+	}
+}
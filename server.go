@@ -0,0 +1,1137 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"mime"
+	"net/http"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/y1zhuo/receipt-processor-challenge/api"
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+const (
+	// defaultBatchLimit is the default maximum number of receipts accepted
+	// by a single request to /receipts/process/batch.
+	defaultBatchLimit = 100
+	// defaultMaxBodyBytes is the default limit on the size of a request body.
+	defaultMaxBodyBytes = 1 << 20
+	// defaultMaxBatchBodyBytes is the default limit on the size of a batch
+	// or CSV upload, which holds many receipts.
+	defaultMaxBatchBodyBytes = 16 << 20
+	// defaultDeletedRetention is how long deleted receipts can be restored
+	// unless configured otherwise.
+	defaultDeletedRetention = 7 * 24 * time.Hour
+)
+
+// Server serves the receipt processor API on top of a Store.
+type Server struct {
+	store        Store
+	metrics      *metrics
+	dedup        *dedupIndex // nil unless deduplication is enabled
+	retailers    *retailerIndex
+	names        *retailerNames // nil unless retailer names are normalized
+	denylist     *denylist      // nil unless a denylist is configured
+	quotas       *quotaTracker  // nil unless API key quotas are configured
+	idempotency  *idempotencyCache
+	batchLimit   int
+	workers      int // how many receipts batches, imports and recalculations score at once
+	maxBodyBytes int64
+	maxBatchBody int64 // maxBodyBytes for batch and CSV uploads
+	images       BlobStore
+	maxImageSize int64 // bytes a receipt image may have
+	features     *featureSwitch
+	dates        points.DateWindow // when receipts may be dated
+	inputFormats points.InputFormats
+	limits       points.Limits // how large receipts may be
+	adminToken   string        // admin endpoints are disabled when empty
+	apiKeys      []apiKey
+	rateLimiter  *rateLimiter     // nil unless rate limiting is enabled
+	webhooks     *webhookNotifier // nil unless webhooks are configured
+	cors         *corsPolicy      // nil unless CORS is configured
+	async        *asyncQueue
+	caps         *dailyCaps   // nil unless a daily cap is configured
+	audit        *auditLog    // nil unless auditing is enabled
+	ids          *idSigner    // nil unless receipt IDs are signed
+	idgen        IDGenerator  // makes the IDs of new receipts
+	snapshots    *snapshotter // nil unless snapshots are enabled
+	anomalies    *anomalyTracker
+	stream       *receiptStream
+	pointsMaxAge time.Duration
+	expiry       pointsExpiry
+	keepDeleted  time.Duration // how long deleted receipts can be restored before they are purged
+	rulesPath    string        // the rules file reloaded by reloadRules; "" for the compiled-in rules
+	// requestTimeout bounds the time spent on each API request; zero
+	// means no limit.
+	requestTimeout time.Duration
+	authRules      []authRule
+	logger         *slog.Logger
+	logLevel       *slog.LevelVar // the level logger logs at, adjustable at runtime
+	started        time.Time
+}
+
+func newServer(store Store) *Server {
+	return &Server{
+		store:        store,
+		metrics:      newMetrics(store),
+		retailers:    newRetailerIndex(),
+		idempotency:  newIdempotencyCache(defaultIdempotencyTTL),
+		async:        newAsyncQueue(defaultAsyncQueueSize, defaultAsyncWorkers),
+		stream:       newReceiptStream(),
+		anomalies:    newAnomalyTracker(defaultAnomalyWindow, defaultAnomalyThreshold),
+		idgen:        uuidGenerator{},
+		features:     newFeatureSwitch(features{}, nil),
+		batchLimit:   defaultBatchLimit,
+		workers:      runtime.GOMAXPROCS(0),
+		maxBodyBytes: defaultMaxBodyBytes,
+		maxBatchBody: defaultMaxBatchBodyBytes,
+		images:       newMemoryBlobStore(),
+		maxImageSize: defaultMaxImageBytes,
+		dates:        points.DateWindow{Location: time.UTC},
+		limits:       points.DefaultLimits(),
+		keepDeleted:  defaultDeletedRetention,
+		logger:       slog.Default(),
+		logLevel:     new(slog.LevelVar),
+		started:      time.Now(),
+	}
+}
+
+// Handler returns the HTTP handler for the API routes.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /receipts/process", s.writable(s.idempotency.wrap(s.processReceiptHandler)))
+	mux.HandleFunc("POST /receipts/process/batch", s.writable(s.processBatchHandler))
+	mux.HandleFunc("POST /receipts/process/csv", s.writable(s.processCSVHandler))
+	mux.HandleFunc("POST /receipts/points", s.previewPointsHandler)
+	// Without these, GET, PUT and DELETE /receipts/process and
+	// /receipts/points would match the {id} routes below and be rejected
+	// as an invalid ID.
+	for _, path := range []string{"/receipts/process", "/receipts/points"} {
+		mux.Handle("GET "+path, allowOnly(http.MethodPost))
+		mux.Handle("PUT "+path, allowOnly(http.MethodPost))
+		mux.Handle("DELETE "+path, allowOnly(http.MethodPost))
+	}
+	mux.HandleFunc("GET /receipts", s.listReceiptsHandler)
+	mux.HandleFunc("GET /receipts/export.csv", s.exportCSVHandler)
+	mux.HandleFunc("GET /receipts/search", s.searchReceiptsHandler)
+	for _, path := range []string{"/receipts/export.csv", "/receipts/search", "/receipts/stream"} {
+		mux.Handle("PUT "+path, allowOnly(http.MethodGet, http.MethodHead))
+		mux.Handle("DELETE "+path, allowOnly(http.MethodGet, http.MethodHead))
+	}
+	mux.HandleFunc("GET /receipts/{id}", s.getReceiptHandler)
+	mux.HandleFunc("PUT /receipts/{id}", s.writable(s.updateReceiptHandler))
+	mux.HandleFunc("DELETE /receipts/{id}", s.writable(s.deleteReceiptHandler))
+	mux.HandleFunc("POST /receipts/{id}/restore", s.writable(s.restoreReceiptHandler))
+	mux.HandleFunc("GET /receipts/{id}/points", s.getPointsHandler)
+	mux.HandleFunc("GET /receipts/{id}/breakdown", s.getBreakdownHandler)
+	mux.HandleFunc("POST /receipts/{id}/image", s.writable(s.uploadImageHandler))
+	mux.HandleFunc("GET /receipts/{id}/image", s.getImageHandler)
+	mux.HandleFunc("GET /rules", s.rulesHandler)
+	mux.HandleFunc("GET /version", s.versionHandler)
+	mux.HandleFunc("GET /retailers/points", s.leaderboardHandler)
+	if s.quotas != nil {
+		mux.HandleFunc("GET /quota", s.quotaHandler)
+	}
+	mux.Handle("GET /metrics", s.metrics)
+	mux.HandleFunc("GET /openapi.yaml", openAPIHandler)
+	mux.HandleFunc("GET /docs", docsHandler)
+	api := s.metrics.instrument(mux, limitTime(s.requestTimeout, s.authenticate(s.limitRate(limitBody(s.bodyLimit, decompressBody(s.bodyLimit, negotiateContent(mux, withJSONFallback(mux))))))))
+
+	// Probes are served ahead of the API middleware so that they are never
+	// subject to it.
+	root := http.NewServeMux()
+	root.HandleFunc("GET /healthz", s.healthzHandler)
+	root.HandleFunc("GET /readyz", s.readyzHandler)
+	// The stream outlives any request timeout, and its latency says
+	// nothing, so it skips those parts of the API middleware too.
+	root.Handle("GET /receipts/stream", s.authenticate(s.limitRate(negotiateContent(root, http.HandlerFunc(s.streamReceiptsHandler)))))
+	// Likewise an NDJSON upload lasts as long as the client keeps sending,
+	// and holds its lines to the body limit one at a time instead.
+	root.Handle("POST /receipts/process/stream", s.authenticate(s.limitRate(decompressBody(nil, negotiateContent(root, s.writable(s.processStreamHandler))))))
+	// Other methods on these paths would fall through to the API mux,
+	// which knows nothing of them and would answer 404.
+	for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete} {
+		root.Handle(method+" /healthz", allowOnly(http.MethodGet, http.MethodHead))
+		root.Handle(method+" /readyz", allowOnly(http.MethodGet, http.MethodHead))
+	}
+	for _, method := range []string{http.MethodGet, http.MethodPut, http.MethodPatch, http.MethodDelete} {
+		root.Handle(method+" /receipts/process/stream", allowOnly(http.MethodPost))
+	}
+	root.Handle("/", api)
+
+	// Admin routes have their own token in place of API keys and rate
+	// limits, and no body limit so that imports can be large. They do not
+	// exist at all unless a token is configured.
+	muxes := []*http.ServeMux{root, mux}
+	if s.adminToken != "" {
+		admin := http.NewServeMux()
+		muxes = append(muxes, admin)
+		admin.HandleFunc("POST /admin/recalculate", s.writable(s.recalculateHandler))
+		admin.HandleFunc("GET /admin/export", s.exportHandler)
+		admin.HandleFunc("POST /admin/import", s.writable(s.importHandler))
+		admin.HandleFunc("DELETE /admin/receipts", s.writable(s.purgeHandler))
+		admin.HandleFunc("GET /admin/stats", s.statsHandler)
+		admin.HandleFunc("GET /admin/stats/points", s.pointsStatsHandler)
+		admin.HandleFunc("GET /admin/anomalies", s.anomaliesHandler)
+		admin.HandleFunc("POST /admin/rules/reload", s.reloadRulesHandler)
+		admin.HandleFunc("POST /admin/denylist/reload", s.reloadDenylistHandler)
+		admin.HandleFunc("GET /admin/loglevel", s.logLevelHandler)
+		admin.HandleFunc("PUT /admin/loglevel", s.setLogLevelHandler)
+		admin.HandleFunc("GET /admin/features", s.featuresHandler)
+		admin.HandleFunc("PATCH /admin/features", s.patchFeaturesHandler)
+		if s.audit != nil {
+			admin.HandleFunc("GET /admin/audit", s.auditHandler)
+		}
+		if s.webhooks != nil && s.webhooks.outbox != nil {
+			admin.HandleFunc("GET /admin/webhooks/failed", s.failedWebhooksHandler)
+			admin.HandleFunc("POST /admin/webhooks/{eventId}/retry", s.retryWebhookHandler)
+		}
+		root.Handle("/admin/", s.metrics.instrument(admin, s.requireAdmin(decompressBody(nil, negotiateContent(admin, withJSONFallback(admin))))))
+	}
+	for _, register := range debugRoutes {
+		register(root)
+	}
+	return s.logRequests(negotiateLanguage(s.recoverPanics(compressResponses(s.handleCORS(trimTrailingSlash(answerOptions(rejectEmptyIDs(root), muxes...)))))))
+}
+
+// debugRoutes registers extra routes on the root mux. It is only populated
+// in builds with the debugroutes tag.
+var debugRoutes []func(mux *http.ServeMux)
+
+// Start runs the server's background maintenance until ctx is canceled.
+func (s *Server) Start(ctx context.Context) {
+	go s.idempotency.run(ctx, min(s.idempotency.ttl, time.Minute))
+	if s.rateLimiter != nil {
+		go s.rateLimiter.run(ctx, time.Minute)
+	}
+	if s.webhooks != nil {
+		s.webhooks.run(ctx)
+	}
+	s.async.run(s.storeQueued)
+	if s.audit != nil {
+		go s.audit.run()
+	}
+	go s.purgeDeleted(ctx, min(s.keepDeleted, time.Minute))
+	go func() {
+		<-ctx.Done()
+		s.stream.close()
+	}()
+}
+
+// Drain waits for receipts accepted in async mode to be stored, or for ctx
+// to be done. It must only be called once the HTTP server has stopped.
+func (s *Server) Drain(ctx context.Context) error {
+	return s.async.drain(ctx)
+}
+
+// processReceiptHandler handles POST /receipts/process. With async=true, or
+// by default when the server is configured for it, the receipt is validated
+// and scored but only queued to be stored, and the response is 202.
+func (s *Server) processReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	async := s.features.get().Async
+	if v := r.URL.Query().Get("async"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidQuery, "The query parameters are invalid.",
+				points.FieldError{Field: "async", Message: "must be true or false"})
+			return
+		}
+		async = b
+	}
+
+	var receipt points.Receipt
+	if err := decodeJSON(r, &receipt, "Invalid receipt format"); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	var result processResult
+	var err *apiError
+	if async {
+		result, err = s.processReceiptAsync(r.Context(), receipt, s.strictTotalsFor(r))
+	} else {
+		result, err = s.processReceipt(r.Context(), receipt, s.strictTotalsFor(r))
+	}
+	if err != nil {
+		if err.Code == codeQueueFull {
+			w.Header().Set("Retry-After", "1")
+		}
+		if err.ResetsAt != nil {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(*err.ResetsAt).Seconds()))))
+		}
+		writeAPIError(w, err)
+		return
+	}
+
+	// Clients tell a new receipt from a resubmitted one by the status, and
+	// the duplicate header when deduplication is on.
+	status := http.StatusCreated
+	if async {
+		status = http.StatusAccepted
+	}
+	if result.Duplicate {
+		status = http.StatusOK
+		w.Header().Set("X-Receipt-Duplicate", "true")
+	} else {
+		w.Header().Set("Location", "/receipts/"+s.ids.external(result.ID))
+	}
+
+	response := api.ProcessResponse{ID: s.ids.external(result.ID), Cap: result.Cap}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// previewPointsHandler handles POST /receipts/points, reporting the points a
+// receipt would be awarded without storing it. The breakdown is included
+// when the breakdown query parameter is true.
+func (s *Server) previewPointsHandler(w http.ResponseWriter, r *http.Request) {
+	withBreakdown := false
+	if v := r.URL.Query().Get("breakdown"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidQuery, "The query parameters are invalid.",
+				points.FieldError{Field: "breakdown", Message: "must be true or false"})
+			return
+		}
+		withBreakdown = b
+	}
+
+	var receipt points.Receipt
+	if err := decodeJSON(r, &receipt, "Invalid receipt format"); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	_, breakdown, err := s.scoreReceipt(receipt, s.strictTotalsFor(r))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	response := api.PreviewResponse{Points: breakdown.Total}
+	if withBreakdown {
+		response.Breakdown = &breakdown
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// rulesHandler handles GET /rules, reporting the live ruleset in the same
+// format as a rules file.
+func (s *Server) rulesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules.get())
+}
+
+// decodeJSON decodes the request body into v, which must be sent as
+// application/json. invalidMessage is reported if the body is not valid JSON
+// for v.
+func decodeJSON(r *http.Request, v any, invalidMessage string) *apiError {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		return newAPIError(http.StatusUnsupportedMediaType, codeUnsupportedMediaType,
+			"Content-Type must be application/json")
+	}
+	return decodeStrict(r.Body, v, invalidMessage)
+}
+
+// decodeStrict decodes exactly one JSON value from body into v, rejecting
+// trailing data and fields v has no place for. A misspelt field would
+// otherwise be dropped and silently cost the receipt its points.
+func decodeStrict(body io.Reader, v any, invalidMessage string) *apiError {
+	dec := json.NewDecoder(body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		if errors.Is(err, io.EOF) {
+			return newAPIError(http.StatusBadRequest, codeEmptyBody, "The request body is empty")
+		}
+		// encoding/json has no typed error for unknown fields.
+		if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+			field, _ = strconv.Unquote(field)
+			return newAPIError(http.StatusBadRequest, codeInvalidBody, invalidMessage,
+				points.FieldError{Field: field, Message: "is not a known field"})
+		}
+		return bodyReadError(err, invalidMessage)
+	}
+	if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+		return bodyReadError(err, "The request body must hold a single JSON value")
+	}
+	return nil
+}
+
+// bodyReadError converts an error reading or decoding the request body into
+// a 413 if the body was too large, or a 400 with message otherwise.
+func bodyReadError(err error, message string) *apiError {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return newAPIError(http.StatusRequestEntityTooLarge, codeBodyTooLarge,
+			fmt.Sprintf("Request body exceeds the limit of %d bytes", maxBytesErr.Limit))
+	}
+	return newAPIError(http.StatusBadRequest, codeInvalidBody, message)
+}
+
+// bodyLimit returns the most bytes the body of r may hold, uploads of many
+// receipts and of images being allowed more than the rest.
+func (s *Server) bodyLimit(r *http.Request) int64 {
+	switch r.URL.Path {
+	case "/receipts/process/batch", "/receipts/process/csv":
+		return s.maxBatchBody
+	}
+	if r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/receipts/") && strings.HasSuffix(r.URL.Path, "/image") {
+		return s.maxImageSize + imageFormOverhead
+	}
+	return s.maxBodyBytes
+}
+
+// processResult describes a successfully processed receipt.
+type processResult struct {
+	ID string
+	// Duplicate reports that an identical receipt was already stored under
+	// ID, so nothing new was stored.
+	Duplicate bool
+	// Cap reports that a daily cap reduced the receipt's points.
+	Cap *capResult
+}
+
+// scoreReceipt normalizes, validates and scores a receipt without storing
+// it, returning the receipt in its normalized form. It is the single path by
+// which both stored receipts and previews are scored. With
+// strict set, a receipt whose total is not the sum of its item prices is
+// rejected; otherwise the mismatch is only noted in the breakdown's warnings.
+// A receipt dated outside s.dates is likewise rejected if the strict-dates
+// feature is on, and flagged in the warnings if not.
+func (s *Server) scoreReceipt(receipt points.Receipt, strict bool) (points.Receipt, points.Breakdown, *apiError) {
+	features := s.features.get()
+	formats := s.inputFormats
+	formats.RetailerAlphanumeric = features.RetailerAlphanumeric
+	formats.ReceiptZones = features.ZoneAwareScoring
+	formats.Itemless = features.ItemlessReceipts
+	receipt, errs := formats.ValidateInput(receipt)
+	if len(errs) > 0 {
+		s.metrics.observeValidation(errs)
+		return receipt, points.Breakdown{}, newAPIError(http.StatusBadRequest, codeInvalidReceipt, "The receipt is invalid.", errs...)
+	}
+	if errs := s.limits.Check(receipt); len(errs) > 0 {
+		s.metrics.observeValidation(errs)
+		return receipt, points.Breakdown{}, newAPIError(http.StatusUnprocessableEntity, codeLimitExceeded,
+			"The receipt exceeds the accepted limits.", errs...)
+	}
+	if apiErr := s.denylist.check(receipt); apiErr != nil {
+		s.metrics.observeValidation(apiErr.Details)
+		return receipt, points.Breakdown{}, apiErr
+	}
+	if mismatch, ok := points.CheckTotal(receipt); !ok && strict {
+		s.metrics.observeValidation([]points.FieldError{mismatch})
+		return receipt, points.Breakdown{}, newAPIError(http.StatusUnprocessableEntity, codeTotalMismatch,
+			"The total does not match the item prices.", mismatch)
+	}
+	dates := s.dates
+	if loc, ok := points.LoadZone(receipt.Timezone); ok && features.ZoneAwareScoring {
+		dates.Location = loc
+	}
+	dateProblem, datesOK := dates.Check(receipt, time.Now())
+	if !datesOK && features.StrictDates {
+		s.metrics.observeValidation([]points.FieldError{dateProblem})
+		return receipt, points.Breakdown{}, newAPIError(http.StatusUnprocessableEntity, codeDateOutOfRange,
+			"The receipt is dated outside the accepted range.", dateProblem)
+	}
+
+	breakdown := s.scoringRules().Breakdown(receipt)
+	if !datesOK {
+		s.metrics.observeDateFlagged(dateProblem.Field)
+		breakdown.Warnings = append(breakdown.Warnings, dateProblem.Error())
+	}
+	return receipt, breakdown, nil
+}
+
+// parseInputFormats parses the -input-formats list.
+func parseInputFormats(spec string) (points.InputFormats, error) {
+	var formats points.InputFormats
+	for _, name := range splitList(spec) {
+		switch strings.ToLower(name) {
+		case "us-date":
+			formats.USDates = true
+		case "12-hour":
+			formats.TwelveHourTimes = true
+		case "datetime":
+			formats.DateTimes = true
+		case "none":
+		default:
+			return formats, fmt.Errorf("unknown input format %q", name)
+		}
+	}
+	return formats, nil
+}
+
+// scoringRules returns the rules receipts are scored with, which are the
+// live ruleset read in receipts' own time zones if zone-aware-scoring is on.
+func (s *Server) scoringRules() points.RulesConfig {
+	config := rules.get()
+	config.ZoneAware = s.features.get().ZoneAwareScoring
+	return config
+}
+
+// strictTotalsFor reports whether totals are checked for r: always when the
+// server is configured to, and otherwise when the client asks with an
+// X-Strict-Totals header. A client cannot turn the check off.
+func (s *Server) strictTotalsFor(r *http.Request) bool {
+	if s.features.get().StrictTotals {
+		return true
+	}
+	strict, _ := strconv.ParseBool(r.Header.Get("X-Strict-Totals"))
+	return strict
+}
+
+// processReceipt validates, scores and stores a receipt, checking its total
+// if strict is set.
+func (s *Server) processReceipt(ctx context.Context, receipt points.Receipt, strict bool) (processResult, *apiError) {
+	receipt, breakdown, err := s.scoreReceipt(receipt, strict)
+	if err != nil {
+		return processResult{}, err
+	}
+	return s.storeScored(ctx, receipt, breakdown)
+}
+
+// storeScored stores a receipt scoreReceipt has normalized and scored. It
+// is the part of processReceipt that batches run in order, once the
+// receipts have been scored in parallel.
+func (s *Server) storeScored(ctx context.Context, receipt points.Receipt, breakdown points.Breakdown) (processResult, *apiError) {
+	return s.acceptScored(ctx, receipt, breakdown, func(id string, receipt points.Receipt, breakdown points.Breakdown) *apiError {
+		saveCtx, deliveries := s.webhooks.prepare(ctx, s.webhookEvent(id, ownerFrom(ctx), receipt, breakdown))
+		if err := s.store.SaveReceipt(withNewID(saveCtx), id, receipt, breakdown); err != nil {
+			return s.storeError(ctx, err)
+		}
+		s.receiptStored(id, ownerFrom(ctx), receipt, breakdown, deliveries)
+		s.audit.record(ctx, auditCreated, id, nil)
+		return nil
+	})
+}
+
+// processReceiptAsync is processReceipt, except that the receipt is queued
+// to be stored by a worker rather than stored before it returns.
+func (s *Server) processReceiptAsync(ctx context.Context, receipt points.Receipt, strict bool) (processResult, *apiError) {
+	receipt, breakdown, err := s.scoreReceipt(receipt, strict)
+	if err != nil {
+		return processResult{}, err
+	}
+	return s.acceptScored(ctx, receipt, breakdown, func(id string, receipt points.Receipt, breakdown points.Breakdown) *apiError {
+		// The receipt is only stored once the client has its ID, so the
+		// ID must be checked before then.
+		if taken, err := s.idTaken(id); err != nil {
+			return s.storeError(ctx, err)
+		} else if taken {
+			return errIDUnavailable()
+		}
+		job := asyncJob{id: id, receipt: receipt, breakdown: breakdown, tenant: ownerFrom(ctx), audit: newAuditEntry(ctx, auditCreated, id)}
+		if !s.async.enqueue(job) {
+			return newAPIError(http.StatusServiceUnavailable, codeQueueFull, "Too many receipts are waiting to be processed; retry later")
+		}
+		return nil
+	})
+}
+
+// acceptScored takes a receipt scoreReceipt has normalized and scored and,
+// unless it duplicates one already stored, assigns it an ID and hands it to
+// save.
+func (s *Server) acceptScored(ctx context.Context, receipt points.Receipt, breakdown points.Breakdown, save func(id string, receipt points.Receipt, breakdown points.Breakdown) *apiError) (processResult, *apiError) {
+	var hash string
+	if s.dedup != nil {
+		s.dedup.mu.Lock()
+		defer s.dedup.mu.Unlock()
+
+		hash = s.dedup.hash(ownerFrom(ctx), receipt)
+		if id, ok := s.dedup.ids[hash]; ok {
+			// The original may have been evicted from the store since.
+			pending := s.async.isPending(ctx, id)
+			_, err := s.store.GetPoints(ctx, id)
+			if err == nil || pending {
+				return processResult{ID: id, Duplicate: true}, nil
+			}
+			if !errors.Is(err, ErrNotFound) {
+				return processResult{}, s.storeError(ctx, err)
+			}
+			s.dedup.remove(id)
+		}
+	}
+
+	// An ID that turns out to be taken is replaced, up to maxIDAttempts
+	// times.
+	for attempt := 1; ; attempt++ {
+		id, err := s.idgen.NewID()
+		if err != nil {
+			return processResult{}, newAPIError(http.StatusInternalServerError, codeInternal, "Failed to generate receipt ID")
+		}
+		result, apiErr := s.acceptAs(ctx, id, receipt, breakdown, save)
+		if apiErr != nil && apiErr.Code == codeIDUnavailable && attempt < maxIDAttempts {
+			continue
+		}
+		if apiErr == nil && s.dedup != nil {
+			s.dedup.add(hash, id)
+		}
+		return result, apiErr
+	}
+}
+
+// acceptAs hands a receipt to save under id, for acceptScored.
+func (s *Server) acceptAs(ctx context.Context, id string, receipt points.Receipt, breakdown points.Breakdown, save func(id string, receipt points.Receipt, breakdown points.Breakdown) *apiError) (processResult, *apiError) {
+	// The receipt is counted toward its key's quota, and its points toward
+	// the cap, before it is saved, so that receipts saved concurrently
+	// cannot both fit under either. Duplicates count toward neither.
+	unquota, apiErr := s.quotas.take(ctx)
+	if apiErr != nil {
+		return processResult{}, apiErr
+	}
+	var capped *capResult
+	undo := func() {}
+	if s.caps != nil {
+		breakdown, capped, undo = s.caps.award(id, ownerFrom(ctx), receipt, breakdown)
+	}
+	if err := save(id, receipt, breakdown); err != nil {
+		undo()
+		unquota()
+		return processResult{}, err
+	}
+	return processResult{ID: id, Cap: capped}, nil
+}
+
+// idTaken reports whether a receipt, whoever owns it, is stored, deleted or
+// not, or waiting to be stored under id.
+func (s *Server) idTaken(id string) (bool, error) {
+	ctx := context.Background()
+	if s.async.isPending(ctx, id) {
+		return true, nil
+	}
+	_, err := s.store.GetRevision(withDeleted(ctx), id)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// errIDUnavailable is what a receipt is refused with when every ID it was
+// tried under was taken.
+func errIDUnavailable() *apiError {
+	return newAPIError(http.StatusServiceUnavailable, codeIDUnavailable, "No free receipt ID was found; retry later")
+}
+
+// webhookEvent returns the webhook event for a receipt stored for tenant.
+func (s *Server) webhookEvent(id, tenant string, receipt points.Receipt, breakdown points.Breakdown) webhookEvent {
+	return webhookEvent{
+		ID:           s.ids.external(id),
+		Tenant:       tenant,
+		Retailer:     receipt.Retailer,
+		PurchaseDate: receipt.PurchaseDate,
+		Total:        receipt.Total,
+		Points:       breakdown.Total,
+	}
+}
+
+// receiptStored records that a receipt has been stored for tenant, sending
+// the webhook deliveries prepared for it.
+func (s *Server) receiptStored(id, tenant string, receipt points.Receipt, breakdown points.Breakdown, deliveries []webhookDelivery) {
+	s.metrics.observeProcessed(breakdown)
+	s.anomalies.observe(breakdown)
+	s.retailers.add(id, tenant, receipt.Retailer, breakdown.Total)
+	if s.webhooks != nil {
+		s.webhooks.send(deliveries)
+	}
+	s.stream.publish(streamEvent{ID: s.ids.external(id), Retailer: receipt.Retailer, Total: receipt.Total, Points: breakdown.Total, tenant: tenant})
+}
+
+// receiptEvicted records that the memory store evicted a receipt.
+func (s *Server) receiptEvicted(id, reason string) {
+	s.metrics.observeEviction(reason)
+	s.audit.record(context.Background(), auditEvicted, id, nil)
+	s.retailers.remove(id)
+	if s.caps != nil {
+		s.caps.remove(id)
+	}
+	s.deleteImage(context.Background(), id)
+}
+
+// uuidPattern matches the canonical textual form of an RFC 4122 UUID.
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// generateUniqueID returns a random (version 4) RFC 4122 UUID.
+func generateUniqueID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40 // version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // variant 10
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// storeError converts a failed Store call into the error reported to clients,
+// logging failures that are not the client's doing.
+func (s *Server) storeError(ctx context.Context, err error) *apiError {
+	var deleted *DeletedError
+	if errors.As(err, &deleted) {
+		at := deleted.DeletedAt.UTC()
+		e := newAPIError(http.StatusGone, codeReceiptDeleted, "The receipt was deleted")
+		e.DeletedAt = &at
+		return e
+	}
+	var compacted *CompactedError
+	if errors.As(err, &compacted) {
+		at := compacted.CompactedAt.UTC()
+		e := newAPIError(http.StatusGone, codeReceiptCompacted, "The receipt was compacted; only its points and a summary are kept")
+		e.CompactedAt = &at
+		return e
+	}
+	if errors.Is(err, ErrNotFound) {
+		return newAPIError(http.StatusNotFound, codeReceiptNotFound, "No receipt found for that ID")
+	}
+	if errors.Is(err, ErrIDTaken) {
+		return errIDUnavailable()
+	}
+	if errors.Is(err, ErrRevisionMismatch) {
+		return newAPIError(http.StatusPreconditionFailed, codeReceiptChanged, "The receipt has changed since it was read; fetch it again and retry")
+	}
+	if errors.Is(err, context.DeadlineExceeded) && deadlineRequested(ctx) {
+		// As for the server's own timeout below, but the time was the
+		// client's to give, so it is the one that ran out.
+		return newAPIError(http.StatusGatewayTimeout, codeTimeout, "The request ran past its X-Request-Timeout")
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		// The store gave up on the call, leaving nothing half done. A
+		// client that canceled will not see this.
+		return newAPIError(http.StatusServiceUnavailable, codeTimeout, "The request timed out")
+	}
+	s.logger.ErrorContext(ctx, "store call failed", slog.String("component", componentStore), slog.Any("error", err))
+	return newAPIError(http.StatusInternalServerError, codeInternal, "Internal server error")
+}
+
+func (s *Server) writeStoreError(w http.ResponseWriter, r *http.Request, err error) {
+	writeAPIError(w, s.storeError(r.Context(), err))
+}
+
+// writeLookupError writes the response for a failed read of the receipt with
+// id. pending is whether the receipt was waiting to be stored before the read
+// was attempted: checking afterwards could miss one stored in between.
+func (s *Server) writeLookupError(w http.ResponseWriter, r *http.Request, err error, pending bool) {
+	if errors.Is(err, ErrNotFound) && pending {
+		w.Header().Set("Retry-After", "1")
+		writeError(w, http.StatusNotFound, codeReceiptPending, "Receipt is still being processed")
+		return
+	}
+	s.writeStoreError(w, r, err)
+}
+
+// internalID returns the receipt ID that external, as sent by a client,
+// stands for, reporting false if it is not a token s.ids issued or, with no
+// signer, not an ID of the configured format.
+func (s *Server) internalID(external string) (string, bool) {
+	if s.ids != nil {
+		return s.ids.internal(external)
+	}
+	return s.idgen.ParseID(external)
+}
+
+// receiptID returns the receipt ID the {id} path segment of r, percent-decoded,
+// names, writing a 400 response and reporting false if it is not a valid
+// receipt ID, or a 404 if it is not a token s.ids issued.
+func (s *Server) receiptID(w http.ResponseWriter, r *http.Request) (string, bool) {
+	id, ok := s.internalID(r.PathValue("id"))
+	if !ok {
+		if s.ids != nil {
+			// A forged token is reported as an unknown ID would be, so
+			// that it reveals nothing about the ID inside it.
+			writeError(w, http.StatusNotFound, codeReceiptNotFound, "No receipt found for that ID")
+			return "", false
+		}
+		writeInvalidID(w)
+		return "", false
+	}
+	return id, true
+}
+
+// expectedRevision returns the revision of the receipt with id that the
+// If-Match header of r makes a write to it conditional on, or 0 if there is
+// none. It returns ErrRevisionMismatch if the receipt is no longer at a
+// revision the header names.
+func (s *Server) expectedRevision(r *http.Request, id string) (uint64, error) {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return 0, nil
+	}
+	revision, err := s.store.GetRevision(r.Context(), id)
+	if err != nil {
+		return 0, err
+	}
+	if !etagMatchesStrongly(header, revisionETag(revision)) {
+		return 0, ErrRevisionMismatch
+	}
+	return revision, nil
+}
+
+// getReceiptHandler handles GET /receipts/{id}. The receipt's revision is
+// its ETag, for If-None-Match and for the If-Match of a later PUT or
+// DELETE.
+func (s *Server) getReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.receiptID(w, r)
+	if !ok {
+		return
+	}
+
+	// The revision is read first: should the receipt change in between,
+	// the ETag is older than the receipt served, and a write made with it
+	// is refused rather than undoing a change the client has not seen.
+	pending := s.async.isPending(r.Context(), id)
+	revision, err := s.store.GetRevision(r.Context(), id)
+	if err != nil {
+		s.writeLookupError(w, r, err, pending)
+		return
+	}
+	receipt, err := s.store.GetReceipt(r.Context(), id)
+	if err != nil {
+		s.writeLookupError(w, r, err, pending)
+		return
+	}
+
+	etag := revisionETag(revision)
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	mediaType, body := encodeResponse(r, "receipt", receipt)
+	w.Header().Set("Content-Type", mediaType)
+	w.Write(append(body, '\n'))
+}
+
+// updateReceiptHandler handles PUT /receipts/{id}, replacing a stored
+// receipt with a corrected one. The replacement is validated and scored as a
+// new receipt would be, and its points are returned. With If-Match, the
+// receipt is only replaced if it is still at the revision named.
+func (s *Server) updateReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.receiptID(w, r)
+	if !ok {
+		return
+	}
+	if s.async.isPending(r.Context(), id) {
+		w.Header().Set("Retry-After", "1")
+		writeError(w, http.StatusConflict, codeReceiptPending, "Receipt is still being processed; retry once it is stored")
+		return
+	}
+
+	var receipt points.Receipt
+	if err := decodeJSON(r, &receipt, "Invalid receipt format"); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	receipt, breakdown, apiErr := s.scoreReceipt(receipt, s.strictTotalsFor(r))
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	if s.dedup != nil {
+		s.dedup.mu.Lock()
+		defer s.dedup.mu.Unlock()
+	}
+	revision, err := s.expectedRevision(r, id)
+	if err != nil {
+		s.writeStoreError(w, r, err)
+		return
+	}
+	var capped *capResult
+	undo := func() {}
+	if s.caps != nil {
+		breakdown, capped, undo = s.caps.reaward(id, receipt, breakdown)
+	}
+	var changes *auditChanges
+	if s.audit != nil {
+		// Read before the update, so the entry can say what it changed. A
+		// receipt that cannot be read will fail to update too.
+		if old, err := s.store.GetReceipt(r.Context(), id); err == nil {
+			if oldPoints, err := s.store.GetPoints(r.Context(), id); err == nil {
+				changes = receiptChanges(old, oldPoints, receipt, breakdown.Total)
+			}
+		}
+	}
+	if err := s.store.UpdateReceipt(r.Context(), id, revision, receipt, breakdown); err != nil {
+		undo()
+		s.writeStoreError(w, r, err)
+		return
+	}
+	s.audit.record(r.Context(), auditUpdated, id, changes)
+	if s.dedup != nil {
+		// A correction that duplicates another receipt leaves that one
+		// as the receipt its duplicates resolve to.
+		s.dedup.remove(id)
+		if hash := s.dedup.hash(ownerFrom(r.Context()), receipt); s.dedup.ids[hash] == "" {
+			s.dedup.add(hash, id)
+		}
+	}
+	s.retailers.replaced(id, receipt.Retailer, breakdown.Total)
+
+	response := struct {
+		Points int        `json:"points"`
+		Cap    *capResult `json:"cap,omitempty"`
+	}{breakdown.Total, capped}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// deleteReceiptHandler handles DELETE /receipts/{id}. The receipt is only
+// marked deleted, and can be restored until keepDeleted has passed, but its
+// image is removed for good. With If-Match, it is only deleted if it is
+// still at the revision named.
+func (s *Server) deleteReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.receiptID(w, r)
+	if !ok {
+		return
+	}
+
+	if s.dedup != nil {
+		s.dedup.mu.Lock()
+		defer s.dedup.mu.Unlock()
+	}
+	revision, err := s.expectedRevision(r, id)
+	if err != nil {
+		s.writeStoreError(w, r, err)
+		return
+	}
+	if err := s.store.Delete(r.Context(), id, revision); err != nil {
+		s.writeStoreError(w, r, err)
+		return
+	}
+	s.audit.record(r.Context(), auditDeleted, id, nil)
+	if s.dedup != nil {
+		s.dedup.remove(id)
+	}
+	s.retailers.remove(id)
+	if s.caps != nil {
+		s.caps.remove(id)
+	}
+	// Unlike the receipt, the image is not kept for a restore.
+	s.deleteImage(r.Context(), id)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// restoreReceiptHandler handles POST /receipts/{id}/restore, undoing the
+// deletion of a receipt deleted within keepDeleted. Restoring a receipt
+// that is not deleted changes nothing.
+func (s *Server) restoreReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.receiptID(w, r)
+	if !ok {
+		return
+	}
+
+	if s.dedup != nil {
+		s.dedup.mu.Lock()
+		defer s.dedup.mu.Unlock()
+	}
+	stored, err := s.store.Restore(r.Context(), id, time.Now().Add(-s.keepDeleted))
+	if err != nil {
+		apiErr := s.storeError(r.Context(), err)
+		if apiErr.Code == codeReceiptDeleted {
+			apiErr.Message = "The receipt was deleted too long ago to be restored"
+		}
+		writeAPIError(w, apiErr)
+		return
+	}
+	s.audit.record(r.Context(), auditRestored, id, nil)
+	if s.dedup != nil {
+		// A receipt resubmitted while this one was deleted keeps the
+		// duplicates that resolve to it.
+		if hash := s.dedup.hash(stored.Tenant, stored.Receipt); s.dedup.ids[hash] == "" {
+			s.dedup.add(hash, id)
+		}
+	}
+	s.retailers.add(id, stored.Tenant, stored.Receipt.Retailer, stored.Points)
+	if s.caps != nil {
+		// The receipt gets back the points it had, even if others have
+		// used up its cap since.
+		s.caps.add(id, stored.Tenant, stored.Receipt, stored.Points)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.RestoreResponse{ID: s.ids.external(id), Points: stored.Points})
+}
+
+// purgeDeleted removes receipts deleted more than keepDeleted ago, every
+// interval until ctx is canceled.
+func (s *Server) purgeDeleted(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			n, err := s.store.PurgeDeleted(ctx, now.Add(-s.keepDeleted))
+			if err != nil {
+				if ctx.Err() == nil {
+					s.logger.Error("failed to purge deleted receipts", slog.String("component", componentStore), slog.Any("error", err))
+				}
+				continue
+			}
+			if n > 0 {
+				s.logger.Info("purged deleted receipts", slog.String("component", componentStore), slog.Int("receipts", n))
+				entry := newAuditEntry(ctx, auditExpired, "")
+				entry.Receipts = n
+				s.audit.add(entry)
+			}
+		}
+	}
+}
+
+func (s *Server) getPointsHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.receiptID(w, r)
+	if !ok {
+		return
+	}
+
+	include, fieldErr := parsePointsInclude(r.URL.Query()["include"])
+	if fieldErr != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidQuery, "The query parameters are invalid.", *fieldErr)
+		return
+	}
+	at, fieldErr := parseAt(r.URL.Query())
+	if fieldErr != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidQuery, "The query parameters are invalid.", *fieldErr)
+		return
+	}
+
+	pending := s.async.isPending(r.Context(), id)
+	points, err := s.store.GetPoints(r.Context(), id)
+	if err != nil {
+		s.writeLookupError(w, r, err, pending)
+		return
+	}
+	response := pointsResponse{Points: points}
+	if include.receipt {
+		receipt, err := s.store.GetReceipt(r.Context(), id)
+		if err != nil {
+			s.writeLookupError(w, r, err, pending)
+			return
+		}
+		response.Receipt = &receipt
+	}
+	if include.breakdown {
+		breakdown, err := s.store.GetBreakdown(r.Context(), id)
+		if err != nil {
+			s.writeLookupError(w, r, err, pending)
+			return
+		}
+		// The receipt may have been rescored since its points were read.
+		response.Points, response.Breakdown = breakdown.Total, &breakdown.Rules
+	}
+	if !at.IsZero() && s.expiry.months > 0 {
+		// The expiry policy only reads the purchase date, which a
+		// compacted receipt keeps.
+		receipt, err := s.store.GetReceipt(withCompacted(r.Context()), id)
+		if err != nil {
+			s.writeLookupError(w, r, err, pending)
+			return
+		}
+		effective, expires, ok, err := s.expiry.effective(receipt, response.Points, at)
+		if err != nil {
+			writeAPIError(w, undatedError())
+			return
+		}
+		response.Points = effective
+		if ok {
+			response.ExpiresOn = expires.Format("2006-01-02")
+		}
+	}
+
+	// Points only change when a receipt is rescored, so clients polling
+	// for them can revalidate cheaply.
+	mediaType, body := encodeResponse(r, "receiptPoints", response)
+	etag := pointsETag(id, points)
+	if include != (pointsInclude{}) || !at.IsZero() || mediaType != mediaJSON {
+		variant := include.String()
+		if !at.IsZero() {
+			variant += " at=" + at.Format("2006-01-02")
+		}
+		if mediaType != mediaJSON {
+			variant += " type=" + mediaType
+		}
+		etag = embeddedPointsETag(id, variant, body)
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(s.pointsMaxAge.Seconds())))
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", mediaType)
+	w.Write(append(body, '\n'))
+}
+
+// pointsResponse is the body of GET /receipts/{id}/points.
+type pointsResponse = api.PointsResponse
+
+// pointsInclude says what GET /receipts/{id}/points embeds besides the
+// points.
+type pointsInclude struct {
+	receipt, breakdown bool
+}
+
+// parsePointsInclude parses the values of the include query parameter, each
+// a comma-separated list of receipt and breakdown.
+func parsePointsInclude(values []string) (pointsInclude, *points.FieldError) {
+	var include pointsInclude
+	for _, value := range values {
+		for _, token := range strings.Split(value, ",") {
+			switch strings.TrimSpace(token) {
+			case "receipt":
+				include.receipt = true
+			case "breakdown":
+				include.breakdown = true
+			case "":
+			default:
+				return include, &points.FieldError{Field: "include", Message: fmt.Sprintf("has an unknown value %q; it may list receipt and breakdown", strings.TrimSpace(token))}
+			}
+		}
+	}
+	return include, nil
+}
+
+// String lists what is included as the include parameter would, in a fixed
+// order.
+func (i pointsInclude) String() string {
+	var names []string
+	if i.receipt {
+		names = append(names, "receipt")
+	}
+	if i.breakdown {
+		names = append(names, "breakdown")
+	}
+	return strings.Join(names, ",")
+}
+
+func (s *Server) getBreakdownHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.receiptID(w, r)
+	if !ok {
+		return
+	}
+
+	pending := s.async.isPending(r.Context(), id)
+	breakdown, err := s.store.GetBreakdown(r.Context(), id)
+	if err != nil {
+		s.writeLookupError(w, r, err, pending)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(breakdown)
+}
@@ -0,0 +1,802 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+// targetReceipt is the first example of the challenge's README, awarded 28
+// points.
+const targetReceipt = `{
+  "retailer": "Target",
+  "purchaseDate": "2022-01-01",
+  "purchaseTime": "13:01",
+  "items": [
+    {"shortDescription": "Mountain Dew 12PK", "price": "6.49"},
+    {"shortDescription": "Emils Cheese Pizza", "price": "12.25"},
+    {"shortDescription": "Knorr Creamy Chicken", "price": "1.26"},
+    {"shortDescription": "Doritos Nacho Cheese", "price": "3.35"},
+    {"shortDescription": "   Klarbrunn 12-PK 12 FL OZ  ", "price": "12.00"}
+  ],
+  "total": "35.35"
+}`
+
+// marketReceipt is the second example of the challenge's README, awarded 109
+// points.
+const marketReceipt = `{
+  "retailer": "M&M Corner Market",
+  "purchaseDate": "2022-03-20",
+  "purchaseTime": "14:33",
+  "items": [
+    {"shortDescription": "Gatorade", "price": "2.25"},
+    {"shortDescription": "Gatorade", "price": "2.25"},
+    {"shortDescription": "Gatorade", "price": "2.25"},
+    {"shortDescription": "Gatorade", "price": "2.25"}
+  ],
+  "total": "9.00"
+}`
+
+// A serverOption sets up a test server before its handler is built.
+type serverOption func(t testing.TB, s *Server)
+
+// newTestServer returns a server on a fresh memory store that logs nowhere,
+// set up by opts in order.
+func newTestServer(t testing.TB, opts ...serverOption) *Server {
+	t.Helper()
+	return newStoreServer(t, newMemoryStore(), opts...)
+}
+
+// newStoreServer is newTestServer on store.
+func newStoreServer(t testing.TB, store Store, opts ...serverOption) *Server {
+	t.Helper()
+	s := newServer(store)
+	s.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	for _, opt := range opts {
+		opt(t, s)
+	}
+	return s
+}
+
+// send sends a request to h and returns its response. header holds header
+// names and values in turn; a body is sent as JSON unless header says
+// otherwise.
+func send(h http.Handler, method, target, body string, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// decodeBody decodes the JSON body of rec into v, failing the test if it is
+// not JSON.
+func decodeBody(t testing.TB, rec *httptest.ResponseRecorder, v any) {
+	t.Helper()
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("decoding body %q: %v", rec.Body.String(), err)
+	}
+}
+
+// processReceipt posts receipt to h and returns the ID it was stored under.
+func processReceipt(t testing.TB, h http.Handler, receipt string) string {
+	t.Helper()
+	rec := send(h, http.MethodPost, "/receipts/process", receipt)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST /receipts/process = %d %s, want 201", rec.Code, rec.Body)
+	}
+	var body struct{ ID string }
+	decodeBody(t, rec, &body)
+	return body.ID
+}
+
+// receiptPoints returns the points h reports for the receipt of id.
+func receiptPoints(t testing.TB, h http.Handler, id string) int {
+	t.Helper()
+	rec := send(h, http.MethodGet, "/receipts/"+id+"/points", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /receipts/%s/points = %d %s, want 200", id, rec.Code, rec.Body)
+	}
+	var body struct{ Points int }
+	decodeBody(t, rec, &body)
+	return body.Points
+}
+
+// errorCode returns the code of the JSON error response rec holds.
+func errorCode(t testing.TB, rec *httptest.ResponseRecorder) string {
+	t.Helper()
+	var body struct {
+		Error struct{ Code string }
+	}
+	decodeBody(t, rec, &body)
+	return body.Error.Code
+}
+
+func TestConcurrentProcessGivesUniqueIDs(t *testing.T) {
+	h := newTestServer(t).Handler()
+
+	const n = 3000
+	ids := make([]string, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := send(h, http.MethodPost, "/receipts/process", targetReceipt)
+			if rec.Code != http.StatusCreated {
+				t.Errorf("POST /receipts/process = %d %s, want 201", rec.Code, rec.Body)
+				return
+			}
+			var body struct{ ID string }
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Errorf("decoding body %q: %v", rec.Body, err)
+			}
+			ids[i] = body.ID
+		}()
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	seen := make(map[string]bool, n)
+	for _, id := range ids {
+		if !uuidPattern.MatchString(id) {
+			t.Errorf("ID %q is not a UUID", id)
+		}
+		if seen[id] {
+			t.Fatalf("ID %q was returned twice", id)
+		}
+		seen[id] = true
+		if got := receiptPoints(t, h, id); got != 28 {
+			t.Fatalf("points of %s = %d, want 28", id, got)
+		}
+	}
+}
+
+func TestPreviewPointsDoesNotStore(t *testing.T) {
+	store := newMemoryStore()
+	h := newStoreServer(t, store).Handler()
+	for receipt, want := range map[string]int{targetReceipt: 28, marketReceipt: 109} {
+		rec := send(h, http.MethodPost, "/receipts/points?breakdown=true", receipt)
+		var body struct {
+			Points    int
+			Breakdown struct{ Total int }
+		}
+		decodeBody(t, rec, &body)
+		if rec.Code != http.StatusOK || body.Points != want || body.Breakdown.Total != want {
+			t.Errorf("POST /receipts/points = %d %s, want 200 with %d points", rec.Code, rec.Body, want)
+		}
+	}
+	if ids, err := store.List(context.Background()); err != nil || len(ids) != 0 {
+		t.Errorf("store holds %v, %v after previews, want nothing", ids, err)
+	}
+
+	// The preview agrees with processing, including on what it rejects.
+	id := processReceipt(t, h, marketReceipt)
+	if got := receiptPoints(t, h, id); got != 109 {
+		t.Errorf("processed points = %d, want 109 as previewed", got)
+	}
+	preview := send(h, http.MethodPost, "/receipts/points", `{"retailer": "Target"}`)
+	process := send(h, http.MethodPost, "/receipts/process", `{"retailer": "Target"}`)
+	if preview.Code != process.Code || errorCode(t, preview) != errorCode(t, process) {
+		t.Errorf("invalid receipt: preview %d %s, process %d %s", preview.Code, preview.Body, process.Code, process.Body)
+	}
+	if ids, _ := store.List(context.Background()); len(ids) != 1 {
+		t.Errorf("store holds %d receipts, want the 1 processed", len(ids))
+	}
+}
+
+func TestProcessContentType(t *testing.T) {
+	h := newTestServer(t).Handler()
+	tests := []struct {
+		contentType string
+		status      int
+	}{
+		{"application/json", http.StatusCreated},
+		{"application/json; charset=utf-8", http.StatusCreated},
+		{"application/json;charset=UTF-8", http.StatusCreated},
+		{"Application/JSON; Charset=\"utf-8\"", http.StatusCreated},
+		{"", http.StatusUnsupportedMediaType},
+		{"text/plain", http.StatusUnsupportedMediaType},
+		{"text/plain; charset=utf-8", http.StatusUnsupportedMediaType},
+		{"application/x-www-form-urlencoded", http.StatusUnsupportedMediaType},
+		{"application/json-seq", http.StatusUnsupportedMediaType},
+		{"application/json; charset", http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		rec := send(h, http.MethodPost, "/receipts/process", targetReceipt, "Content-Type", tt.contentType)
+		if rec.Code != tt.status {
+			t.Errorf("POST with Content-Type %q = %d %s, want %d", tt.contentType, rec.Code, rec.Body, tt.status)
+		}
+		if tt.status == http.StatusUnsupportedMediaType && errorCode(t, rec) != codeUnsupportedMediaType {
+			t.Errorf("POST with Content-Type %q: code %q, want %q", tt.contentType, errorCode(t, rec), codeUnsupportedMediaType)
+		}
+	}
+}
+
+func TestProcessDecodesStrictly(t *testing.T) {
+	h := newTestServer(t).Handler()
+	misspelt := strings.Replace(targetReceipt, `"purchaseDate"`, `"purchase_date"`, 1)
+	if misspelt == targetReceipt {
+		t.Fatal("targetReceipt has no purchaseDate")
+	}
+	tests := []struct {
+		name  string
+		body  string
+		code  string
+		field string
+	}{
+		{"unknown field", misspelt, codeInvalidBody, "purchase_date"},
+		{"unknown item field", strings.Replace(targetReceipt, `"price": "6.49"`, `"price": "6.49", "sku": "x"`, 1), codeInvalidBody, "sku"},
+		{"trailing object", targetReceipt + `{}`, codeInvalidBody, ""},
+		{"trailing garbage", targetReceipt + ` xyz`, codeInvalidBody, ""},
+		{"two receipts", targetReceipt + "\n" + targetReceipt, codeInvalidBody, ""},
+		{"empty body", "", codeEmptyBody, ""},
+		{"whitespace", " \n\t ", codeEmptyBody, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := send(h, http.MethodPost, "/receipts/process", tt.body, "Content-Type", "application/json")
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d %s, want 400", rec.Code, rec.Body)
+			}
+			var body struct {
+				Error struct {
+					Code    string
+					Details []struct{ Field string }
+				}
+			}
+			decodeBody(t, rec, &body)
+			if body.Error.Code != tt.code {
+				t.Errorf("code = %q, want %q", body.Error.Code, tt.code)
+			}
+			if tt.field != "" && (len(body.Error.Details) != 1 || body.Error.Details[0].Field != tt.field) {
+				t.Errorf("details = %+v, want one naming %s", body.Error.Details, tt.field)
+			}
+		})
+	}
+
+	// Whitespace after the receipt is not trailing data.
+	if rec := send(h, http.MethodPost, "/receipts/process", targetReceipt+"\n\n"); rec.Code != http.StatusCreated {
+		t.Errorf("receipt followed by newlines = %d %s, want 201", rec.Code, rec.Body)
+	}
+}
+
+func TestProcessStatus(t *testing.T) {
+	store := newMemoryStore()
+	s := newStoreServer(t, store)
+	h := s.Handler()
+
+	rec := send(h, http.MethodPost, "/receipts/process", targetReceipt)
+	var created struct{ ID string }
+	decodeBody(t, rec, &created)
+	if rec.Code != http.StatusCreated || created.ID == "" {
+		t.Fatalf("POST /receipts/process = %d %s, want 201 with an id", rec.Code, rec.Body)
+	}
+	location := rec.Header().Get("Location")
+	if location != "/receipts/"+created.ID {
+		t.Errorf("Location = %q, want /receipts/%s", location, created.ID)
+	}
+	if rec := send(h, http.MethodGet, location, ""); rec.Code != http.StatusOK {
+		t.Errorf("GET of the Location = %d, want 200", rec.Code)
+	}
+
+	// An idempotent replay says it created nothing.
+	first := send(h, http.MethodPost, "/receipts/process", marketReceipt, "Idempotency-Key", "status-test")
+	replay := send(h, http.MethodPost, "/receipts/process", marketReceipt, "Idempotency-Key", "status-test")
+	if first.Code != http.StatusCreated || replay.Code != http.StatusOK || replay.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("first = %d, replay = %d %q, want 201 then 200 replayed", first.Code, replay.Code, replay.Header().Get("Idempotent-Replayed"))
+	}
+	if first.Body.String() != replay.Body.String() {
+		t.Errorf("replay body %s differs from %s", replay.Body, first.Body)
+	}
+
+	// So does finding a duplicate.
+	var err error
+	if s.dedup, err = newDedupIndex(store, false); err != nil {
+		t.Fatal(err)
+	}
+	dup := send(h, http.MethodPost, "/receipts/process", targetReceipt)
+	var found struct{ ID string }
+	decodeBody(t, dup, &found)
+	if dup.Code != http.StatusOK || dup.Header().Get("X-Receipt-Duplicate") != "true" || found.ID != created.ID {
+		t.Errorf("duplicate = %d %s, want 200 with the ID %s", dup.Code, dup.Body, created.ID)
+	}
+	if got := dup.Header().Get("Location"); got != "" {
+		t.Errorf("duplicate Location = %q, want none, as nothing was created", got)
+	}
+}
+
+func TestStrictTotals(t *testing.T) {
+	s := newTestServer(t)
+	h := s.Handler()
+	mismatched := strings.Replace(targetReceipt, `"total": "35.35"`, `"total": "35.36"`, 1)
+
+	rec := send(h, http.MethodPost, "/receipts/process", mismatched, "X-Strict-Totals", "true")
+	var body struct {
+		Error struct {
+			Code    string
+			Details []struct{ Field, Message, Value string }
+		}
+	}
+	decodeBody(t, rec, &body)
+	if rec.Code != http.StatusUnprocessableEntity || body.Error.Code != codeTotalMismatch {
+		t.Fatalf("strict POST of a mismatched total = %d %s, want 422 %s", rec.Code, rec.Body, codeTotalMismatch)
+	}
+	if d := body.Error.Details; len(d) != 1 || d[0].Field != "total" || d[0].Value != "35.36" || !strings.Contains(d[0].Message, "35.35") {
+		t.Errorf("details = %+v, want the total and the sum of the prices", d)
+	}
+	if rec := send(h, http.MethodPost, "/receipts/process", targetReceipt, "X-Strict-Totals", "true"); rec.Code != http.StatusCreated {
+		t.Errorf("strict POST of a matching total = %d %s, want 201", rec.Code, rec.Body)
+	}
+
+	// Without strict mode the receipt is stored, and the mismatch is a
+	// warning in its breakdown.
+	id := processReceipt(t, h, mismatched)
+	rec = send(h, http.MethodGet, "/receipts/"+id+"/breakdown", "")
+	var breakdown struct{ Warnings []string }
+	decodeBody(t, rec, &breakdown)
+	if len(breakdown.Warnings) != 1 || !strings.Contains(breakdown.Warnings[0], "35.35") {
+		t.Errorf("warnings = %q, want the mismatch", breakdown.Warnings)
+	}
+	id = processReceipt(t, h, targetReceipt)
+	rec = send(h, http.MethodGet, "/receipts/"+id+"/breakdown", "")
+	breakdown.Warnings = nil
+	decodeBody(t, rec, &breakdown)
+	if len(breakdown.Warnings) != 0 {
+		t.Errorf("warnings of a matching total = %q, want none", breakdown.Warnings)
+	}
+
+	// A server in strict mode checks every receipt, and the header cannot
+	// turn that off.
+	s.features = newFeatureSwitch(features{StrictTotals: true}, nil)
+	if rec := send(h, http.MethodPost, "/receipts/process", mismatched, "X-Strict-Totals", "false"); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("POST to a strict server = %d, want 422", rec.Code)
+	}
+}
+
+func TestDateWindowPolicy(t *testing.T) {
+	s := newTestServer(t)
+	s.dates.MaxAgeDays = 30
+	h := s.Handler()
+	future := strings.Replace(targetReceipt, `"2022-01-01"`, `"2999-01-01"`, 1)
+	today := strings.Replace(targetReceipt, `"2022-01-01"`, `"`+time.Now().UTC().Format("2006-01-02")+`"`, 1)
+	today = strings.Replace(today, `"13:01"`, `"00:00"`, 1)
+
+	// By default receipts out of the window are stored, and flagged in
+	// their breakdown's warnings.
+	for _, tt := range []struct{ name, receipt, warning string }{
+		{"future", future, "purchaseDate: is in the future"},
+		{"old", targetReceipt, "purchaseDate: is more than 30 days ago"},
+		{"today", today, ""},
+	} {
+		id := processReceipt(t, h, tt.receipt)
+		var breakdown struct{ Warnings []string }
+		decodeBody(t, send(h, http.MethodGet, "/receipts/"+id+"/breakdown", ""), &breakdown)
+		if want := []string{tt.warning}; tt.warning == "" {
+			if len(breakdown.Warnings) != 0 {
+				t.Errorf("%s: warnings = %q, want none", tt.name, breakdown.Warnings)
+			}
+		} else if !slices.Equal(breakdown.Warnings, want) {
+			t.Errorf("%s: warnings = %q, want %q", tt.name, breakdown.Warnings, want)
+		}
+	}
+
+	// With strict dates they are rejected.
+	s.features = newFeatureSwitch(features{StrictDates: true}, nil)
+	for _, receipt := range []string{future, targetReceipt} {
+		rec := send(h, http.MethodPost, "/receipts/process", receipt)
+		if rec.Code != http.StatusUnprocessableEntity || errorCode(t, rec) != codeDateOutOfRange {
+			t.Errorf("strict POST of a receipt out of the window = %d %s, want 422 %s", rec.Code, rec.Body, codeDateOutOfRange)
+		}
+	}
+	processReceipt(t, h, today)
+}
+
+func TestProcessNormalizesDatesAndTimes(t *testing.T) {
+	s := newTestServer(t)
+	formats, err := parseInputFormats("us-date,12-hour")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.inputFormats = formats
+	h := s.Handler()
+
+	us := strings.Replace(strings.Replace(targetReceipt, `"2022-01-01"`, `"01/01/2022"`, 1), `"13:01"`, `"1:01 PM"`, 1)
+	id := processReceipt(t, h, us)
+	if got := receiptPoints(t, h, id); got != 28 {
+		t.Errorf("points of the Target receipt in US layouts = %d, want 28", got)
+	}
+	if rec := send(h, http.MethodGet, "/receipts/"+id, ""); !strings.Contains(rec.Body.String(), `"purchaseTime":"13:01"`) {
+		t.Errorf("stored receipt %s, want purchaseTime 13:01", rec.Body)
+	}
+	// The receipt is stored, listed and exported in the canonical forms.
+	for _, target := range []string{"/receipts/" + id, "/receipts", "/receipts/export.csv"} {
+		body := send(h, http.MethodGet, target, "").Body.String()
+		if !strings.Contains(body, "2022-01-01") || strings.Contains(body, "01/01/2022") || strings.Contains(body, "1:01 PM") {
+			t.Errorf("GET %s = %s, want the date and time normalized", target, body)
+		}
+	}
+
+	unreadable := strings.Replace(targetReceipt, `"13:01"`, `"1 o'clock"`, 1)
+	rec := send(h, http.MethodPost, "/receipts/process", unreadable)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "12-hour time such as 2:05 PM") {
+		t.Errorf("POST with an unreadable time = %d %s, want 400 naming the layouts accepted", rec.Code, rec.Body)
+	}
+	if _, err := parseInputFormats("us-date,julian"); err == nil {
+		t.Error("parseInputFormats accepted an unknown format")
+	}
+}
+
+func TestProcessEnforcesLimits(t *testing.T) {
+	s := newTestServer(t)
+	h := s.Handler()
+	items := func(n int, price string) string {
+		item := `{"shortDescription": "Gum", "price": "` + price + `"}`
+		return strings.Repeat(item+",", n-1) + item
+	}
+	receipt := func(items, total string) string {
+		return `{"retailer": "Target", "purchaseDate": "2022-01-01", "purchaseTime": "13:01", "items": [` + items + `], "total": "` + total + `"}`
+	}
+
+	tests := []struct {
+		name, body string
+		status     int
+		field      string
+	}{
+		{"1000 items", receipt(items(1000, "0.01"), "10.00"), http.StatusCreated, ""},
+		{"1001 items", receipt(items(1001, "0.01"), "10.01"), http.StatusUnprocessableEntity, "items"},
+		{"largest price", receipt(items(1, "100000.00"), "100000.00"), http.StatusCreated, ""},
+		{"price over the limit", receipt(items(1, "100000.01"), "1.00"), http.StatusUnprocessableEntity, "items[0].price"},
+		{"total over the limit", receipt(items(1, "1.00"), "100000.01"), http.StatusUnprocessableEntity, "total"},
+	}
+	for _, tt := range tests {
+		rec := send(h, http.MethodPost, "/receipts/process", tt.body)
+		if rec.Code != tt.status {
+			t.Errorf("%s: POST = %d %.200s, want %d", tt.name, rec.Code, rec.Body, tt.status)
+			continue
+		}
+		if tt.field == "" {
+			continue
+		}
+		var body struct {
+			Error struct {
+				Code    string
+				Details []struct{ Field, Message string }
+			}
+		}
+		decodeBody(t, rec, &body)
+		if body.Error.Code != codeLimitExceeded || len(body.Error.Details) != 1 || body.Error.Details[0].Field != tt.field || !strings.Contains(body.Error.Details[0].Message, "limit") {
+			t.Errorf("%s: error %+v, want %s naming the limit on %s", tt.name, body.Error, codeLimitExceeded, tt.field)
+		}
+	}
+
+	// Configured limits apply instead.
+	s.limits = points.Limits{MaxItems: 2}
+	if rec := send(h, http.MethodPost, "/receipts/process", receipt(items(3, "1.00"), "3.00")); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("3 items with a limit of 2 = %d, want 422", rec.Code)
+	}
+	if rec := send(h, http.MethodPost, "/receipts/process", receipt(items(1, "200000.00"), "200000.00")); rec.Code != http.StatusCreated {
+		t.Errorf("a price with no amount limit = %d %s, want 201", rec.Code, rec.Body)
+	}
+}
+
+func TestUpdateReceipt(t *testing.T) {
+	h := newTestServer(t).Handler()
+	id := processReceipt(t, h, targetReceipt)
+	processReceipt(t, h, marketReceipt)
+
+	// 36.00 is a round dollar amount and a multiple of 0.25, worth 50 and
+	// 25 points more than 35.35.
+	corrected := strings.Replace(targetReceipt, `"total": "35.35"`, `"total": "36.00"`, 1)
+	if corrected == targetReceipt {
+		t.Fatal("targetReceipt has no total of 35.35 to correct")
+	}
+	rec := send(h, http.MethodPut, "/receipts/"+id, corrected)
+	var updated struct{ Points int }
+	decodeBody(t, rec, &updated)
+	if rec.Code != http.StatusOK || updated.Points != 103 {
+		t.Fatalf("PUT /receipts/%s = %d %s, want 103 points", id, rec.Code, rec.Body)
+	}
+	if got := receiptPoints(t, h, id); got != 103 {
+		t.Errorf("points after the update = %d, want 103", got)
+	}
+
+	var breakdown points.Breakdown
+	decodeBody(t, send(h, http.MethodGet, "/receipts/"+id+"/breakdown", ""), &breakdown)
+	awarded := map[string]int{}
+	for _, rule := range breakdown.Rules {
+		awarded[rule.Rule] = rule.Points
+	}
+	if breakdown.Total != 103 || awarded["round-dollar-total"] != 50 || awarded["quarter-multiple-total"] != 25 {
+		t.Errorf("breakdown after the update = %+v, want the total rules awarded", breakdown)
+	}
+
+	var leaderboard leaderboardResponse
+	decodeBody(t, send(h, http.MethodGet, "/retailers/points", ""), &leaderboard)
+	for _, entry := range leaderboard.Retailers {
+		if entry.Retailer == "Target" && (entry.ReceiptCount != 1 || entry.TotalPoints != 103) {
+			t.Errorf("leaderboard has %+v, want Target's one receipt at 103", entry)
+		}
+		if entry.Retailer == "M&M Corner Market" && entry.TotalPoints != 109 {
+			t.Errorf("leaderboard has %+v, want the other receipt untouched", entry)
+		}
+	}
+
+	// An invalid replacement changes nothing.
+	rec = send(h, http.MethodPut, "/receipts/"+id, `{"retailer":"Target"}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("PUT of an invalid receipt = %d, want 400", rec.Code)
+	}
+	if got := receiptPoints(t, h, id); got != 103 {
+		t.Errorf("points after a rejected update = %d, want 103", got)
+	}
+
+	const missing = "00000000-0000-4000-8000-000000000000"
+	rec = send(h, http.MethodPut, "/receipts/"+missing, corrected)
+	if rec.Code != http.StatusNotFound || errorCode(t, rec) != codeReceiptNotFound {
+		t.Errorf("PUT of a missing receipt = %d %s, want 404", rec.Code, rec.Body)
+	}
+}
+
+func TestUpdatePendingReceipt(t *testing.T) {
+	// Without Start, nothing stores queued receipts, so they stay pending.
+	h := newTestServer(t).Handler()
+	rec := send(h, http.MethodPost, "/receipts/process?async=true", targetReceipt)
+	var queued struct{ ID string }
+	decodeBody(t, rec, &queued)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("POST ?async=true = %d %s, want 202", rec.Code, rec.Body)
+	}
+
+	rec = send(h, http.MethodPut, "/receipts/"+queued.ID, targetReceipt)
+	if rec.Code != http.StatusConflict || errorCode(t, rec) != codeReceiptPending || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("PUT of a pending receipt = %d %s, want 409 with Retry-After", rec.Code, rec.Body)
+	}
+}
+
+// listedIDs returns the IDs GET /receipts lists on h.
+func listedIDs(t *testing.T, h http.Handler) []string {
+	t.Helper()
+	rec := send(h, http.MethodGet, "/receipts", "")
+	var list listResponse
+	decodeBody(t, rec, &list)
+	var ids []string
+	for _, r := range list.Receipts {
+		ids = append(ids, r.ID)
+	}
+	return ids
+}
+
+// exportedDeletions maps the ID of every receipt on a line of export to its
+// deletedAt, nil for receipts that are not deleted.
+func exportedDeletions(t *testing.T, export *httptest.ResponseRecorder) map[string]*time.Time {
+	t.Helper()
+	if export.Code != http.StatusOK {
+		t.Fatalf("GET /admin/export = %d %s, want 200", export.Code, export.Body)
+	}
+	deletions := make(map[string]*time.Time)
+	dec := json.NewDecoder(export.Body)
+	for dec.More() {
+		var record snapshotRecord
+		if err := dec.Decode(&record); err != nil {
+			t.Fatal(err)
+		}
+		deletions[record.ID] = record.DeletedAt
+	}
+	return deletions
+}
+
+// TestSoftDelete deletes a receipt and checks that it is gone from lookups
+// and listings, kept in an export that asks for it, and can be restored.
+func TestSoftDelete(t *testing.T) {
+	h := newTestServer(t, withAdmin).Handler()
+	id := processReceipt(t, h, targetReceipt)
+	kept := processReceipt(t, h, marketReceipt)
+
+	before := time.Now().UTC().Truncate(time.Second)
+	if rec := send(h, http.MethodDelete, "/receipts/"+id, ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE = %d %s, want 204", rec.Code, rec.Body)
+	}
+	for _, target := range []string{"/receipts/" + id, "/receipts/" + id + "/points", "/receipts/" + id + "/breakdown"} {
+		rec := send(h, http.MethodGet, target, "")
+		var body struct{ Error apiError }
+		decodeBody(t, rec, &body)
+		if rec.Code != http.StatusGone || body.Error.Code != codeReceiptDeleted || body.Error.DeletedAt == nil || body.Error.DeletedAt.Before(before) {
+			t.Errorf("GET %s of a deleted receipt = %d %s, want 410 receipt_deleted with the deletion time", target, rec.Code, rec.Body)
+		}
+	}
+	if rec := send(h, http.MethodPut, "/receipts/"+id, targetReceipt); rec.Code != http.StatusGone {
+		t.Errorf("PUT of a deleted receipt = %d %s, want 410", rec.Code, rec.Body)
+	}
+	if rec := send(h, http.MethodDelete, "/receipts/"+id, ""); rec.Code != http.StatusGone {
+		t.Errorf("second DELETE = %d %s, want 410", rec.Code, rec.Body)
+	}
+
+	if got := listedIDs(t, h); !slices.Equal(got, []string{kept}) {
+		t.Errorf("GET /receipts lists %q, want only %q", got, kept)
+	}
+	exported := exportedDeletions(t, sendAdmin(h, http.MethodGet, "/admin/export", ""))
+	if _, ok := exported[id]; ok || len(exported) != 1 {
+		t.Errorf("export holds %v, want only %s", exported, kept)
+	}
+	exported = exportedDeletions(t, sendAdmin(h, http.MethodGet, "/admin/export?includeDeleted=true", ""))
+	if exported[id] == nil || exported[kept] != nil || len(exported) != 2 {
+		t.Errorf("export with includeDeleted holds %v, want both, with %s deleted", exported, id)
+	}
+	if rec := sendAdmin(h, http.MethodGet, "/admin/export?includeDeleted=maybe", ""); rec.Code != http.StatusBadRequest || errorCode(t, rec) != codeInvalidQuery {
+		t.Errorf("export with includeDeleted=maybe = %d %s, want 400 invalid_query", rec.Code, rec.Body)
+	}
+
+	// Restoring brings the receipt back as it was, and restoring it again
+	// changes nothing.
+	for range 2 {
+		rec := send(h, http.MethodPost, "/receipts/"+id+"/restore", "")
+		var restored struct {
+			ID     string
+			Points int
+		}
+		decodeBody(t, rec, &restored)
+		if rec.Code != http.StatusOK || restored.ID != id || restored.Points != 28 {
+			t.Errorf("POST restore = %d %s, want 200 with 28 points", rec.Code, rec.Body)
+		}
+	}
+	if got := receiptPoints(t, h, id); got != 28 {
+		t.Errorf("points of the restored receipt = %d, want 28", got)
+	}
+	if got := listedIDs(t, h); !slices.Equal(got, []string{id, kept}) {
+		t.Errorf("GET /receipts lists %q after the restore, want %q", got, []string{id, kept})
+	}
+
+	const missing = "00000000-0000-4000-8000-000000000000"
+	if rec := send(h, http.MethodPost, "/receipts/"+missing+"/restore", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("restore of a missing receipt = %d %s, want 404", rec.Code, rec.Body)
+	}
+}
+
+// TestRestoreWindow checks that a receipt deleted longer ago than the
+// retention window can no longer be restored, and is purged.
+func TestRestoreWindow(t *testing.T) {
+	store := newMemoryStore()
+	s := newStoreServer(t, store)
+	h := s.Handler()
+	recent := processReceipt(t, h, targetReceipt)
+	old := processReceipt(t, h, marketReceipt)
+
+	store.now = func() time.Time { return time.Now().Add(-s.keepDeleted - time.Hour) }
+	send(h, http.MethodDelete, "/receipts/"+old, "")
+	store.now = time.Now
+	send(h, http.MethodDelete, "/receipts/"+recent, "")
+
+	rec := send(h, http.MethodPost, "/receipts/"+old+"/restore", "")
+	if rec.Code != http.StatusGone || errorCode(t, rec) != codeReceiptDeleted {
+		t.Errorf("restore past the window = %d %s, want 410 receipt_deleted", rec.Code, rec.Body)
+	}
+	if rec := send(h, http.MethodPost, "/receipts/"+recent+"/restore", ""); rec.Code != http.StatusOK {
+		t.Errorf("restore within the window = %d %s, want 200", rec.Code, rec.Body)
+	}
+
+	ctx := context.Background()
+	if n, err := store.PurgeDeleted(ctx, time.Now().Add(-s.keepDeleted)); err != nil || n != 1 {
+		t.Errorf("PurgeDeleted = %d, %v, want 1", n, err)
+	}
+	if rec := send(h, http.MethodGet, "/receipts/"+old+"/points", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("GET points of a purged receipt = %d %s, want 404", rec.Code, rec.Body)
+	}
+	if got := receiptPoints(t, h, recent); got != 28 {
+		t.Errorf("points of the restored receipt = %d, want 28", got)
+	}
+}
+
+// padded returns body with trailing spaces to make it n bytes long.
+func padded(t *testing.T, body string, n int) string {
+	t.Helper()
+	if len(body) > n {
+		t.Fatalf("body of %d bytes does not fit in %d", len(body), n)
+	}
+	return body + strings.Repeat(" ", n-len(body))
+}
+
+// countingReader counts the bytes read from it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func TestBodyLimits(t *testing.T) {
+	s := newTestServer(t)
+	s.maxBodyBytes = 1024
+	s.maxBatchBody = 4096
+	h := s.Handler()
+
+	tests := []struct {
+		target string
+		body   string
+		limit  int
+	}{
+		{"/receipts/process", targetReceipt, 1024},
+		{"/receipts/points", targetReceipt, 1024},
+		{"/receipts/process/batch", "[" + targetReceipt + "," + targetReceipt + "]", 4096},
+	}
+	for _, tt := range tests {
+		rec := send(h, http.MethodPost, tt.target, padded(t, tt.body, tt.limit))
+		if rec.Code == http.StatusRequestEntityTooLarge || rec.Code >= 300 {
+			t.Errorf("POST %s of %d bytes = %d %s, want it accepted", tt.target, tt.limit, rec.Code, rec.Body)
+		}
+		rec = send(h, http.MethodPost, tt.target, padded(t, tt.body, tt.limit+1))
+		var body struct {
+			Error struct{ Code, Message string }
+		}
+		decodeBody(t, rec, &body)
+		want := fmt.Sprintf("Request body exceeds the limit of %d bytes", tt.limit)
+		if rec.Code != http.StatusRequestEntityTooLarge || body.Error.Code != codeBodyTooLarge || body.Error.Message != want {
+			t.Errorf("POST %s of %d bytes = %d %s, want 413 %q", tt.target, tt.limit+1, rec.Code, rec.Body, want)
+		}
+	}
+
+	// A body too large for a single receipt is still fine as a batch.
+	batch := padded(t, "["+targetReceipt+"]", 2048)
+	if rec := send(h, http.MethodPost, "/receipts/process/batch", batch); rec.Code >= 300 {
+		t.Errorf("POST /receipts/process/batch of 2048 bytes = %d %s, want it accepted", rec.Code, rec.Body)
+	}
+}
+
+func TestBodyLimitStopsReading(t *testing.T) {
+	s := newTestServer(t)
+	s.maxBodyBytes = 1024
+	h := s.Handler()
+
+	// A body of unknown length, far larger than the limit, is only read
+	// as far as the limit.
+	body := &countingReader{r: io.MultiReader(strings.NewReader(`{"retailer":"`), strings.NewReader(strings.Repeat("a", 200<<20)))}
+	req := httptest.NewRequest(http.MethodPost, "/receipts/process", body)
+	req.ContentLength = -1
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge || errorCode(t, rec) != codeBodyTooLarge {
+		t.Errorf("POST of an endless body = %d %s, want 413", rec.Code, rec.Body)
+	}
+	if body.n > 64<<10 {
+		t.Errorf("read %d bytes of the body, want reading to stop near the 1024-byte limit", body.n)
+	}
+}
+
+func TestBodyLimitAppliesDecompressed(t *testing.T) {
+	s := newTestServer(t)
+	s.maxBodyBytes = 1024
+	h := s.Handler()
+
+	for _, tt := range []struct {
+		size   int
+		status int
+	}{{1024, http.StatusCreated}, {1025, http.StatusRequestEntityTooLarge}} {
+		rec := sendGzipped(t, h, "/receipts/process", []byte(padded(t, targetReceipt, tt.size)), "")
+		if rec.Code != tt.status {
+			t.Errorf("POST of %d bytes gzipped = %d %s, want %d", tt.size, rec.Code, rec.Body, tt.status)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+)
+
+// signatureSize is how much of the HMAC-SHA256 of an ID a token keeps. 128
+// bits are as hard to forge as a random UUID is to guess.
+const signatureSize = 16
+
+// idSigner hides receipt IDs behind tokens signed with a server secret, so
+// that a client holding one token cannot derive others and read receipts
+// that are not its own. A token is the unpadded base64url encoding of the
+// 16 bytes of the ID followed by their truncated HMAC-SHA256. The store,
+// the audit log and the /admin endpoints keep using the IDs themselves.
+//
+// The external form of an ID from a nil *idSigner is the ID itself.
+type idSigner struct {
+	// keys[0] signs new tokens; every key is accepted when verifying, so
+	// tokens issued under the previous secret keep working while clients
+	// move over.
+	keys [][]byte
+}
+
+// newIDSigner returns a signer that signs with secret and also accepts tokens
+// signed with previous, if set.
+func newIDSigner(secret, previous string) *idSigner {
+	s := &idSigner{keys: [][]byte{[]byte(secret)}}
+	if previous != "" {
+		s.keys = append(s.keys, []byte(previous))
+	}
+	return s
+}
+
+func (s *idSigner) sign(key, id []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(id)
+	return mac.Sum(nil)[:signatureSize]
+}
+
+// external returns what clients are given in place of the receipt ID id.
+func (s *idSigner) external(id string) string {
+	if s == nil {
+		return id
+	}
+	raw, err := hex.DecodeString(strings.ReplaceAll(id, "-", ""))
+	if err != nil {
+		// IDs are only signed in the uuid4 format, so this cannot
+		// happen.
+		panic("signing receipt ID " + id + ": " + err.Error())
+	}
+	return base64.RawURLEncoding.EncodeToString(append(raw, s.sign(s.keys[0], raw)...))
+}
+
+// internal returns the receipt ID that external, as sent by a client, stands
+// for, reporting false if it is not a token the server issued. Tokens are
+// checked in constant time.
+func (s *idSigner) internal(external string) (string, bool) {
+	token, err := base64.RawURLEncoding.Strict().DecodeString(external)
+	if err != nil || len(token) != 16+signatureSize {
+		return "", false
+	}
+	raw, signature := token[:16], token[16:]
+	for _, key := range s.keys {
+		if hmac.Equal(signature, s.sign(key, raw)) {
+			id := hex.EncodeToString(raw)
+			return id[:8] + "-" + id[8:12] + "-" + id[12:16] + "-" + id[16:20] + "-" + id[20:], true
+		}
+	}
+	return "", false
+}
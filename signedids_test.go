@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// storedID returns the ID of the only receipt s stores.
+func storedID(t *testing.T, s *Server) string {
+	t.Helper()
+	ids, err := s.store.List(context.Background())
+	if err != nil || len(ids) != 1 {
+		t.Fatalf("List = %v, %v, want one receipt", ids, err)
+	}
+	return ids[0]
+}
+
+func TestSignedIDs(t *testing.T) {
+	s := newTestServer(t)
+	s.ids = newIDSigner("secret", "")
+	h := s.Handler()
+	token := processReceipt(t, h, targetReceipt)
+	id := storedID(t, s)
+	if token == id || strings.Contains(token, strings.ReplaceAll(id, "-", "")) {
+		t.Fatalf("client was given %s for receipt %s, want a token hiding it", token, id)
+	}
+	if got := receiptPoints(t, h, token); got != 28 {
+		t.Errorf("points of the token = %d, want 28", got)
+	}
+
+	// A forged token is answered as a token for a receipt that does not
+	// exist is, giving away nothing about whether its ID does.
+	unknown := send(h, http.MethodGet, "/receipts/"+s.ids.external("00000000-0000-4000-8000-000000000000")+"/points", "", requestIDHeader, "probe")
+	if unknown.Code != http.StatusNotFound || errorCode(t, unknown) != codeReceiptNotFound {
+		t.Fatalf("points of an unknown receipt's token = %d %s, want 404", unknown.Code, unknown.Body)
+	}
+	forgeries := []string{id, token[:len(token)-1], token + "A", token + "=", strings.ToUpper(token), newIDSigner("guess", "").external(id)}
+	for i := range token {
+		tampered := []byte(token)
+		if tampered[i] == 'A' {
+			tampered[i] = 'B'
+		} else {
+			tampered[i] = 'A'
+		}
+		forgeries = append(forgeries, string(tampered))
+	}
+	for _, forged := range forgeries {
+		if forged == token {
+			continue
+		}
+		rec := send(h, http.MethodGet, "/receipts/"+forged+"/points", "", requestIDHeader, "probe")
+		if rec.Code != unknown.Code || rec.Body.String() != unknown.Body.String() {
+			t.Errorf("points of forged token %s = %d %s, want %d %s", forged, rec.Code, rec.Body, unknown.Code, unknown.Body)
+		}
+	}
+}
+
+func TestSignedIDsRotation(t *testing.T) {
+	s := newTestServer(t)
+	s.ids = newIDSigner("old", "")
+	h := s.Handler()
+	oldToken := processReceipt(t, h, targetReceipt)
+	id := storedID(t, s)
+
+	// During the grace window tokens under either secret are accepted, and
+	// new ones are signed with the new secret.
+	s.ids = newIDSigner("new", "old")
+	newToken := s.ids.external(id)
+	if newToken == oldToken {
+		t.Fatal("the new secret signs the receipt's ID as the old one did")
+	}
+	for _, token := range []string{oldToken, newToken} {
+		if got := receiptPoints(t, h, token); got != 28 {
+			t.Errorf("points of %s during rotation = %d, want 28", token, got)
+		}
+	}
+
+	// Once the old secret is dropped, so are its tokens.
+	s.ids = newIDSigner("new", "")
+	if got := receiptPoints(t, h, newToken); got != 28 {
+		t.Errorf("points of the new token after rotation = %d, want 28", got)
+	}
+	if rec := send(h, http.MethodGet, "/receipts/"+oldToken+"/points", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("points of the old token after rotation = %d %s, want 404", rec.Code, rec.Body)
+	}
+	if got, ok := newIDSigner("old", "").internal(newToken); ok {
+		t.Errorf("the old secret alone accepts the new token, as %s", got)
+	}
+}
+
+// TestSignedIDsExport checks that exports carry the IDs themselves, which
+// an import under the same secret gives the same tokens for.
+func TestSignedIDsExport(t *testing.T) {
+	s := newTestServer(t, withAdmin)
+	s.ids = newIDSigner("secret", "")
+	token := processReceipt(t, s.Handler(), targetReceipt)
+	id := storedID(t, s)
+
+	rec := sendAdmin(s.Handler(), http.MethodGet, "/admin/export", "")
+	var record snapshotRecord
+	line, _ := bufio.NewReader(rec.Body).ReadBytes('\n')
+	if err := json.Unmarshal(line, &record); err != nil || record.ID != id {
+		t.Fatalf("export starts %s, want receipt %s", line, id)
+	}
+
+	imported := newTestServer(t, withAdmin)
+	imported.ids = newIDSigner("secret", "")
+	if rec := sendAdmin(imported.Handler(), http.MethodPost, "/admin/import", string(line)); rec.Code != http.StatusOK {
+		t.Fatalf("POST /admin/import = %d %s", rec.Code, rec.Body)
+	}
+	if got := storedID(t, imported); got != id {
+		t.Errorf("imported receipt %s, want %s", got, id)
+	}
+	if got := receiptPoints(t, imported.Handler(), token); got != 28 {
+		t.Errorf("points of the token after importing = %d, want 28", got)
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+// scanPageSize is how many receipts scanPaged reads from the store at a
+// time.
+const scanPageSize = 500
+
+// maxImportErrors bounds how many rejected records are described in an
+// import summary.
+const maxImportErrors = 100
+
+// snapshotRecord is one line of an export, and of an import.
+type snapshotRecord struct {
+	ID        string            `json:"id"`
+	Tenant    string            `json:"tenant,omitempty"`
+	Points    int               `json:"points"`
+	Receipt   points.Receipt    `json:"receipt"`
+	Breakdown *points.Breakdown `json:"breakdown,omitempty"`
+	// Revision is only written to snapshots, so that receipts keep their
+	// revisions across restarts. Imports ignore it.
+	Revision uint64 `json:"revision,omitempty"`
+	// DeletedAt is set on the records of deleted receipts, which are only
+	// exported when asked for.
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
+	// CompactedAt is set on the records of receipts whose items were
+	// dropped by compaction, which imports refuse.
+	CompactedAt *time.Time `json:"compactedAt,omitempty"`
+	// Image refers to the receipt's image, in exports that ask for images.
+	// The image itself is not exported, and imports ignore it.
+	Image *imageRef `json:"image,omitempty"`
+}
+
+// exportHandler handles GET /admin/export, streaming every stored receipt as
+// newline-delimited JSON in the order they were stored. Deleted receipts are
+// included, with their deletion time, when includeDeleted is true, and
+// receipts with an image refer to it when includeImages is true.
+func (s *Server) exportHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if v := r.URL.Query().Get("includeDeleted"); v != "" {
+		include, err := strconv.ParseBool(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidQuery, "The query parameters are invalid.",
+				points.FieldError{Field: "includeDeleted", Message: "must be true or false"})
+			return
+		}
+		if include {
+			ctx = withDeleted(ctx)
+		}
+	}
+	var includeImages bool
+	if v := r.URL.Query().Get("includeImages"); v != "" {
+		include, err := strconv.ParseBool(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidQuery, "The query parameters are invalid.",
+				points.FieldError{Field: "includeImages", Message: "must be true or false"})
+			return
+		}
+		includeImages = include
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	err := scanPaged(ctx, s.store, func(stored StoredReceipt) error {
+		record := snapshotRecord{ID: stored.ID, Tenant: stored.Tenant, Points: stored.Points, Receipt: stored.Receipt}
+		if breakdown, err := s.store.GetBreakdown(ctx, stored.ID); err == nil {
+			record.Breakdown = &breakdown
+		}
+		if !stored.DeletedAt.IsZero() {
+			at := stored.DeletedAt.UTC()
+			record.DeletedAt = &at
+		}
+		if !stored.CompactedAt.IsZero() {
+			at := stored.CompactedAt.UTC()
+			record.CompactedAt = &at
+		}
+		if includeImages {
+			blob, err := s.images.Stat(ctx, stored.ID)
+			switch {
+			case err == nil:
+				record.Image = s.imageRef(stored.ID, blob)
+			case !errors.Is(err, ErrBlobNotFound):
+				return err
+			}
+		}
+		return enc.Encode(record)
+	})
+	if err != nil {
+		// The status line has likely gone out already, so all that can
+		// be done is to cut the stream short.
+		s.logger.ErrorContext(r.Context(), "export failed", slog.String("component", componentStore), slog.Any("error", err))
+		return
+	}
+	bw.Flush()
+}
+
+// scanPaged calls fn for every stored receipt in the order they were stored.
+// Receipts are read from the store scanPageSize at a time, and fn is only
+// called between reads, so the store is never locked for the whole scan and
+// fn may call back into it. Scanning stops at the first error from fn, or
+// when ctx is canceled.
+func scanPaged(ctx context.Context, store Store, fn func(StoredReceipt) error) error {
+	var after uint64
+	for {
+		page := make([]StoredReceipt, 0, scanPageSize)
+		err := store.Scan(ctx, after, func(stored StoredReceipt) bool {
+			page = append(page, stored)
+			return len(page) < scanPageSize
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, stored := range page {
+			if err := fn(stored); err != nil {
+				return err
+			}
+			after = stored.Seq
+		}
+		if len(page) < scanPageSize {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+// importSummary is the response to POST /admin/import.
+type importSummary struct {
+	Created  int           `json:"created"`
+	Skipped  int           `json:"skipped"`
+	Rejected int           `json:"rejected"`
+	Errors   []importError `json:"errors,omitempty"`
+}
+
+// importError explains why the record on Line was rejected.
+type importError struct {
+	Line    int                 `json:"line"`
+	Message string              `json:"message"`
+	Details []points.FieldError `json:"details,omitempty"`
+}
+
+// importHandler handles POST /admin/import, storing each record of an export
+// under its original ID. Records whose ID is already stored, if only as a
+// deleted receipt, are skipped, as are records of deleted receipts. By
+// default points are recomputed with the current rules; with points=trust
+// the exported points and breakdown are kept as they are. Records are
+// decoded and scored on s.workers goroutines and stored in the order of the
+// export.
+func (s *Server) importHandler(w http.ResponseWriter, r *http.Request) {
+	var trust bool
+	switch r.URL.Query().Get("points") {
+	case "", "recompute":
+	case "trust":
+		trust = true
+	default:
+		writeError(w, http.StatusBadRequest, codeInvalidQuery, "The query parameters are invalid.",
+			points.FieldError{Field: "points", Message: "must be recompute or trust"})
+		return
+	}
+
+	var summary importSummary
+	reject := func(line int, message string, details ...points.FieldError) {
+		summary.Rejected++
+		if len(summary.Errors) < maxImportErrors {
+			summary.Errors = append(summary.Errors, importError{Line: line, Message: message, Details: details})
+		}
+	}
+
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(nil, int(s.maxBodyBytes))
+	line := 0
+	next := func() (importLine, bool) {
+		for scanner.Scan() {
+			line++
+			if len(scanner.Bytes()) > 0 {
+				// The scanner reuses its buffer for the next line.
+				return importLine{number: line, data: bytes.Clone(scanner.Bytes())}, true
+			}
+		}
+		return importLine{}, false
+	}
+
+	var failed error
+	err := runOrdered(r.Context(), s.workers, next,
+		func(in importLine) importedRecord {
+			return decodeImportRecord(in.data, s.idgen, trust, s.features.get().ItemlessReceipts, s.scoringRules())
+		},
+		func(in importLine, v any) importedRecord {
+			return importedRecord{rejected: &importError{Message: s.scoringPanic(r.Context(), v).Message}}
+		},
+		func(in importLine, imported importedRecord) bool {
+			switch {
+			case imported.rejected != nil:
+				reject(in.number, imported.rejected.Message, imported.rejected.Details...)
+				return true
+			case imported.record.DeletedAt != nil:
+				summary.Skipped++
+				return true
+			}
+			record := imported.record
+			created, err := s.importReceipt(r.Context(), record.ID, record.Tenant, record.Receipt, imported.breakdown, !trust)
+			if err != nil {
+				failed = err
+				return false
+			}
+			if created {
+				summary.Created++
+			} else {
+				summary.Skipped++
+			}
+			return true
+		})
+	if failed == nil {
+		failed = err
+	}
+	if failed != nil {
+		s.writeStoreError(w, r, failed)
+		return
+	}
+	if err := scanner.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			writeError(w, http.StatusRequestEntityTooLarge, codeBodyTooLarge,
+				fmt.Sprintf("Line %d exceeds the limit of %d bytes; %d records were imported before it", line+1, s.maxBodyBytes, summary.Created))
+			return
+		}
+		writeAPIError(w, bodyReadError(err, "Failed to read request body"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
+
+// importLine is a line of an import, numbered from 1.
+type importLine struct {
+	number int
+	data   []byte
+}
+
+// importedRecord is a record of an import decoded and scored, or the reason
+// it was rejected.
+type importedRecord struct {
+	record    snapshotRecord
+	breakdown points.Breakdown
+	rejected  *importError // with no line
+}
+
+// decodeImportRecord decodes and scores a line of an import. Receipts without
+// items are accepted if itemless is set, so that a snapshot taken while
+// itemless receipts are allowed can be restored.
+func decodeImportRecord(data []byte, ids IDGenerator, trust, itemless bool, scoring points.RulesConfig) importedRecord {
+	var record snapshotRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return importedRecord{rejected: &importError{Message: "Invalid JSON"}}
+	}
+	id, ok := ids.ParseID(record.ID)
+	if !ok {
+		return importedRecord{rejected: &importError{Message: "Invalid receipt ID"}}
+	}
+	record.ID = id
+	if record.CompactedAt != nil {
+		if record.DeletedAt != nil {
+			// Skipped as a deleted receipt, though it cannot be
+			// validated.
+			return importedRecord{record: record}
+		}
+		return importedRecord{rejected: &importError{Message: "The receipt was compacted, so its items are missing"}}
+	}
+	if _, errs := (points.InputFormats{Itemless: itemless}).ValidateInput(record.Receipt); len(errs) > 0 {
+		return importedRecord{rejected: &importError{Message: "The receipt is invalid.", Details: errs}}
+	}
+	if record.DeletedAt != nil {
+		return importedRecord{record: record}
+	}
+
+	if trust {
+		breakdown := points.Breakdown{Rules: []points.RuleResult{}}
+		if record.Breakdown != nil {
+			breakdown = *record.Breakdown
+		}
+		breakdown.Total = record.Points
+		return importedRecord{record: record, breakdown: breakdown}
+	}
+	return importedRecord{record: record, breakdown: scoring.Breakdown(record.Receipt)}
+}
+
+// importReceipt stores receipt under id for tenant unless id is already
+// stored, reporting whether it did. A recomputed breakdown is held to the
+// daily caps, as a new receipt's would be; a trusted one is kept as it is.
+func (s *Server) importReceipt(ctx context.Context, id, tenant string, receipt points.Receipt, breakdown points.Breakdown, recomputed bool) (bool, error) {
+	if s.dedup != nil {
+		s.dedup.mu.Lock()
+		defer s.dedup.mu.Unlock()
+	}
+
+	var deleted *DeletedError
+	if _, err := s.store.GetPoints(ctx, id); err == nil || errors.As(err, &deleted) {
+		return false, nil
+	} else if !errors.Is(err, ErrNotFound) {
+		return false, err
+	}
+	undo := func() {}
+	if s.caps != nil && recomputed {
+		breakdown, _, undo = s.caps.award(id, tenant, receipt, breakdown)
+	} else if s.caps != nil {
+		s.caps.add(id, tenant, receipt, breakdown.Total)
+		undo = func() { s.caps.remove(id) }
+	}
+	if err := s.store.SaveReceipt(withTenant(ctx, tenant), id, receipt, breakdown); err != nil {
+		undo()
+		return false, err
+	}
+	if s.dedup != nil {
+		s.dedup.add(s.dedup.hash(tenant, receipt), id)
+	}
+	s.retailers.add(id, tenant, receipt.Retailer, breakdown.Total)
+	entry := newAuditEntry(ctx, auditImported, id)
+	entry.Tenant = tenant
+	s.audit.add(entry)
+	return true, nil
+}
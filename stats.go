@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+// topRetailersCount is how many retailers GET /admin/stats ranks.
+const topRetailersCount = 10
+
+// storeStats is the response to GET /admin/stats. MinPoints and MaxPoints
+// are omitted when the store is empty.
+type storeStats struct {
+	Receipts      int             `json:"receipts"`
+	TotalPoints   int             `json:"totalPoints"`
+	AveragePoints float64         `json:"averagePoints"`
+	MinPoints     *int            `json:"minPoints,omitempty"`
+	MaxPoints     *int            `json:"maxPoints,omitempty"`
+	TopRetailers  []retailerCount `json:"topRetailers"`
+	// ApproxBytes estimates the memory the stored receipts take up. It
+	// counts the receipts themselves, not the store's indexes or the
+	// breakdowns. BytesPerReceipt is its average per receipt.
+	ApproxBytes     int64   `json:"approxBytes"`
+	BytesPerReceipt float64 `json:"bytesPerReceipt"`
+	// Compaction is omitted unless the memory store compacts receipts.
+	Compaction *compactionStats `json:"compaction,omitempty"`
+	// Snapshot is omitted unless snapshots are enabled.
+	Snapshot *snapshotStatus `json:"snapshot,omitempty"`
+}
+
+// compactionStats reports how the memory store compacts receipts.
+type compactionStats struct {
+	// After is how long after they are stored receipts are compacted.
+	After string `json:"after"`
+	// Receipts counts the receipts compacted, and FreedBytes estimates
+	// the memory compaction has freed since the server started.
+	Receipts   int   `json:"receipts"`
+	FreedBytes int64 `json:"freedBytes"`
+}
+
+type retailerCount struct {
+	Retailer string `json:"retailer"`
+	Receipts int    `json:"receipts"`
+
+	// CanonicalRetailer is the name the receipts are grouped under, set
+	// when retailer names are normalized.
+	CanonicalRetailer string `json:"canonicalRetailer,omitempty"`
+}
+
+// statsHandler handles GET /admin/stats. The figures are gathered a page at
+// a time, so receipts stored or deleted while they are may or may not be
+// counted. With ?at= the points figures are of the points still counting
+// at that date, leaving out receipts the expiry policy rejects.
+func (s *Server) statsHandler(w http.ResponseWriter, r *http.Request) {
+	at, fieldErr := parseAt(r.URL.Query())
+	if fieldErr != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidQuery, "The query parameters are invalid.", *fieldErr)
+		return
+	}
+
+	stats := storeStats{TopRetailers: []retailerCount{}}
+	if memory, ok := s.store.(*memoryStore); ok {
+		stats.Compaction = memory.compactionStats()
+	}
+	// Retailers are counted by name as given, or by canonical name when
+	// names are normalized.
+	retailers := make(map[string]*retailerCount)
+	err := scanPaged(r.Context(), s.store, func(stored StoredReceipt) error {
+		if !at.IsZero() {
+			effective, _, _, err := s.expiry.effective(stored.Receipt, stored.Points, at)
+			if err != nil {
+				return nil
+			}
+			stored.Points = effective
+		}
+		stats.Receipts++
+		stats.TotalPoints += stored.Points
+		if stats.MinPoints == nil || stored.Points < *stats.MinPoints {
+			stats.MinPoints = &stored.Points
+		}
+		if stats.MaxPoints == nil || stored.Points > *stats.MaxPoints {
+			stats.MaxPoints = &stored.Points
+		}
+		key := stored.Receipt.Retailer
+		if s.names != nil {
+			key = s.names.key(key)
+		}
+		count, ok := retailers[key]
+		if !ok {
+			count = &retailerCount{Retailer: stored.Receipt.Retailer}
+			if s.names != nil {
+				count.CanonicalRetailer = s.names.canonical(stored.Receipt.Retailer)
+			}
+			retailers[key] = count
+		}
+		count.Receipts++
+		stats.ApproxBytes += receiptSize(stored.Receipt)
+		if !stored.CompactedAt.IsZero() && stats.Compaction != nil {
+			stats.Compaction.Receipts++
+		}
+		return nil
+	})
+	if err != nil {
+		s.writeStoreError(w, r, err)
+		return
+	}
+
+	if stats.Receipts > 0 {
+		stats.AveragePoints = float64(stats.TotalPoints) / float64(stats.Receipts)
+		stats.BytesPerReceipt = float64(stats.ApproxBytes) / float64(stats.Receipts)
+	}
+	for _, count := range retailers {
+		stats.TopRetailers = append(stats.TopRetailers, *count)
+	}
+	sort.Slice(stats.TopRetailers, func(i, j int) bool {
+		a, b := stats.TopRetailers[i], stats.TopRetailers[j]
+		return a.Receipts > b.Receipts || (a.Receipts == b.Receipts && a.Retailer < b.Retailer)
+	})
+	stats.TopRetailers = stats.TopRetailers[:min(topRetailersCount, len(stats.TopRetailers))]
+	if s.snapshots != nil {
+		status := s.snapshots.status()
+		stats.Snapshot = &status
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// receiptSize estimates the bytes receipt occupies in memory: its struct,
+// items and string contents.
+func receiptSize(receipt points.Receipt) int64 {
+	size := int64(unsafe.Sizeof(receipt)) + int64(len(receipt.Retailer)+len(receipt.PurchaseDate)+len(receipt.PurchaseTime)+len(receipt.Total))
+	for _, item := range receipt.Items {
+		size += int64(unsafe.Sizeof(item)) + int64(len(item.ShortDescription)+len(item.Price))
+	}
+	return size
+}
+
+// maxHistogramBounds is how many bucket boundaries GET /admin/stats/points
+// may be asked for.
+const maxHistogramBounds = 100
+
+// defaultHistogramBounds are the bucket boundaries of GET /admin/stats/points
+// unless the request gives its own.
+var defaultHistogramBounds = []int{10, 25, 50, 75, 100, 150, 200, 300, 500}
+
+// pointsStats is the response to GET /admin/stats/points. Percentiles is
+// omitted when no receipts are counted.
+type pointsStats struct {
+	Receipts    int                `json:"receipts"`
+	Buckets     []pointsBucket     `json:"buckets"`
+	Percentiles *pointsPercentiles `json:"percentiles,omitempty"`
+}
+
+// pointsBucket counts the receipts awarded at least Min points and fewer
+// than Max, which the last bucket has none of.
+type pointsBucket struct {
+	Min      int  `json:"min"`
+	Max      *int `json:"max,omitempty"`
+	Receipts int  `json:"receipts"`
+}
+
+// pointsPercentiles are nearest-rank percentiles: the fewest points at least
+// that percentage of the receipts were awarded.
+type pointsPercentiles struct {
+	P50 int `json:"p50"`
+	P90 int `json:"p90"`
+	P99 int `json:"p99"`
+}
+
+// pointsStatsHandler handles GET /admin/stats/points, the distribution of
+// the points awarded as a histogram and percentiles. ?buckets= lists the
+// boundaries between buckets, and ?retailer=, ?from= and ?to= filter the
+// receipts as in GET /receipts. The figures come from the retailer index
+// unless a date range is asked for, which needs a scan of the store.
+func (s *Server) pointsStatsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter, errs := parseReceiptFilter(query, s.names)
+	bounds, boundsErr := parseHistogramBounds(query.Get("buckets"))
+	if boundsErr != nil {
+		errs = append(errs, *boundsErr)
+	}
+	if len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, codeInvalidQuery, "The query parameters are invalid.", errs...)
+		return
+	}
+
+	var counts map[int]int
+	if filter.from == "" && filter.to == "" {
+		counts = s.retailers.pointsCounts(r.Context(), filter.retailer)
+	} else {
+		counts = make(map[int]int)
+		err := scanPaged(r.Context(), s.store, func(stored StoredReceipt) error {
+			if filter.matches(stored.Receipt) {
+				counts[stored.Points]++
+			}
+			return nil
+		})
+		if err != nil {
+			s.writeStoreError(w, r, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summarizePoints(counts, bounds))
+}
+
+// parseHistogramBounds parses the ?buckets= parameter, increasing positive
+// integers separated by commas, returning defaultHistogramBounds if it is
+// empty.
+func parseHistogramBounds(value string) ([]int, *points.FieldError) {
+	if value == "" {
+		return defaultHistogramBounds, nil
+	}
+	invalid := &points.FieldError{Field: "buckets",
+		Message: fmt.Sprintf("must be at most %d increasing positive integers, separated by commas", maxHistogramBounds)}
+	fields := strings.Split(value, ",")
+	if len(fields) > maxHistogramBounds {
+		return nil, invalid
+	}
+	bounds := make([]int, 0, len(fields))
+	for _, field := range fields {
+		bound, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || bound <= 0 || len(bounds) > 0 && bound <= bounds[len(bounds)-1] {
+			return nil, invalid
+		}
+		bounds = append(bounds, bound)
+	}
+	return bounds, nil
+}
+
+// summarizePoints returns the histogram with bucket boundaries bounds, and
+// the percentiles, of counts, the number of receipts awarded each number
+// of points.
+func summarizePoints(counts map[int]int, bounds []int) pointsStats {
+	stats := pointsStats{Buckets: make([]pointsBucket, len(bounds)+1)}
+	for i := range stats.Buckets {
+		if i > 0 {
+			stats.Buckets[i].Min = bounds[i-1]
+		}
+		if i < len(bounds) {
+			stats.Buckets[i].Max = &bounds[i]
+		}
+	}
+
+	values := make([]int, 0, len(counts))
+	for points, n := range counts {
+		values = append(values, points)
+		stats.Receipts += n
+		// The first boundary above points ends its bucket.
+		stats.Buckets[sort.SearchInts(bounds, points+1)].Receipts += n
+	}
+	if stats.Receipts == 0 {
+		return stats
+	}
+
+	sort.Ints(values)
+	percentile := func(p int) int {
+		rank := (stats.Receipts*p + 99) / 100
+		seen := 0
+		for _, points := range values {
+			if seen += counts[points]; seen >= rank {
+				return points
+			}
+		}
+		return values[len(values)-1]
+	}
+	stats.Percentiles = &pointsPercentiles{P50: percentile(50), P90: percentile(90), P99: percentile(99)}
+	return stats
+}
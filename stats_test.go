@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// seededReceipt returns a random receipt from rng, from one of a few
+// retailers and dated in January 2022.
+func seededReceipt(rng *rand.Rand) string {
+	retailers := []string{"Target", "Walgreens", "M&M Corner Market", "Corner Shop 24", "A"}
+	descriptions := []string{"Gum", "Pepsi - 12-oz", "Dasani", "Emils Cheese Pizza", "Mountain Dew 12PK", "Tea"}
+	var items []string
+	var total int
+	for range 1 + rng.Intn(8) {
+		price := []int{25, 100, 149, 500, 1225, 2000}[rng.Intn(6)]
+		total += price
+		items = append(items, fmt.Sprintf(`{"shortDescription": %q, "price": "%d.%02d"}`, descriptions[rng.Intn(len(descriptions))], price/100, price%100))
+	}
+	return fmt.Sprintf(`{"retailer": %q, "purchaseDate": "2022-01-%02d", "purchaseTime": "%02d:%02d", "total": "%d.%02d", "items": [%s]}`,
+		retailers[rng.Intn(len(retailers))], 1+rng.Intn(31), rng.Intn(24), rng.Intn(60), total/100, total%100, strings.Join(items, ", "))
+}
+
+// bruteForceStats returns the histogram and percentiles of the points of
+// the receipts in store that keep says to, by sorting them all.
+func bruteForceStats(t *testing.T, store Store, bounds []int, keep func(StoredReceipt) bool) pointsStats {
+	t.Helper()
+	var all []int
+	err := store.Scan(context.Background(), 0, func(stored StoredReceipt) bool {
+		if keep(stored) {
+			all = append(all, stored.Points)
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(all)
+
+	stats := pointsStats{Receipts: len(all), Buckets: make([]pointsBucket, len(bounds)+1)}
+	for i := range stats.Buckets {
+		if i > 0 {
+			stats.Buckets[i].Min = bounds[i-1]
+		}
+		if i < len(bounds) {
+			stats.Buckets[i].Max = &bounds[i]
+		}
+		for _, points := range all {
+			if points >= stats.Buckets[i].Min && (i == len(bounds) || points < bounds[i]) {
+				stats.Buckets[i].Receipts++
+			}
+		}
+	}
+	if len(all) > 0 {
+		// The nearest rank of p is the ceiling of p% of the receipts.
+		rank := func(p int) int {
+			r := len(all) * p / 100
+			if len(all)*p%100 != 0 {
+				r++
+			}
+			return all[r-1]
+		}
+		stats.Percentiles = &pointsPercentiles{P50: rank(50), P90: rank(90), P99: rank(99)}
+	}
+	return stats
+}
+
+// TestPointsStatsMatchBruteForce checks the histogram and percentiles, from
+// the retailer index and from a scan, against sorting every receipt's
+// points, after a seeded run of stores, updates and deletes.
+func TestPointsStatsMatchBruteForce(t *testing.T) {
+	s := newTestServer(t, withAdmin)
+	h := s.Handler()
+	rng := rand.New(rand.NewSource(92))
+	var ids []string
+	for range 300 {
+		ids = append(ids, processReceipt(t, h, seededReceipt(rng)))
+	}
+	for _, i := range rng.Perm(len(ids))[:60] {
+		if rec := send(h, http.MethodPut, "/receipts/"+ids[i], seededReceipt(rng)); rec.Code != http.StatusOK {
+			t.Fatalf("PUT /receipts/%s = %d %s", ids[i], rec.Code, rec.Body)
+		}
+	}
+	for _, i := range rng.Perm(len(ids))[:40] {
+		if rec := send(h, http.MethodDelete, "/receipts/"+ids[i], ""); rec.Code != http.StatusNoContent && rec.Code != http.StatusGone {
+			t.Fatalf("DELETE /receipts/%s = %d %s", ids[i], rec.Code, rec.Body)
+		}
+	}
+
+	// Scan leaves the deleted receipts out.
+	every := func(StoredReceipt) bool { return true }
+	tests := []struct {
+		query  string
+		bounds []int
+		keep   func(StoredReceipt) bool
+	}{
+		{"", defaultHistogramBounds, every},
+		{"buckets=1,30,31,60,100,1000", []int{1, 30, 31, 60, 100, 1000}, every},
+		{"retailer=" + url.QueryEscape("  target "), defaultHistogramBounds, func(stored StoredReceipt) bool {
+			return stored.Receipt.Retailer == "Target"
+		}},
+		{"retailer=nobody", defaultHistogramBounds, func(StoredReceipt) bool { return false }},
+		// A date range is scanned for.
+		{"from=2022-01-01&to=2022-01-31", defaultHistogramBounds, every},
+		{"from=2022-01-10&to=2022-01-20&buckets=50", []int{50}, func(stored StoredReceipt) bool {
+			return stored.Receipt.PurchaseDate >= "2022-01-10" && stored.Receipt.PurchaseDate <= "2022-01-20"
+		}},
+	}
+	for _, tt := range tests {
+		rec := sendAdmin(h, http.MethodGet, "/admin/stats/points?"+tt.query, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET /admin/stats/points?%s = %d %s", tt.query, rec.Code, rec.Body)
+		}
+		var got pointsStats
+		decodeBody(t, rec, &got)
+		want := bruteForceStats(t, s.store, tt.bounds, tt.keep)
+		if fmt.Sprint(got.Receipts, got.Percentiles, bucketsString(got.Buckets)) != fmt.Sprint(want.Receipts, want.Percentiles, bucketsString(want.Buckets)) {
+			t.Errorf("GET /admin/stats/points?%s = %d receipts, %+v, %s; sorting gives %d, %+v, %s", tt.query,
+				got.Receipts, got.Percentiles, bucketsString(got.Buckets), want.Receipts, want.Percentiles, bucketsString(want.Buckets))
+		}
+	}
+}
+
+// bucketsString writes buckets as [min,max):receipts.
+func bucketsString(buckets []pointsBucket) string {
+	var b strings.Builder
+	for _, bucket := range buckets {
+		upper := "∞"
+		if bucket.Max != nil {
+			upper = fmt.Sprint(*bucket.Max)
+		}
+		fmt.Fprintf(&b, "[%d,%s):%d ", bucket.Min, upper, bucket.Receipts)
+	}
+	return b.String()
+}
+
+func TestPointsStatsRejectsBadBuckets(t *testing.T) {
+	h := newTestServer(t, withAdmin).Handler()
+	for _, buckets := range []string{"0", "-5", "10,10", "20,10", "a", "10,,20", strings.Repeat("1,", maxHistogramBounds) + "1"} {
+		rec := sendAdmin(h, http.MethodGet, "/admin/stats/points?buckets="+url.QueryEscape(buckets), "")
+		if rec.Code != http.StatusBadRequest || errorCode(t, rec) != codeInvalidQuery {
+			t.Errorf("GET /admin/stats/points?buckets=%s = %d %s, want 400", buckets, rec.Code, rec.Body)
+		}
+	}
+}
@@ -0,0 +1,774 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+// ErrNotFound is returned by a Store when no receipt has the requested ID.
+var ErrNotFound = errors.New("receipt not found")
+
+// ErrRevisionMismatch is returned by a Store for a conditional write to a
+// receipt whose revision is not the one the write expected.
+var ErrRevisionMismatch = errors.New("receipt revision does not match")
+
+// ErrIDTaken is returned by a Store when a receipt saved under a new ID (see
+// withNewID) finds another already stored under it.
+var ErrIDTaken = errors.New("receipt ID already taken")
+
+// DeletedError is returned by a Store for a receipt that has been deleted but
+// not yet purged. It matches ErrNotFound, so callers that do not care when a
+// receipt went away need not tell the two apart.
+type DeletedError struct {
+	DeletedAt time.Time
+}
+
+func (e *DeletedError) Error() string {
+	return "receipt deleted at " + e.DeletedAt.UTC().Format(time.RFC3339)
+}
+
+func (e *DeletedError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+// CompactedError is returned by GetReceipt for a receipt whose body the
+// memory store dropped, keeping only its points and a summary (see
+// memoryStore.compactAfter), unless the context asks for compacted receipts
+// (see withCompacted).
+type CompactedError struct {
+	CompactedAt time.Time
+}
+
+func (e *CompactedError) Error() string {
+	return "receipt compacted at " + e.CompactedAt.UTC().Format(time.RFC3339)
+}
+
+type includeCompactedKey struct{}
+
+// withCompacted returns a copy of ctx whose GetReceipt calls return what is
+// left of a compacted receipt, without its items, rather than a
+// *CompactedError.
+func withCompacted(ctx context.Context) context.Context {
+	return context.WithValue(ctx, includeCompactedKey{}, true)
+}
+
+func includeCompacted(ctx context.Context) bool {
+	include, _ := ctx.Value(includeCompactedKey{}).(bool)
+	return include
+}
+
+type includeDeletedKey struct{}
+
+// withDeleted returns a copy of ctx whose lookups, List and Scan calls see
+// deleted receipts as they were before they were deleted.
+func withDeleted(ctx context.Context) context.Context {
+	return context.WithValue(ctx, includeDeletedKey{}, true)
+}
+
+// includeDeleted reports whether ctx was returned by withDeleted.
+func includeDeleted(ctx context.Context) bool {
+	include, _ := ctx.Value(includeDeletedKey{}).(bool)
+	return include
+}
+
+type newIDKey struct{}
+
+// withNewID returns a copy of ctx whose SaveReceipt calls store a receipt
+// under an ID just generated for it, failing with ErrIDTaken rather than
+// overwrite a receipt already stored under it, whoever owns that one and
+// whether or not it was deleted.
+func withNewID(ctx context.Context) context.Context {
+	return context.WithValue(ctx, newIDKey{}, true)
+}
+
+// isNewID reports whether ctx was returned by withNewID.
+func isNewID(ctx context.Context) bool {
+	fresh, _ := ctx.Value(newIDKey{}).(bool)
+	return fresh
+}
+
+// Store holds processed receipts together with the points they were awarded.
+// Implementations must be safe for concurrent use.
+//
+// Every method but Close takes a context; a write or scan is abandoned with
+// its error once it is done. A write that gives up leaves the store as it
+// was: a receipt is never stored without its score, nor its score without it.
+//
+// The context also carries the tenant a call acts for, if any (see
+// withTenant). Receipts are saved owned by that tenant, and those owned by
+// another are treated as absent: not found by lookups, updates and deletes
+// and skipped by List and Scan.
+//
+// Deleting a receipt leaves a tombstone, from which it can be restored until
+// PurgeDeleted removes it. Lookups, updates and deletes of a deleted receipt
+// return a *DeletedError, and List and Scan skip it, unless the context asks
+// for deleted receipts (see withDeleted).
+//
+// Each receipt has a revision, starting at 1 when it is first saved and
+// increased by every write to it, deletion and restoration included. Updates
+// and deletes given a revision other than 0 only go ahead if the receipt is
+// still at it, returning ErrRevisionMismatch otherwise, so that a client can
+// change a receipt without undoing a change it has not seen.
+type Store interface {
+	// SaveReceipt stores a receipt and its scoring breakdown under id,
+	// replacing any receipt stored there unless ctx was returned by
+	// withNewID. A store with a webhook outbox also adds the events ctx
+	// carries for it (see withOutbox), in the same write.
+	SaveReceipt(ctx context.Context, id string, receipt points.Receipt, breakdown points.Breakdown) error
+	GetPoints(ctx context.Context, id string) (int, error)
+	GetReceipt(ctx context.Context, id string) (points.Receipt, error)
+	GetBreakdown(ctx context.Context, id string) (points.Breakdown, error)
+	// GetRevision returns the revision of a stored receipt.
+	GetRevision(ctx context.Context, id string) (uint64, error)
+	// UpdateBreakdown replaces the score of a stored receipt, returning
+	// ErrNotFound if there is no receipt with that id.
+	UpdateBreakdown(ctx context.Context, id string, breakdown points.Breakdown) error
+	// UpdateReceipt replaces a stored receipt and its score together,
+	// keeping its sequence number and tenant, and returns ErrNotFound if
+	// there is no receipt with that id. A revision other than 0 makes the
+	// update conditional on the receipt being at it.
+	UpdateReceipt(ctx context.Context, id string, revision uint64, receipt points.Receipt, breakdown points.Breakdown) error
+	// Delete marks a receipt deleted, returning ErrNotFound if there is
+	// nothing to delete. A revision other than 0 makes the deletion
+	// conditional on the receipt being at it.
+	Delete(ctx context.Context, id string, revision uint64) error
+	// Restore undoes the deletion of a receipt deleted at or after since
+	// and returns it. A receipt deleted earlier is left deleted, with a
+	// *DeletedError returned; one that is not deleted is returned as is.
+	Restore(ctx context.Context, id string, since time.Time) (StoredReceipt, error)
+	// PurgeDeleted removes the receipts deleted before before for good,
+	// returning how many were removed. It ignores the tenant.
+	PurgeDeleted(ctx context.Context, before time.Time) (int, error)
+	// Purge removes every receipt, returning how many were removed. It
+	// ignores the tenant, removing the receipts of all of them.
+	Purge(ctx context.Context) (int, error)
+	// List returns the IDs of all stored receipts in no particular order.
+	List(ctx context.Context) ([]string, error)
+	// Scan calls fn for each receipt stored after the one with sequence
+	// number after (0 for the beginning), in the order they were first
+	// stored, until fn returns false. fn must not call back into the store.
+	Scan(ctx context.Context, after uint64, fn func(StoredReceipt) bool) error
+	// Ping reports whether the store's backing storage is reachable.
+	Ping(ctx context.Context) error
+	// Close releases any resources held by the store.
+	Close() error
+}
+
+// StoredReceipt is a receipt as returned by Store.Scan. Seq increases with
+// every receipt stored, so it orders receipts by when they were processed.
+type StoredReceipt struct {
+	Seq     uint64
+	ID      string
+	Tenant  string // "" for receipts stored without a tenant
+	Receipt points.Receipt
+	Points  int
+	// DeletedAt is when the receipt was deleted; zero unless it was, and
+	// the scan asked for deleted receipts.
+	DeletedAt time.Time
+	// CompactedAt is when the receipt's items were dropped; zero unless
+	// they were.
+	CompactedAt time.Time
+}
+
+// memoryStore is a Store backed by in-process maps. Reads share mu, so they
+// only contend with writes.
+type memoryStore struct {
+	mu sync.RWMutex
+	// records holds everything stored about each receipt in one value, so
+	// that a receipt is never present without its points or the reverse.
+	records map[string]*memoryRecord
+
+	// order lists receipts by sequence number. Deleted receipts stay in it
+	// until compacted; an entry whose record has another seq is dead.
+	order   []orderEntry
+	lastSeq uint64
+
+	// changes counts writes, so that snapshots can tell whether anything
+	// has changed since the last one.
+	changes uint64
+
+	// maxReceipts and ttl bound what the store holds; zero means no
+	// limit. onEvict, if set, is told which receipt was evicted and why,
+	// once mu has been released; evicted holds the receipts it is yet to
+	// be told of.
+	maxReceipts int
+	ttl         time.Duration
+	onEvict     func(id, reason string)
+	evicted     []eviction
+	now         func() time.Time
+
+	// items indexes item descriptions for scanItems; nil unless
+	// indexItems was called.
+	items *itemIndex
+
+	// compactAfter is how long after they are stored receipts are
+	// compacted, dropping their items and breakdown details; zero means
+	// never. Every receipt up to compactedSeq has been, and freedBytes
+	// estimates the memory that freed.
+	compactAfter time.Duration
+	compactedSeq uint64
+	freedBytes   int64
+}
+
+// memoryRecord is a receipt as the memory store holds it.
+type memoryRecord struct {
+	seq       uint64
+	revision  uint64
+	tenant    string // "" for receipts stored without a tenant
+	receipt   points.Receipt
+	breakdown points.Breakdown // its Total is the receipt's points
+	storedAt  time.Time        // when the receipt was first saved
+	deletedAt time.Time        // zero unless the receipt was deleted
+	// compactedAt is when the receipt's items were dropped; zero unless
+	// they were.
+	compactedAt time.Time
+}
+
+func (r *memoryRecord) deleted() bool {
+	return !r.deletedAt.IsZero()
+}
+
+func (r *memoryRecord) stored(id string) StoredReceipt {
+	return StoredReceipt{Seq: r.seq, ID: id, Tenant: r.tenant, Receipt: r.receipt, Points: r.breakdown.Total, DeletedAt: r.deletedAt, CompactedAt: r.compactedAt}
+}
+
+// Reasons passed to memoryStore.onEvict.
+const (
+	evictCapacity = "capacity"
+	evictExpired  = "expired"
+)
+
+// eviction is a receipt evicted from a memoryStore, and why.
+type eviction struct {
+	id, reason string
+}
+
+type orderEntry struct {
+	seq uint64
+	id  string
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		records: make(map[string]*memoryRecord),
+		now:     time.Now,
+	}
+}
+
+// recordLocked returns the record entry refers to, unless entry is dead.
+// s.mu must be held for reading.
+func (s *memoryStore) recordLocked(entry orderEntry) (*memoryRecord, bool) {
+	record, exists := s.records[entry.id]
+	return record, exists && record.seq == entry.seq
+}
+
+func (s *memoryStore) SaveReceipt(ctx context.Context, id string, receipt points.Receipt, breakdown points.Breakdown) error {
+	s.mu.Lock()
+	defer s.unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	previous, exists := s.records[id]
+	if exists && isNewID(ctx) {
+		return ErrIDTaken
+	}
+	now := s.now()
+	record := &memoryRecord{tenant: ownerFrom(ctx), receipt: receipt, breakdown: breakdown}
+	if exists {
+		record.seq, record.storedAt = previous.seq, previous.storedAt
+		record.revision = previous.revision + 1
+	} else {
+		s.lastSeq++
+		record.seq, record.storedAt = s.lastSeq, now
+		record.revision = 1
+		s.order = append(s.order, orderEntry{seq: s.lastSeq, id: id})
+	}
+	s.records[id] = record
+	s.items.add(id, receipt)
+	s.changes++
+	s.recompactLocked(id, record)
+	s.evictLocked(now)
+	return nil
+}
+
+// stored reports whether a receipt is stored under id, whoever owns it and
+// whether or not it was deleted or has expired.
+func (s *memoryStore) stored(id string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, exists := s.records[id]
+	return exists
+}
+
+// liveLocked returns the record of id if it is stored and unexpired.
+// Expired receipts are left for the next write or sweep to evict, so that
+// reads only need a read lock. s.mu must be held for reading.
+func (s *memoryStore) liveLocked(id string, now time.Time) (*memoryRecord, bool) {
+	record, exists := s.records[id]
+	return record, exists && !s.expired(record, now)
+}
+
+// visibleLocked returns the record of id if it is stored, unexpired and
+// visible to a call made with ctx. s.mu must be held for reading.
+func (s *memoryStore) visibleLocked(ctx context.Context, id string, now time.Time) (*memoryRecord, bool) {
+	record, live := s.liveLocked(id, now)
+	return record, live && canSee(ctx, record.tenant)
+}
+
+// lookupLocked returns the record of id if it is stored, unexpired and
+// visible to a call made with ctx, evicting it if it has expired. s.mu must
+// be held for writing, and released with unlock.
+func (s *memoryStore) lookupLocked(ctx context.Context, id string) (*memoryRecord, bool) {
+	record, exists := s.records[id]
+	if !exists || !canSee(ctx, record.tenant) {
+		return nil, false
+	}
+	if s.expired(record, s.now()) {
+		s.evict(id, evictExpired)
+		return nil, false
+	}
+	return record, true
+}
+
+// readableLocked returns the record of id if a read made with ctx may see
+// it, and otherwise the error the read returns. s.mu must be held for
+// reading.
+func (s *memoryStore) readableLocked(ctx context.Context, id string, now time.Time) (*memoryRecord, error) {
+	record, visible := s.visibleLocked(ctx, id, now)
+	if !visible {
+		return nil, ErrNotFound
+	}
+	if record.deleted() && !includeDeleted(ctx) {
+		return nil, &DeletedError{DeletedAt: record.deletedAt}
+	}
+	return record, nil
+}
+
+// writableLocked returns the record of id if it is stored, unexpired,
+// visible to a call made with ctx, not deleted and, unless revision is 0, at
+// revision, and otherwise the error a write returns. It evicts id if it has
+// expired. s.mu must be held for writing, and released with unlock.
+func (s *memoryStore) writableLocked(ctx context.Context, id string, revision uint64) (*memoryRecord, error) {
+	record, found := s.lookupLocked(ctx, id)
+	if !found {
+		return nil, ErrNotFound
+	}
+	if record.deleted() {
+		return nil, &DeletedError{DeletedAt: record.deletedAt}
+	}
+	if revision != 0 && record.revision != revision {
+		return nil, ErrRevisionMismatch
+	}
+	return record, nil
+}
+
+// listedLocked reports whether List and Scan, called with ctx, include
+// record. s.mu must be held for reading.
+func (s *memoryStore) listedLocked(ctx context.Context, record *memoryRecord, now time.Time) bool {
+	return !s.expired(record, now) && canSee(ctx, record.tenant) && (!record.deleted() || includeDeleted(ctx))
+}
+
+func (s *memoryStore) expired(record *memoryRecord, now time.Time) bool {
+	return s.ttl > 0 && now.Sub(record.storedAt) >= s.ttl
+}
+
+// evictLocked removes expired receipts, then the oldest receipts until the
+// store is within maxReceipts. s.mu must be held for writing, and released
+// with unlock.
+func (s *memoryStore) evictLocked(now time.Time) {
+	// order is sorted by when receipts were first stored, so the expired
+	// and the oldest receipts are both at its front.
+	// Evicting a receipt leaves its entry dead at the front, to be dropped
+	// on the next iteration (unless remove compacted it away).
+	for len(s.order) > 0 {
+		entry := s.order[0]
+		record, live := s.recordLocked(entry)
+		switch {
+		case !live:
+			s.order = s.order[1:]
+		case s.expired(record, now):
+			s.evict(entry.id, evictExpired)
+		case s.maxReceipts > 0 && len(s.records) > s.maxReceipts:
+			s.evict(entry.id, evictCapacity)
+		default:
+			return
+		}
+	}
+}
+
+func (s *memoryStore) evict(id, reason string) {
+	s.remove(id)
+	if s.onEvict != nil {
+		s.evicted = append(s.evicted, eviction{id: id, reason: reason})
+	}
+}
+
+// unlock releases s.mu, held for writing, then tells onEvict of the
+// receipts evicted while it was held. onEvict removes their images and
+// records them in the audit log, which must not hold up every other read
+// and write of the store.
+func (s *memoryStore) unlock() {
+	evicted := s.evicted
+	s.evicted = nil
+	s.mu.Unlock()
+	for _, e := range evicted {
+		s.onEvict(e.id, e.reason)
+	}
+}
+
+// sweep evicts expired receipts, then compacts those due.
+func (s *memoryStore) sweep(now time.Time) {
+	s.mu.Lock()
+	s.evictLocked(now)
+	s.unlock()
+	if s.compactAfter > 0 {
+		s.compact(now)
+	}
+}
+
+// run sweeps the store every interval until ctx is canceled.
+func (s *memoryStore) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.sweep(now)
+		}
+	}
+}
+
+func (s *memoryStore) GetPoints(ctx context.Context, id string) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	record, err := s.readableLocked(ctx, id, s.now())
+	if err != nil {
+		return 0, err
+	}
+	return record.breakdown.Total, nil
+}
+
+func (s *memoryStore) GetReceipt(ctx context.Context, id string) (points.Receipt, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	record, err := s.readableLocked(ctx, id, s.now())
+	if err != nil {
+		return points.Receipt{}, err
+	}
+	if record.compacted() && !includeCompacted(ctx) {
+		return points.Receipt{}, &CompactedError{CompactedAt: record.compactedAt}
+	}
+	return record.receipt, nil
+}
+
+func (s *memoryStore) GetBreakdown(ctx context.Context, id string) (points.Breakdown, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	record, err := s.readableLocked(ctx, id, s.now())
+	if err != nil {
+		return points.Breakdown{}, err
+	}
+	return record.breakdown, nil
+}
+
+func (s *memoryStore) GetRevision(ctx context.Context, id string) (uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	record, err := s.readableLocked(ctx, id, s.now())
+	if err != nil {
+		return 0, err
+	}
+	return record.revision, nil
+}
+
+func (s *memoryStore) UpdateBreakdown(ctx context.Context, id string, breakdown points.Breakdown) error {
+	s.mu.Lock()
+	defer s.unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	record, err := s.writableLocked(ctx, id, 0)
+	if err != nil {
+		return err
+	}
+	record.breakdown = breakdown
+	record.revision++
+	s.changes++
+	s.recompactLocked(id, record)
+	return nil
+}
+
+func (s *memoryStore) UpdateReceipt(ctx context.Context, id string, revision uint64, receipt points.Receipt, breakdown points.Breakdown) error {
+	s.mu.Lock()
+	defer s.unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	record, err := s.writableLocked(ctx, id, revision)
+	if err != nil {
+		return err
+	}
+	record.receipt, record.breakdown = receipt, breakdown
+	record.compactedAt = time.Time{}
+	record.revision++
+	s.items.add(id, receipt)
+	s.changes++
+	s.recompactLocked(id, record)
+	return nil
+}
+
+func (s *memoryStore) Delete(ctx context.Context, id string, revision uint64) error {
+	return s.deleteAt(ctx, id, revision, s.now())
+}
+
+// deleteAt is Delete, recording the receipt as deleted at at.
+func (s *memoryStore) deleteAt(ctx context.Context, id string, revision uint64, at time.Time) error {
+	s.mu.Lock()
+	defer s.unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	record, err := s.writableLocked(ctx, id, revision)
+	if err != nil {
+		return err
+	}
+	record.deletedAt = at
+	record.revision++
+	s.changes++
+	return nil
+}
+
+func (s *memoryStore) Restore(ctx context.Context, id string, since time.Time) (StoredReceipt, error) {
+	s.mu.Lock()
+	defer s.unlock()
+
+	if err := ctx.Err(); err != nil {
+		return StoredReceipt{}, err
+	}
+
+	record, found := s.lookupLocked(ctx, id)
+	if !found {
+		return StoredReceipt{}, ErrNotFound
+	}
+	if record.deleted() {
+		if record.deletedAt.Before(since) {
+			return StoredReceipt{}, &DeletedError{DeletedAt: record.deletedAt}
+		}
+		record.deletedAt = time.Time{}
+		record.revision++
+		s.changes++
+	}
+	return record.stored(id), nil
+}
+
+func (s *memoryStore) PurgeDeleted(ctx context.Context, before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for id, record := range s.records {
+		if record.deleted() && record.deletedAt.Before(before) {
+			s.remove(id)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// deletedBefore reports whether any receipt was deleted before before.
+func (s *memoryStore) deletedBefore(before time.Time) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, record := range s.records {
+		if record.deleted() && record.deletedAt.Before(before) {
+			return true
+		}
+	}
+	return false
+}
+
+// forget removes id for good, if it is stored.
+func (s *memoryStore) forget(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.records[id]; exists {
+		s.remove(id)
+	}
+}
+
+// remove deletes id, which must be stored. s.mu must be held for writing.
+func (s *memoryStore) remove(id string) {
+	delete(s.records, id)
+	s.items.remove(id)
+	s.changes++
+
+	// Compact once most of order refers to deleted receipts.
+	if len(s.order) > 64 && len(s.records) < len(s.order)/2 {
+		live := make([]orderEntry, 0, len(s.records))
+		for _, entry := range s.order {
+			if _, ok := s.recordLocked(entry); ok {
+				live = append(live, entry)
+			}
+		}
+		s.order = live
+	}
+}
+
+func (s *memoryStore) Purge(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	now := s.now()
+	removed := 0
+	for _, record := range s.records {
+		if !s.expired(record, now) && !record.deleted() {
+			removed++
+		}
+	}
+	// lastSeq is kept so that sequence numbers, and with them list
+	// cursors, are never reused.
+	s.records = make(map[string]*memoryRecord)
+	s.order = nil
+	s.items.clear()
+	s.changes++
+	return removed, nil
+}
+
+func (s *memoryStore) List(ctx context.Context) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := s.now()
+	ids := make([]string, 0, len(s.records))
+	for id, record := range s.records {
+		if s.listedLocked(ctx, record, now) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (s *memoryStore) Scan(ctx context.Context, after uint64, fn func(StoredReceipt) bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	now := s.now()
+	start := sort.Search(len(s.order), func(i int) bool { return s.order[i].seq > after })
+	for _, entry := range s.order[start:] {
+		record, live := s.recordLocked(entry)
+		if !live || !s.listedLocked(ctx, record, now) {
+			continue
+		}
+		if !fn(record.stored(entry.id)) {
+			break
+		}
+	}
+	return nil
+}
+
+// dump returns every unexpired receipt with its score, owner and deletion
+// time, in the order they were stored, and the change count they are current
+// as of.
+func (s *memoryStore) dump() ([]snapshotRecord, uint64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := s.now()
+	records := make([]snapshotRecord, 0, len(s.records))
+	for _, entry := range s.order {
+		record, live := s.recordLocked(entry)
+		if !live || s.expired(record, now) {
+			continue
+		}
+		breakdown := record.breakdown
+		snapshot := snapshotRecord{
+			ID:        entry.id,
+			Tenant:    record.tenant,
+			Revision:  record.revision,
+			Points:    breakdown.Total,
+			Receipt:   record.receipt,
+			Breakdown: &breakdown,
+		}
+		if record.deleted() {
+			deletedAt := record.deletedAt
+			snapshot.DeletedAt = &deletedAt
+		}
+		if record.compacted() {
+			compactedAt := record.compactedAt
+			snapshot.CompactedAt = &compactedAt
+		}
+		records = append(records, snapshot)
+	}
+	return records, s.changes
+}
+
+// setRevision sets the revision of id, if it is stored, as when loading a
+// snapshot of the receipt at that revision.
+func (s *memoryStore) setRevision(id string, revision uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if record, exists := s.records[id]; exists {
+		record.revision = revision
+	}
+}
+
+// setCompacted marks id, if it is stored, as compacted at at, as when
+// loading a snapshot of the receipt taken after it was.
+func (s *memoryStore) setCompacted(id string, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if record, exists := s.records[id]; exists {
+		record.compactedAt = at
+		s.items.remove(id)
+	}
+}
+
+// changeCount returns the number of writes made to the store so far.
+func (s *memoryStore) changeCount() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.changes
+}
+
+func (s *memoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
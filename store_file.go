@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+// fileStore is a Store that keeps its data in memory and appends every change
+// to a JSON-lines log, which is replayed on startup.
+type fileStore struct {
+	*memoryStore
+
+	mu   sync.Mutex // serializes appends so the log order matches memory
+	file *os.File
+	// write writes to file. Tests replace it to make appends fail.
+	write func([]byte) (int, error)
+
+	// outbox holds the webhook events of the log by ID, for fileOutbox.
+	// It is guarded by mu.
+	outbox map[string]*outboxEvent
+}
+
+// fileEntry is one line of the fileStore log.
+type fileEntry struct {
+	Op        string            `json:"op"`
+	ID        string            `json:"id"`
+	Tenant    string            `json:"tenant,omitempty"`
+	Receipt   *points.Receipt   `json:"receipt,omitempty"`
+	Breakdown *points.Breakdown `json:"breakdown,omitempty"`
+	// DeletedAt is when a tombstone entry deleted its receipt, and for a
+	// purge entry, the time before which deleted receipts were purged.
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
+	// Webhooks are the webhook events a save entry adds to the outbox, and
+	// for a webhook entry, the event it changes.
+	Webhooks []outboxEvent `json:"webhooks,omitempty"`
+	// Points are the points of a points entry.
+	Points *int `json:"points,omitempty"`
+}
+
+const (
+	fileOpSave         = "save"
+	fileOpScore        = "score"
+	fileOpUpdate       = "update"
+	fileOpTombstone    = "tombstone"
+	fileOpRestore      = "restore"
+	fileOpPurgeDeleted = "purge_deleted"
+	fileOpWebhook      = "webhook"
+	// fileOpDelete entries remove a receipt outright. They were written
+	// before deleted receipts could be restored, and are still replayed.
+	fileOpDelete = "delete"
+	// fileOpReceipt and fileOpPoints entries wrote a receipt and its
+	// points apart, in the two-map layout (see legacyMerge). They are
+	// still replayed, merged into records.
+	fileOpReceipt = "receipt"
+	fileOpPoints  = "points"
+)
+
+// openFileStore opens the log at path, creating it if needed, and replays it.
+func openFileStore(path string) (*fileStore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &fileStore{memoryStore: newMemoryStore(), file: file, write: file.Write, outbox: make(map[string]*outboxEvent)}
+	if err := s.replay(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("replaying %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// replay loads the log into memory and leaves the file positioned for
+// appending. A final line without a trailing newline is the remains of an
+// interrupted write and is discarded, as are receipts of the two-map layout
+// whose points were never written, and the reverse.
+func (s *fileStore) replay() error {
+	reader := bufio.NewReader(s.file)
+	merge := newLegacyMerge()
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		var entry fileEntry
+		if err := json.Unmarshal(bytes.TrimSpace(line), &entry); err != nil {
+			return fmt.Errorf("offset %d: %w", offset, err)
+		}
+		if entry.Op == fileOpReceipt || entry.Op == fileOpPoints {
+			s.applyLegacy(merge, entry)
+		} else {
+			s.apply(entry)
+		}
+		offset += int64(len(line))
+	}
+
+	if err := s.file.Truncate(offset); err != nil {
+		return err
+	}
+	_, err := s.file.Seek(offset, io.SeekStart)
+	return err
+}
+
+func (s *fileStore) apply(entry fileEntry) {
+	ctx := context.Background()
+	switch entry.Op {
+	case fileOpSave:
+		if entry.Receipt != nil && entry.Breakdown != nil {
+			s.memoryStore.SaveReceipt(withTenant(ctx, entry.Tenant), entry.ID, *entry.Receipt, *entry.Breakdown)
+			s.addOutbox(entry.Webhooks)
+		}
+	case fileOpScore:
+		if entry.Breakdown != nil {
+			s.memoryStore.UpdateBreakdown(ctx, entry.ID, *entry.Breakdown)
+		}
+	case fileOpUpdate:
+		if entry.Receipt != nil && entry.Breakdown != nil {
+			s.memoryStore.UpdateReceipt(ctx, entry.ID, 0, *entry.Receipt, *entry.Breakdown)
+		}
+	case fileOpTombstone:
+		if entry.DeletedAt != nil {
+			s.memoryStore.deleteAt(ctx, entry.ID, 0, *entry.DeletedAt)
+		}
+	case fileOpRestore:
+		s.memoryStore.Restore(ctx, entry.ID, time.Time{})
+	case fileOpPurgeDeleted:
+		if entry.DeletedAt != nil {
+			s.memoryStore.PurgeDeleted(ctx, *entry.DeletedAt)
+		}
+	case fileOpWebhook:
+		for _, event := range entry.Webhooks {
+			if _, ok := s.outbox[event.ID]; ok {
+				s.outbox[event.ID] = &event
+			}
+		}
+	case fileOpDelete:
+		s.memoryStore.forget(entry.ID)
+	}
+}
+
+// applyLegacy replays an entry of the two-map layout, storing a receipt once
+// both it and its points have been read. Points written for a receipt
+// already stored rescored it.
+func (s *fileStore) applyLegacy(merge *legacyMerge, entry fileEntry) {
+	ctx := context.Background()
+	var record snapshotRecord
+	var complete bool
+	switch {
+	case entry.Op == fileOpReceipt && entry.Receipt != nil:
+		record, complete = merge.addReceipt(entry.ID, entry.Tenant, *entry.Receipt)
+	case entry.Op == fileOpPoints && entry.Points != nil:
+		if s.memoryStore.stored(entry.ID) {
+			s.memoryStore.UpdateBreakdown(ctx, entry.ID, legacyBreakdown(*entry.Points))
+			return
+		}
+		record, complete = merge.addPoints(entry.ID, *entry.Points)
+	}
+	if complete {
+		s.memoryStore.SaveReceipt(withTenant(ctx, record.Tenant), record.ID, record.Receipt, legacyBreakdown(record.Points))
+	}
+}
+
+// addOutbox adds events to the outbox. s.mu must be held.
+func (s *fileStore) addOutbox(events []outboxEvent) {
+	for _, event := range events {
+		s.outbox[event.ID] = &event
+	}
+}
+
+// append writes entry to the log unless ctx is already done. Once started,
+// the write is seen through, since memory must match the log. A write that
+// fails is truncated away, so that a torn line cannot run into the next one.
+func (s *fileStore) append(ctx context.Context, entry fileEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	offset, err := s.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := s.write(append(line, '\n')); err != nil {
+		if truncErr := s.file.Truncate(offset); truncErr == nil {
+			s.file.Seek(offset, io.SeekStart)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *fileStore) SaveReceipt(ctx context.Context, id string, receipt points.Receipt, breakdown points.Breakdown) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if isNewID(ctx) && s.memoryStore.stored(id) {
+		return ErrIDTaken
+	}
+	webhooks := outboxFrom(ctx)
+	if err := s.append(ctx, fileEntry{Op: fileOpSave, ID: id, Tenant: ownerFrom(ctx), Receipt: &receipt, Breakdown: &breakdown, Webhooks: webhooks}); err != nil {
+		return err
+	}
+	s.addOutbox(webhooks)
+	return s.memoryStore.SaveReceipt(context.WithoutCancel(ctx), id, receipt, breakdown)
+}
+
+func (s *fileStore) UpdateBreakdown(ctx context.Context, id string, breakdown points.Breakdown) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.memoryStore.GetReceipt(ctx, id); err != nil {
+		return err
+	}
+	if err := s.append(ctx, fileEntry{Op: fileOpScore, ID: id, Breakdown: &breakdown}); err != nil {
+		return err
+	}
+	return s.memoryStore.UpdateBreakdown(context.WithoutCancel(ctx), id, breakdown)
+}
+
+func (s *fileStore) UpdateReceipt(ctx context.Context, id string, revision uint64, receipt points.Receipt, breakdown points.Breakdown) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkRevision(ctx, id, revision); err != nil {
+		return err
+	}
+	if err := s.append(ctx, fileEntry{Op: fileOpUpdate, ID: id, Receipt: &receipt, Breakdown: &breakdown}); err != nil {
+		return err
+	}
+	return s.memoryStore.UpdateReceipt(context.WithoutCancel(ctx), id, 0, receipt, breakdown)
+}
+
+func (s *fileStore) Delete(ctx context.Context, id string, revision uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkRevision(ctx, id, revision); err != nil {
+		return err
+	}
+	at := s.now()
+	if err := s.append(ctx, fileEntry{Op: fileOpTombstone, ID: id, DeletedAt: &at}); err != nil {
+		return err
+	}
+	return s.memoryStore.deleteAt(context.WithoutCancel(ctx), id, 0, at)
+}
+
+// checkRevision returns the error a write to id expecting revision returns,
+// if any, before anything is logged. Revisions are not logged themselves:
+// replaying the log makes the same writes, which leave the same revisions.
+// s.mu must be held.
+func (s *fileStore) checkRevision(ctx context.Context, id string, revision uint64) error {
+	current, err := s.memoryStore.GetRevision(ctx, id)
+	if err != nil {
+		return err
+	}
+	if revision != 0 && current != revision {
+		return ErrRevisionMismatch
+	}
+	return nil
+}
+
+func (s *fileStore) Restore(ctx context.Context, id string, since time.Time) (StoredReceipt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Only a receipt that will be restored needs an entry.
+	_, err := s.memoryStore.GetReceipt(ctx, id)
+	var deleted *DeletedError
+	if errors.As(err, &deleted) && !deleted.DeletedAt.Before(since) {
+		if err := s.append(ctx, fileEntry{Op: fileOpRestore, ID: id}); err != nil {
+			return StoredReceipt{}, err
+		}
+	}
+	return s.memoryStore.Restore(context.WithoutCancel(ctx), id, since)
+}
+
+func (s *fileStore) PurgeDeleted(ctx context.Context, before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The purge runs periodically, and the log should not grow when there
+	// is nothing to purge.
+	if !s.memoryStore.deletedBefore(before) {
+		return 0, ctx.Err()
+	}
+	if err := s.append(ctx, fileEntry{Op: fileOpPurgeDeleted, DeletedAt: &before}); err != nil {
+		return 0, err
+	}
+	return s.memoryStore.PurgeDeleted(context.WithoutCancel(ctx), before)
+}
+
+// Purge empties the log as well as memory: with nothing stored, there is
+// nothing for it to replay.
+func (s *fileStore) Purge(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if err := s.file.Truncate(0); err != nil {
+		return 0, err
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return s.memoryStore.Purge(context.WithoutCancel(ctx))
+}
+
+// Ping checks that the log file is still open and present on disk.
+func (s *fileStore) Ping(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.file.Stat(); err != nil {
+		return err
+	}
+	_, err := os.Stat(s.file.Name())
+	return err
+}
+
+func (s *fileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.file.Sync(); err != nil {
+		s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// openTestFileStore opens the file store at path, closing it when the test
+// ends.
+func openTestFileStore(t *testing.T, path string) *fileStore {
+	t.Helper()
+	store, err := openFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestFileStoreTornLastLine(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "receipts")
+	ctx := context.Background()
+	store := openTestFileStore(t, path)
+	target, targetBreakdown := scored(parseReceipt(t, targetReceipt))
+	market, marketBreakdown := scored(parseReceipt(t, marketReceipt))
+	store.SaveReceipt(ctx, "a", target, targetBreakdown)
+	store.UpdateReceipt(ctx, "a", 0, market, marketBreakdown)
+	store.SaveReceipt(ctx, "b", target, targetBreakdown)
+	before, _ := os.ReadFile(path)
+	store.UpdateReceipt(ctx, "b", 0, market, marketBreakdown)
+	store.Close()
+	after, _ := os.ReadFile(path)
+
+	// A crash can cut the last line anywhere, up to its newline.
+	want := map[string]int{"a": 109, "b": 28}
+	for cut := len(before); cut < len(after); cut++ {
+		torn := filepath.Join(dir, "torn")
+		if err := os.WriteFile(torn, after[:cut], 0o644); err != nil {
+			t.Fatal(err)
+		}
+		store, err := openFileStore(torn)
+		if err != nil {
+			t.Fatalf("opening a log cut at %d of %d bytes: %v", cut, len(after), err)
+		}
+		if got := snapshot(t, store); !maps.Equal(got, want) {
+			t.Errorf("log cut at %d of %d bytes holds %v, want %v", cut, len(after), got, want)
+		}
+
+		// The torn line is gone from the file too, so what is appended
+		// next starts a line of its own.
+		if err := store.SaveReceipt(ctx, "c", target, targetBreakdown); err != nil {
+			t.Fatal(err)
+		}
+		store.Close()
+		store, err = openFileStore(torn)
+		if err != nil {
+			t.Fatalf("reopening a log cut at %d after appending: %v", cut, err)
+		}
+		if got := snapshot(t, store); len(got) != 3 || got["c"] != 28 {
+			t.Errorf("log cut at %d then appended to holds %v, want c added", cut, got)
+		}
+		store.Close()
+	}
+}
+
+// errDiskFull fails the appends of TestFileStoreFailedAppend.
+var errDiskFull = errors.New("disk full")
+
+func TestFileStoreFailedAppend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "receipts")
+	ctx := context.Background()
+	store := openTestFileStore(t, path)
+	target, targetBreakdown := scored(parseReceipt(t, targetReceipt))
+	market, marketBreakdown := scored(parseReceipt(t, marketReceipt))
+	if err := store.SaveReceipt(ctx, "a", target, targetBreakdown); err != nil {
+		t.Fatal(err)
+	}
+	good, _ := os.ReadFile(path)
+
+	// Each write gets half its line onto the disk before failing.
+	store.write = func(b []byte) (int, error) {
+		n, _ := store.file.Write(b[:len(b)/2])
+		return n, errDiskFull
+	}
+	if err := store.SaveReceipt(ctx, "b", market, marketBreakdown); !errors.Is(err, errDiskFull) {
+		t.Errorf("SaveReceipt = %v, want the write's error", err)
+	}
+	if err := store.UpdateReceipt(ctx, "a", 0, market, marketBreakdown); !errors.Is(err, errDiskFull) {
+		t.Errorf("UpdateReceipt = %v, want the write's error", err)
+	}
+	if err := store.Delete(ctx, "a", 0); !errors.Is(err, errDiskFull) {
+		t.Errorf("Delete = %v, want the write's error", err)
+	}
+	want := map[string]int{"a": 28}
+	if got := snapshot(t, store); !maps.Equal(got, want) {
+		t.Errorf("after failed writes the store holds %v, want %v", got, want)
+	}
+	if data, _ := os.ReadFile(path); string(data) != string(good) {
+		t.Errorf("failed writes left %q in the log", strings.TrimPrefix(string(data), string(good)))
+	}
+
+	// Once writes work again, the log carries on where it was.
+	store.write = store.file.Write
+	if err := store.SaveReceipt(ctx, "b", market, marketBreakdown); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+	want["b"] = 109
+	if got := snapshot(t, openTestFileStore(t, path)); !maps.Equal(got, want) {
+		t.Errorf("reopened log holds %v, want %v", got, want)
+	}
+}
+
+// legacyLine encodes an entry of the two-map layout, which wrote a receipt
+// and its points as separate entries.
+func legacyLine(t *testing.T, op, id, receipt string, total int) string {
+	t.Helper()
+	entry := map[string]any{"op": op, "id": id}
+	if receipt != "" {
+		entry["receipt"] = json.RawMessage(receipt)
+	} else {
+		entry["points"] = total
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(line) + "\n"
+}
+
+func TestFileStoreMergesTwoMapEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "receipts")
+	log := legacyLine(t, fileOpReceipt, "a", targetReceipt, 0) +
+		legacyLine(t, fileOpPoints, "a", "", 28) +
+		// Points may come first, and be rewritten by a rescore.
+		legacyLine(t, fileOpPoints, "b", "", 100) +
+		legacyLine(t, fileOpReceipt, "b", marketReceipt, 0) +
+		legacyLine(t, fileOpPoints, "b", "", 109) +
+		// Halves of records whose writes were cut short.
+		legacyLine(t, fileOpReceipt, "c", targetReceipt, 0) +
+		legacyLine(t, fileOpPoints, "d", "", 28)
+	if err := os.WriteFile(path, []byte(log), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	store := openTestFileStore(t, path)
+	want := map[string]int{"a": 28, "b": 109}
+	if got := snapshot(t, store); !maps.Equal(got, want) {
+		t.Errorf("log of the two-map layout holds %v, want %v", got, want)
+	}
+
+	// Entries written since are replayed after the merged ones.
+	ctx := context.Background()
+	if err := store.Delete(ctx, "a", 0); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+	if got := snapshot(t, openTestFileStore(t, path)); !maps.Equal(got, map[string]int{"b": 109}) {
+		t.Errorf("reopened log holds %v, want only b", got)
+	}
+}
@@ -0,0 +1,546 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+	_ "modernc.org/sqlite"
+)
+
+// sqliteMigrations are applied in order on startup; schema_migrations records
+// how many have run. Append new migrations, never edit existing ones.
+var sqliteMigrations = []string{
+	`CREATE TABLE receipts (
+		id            TEXT PRIMARY KEY,
+		retailer      TEXT NOT NULL,
+		purchase_date TEXT NOT NULL,
+		purchase_time TEXT NOT NULL,
+		total_cents   INTEGER NOT NULL,
+		points        INTEGER NOT NULL,
+		breakdown     TEXT NOT NULL,
+		raw           TEXT NOT NULL
+	);
+	CREATE TABLE items (
+		receipt_id        TEXT NOT NULL REFERENCES receipts (id) ON DELETE CASCADE,
+		position          INTEGER NOT NULL,
+		short_description TEXT NOT NULL,
+		price_cents       INTEGER NOT NULL,
+		PRIMARY KEY (receipt_id, position)
+	);`,
+	// seq orders receipts by when they were first stored. It is handed out
+	// from counters rather than derived from MAX(seq) so that values are
+	// never reused after a delete.
+	`ALTER TABLE receipts ADD COLUMN seq INTEGER NOT NULL DEFAULT 0;
+	UPDATE receipts SET seq = rowid;
+	CREATE UNIQUE INDEX receipts_seq ON receipts (seq);
+	CREATE TABLE counters (name TEXT PRIMARY KEY, value INTEGER NOT NULL);
+	INSERT INTO counters (name, value) SELECT 'receipt_seq', COALESCE(MAX(seq), 0) FROM receipts;`,
+	// tenant is the tenant owning a receipt; '' for none.
+	`ALTER TABLE receipts ADD COLUMN tenant TEXT NOT NULL DEFAULT '';
+	CREATE INDEX receipts_tenant_seq ON receipts (tenant, seq);`,
+	// deleted_at is when a receipt was deleted, in Unix nanoseconds; NULL
+	// unless it was.
+	`ALTER TABLE receipts ADD COLUMN deleted_at INTEGER;
+	CREATE INDEX receipts_deleted_at ON receipts (deleted_at) WHERE deleted_at IS NOT NULL;`,
+	// A receipt's points are kept both in points and as the total of its
+	// breakdown, and its items apart from it. Rows written before every
+	// write kept them together are brought into line: the points column
+	// is what the receipt was awarded, a breakdown that is not a JSON
+	// object is replaced by one with no rules, and items left without
+	// their receipt are removed.
+	`UPDATE receipts SET breakdown = json_object('rules', json('[]'), 'total', points)
+		WHERE NOT json_valid(breakdown) OR json_type(breakdown) IS NOT 'object';
+	UPDATE receipts SET breakdown = json_set(breakdown, '$.total', points)
+		WHERE json_extract(breakdown, '$.total') IS NOT points;
+	DELETE FROM items WHERE receipt_id NOT IN (SELECT id FROM receipts);`,
+	// audit_log holds the audit entries of -audit, each as JSON in entry,
+	// with the columns GET /admin/audit filters on. at is in Unix
+	// nanoseconds.
+	`CREATE TABLE audit_log (
+		seq        INTEGER PRIMARY KEY AUTOINCREMENT,
+		at         INTEGER NOT NULL,
+		action     TEXT NOT NULL,
+		receipt_id TEXT NOT NULL,
+		entry      TEXT NOT NULL
+	);
+	CREATE INDEX audit_log_receipt_id ON audit_log (receipt_id, seq);`,
+	// revision counts the writes to a receipt, for conditional updates
+	// and deletes.
+	`ALTER TABLE receipts ADD COLUMN revision INTEGER NOT NULL DEFAULT 1;`,
+	// quota_usage holds how many receipts each API key has processed in
+	// its current quota period, which started at period_start, in Unix
+	// seconds.
+	`CREATE TABLE quota_usage (
+		key_name     TEXT PRIMARY KEY,
+		period_start INTEGER NOT NULL,
+		used         INTEGER NOT NULL
+	);`,
+	// quantity is how many units an item is for; NULL if the receipt did
+	// not say.
+	`ALTER TABLE items ADD COLUMN quantity INTEGER;`,
+	// webhook_outbox holds webhook events until they are delivered. They
+	// are written in the transaction that saves their receipt. Times are
+	// in Unix nanoseconds.
+	`CREATE TABLE webhook_outbox (
+		id         TEXT PRIMARY KEY,
+		url        TEXT NOT NULL,
+		receipt_id TEXT NOT NULL,
+		body       TEXT NOT NULL,
+		status     TEXT NOT NULL,
+		attempts   INTEGER NOT NULL,
+		last_error TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL
+	);
+	CREATE INDEX webhook_outbox_status ON webhook_outbox (status, created_at);`,
+}
+
+// sqliteRevisionCond restricts a write to a receipt at the expected revision,
+// unless that is 0. It takes the expected revision twice.
+const sqliteRevisionCond = `(? = 0 OR revision = ?)`
+
+// sqliteTenantCond restricts a statement to the receipts visible to a call.
+// It takes the two arguments returned by tenantArgs.
+const sqliteTenantCond = `(? OR tenant = ?)`
+
+func tenantArgs(ctx context.Context) []any {
+	tenant, scoped := tenantFrom(ctx)
+	return []any{!scoped, tenant}
+}
+
+// sqliteListedCond restricts a List or Scan to the receipts it includes. It
+// takes the argument includeDeleted(ctx).
+const sqliteListedCond = `(? OR deleted_at IS NULL)`
+
+// deletedError returns the error for a read of a receipt with the given
+// deleted_at, or nil if ctx may read it.
+func deletedError(ctx context.Context, deletedAt sql.NullInt64) error {
+	if !deletedAt.Valid || includeDeleted(ctx) {
+		return nil
+	}
+	return &DeletedError{DeletedAt: time.Unix(0, deletedAt.Int64)}
+}
+
+// queryRower is a *sql.DB or a *sql.Tx.
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// requireChanged returns nil if result, of a write to the receipt with id
+// expecting revision, affected a row. Otherwise the receipt was missing,
+// deleted or at another revision, and the error says which.
+func requireChanged(ctx context.Context, q queryRower, result sql.Result, id string, revision uint64) error {
+	if err := requireAffected(result); !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	var deletedAt sql.NullInt64
+	err := q.QueryRowContext(ctx, `SELECT deleted_at FROM receipts WHERE id = ? AND `+sqliteTenantCond,
+		append([]any{id}, tenantArgs(ctx)...)...).Scan(&deletedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if err := deletedError(ctx, deletedAt); err != nil {
+		return err
+	}
+	if revision != 0 {
+		// Either at another revision or restored since the write missed
+		// it, which moved it on from any revision the write expected.
+		return ErrRevisionMismatch
+	}
+	// Restored since the write missed it; as far as the write could tell,
+	// it was not there.
+	return ErrNotFound
+}
+
+// sqliteStore is a Store persisted in a SQLite database, so receipts survive
+// restarts.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func openSQLiteStore(path string) (*sqliteStore, error) {
+	dsn := "file:" + url.PathEscape(path) + "?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer; one connection avoids SQLITE_BUSY churn.
+	db.SetMaxOpenConns(1)
+
+	if err := migrateSQLite(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating %s: %w", path, err)
+	}
+	return &sqliteStore{db: db}, nil
+}
+
+func migrateSQLite(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER NOT NULL)`); err != nil {
+		return err
+	}
+
+	var version int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return err
+	}
+
+	for i := version; i < len(sqliteMigrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqliteMigrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version) VALUES (?)`, i+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqliteStore) SaveReceipt(ctx context.Context, id string, receipt points.Receipt, breakdown points.Breakdown) error {
+	raw, err := json.Marshal(receipt)
+	if err != nil {
+		return err
+	}
+	breakdownJSON, err := json.Marshal(breakdown)
+	if err != nil {
+		return err
+	}
+	total, _ := receipt.Total.Cents()
+
+	// The receipt, its items, its score and its webhook events are
+	// written in one transaction, which is rolled back if ctx is done
+	// before it commits.
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Overwriting a receipt keeps its original sequence number, and moves
+	// it to the next revision.
+	var seq, revision uint64
+	err = tx.QueryRowContext(ctx, `SELECT seq, revision FROM receipts WHERE id = ?`, id).Scan(&seq, &revision)
+	if err == nil && isNewID(ctx) {
+		return ErrIDTaken
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		err = tx.QueryRowContext(ctx, `UPDATE counters SET value = value + 1 WHERE name = 'receipt_seq' RETURNING value`).Scan(&seq)
+	}
+	revision++
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM receipts WHERE id = ?`, id); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO receipts (id, seq, revision, tenant, retailer, purchase_date, purchase_time, total_cents, points, breakdown, raw)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		id, seq, revision, ownerFrom(ctx), receipt.Retailer, receipt.PurchaseDate, receipt.PurchaseTime, total, breakdown.Total, string(breakdownJSON), string(raw))
+	if err != nil {
+		return err
+	}
+	if err := insertItems(ctx, tx, id, receipt.Items); err != nil {
+		return err
+	}
+	if err := insertOutbox(ctx, tx, outboxFrom(ctx)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func insertItems(ctx context.Context, tx *sql.Tx, id string, items []points.Item) error {
+	for i, item := range items {
+		price, _ := item.Price.Cents()
+		_, err := tx.ExecContext(ctx, `INSERT INTO items (receipt_id, position, short_description, price_cents, quantity) VALUES (?, ?, ?, ?, ?)`,
+			id, i, item.ShortDescription, price, item.Quantity)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqliteStore) GetPoints(ctx context.Context, id string) (int, error) {
+	var points int
+	var deletedAt sql.NullInt64
+	err := s.db.QueryRowContext(ctx, `SELECT points, deleted_at FROM receipts WHERE id = ? AND `+sqliteTenantCond,
+		append([]any{id}, tenantArgs(ctx)...)...).Scan(&points, &deletedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := deletedError(ctx, deletedAt); err != nil {
+		return 0, err
+	}
+	return points, nil
+}
+
+func (s *sqliteStore) GetReceipt(ctx context.Context, id string) (points.Receipt, error) {
+	var receipt points.Receipt
+	err := s.getJSON(ctx, `SELECT raw, deleted_at FROM receipts WHERE id = ? AND `+sqliteTenantCond, id, &receipt)
+	return receipt, err
+}
+
+func (s *sqliteStore) GetRevision(ctx context.Context, id string) (uint64, error) {
+	var revision uint64
+	var deletedAt sql.NullInt64
+	err := s.db.QueryRowContext(ctx, `SELECT revision, deleted_at FROM receipts WHERE id = ? AND `+sqliteTenantCond,
+		append([]any{id}, tenantArgs(ctx)...)...).Scan(&revision, &deletedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := deletedError(ctx, deletedAt); err != nil {
+		return 0, err
+	}
+	return revision, nil
+}
+
+func (s *sqliteStore) GetBreakdown(ctx context.Context, id string) (points.Breakdown, error) {
+	var breakdown points.Breakdown
+	err := s.getJSON(ctx, `SELECT breakdown, deleted_at FROM receipts WHERE id = ? AND `+sqliteTenantCond, id, &breakdown)
+	return breakdown, err
+}
+
+// getJSON scans the JSON column selected by query into v. query selects it
+// and deleted_at, and takes id followed by the tenantArgs of ctx.
+func (s *sqliteStore) getJSON(ctx context.Context, query, id string, v any) error {
+	var data string
+	var deletedAt sql.NullInt64
+	err := s.db.QueryRowContext(ctx, query, append([]any{id}, tenantArgs(ctx)...)...).Scan(&data, &deletedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if err := deletedError(ctx, deletedAt); err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(data), v)
+}
+
+func (s *sqliteStore) UpdateBreakdown(ctx context.Context, id string, breakdown points.Breakdown) error {
+	breakdownJSON, err := json.Marshal(breakdown)
+	if err != nil {
+		return err
+	}
+	result, err := s.db.ExecContext(ctx, `UPDATE receipts SET points = ?, breakdown = ?, revision = revision + 1 WHERE id = ? AND deleted_at IS NULL AND `+sqliteTenantCond,
+		append([]any{breakdown.Total, string(breakdownJSON), id}, tenantArgs(ctx)...)...)
+	if err != nil {
+		return err
+	}
+	return requireChanged(ctx, s.db, result, id, 0)
+}
+
+func (s *sqliteStore) UpdateReceipt(ctx context.Context, id string, revision uint64, receipt points.Receipt, breakdown points.Breakdown) error {
+	raw, err := json.Marshal(receipt)
+	if err != nil {
+		return err
+	}
+	breakdownJSON, err := json.Marshal(breakdown)
+	if err != nil {
+		return err
+	}
+	total, _ := receipt.Total.Cents()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `UPDATE receipts SET retailer = ?, purchase_date = ?, purchase_time = ?, total_cents = ?, points = ?, breakdown = ?, raw = ?, revision = revision + 1
+		WHERE id = ? AND deleted_at IS NULL AND `+sqliteRevisionCond+` AND `+sqliteTenantCond,
+		append([]any{receipt.Retailer, receipt.PurchaseDate, receipt.PurchaseTime, total, breakdown.Total, string(breakdownJSON), string(raw), id, revision, revision}, tenantArgs(ctx)...)...)
+	if err != nil {
+		return err
+	}
+	if err := requireChanged(ctx, tx, result, id, revision); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM items WHERE receipt_id = ?`, id); err != nil {
+		return err
+	}
+	if err := insertItems(ctx, tx, id, receipt.Items); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) Delete(ctx context.Context, id string, revision uint64) error {
+	result, err := s.db.ExecContext(ctx, `UPDATE receipts SET deleted_at = ?, revision = revision + 1 WHERE id = ? AND deleted_at IS NULL AND `+sqliteRevisionCond+` AND `+sqliteTenantCond,
+		append([]any{time.Now().UnixNano(), id, revision, revision}, tenantArgs(ctx)...)...)
+	if err != nil {
+		return err
+	}
+	return requireChanged(ctx, s.db, result, id, revision)
+}
+
+func (s *sqliteStore) Restore(ctx context.Context, id string, since time.Time) (StoredReceipt, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return StoredReceipt{}, err
+	}
+	defer tx.Rollback()
+
+	stored := StoredReceipt{ID: id}
+	var raw string
+	var deletedAt sql.NullInt64
+	err = tx.QueryRowContext(ctx, `SELECT seq, tenant, points, raw, deleted_at FROM receipts WHERE id = ? AND `+sqliteTenantCond,
+		append([]any{id}, tenantArgs(ctx)...)...).Scan(&stored.Seq, &stored.Tenant, &stored.Points, &raw, &deletedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return StoredReceipt{}, ErrNotFound
+	}
+	if err != nil {
+		return StoredReceipt{}, err
+	}
+	if deletedAt.Valid {
+		if at := time.Unix(0, deletedAt.Int64); at.Before(since) {
+			return StoredReceipt{}, &DeletedError{DeletedAt: at}
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE receipts SET deleted_at = NULL, revision = revision + 1 WHERE id = ?`, id); err != nil {
+			return StoredReceipt{}, err
+		}
+	}
+	if err := json.Unmarshal([]byte(raw), &stored.Receipt); err != nil {
+		return StoredReceipt{}, fmt.Errorf("receipt %s: %w", id, err)
+	}
+	return stored, tx.Commit()
+}
+
+func (s *sqliteStore) PurgeDeleted(ctx context.Context, before time.Time) (int, error) {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM receipts WHERE deleted_at < ?`, before.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	return int(n), err
+}
+
+// Purge reports the receipts removed as the other stores do, not counting
+// deleted ones.
+func (s *sqliteStore) Purge(ctx context.Context) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var n int
+	if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM receipts WHERE deleted_at IS NULL`).Scan(&n); err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM receipts`); err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+// requireAffected returns ErrNotFound if result affected no rows.
+func requireAffected(result sql.Result) error {
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *sqliteStore) List(ctx context.Context) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id FROM receipts WHERE `+sqliteListedCond+` AND `+sqliteTenantCond,
+		append([]any{includeDeleted(ctx)}, tenantArgs(ctx)...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (s *sqliteStore) Scan(ctx context.Context, after uint64, fn func(StoredReceipt) bool) error {
+	// Pages are fetched separately so the query is not held open while
+	// fn runs.
+	const pageSize = 500
+	for {
+		page, err := s.scanPage(ctx, after, pageSize)
+		if err != nil {
+			return err
+		}
+		for _, stored := range page {
+			if !fn(stored) {
+				return nil
+			}
+			after = stored.Seq
+		}
+		if len(page) < pageSize {
+			return nil
+		}
+	}
+}
+
+func (s *sqliteStore) scanPage(ctx context.Context, after uint64, limit int) ([]StoredReceipt, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT seq, id, tenant, points, raw, deleted_at FROM receipts
+		WHERE seq > ? AND `+sqliteListedCond+` AND `+sqliteTenantCond+` ORDER BY seq LIMIT ?`,
+		append(append([]any{after, includeDeleted(ctx)}, tenantArgs(ctx)...), limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var page []StoredReceipt
+	for rows.Next() {
+		var stored StoredReceipt
+		var raw string
+		var deletedAt sql.NullInt64
+		if err := rows.Scan(&stored.Seq, &stored.ID, &stored.Tenant, &stored.Points, &raw, &deletedAt); err != nil {
+			return nil, err
+		}
+		if deletedAt.Valid {
+			stored.DeletedAt = time.Unix(0, deletedAt.Int64)
+		}
+		if err := json.Unmarshal([]byte(raw), &stored.Receipt); err != nil {
+			return nil, fmt.Errorf("receipt %s: %w", stored.ID, err)
+		}
+		page = append(page, stored)
+	}
+	return page, rows.Err()
+}
+
+func (s *sqliteStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
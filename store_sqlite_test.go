@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"modernc.org/sqlite"
+)
+
+// openTestSQLiteStore opens the SQLite store at path, closing it when the
+// test ends.
+func openTestSQLiteStore(t *testing.T, path string) *sqliteStore {
+	t.Helper()
+	store, err := openSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// checkSQLiteRows checks that the database of store holds no items without
+// their receipt and passes its integrity check.
+func checkSQLiteRows(t *testing.T, store *sqliteStore) {
+	t.Helper()
+	var orphans int
+	if err := store.db.QueryRow(`SELECT COUNT(*) FROM items WHERE receipt_id NOT IN (SELECT id FROM receipts)`).Scan(&orphans); err != nil {
+		t.Fatal(err)
+	}
+	if orphans != 0 {
+		t.Errorf("%d items are stored without their receipt", orphans)
+	}
+	var integrity string
+	if err := store.db.QueryRow(`PRAGMA integrity_check`).Scan(&integrity); err != nil || integrity != "ok" {
+		t.Errorf("integrity_check = %q, %v", integrity, err)
+	}
+}
+
+func TestSQLiteFailedWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "receipts.db")
+	ctx := context.Background()
+	store := openTestSQLiteStore(t, path)
+	target, targetBreakdown := scored(parseReceipt(t, targetReceipt))
+	market, marketBreakdown := scored(parseReceipt(t, marketReceipt))
+	if err := store.SaveReceipt(ctx, "a", target, targetBreakdown); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writing items fails once the receipt's row has been written, as a
+	// full disk would fail it part way through.
+	if _, err := store.db.Exec(`CREATE TRIGGER disk_full BEFORE INSERT ON items BEGIN SELECT RAISE(ABORT, 'disk full'); END`); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveReceipt(ctx, "b", market, marketBreakdown); err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Errorf("SaveReceipt = %v, want the write's error", err)
+	}
+	if err := store.UpdateReceipt(ctx, "a", 0, market, marketBreakdown); err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Errorf("UpdateReceipt = %v, want the write's error", err)
+	}
+	want := map[string]int{"a": 28}
+	if got := snapshot(t, store); !maps.Equal(got, want) {
+		t.Errorf("after failed writes the store holds %v, want %v", got, want)
+	}
+	if receipt, err := store.GetReceipt(ctx, "a"); err != nil || receipt.Retailer != "Target" || len(receipt.Items) != 5 {
+		t.Errorf("GetReceipt(a) = %+v, %v, want the receipt as first saved", receipt, err)
+	}
+	checkSQLiteRows(t, store)
+
+	if _, err := store.db.Exec(`DROP TRIGGER disk_full`); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveReceipt(ctx, "b", market, marketBreakdown); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+	want["b"] = 109
+	if got := snapshot(t, openTestSQLiteStore(t, path)); !maps.Equal(got, want) {
+		t.Errorf("reopened store holds %v, want %v", got, want)
+	}
+}
+
+// crashDBEnv names the database TestSQLiteCrashHelper writes to when run
+// by TestSQLiteCrashMidWrite.
+const crashDBEnv = "RECEIPT_PROCESSOR_CRASH_DB"
+
+// crashExitCode is the exit code of TestSQLiteCrashHelper when it dies as
+// intended.
+const crashExitCode = 7
+
+// TestSQLiteCrashHelper is not a test of its own. Run by
+// TestSQLiteCrashMidWrite, it saves a receipt, then kills the process in
+// the middle of saving and of updating others.
+func TestSQLiteCrashHelper(t *testing.T) {
+	path := os.Getenv(crashDBEnv)
+	if path == "" {
+		t.Skip("only run by TestSQLiteCrashMidWrite")
+	}
+	err := sqlite.RegisterScalarFunction("crash", 0, func(*sqlite.FunctionContext, []driver.Value) (driver.Value, error) {
+		os.Exit(crashExitCode)
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := openSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	target, targetBreakdown := scored(parseReceipt(t, targetReceipt))
+	market, marketBreakdown := scored(parseReceipt(t, marketReceipt))
+	if err := store.SaveReceipt(ctx, "a", target, targetBreakdown); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.db.Exec(`CREATE TRIGGER crash AFTER INSERT ON items WHEN NEW.position = 2 BEGIN SELECT crash(); END`); err != nil {
+		t.Fatal(err)
+	}
+	switch os.Getenv(crashDBEnv + "_OP") {
+	case "save":
+		store.SaveReceipt(ctx, "b", market, marketBreakdown)
+	case "update":
+		store.UpdateReceipt(ctx, "a", 0, market, marketBreakdown)
+	}
+	t.Fatal("the write did not crash")
+}
+
+func TestSQLiteCrashMidWrite(t *testing.T) {
+	if os.Getenv(crashDBEnv) != "" {
+		t.Skip("running as the crash helper")
+	}
+	for _, op := range []string{"save", "update"} {
+		t.Run(op, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "receipts.db")
+			cmd := exec.Command(os.Args[0], "-test.run=^TestSQLiteCrashHelper$")
+			cmd.Env = append(os.Environ(), crashDBEnv+"="+path, crashDBEnv+"_OP="+op)
+			out, err := cmd.CombinedOutput()
+			var exit *exec.ExitError
+			if !errors.As(err, &exit) || exit.ExitCode() != crashExitCode {
+				t.Fatalf("crash helper = %v, want exit code %d\n%s", err, crashExitCode, out)
+			}
+
+			// The write in progress is rolled back as the store is
+			// opened; the receipt saved before it is whole.
+			store := openTestSQLiteStore(t, path)
+			if got, want := snapshot(t, store), map[string]int{"a": 28}; !maps.Equal(got, want) {
+				t.Errorf("after a crash the store holds %v, want %v", got, want)
+			}
+			if receipt, err := store.GetReceipt(context.Background(), "a"); err != nil || receipt.Retailer != "Target" || len(receipt.Items) != 5 {
+				t.Errorf("GetReceipt(a) = %+v, %v, want the receipt as first saved", receipt, err)
+			}
+			checkSQLiteRows(t, store)
+		})
+	}
+}
+
+func TestSQLiteMigratesOlderRows(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "receipts.db")
+	ctx := context.Background()
+	store := openTestSQLiteStore(t, path)
+	target, targetBreakdown := scored(parseReceipt(t, targetReceipt))
+	for _, id := range []string{"a", "b", "c", "d"} {
+		if err := store.SaveReceipt(ctx, id, target, targetBreakdown); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Rows as older versions could leave them, put right by the migration
+	// that reconciles them.
+	reconcile := slices.IndexFunc(sqliteMigrations, func(m string) bool {
+		return strings.Contains(m, "DELETE FROM items WHERE receipt_id NOT IN")
+	})
+	for _, stmt := range []string{
+		`UPDATE receipts SET breakdown = '' WHERE id = 'a'`,
+		`UPDATE receipts SET breakdown = 'null' WHERE id = 'b'`,
+		`UPDATE receipts SET breakdown = json_set(breakdown, '$.total', 99) WHERE id = 'c'`,
+		`PRAGMA foreign_keys = OFF`,
+		`INSERT INTO items (receipt_id, position, short_description, price_cents) VALUES ('gone', 0, 'Gum', 100)`,
+		sqliteMigrations[reconcile],
+	} {
+		if _, err := store.db.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+
+	want := map[string]int{"a": 28, "b": 28, "c": 28, "d": 28}
+	if got := snapshot(t, store); !maps.Equal(got, want) {
+		t.Errorf("migrated store holds %v, want %v", got, want)
+	}
+	for id, rules := range map[string]int{"a": 0, "b": 0, "c": len(targetBreakdown.Rules), "d": len(targetBreakdown.Rules)} {
+		breakdown, err := store.GetBreakdown(ctx, id)
+		if err != nil || len(breakdown.Rules) != rules {
+			t.Errorf("GetBreakdown(%s) = %+v, %v, want %d rules", id, breakdown, err, rules)
+		}
+	}
+	checkSQLiteRows(t, store)
+}
@@ -0,0 +1,560 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+// storeKinds are the kinds of Store openStore opens.
+var storeKinds = []string{"memory", "file", "sqlite"}
+
+// openTestStore opens a store of kind at path, closing it when the test ends.
+func openTestStore(t testing.TB, kind, path string) Store {
+	t.Helper()
+	store, err := openStore(kind, path)
+	if err != nil {
+		t.Fatalf("opening %s store: %v", kind, err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// eachStore runs test as a subtest against a fresh store of each kind.
+func eachStore(t *testing.T, test func(t *testing.T, store Store)) {
+	for _, kind := range storeKinds {
+		t.Run(kind, func(t *testing.T) {
+			test(t, openTestStore(t, kind, filepath.Join(t.TempDir(), "receipts")))
+		})
+	}
+}
+
+// parseReceipt decodes a receipt written as JSON, such as targetReceipt.
+func parseReceipt(t testing.TB, data string) points.Receipt {
+	t.Helper()
+	var receipt points.Receipt
+	if err := json.Unmarshal([]byte(data), &receipt); err != nil {
+		t.Fatalf("decoding receipt: %v", err)
+	}
+	return receipt
+}
+
+// scored returns receipt with its breakdown under the default rules.
+func scored(receipt points.Receipt) (points.Receipt, points.Breakdown) {
+	return receipt, points.DefaultRulesConfig().Breakdown(receipt)
+}
+
+func TestStoreRoundTrip(t *testing.T) {
+	eachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		receipt, breakdown := scored(parseReceipt(t, targetReceipt))
+		if err := store.SaveReceipt(ctx, "a", receipt, breakdown); err != nil {
+			t.Fatal(err)
+		}
+
+		if got, err := store.GetPoints(ctx, "a"); err != nil || got != 28 {
+			t.Errorf("GetPoints = %d, %v, want 28", got, err)
+		}
+		if got, err := store.GetReceipt(ctx, "a"); err != nil || got.Retailer != "Target" || len(got.Items) != 5 {
+			t.Errorf("GetReceipt = %+v, %v, want the Target receipt", got, err)
+		}
+		if got, err := store.GetBreakdown(ctx, "a"); err != nil || got.Total != 28 || len(got.Rules) != len(breakdown.Rules) {
+			t.Errorf("GetBreakdown = %+v, %v, want %+v", got, err, breakdown)
+		}
+		if _, err := store.GetPoints(ctx, "b"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetPoints of a missing receipt: %v, want ErrNotFound", err)
+		}
+		if err := store.Delete(ctx, "a", 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.GetPoints(ctx, "a"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetPoints of a deleted receipt: %v, want ErrNotFound", err)
+		}
+		if ids, err := store.List(ctx); err != nil || len(ids) != 0 {
+			t.Errorf("List = %v, %v, want nothing", ids, err)
+		}
+	})
+}
+
+// TestStoreConcurrentUse saves, reads, lists and deletes receipts from many
+// goroutines at once. Run it with -race.
+func TestStoreConcurrentUse(t *testing.T) {
+	eachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		target, targetBreakdown := scored(parseReceipt(t, targetReceipt))
+		market, marketBreakdown := scored(parseReceipt(t, marketReceipt))
+
+		const workers, perWorker = 8, 20
+		var wg sync.WaitGroup
+		for w := range workers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range perWorker {
+					id := fmt.Sprintf("%d-%d", w, i)
+					if err := store.SaveReceipt(ctx, id, target, targetBreakdown); err != nil {
+						t.Errorf("SaveReceipt(%s): %v", id, err)
+						return
+					}
+					// A receipt is never seen without its points, nor
+					// with the points of what it replaced.
+					if got, err := store.GetPoints(ctx, id); err != nil || got != 28 {
+						t.Errorf("GetPoints(%s) = %d, %v, want 28", id, got, err)
+					}
+					if err := store.UpdateReceipt(ctx, id, 0, market, marketBreakdown); err != nil {
+						t.Errorf("UpdateReceipt(%s): %v", id, err)
+					}
+					receipt, err := store.GetReceipt(ctx, id)
+					if err != nil || receipt.Retailer != market.Retailer {
+						t.Errorf("GetReceipt(%s) = %q, %v, want %q", id, receipt.Retailer, err, market.Retailer)
+					}
+					if got, err := store.GetPoints(ctx, id); err != nil || got != 109 {
+						t.Errorf("GetPoints(%s) = %d, %v, want 109", id, got, err)
+					}
+					if _, err := store.List(ctx); err != nil {
+						t.Errorf("List: %v", err)
+					}
+					if i%2 == 1 {
+						if err := store.Delete(ctx, id, 0); err != nil {
+							t.Errorf("Delete(%s): %v", id, err)
+						}
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		ids, err := store.List(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want []string
+		for w := range workers {
+			for i := 0; i < perWorker; i += 2 {
+				want = append(want, fmt.Sprintf("%d-%d", w, i))
+			}
+		}
+		slices.Sort(ids)
+		slices.Sort(want)
+		if !slices.Equal(ids, want) {
+			t.Errorf("List = %d IDs, want the %d not deleted", len(ids), len(want))
+		}
+		for _, id := range want {
+			if got, err := store.GetPoints(ctx, id); err != nil || got != 109 {
+				t.Errorf("GetPoints(%s) = %d, %v, want 109", id, got, err)
+			}
+		}
+	})
+}
+
+// TestStoreConcurrentUpdates rescores one receipt from many goroutines while
+// others read it, checking that every read sees the points of one of the
+// breakdowns written. Run it with -race.
+func TestStoreConcurrentUpdates(t *testing.T) {
+	eachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		receipt, breakdown := scored(parseReceipt(t, targetReceipt))
+		if err := store.SaveReceipt(ctx, "a", receipt, breakdown); err != nil {
+			t.Fatal(err)
+		}
+
+		const writers, writes = 4, 25
+		var wg sync.WaitGroup
+		for w := range writers {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				for i := range writes {
+					rescored := breakdown
+					rescored.Total = 1000 + w*writes + i
+					if err := store.UpdateBreakdown(ctx, "a", rescored); err != nil {
+						t.Errorf("UpdateBreakdown: %v", err)
+					}
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				for range writes {
+					got, err := store.GetPoints(ctx, "a")
+					if err != nil || (got != 28 && (got < 1000 || got >= 1000+writers*writes)) {
+						t.Errorf("GetPoints = %d, %v, want 28 or a rescored total", got, err)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		revision, err := store.GetRevision(ctx, "a")
+		if err != nil || revision != 1+writers*writes {
+			t.Errorf("GetRevision = %d, %v, want %d", revision, err, 1+writers*writes)
+		}
+	})
+}
+
+// TestStoreConditionalUpdateRace has many goroutines update one receipt at
+// the revision they all read, checking that the store lets exactly one of
+// them through and refuses the rest. Run it with -race.
+func TestStoreConditionalUpdateRace(t *testing.T) {
+	eachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		target, targetBreakdown := scored(parseReceipt(t, targetReceipt))
+		market, marketBreakdown := scored(parseReceipt(t, marketReceipt))
+		if err := store.SaveReceipt(ctx, "a", target, targetBreakdown); err != nil {
+			t.Fatal(err)
+		}
+
+		const writers = 8
+		for round := range 10 {
+			revision, err := store.GetRevision(ctx, "a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			errs := make([]error, writers)
+			start := make(chan struct{})
+			var wg sync.WaitGroup
+			for w := range writers {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					<-start
+					errs[w] = store.UpdateReceipt(ctx, "a", revision, market, marketBreakdown)
+				}()
+			}
+			close(start)
+			wg.Wait()
+
+			wins := 0
+			for _, err := range errs {
+				switch {
+				case err == nil:
+					wins++
+				case !errors.Is(err, ErrRevisionMismatch):
+					t.Fatalf("round %d: UpdateReceipt = %v", round, err)
+				}
+			}
+			if wins != 1 {
+				t.Fatalf("round %d: %d of %d updates at revision %d won, want exactly one", round, wins, writers, revision)
+			}
+			if got, err := store.GetRevision(ctx, "a"); err != nil || got != revision+1 {
+				t.Errorf("round %d: GetRevision = %d, %v, want %d", round, got, err, revision+1)
+			}
+		}
+	})
+}
+
+// TestStoreKeepsPointsAcrossRestart processes receipts through the server,
+// closes the store, and checks that a server on the reopened store still
+// reports their points.
+func TestStoreKeepsPointsAcrossRestart(t *testing.T) {
+	for _, kind := range []string{"file", "sqlite"} {
+		t.Run(kind, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "receipts")
+			store, err := openStore(kind, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := newStoreServer(t, store).Handler()
+			want := map[string]int{
+				processReceipt(t, h, targetReceipt): 28,
+				processReceipt(t, h, marketReceipt): 109,
+			}
+			if err := store.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// Opening twice more checks the migrations and replay leave
+			// the data as it was when they have nothing to do.
+			for range 2 {
+				store, err := openStore(kind, path)
+				if err != nil {
+					t.Fatalf("reopening: %v", err)
+				}
+				h := newStoreServer(t, store).Handler()
+				for id, points := range want {
+					if got := receiptPoints(t, h, id); got != points {
+						t.Errorf("points of %s after restart = %d, want %d", id, got, points)
+					}
+				}
+				if err := store.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// TestSQLiteMigratesOldDatabase opens a database written before all the
+// migrations existed and checks its receipts are kept.
+func TestSQLiteMigratesOldDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "receipts.db")
+	db, err := sql.Open("sqlite", "file:"+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receipt, breakdown := scored(parseReceipt(t, targetReceipt))
+	raw, _ := json.Marshal(receipt)
+	rawBreakdown, _ := json.Marshal(breakdown)
+	for _, stmt := range []string{
+		`CREATE TABLE schema_migrations (version INTEGER NOT NULL)`,
+		sqliteMigrations[0],
+		`INSERT INTO schema_migrations (version) VALUES (1)`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = db.Exec(`INSERT INTO receipts (id, retailer, purchase_date, purchase_time, total_cents, points, breakdown, raw)
+		VALUES ('old', ?, ?, ?, 3535, ?, ?, ?)`,
+		receipt.Retailer, receipt.PurchaseDate, receipt.PurchaseTime, breakdown.Total, rawBreakdown, raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	store := openTestStore(t, "sqlite", path)
+	ctx := context.Background()
+	if got, err := store.GetPoints(ctx, "old"); err != nil || got != 28 {
+		t.Errorf("GetPoints = %d, %v, want 28", got, err)
+	}
+	if revision, err := store.GetRevision(ctx, "old"); err != nil || revision != 1 {
+		t.Errorf("GetRevision = %d, %v, want 1", revision, err)
+	}
+	if ids, err := store.List(ctx); err != nil || !slices.Equal(ids, []string{"old"}) {
+		t.Errorf("List = %v, %v, want [old]", ids, err)
+	}
+	var version int
+	if err := store.(*sqliteStore).db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version); err != nil || version != len(sqliteMigrations) {
+		t.Errorf("schema version = %d, %v, want %d", version, err, len(sqliteMigrations))
+	}
+}
+
+// eachStoreBench runs bench as a sub-benchmark against a fresh store of each
+// kind, so that their throughput can be compared.
+func eachStoreBench(b *testing.B, bench func(b *testing.B, store Store)) {
+	for _, kind := range storeKinds {
+		b.Run(kind, func(b *testing.B) {
+			bench(b, openTestStore(b, kind, filepath.Join(b.TempDir(), "receipts")))
+		})
+	}
+}
+
+// BenchmarkProcessParallel scores and saves receipts from many goroutines.
+func BenchmarkProcessParallel(b *testing.B) {
+	receipt := parseReceipt(b, targetReceipt)
+	config := points.DefaultRulesConfig()
+	eachStoreBench(b, func(b *testing.B, store Store) {
+		ctx := context.Background()
+		var next atomic.Int64
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				id := strconv.FormatInt(next.Add(1), 10)
+				if err := store.SaveReceipt(ctx, id, receipt, config.Breakdown(receipt)); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+}
+
+// BenchmarkGetPointsParallel reads the points of stored receipts from many
+// goroutines, the load GET /receipts/{id}/points puts on a store.
+func BenchmarkGetPointsParallel(b *testing.B) {
+	receipt, breakdown := scored(parseReceipt(b, targetReceipt))
+	eachStoreBench(b, func(b *testing.B, store Store) {
+		ctx := context.Background()
+		const stored = 1000
+		for i := range stored {
+			if err := store.SaveReceipt(ctx, strconv.Itoa(i), receipt, breakdown); err != nil {
+				b.Fatal(err)
+			}
+		}
+		var next atomic.Int64
+		b.ReportAllocs()
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				id := strconv.FormatInt(next.Add(1)%stored, 10)
+				if _, err := store.GetPoints(ctx, id); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+}
+
+type cancelKey struct{}
+
+// cancelingStore is a Store that cancels the request it is saving for,
+// through the cancel function the request's context carries under
+// cancelKey, just before the save starts.
+type cancelingStore struct {
+	Store
+}
+
+func (s cancelingStore) SaveReceipt(ctx context.Context, id string, receipt points.Receipt, breakdown points.Breakdown) error {
+	if cancel, ok := ctx.Value(cancelKey{}).(context.CancelFunc); ok {
+		cancel()
+	}
+	return s.Store.SaveReceipt(ctx, id, receipt, breakdown)
+}
+
+// snapshot returns the points of each receipt store holds, by ID, checking
+// that each has its receipt and a breakdown of those points as well.
+func snapshot(t *testing.T, store Store) map[string]int {
+	t.Helper()
+	ctx := context.Background()
+	receipts := make(map[string]int)
+	err := store.Scan(ctx, 0, func(stored StoredReceipt) bool {
+		receipts[stored.ID] = stored.Points
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range receipts {
+		receipt, err := store.GetReceipt(ctx, id)
+		if err != nil || len(receipt.Items) == 0 {
+			t.Errorf("receipt %s has points but GetReceipt = %+v, %v", id, receipt, err)
+		}
+		if got, err := store.GetPoints(ctx, id); err != nil || got != want {
+			t.Errorf("GetPoints(%s) = %d, %v, want %d", id, got, err, want)
+		}
+		if breakdown, err := store.GetBreakdown(ctx, id); err != nil || breakdown.Total != want {
+			t.Errorf("GetBreakdown(%s) totals %d, %v, want %d", id, breakdown.Total, err, want)
+		}
+	}
+	return receipts
+}
+
+// TestCanceledRequestsLeaveStoreConsistent cancels requests before they
+// are served, as they are being saved and at whatever point a racing
+// goroutine gets to, and checks that what the store holds in memory is what
+// it reads back from disk, with no receipt stored without its points or the
+// other way round.
+func TestCanceledRequestsLeaveStoreConsistent(t *testing.T) {
+	for _, kind := range []string{"file", "sqlite"} {
+		t.Run(kind, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "receipts")
+			store, err := openStore(kind, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := newStoreServer(t, cancelingStore{store}).Handler()
+
+			const n = 200
+			created := make([]string, n)
+			var wg sync.WaitGroup
+			for i := range n {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					ctx, cancel := context.WithCancel(context.Background())
+					defer cancel()
+					switch i % 3 {
+					case 0:
+						ctx = context.WithValue(ctx, cancelKey{}, cancel)
+					case 1:
+						cancel()
+					case 2:
+						go cancel()
+					}
+					req := httptest.NewRequest(http.MethodPost, "/receipts/process", strings.NewReader(targetReceipt)).WithContext(ctx)
+					req.Header.Set("Content-Type", "application/json")
+					rec := httptest.NewRecorder()
+					h.ServeHTTP(rec, req)
+					if rec.Code >= 200 && rec.Code < 300 {
+						if i%3 != 2 {
+							t.Errorf("request canceled before its save = %d %s", rec.Code, rec.Body)
+						}
+						var body struct{ ID string }
+						json.Unmarshal(rec.Body.Bytes(), &body)
+						created[i] = body.ID
+					}
+				}()
+			}
+			wg.Wait()
+
+			inMemory := snapshot(t, store)
+			for _, id := range created {
+				if _, ok := inMemory[id]; id != "" && !ok {
+					t.Errorf("receipt %s was reported stored but is not", id)
+				}
+			}
+			if err := store.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			reopened := openTestStore(t, kind, path)
+			onDisk := snapshot(t, reopened)
+			if !maps.Equal(inMemory, onDisk) {
+				t.Errorf("store held %d receipts before restarting and %d after\nbefore: %v\nafter: %v", len(inMemory), len(onDisk), inMemory, onDisk)
+			}
+		})
+	}
+}
+
+// TestMemoryStoreEviction checks that receipts are evicted past the store's
+// limits, and that onEvict is told of them once the store is unlocked, so
+// that it may be slow or read the store itself.
+func TestMemoryStoreEviction(t *testing.T) {
+	store := newMemoryStore()
+	clock := time.Date(2026, time.March, 1, 12, 0, 0, 0, time.UTC)
+	store.now = func() time.Time { return clock }
+	store.maxReceipts, store.ttl = 2, time.Hour
+	var evicted []string
+	store.onEvict = func(id, reason string) {
+		if !store.mu.TryLock() {
+			t.Errorf("onEvict(%s, %s) was called with the store locked", id, reason)
+			return
+		}
+		store.mu.Unlock()
+		if _, err := store.GetPoints(context.Background(), id); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetPoints of evicted receipt %s = %v, want ErrNotFound", id, err)
+		}
+		evicted = append(evicted, id+" "+reason)
+	}
+	ctx := context.Background()
+	receipt, breakdown := scored(parseReceipt(t, targetReceipt))
+	for _, id := range []string{"a", "b", "c"} {
+		if err := store.SaveReceipt(ctx, id, receipt, breakdown); err != nil {
+			t.Fatal(err)
+		}
+		clock = clock.Add(time.Minute)
+	}
+	if want := []string{"a capacity"}; !slices.Equal(evicted, want) {
+		t.Fatalf("evicted %q after storing 3 receipts, want %q", evicted, want)
+	}
+
+	// An expired receipt is evicted by the next write that looks it up, or
+	// by a sweep.
+	clock = clock.Add(time.Hour - 2*time.Minute)
+	if err := store.UpdateBreakdown(ctx, "b", breakdown); !errors.Is(err, ErrNotFound) {
+		t.Errorf("UpdateBreakdown of an expired receipt = %v, want ErrNotFound", err)
+	}
+	clock = clock.Add(time.Minute)
+	store.sweep(clock)
+	if want := []string{"a capacity", "b expired", "c expired"}; !slices.Equal(evicted, want) {
+		t.Errorf("evicted %q, want %q", evicted, want)
+	}
+	if len(store.evicted) != 0 {
+		t.Errorf("store still holds evictions %v", store.evicted)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+// Receipt stream tuning. Each subscriber can fall streamBufferSize events
+// behind before events are dropped for it, and idle streams get a comment
+// every streamHeartbeat so that proxies keep them open.
+const (
+	streamBufferSize = 64
+	streamHeartbeat  = 15 * time.Second
+)
+
+// streamEvent is the data of a "receipt" event on GET /receipts/stream.
+type streamEvent struct {
+	ID       string       `json:"id"`
+	Retailer string       `json:"retailer"`
+	Total    points.Money `json:"total"`
+	Points   int          `json:"points"`
+
+	tenant string
+}
+
+// receiptStream fans processed receipts out to the subscribers of GET
+// /receipts/stream. Publishing never blocks: a subscriber whose buffer is
+// full misses the event and is told how many it missed instead.
+type receiptStream struct {
+	mu          sync.Mutex
+	subscribers map[*streamSubscriber]struct{}
+	done        chan struct{} // closed when the stream is shut down
+	closed      bool
+}
+
+type streamSubscriber struct {
+	// ctx scopes the events the subscriber sees, as it does store calls.
+	ctx     context.Context
+	events  chan streamEvent
+	dropped atomic.Int64 // events missed since the last lagged event
+}
+
+func newReceiptStream() *receiptStream {
+	return &receiptStream{subscribers: make(map[*streamSubscriber]struct{}), done: make(chan struct{})}
+}
+
+// subscribe registers a subscriber acting for the tenant of ctx, reporting
+// false if the stream has been shut down.
+func (b *receiptStream) subscribe(ctx context.Context) (*streamSubscriber, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, false
+	}
+	sub := &streamSubscriber{ctx: ctx, events: make(chan streamEvent, streamBufferSize)}
+	b.subscribers[sub] = struct{}{}
+	return sub, true
+}
+
+func (b *receiptStream) unsubscribe(sub *streamSubscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subscribers, sub)
+}
+
+// publish offers event to every subscriber allowed to see it.
+func (b *receiptStream) publish(event streamEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sub := range b.subscribers {
+		if !canSee(sub.ctx, event.tenant) {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
+
+// close ends every subscription and refuses new ones.
+func (b *receiptStream) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.closed {
+		b.closed = true
+		close(b.done)
+	}
+}
+
+// streamReceiptsHandler handles GET /receipts/stream, sending a Server-Sent
+// Event for each receipt processed while the client stays connected.
+func (s *Server) streamReceiptsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodHead {
+		// There is no end of the body to wait for.
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-store")
+		return
+	}
+	sub, ok := s.stream.subscribe(r.Context())
+	if !ok {
+		writeError(w, http.StatusServiceUnavailable, codeShuttingDown, "The server is shutting down.")
+		return
+	}
+	defer s.stream.unsubscribe(sub)
+
+	rc := http.NewResponseController(w)
+	// The stream lasts as long as the client wants, so the server's write
+	// timeout must not cut it off.
+	rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.stream.done:
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		case event := <-sub.events:
+			if dropped := sub.dropped.Swap(0); dropped > 0 {
+				writeStreamEvent(w, "lagged", struct {
+					Dropped int64 `json:"dropped"`
+				}{dropped})
+			}
+			writeStreamEvent(w, "receipt", event)
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func writeStreamEvent(w http.ResponseWriter, name string, data any) {
+	// JSON never contains a raw newline, so it fits on one data line.
+	line, _ := json.Marshal(data)
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, line)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// subscribeStream opens GET /receipts/stream on srv, closing it when ctx is
+// done, and returns a reader of its body once the stream is connected.
+func subscribeStream(t *testing.T, ctx context.Context, srv *httptest.Server) *bufio.Reader {
+	t.Helper()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/receipts/stream", nil)
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("GET /receipts/stream = %d %s, want 200 text/event-stream", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	r := bufio.NewReader(resp.Body)
+	if line, err := r.ReadString('\n'); err != nil || line != ": connected\n" {
+		t.Fatalf("first line of the stream = %q, %v, want the connected comment", line, err)
+	}
+	return r
+}
+
+// readStreamEvent reads the next event from r, skipping comments, and
+// returns its name and data.
+func readStreamEvent(t *testing.T, r *bufio.Reader) (name, data string) {
+	t.Helper()
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading the stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && name != "":
+			return name, data
+		case strings.HasPrefix(line, "event: "):
+			name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+// subscriberCount returns how many subscribers stream has.
+func subscriberCount(stream *receiptStream) int {
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	return len(stream.subscribers)
+}
+
+// waitFor polls cond until it holds, failing the test after a second.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestReceiptStream(t *testing.T) {
+	s := newTestServer(t)
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(srv.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := subscribeStream(t, ctx, srv)
+
+	h := s.Handler()
+	ids := []string{processReceipt(t, h, targetReceipt), processReceipt(t, h, marketReceipt)}
+	want := []streamEvent{
+		{ID: ids[0], Retailer: "Target", Total: "35.35", Points: 28},
+		{ID: ids[1], Retailer: "M&M Corner Market", Total: "9.00", Points: 109},
+	}
+	for _, w := range want {
+		name, data := readStreamEvent(t, r)
+		var got streamEvent
+		if err := json.Unmarshal([]byte(data), &got); err != nil || name != "receipt" || got != w {
+			t.Errorf("event %s %s, want receipt %+v", name, data, w)
+		}
+	}
+
+	// Disconnecting unsubscribes.
+	cancel()
+	waitFor(t, "the subscriber to be removed", func() bool { return subscriberCount(s.stream) == 0 })
+}
+
+func TestReceiptStreamShutdown(t *testing.T) {
+	s := newTestServer(t)
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(srv.Close)
+
+	r := subscribeStream(t, context.Background(), srv)
+	s.stream.close()
+	if _, err := io.ReadAll(r); err != nil {
+		t.Errorf("reading the stream after shutting it down: %v", err)
+	}
+	waitFor(t, "the subscriber to be removed", func() bool { return subscriberCount(s.stream) == 0 })
+
+	rec := send(s.Handler(), http.MethodGet, "/receipts/stream", "")
+	if rec.Code != http.StatusServiceUnavailable || errorCode(t, rec) != codeShuttingDown {
+		t.Errorf("GET /receipts/stream after shutdown = %d %s, want 503", rec.Code, rec.Body)
+	}
+}
+
+func TestReceiptStreamDropsForSlowSubscribers(t *testing.T) {
+	stream := newReceiptStream()
+	slow, _ := stream.subscribe(context.Background())
+
+	// Publishing does not wait for a subscriber that is not reading.
+	const extra = 5
+	done := make(chan struct{})
+	go func() {
+		for i := range streamBufferSize + extra {
+			stream.publish(streamEvent{Points: i})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("publish blocked on a full subscriber")
+	}
+	if got := slow.dropped.Load(); got != extra {
+		t.Errorf("dropped %d events, want %d", got, extra)
+	}
+	if got := len(slow.events); got != streamBufferSize {
+		t.Errorf("buffered %d events, want %d", got, streamBufferSize)
+	}
+}
+
+// pipeResponse is a ResponseWriter whose writes block until the body is
+// read from the other end of the pipe, as a stalled client's would.
+type pipeResponse struct {
+	header http.Header
+	body   *io.PipeWriter
+}
+
+func (p *pipeResponse) Header() http.Header         { return p.header }
+func (p *pipeResponse) Write(b []byte) (int, error) { return p.body.Write(b) }
+func (p *pipeResponse) WriteHeader(int)             {}
+func (p *pipeResponse) Flush()                      {}
+
+func TestReceiptStreamReportsLag(t *testing.T) {
+	s := newTestServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pr, pw := io.Pipe()
+	go func() {
+		req := httptest.NewRequest(http.MethodGet, "/receipts/stream", nil).WithContext(ctx)
+		s.streamReceiptsHandler(&pipeResponse{header: http.Header{}, body: pw}, req)
+		pw.Close()
+	}()
+	r := bufio.NewReader(pr)
+	if line, err := r.ReadString('\n'); err != nil || line != ": connected\n" {
+		t.Fatalf("first line of the stream = %q, %v, want the connected comment", line, err)
+	}
+
+	// Nothing more is read until every event is published, so the handler
+	// stalls writing the first and the rest overflow its buffer.
+	const n = streamBufferSize + 3
+	for i := range n {
+		s.stream.publish(streamEvent{Points: i})
+	}
+	var received, dropped, lagged int
+	for received+dropped < n {
+		name, data := readStreamEvent(t, r)
+		switch name {
+		case "receipt":
+			received++
+		case "lagged":
+			var body struct{ Dropped int }
+			json.Unmarshal([]byte(data), &body)
+			dropped += body.Dropped
+			lagged++
+		default:
+			t.Fatalf("unexpected event %s %s", name, data)
+		}
+	}
+	if lagged != 1 || dropped == 0 || received+dropped != n {
+		t.Errorf("received %d events and %d lagged events dropping %d, want all %d accounted for by one lagged event", received, lagged, dropped, n)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import "context"
+
+// Tenants partition the store when -isolate-tenants is set: each API key is
+// a tenant, owning the receipts submitted with it. Requests carrying no key
+// act for the anonymous tenant "", which owns receipts stored before
+// isolation was turned on.
+//
+// The tenant travels in the context of every store call. A call made with
+// a tenant stores receipts owned by it and finds no receipts owned by any
+// other; a call made without one, as by the admin endpoints and background
+// work, sees every receipt.
+
+type tenantKey struct{}
+
+// withTenant returns a copy of ctx whose store calls act for tenant.
+func withTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// tenantFrom returns the tenant ctx acts for, reporting false if it is not
+// scoped to one.
+func tenantFrom(ctx context.Context) (string, bool) {
+	tenant, ok := ctx.Value(tenantKey{}).(string)
+	return tenant, ok
+}
+
+// ownerFrom returns the tenant that receipts stored with ctx are owned by.
+func ownerFrom(ctx context.Context) string {
+	tenant, _ := tenantFrom(ctx)
+	return tenant
+}
+
+// canSee reports whether a call made with ctx may see a receipt owned by
+// owner.
+func canSee(ctx context.Context, owner string) bool {
+	tenant, scoped := tenantFrom(ctx)
+	return !scoped || tenant == owner
+}
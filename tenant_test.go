@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// withTenants isolates the tenants "a" and "b", whose keys are "key-a" and
+// "key-b".
+func withTenants(t testing.TB, s *Server) {
+	keys, err := loadAPIKeys("a:key-a,b:key-b", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.apiKeys = keys
+	s.features = newFeatureSwitch(features{IsolateTenants: true}, nil)
+}
+
+// processAs processes receipt with the API key key, returning its ID.
+func processAs(t *testing.T, h http.Handler, key, receipt string) string {
+	t.Helper()
+	rec := send(h, http.MethodPost, "/receipts/process", receipt, "X-Api-Key", key)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST /receipts/process with %s = %d %s, want 201", key, rec.Code, rec.Body)
+	}
+	var body struct{ ID string }
+	decodeBody(t, rec, &body)
+	return body.ID
+}
+
+// checkIsolation checks that the receipts a and b own, by ID, are seen by
+// their owner alone, on every endpoint reading receipts.
+func checkIsolation(t *testing.T, h http.Handler, a, b string) {
+	t.Helper()
+	for _, route := range []string{"/receipts/%s", "/receipts/%s/points", "/receipts/%s/breakdown"} {
+		for _, tt := range []struct{ key, id, other string }{{"key-a", a, b}, {"key-b", b, a}} {
+			if rec := send(h, http.MethodGet, strings.Replace(route, "%s", tt.id, 1), "", "X-Api-Key", tt.key); rec.Code != http.StatusOK {
+				t.Errorf("GET %s of its own receipt with %s = %d, want 200", route, tt.key, rec.Code)
+			}
+			rec := send(h, http.MethodGet, strings.Replace(route, "%s", tt.other, 1), "", "X-Api-Key", tt.key)
+			if rec.Code != http.StatusNotFound || errorCode(t, rec) != codeReceiptNotFound {
+				t.Errorf("GET %s of another tenant's receipt with %s = %d %s, want 404", route, tt.key, rec.Code, rec.Body)
+			}
+		}
+		// Without a key a request acts for the anonymous tenant, which
+		// owns neither.
+		if rec := send(h, http.MethodGet, strings.Replace(route, "%s", a, 1), ""); rec.Code != http.StatusNotFound {
+			t.Errorf("GET %s without a key = %d, want 404", route, rec.Code)
+		}
+	}
+
+	for _, target := range []string{"/receipts", "/receipts/export.csv"} {
+		for _, tt := range []struct{ key, id, other string }{{"key-a", a, b}, {"key-b", b, a}} {
+			body := send(h, http.MethodGet, target, "", "X-Api-Key", tt.key).Body.String()
+			if !strings.Contains(body, tt.id) || strings.Contains(body, tt.other) {
+				t.Errorf("GET %s with %s = %s, want its own receipt alone", target, tt.key, body)
+			}
+		}
+	}
+	for _, tt := range []struct{ key, item, other string }{{"key-a", "gatorade", b}, {"key-b", "pizza", a}} {
+		if body := send(h, http.MethodGet, "/receipts/search?item="+tt.item, "", "X-Api-Key", tt.key).Body.String(); strings.Contains(body, tt.other) {
+			t.Errorf("searching for %s with %s finds another tenant's receipt: %s", tt.item, tt.key, body)
+		}
+	}
+	if body := send(h, http.MethodGet, "/retailers/points", "", "X-Api-Key", "key-a").Body.String(); strings.Contains(body, "M&M") {
+		t.Errorf("leaderboard of a counts b's retailer: %s", body)
+	}
+
+	// Writes are scoped as well.
+	rec := send(h, http.MethodDelete, "/receipts/"+b, "", "X-Api-Key", "key-a")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("DELETE of another tenant's receipt = %d, want 404", rec.Code)
+	}
+	rec = send(h, http.MethodPut, "/receipts/"+b, targetReceipt, "X-Api-Key", "key-a")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("PUT of another tenant's receipt = %d, want 404", rec.Code)
+	}
+	if rec := send(h, http.MethodGet, "/receipts/"+b+"/points", "", "X-Api-Key", "key-b"); rec.Code != http.StatusOK {
+		t.Errorf("b's receipt after a's writes = %d, want it untouched", rec.Code)
+	}
+
+	// The admin endpoints see every tenant.
+	rec = sendAdmin(h, http.MethodGet, "/admin/stats", "")
+	if !strings.Contains(rec.Body.String(), `"receipts":2`) {
+		t.Errorf("admin stats %s, want both tenants' receipts", rec.Body)
+	}
+	rec = sendAdmin(h, http.MethodGet, "/admin/export", "")
+	if !strings.Contains(rec.Body.String(), a) || !strings.Contains(rec.Body.String(), b) {
+		t.Errorf("admin export lacks a tenant's receipt: %s", rec.Body)
+	}
+}
+
+func TestTenantIsolation(t *testing.T) {
+	eachStore(t, func(t *testing.T, store Store) {
+		h := newStoreServer(t, store, withAdmin, withTenants).Handler()
+		a := processAs(t, h, "key-a", targetReceipt)
+		b := processAs(t, h, "key-b", marketReceipt)
+		checkIsolation(t, h, a, b)
+	})
+}
+
+func TestTenantIsolationAcrossRestart(t *testing.T) {
+	for _, kind := range []string{"file", "sqlite"} {
+		t.Run(kind, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "receipts")
+			store, err := openStore(kind, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := newStoreServer(t, store, withAdmin, withTenants).Handler()
+			a := processAs(t, h, "key-a", targetReceipt)
+			b := processAs(t, h, "key-b", marketReceipt)
+			store.Close()
+
+			checkIsolation(t, newStoreServer(t, openTestStore(t, kind, path), withAdmin, withTenants).Handler(), a, b)
+		})
+	}
+}
+
+func TestTenantsDoNotShareDuplicates(t *testing.T) {
+	s := newTestServer(t, withAdmin, withTenants)
+	dedup, err := newDedupIndex(s.store, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.dedup = dedup
+	h := s.Handler()
+
+	a := processAs(t, h, "key-a", targetReceipt)
+	// The same receipt from another tenant is theirs, not a duplicate of
+	// a receipt they cannot see.
+	rec := send(h, http.MethodPost, "/receipts/process", targetReceipt, "X-Api-Key", "key-b")
+	if rec.Code != http.StatusCreated || strings.Contains(rec.Body.String(), a) {
+		t.Errorf("the same receipt from b = %d %s, want 201 with an ID of its own", rec.Code, rec.Body)
+	}
+	rec = send(h, http.MethodPost, "/receipts/process", targetReceipt, "X-Api-Key", "key-a")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), a) {
+		t.Errorf("the same receipt from a again = %d %s, want 200 with %s", rec.Code, rec.Body, a)
+	}
+}
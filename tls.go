@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// setupTLS configures httpServer to serve HTTPS as cfg asks, and returns the
+// companion plain-HTTP server, if one is needed. That server redirects to
+// HTTPS and, with automatic certificates, answers the ACME HTTP-01
+// challenges that prove control of the hostnames.
+func setupTLS(cfg config, httpServer *http.Server) (*http.Server, error) {
+	var companion http.Handler
+	switch {
+	case cfg.TLSCert != "":
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading certificate: %w", err)
+		}
+		httpServer.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+		companion = redirectToHTTPS(cfg.Addr)
+	case cfg.AutocertHosts != "":
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(splitList(cfg.AutocertHosts)...),
+			Cache:      autocert.DirCache(cfg.AutocertCache),
+		}
+		httpServer.TLSConfig = manager.TLSConfig()
+		httpServer.TLSConfig.MinVersion = tls.VersionTLS12
+		companion = manager.HTTPHandler(redirectToHTTPS(cfg.Addr))
+	default:
+		return nil, nil
+	}
+
+	if cfg.HTTPAddr == "" {
+		return nil, nil
+	}
+	return &http.Server{
+		Addr:              cfg.HTTPAddr,
+		Handler:           companion,
+		ReadHeaderTimeout: cfg.ReadTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}, nil
+}
+
+// redirectToHTTPS redirects every request to the same URL on the HTTPS
+// listener at httpsAddr. 308 keeps the method and body of a redirected POST.
+func redirectToHTTPS(httpsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		if port != "" && port != "443" {
+			host += ":" + port
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// unknownBuild stands in for build details missing from the binary, as when
+// it was built without module or VCS information.
+const unknownBuild = "unknown"
+
+// buildInfo describes the running binary.
+type buildInfo struct {
+	Version    string `json:"version"`
+	Revision   string `json:"revision"`
+	CommitTime string `json:"commitTime"`
+	// Modified reports whether the working tree had uncommitted changes.
+	Modified  bool   `json:"modified"`
+	GoVersion string `json:"goVersion"`
+}
+
+// build is read once; it cannot change while the process runs.
+var build = readBuildInfo()
+
+func readBuildInfo() buildInfo {
+	info := buildInfo{Version: unknownBuild, Revision: unknownBuild, CommitTime: unknownBuild, GoVersion: runtime.Version()}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	if bi.Main.Version != "" {
+		info.Version = bi.Main.Version
+	}
+	for _, setting := range bi.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			info.Revision = setting.Value
+		case "vcs.time":
+			info.CommitTime = setting.Value
+		case "vcs.modified":
+			info.Modified = setting.Value == "true"
+		}
+	}
+	return info
+}
+
+// versionResponse is the body of the GET /version response.
+type versionResponse struct {
+	buildInfo
+	Rules struct {
+		Version string `json:"version"`
+		Hash    string `json:"hash"`
+	} `json:"rules"`
+	StartedAt     time.Time `json:"startedAt"`
+	UptimeSeconds float64   `json:"uptimeSeconds"`
+}
+
+// versionHandler handles GET /version, identifying the deployed build and
+// the ruleset it scores with.
+func (s *Server) versionHandler(w http.ResponseWriter, r *http.Request) {
+	response := versionResponse{
+		buildInfo:     build,
+		StartedAt:     s.started.UTC(),
+		UptimeSeconds: time.Since(s.started).Seconds(),
+	}
+	current := rules.get()
+	response.Rules.Version = current.Version
+	response.Rules.Hash = current.Hash()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(response)
+}
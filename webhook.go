@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/y1zhuo/receipt-processor-challenge/points"
+)
+
+// Webhook delivery tuning. A delivery is attempted up to
+// webhookMaxAttempts times, waiting webhookBackoff before the first retry
+// and twice as long before each one after.
+const (
+	webhookQueueSize   = 1000
+	webhookWorkers     = 4
+	webhookMaxAttempts = 5
+	webhookBackoff     = time.Second
+	webhookTimeout     = 10 * time.Second
+	// webhookSweepInterval is how often the outbox is checked for events
+	// that are pending but not queued, such as those that did not fit in
+	// the queue, and pruned of old delivered ones. Events younger than
+	// webhookSweepAge are left alone, as they may yet be queued by the
+	// request that stored them.
+	webhookSweepInterval = time.Minute
+	webhookSweepAge      = 30 * time.Second
+)
+
+// webhookSignatureHeader carries "sha256=" and the hex HMAC-SHA256 of the
+// request body, keyed with the webhook secret.
+const webhookSignatureHeader = "X-Webhook-Signature"
+
+// webhookEventIDHeader carries the ID of the event being delivered, the same
+// on every attempt, so that receivers can ignore an event delivered twice.
+const webhookEventIDHeader = "X-Webhook-Event-ID"
+
+// webhookEvent is the body POSTed to webhooks for each processed receipt.
+type webhookEvent struct {
+	ID           string       `json:"id"`
+	Tenant       string       `json:"tenant,omitempty"`
+	Retailer     string       `json:"retailer"`
+	PurchaseDate string       `json:"purchaseDate"`
+	Total        points.Money `json:"total"`
+	Points       int          `json:"points"`
+}
+
+// webhookNotifier delivers webhook events in the background, so a slow or
+// failing receiver never delays an API response.
+//
+// With an outbox, delivery is at least once: events are kept with their
+// receipts until delivered, and those still pending after a restart are
+// delivered then, even if they were before the process stopped. Without one,
+// events still queued when the process stops, or that do not fit in the
+// queue, are lost.
+type webhookNotifier struct {
+	urls   []string
+	secret []byte
+	client *http.Client
+	queue  chan webhookDelivery
+	// backoff is the wait before the first retry. onFailure, if set, is
+	// told of each delivery given up on.
+	backoff   time.Duration
+	onFailure func()
+	logger    *slog.Logger
+
+	// outbox is nil unless the store is persistent. Delivered events
+	// are pruned from it once retention has passed.
+	outbox    webhookOutbox
+	retention time.Duration
+
+	mu     sync.Mutex
+	queued map[string]bool // IDs of the events queued or being delivered
+}
+
+type webhookDelivery struct {
+	id       string
+	url      string
+	body     []byte
+	attempts int // made before this delivery, if it is from the outbox
+}
+
+func newWebhookNotifier(urls []string, secret string) *webhookNotifier {
+	return &webhookNotifier{
+		urls:      urls,
+		secret:    []byte(secret),
+		client:    &http.Client{Timeout: webhookTimeout},
+		queue:     make(chan webhookDelivery, webhookQueueSize),
+		backoff:   webhookBackoff,
+		logger:    slog.Default().With(slog.String("component", componentWebhook)),
+		retention: defaultWebhookRetention,
+		queued:    make(map[string]bool),
+	}
+}
+
+// parseWebhookURLs parses a comma-separated list of http or https URLs.
+func parseWebhookURLs(spec string) ([]string, error) {
+	var urls []string
+	for _, raw := range strings.Split(spec, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("%q is not an http or https URL", raw)
+		}
+		urls = append(urls, raw)
+	}
+	return urls, nil
+}
+
+// prepare returns the deliveries of event to every webhook, and ctx
+// carrying them for the outbox, if there is one, so that SaveReceipt keeps
+// them with the receipt. They are sent once it is stored. A nil
+// *webhookNotifier has nothing to deliver.
+func (n *webhookNotifier) prepare(ctx context.Context, event webhookEvent) (context.Context, []webhookDelivery) {
+	if n == nil {
+		return ctx, nil
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		n.logger.Error("failed to encode webhook event", slog.String("receipt_id", event.ID), slog.Any("error", err))
+		return ctx, nil
+	}
+	deliveries := make([]webhookDelivery, 0, len(n.urls))
+	for _, target := range n.urls {
+		id, err := generateUniqueID()
+		if err != nil {
+			n.logger.Error("failed to generate webhook event ID", slog.String("receipt_id", event.ID), slog.Any("error", err))
+			return ctx, nil
+		}
+		deliveries = append(deliveries, webhookDelivery{id: id, url: target, body: body})
+	}
+	if n.outbox != nil {
+		now := time.Now().UTC()
+		events := make([]outboxEvent, len(deliveries))
+		for i, d := range deliveries {
+			events[i] = outboxEvent{ID: d.id, URL: d.url, ReceiptID: event.ID, Body: d.body, Status: outboxPending, CreatedAt: now, UpdatedAt: now}
+		}
+		ctx = withOutbox(ctx, events)
+	}
+	return ctx, deliveries
+}
+
+// send queues deliveries returned by prepare, once their receipt is stored.
+func (n *webhookNotifier) send(deliveries []webhookDelivery) {
+	for _, delivery := range deliveries {
+		n.enqueue(delivery)
+	}
+}
+
+// enqueue queues delivery unless it already is. If the queue is full, an
+// event in the outbox is left pending there for the next sweep, and one
+// that is not is dropped rather than blocking the caller.
+func (n *webhookNotifier) enqueue(delivery webhookDelivery) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.queued[delivery.id] {
+		return
+	}
+	select {
+	case n.queue <- delivery:
+		n.queued[delivery.id] = true
+	default:
+		if n.outbox != nil {
+			n.logger.Warn("webhook queue is full; leaving event in the outbox",
+				slog.String("event_id", delivery.id), slog.String("url", delivery.url))
+			return
+		}
+		n.logger.Warn("webhook queue is full; dropping event",
+			slog.String("event_id", delivery.id), slog.String("url", delivery.url))
+		n.failed()
+	}
+}
+
+// run delivers queued events with webhookWorkers workers until ctx is
+// canceled. Events still queued then are not delivered, though those in the
+// outbox will be after a restart; those pending there from before this one
+// are queued now.
+func (n *webhookNotifier) run(ctx context.Context) {
+	for range webhookWorkers {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case delivery := <-n.queue:
+					n.deliver(ctx, delivery)
+					n.mu.Lock()
+					delete(n.queued, delivery.id)
+					n.mu.Unlock()
+				}
+			}
+		}()
+	}
+	if n.outbox != nil {
+		go n.sweep(ctx)
+	}
+}
+
+// sweep queues the events pending in the outbox, all of them at once and
+// then every webhookSweepInterval those older than webhookSweepAge, and
+// prunes delivered ones older than n.retention, until ctx is canceled.
+func (n *webhookNotifier) sweep(ctx context.Context) {
+	ticker := time.NewTicker(webhookSweepInterval)
+	defer ticker.Stop()
+	cutoff := time.Now()
+	for {
+		pending, err := n.outbox.list(ctx, outboxPending)
+		if err != nil && ctx.Err() == nil {
+			n.logger.Error("failed to read the webhook outbox", slog.Any("error", err))
+		}
+		for _, event := range pending {
+			if event.CreatedAt.Before(cutoff) {
+				n.enqueue(event.delivery())
+			}
+		}
+		if pruned, err := n.outbox.prune(ctx, time.Now().Add(-n.retention)); err != nil && ctx.Err() == nil {
+			n.logger.Error("failed to prune the webhook outbox", slog.Any("error", err))
+		} else if pruned > 0 {
+			n.logger.Info("pruned delivered webhook events", slog.Int("events", pruned))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			cutoff = now.Add(-webhookSweepAge)
+		}
+	}
+}
+
+// deliver POSTs delivery, retrying with exponential backoff while the
+// failure may be temporary, and records the outcome in the outbox. A
+// delivery cut short by ctx is left pending there.
+func (n *webhookNotifier) deliver(ctx context.Context, delivery webhookDelivery) {
+	wait := n.backoff
+	for attempt := 1; ; attempt++ {
+		retry, err := n.post(ctx, delivery)
+		if err == nil {
+			n.settle(ctx, delivery, outboxDelivered, attempt, nil)
+			return
+		}
+		if ctx.Err() != nil {
+			n.abandoned()
+			return
+		}
+		if !retry || attempt == webhookMaxAttempts {
+			n.logger.Error("webhook delivery failed", slog.String("event_id", delivery.id),
+				slog.String("url", delivery.url), slog.Int("attempts", attempt), slog.Any("error", err))
+			n.failed()
+			n.settle(ctx, delivery, outboxFailed, attempt, err)
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			n.abandoned()
+			return
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+// settle records in the outbox, if there is one, that delivery ended in
+// status after attempts more attempts.
+func (n *webhookNotifier) settle(ctx context.Context, delivery webhookDelivery, status string, attempts int, failure error) {
+	if n.outbox == nil {
+		return
+	}
+	event := outboxEvent{ID: delivery.id, Status: status, Attempts: delivery.attempts + attempts, UpdatedAt: time.Now().UTC()}
+	if failure != nil {
+		event.LastError = failure.Error()
+	}
+	// Recorded even as the server shuts down, or a delivered event would
+	// be delivered again after the restart.
+	if err := n.outbox.settle(context.WithoutCancel(ctx), event); err != nil {
+		n.logger.Error("failed to record webhook delivery", slog.String("event_id", delivery.id),
+			slog.String("status", status), slog.Any("error", err))
+	}
+}
+
+// post makes a single delivery attempt, reporting whether a failure is
+// worth retrying.
+func (n *webhookNotifier) post(ctx context.Context, delivery webhookDelivery) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.url, bytes.NewReader(delivery.body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookSignatureHeader, "sha256="+n.sign(delivery.body))
+	req.Header.Set(webhookEventIDHeader, delivery.id)
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("receiver responded %s", resp.Status)
+	default:
+		// The receiver rejected the event itself; sending it again
+		// will not help.
+		return false, fmt.Errorf("receiver responded %s", resp.Status)
+	}
+}
+
+// sign returns the hex HMAC-SHA256 of body.
+func (n *webhookNotifier) sign(body []byte) string {
+	mac := hmac.New(sha256.New, n.secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (n *webhookNotifier) failed() {
+	if n.onFailure != nil {
+		n.onFailure()
+	}
+}
+
+// abandoned records a delivery cut short by shutdown, which is lost unless
+// the outbox keeps it for after the restart.
+func (n *webhookNotifier) abandoned() {
+	if n.outbox == nil {
+		n.failed()
+	}
+}
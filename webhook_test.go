@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookDeliveryRecord is a request received by a webhookReceiver.
+type webhookDeliveryRecord struct {
+	body      []byte
+	signature string
+	eventID   string
+}
+
+// webhookReceiver is a webhook endpoint answering each delivery with the
+// next of its statuses, then 200.
+type webhookReceiver struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	statuses   []int
+	deliveries []webhookDeliveryRecord
+	received   chan struct{}
+}
+
+func newWebhookReceiver(t *testing.T, statuses ...int) *webhookReceiver {
+	rcv := &webhookReceiver{statuses: statuses, received: make(chan struct{}, 100)}
+	rcv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		rcv.mu.Lock()
+		rcv.deliveries = append(rcv.deliveries, webhookDeliveryRecord{body, r.Header.Get(webhookSignatureHeader), r.Header.Get(webhookEventIDHeader)})
+		status := http.StatusOK
+		if len(rcv.statuses) > 0 {
+			status, rcv.statuses = rcv.statuses[0], rcv.statuses[1:]
+		}
+		rcv.mu.Unlock()
+		w.WriteHeader(status)
+		rcv.received <- struct{}{}
+	}))
+	t.Cleanup(rcv.Close)
+	return rcv
+}
+
+// wait waits for n more deliveries.
+func (rcv *webhookReceiver) wait(t *testing.T, n int) {
+	t.Helper()
+	for range n {
+		select {
+		case <-rcv.received:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a webhook delivery")
+		}
+	}
+}
+
+func (rcv *webhookReceiver) recorded() []webhookDeliveryRecord {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	return append([]webhookDeliveryRecord(nil), rcv.deliveries...)
+}
+
+// withWebhooks delivers webhooks to urls, with a millisecond of backoff,
+// until the test ends.
+func withWebhooks(urls ...string) serverOption {
+	return func(t testing.TB, s *Server) {
+		s.webhooks = newWebhookNotifier(urls, "secret")
+		s.webhooks.backoff = time.Millisecond
+		s.webhooks.logger = s.logger
+		s.webhooks.onFailure = s.metrics.observeWebhookFailure
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		s.webhooks.run(ctx)
+	}
+}
+
+func TestWebhookPayloadAndSignature(t *testing.T) {
+	rcv := newWebhookReceiver(t)
+	h := newTestServer(t, withWebhooks(rcv.URL)).Handler()
+	id := processReceipt(t, h, targetReceipt)
+	rcv.wait(t, 1)
+
+	delivery := rcv.recorded()[0]
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(delivery.body)
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); delivery.signature != want {
+		t.Errorf("signature = %q, want %q", delivery.signature, want)
+	}
+	if delivery.eventID == "" {
+		t.Error("no event ID")
+	}
+	var event map[string]any
+	if err := json.Unmarshal(delivery.body, &event); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{"id": id, "retailer": "Target", "purchaseDate": "2022-01-01", "total": "35.35", "points": 28.0}
+	if len(event) != len(want) {
+		t.Errorf("event = %v, want %v", event, want)
+	}
+	for key, value := range want {
+		if event[key] != value {
+			t.Errorf("event %s = %v, want %v", key, event[key], value)
+		}
+	}
+}
+
+func TestWebhookToEveryURL(t *testing.T) {
+	a, b := newWebhookReceiver(t), newWebhookReceiver(t)
+	h := newTestServer(t, withWebhooks(a.URL, b.URL)).Handler()
+	processReceipt(t, h, marketReceipt)
+	a.wait(t, 1)
+	b.wait(t, 1)
+	if a.recorded()[0].eventID == b.recorded()[0].eventID {
+		t.Error("the deliveries to two URLs share an event ID")
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	rcv := newWebhookReceiver(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	s := newTestServer(t, withWebhooks(rcv.URL))
+	processReceipt(t, s.Handler(), targetReceipt)
+	rcv.wait(t, 3)
+
+	deliveries := rcv.recorded()
+	for _, d := range deliveries[1:] {
+		if d.eventID != deliveries[0].eventID || string(d.body) != string(deliveries[0].body) {
+			t.Errorf("retry %+v differs from the first attempt %+v", d, deliveries[0])
+		}
+	}
+	if got := webhookFailureCount(t, s); got != 0 {
+		t.Errorf("%d failures counted for a delivery that succeeded", got)
+	}
+}
+
+func TestWebhookGivesUp(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		attempts int
+	}{
+		{"server error", http.StatusInternalServerError, webhookMaxAttempts},
+		// The receiver refused the event, so it is not sent again.
+		{"rejected", http.StatusBadRequest, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			statuses := make([]int, webhookMaxAttempts+1)
+			for i := range statuses {
+				statuses[i] = tt.status
+			}
+			rcv := newWebhookReceiver(t, statuses...)
+			s := newTestServer(t, withWebhooks(rcv.URL))
+			processReceipt(t, s.Handler(), targetReceipt)
+			rcv.wait(t, tt.attempts)
+
+			deadline := time.Now().Add(5 * time.Second)
+			for webhookFailureCount(t, s) == 0 && time.Now().Before(deadline) {
+				time.Sleep(5 * time.Millisecond)
+			}
+			if got := webhookFailureCount(t, s); got != 1 {
+				t.Errorf("%d failures counted, want 1", got)
+			}
+			if got := len(rcv.recorded()); got != tt.attempts {
+				t.Errorf("%d attempts, want %d", got, tt.attempts)
+			}
+		})
+	}
+}
+
+// TestSlowWebhookDoesNotDelayResponses processes receipts while the receiver
+// holds every delivery open.
+func TestSlowWebhookDoesNotDelayResponses(t *testing.T) {
+	release := make(chan struct{})
+	rcv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer rcv.Close()
+	defer close(release)
+	h := newTestServer(t, withWebhooks(rcv.URL)).Handler()
+
+	start := time.Now()
+	for range 2 * webhookWorkers {
+		processReceipt(t, h, targetReceipt)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("processing took %s with a slow webhook", elapsed)
+	}
+}
+
+// webhookFailureCount returns the failed deliveries s's metrics count.
+func webhookFailureCount(t *testing.T, s *Server) int {
+	t.Helper()
+	rec := send(s.Handler(), http.MethodGet, "/metrics", "")
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if value, ok := strings.CutPrefix(line, "receipt_processor_webhook_failures_total "); ok {
+			var n int
+			json.Unmarshal([]byte(value), &n)
+			return n
+		}
+	}
+	t.Fatalf("no webhook failure count in the metrics:\n%s", rec.Body)
+	return 0
+}